@@ -0,0 +1,354 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	// CurrentArchiveVersion is the version of the archive format written by
+	// ArchiveTable.
+	CurrentArchiveVersion = 1
+)
+
+var (
+	archiveMagic = []byte("ZENOARCH")
+)
+
+// archiveManifest describes the table contained in an archive.
+type archiveManifest struct {
+	Name            string
+	SQL             string
+	Resolution      time.Duration
+	RetentionPeriod time.Duration
+	MinFlushLatency time.Duration
+	MaxFlushLatency time.Duration
+	Backfill        time.Duration
+	PartitionBy     []string
+	Fields          []string
+	FileVersion     int
+	// FileCodec is the ID of the FileCodec used to compress the data. Archives
+	// written before codecs were configurable always use snappy.
+	FileCodec byte
+	// KeyDictionary is the encoded keyDictionary with which keys in the data
+	// are encoded, starting with FileVersion_11. It lives in the footer, which
+	// isn't part of the archived data.
+	KeyDictionary []byte
+}
+
+// ArchiveTable writes a self-contained archive of the named table to w. See
+// table.Archive.
+func (db *DB) ArchiveTable(ctx context.Context, table string, w io.Writer) error {
+	t := db.getTable(table)
+	if t == nil {
+		return errors.New("Table %v not found", table)
+	}
+	return t.Archive(ctx, w)
+}
+
+// Archive writes a self-contained archive of this table to w. The archive
+// consists of a manifest describing the table's schema followed by the
+// contents of the table's file store. The memstore is flushed before archiving
+// so that the archive includes all data received up to that point.
+//
+// The archive is laid out as:
+//
+//	magic|archiveversion|manifestlength|manifest|datalength|data
+//
+// archiveversion and manifestlength are 32 bits, datalength is 64 bits and the
+// manifest is JSON.
+func (t *table) Archive(ctx context.Context, w io.Writer) error {
+	if t.rowStore == nil {
+		return errors.New("Table %v does not store data locally and can't be archived", t.Name)
+	}
+	if t.rowStore.opts.readOnly {
+		// Archiving compacts the table's files, which read only tables can't do
+		return errors.New("Table %v is read only and can't be archived", t.Name)
+	}
+
+	t.forceFlush()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	rs := t.rowStore
+	// The archive contains a single file store, so merge any deltas first
+	if _, err := rs.compact(true); err != nil {
+		return errors.New("Unable to compact file stores before archiving: %v", err)
+	}
+	rs.mx.Lock()
+	fs := rs.fileStore
+	rs.iterationsInProgress[fs.filename]++
+	rs.mx.Unlock()
+	defer func() {
+		rs.mx.Lock()
+		rs.iterationsInProgress[fs.filename]--
+		rs.mx.Unlock()
+	}()
+
+	manifest := &archiveManifest{
+		Name:            t.Name,
+		SQL:             t.TableOpts.SQL,
+		Resolution:      t.Resolution,
+		RetentionPeriod: t.RetentionPeriod,
+		MinFlushLatency: t.MinFlushLatency,
+		MaxFlushLatency: t.MaxFlushLatency,
+		Backfill:        t.Backfill,
+		PartitionBy:     t.PartitionBy,
+		FileVersion:     t.versionFor(fs.filename),
+		FileCodec:       FileCodecIDSnappy,
+	}
+	for _, field := range t.getFields() {
+		manifest.Fields = append(manifest.Fields, field.String())
+	}
+
+	var file *os.File
+	var err error
+	dataLength := int64(0)
+	if fs.filename != "" {
+		file, err = os.Open(fs.filename)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.New("Unable to open file store %v: %v", fs.filename, err)
+		}
+		if file != nil {
+			defer file.Close()
+			fi, statErr := file.Stat()
+			if statErr != nil {
+				return errors.New("Unable to stat file store %v: %v", fs.filename, statErr)
+			}
+			dataLength = fi.Size()
+			// The archive only contains the compressed data, so skip the file
+			// header (if any) and record its version and codec in the manifest
+			// instead.
+			_, header, headerErr := readFileHeader(file, fs.filename, manifest.FileVersion)
+			if headerErr != nil {
+				return headerErr
+			}
+			if _, seekErr := file.Seek(int64(header.length), io.SeekStart); seekErr != nil {
+				return errors.New("Unable to seek past header of file store %v: %v", fs.filename, seekErr)
+			}
+			manifest.FileVersion = header.version
+			manifest.FileCodec = header.codec.ID()
+			dataLength -= int64(header.length)
+			if header.footer != nil {
+				// Nor does it contain the footer, since the offsets in the key index
+				// only apply to the original file
+				dataLength = header.footer.dataEnd - int64(header.length)
+				if header.footer.dictionary != nil {
+					manifest.KeyDictionary = header.footer.dictionary.appendTo(nil)
+				}
+			}
+		}
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.New("Unable to encode archive manifest: %v", err)
+	}
+
+	if _, err := w.Write(archiveMagic); err != nil {
+		return errors.New("Unable to write archive header: %v", err)
+	}
+	if err := binary.Write(w, encoding.Binary, uint32(CurrentArchiveVersion)); err != nil {
+		return errors.New("Unable to write archive version: %v", err)
+	}
+	if err := binary.Write(w, encoding.Binary, uint32(len(manifestBytes))); err != nil {
+		return errors.New("Unable to write manifest length: %v", err)
+	}
+	if _, err := w.Write(manifestBytes); err != nil {
+		return errors.New("Unable to write manifest: %v", err)
+	}
+	if err := binary.Write(w, encoding.Binary, uint64(dataLength)); err != nil {
+		return errors.New("Unable to write data length: %v", err)
+	}
+	if file != nil {
+		n, err := io.CopyN(w, file, dataLength)
+		if err != nil {
+			return errors.New("Unable to write data after %d bytes: %v", n, err)
+		}
+	}
+
+	t.log.Debugf("Archived %d bytes of data from %v", dataLength, fs.filename)
+	return ctx.Err()
+}
+
+// ImportArchive recreates a table from an archive produced by ArchiveTable. The
+// table must not already exist in this database. Because the archived data came
+// from a different WAL, the imported table starts reading its stream from the
+// beginning of this database's WAL (subject to retention and backfill limits).
+func (db *DB) ImportArchive(ctx context.Context, r io.Reader) error {
+	if db.opts.ReadOnly {
+		return errors.New("Unable to import archive into read-only database")
+	}
+
+	magic := make([]byte, len(archiveMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return errors.New("Unable to read archive header: %v", err)
+	}
+	if !bytes.Equal(magic, archiveMagic) {
+		return errors.New("Not a zenodb archive")
+	}
+	var version, manifestLength uint32
+	if err := binary.Read(r, encoding.Binary, &version); err != nil {
+		return errors.New("Unable to read archive version: %v", err)
+	}
+	if version != CurrentArchiveVersion {
+		return errors.New("Unsupported archive version %d, expected %d", version, CurrentArchiveVersion)
+	}
+	if err := binary.Read(r, encoding.Binary, &manifestLength); err != nil {
+		return errors.New("Unable to read manifest length: %v", err)
+	}
+	manifestBytes := make([]byte, manifestLength)
+	if _, err := io.ReadFull(r, manifestBytes); err != nil {
+		return errors.New("Unable to read manifest: %v", err)
+	}
+	manifest := &archiveManifest{FileCodec: FileCodecIDSnappy}
+	if err := json.Unmarshal(manifestBytes, manifest); err != nil {
+		return errors.New("Unable to decode manifest: %v", err)
+	}
+	if manifest.FileVersion > CurrentFileVersion {
+		return errors.New("Archive contains data in file version %d, newer than supported version %d", manifest.FileVersion, CurrentFileVersion)
+	}
+	if _, found := fileCodecFor(manifest.FileCodec); !found {
+		return errors.New("Archive contains data compressed with unknown codec %d", manifest.FileCodec)
+	}
+	var dataLength uint64
+	if err := binary.Read(r, encoding.Binary, &dataLength); err != nil {
+		return errors.New("Unable to read data length: %v", err)
+	}
+
+	name := strings.ToLower(manifest.Name)
+	if db.getTable(name) != nil {
+		return errors.New("Table %v already exists", name)
+	}
+
+	dir := filepath.Join(db.opts.Dir, name)
+	existing, err := listRegularFiles(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Unable to list contents of %v: %v", dir, err)
+	}
+	if len(existing) > 0 {
+		return errors.New("Data directory %v for table %v is not empty", dir, name)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.New("Unable to create data directory %v: %v", dir, err)
+	}
+
+	if dataLength > 0 {
+		if err := db.materializeArchivedData(ctx, dir, manifest, io.LimitReader(r, int64(dataLength))); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.CreateTable(&TableOpts{
+		Name:            name,
+		SQL:             manifest.SQL,
+		RetentionPeriod: manifest.RetentionPeriod,
+		MinFlushLatency: manifest.MinFlushLatency,
+		MaxFlushLatency: manifest.MaxFlushLatency,
+		Backfill:        manifest.Backfill,
+		PartitionBy:     manifest.PartitionBy,
+	})
+}
+
+// materializeArchivedData writes the archived file store data into a new file
+// store in dir, replacing the WAL offsets in the header with empty offsets.
+func (db *DB) materializeArchivedData(ctx context.Context, dir string, manifest *archiveManifest, data io.Reader) error {
+	t := &table{db: db, log: db.log}
+	codec, _ := fileCodecFor(manifest.FileCodec)
+	in := codec.NewReader(data)
+	headerLength := uint32(0)
+	if err := binary.Read(in, encoding.Binary, &headerLength); err != nil {
+		return errors.New("Unable to read header length from archived data: %v", err)
+	}
+	header := make([]byte, headerLength)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return errors.New("Unable to read header from archived data: %v", err)
+	}
+	_, fieldsBytes := t.readOffsets(manifest.FileVersion, header)
+
+	// Create the temp file next to its destination so that moving it into place
+	// is a rename rather than a copy
+	out, err := ioutil.TempFile(dir, flushTempPrefix)
+	if err != nil {
+		return errors.New("Unable to create file store for archived data: %v", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	if err := writeFileHeader(out, manifest.FileVersion, codec); err != nil {
+		return errors.New("Unable to write file header: %v", err)
+	}
+	var sout io.WriteCloser
+	var iw *indexingWriter
+	if manifest.FileVersion >= FileVersion_9 {
+		// Rows may not be sorted, so don't index them, but do write the footer
+		// that's required in this version
+		iw = newIndexingWriter(out, codec, manifest.FileVersion, fileHeaderLength, 0, DefaultBloomFilterFalsePositiveRate)
+		iw.footer.resolution = manifest.Resolution
+		if manifest.FileVersion >= FileVersion_11 {
+			dictionary, _, err := readKeyDictionary(manifest.KeyDictionary, "archive")
+			if err != nil {
+				return err
+			}
+			iw.usePreEncodedKeys(dictionary)
+		}
+		sout = iw
+	} else {
+		sout = codec.NewWriter(out)
+	}
+	newHeaderLength := uint32(encoding.Width64bits + len(fieldsBytes))
+	if err := binary.Write(sout, encoding.Binary, newHeaderLength); err != nil {
+		return errors.New("Unable to write header length: %v", err)
+	}
+	if err := t.writeOffsets(sout, make(common.OffsetsBySource)); err != nil {
+		return errors.New("Unable to write header: %v", err)
+	}
+	if _, err := sout.Write(fieldsBytes); err != nil {
+		return errors.New("Unable to write header: %v", err)
+	}
+	if iw != nil {
+		iw.startRows()
+	}
+	n, err := io.Copy(sout, in)
+	if err != nil {
+		return errors.New("Unable to copy archived data after %d bytes: %v", n, err)
+	}
+	if err := sout.Close(); err != nil {
+		return errors.New("Unable to finish writing archived data: %v", err)
+	}
+	if err := out.Sync(); err != nil {
+		return errors.New("Unable to sync archived data: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return errors.New("Unable to close archived data: %v", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Keep the archived file version since the rest of the header and the rows
+	// are copied as is
+	finalName := filepath.Join(dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), manifest.FileVersion))
+	if err := db.renameFile(out.Name(), finalName, true); err != nil {
+		return errors.New("Unable to move archived data into place: %v", err)
+	}
+	db.log.Debugf("Imported %d bytes of archived data into %v", n, finalName)
+	return nil
+}
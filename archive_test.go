@@ -0,0 +1,78 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "archived", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	resolution := time.Second
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	_, err := db.InsertBatch("archived", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch.Add(-1 * resolution), Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 2}},
+		{TS: epoch, Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 3}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	archive := &bytes.Buffer{}
+	if !assert.NoError(t, db.ArchiveTable(context.Background(), "archived", archive)) {
+		return
+	}
+	archived := archive.Bytes()
+
+	db2, cleanup2 := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup2()
+	db2.clock.Advance(epoch)
+
+	assert.Error(t, db2.ImportArchive(context.Background(), bytes.NewReader([]byte("not an archive"))))
+	if !assert.NoError(t, db2.ImportArchive(context.Background(), bytes.NewReader(archived))) {
+		return
+	}
+	assert.Error(t, db2.ImportArchive(context.Background(), bytes.NewReader(archived)), "Importing an existing table should fail")
+
+	tbl := db2.getTable("archived")
+	if !assert.NotNil(t, tbl) {
+		return
+	}
+	assert.Equal(t, resolution, tbl.Resolution)
+	assert.Equal(t, 1*time.Hour, tbl.RetentionPeriod)
+
+	fields := tbl.getFields()
+	vIdx := -1
+	for i, field := range fields {
+		if field.Name == "v" {
+			vIdx = i
+		}
+	}
+	if !assert.True(t, vIdx >= 0, "Field v not found") {
+		return
+	}
+	ex := fields[vIdx].Expr
+
+	totals := make(map[string]float64)
+	_, err = tbl.iterate(context.Background(), fields, false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		seq := vals[vIdx]
+		for p := 0; p < seq.NumPeriods(ex.EncodedWidth()); p++ {
+			v, _ := seq.ValueAt(p, ex)
+			totals[key.Get("k").(string)] += v
+		}
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]float64{"a": 3, "b": 3}, totals)
+}
@@ -0,0 +1,349 @@
+package zenodb
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	batchLogDirName       = "batchlog"
+	batchLogSegmentPrefix = "segment_"
+
+	// maxBatchLogRecordLength guards against allocating huge buffers when
+	// reading a garbled length from a torn record.
+	maxBatchLogRecordLength = 256 * 1024 * 1024
+)
+
+// batchLog is a write-ahead log for the points that are inserted into a table
+// with InsertBatch or TryInsertBatch. Unlike points inserted into a stream,
+// these don't go through the stream's WAL, so without the batch log they would
+// be lost if the process died before they were flushed.
+//
+// The log is split into numbered segments. Whenever the memstore is flushed,
+// the log moves on to a new segment, so every segment only contains inserts
+// that were applied to memstores that have since been flushed (or that are
+// still being flushed). Once a flush succeeds, the segments up to the one that
+// was current when it started are removed. Anything left over when the row
+// store is opened again is replayed into the new memstore.
+//
+// Each record holds the inserts of one batch and consists of a 32 bit length,
+// the encoded inserts and a crc32c checksum of those. A torn record at the end
+// of a segment (e.g. from a crash in the middle of a write) is skipped when
+// replaying. A nil batchLog (e.g. for a read only row store) doesn't log
+// anything.
+type batchLog struct {
+	dir          string
+	syncInterval time.Duration
+	log          golog.Logger
+	// segments lists the segments on disk, in order
+	segments []int64
+	// current is the segment to which appends are written
+	current int64
+	// file is the open file of the current segment, nil until something is
+	// written to it
+	file     *os.File
+	unsynced bool
+	mx       sync.Mutex
+}
+
+// openBatchLog opens the batch log in dir. Appends go to a new segment after
+// any existing segments, which can be replayed with replay.
+func openBatchLog(dir string, syncInterval time.Duration, log golog.Logger) (*batchLog, error) {
+	bl := &batchLog{dir: dir, syncInterval: syncInterval, log: log}
+	files, err := listRegularFiles(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New("Unable to list batch log segments in %v: %v", dir, err)
+	}
+	for _, file := range files {
+		segment, ok := parseBatchLogSegmentName(file.Name())
+		if !ok {
+			continue
+		}
+		bl.segments = append(bl.segments, segment)
+	}
+	sort.Slice(bl.segments, func(i, j int) bool {
+		return bl.segments[i] < bl.segments[j]
+	})
+	if len(bl.segments) > 0 {
+		bl.current = bl.segments[len(bl.segments)-1]
+	}
+	bl.current++
+	return bl, nil
+}
+
+func batchLogSegmentName(segment int64) string {
+	return fmt.Sprintf("%v%020d", batchLogSegmentPrefix, segment)
+}
+
+func parseBatchLogSegmentName(name string) (int64, bool) {
+	if !strings.HasPrefix(name, batchLogSegmentPrefix) {
+		return 0, false
+	}
+	segment, err := strconv.ParseInt(strings.TrimPrefix(name, batchLogSegmentPrefix), 10, 64)
+	return segment, err == nil
+}
+
+func (bl *batchLog) filename(segment int64) string {
+	return filepath.Join(bl.dir, batchLogSegmentName(segment))
+}
+
+// replay calls onInserts with the inserts of each record in the segments that
+// existed when the log was opened, in the order in which they were appended.
+// It returns the number of inserts replayed.
+func (bl *batchLog) replay(onInserts func(inserts []*insert)) (int, error) {
+	replayed := 0
+	for _, segment := range bl.segments {
+		if segment >= bl.current {
+			break
+		}
+		n, err := bl.replaySegment(segment, onInserts)
+		replayed += n
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+func (bl *batchLog) replaySegment(segment int64, onInserts func(inserts []*insert)) (int, error) {
+	filename := bl.filename(segment)
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, errors.New("Unable to open batch log segment %v: %v", filename, err)
+	}
+	defer file.Close()
+
+	replayed := 0
+	r := bufio.NewReader(file)
+	header := make([]byte, encoding.Width32bits)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return replayed, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				bl.log.Debugf("Skipping torn record at end of batch log segment %v", filename)
+				return replayed, nil
+			}
+			return replayed, errors.New("Unable to read batch log record length from %v: %v", filename, err)
+		}
+		length, _ := encoding.ReadInt32(header)
+		if length > maxBatchLogRecordLength {
+			bl.log.Debugf("Skipping torn record with length %d at end of batch log segment %v", length, filename)
+			return replayed, nil
+		}
+		body := make([]byte, length+encoding.Width32bits)
+		if _, err := io.ReadFull(r, body); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				bl.log.Debugf("Skipping torn record at end of batch log segment %v", filename)
+				return replayed, nil
+			}
+			return replayed, errors.New("Unable to read batch log record from %v: %v", filename, err)
+		}
+		expected, _ := encoding.ReadInt32(body[length:])
+		if uint32(expected) != crc32.Checksum(body[:length], crc32cTable) {
+			// Records are only ever appended, so a bad checksum means that the
+			// write of this record (and anything after it) didn't complete
+			bl.log.Debugf("Skipping record that failed checksum verification at end of batch log segment %v", filename)
+			return replayed, nil
+		}
+		inserts, ok := decodeBatchLogRecord(body[:length])
+		if !ok {
+			return replayed, errors.New("Unable to decode batch log record from %v", filename)
+		}
+		onInserts(inserts)
+		replayed += len(inserts)
+	}
+}
+
+// append writes the given inserts to the current segment as a single record.
+// If syncInterval is 0, the record is synced to disk before append returns.
+func (bl *batchLog) append(inserts []*insert) error {
+	if bl == nil {
+		return nil
+	}
+	record := encodeBatchLogRecord(inserts)
+
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+	if bl.file == nil {
+		if err := os.MkdirAll(bl.dir, 0755); err != nil {
+			return errors.New("Unable to create batch log directory %v: %v", bl.dir, err)
+		}
+		filename := bl.filename(bl.current)
+		file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.New("Unable to open batch log segment %v: %v", filename, err)
+		}
+		bl.file = file
+		bl.segments = append(bl.segments, bl.current)
+	}
+	if _, err := bl.file.Write(record); err != nil {
+		err = errors.New("Unable to write to batch log segment %v: %v", bl.file.Name(), err)
+		// The segment may now end in a partial record, which would hide any
+		// records after it when replaying, so move on to a new segment
+		bl.closeFile()
+		bl.current++
+		return err
+	}
+	if bl.syncInterval > 0 {
+		bl.unsynced = true
+		return nil
+	}
+	if err := bl.file.Sync(); err != nil {
+		return errors.New("Unable to sync batch log segment %v: %v", bl.file.Name(), err)
+	}
+	return nil
+}
+
+// rotate moves on to a new segment and returns the number of the prior
+// segment. It must be called before flushing the memstore, at a point where
+// no inserts are being applied to it.
+func (bl *batchLog) rotate() int64 {
+	if bl == nil {
+		return 0
+	}
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+	bl.closeFile()
+	segment := bl.current
+	bl.current++
+	return segment
+}
+
+// remove removes all segments up to and including the given segment, whose
+// inserts have all been flushed to durable storage.
+func (bl *batchLog) remove(through int64) {
+	if bl == nil {
+		return
+	}
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+	remaining := bl.segments[:0]
+	for _, segment := range bl.segments {
+		if segment > through {
+			remaining = append(remaining, segment)
+			continue
+		}
+		if err := os.Remove(bl.filename(segment)); err != nil && !os.IsNotExist(err) {
+			bl.log.Errorf("Unable to remove batch log segment: %v", err)
+			remaining = append(remaining, segment)
+		}
+	}
+	bl.segments = remaining
+}
+
+// sync periodically syncs the current segment to disk until stop is closed.
+func (bl *batchLog) sync(stop <-chan interface{}) {
+	ticker := time.NewTicker(bl.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			bl.mx.Lock()
+			if bl.unsynced {
+				if err := bl.file.Sync(); err != nil {
+					bl.log.Errorf("Unable to sync batch log segment %v: %v", bl.file.Name(), err)
+				} else {
+					bl.unsynced = false
+				}
+			}
+			bl.mx.Unlock()
+		}
+	}
+}
+
+// close syncs and closes the current segment.
+func (bl *batchLog) close() {
+	if bl == nil {
+		return
+	}
+	bl.mx.Lock()
+	defer bl.mx.Unlock()
+	bl.closeFile()
+}
+
+func (bl *batchLog) closeFile() {
+	if bl.file == nil {
+		return
+	}
+	if bl.unsynced {
+		if err := bl.file.Sync(); err != nil {
+			bl.log.Errorf("Unable to sync batch log segment %v: %v", bl.file.Name(), err)
+		}
+		bl.unsynced = false
+	}
+	if err := bl.file.Close(); err != nil {
+		bl.log.Errorf("Unable to close batch log segment %v: %v", bl.file.Name(), err)
+	}
+	bl.file = nil
+}
+
+// encodeBatchLogRecord encodes the key, vals and metadata of each insert,
+// each prefixed by its 32 bit length, and frames the result as a record.
+func encodeBatchLogRecord(inserts []*insert) []byte {
+	length := 0
+	for _, insert := range inserts {
+		length += 3*encoding.Width32bits + len(insert.key) + len(insert.vals) + len(insert.metadata)
+	}
+	record := make([]byte, encoding.Width32bits+length+encoding.Width32bits)
+	encoding.WriteInt32(record, length)
+	body := record[encoding.Width32bits : encoding.Width32bits+length]
+	b := body
+	for _, insert := range inserts {
+		for _, part := range [][]byte{insert.key, insert.vals, insert.metadata} {
+			b = encoding.WriteInt32(b, len(part))
+			b = b[copy(b, part):]
+		}
+	}
+	encoding.WriteInt32(record[encoding.Width32bits+length:], int(crc32.Checksum(body, crc32cTable)))
+	return record
+}
+
+func decodeBatchLogRecord(body []byte) ([]*insert, bool) {
+	var inserts []*insert
+	readPart := func() ([]byte, bool) {
+		if len(body) < encoding.Width32bits {
+			return nil, false
+		}
+		var length int
+		length, body = encoding.ReadInt32(body)
+		if len(body) < length {
+			return nil, false
+		}
+		part := body[:length]
+		body = body[length:]
+		return part, true
+	}
+	for len(body) > 0 {
+		key, ok := readPart()
+		if !ok {
+			return nil, false
+		}
+		vals, ok := readPart()
+		if !ok {
+			return nil, false
+		}
+		metadata, ok := readPart()
+		if !ok {
+			return nil, false
+		}
+		inserts = append(inserts, &insert{key: key, vals: encoding.TSParams(vals), metadata: metadata})
+	}
+	return inserts, true
+}
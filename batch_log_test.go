@@ -0,0 +1,145 @@
+package zenodb
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchLogRecoversUnflushedBatches(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	open := func(h *hooks) (*DB, *table) {
+		db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true, hooks: h, FlushRetryBackoff: time.Millisecond})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		db.clock.Advance(testEpoch)
+		err = db.CreateTable(&TableOpts{
+			Name:            "logged",
+			RetentionPeriod: 1 * time.Hour,
+			SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+		})
+		if !assert.NoError(t, err) {
+			db.Close()
+			t.FailNow()
+		}
+		return db, db.getTable("logged")
+	}
+	keys := func(tbl *table) map[string]float64 {
+		result := make(map[string]float64)
+		fields := tbl.getFields()
+		v := -1
+		for i, field := range fields {
+			if field.Name == "v" {
+				v = i
+			}
+		}
+		_, err := tbl.iterate(context.Background(), fields, true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			total, _ := vals[v].ValueAt(0, fields[v].Expr)
+			result[key.Get("k").(string)] += total
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	// Simulate a crash by keeping the final flush from writing anything
+	h := &hooks{}
+	failing := int32(1)
+	h.flushWriter = func(out io.Writer) io.Writer {
+		return &failingWriter{&failing, out}
+	}
+	db, tbl := open(h)
+	insertKeys(t, db, "logged", testEpoch, "a", "b")
+	_, err = db.TryInsertBatch("logged", []*Point{{TS: testEpoch, Dims: map[string]interface{}{"k": "c"}, Vals: map[string]interface{}{"v": 1}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	logDir := filepath.Join(tbl.rowStore.opts.dir, batchLogDirName)
+	db.Close()
+
+	segments, err := filepath.Glob(filepath.Join(logDir, batchLogSegmentPrefix+"*"))
+	if !assert.NoError(t, err) || !assert.Len(t, segments, 1, "Unflushed batches should have been logged") {
+		return
+	}
+	// Simulate a torn write at the end of the log
+	segment, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = segment.Write([]byte{0, 0, 1, 0, 5, 6})
+	segment.Close()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	db, tbl = open(nil)
+	defer db.Close()
+	assert.Equal(t, map[string]float64{"a": 1, "b": 1, "c": 1}, keys(tbl), "Unflushed batches should have been recovered from the batch log")
+
+	tbl.forceFlush()
+	segments, err = filepath.Glob(filepath.Join(logDir, batchLogSegmentPrefix+"*"))
+	assert.NoError(t, err)
+	assert.Empty(t, segments, "Batch log should have been removed once flushed")
+	assert.Equal(t, map[string]float64{"a": 1, "b": 1, "c": 1}, keys(tbl), "Recovered batches should have been flushed")
+}
+
+func TestBatchLogRemovedAfterDurableFlush(t *testing.T) {
+	scratchDir, err := ioutil.TempDir("", "zenodbscratch")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(scratchDir)
+
+	db, cleanup := newTestDB(t, &DBOpts{FlushScratchDir: scratchDir}, "durable", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	db.clock.Advance(testEpoch)
+	insertKeys(t, db, "durable", testEpoch, "a")
+	rs := db.getTable("durable").rowStore
+	segments := func() []string {
+		result, err := filepath.Glob(filepath.Join(rs.opts.dir, batchLogDirName, batchLogSegmentPrefix+"*"))
+		assert.NoError(t, err)
+		return result
+	}
+	assert.Len(t, segments(), 1, "Batch should have been logged")
+
+	if !assert.NoError(t, db.Flush("durable")) {
+		return
+	}
+	assert.Empty(t, segments(), "Batch log should have been removed once the flush was durable")
+}
+
+func TestBatchLogRecords(t *testing.T) {
+	inserts := []*insert{
+		{key: bytemap.New(map[string]interface{}{"k": "a"}), vals: encoding.NewTSParams(testEpoch, bytemap.New(map[string]interface{}{"v": 1})), metadata: bytemap.New(map[string]interface{}{"k": "a", "x": 1})},
+		{key: bytemap.New(map[string]interface{}{"k": "b"}), vals: encoding.NewTSParams(testEpoch, bytemap.New(map[string]interface{}{"v": 2}))},
+	}
+	record := encodeBatchLogRecord(inserts)
+	length, body := encoding.ReadInt32(record)
+	decoded, ok := decodeBatchLogRecord(body[:length])
+	if !assert.True(t, ok) || !assert.Len(t, decoded, len(inserts)) {
+		return
+	}
+	for i, insert := range inserts {
+		assert.EqualValues(t, insert.key, decoded[i].key)
+		assert.EqualValues(t, insert.vals, decoded[i].vals)
+		assert.EqualValues(t, len(insert.metadata), len(decoded[i].metadata))
+	}
+
+	_, ok = decodeBatchLogRecord(body[:length-1])
+	assert.False(t, ok, "Truncated record shouldn't decode")
+}
@@ -0,0 +1,128 @@
+package zenodb
+
+import (
+	"hash/fnv"
+	"math"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	// DefaultBloomFilterFalsePositiveRate is the default for
+	// TableOpts.BloomFilterFalsePositiveRate
+	DefaultBloomFilterFalsePositiveRate = 0.01
+)
+
+// bloomFilter records the keys contained in a file store, allowing point
+// lookups to skip files that definitely don't contain a key. It's encoded in
+// the file footer (see fileFooter) as:
+//
+//	bloomLength|numHashes|bits
+//
+// bloomLength is the 32 bit length of bits in bytes, 0 if the file has no
+// bloom filter
+// numHashes is the 8 bit number of bits set for each key
+// bits is the bit array itself
+//
+// Bit positions are derived from a 64 bit FNV-1a hash of the key using double
+// hashing.
+type bloomFilter struct {
+	numHashes int
+	bits      []byte
+}
+
+// bloomHash hashes a key for adding to or checking against a bloomFilter.
+func bloomHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// newBloomFilter builds a bloomFilter containing the keys with the given
+// hashes (see bloomHash), sized for the given false positive rate. Returns nil
+// if falsePositiveRate isn't between 0 and 1.
+func newBloomFilter(hashes []uint64, falsePositiveRate float64) *bloomFilter {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return nil
+	}
+	n := float64(len(hashes))
+	if n < 1 {
+		n = 1
+	}
+	numBits := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	numHashes := int(math.Round(numBits / n * math.Ln2))
+	if numHashes < 1 {
+		numHashes = 1
+	} else if numHashes > math.MaxUint8 {
+		numHashes = math.MaxUint8
+	}
+	bf := &bloomFilter{numHashes: numHashes, bits: make([]byte, (int(numBits)+7)/8)}
+	for _, hash := range hashes {
+		bf.add(hash)
+	}
+	return bf
+}
+
+func (bf *bloomFilter) add(hash uint64) {
+	numBits := uint64(len(bf.bits)) * 8
+	h1, h2 := hash&math.MaxUint32, hash>>32
+	for i := uint64(0); i < uint64(bf.numHashes); i++ {
+		bit := (h1 + i*h2) % numBits
+		bf.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// mayContain returns false if the key with the given hash definitely isn't in
+// the filter. A nil bloomFilter may contain anything.
+func (bf *bloomFilter) mayContain(hash uint64) bool {
+	if bf == nil || len(bf.bits) == 0 {
+		return true
+	}
+	numBits := uint64(len(bf.bits)) * 8
+	h1, h2 := hash&math.MaxUint32, hash>>32
+	for i := uint64(0); i < uint64(bf.numHashes); i++ {
+		bit := (h1 + i*h2) % numBits
+		if bf.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// encodedLength returns the number of bytes that the encoded filter takes up
+// in the footer.
+func (bf *bloomFilter) encodedLength() int {
+	if bf == nil {
+		return encoding.Width32bits + 1
+	}
+	return encoding.Width32bits + 1 + len(bf.bits)
+}
+
+func (bf *bloomFilter) appendTo(b []byte) []byte {
+	if bf == nil {
+		b = appendUint32(b, 0)
+		return append(b, 0)
+	}
+	b = appendUint32(b, uint32(len(bf.bits)))
+	b = append(b, byte(bf.numHashes))
+	return append(b, bf.bits...)
+}
+
+// readBloomFilter reads an encoded bloomFilter from b, returning the remainder
+// of b. The filter is nil if the file doesn't have one.
+func readBloomFilter(b []byte, filename string) (*bloomFilter, []byte, error) {
+	if len(b) < encoding.Width32bits+1 {
+		return nil, nil, errors.New("Bloom filter in %v is truncated", filename)
+	}
+	length := int(encoding.Binary.Uint32(b))
+	numHashes := int(b[encoding.Width32bits])
+	b = b[encoding.Width32bits+1:]
+	if len(b) < length {
+		return nil, nil, errors.New("Bloom filter in %v is truncated", filename)
+	}
+	if length == 0 {
+		return nil, b, nil
+	}
+	return &bloomFilter{numHashes: numHashes, bits: b[:length]}, b[length:], nil
+}
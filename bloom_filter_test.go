@@ -0,0 +1,109 @@
+package zenodb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	var hashes []uint64
+	for i := 0; i < 1000; i++ {
+		hashes = append(hashes, bloomHash([]byte(fmt.Sprintf("key%d", i))))
+	}
+	bf := newBloomFilter(hashes, 0.01)
+	for i, hash := range hashes {
+		assert.True(t, bf.mayContain(hash), "key%d should be in filter", i)
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if bf.mayContain(bloomHash([]byte(fmt.Sprintf("other%d", i)))) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 200, "False positive rate should be about 1%%, not %v%%", float64(falsePositives)/100)
+
+	decoded, remain, err := readBloomFilter(bf.appendTo(nil), "test")
+	if assert.NoError(t, err) {
+		assert.Empty(t, remain)
+		assert.Equal(t, bf, decoded)
+	}
+
+	assert.Nil(t, newBloomFilter(hashes, -1), "Negative rate should disable filter")
+	var disabled *bloomFilter
+	assert.True(t, disabled.mayContain(bloomHash([]byte("anything"))), "Missing filter may contain anything")
+	decoded, _, err = readBloomFilter(disabled.appendTo(nil), "test")
+	if assert.NoError(t, err) {
+		assert.Nil(t, decoded)
+	}
+}
+
+func TestGetSkipsFilesUsingBloomFilter(t *testing.T) {
+	testGetWithBloomFilter(t, 0.0001, true)
+	testGetWithBloomFilter(t, -1, false)
+}
+
+func testGetWithBloomFilter(t *testing.T, falsePositiveRate float64, shouldSkip bool) {
+	h := &hooks{}
+	db, cleanup := newTestDB(t, &DBOpts{hooks: h}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:                         "bloomed",
+		RetentionPeriod:              1 * time.Hour,
+		MaxFileStores:                10,
+		BloomFilterFalsePositiveRate: falsePositiveRate,
+		SQL:                          "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("bloomed")
+
+	// Each file gets its own keys
+	for i := 0; i < 4; i++ {
+		var points []*Point
+		for j := 0; j < 100; j++ {
+			points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": fmt.Sprintf("%d-%d", i, j)}, Vals: map[string]interface{}{"v": i}})
+		}
+		if _, err := db.InsertBatch("bloomed", points); !assert.NoError(t, err) {
+			return
+		}
+		tbl.forceFlush()
+	}
+	tbl.rowStore.mx.RLock()
+	fs := tbl.rowStore.fileStore
+	tbl.rowStore.mx.RUnlock()
+	files := fs.files()
+	if !assert.Len(t, files, 4) {
+		return
+	}
+
+	var read []string
+	h.getFile = func(filename string) {
+		read = append(read, filename)
+	}
+
+	columns, err := fs.get(bytemap.New(map[string]interface{}{"k": "2-50"}))
+	if assert.NoError(t, err) && assert.NotNil(t, columns) {
+		val, _ := columns[0].ValueAtTime(epoch, fs.fields[0].Expr, tbl.Resolution)
+		assert.EqualValues(t, 2, val)
+	}
+	if shouldSkip {
+		assert.Equal(t, []string{files[2]}, read, "Files without key should have been skipped")
+	} else {
+		assert.Equal(t, files, read, "Without bloom filters, all files should have been read")
+	}
+
+	read = nil
+	columns, err = fs.get(bytemap.New(map[string]interface{}{"k": "missing"}))
+	assert.NoError(t, err)
+	assert.Nil(t, columns)
+	if shouldSkip {
+		assert.Empty(t, read, "No file should have been read for missing key")
+	}
+}
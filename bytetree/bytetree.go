@@ -24,6 +24,11 @@ type Tree struct {
 	bytes         int
 	length        int
 	mx            sync.RWMutex
+
+	// preallocated storage, see Reserve
+	reservedNodes []node
+	reservedEdges []edge
+	reservedData  []encoding.Sequence
 }
 
 type node struct {
@@ -65,6 +70,44 @@ func New(
 	}
 }
 
+// Reserve preallocates storage for the given number of keys so that inserting
+// lots of keys doesn't require as many individual allocations.
+func (bt *Tree) Reserve(numKeys int) {
+	if numKeys <= 0 {
+		return
+	}
+	// Each key requires a leaf and possibly an intermediate node from splitting
+	bt.reservedNodes = make([]node, 0, numKeys*2)
+	bt.reservedEdges = make([]edge, 0, numKeys*2)
+	bt.reservedData = make([]encoding.Sequence, 0, numKeys*len(bt.outExprs))
+}
+
+func (bt *Tree) newNode() *node {
+	if len(bt.reservedNodes) == cap(bt.reservedNodes) {
+		return &node{}
+	}
+	bt.reservedNodes = bt.reservedNodes[:len(bt.reservedNodes)+1]
+	return &bt.reservedNodes[len(bt.reservedNodes)-1]
+}
+
+func (bt *Tree) newEdge(label []byte, target *node) *edge {
+	if len(bt.reservedEdges) == cap(bt.reservedEdges) {
+		return &edge{label, target}
+	}
+	bt.reservedEdges = append(bt.reservedEdges, edge{label, target})
+	return &bt.reservedEdges[len(bt.reservedEdges)-1]
+}
+
+func (bt *Tree) newData() []encoding.Sequence {
+	numExprs := len(bt.outExprs)
+	if cap(bt.reservedData)-len(bt.reservedData) < numExprs {
+		return make([]encoding.Sequence, numExprs)
+	}
+	start := len(bt.reservedData)
+	bt.reservedData = bt.reservedData[:start+numExprs]
+	return bt.reservedData[start : start+numExprs : start+numExprs]
+}
+
 // Bytes returns an estimate of the number of bytes stored in this Tree.
 func (bt *Tree) Bytes() int {
 	return bt.bytes * 2
@@ -148,6 +191,81 @@ nodeLoop:
 	}
 }
 
+// Get returns the data for the given key, or nil if the key isn't in this
+// Tree. Keys that were removed under some ctx are still visible to Get.
+func (bt *Tree) Get(fullKey []byte) []encoding.Sequence {
+	n := bt.root
+	key := fullKey
+nodeLoop:
+	for {
+		for _, edge := range n.edges {
+			labelLength := len(edge.label)
+			keyLength := len(key)
+			i := 0
+			for ; i < keyLength && i < labelLength; i++ {
+				if edge.label[i] != key[i] {
+					break
+				}
+			}
+			if i == keyLength && keyLength == labelLength {
+				// found it
+				return edge.target.data
+			} else if i == labelLength && labelLength < keyLength {
+				// descend
+				n = edge.target
+				key = key[labelLength:]
+				continue nodeLoop
+			}
+		}
+
+		// not found
+		return nil
+	}
+}
+
+// Delete permanently deletes the data for the given key from this Tree,
+// regardless of ctx, and returns whether there was any. Copies of this Tree made
+// before the deletion keep their data.
+func (bt *Tree) Delete(fullKey []byte) bool {
+	n := bt.root
+	key := fullKey
+nodeLoop:
+	for {
+		for _, edge := range n.edges {
+			labelLength := len(edge.label)
+			keyLength := len(key)
+			i := 0
+			for ; i < keyLength && i < labelLength; i++ {
+				if edge.label[i] != key[i] {
+					break
+				}
+			}
+			if i == keyLength && keyLength == labelLength {
+				// found it
+				target := edge.target
+				if target.data == nil {
+					return false
+				}
+				bt.bytes -= target.dataBytes()
+				if bt.bytes < 0 {
+					bt.bytes = 0
+				}
+				bt.length--
+				target.data = nil
+				return true
+			} else if i == labelLength && labelLength < keyLength {
+				// descend
+				n = edge.target
+				key = key[labelLength:]
+				continue nodeLoop
+			}
+		}
+
+		// not found
+		return false
+	}
+}
+
 // Copy makes a copy of this Tree.
 func (bt *Tree) Copy() *Tree {
 	cp := &Tree{bytes: bt.bytes, length: bt.length, root: &node{}}
@@ -180,6 +298,11 @@ func (bt *Tree) Copy() *Tree {
 func (bt *Tree) Update(key []byte, vals []encoding.Sequence, params encoding.TSParams, metadata bytemap.ByteMap) int {
 	bytesAdded, newNode := bt.doUpdate(key, vals, params, metadata)
 	bt.bytes += bytesAdded
+	if bt.bytes < 0 {
+		// Shouldn't happen since bytesAdded is always based on the actual sizes
+		// of the data, but never report a negative size
+		bt.bytes = 0
+	}
 	if newNode {
 		bt.length++
 	}
@@ -202,8 +325,10 @@ nodeLoop:
 				}
 			}
 			if i == keyLength && keyLength == labelLength {
-				// update existing node
-				return edge.target.doUpdate(bt, fullKey, vals, params, metadata), false
+				// update existing node, which only counts as new if it didn't have data
+				// (e.g. because it was deleted)
+				isNew := edge.target.data == nil
+				return edge.target.doUpdate(bt, fullKey, vals, params, metadata), isNew
 			} else if i == labelLength && labelLength < keyLength {
 				// descend
 				n = edge.target
@@ -216,24 +341,24 @@ nodeLoop:
 		}
 
 		// Create new edge
-		target := &node{key: fullKey}
-		n.edges = append(n.edges, &edge{key, target})
+		target := bt.newNode()
+		target.key = fullKey
+		n.edges = append(n.edges, bt.newEdge(key, target))
 		return target.doUpdate(bt, fullKey, vals, params, metadata) + len(key), true
 	}
 }
 
 func (n *node) doUpdate(bt *Tree, fullKey []byte, vals []encoding.Sequence, params encoding.TSParams, metadata bytemap.ByteMap) int {
 	if n.data == nil {
-		n.data = make([]encoding.Sequence, len(bt.outExprs))
+		n.data = bt.newData()
 	}
-	bytesAdded := 0
+	// Updating can shrink sequences (or drop them entirely) when truncating
+	// values older than asOf, so rather than assuming that updates only grow the
+	// data, compare the size of all of the node's data before and after.
+	previousSize := n.dataBytes()
 	if params != nil {
 		for o, ex := range bt.outExprs {
-			current := n.data[o]
-			previousSize := cap(current)
-			updated := current.Update(params, metadata, ex, bt.outResolution, bt.asOf)
-			n.data[o] = updated
-			bytesAdded += cap(updated) - previousSize
+			n.data[o] = n.data[o].Update(params, metadata, ex, bt.outResolution, bt.asOf)
 		}
 	} else {
 		for o, subMergers := range bt.subMergers {
@@ -245,14 +370,21 @@ func (n *node) doUpdate(bt *Tree, fullKey []byte, vals []encoding.Sequence, para
 				}
 				in := vals[i]
 				inEx := bt.inExprs[i]
-				previousSize := cap(out)
 				out = out.SubMerge(in, metadata, bt.outResolution, bt.inResolution, outEx, inEx, submerge, bt.asOf, bt.until, bt.strideSlice)
 				n.data[o] = out
-				bytesAdded += cap(out) - previousSize
 			}
 		}
 	}
-	return bytesAdded
+	return n.dataBytes() - previousSize
+}
+
+// dataBytes returns the number of bytes allocated to this node's data.
+func (n *node) dataBytes() int {
+	bytes := 0
+	for _, seq := range n.data {
+		bytes += cap(seq)
+	}
+	return bytes
 }
 
 func (n *node) wasRemovedFor(bt *Tree, ctx int64) bool {
@@ -280,11 +412,13 @@ func (n *node) doRemoveFor(bt *Tree, ctx int64) {
 }
 
 func (e *edge) split(bt *Tree, splitOn int, fullKey []byte, key []byte, vals []encoding.Sequence, params encoding.TSParams, metadata bytemap.ByteMap) int {
-	newNode := &node{edges: edges{&edge{e.label[splitOn:], e.target}}}
+	newNode := bt.newNode()
+	newNode.edges = edges{bt.newEdge(e.label[splitOn:], e.target)}
 	newLeaf := newNode
 	if splitOn != len(key) {
-		newLeaf = &node{key: fullKey}
-		newNode.edges = append(newNode.edges, &edge{key[splitOn:], newLeaf})
+		newLeaf = bt.newNode()
+		newLeaf.key = fullKey
+		newNode.edges = append(newNode.edges, bt.newEdge(key[splitOn:], newLeaf))
 	}
 	e.label = e.label[:splitOn]
 	e.target = newNode
@@ -1,6 +1,7 @@
 package bytetree
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -159,3 +160,150 @@ func checkTree(ctx int64, t *testing.T, bt *Tree, e Expr) {
 	assert.EqualValues(t, 32, val)
 	assert.Nil(t, bt.Remove(ctx, []byte("unknown")))
 }
+
+func TestByteTreeReserve(t *testing.T) {
+	doTest(t, func(bt *Tree, resolutionOut time.Duration, eA Expr, eB Expr) {
+		// Reserve less than we need to make sure we fall back to allocating
+		bt.Reserve(2)
+		bt.Update([]byte("test"), nil, params(1, 1), nil)
+		bt.Update([]byte("slow"), nil, params(2, 2), nil)
+		bt.Update(nil, nil, params(3, 3), nil)
+		bt.Update([]byte("slower"), nil, params(4, 4), nil)
+		bt.Update([]byte("team"), nil, params(5, 5), nil)
+		bt.Update([]byte("toast"), nil, params(6, 6), nil)
+		assert.Equal(t, 6, bt.Length())
+
+		bt.Update([]byte("test"), nil, params(10, 10), nil)
+		bt.Update([]byte("slow"), nil, params(10, 10), nil)
+		bt.Update(nil, nil, params(10, 10), nil)
+		bt.Update([]byte("slower"), nil, params(10, 10), nil)
+		bt.Update([]byte("team"), nil, params(10, 10), nil)
+		bt.Update([]byte("toast"), nil, params(10, 10), nil)
+		assert.Equal(t, 6, bt.Length())
+	})
+}
+
+func TestByteTreeGet(t *testing.T) {
+	eA := SUM(FIELD("a"))
+	eB := SUM(FIELD("b"))
+	bt := New([]Expr{eA, eB}, nil, time.Second, 0, time.Time{}, time.Time{}, 0)
+	bt.Update([]byte("test"), nil, params(1, 1), nil)
+	bt.Update([]byte("team"), nil, params(2, 2), nil)
+
+	data := bt.Get([]byte("team"))
+	if assert.Len(t, data, 2) {
+		val, _ := data[0].ValueAt(0, eA)
+		assert.EqualValues(t, 2, val)
+	}
+	assert.Nil(t, bt.Get([]byte("te")), "Intermediate nodes without data should not be found")
+	assert.Nil(t, bt.Get([]byte("toast")))
+
+	bt.Remove(ctx, []byte("test"))
+	assert.NotNil(t, bt.Get([]byte("test")), "Removing under a ctx should not affect Get")
+}
+
+func TestByteTreeDelete(t *testing.T) {
+	eA := SUM(FIELD("a"))
+	eB := SUM(FIELD("b"))
+	bt := New([]Expr{eA, eB}, nil, time.Second, 0, time.Time{}, time.Time{}, 0)
+	bt.Update([]byte("test"), nil, params(1, 1), nil)
+	bt.Update([]byte("team"), nil, params(2, 2), nil)
+	cp := bt.Copy()
+
+	assert.True(t, bt.Delete([]byte("test")))
+	assert.False(t, bt.Delete([]byte("test")), "Deleting twice should find nothing")
+	assert.False(t, bt.Delete([]byte("te")), "Intermediate nodes without data should not be deleted")
+	assert.Nil(t, bt.Get([]byte("test")))
+	assert.NotNil(t, cp.Get([]byte("test")), "Deleting should not affect copies")
+	assert.Equal(t, 1, bt.Length())
+	assert.Equal(t, actualBytes(bt.root), bt.Bytes())
+
+	walked := 0
+	bt.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+		walked++
+		assert.Equal(t, "team", string(key))
+		return true, true, nil
+	})
+	assert.Equal(t, 1, walked)
+
+	bt.Update([]byte("test"), nil, params(3, 3), nil)
+	assert.Equal(t, 2, bt.Length(), "Re-inserting a deleted key should count it again")
+	val, _ := bt.Get([]byte("test"))[0].ValueAt(0, eA)
+	assert.EqualValues(t, 3, val, "Re-inserted key should not include deleted data")
+}
+
+func TestByteTreeBytesWithTruncation(t *testing.T) {
+	resolution := time.Second
+	eA := SUM(FIELD("a"))
+	eB := SUM(FIELD("b"))
+	asOf := epoch.Add(-10 * resolution)
+	bt := New([]Expr{eA, eB}, nil, resolution, 0, asOf, time.Time{}, 0)
+
+	checkBytes := func(msg string) {
+		assert.Equal(t, actualBytes(bt.root), bt.bytes, msg)
+		assert.True(t, bt.Bytes() >= 0, msg)
+	}
+
+	for i := 0; i < 10; i++ {
+		bt.Update([]byte("test"), nil, tsParams(epoch.Add(time.Duration(-i)*resolution), 1, 1), nil)
+		bt.Update([]byte("team"), nil, tsParams(epoch.Add(time.Duration(-i)*resolution), 1, 1), nil)
+	}
+	checkBytes("After filling sequences")
+
+	// Out of order values older than asOf for existing keys
+	bt.Update([]byte("test"), nil, tsParams(asOf.Add(-5*resolution), 1, 1), nil)
+	checkBytes("After inserting old value for existing key")
+
+	// Old values for new keys leave nodes without data
+	bt.Update([]byte("toast"), nil, tsParams(asOf.Add(-5*resolution), 1, 1), nil)
+	bt.Update([]byte("tea"), nil, tsParams(asOf.Add(-5*resolution), 1, 1), nil)
+	checkBytes("After inserting old values for new keys")
+	assert.Nil(t, bt.Get([]byte("toast"))[0], "Old value should have been truncated")
+
+	// Newer values push the existing data past asOf, shrinking sequences
+	bt.asOf = epoch.Add(-2 * resolution)
+	bt.Update([]byte("test"), nil, tsParams(epoch.Add(resolution), 1, 1), nil)
+	bt.Update([]byte("team"), nil, tsParams(bt.asOf.Add(-resolution), 1, 1), nil)
+	checkBytes("After truncating existing sequences")
+}
+
+// actualBytes computes the number of bytes held by the tree under n, which is
+// what Tree.bytes is supposed to track.
+func actualBytes(n *node) int {
+	bytes := n.dataBytes()
+	for _, e := range n.edges {
+		bytes += len(e.label) + actualBytes(e.target)
+	}
+	return bytes
+}
+
+func BenchmarkUpdateHighCardinality(b *testing.B) {
+	doBenchmarkUpdateHighCardinality(b, false)
+}
+
+func BenchmarkUpdateHighCardinalityReserved(b *testing.B) {
+	doBenchmarkUpdateHighCardinality(b, true)
+}
+
+func doBenchmarkUpdateHighCardinality(b *testing.B, reserve bool) {
+	numKeys := 100000
+	keys := make([][]byte, 0, numKeys)
+	for i := 0; i < numKeys; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key_%d", i)))
+	}
+	eA := SUM(FIELD("a"))
+	eB := SUM(FIELD("b"))
+	p := params(1, 1)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bt := New([]Expr{eA, eB}, nil, 10*time.Second, 0, time.Time{}, time.Time{}, 0)
+		if reserve {
+			bt.Reserve(numKeys)
+		}
+		for _, key := range keys {
+			bt.Update(key, nil, p, nil)
+		}
+	}
+}
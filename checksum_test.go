@@ -0,0 +1,70 @@
+package zenodb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRowChecksums(t *testing.T) {
+	_, tbl, cleanup := newFlushedTestDB(t, &DBOpts{}, "checksummed", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)", "a")
+	defer cleanup()
+
+	rs := tbl.rowStore
+	fs := rs.fileStore
+	assert.Equal(t, CurrentFileVersion, tbl.versionFor(fs.filename))
+
+	read := func() error {
+		_, err := fs.iterate(tbl.getFields(), nil, false, false, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			return true, nil
+		})
+		return err
+	}
+	if !assert.NoError(t, read()) {
+		return
+	}
+
+	// Flip a bit in the checksum of the last row, keeping the snappy framing
+	// intact so that only our checksum can detect it.
+	compressed, err := ioutil.ReadFile(fs.filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	footer, err := readFileFooter(bytes.NewReader(compressed), fs.filename, CurrentFileVersion)
+	if !assert.NoError(t, err) {
+		return
+	}
+	data, err := ioutil.ReadAll(snappy.NewReader(bytes.NewReader(compressed[fileHeaderLength:footer.dataEnd])))
+	if !assert.NoError(t, err) {
+		return
+	}
+	data[len(data)-1] ^= 1
+	out, err := os.Create(fs.filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = out.Write(compressed[:fileHeaderLength])
+	assert.NoError(t, err)
+	sout := snappy.NewBufferedWriter(out)
+	_, err = sout.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, sout.Close())
+	_, err = out.Write(compressed[footer.dataEnd:])
+	assert.NoError(t, err)
+	assert.NoError(t, out.Close())
+
+	err = read()
+	if assert.Error(t, err, "Corrupted row should have failed verification") {
+		assert.Contains(t, err.Error(), "Checksum mismatch")
+		assert.Contains(t, err.Error(), "at offset")
+	}
+
+	rs.opts.skipChecksumVerification = true
+	assert.NoError(t, read(), "Reading without verification should ignore checksum")
+}
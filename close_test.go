@@ -0,0 +1,53 @@
+package zenodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRowStoreClose(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "closeable", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	point := func(k string) []*Point {
+		return []*Point{{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": 1}}}
+	}
+	_, err := db.InsertBatch("closeable", point("a"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = db.TryInsertBatch("closeable", point("b"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	rs := db.getTable("closeable").rowStore
+	if !assert.NoError(t, rs.Close()) {
+		return
+	}
+	stats := db.TableStats("closeable").RowStore
+	assert.EqualValues(t, 1, stats.Flushes, "Closing should have flushed the memstore")
+	assert.Zero(t, stats.MemStoreBytes, "Queued inserts should have been flushed too")
+	assert.True(t, stats.BytesOnDisk > 0)
+
+	_, err = db.InsertBatch("closeable", point("c"))
+	assert.Equal(t, ErrTableClosed, err)
+	_, err = db.TryInsertBatch("closeable", point("c"))
+	assert.Equal(t, ErrTableClosed, err)
+	assert.NoError(t, rs.Close(), "Closing again should be fine")
+
+	keys := 0
+	_, err = db.getTable("closeable").iterate(context.Background(), db.getTable("closeable").getFields(), false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		keys++
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, keys, "Both inserted keys should have been flushed")
+}
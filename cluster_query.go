@@ -15,6 +15,7 @@ import (
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/planner"
+	"github.com/getlantern/zenodb/sql"
 )
 
 var (
@@ -54,6 +55,11 @@ func (db *DB) queryForRemote(ctx context.Context, sqlString string, isSubQuery b
 		db.log.Debugf("Processed query in %v, error?: %v : %v", elapsed(), err, sqlString)
 	}()
 	if unflat {
+		if ert, ok := source.(*emptyResultTracker); ok {
+			// The leader tracks empty results, unwrap so that we can skip the
+			// flatten/unflatten cycle
+			source = ert.source
+		}
 		result, err = core.UnflattenOptimized(source).Iterate(ctx, onFields, onRow)
 	} else {
 		result, err = source.Iterate(ctx, onFields, onFlatRow)
@@ -62,20 +68,28 @@ func (db *DB) queryForRemote(ctx context.Context, sqlString string, isSubQuery b
 }
 
 type remoteResult struct {
-	partition     int
-	fields        core.Fields
-	key           bytemap.ByteMap
-	vals          core.Vals
-	flatRow       *core.FlatRow
-	totalRows     int
-	elapsed       time.Duration
-	highWaterMark int64
-	err           error
+	partition       int
+	fields          core.Fields
+	key             bytemap.ByteMap
+	vals            core.Vals
+	flatRow         *core.FlatRow
+	totalRows       int
+	elapsed         time.Duration
+	highWaterMark   int64
+	rowsScanned     int64
+	bytesScanned    int64
+	rowsInRetention int64
+	// bytesDecompressed and filesRead are from the partition's QueryStats
+	bytesDecompressed int64
+	filesRead         int64
+	skippedFiles      []string
+	err               error
 }
 
 func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
 	ctx = common.WithIncludeMemStore(ctx, includeMemStore)
-	numPartitions := db.opts.NumPartitions
+	partitions := db.partitionsFor(sqlString)
+	numPartitions := len(partitions)
 	results := make(chan *remoteResult, numPartitions*100000) // TODO: make this tunable
 	resultsByPartition := make(map[int]*int64)
 
@@ -123,6 +137,12 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 			if stats.HighestHighWaterMark < result.highWaterMark {
 				stats.HighestHighWaterMark = result.highWaterMark
 			}
+			stats.RowsScanned += result.rowsScanned
+			stats.RowsInRetention += result.rowsInRetention
+			stats.BytesScanned += result.bytesScanned
+			stats.BytesDecompressed += result.bytesDecompressed
+			stats.FilesRead += result.filesRead
+			stats.SkippedFiles = append(stats.SkippedFiles, result.skippedFiles...)
 		}
 	}
 
@@ -134,7 +154,10 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 		atomic.StoreInt64(&_stopped, 1)
 	}
 
-	subCtx := ctx
+	// Cancel sub-contexts once we return so that partitions whose results we're
+	// no longer waiting for stop working on the query
+	subCtx, cancelSubCtx := context.WithCancel(ctx)
+	defer cancelSubCtx()
 	ctxDeadline, ctxHasDeadline := subCtx.Deadline()
 	if ctxHasDeadline {
 		// Halve timeout for sub-contexts
@@ -146,8 +169,8 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 		defer cancel()
 	}
 
-	for i := 0; i < numPartitions; i++ {
-		partition := i
+	for _, _partition := range partitions {
+		partition := _partition
 		_resultsForPartition := int64(0)
 		resultsForPartition := &_resultsForPartition
 		resultsByPartition[partition] = resultsForPartition
@@ -213,23 +236,39 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 				if err != nil {
 					switch err.(type) {
 					case common.Retriable:
-						db.log.Debugf("Failed on partition %d but error is retriable, continuing: %v", partition, err)
-						continue
+						if subCtx.Err() == nil {
+							db.log.Debugf("Failed on partition %d but error is retriable, continuing: %v", partition, err)
+							continue
+						}
+						db.log.Debugf("Failed on partition %d and query is done, will abort: %v", partition, err)
 					default:
 						db.log.Debugf("Failed on partition %d and error is not retriable, will abort: %v", partition, err)
 					}
 				}
-				var highWaterMark int64
+				var highWaterMark, rowsScanned, bytesScanned, rowsInRetention, bytesDecompressed, filesRead int64
+				var skippedFiles []string
 				qs, ok := qstats.(*common.QueryStats)
 				if ok && qs != nil {
 					highWaterMark = qs.HighestHighWaterMark
+					rowsScanned = qs.RowsScanned
+					bytesScanned = qs.BytesScanned
+					rowsInRetention = qs.RowsInRetention
+					bytesDecompressed = qs.BytesDecompressed
+					filesRead = qs.FilesRead
+					skippedFiles = qs.SkippedFiles
 				}
 				results <- &remoteResult{
-					partition:     partition,
-					totalRows:     int(atomic.LoadInt64(resultsForPartition)),
-					elapsed:       elapsed(),
-					highWaterMark: highWaterMark,
-					err:           err,
+					partition:         partition,
+					totalRows:         int(atomic.LoadInt64(resultsForPartition)),
+					elapsed:           elapsed(),
+					highWaterMark:     highWaterMark,
+					rowsScanned:       rowsScanned,
+					bytesScanned:      bytesScanned,
+					rowsInRetention:   rowsInRetention,
+					bytesDecompressed: bytesDecompressed,
+					filesRead:         filesRead,
+					skippedFiles:      skippedFiles,
+					err:               err,
 				}
 				break
 			}
@@ -312,7 +351,7 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 				fail(result.partition, result.err)
 			}
 			finish(result)
-			db.log.Debugf("%d/%d got %d results from partition %d in %v", resultCount, db.opts.NumPartitions, result.totalRows, result.partition, result.elapsed)
+			db.log.Debugf("%d/%d got %d results from partition %d in %v", resultCount, numPartitions, result.totalRows, result.partition, result.elapsed)
 			delete(resultsByPartition, result.partition)
 		case <-timeoutTimer.C:
 			db.log.Errorf("Failed to get results by within %v, %d of %d partitions reporting", timeout, resultCount, numPartitions)
@@ -334,6 +373,67 @@ func (db *DB) queryCluster(ctx context.Context, sqlString string, isSubQuery boo
 	return finalStats(), finalErr()
 }
 
+// partitionsFor returns the partitions that need to be queried to answer the
+// given query. If the query's WHERE clause constrains every one of the table's
+// partition keys to specific values, only the partitions that can hold those
+// values are returned. Otherwise, all partitions are returned.
+func (db *DB) partitionsFor(sqlString string) []int {
+	all := make([]int, 0, db.opts.NumPartitions)
+	for i := 0; i < db.opts.NumPartitions; i++ {
+		all = append(all, i)
+	}
+
+	query, err := sql.Parse(sqlString)
+	if err != nil {
+		// Let the partitions report the error
+		return all
+	}
+	for query.FromSubQuery != nil {
+		query = query.FromSubQuery
+	}
+	t := db.getTable(query.From)
+	if t == nil || len(t.PartitionBy) == 0 {
+		return all
+	}
+	// Followers hash partition keys in sorted order (see followLeaders)
+	partitionKeys := append([]string(nil), t.PartitionBy...)
+	sort.Strings(partitionKeys)
+
+	// Build the dims for every combination of allowed partition key values
+	combos := []map[string]interface{}{make(map[string]interface{}, len(partitionKeys))}
+	for _, partitionKey := range partitionKeys {
+		values := query.WhereEquals[partitionKey]
+		if len(values) == 0 {
+			return all
+		}
+		nextCombos := make([]map[string]interface{}, 0, len(combos)*len(values))
+		for _, combo := range combos {
+			for _, value := range values {
+				nextCombo := make(map[string]interface{}, len(partitionKeys))
+				for k, v := range combo {
+					nextCombo[k] = v
+				}
+				nextCombo[partitionKey] = value
+				nextCombos = append(nextCombos, nextCombo)
+			}
+		}
+		combos = nextCombos
+	}
+
+	h := partitionHash()
+	included := make(map[int]bool, len(combos))
+	for _, combo := range combos {
+		included[db.partitionFor(h, bytemap.New(combo), partitionKeys)] = true
+	}
+	partitions := make([]int, 0, len(included))
+	for partition := range included {
+		partitions = append(partitions, partition)
+	}
+	sort.Ints(partitions)
+	db.log.Debugf("Pruned query to partitions %v: %v", partitions, sqlString)
+	return partitions
+}
+
 func partitionRowMapper(canonicalFields core.Fields, partitionFields core.Fields) func(core.Vals) core.Vals {
 	if canonicalFields.Equals(partitionFields) {
 		return func(vals core.Vals) core.Vals { return vals }
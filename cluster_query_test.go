@@ -0,0 +1,115 @@
+package zenodb
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryClusterPrunesPartitions(t *testing.T) {
+	numPartitions := 8
+	db, cleanup := newTestDB(t, &DBOpts{
+		Passthrough:             true,
+		NumPartitions:           numPartitions,
+		ClusterQueryConcurrency: clusterQueryConcurrency,
+	}, "", "")
+	defer cleanup()
+
+	if !assert.NoError(t, db.CreateTable(&TableOpts{
+		Name:            "partitioned",
+		RetentionPeriod: 1 * time.Hour,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY *, period(1s)",
+		PartitionBy:     []string{"k", "j"},
+	})) {
+		return
+	}
+	if !assert.NoError(t, db.CreateTable(&TableOpts{
+		Name:            "unpartitioned",
+		RetentionPeriod: 1 * time.Hour,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY *, period(1s)",
+	})) {
+		return
+	}
+
+	partitionOf := func(k string, j string) int {
+		return db.partitionFor(partitionHash(), bytemap.New(map[string]interface{}{"k": k, "j": j}), []string{"j", "k"})
+	}
+	partitionsOf := func(pairs ...[2]string) []int {
+		included := make(map[int]bool)
+		for _, pair := range pairs {
+			included[partitionOf(pair[0], pair[1])] = true
+		}
+		var result []int
+		for partition := range included {
+			result = append(result, partition)
+		}
+		sort.Ints(result)
+		return result
+	}
+	all := make([]int, 0, numPartitions)
+	for i := 0; i < numPartitions; i++ {
+		all = append(all, i)
+	}
+
+	query := func(sqlString string) []int {
+		var mx sync.Mutex
+		var queried []int
+		for i := 0; i < numPartitions; i++ {
+			partition := i
+			db.RegisterQueryHandler(partition, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+				mx.Lock()
+				queried = append(queried, partition)
+				mx.Unlock()
+				return &common.QueryStats{}, nil
+			})
+		}
+		stats, err := db.queryCluster(context.Background(), sqlString, false, nil, true, false, func(fields core.Fields) error {
+			return nil
+		}, nil, func(row *core.FlatRow) (bool, error) {
+			return true, nil
+		})
+		assert.NoError(t, err)
+		mx.Lock()
+		defer mx.Unlock()
+		sort.Ints(queried)
+		assert.Equal(t, len(queried), stats.(*common.QueryStats).NumPartitions)
+		// Drain handlers for partitions that weren't queried
+		for i := 0; i < numPartitions; i++ {
+			db.remoteQueryHandlerForPartition(i)
+		}
+		return queried
+	}
+
+	assert.Equal(t, partitionsOf([2]string{"a", "x"}), query("SELECT * FROM partitioned WHERE k = 'a' AND j = 'x'"))
+	assert.Equal(t, partitionsOf([2]string{"a", "x"}), query("SELECT * FROM partitioned WHERE (j = 'x' AND k IN ('a', 'b')) AND k = 'a' AND other > 5"))
+	assert.Equal(t, partitionsOf([2]string{"a", "x"}, [2]string{"b", "x"}, [2]string{"a", "y"}, [2]string{"b", "y"}), query("SELECT * FROM partitioned WHERE k IN ('a', 'b') AND j IN ('x', 'y')"))
+	assert.Equal(t, partitionsOf([2]string{"a", "x"}), query("SELECT * FROM (SELECT * FROM partitioned WHERE k = 'a' AND j = 'x') GROUP BY k"))
+	assert.Equal(t, all, query("SELECT * FROM partitioned WHERE k = 'a'"), "not all partition keys constrained")
+	assert.Equal(t, all, query("SELECT * FROM partitioned WHERE k = 'a' OR j = 'x'"), "OR doesn't constrain")
+	assert.Equal(t, all, query("SELECT * FROM partitioned WHERE k = 'a' AND k = 'b' AND j = 'x'"), "contradictory conditions")
+	assert.Equal(t, all, query("SELECT * FROM partitioned"), "no WHERE")
+	assert.Equal(t, all, query("SELECT * FROM unpartitioned WHERE k = 'a' AND j = 'x'"), "table not partitioned")
+
+	explainPartitions := func(sqlString string) []int {
+		plan, err := db.Explain(sqlString, false, nil, false)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		for node := plan; node != nil; node = node.Source {
+			if node.Type == "cluster" {
+				return node.Partitions
+			}
+		}
+		assert.Fail(t, "No cluster node in plan")
+		return nil
+	}
+	assert.Equal(t, partitionsOf([2]string{"a", "x"}), explainPartitions("SELECT * FROM partitioned WHERE k = 'a' AND j = 'x'"))
+	assert.Equal(t, all, explainPartitions("SELECT * FROM partitioned"))
+}
@@ -159,6 +159,10 @@ func query(stdout io.Writer, stderr io.Writer, client rpc.Client, sql string, cs
 	} else {
 		stats, err = dumpPlainText(stdout, sql, md, iterate)
 	}
+	// Warnings are only known once all results have been received
+	for _, warning := range md.Warnings {
+		fmt.Fprintf(stderr, "Warning: %v\n", warning)
+	}
 
 	if err == nil {
 		if !*allowIncomplete && stats.NumSuccessfulPartitions < stats.NumPartitions {
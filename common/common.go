@@ -46,12 +46,43 @@ type Follow struct {
 
 type QueryRemote func(sqlString string, includeMemStore bool, isSubQuery bool, subQueryResults [][]interface{}, onValue func(bytemap.ByteMap, []encoding.Sequence)) (hasReadResult bool, err error)
 
+// EmptyReason explains why a query returned no rows
+type EmptyReason string
+
+const (
+	// EmptyReasonNoMatchingKeys means that the table contained data within the
+	// retention period but none of it matched the query.
+	EmptyReasonNoMatchingKeys EmptyReason = "no_matching_keys"
+	// EmptyReasonAllExpired means that the table contained data but all of it
+	// fell outside of the retention period.
+	EmptyReasonAllExpired EmptyReason = "all_expired"
+	// EmptyReasonTableEmpty means that the table contained no data at all.
+	EmptyReasonTableEmpty EmptyReason = "table_empty"
+)
+
 type QueryMetaData struct {
 	FieldNames []string
+	// AsOf and Until are the effective window covered by the query, after any
+	// clipping to the retention of the tables involved
 	AsOf       time.Time
 	Until      time.Time
 	Resolution time.Duration
 	Plan       string
+	// Warnings contains any warnings raised while running the query
+	Warnings []string
+	// Empty indicates that the query completed without returning any rows. This
+	// is only known once the query has finished iterating.
+	Empty bool
+	// EmptyReason explains why the query returned no rows if Empty is true
+	EmptyReason EmptyReason
+	// RowsScanned, BytesScanned, BytesDecompressed, FilesRead and Elapsed
+	// describe how the query executed (see QueryStats). Like Empty, they're
+	// only known once the query has finished iterating.
+	RowsScanned       int64
+	BytesScanned      int64
+	BytesDecompressed int64
+	FilesRead         int64
+	Elapsed           time.Duration
 }
 
 // QueryStats captures stats about query
@@ -61,6 +92,31 @@ type QueryStats struct {
 	LowestHighWaterMark     int64
 	HighestHighWaterMark    int64
 	MissingPartitions       []int
+	// RowsScanned is the number of rows read from tables to answer the query
+	RowsScanned int64
+	// BytesScanned is the number of bytes of keys and values read from tables
+	// to answer the query
+	BytesScanned int64
+	// RowsInRetention is the number of scanned rows that had data within the
+	// retention period
+	RowsInRetention int64
+	// BytesDecompressed is the number of uncompressed bytes read from files to
+	// answer the query
+	BytesDecompressed int64
+	// FilesRead is the number of files read to answer the query
+	FilesRead int64
+	// Elapsed is the wall-clock time that it took to run the query
+	Elapsed time.Duration
+	// Empty indicates that the query completed without returning any rows
+	Empty bool
+	// EmptyReason explains why the query returned no rows if Empty is true
+	EmptyReason EmptyReason
+	// Warnings contains any warnings raised while running the query
+	Warnings []string
+	// SkippedFiles lists corrupt files that were skipped while running the
+	// query. If it's not empty, the results are missing whatever data those
+	// files held.
+	SkippedFiles []string
 }
 
 // Retriable is a marker for retriable errors
@@ -0,0 +1,389 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	// deltasDir is the subdirectory that holds file stores written by
+	// incremental flushes. It's a subdirectory so that deltas aren't mistaken
+	// for the base file store.
+	deltasDir = "deltas"
+)
+
+// incrementalFlushes indicates whether flushes write just the memstore to a new
+// delta file rather than rewriting the entire file store.
+func (rs *rowStore) incrementalFlushes() bool {
+	return rs.opts.maxFileStores > 1
+}
+
+func (rs *rowStore) deltasDirName() string {
+	return filepath.Join(rs.opts.dir, deltasDir)
+}
+
+// files returns the names of all files that make up this file store, oldest
+// first.
+func (fs *fileStore) files() []string {
+	files := make([]string, 0, len(fs.deltas)+1)
+	if fs.filename != "" {
+		files = append(files, fs.filename)
+	}
+	return append(files, fs.deltas...)
+}
+
+// doProcessDeltaFlush writes the contents of the given memstore to a new delta
+// file, leaving the existing file stores as they are.
+func (rs *rowStore) doProcessDeltaFlush(ms *memstore, allowSort bool) (*memstore, time.Duration, error) {
+	shouldSort := allowSort && rs.t.shouldSort()
+	if shouldSort {
+		defer rs.t.stopSorting()
+	}
+
+	rs.mx.RLock()
+	tombstones := rs.tombstones
+	rs.mx.RUnlock()
+
+	start := time.Now()
+	dir := rs.deltasDirName()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, 0, errors.New("Unable to create deltas directory %v: %v", dir, err)
+	}
+	out, err := ioutil.TempFile(dir, "nextdelta")
+	if err != nil {
+		return nil, 0, errors.New("Unable to create temp file for delta: %v", err)
+	}
+	defer out.Close()
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			os.Remove(out.Name())
+		}
+	}()
+
+	// A file store without any files just reads the memstore. Deleted keys are
+	// dropped from the delta, but they remain deleted until a compaction has
+	// dropped them from all older files too.
+	empty := &fileStore{t: rs.t, rs: rs, fields: rs.fields}
+	highWaterMark, rowCount, keysPurged, err := empty.flush(out, rs.fields, nil, tombstones, ms.offsetsBySource, ms, shouldSort, true, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rowCount == 0 {
+		// Everything in the memstore expired or was deleted, so don't add an empty
+		// delta that would only need compacting later. We still need to record how
+		// far we've gotten in the WAL.
+		if err := rs.writeOffsets(ms.offsetsBySource); err != nil {
+			return nil, 0, errors.New("Unable to write offsets: %v", err)
+		}
+		ms = rs.newMemStore(ms.offsetsBySource)
+		rs.mx.Lock()
+		rs.memStore = ms
+		rs.mx.Unlock()
+		rs.keysPurgedByLastFlush = keysPurged
+		flushDuration := time.Now().Sub(start)
+		rs.t.log.Debugf("No rows left to flush to delta after dropping expired and deleted keys, took %v", flushDuration)
+		return ms, flushDuration, nil
+	}
+	if err := rs.syncFile(out); err != nil {
+		return nil, 0, errors.New("Unable to sync delta: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return nil, 0, errors.New("Unable to close delta: %v", err)
+	}
+	deltaName := filepath.Join(dir, fmt.Sprintf("filestore_%020d_%d.dat", rs.nextFileNanos(), CurrentFileVersion))
+	if err := os.Rename(out.Name(), deltaName); err != nil {
+		return nil, 0, errors.New("Unable to move delta into place at %v: %v", deltaName, err)
+	}
+	if err := rs.syncDir(dir); err != nil {
+		return nil, 0, err
+	}
+	succeeded = true
+
+	ms = rs.newMemStore(ms.offsetsBySource)
+	rs.mx.Lock()
+	current := rs.fileStore
+	newFS := &fileStore{t: rs.t, rs: rs, fields: rs.fields, filename: current.filename, deltas: append(append([]string(nil), current.deltas...), deltaName)}
+	rs.fileStore = newFS
+	rs.memStore = ms
+	// The rollup no longer covers all data
+	rs.rollupFile = ""
+	rs.mx.Unlock()
+	rs.keysPurgedByLastFlush = keysPurged
+
+	flushDuration := time.Now().Sub(start)
+	rs.t.log.Debugf("Flushed %d rows to delta %v in %v", rowCount, deltaName, flushDuration)
+	rs.t.updateHighWaterMarkDisk(highWaterMark)
+	if len(newFS.files()) > rs.opts.maxFileStores {
+		rs.requestCompaction()
+	}
+	return ms, flushDuration, nil
+}
+
+func (rs *rowStore) requestCompaction() {
+	select {
+	case rs.compactionRequests <- nil:
+	default:
+		// already requested
+	}
+}
+
+// compactFileStores compacts file stores in the background whenever
+// incremental flushes have left too many of them.
+func (rs *rowStore) compactFileStores(stop <-chan interface{}) {
+	for {
+		select {
+		case <-stop:
+			rs.t.log.Debug("Stop compacting file stores")
+			return
+		case <-rs.compactionRequests:
+			if _, err := rs.compact(false); err != nil {
+				rs.t.log.Errorf("Unable to compact file stores: %v", err)
+			}
+		}
+	}
+}
+
+// compact merges the oldest files of the current file store into a new base
+// file store. If all is true, it merges all files, otherwise it merges just
+// enough of the oldest files to get down to opts.maxFileStores files (and
+// more if necessary to produce a file of at least opts.minCompactionBytes).
+// It returns the number of deleted keys that were dropped.
+func (rs *rowStore) compact(all bool) (int, error) {
+	rs.compactionMx.Lock()
+	defer rs.compactionMx.Unlock()
+
+	rs.mx.RLock()
+	fs := rs.fileStore
+	tombstones := rs.tombstones
+	rs.mx.RUnlock()
+
+	files := fs.files()
+	if len(files) <= 1 || (!all && len(files) <= rs.opts.maxFileStores) {
+		return 0, nil
+	}
+	n := len(files)
+	if !all {
+		n = len(files) - rs.opts.maxFileStores + 1
+		size := int64(0)
+		for _, filename := range files[:n] {
+			size += fileSize(filename)
+		}
+		for n < len(files) && size < rs.opts.minCompactionBytes {
+			size += fileSize(files[n])
+			n++
+		}
+	}
+	inputs := files[:n]
+	mergedDeltas := n
+	if fs.filename != "" {
+		mergedDeltas--
+	}
+
+	rs.mx.Lock()
+	for _, filename := range inputs {
+		rs.iterationsInProgress[filename]++
+	}
+	rs.mx.Unlock()
+	defer func() {
+		rs.mx.Lock()
+		for _, filename := range inputs {
+			rs.iterationsInProgress[filename]--
+		}
+		rs.mx.Unlock()
+	}()
+
+	start := time.Now()
+	newest := inputs[len(inputs)-1]
+	offsetsBySource, _, err := rs.t.readWALOffsets(newest)
+	if err != nil {
+		return 0, err
+	}
+	// Deltas that are newer than the base are the ones that haven't been merged
+	// into it, so name the new base after the newest delta merged into it (we
+	// always merge at least two files, so there is one).
+	nanos := fileStoreNanos(newest)
+	// Deltas flushed from now on have to sort after the new base
+	rs.advanceFileNanos(nanos)
+
+	shouldSort := rs.t.shouldSort()
+	if shouldSort {
+		defer rs.t.stopSorting()
+	}
+	out, err := ioutil.TempFile(rs.deltasDirName(), "nextcompaction")
+	if err != nil {
+		return 0, errors.New("Unable to create temp file for compaction: %v", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	input := &fileStore{t: rs.t, rs: rs, fields: rs.fields, filename: inputs[0], deltas: inputs[1:]}
+	_, rowCount, keysPurged, err := input.flush(out, rs.fields, nil, tombstones, offsetsBySource, nil, shouldSort, true, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := rs.syncFile(out); err != nil {
+		return 0, errors.New("Unable to sync compacted file store: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return 0, errors.New("Unable to close compacted file store: %v", err)
+	}
+	newFileStoreName := filepath.Join(rs.opts.dir, fmt.Sprintf("filestore_%020d_%d.dat", nanos, CurrentFileVersion))
+	if err := os.Rename(out.Name(), newFileStoreName); err != nil {
+		return 0, errors.New("Unable to move compacted file store into place at %v: %v", newFileStoreName, err)
+	}
+	if err := rs.syncDir(rs.opts.dir); err != nil {
+		return 0, err
+	}
+
+	newFS := &fileStore{t: rs.t, rs: rs, fields: rs.fields, filename: newFileStoreName}
+	rollupFile := ""
+	if len(rs.t.RollupBy) > 0 && n == len(files) {
+		var rollupErr error
+		rollupFile, rollupErr = rs.writeRollup(newFS, offsetsBySource)
+		if rollupErr != nil {
+			rs.t.log.Errorf("Unable to write rollup: %v", rollupErr)
+		}
+	}
+	rs.mx.Lock()
+	// Flushes may have added deltas in the meantime
+	newFS.deltas = append([]string(nil), rs.fileStore.deltas[mergedDeltas:]...)
+	rs.fileStore = newFS
+	if len(newFS.deltas) == 0 {
+		rs.rollupFile = rollupFile
+	}
+	rs.mx.Unlock()
+	if n == len(files) {
+		// Deltas flushed in the meantime already omit these deleted keys
+		rs.clearTombstones(tombstones)
+	}
+
+	rs.t.log.Debugf("Compacted %d file stores into %d rows at %v in %v", len(inputs), rowCount, newFileStoreName, time.Now().Sub(start))
+	return keysPurged, nil
+}
+
+// liveDeltas lists the deltas in dir that haven't been merged into the given
+// base file store yet, oldest first.
+func liveDeltas(dir string, base string) ([]string, error) {
+	files, err := listRegularFiles(filepath.Join(dir, deltasDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.New("Unable to list deltas in %v: %v", dir, err)
+	}
+	baseNanos := fileStoreNanos(base)
+	var deltas []string
+	for _, file := range files {
+		name := file.Name()
+		if isFileStoreName(name) && fileStoreNanos(name) > baseNanos {
+			deltas = append(deltas, filepath.Join(dir, deltasDir, name))
+		}
+	}
+	return deltas, nil
+}
+
+// removeOldDeltas removes deltas that have been merged into the base file
+// store and aren't being iterated on.
+func (rs *rowStore) removeOldDeltas() {
+	dir := rs.deltasDirName()
+	files, err := listRegularFiles(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			rs.t.log.Errorf("Unable to list deltas in %v: %v", dir, err)
+		}
+		return
+	}
+
+	rs.mx.RLock()
+	base := rs.fileStore.filename
+	rs.mx.RUnlock()
+	if base == "" || filepath.Dir(base) != rs.opts.dir {
+		// Until the base has been moved to durable storage, we may still need the
+		// deltas that it contains
+		return
+	}
+	fi, err := os.Stat(base)
+	if err != nil || time.Since(fi.ModTime()) < rs.opts.oldFileRetention {
+		// Read replicas may still be reading the deltas
+		return
+	}
+	baseNanos := fileStoreNanos(base)
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "filestore_") || fileStoreNanos(name) > baseNanos {
+			continue
+		}
+		filename := filepath.Join(dir, name)
+		rs.mx.RLock()
+		okayToRemove := rs.iterationsInProgress[filename] == 0
+		rs.mx.RUnlock()
+		if okayToRemove {
+			rs.t.log.Debugf("Removing merged delta %v", filename)
+			if err := os.Remove(filename); err != nil {
+				rs.t.log.Errorf("Unable to delete merged delta %v: %v", filename, err)
+			} else {
+				rs.t.db.invalidateSequenceCache(filename)
+			}
+		}
+	}
+}
+
+// nextFileNanos returns the timestamp to embed in the name of a new file store.
+// It's based on the current time but always greater than any timestamp
+// returned before, so that file stores written in quick succession (or while
+// the clock goes backwards) still get distinct names that sort in the order in
+// which they were written.
+func (rs *rowStore) nextFileNanos() int64 {
+	for {
+		last := atomic.LoadInt64(&rs.lastFileNanos)
+		next := time.Now().UnixNano()
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&rs.lastFileNanos, last, next) {
+			return next
+		}
+	}
+}
+
+// advanceFileNanos makes sure that nextFileNanos returns timestamps greater
+// than nanos from now on.
+func (rs *rowStore) advanceFileNanos(nanos int64) {
+	for {
+		last := atomic.LoadInt64(&rs.lastFileNanos)
+		if nanos <= last || atomic.CompareAndSwapInt64(&rs.lastFileNanos, last, nanos) {
+			return
+		}
+	}
+}
+
+// fileStoreNanos returns the timestamp embedded in the name of the given file
+// store, or 0 if it doesn't have one.
+func fileStoreNanos(filename string) int64 {
+	parts := strings.Split(filepath.Base(filename), "_")
+	if len(parts) != 3 {
+		return 0
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return nanos
+}
+
+func fileSize(filename string) int64 {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
@@ -0,0 +1,228 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompaction(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	open := func() (*DB, *table) {
+		db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		db.clock.Advance(epoch)
+		err = db.CreateTable(&TableOpts{
+			Name:            "compacted",
+			RetentionPeriod: 1 * time.Hour,
+			MaxFileStores:   3,
+			SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+		})
+		if !assert.NoError(t, err) {
+			db.Close()
+			t.FailNow()
+		}
+		return db, db.getTable("compacted")
+	}
+	db, tbl := open()
+	rs := tbl.rowStore
+
+	insert := func(keys ...string) {
+		var points []*Point
+		for _, k := range keys {
+			points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": 1}})
+		}
+		_, err := db.InsertBatch("compacted", points)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	read := func(tbl *table) map[string]float64 {
+		field := tbl.getFields()[0]
+		result := make(map[string]float64)
+		_, err := tbl.iterate(context.Background(), tbl.getFields(), false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			result[key.Get("k").(string)], _ = vals[0].ValueAtTime(epoch, field.Expr, tbl.Resolution)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+	numFiles := func() int {
+		rs.mx.RLock()
+		defer rs.mx.RUnlock()
+		return len(rs.fileStore.files())
+	}
+
+	insert("a", "b")
+	tbl.forceFlush()
+	insert("a", "c")
+	tbl.forceFlush()
+	insert("a", "d")
+	tbl.forceFlush()
+	assert.Equal(t, 3, numFiles(), "Each flush should have written a delta")
+	assert.Empty(t, rs.fileStore.filename, "No base file store should have been written yet")
+	expected := map[string]float64{"a": 3, "b": 1, "c": 1, "d": 1}
+	assert.Equal(t, expected, read(tbl), "Rows should be merged across deltas")
+
+	insert("a", "e")
+	tbl.forceFlush()
+	for i := 0; i < 100 && numFiles() > 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 3, numFiles(), "Compaction should have merged oldest files")
+	assert.NotEmpty(t, rs.fileStore.filename, "Compaction should have written base file store")
+	expected = map[string]float64{"a": 4, "b": 1, "c": 1, "d": 1, "e": 1}
+	assert.Equal(t, expected, read(tbl), "Compaction should not have changed data")
+
+	// Merged deltas are ignored after restarting
+	db.Close()
+	db, tbl = open()
+	rs = tbl.rowStore
+	assert.Equal(t, 3, numFiles())
+	assert.Equal(t, expected, read(tbl), "Data should be the same after reopening")
+
+	// Purging compacts all files
+	if !assert.NoError(t, tbl.DeleteKeys(bytemap.New(map[string]interface{}{"k": "b"}))) {
+		return
+	}
+	stats, err := tbl.PurgeDeleted(context.Background())
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, stats.KeysPurged)
+	}
+	assert.Equal(t, 1, numFiles(), "Purge should have merged all files")
+	assert.Empty(t, rs.getTombstones())
+	delete(expected, "b")
+	assert.Equal(t, expected, read(tbl))
+	db.Close()
+}
+
+func TestBackToBackFlushesGetDistinctNames(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "rapid",
+		RetentionPeriod: 1 * time.Hour,
+		MaxFileStores:   100,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("rapid")
+	rs := tbl.rowStore
+
+	for i := 0; i < 20; i++ {
+		_, err := db.InsertBatch("rapid", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}}})
+		if !assert.NoError(t, err) {
+			return
+		}
+		tbl.forceFlush()
+	}
+	rs.mx.RLock()
+	files := rs.fileStore.files()
+	rs.mx.RUnlock()
+	assert.Len(t, files, 20)
+	names := make(map[string]bool)
+	for i, filename := range files {
+		name := filepath.Base(filename)
+		assert.False(t, names[name], "File name %v should be unique", name)
+		names[name] = true
+		if i > 0 {
+			assert.True(t, name > filepath.Base(files[i-1]), "File names should sort in the order in which they were written")
+		}
+	}
+
+	// Even if the clock is behind the newest file, names keep increasing
+	future := time.Now().Add(1 * time.Hour).UnixNano()
+	rs.advanceFileNanos(future)
+	assert.Equal(t, future+1, rs.nextFileNanos())
+	assert.Equal(t, future+2, rs.nextFileNanos())
+}
+
+// BenchmarkFullFlush and BenchmarkIncrementalFlush compare the cost of
+// flushing memstores of different sizes into tables that already hold
+// different amounts of data. Full flushes rewrite all existing rows, so they
+// get slower as the table grows, whereas incremental flushes only write the
+// memstore, so their cost should only depend on the size of the memstore.
+func BenchmarkFullFlush(b *testing.B) {
+	doBenchmarkFlushes(b, 0)
+}
+
+func BenchmarkIncrementalFlush(b *testing.B) {
+	// Keep compaction from kicking in while benchmarking
+	doBenchmarkFlushes(b, 1000000)
+}
+
+func doBenchmarkFlushes(b *testing.B, maxFileStores int) {
+	for _, existingKeys := range []int{10000, 100000} {
+		for _, newKeysPerFlush := range []int{100, 1000} {
+			b.Run(fmt.Sprintf("existing=%d/new=%d", existingKeys, newKeysPerFlush), func(b *testing.B) {
+				doBenchmarkFlush(b, maxFileStores, existingKeys, newKeysPerFlush)
+			})
+		}
+	}
+}
+
+func doBenchmarkFlush(b *testing.B, maxFileStores int, existingKeys int, newKeysPerFlush int) {
+	tmpDir, err := ioutil.TempDir("", "zenodbbench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	err = db.CreateTable(&TableOpts{
+		Name:            "bench",
+		RetentionPeriod: 1 * time.Hour,
+		MaxFileStores:   maxFileStores,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("bench")
+
+	insert := func(from, n int) {
+		points := make([]*Point, 0, n)
+		for i := from; i < from+n; i++ {
+			points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": i}, Vals: map[string]interface{}{"v": 1}})
+		}
+		if _, err := db.InsertBatch("bench", points); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	insert(0, existingKeys)
+	tbl.forceFlush()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		insert(existingKeys+i*newKeysPerFlush, newKeysPerFlush)
+		b.StartTimer()
+		tbl.forceFlush()
+	}
+}
@@ -34,6 +34,10 @@ var (
 type Field struct {
 	Expr expr.Expr
 	Name string
+	// Retention, if positive, overrides the retention period of the table for
+	// this field. Only retentions shorter than the table's have an effect. It's
+	// not part of the field's identity, so it doesn't affect Equals.
+	Retention time.Duration
 }
 
 // NewField is a convenience method for creating new Fields.
@@ -176,6 +180,9 @@ type FlatRow struct {
 	Key bytemap.ByteMap
 	// Values for each field
 	Values []float64
+	// Nulls flags the Values for which there was no data, as opposed to data
+	// that happened to be zero. Nil if all Values had data.
+	Nulls  []bool
 	fields Fields
 }
 
@@ -183,6 +190,11 @@ func (row *FlatRow) SetFields(fields Fields) {
 	row.fields = fields
 }
 
+// IsNull indicates whether there was no data for the value at index i.
+func (row *FlatRow) IsNull(i int) bool {
+	return i < len(row.Nulls) && row.Nulls[i]
+}
+
 type Source interface {
 	GetGroupBy() []GroupBy
 
@@ -44,6 +44,11 @@ func (f *rowFilter) String() string {
 	return fmt.Sprintf("rowFilter %v", f.Label)
 }
 
+func (f *rowFilter) DescribePlan(node *PlanNode) {
+	node.Type = "filter"
+	node.Filter = f.Label
+}
+
 func FlatRowFilter(source FlatRowSource, label string, include func(ctx context.Context, row *FlatRow, fields Fields) (*FlatRow, error)) FlatRowSource {
 	return &flatRowFilter{
 		flatRowTransform{source},
@@ -81,3 +86,8 @@ func (f *flatRowFilter) Iterate(ctx context.Context, onFields OnFields, onRow On
 func (f *flatRowFilter) String() string {
 	return fmt.Sprintf("flatrowFilter %v", f.Label)
 }
+
+func (f *flatRowFilter) DescribePlan(node *PlanNode) {
+	node.Type = "filter"
+	node.Filter = f.Label
+}
@@ -71,6 +71,12 @@ func (f *flatten) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRo
 					anyNonConstantValueFound = true
 				}
 				row.Values[i] = val
+				if !found {
+					if row.Nulls == nil {
+						row.Nulls = make([]bool, numFields)
+					}
+					row.Nulls[i] = true
+				}
 			}
 			if anyNonConstantValueFound {
 				more, err := onRow(row)
@@ -87,3 +93,7 @@ func (f *flatten) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRo
 func (f *flatten) String() string {
 	return "flatten"
 }
+
+func (f *flatten) DescribePlan(node *PlanNode) {
+	node.Type = "flatten"
+}
@@ -3,8 +3,50 @@ package core
 import (
 	"bytes"
 	"strings"
+	"time"
 )
 
+// PlanNode is a machine-readable description of a Source in a query plan,
+// suitable for encoding as JSON.
+type PlanNode struct {
+	// Type identifies the kind of node, e.g. "table", "group" or "filter".
+	// Sources that don't describe themselves have type "source".
+	Type string `json:"type"`
+	// Description is the human-readable description used by FormatSource.
+	Description string `json:"description"`
+	// Table is the name of the table read by this node, if any.
+	Table string `json:"table,omitempty"`
+	// Fields are the names of the fields read by this node, if known.
+	Fields []string `json:"fields,omitempty"`
+	// GroupBy are the names of the dimensions by which this node's output is
+	// grouped.
+	GroupBy []string `json:"groupBy,omitempty"`
+	// Filter is the condition applied by filter nodes.
+	Filter string `json:"filter,omitempty"`
+	// OrderBy is the ordering applied by sort nodes.
+	OrderBy []string `json:"orderBy,omitempty"`
+	// Limit is the maximum number of rows returned by limit nodes.
+	Limit int `json:"limit,omitempty"`
+	// Offset is the number of rows skipped by offset nodes.
+	Offset int `json:"offset,omitempty"`
+	// Resolution is the resolution of this node's output.
+	Resolution string `json:"resolution,omitempty"`
+	// AsOf and Until bound the time window covered by this node's output.
+	AsOf  *time.Time `json:"asOf,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+	// Partitions are the partitions queried by cluster nodes, if known.
+	Partitions []int `json:"partitions,omitempty"`
+	// Source is the node from which this node reads, if any.
+	Source *PlanNode `json:"source,omitempty"`
+}
+
+// PlanDescriber is implemented by Sources that can describe their structure
+// in more detail than their String representation.
+type PlanDescriber interface {
+	// DescribePlan fills in the details of the given node.
+	DescribePlan(node *PlanNode)
+}
+
 func FormatSource(source Source) string {
 	result := &bytes.Buffer{}
 	doFormatSource(result, "", source)
@@ -27,3 +69,33 @@ func doFormatSource(result *bytes.Buffer, indent string, source Source) {
 		doFormatSource(result, indent, s)
 	}
 }
+
+// DescribeSource builds a PlanNode tree describing the given source and all of
+// the sources from which it reads.
+func DescribeSource(source Source) *PlanNode {
+	node := &PlanNode{
+		Type:        "source",
+		Description: source.String(),
+	}
+	for _, groupBy := range source.GetGroupBy() {
+		node.GroupBy = append(node.GroupBy, groupBy.Name)
+	}
+	if resolution := source.GetResolution(); resolution > 0 {
+		node.Resolution = resolution.String()
+	}
+	if asOf := source.GetAsOf(); !asOf.IsZero() {
+		node.AsOf = &asOf
+	}
+	if until := source.GetUntil(); !until.IsZero() {
+		node.Until = &until
+	}
+	if d, ok := source.(PlanDescriber); ok {
+		d.DescribePlan(node)
+	}
+	if t, ok := source.(Transform); ok {
+		if s := t.GetSource(); s != nil {
+			node.Source = DescribeSource(s)
+		}
+	}
+	return node
+}
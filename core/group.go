@@ -63,6 +63,12 @@ type GroupOpts struct {
 	AsOf                  time.Time
 	Until                 time.Time
 	StrideSlice           time.Duration
+	// Streaming indicates that the source yields each key at most once. When
+	// grouping by all dimensions without a crosstab, this allows rows to be
+	// emitted as they're read rather than after the whole source has been
+	// consumed, so that consumers like LIMIT can stop iteration early. Rows are
+	// emitted in source order rather than sorted by key.
+	Streaming bool
 }
 
 func Group(source RowSource, opts GroupOpts) RowSource {
@@ -111,6 +117,10 @@ func (g *group) GetUntil() time.Time {
 }
 
 func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (interface{}, error) {
+	if g.Streaming && len(g.By) == 0 && g.Crosstab == nil {
+		return g.iterateStreaming(ctx, onFields, onRow)
+	}
+
 	guard := Guard(ctx)
 
 	var sliceKey func(key bytemap.ByteMap) bytemap.ByteMap
@@ -269,6 +279,50 @@ func (g *group) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (in
 	return metadata, err
 }
 
+// iterateStreaming groups each row from the source on its own and emits it
+// immediately. This is only correct if the source never yields the same key
+// twice.
+func (g *group) iterateStreaming(ctx context.Context, onFields OnFields, onRow OnRow) (interface{}, error) {
+	guard := Guard(ctx)
+
+	var inFields Fields
+	var outFields Fields
+	if g.Fields == nil {
+		g.Fields = PassthroughFieldSource
+	}
+
+	return g.source.Iterate(ctx, func(fields Fields) error {
+		inFields = fields
+		var err error
+		outFields, err = g.Fields.Get(inFields)
+		if err != nil {
+			return err
+		}
+		return onFields(outFields)
+	}, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+		bt := bytetree.New(
+			outFields.Exprs(),
+			inFields.Exprs(),
+			g.GetResolution(),
+			g.source.GetResolution(),
+			g.GetAsOf(),
+			g.GetUntil(),
+			g.StrideSlice,
+		)
+		bt.Update(key, vals, nil, key)
+		more := true
+		err := bt.Walk(0, func(key []byte, data []encoding.Sequence) (bool, bool, error) {
+			var iterErr error
+			more, iterErr = onRow(key, data)
+			return more, true, iterErr
+		})
+		if !more || err != nil {
+			return false, err
+		}
+		return guard.Proceed()
+	})
+}
+
 func (g *group) String() string {
 	result := &bytes.Buffer{}
 	result.WriteString("group")
@@ -294,5 +348,12 @@ func (g *group) String() string {
 	if g.StrideSlice > 0 {
 		result.WriteString(fmt.Sprintf("\n       stride slice: %v", g.StrideSlice))
 	}
+	if g.Streaming {
+		result.WriteString("\n       streaming: true")
+	}
 	return result.String()
 }
+
+func (g *group) DescribePlan(node *PlanNode) {
+	node.Type = "group"
+}
@@ -24,7 +24,12 @@ func (l *limit) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow)
 		newIdx := atomic.AddInt64(&idx, 1)
 		oldIdx := int(newIdx - 1)
 		if oldIdx < l.limit {
-			return onRow(row)
+			more, err := onRow(row)
+			if oldIdx == l.limit-1 {
+				// That was the last row we need, stop iterating the source
+				more = false
+			}
+			return more, err
 		}
 		return stop()
 	})
@@ -33,3 +38,8 @@ func (l *limit) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow)
 func (l *limit) String() string {
 	return fmt.Sprintf("limit %d", l.limit)
 }
+
+func (l *limit) DescribePlan(node *PlanNode) {
+	node.Type = "limit"
+	node.Limit = l.limit
+}
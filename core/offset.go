@@ -36,3 +36,8 @@ func (o *offset) Iterate(ctx context.Context, onFields OnFields, onRow OnFlatRow
 func (o *offset) String() string {
 	return fmt.Sprintf("offset %d", o.offset)
 }
+
+func (o *offset) DescribePlan(node *PlanNode) {
+	node.Type = "offset"
+	node.Offset = o.offset
+}
@@ -88,6 +88,13 @@ func (s *sorter) String() string {
 	return fmt.Sprintf("order by %v", s.by)
 }
 
+func (s *sorter) DescribePlan(node *PlanNode) {
+	node.Type = "sort"
+	for _, by := range s.by {
+		node.OrderBy = append(node.OrderBy, by.String())
+	}
+}
+
 type orderedRows struct {
 	orderBy []OrderBy
 	rows    []*FlatRow
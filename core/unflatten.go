@@ -10,8 +10,18 @@ import (
 
 func Unflatten(source FlatRowSource, fields FieldSource) RowSource {
 	return &unflatten{
-		flatRowTransform{source},
-		fields,
+		flatRowTransform: flatRowTransform{source},
+		fields:           fields,
+	}
+}
+
+// UnflattenSkippingNulls is like Unflatten, but values that had no data are
+// left out of aggregations rather than being treated as zero.
+func UnflattenSkippingNulls(source FlatRowSource, fields FieldSource) RowSource {
+	return &unflatten{
+		flatRowTransform: flatRowTransform{source},
+		fields:           fields,
+		skipNulls:        true,
 	}
 }
 
@@ -29,7 +39,8 @@ func UnflattenOptimized(source FlatRowSource) RowSource {
 
 type unflatten struct {
 	flatRowTransform
-	fields FieldSource
+	fields    FieldSource
+	skipNulls bool
 }
 
 func (f *unflatten) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (interface{}, error) {
@@ -51,6 +62,9 @@ func (f *unflatten) Iterate(ctx context.Context, onFields OnFields, onRow OnRow)
 		outRow := make(Vals, numOut)
 		params := expr.Map(make(map[string]float64, numIn))
 		for i, field := range inFields {
+			if f.skipNulls && row.IsNull(i) {
+				continue
+			}
 			name := field.Name
 			params[name] = row.Values[i]
 		}
@@ -62,8 +76,16 @@ func (f *unflatten) Iterate(ctx context.Context, onFields OnFields, onRow OnRow)
 }
 
 func (f *unflatten) String() string {
+	skipping := ""
+	if f.skipNulls {
+		skipping = " skipping nulls"
+	}
 	if f.fields == PassthroughFieldSource {
-		return "unflatten all"
+		return "unflatten all" + skipping
 	}
-	return fmt.Sprintf("unflatten to %v", f.fields)
+	return fmt.Sprintf("unflatten to %v%v", f.fields, skipping)
+}
+
+func (f *unflatten) DescribePlan(node *PlanNode) {
+	node.Type = "unflatten"
 }
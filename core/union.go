@@ -0,0 +1,123 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+)
+
+// Union creates a RowSource that yields the rows of all of the given sources,
+// one source after the other. All sources need to have the same resolution
+// and yield fields with the same names. The metadata returned by the sources
+// is combined with mergeMetadata. If mergeMetadata is nil, the metadata of the
+// last source that returned any is used.
+func Union(mergeMetadata func(a interface{}, b interface{}) interface{}, sources ...RowSource) (RowSource, error) {
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("Union requires at least one source")
+	}
+	resolution := sources[0].GetResolution()
+	for _, source := range sources[1:] {
+		if source.GetResolution() != resolution {
+			return nil, fmt.Errorf("Unable to union sources with resolutions %v and %v", resolution, source.GetResolution())
+		}
+	}
+	return &union{sources: sources, mergeMetadata: mergeMetadata}, nil
+}
+
+type union struct {
+	sources       []RowSource
+	mergeMetadata func(a interface{}, b interface{}) interface{}
+}
+
+func (u *union) Iterate(ctx context.Context, onFields OnFields, onRow OnRow) (interface{}, error) {
+	var fields Fields
+	var metadata interface{}
+	for i, source := range u.sources {
+		more := true
+		sourceMetadata, err := source.Iterate(ctx, func(sourceFields Fields) error {
+			if i == 0 {
+				fields = sourceFields
+				return onFields(fields)
+			}
+			if !namesEqual(fields.Names(), sourceFields.Names()) {
+				return fmt.Errorf("Unable to union fields %v with fields %v", strings.Join(fields.Names(), ", "), strings.Join(sourceFields.Names(), ", "))
+			}
+			return nil
+		}, func(key bytemap.ByteMap, vals Vals) (bool, error) {
+			var rowErr error
+			more, rowErr = onRow(key, vals)
+			return more, rowErr
+		})
+		if sourceMetadata != nil {
+			if metadata != nil && u.mergeMetadata != nil {
+				metadata = u.mergeMetadata(metadata, sourceMetadata)
+			} else {
+				metadata = sourceMetadata
+			}
+		}
+		if err != nil || !more {
+			return metadata, err
+		}
+	}
+	return metadata, nil
+}
+
+func namesEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, name := range a {
+		if b[i] != name {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *union) GetGroupBy() []GroupBy {
+	return u.sources[0].GetGroupBy()
+}
+
+func (u *union) GetResolution() time.Duration {
+	return u.sources[0].GetResolution()
+}
+
+// GetAsOf returns the earliest asOf of all sources.
+func (u *union) GetAsOf() time.Time {
+	asOf := u.sources[0].GetAsOf()
+	for _, source := range u.sources[1:] {
+		if sourceAsOf := source.GetAsOf(); sourceAsOf.Before(asOf) {
+			asOf = sourceAsOf
+		}
+	}
+	return asOf
+}
+
+// GetUntil returns the latest until of all sources.
+func (u *union) GetUntil() time.Time {
+	until := u.sources[0].GetUntil()
+	for _, source := range u.sources[1:] {
+		if sourceUntil := source.GetUntil(); sourceUntil.After(until) {
+			until = sourceUntil
+		}
+	}
+	return until
+}
+
+func (u *union) String() string {
+	result := &bytes.Buffer{}
+	result.WriteString("union all")
+	for _, source := range u.sources {
+		result.WriteByte('\n')
+		result.WriteString(strings.TrimRight(FormatSource(source), "\n"))
+	}
+	return result.String()
+}
+
+func (u *union) DescribePlan(node *PlanNode) {
+	node.Type = "union"
+}
@@ -0,0 +1,125 @@
+package zenodb
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+const keySkippedFiles = "zenodb.skippedFiles"
+
+// skippedFiles collects the names of corrupt files that were skipped while
+// iterating.
+type skippedFiles struct {
+	filenames []string
+	mx        sync.Mutex
+}
+
+// withSkippedFiles returns a context under which iterating over file stores
+// skips corrupt files rather than failing, recording them in
+// the returned skippedFiles. Without it (e.g. when flushing or compacting),
+// corrupt files still cause iteration to fail, since skipping them would
+// permanently drop their data from the new file.
+func withSkippedFiles(ctx context.Context) (context.Context, *skippedFiles) {
+	skipped := &skippedFiles{}
+	return context.WithValue(ctx, keySkippedFiles, skipped), skipped
+}
+
+// skippedFilesFrom returns the skippedFiles of the given context, or nil if
+// corrupt files aren't supposed to be skipped.
+func skippedFilesFrom(ctx context.Context) *skippedFiles {
+	skipped, _ := ctx.Value(keySkippedFiles).(*skippedFiles)
+	return skipped
+}
+
+func (sf *skippedFiles) add(filenames ...string) {
+	sf.mx.Lock()
+	sf.filenames = append(sf.filenames, filenames...)
+	sf.mx.Unlock()
+}
+
+func (sf *skippedFiles) get() []string {
+	sf.mx.Lock()
+	defer sf.mx.Unlock()
+	return append([]string(nil), sf.filenames...)
+}
+
+// skipCorrupt determines whether to skip the rest of this file after
+// encountering the given error while reading it. If ctx allows skipping (see
+// withSkippedFiles), the file is recorded as skipped and the query continues
+// without it. The error may not have been caused by corruption (e.g. a
+// transient I/O error), so the file is only quarantined once the row store has
+// verified that it's corrupt, see verifyCorruptLater. Read replicas leave that
+// to the writer.
+func (fs *fileStore) skipCorrupt(ctx context.Context, err error) bool {
+	skipped := skippedFilesFrom(ctx)
+	if skipped == nil || ctx.Err() != nil {
+		return false
+	}
+	fs.t.log.Errorf("Skipping rest of possibly corrupt file %v: %v", fs.filename, err)
+	if fs.rs != nil && !fs.rs.opts.readOnly {
+		fs.rs.verifyCorruptLater(fs.filename)
+	}
+	skipped.add(fs.filename)
+	return true
+}
+
+// verifyCorruptLater runs verifyCorrupt for the named file in the background,
+// unless it's already being verified.
+func (rs *rowStore) verifyCorruptLater(filename string) {
+	rs.mx.Lock()
+	if rs.corruptionChecks[filename] {
+		rs.mx.Unlock()
+		return
+	}
+	rs.corruptionChecks[filename] = true
+	rs.mx.Unlock()
+
+	go func() {
+		rs.verifyCorrupt(filename)
+		rs.mx.Lock()
+		delete(rs.corruptionChecks, filename)
+		rs.mx.Unlock()
+	}()
+}
+
+// verifyCorrupt reads the named file again and quarantines it in the corrupted
+// subdirectory if it still can't be read, so that subsequent queries don't trip
+// over it. This holds compactionMx so that the file can't be replaced in the
+// meantime, and leaves the file alone if it's no longer part of the file store
+// (e.g. because it was compacted) or can't be opened at all, since that doesn't
+// tell us anything about its contents.
+func (rs *rowStore) verifyCorrupt(filename string) {
+	rs.compactionMx.Lock()
+	defer rs.compactionMx.Unlock()
+
+	rs.mx.RLock()
+	current := rs.fileStore
+	rs.mx.RUnlock()
+	found := false
+	for _, file := range current.files() {
+		if file == filename {
+			found = true
+			break
+		}
+	}
+	if !found {
+		rs.t.log.Debugf("%v is no longer part of the file store, not verifying it", filename)
+		return
+	}
+	if _, err := os.Stat(filename); err != nil {
+		rs.t.log.Errorf("Unable to stat %v, not verifying it: %v", filename, err)
+		return
+	}
+
+	fs := &fileStore{t: rs.t, rs: rs, fields: rs.fields, filename: filename}
+	err := rs.checkReadable(fs, false)
+	if err == nil {
+		rs.t.log.Debugf("%v is readable after all, not quarantining it", filename)
+		return
+	}
+	rs.t.log.Errorf("Quarantining corrupt file %v: %v", filename, err)
+	if markErr := fs.markCorrupted(); markErr != nil {
+		rs.t.log.Error(markErr)
+	}
+}
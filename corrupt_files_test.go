@@ -0,0 +1,105 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipCorruptFile(t *testing.T) {
+	tbl, cleanup := newManyFilesTable(t, &DBOpts{}, 3, 100)
+	defer cleanup()
+
+	tbl.rowStore.mx.RLock()
+	files := tbl.rowStore.fileStore.files()
+	tbl.rowStore.mx.RUnlock()
+	if !assert.Len(t, files, 3) {
+		return
+	}
+	corrupt := files[1]
+	fi, err := os.Stat(corrupt)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, os.Truncate(corrupt, fi.Size()/2)) {
+		return
+	}
+
+	query := func() (int, float64, []string) {
+		source, err := tbl.db.Query("SELECT v FROM manyfiles", false, nil, false)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		rows := 0
+		total := float64(0)
+		result, err := source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			rows++
+			total += row.Values[0]
+			return true, nil
+		})
+		if !assert.NoError(t, err, "Corrupt file should not fail query") {
+			t.FailNow()
+		}
+		return rows, total, result.(*common.QueryStats).SkippedFiles
+	}
+
+	// Consecutive files share half of their keys, so all keys are still present
+	// but the middle file's values are missing
+	rows, total, skipped := query()
+	assert.Equal(t, 200, rows)
+	assert.EqualValues(t, 200, total)
+	assert.Equal(t, []string{corrupt}, skipped)
+
+	// The row store verifies that the file is corrupt in the background
+	dir, file := filepath.Split(corrupt)
+	quarantined := filepath.Join(dir, "corrupted", file)
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(quarantined); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, err, "Corrupt file should have been quarantined")
+	_, err = os.Stat(corrupt)
+	assert.True(t, os.IsNotExist(err), "Corrupt file should have been moved out of the way")
+
+	rows, total, skipped = query()
+	assert.Equal(t, 200, rows)
+	assert.EqualValues(t, 200, total)
+	assert.Empty(t, skipped, "Quarantined file should not be read again")
+}
+
+func TestVerifyCorruptLeavesReadableFiles(t *testing.T) {
+	tbl, cleanup := newManyFilesTable(t, &DBOpts{}, 2, 10)
+	defer cleanup()
+
+	rs := tbl.rowStore
+	rs.mx.RLock()
+	files := rs.fileStore.files()
+	rs.mx.RUnlock()
+	if !assert.Len(t, files, 2) {
+		return
+	}
+
+	// A file that failed to read during a query (e.g. due to a transient I/O
+	// error) but reads fine now stays where it is
+	rs.verifyCorrupt(files[1])
+	_, err := os.Stat(files[1])
+	assert.NoError(t, err, "Readable file should not have been quarantined")
+
+	// So does a corrupt file that's no longer part of the file store
+	stale := filepath.Join(filepath.Dir(files[1]), "filestore_stale.dat")
+	if !assert.NoError(t, ioutil.WriteFile(stale, []byte("garbage"), 0644)) {
+		return
+	}
+	rs.verifyCorrupt(stale)
+	_, err = os.Stat(stale)
+	assert.NoError(t, err, "File outside of the file store should not have been quarantined")
+}
@@ -0,0 +1,176 @@
+package zenodb
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// CSVExportOpts configures an export of a table to CSV.
+type CSVExportOpts struct {
+	// AsOf limits the export to periods at or after this time. The export never
+	// includes periods before the table's retention period.
+	AsOf time.Time
+	// Until limits the export to periods at or before this time. If zero, the
+	// export is not limited.
+	Until time.Time
+	// IncludeMemStore indicates whether to include data that hasn't been flushed
+	// to disk yet.
+	IncludeMemStore bool
+}
+
+// ExportCSV writes the contents of the named table to w as CSV. See
+// table.ExportCSV.
+func (db *DB) ExportCSV(ctx context.Context, table string, w io.Writer, opts *CSVExportOpts) error {
+	t := db.getTable(table)
+	if t == nil {
+		return errors.New("Table %v not found", table)
+	}
+	return t.ExportCSV(ctx, w, opts)
+}
+
+// ExportCSV writes the contents of this table to w as CSV. The first row is a
+// header containing _time followed by the dimension names and field names.
+// Each subsequent row contains the values for a single key and period, with
+// the period's timestamp formatted as RFC3339. Dimensions and fields without
+// a value are left empty.
+//
+// If the table groups by specific dimensions, those are used as the dimension
+// columns. Otherwise, the table is scanned once up front to determine which
+// dimensions are present.
+func (t *table) ExportCSV(ctx context.Context, w io.Writer, opts *CSVExportOpts) error {
+	if opts == nil {
+		opts = &CSVExportOpts{}
+	}
+	asOf := opts.AsOf
+	truncateBefore := t.truncateBefore()
+	if asOf.Before(truncateBefore) {
+		asOf = truncateBefore
+	}
+	until := opts.Until
+
+	fields := t.getFields()
+	dims, err := t.csvDims(ctx, opts.IncludeMemStore, truncateBefore)
+	if err != nil {
+		return err
+	}
+
+	out := csv.NewWriter(w)
+	header := make([]string, 0, 1+len(dims)+len(fields))
+	header = append(header, "_time")
+	header = append(header, dims...)
+	header = append(header, fields.Names()...)
+	if err := out.Write(header); err != nil {
+		return errors.New("Unable to write CSV header: %v", err)
+	}
+
+	record := make([]string, len(header))
+	_, err = t.iterateWithTruncateBefore(ctx, fields, opts.IncludeMemStore, truncateBefore, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		for i, dim := range dims {
+			record[1+i] = csvValue(key.Get(dim))
+		}
+		for _, ts := range periodsIn(vals, fields, t.Resolution, asOf, until) {
+			record[0] = ts.UTC().Format(time.RFC3339)
+			for i, field := range fields {
+				record[1+len(dims)+i] = ""
+				if i < len(vals) {
+					val, found := vals[i].ValueAtTime(ts, field.Expr, t.Resolution)
+					if found {
+						record[1+len(dims)+i] = formatValue(val)
+					}
+				}
+			}
+			if err := out.Write(record); err != nil {
+				return false, errors.New("Unable to write CSV row: %v", err)
+			}
+		}
+		return ctx.Err() == nil, ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return errors.New("Unable to flush CSV: %v", err)
+	}
+	return nil
+}
+
+// csvDims determines the dimension columns for a CSV export.
+func (t *table) csvDims(ctx context.Context, includeMemStore bool, truncateBefore time.Time) ([]string, error) {
+	if !t.GroupByAll && len(t.GroupBy) > 0 {
+		dims := make([]string, 0, len(t.GroupBy))
+		for _, groupBy := range t.GroupBy {
+			dims = append(dims, groupBy.Name)
+		}
+		return dims, nil
+	}
+
+	dimsMap := make(map[string]bool)
+	_, err := t.iterateWithTruncateBefore(ctx, t.getFields(), includeMemStore, truncateBefore, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		for dim := range key.AsMap() {
+			dimsMap[dim] = true
+		}
+		return ctx.Err() == nil, ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	dims := make([]string, 0, len(dimsMap))
+	for dim := range dimsMap {
+		dims = append(dims, dim)
+	}
+	sort.Strings(dims)
+	return dims, nil
+}
+
+// periodsIn returns the timestamps of all periods between asOf and until (if
+// non-zero) for which at least one of the given sequences has a value, in
+// chronological order.
+func periodsIn(vals []encoding.Sequence, fields core.Fields, resolution time.Duration, asOf time.Time, until time.Time) []time.Time {
+	tss := make(map[int64]time.Time)
+	for i, seq := range vals {
+		if i >= len(fields) || len(seq) == 0 {
+			continue
+		}
+		e := fields[i].Expr
+		seqUntil := seq.Until()
+		numPeriods := seq.NumPeriods(e.EncodedWidth())
+		for p := 0; p < numPeriods; p++ {
+			ts := seqUntil.Add(-1 * time.Duration(p) * resolution)
+			if ts.Before(asOf) {
+				break
+			}
+			if !until.IsZero() && ts.After(until) {
+				continue
+			}
+			if _, found := seq.ValueAt(p, e); found {
+				tss[ts.UnixNano()] = ts
+			}
+		}
+	}
+	result := make([]time.Time, 0, len(tss))
+	for _, ts := range tss {
+		result = append(result, ts)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Before(result[j])
+	})
+	return result
+}
+
+func csvValue(val interface{}) string {
+	if val == nil {
+		return ""
+	}
+	return fmt.Sprint(val)
+}
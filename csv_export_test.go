@@ -0,0 +1,68 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportCSV(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "exported", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch.Add(2 * time.Second))
+	_, err := db.InsertBatch("exported", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch.Add(time.Second), Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1.5}},
+		{TS: epoch.Add(time.Second), Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 2}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	export := func(opts *CSVExportOpts) [][]string {
+		buf := &bytes.Buffer{}
+		if !assert.NoError(t, db.ExportCSV(context.Background(), "exported", buf, opts)) {
+			t.FailNow()
+		}
+		records, err := csv.NewReader(buf).ReadAll()
+		if !assert.NoError(t, err) || !assert.NotEmpty(t, records) {
+			t.FailNow()
+		}
+		rows := records[1:]
+		sort.Slice(rows, func(i, j int) bool {
+			return rows[i][0]+rows[i][1] < rows[j][0]+rows[j][1]
+		})
+		return records
+	}
+
+	records := export(&CSVExportOpts{IncludeMemStore: true})
+	assert.Equal(t, [][]string{
+		{"_time", "k", "_points", "v"},
+		{"2015-01-01T02:03:04Z", "a", "1", "1"},
+		{"2015-01-01T02:03:05Z", "a", "1", "1.5"},
+		{"2015-01-01T02:03:05Z", "b", "1", "2"},
+	}, records)
+
+	records = export(&CSVExportOpts{AsOf: epoch.Add(time.Second), IncludeMemStore: true})
+	assert.Equal(t, [][]string{
+		{"_time", "k", "_points", "v"},
+		{"2015-01-01T02:03:05Z", "a", "1", "1.5"},
+		{"2015-01-01T02:03:05Z", "b", "1", "2"},
+	}, records)
+
+	records = export(&CSVExportOpts{Until: epoch, IncludeMemStore: true})
+	assert.Equal(t, [][]string{
+		{"_time", "k", "_points", "v"},
+		{"2015-01-01T02:03:04Z", "a", "1", "1"},
+	}, records)
+
+	records = export(nil)
+	assert.Equal(t, [][]string{{"_time", "k", "_points", "v"}}, records, "Unflushed data should be excluded by default")
+}
@@ -0,0 +1,119 @@
+package zenodb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	deadLetterDir = "deadletter"
+)
+
+// checkReadable reads the given file store on its own, the same way that a
+// flush would, to tell whether a failed flush was caused by the file store or
+// by the memstore that was being flushed into it.
+func (rs *rowStore) checkReadable(fs *fileStore, rawOkay bool) (err error) {
+	if fs.filename == "" && len(fs.deltas) == 0 {
+		// nothing to read
+		return nil
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Recovered from panic on reading file store: %v", r)
+		}
+	}()
+	_, err = fs.iterate(rs.fields, nil, false, rawOkay, fs.t.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		return true, nil
+	})
+	return
+}
+
+// quarantine persists the contents of a memstore that repeatedly failed to
+// flush to a dead letter file for manual inspection. The file is stored in the
+// deadletter subdirectory of the table's directory and is encoded as:
+//
+//	fieldslength|fields|row1|row2|...
+//
+// fieldslength is 32 bits and fields are the table's fields delimited like in
+// the current file store version. Each row is encoded like a file store row,
+// except that columns are not encoded with a codec.
+func (rs *rowStore) quarantine(ms *memstore) (string, error) {
+	dir := filepath.Join(rs.opts.dir, deadLetterDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", errors.New("Unable to create dead letter directory %v: %v", dir, err)
+	}
+
+	filename := filepath.Join(dir, fmt.Sprintf("memstore_%020d.dat", time.Now().UnixNano()))
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return "", errors.New("Unable to create dead letter file %v: %v", filename, err)
+	}
+	defer file.Close()
+
+	out := bufio.NewWriter(file)
+	fieldStrings := make([]string, 0, len(ms.fields))
+	for _, field := range ms.fields {
+		fieldStrings = append(fieldStrings, field.String())
+	}
+	fieldsBytes := []byte(strings.Join(fieldStrings, fieldsDelims[CurrentFileVersion]))
+	err = binary.Write(out, encoding.Binary, uint32(len(fieldsBytes)))
+	if err == nil {
+		_, err = out.Write(fieldsBytes)
+	}
+	if err != nil {
+		return "", errors.New("Unable to write fields to dead letter file %v: %v", filename, err)
+	}
+
+	err = rs.writeDeadLetterRows(out, ms)
+	if err != nil {
+		// Keep what we were able to write
+		rs.t.log.Errorf("Unable to write all rows to dead letter file %v: %v", filename, err)
+	}
+
+	err = out.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return "", errors.New("Unable to flush dead letter file %v: %v", filename, err)
+	}
+	return filename, nil
+}
+
+func (rs *rowStore) writeDeadLetterRows(out *bufio.Writer, ms *memstore) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("Recovered from panic writing dead letter rows: %v", r)
+		}
+	}()
+
+	return ms.walk(time.Now().UnixNano(), func(key []byte, columns []encoding.Sequence) (bool, bool, error) {
+		rowLength := encoding.Width64bits + encoding.Width16bits + len(key) + encoding.Width16bits
+		for _, col := range columns {
+			rowLength += encoding.Width64bits + len(col)
+		}
+		b := make([]byte, rowLength)
+		remain := encoding.WriteInt64(b, rowLength)
+		remain = encoding.WriteInt16(remain, len(key))
+		remain = remain[copy(remain, key):]
+		remain = encoding.WriteInt16(remain, len(columns))
+		for _, col := range columns {
+			remain = encoding.WriteInt64(remain, len(col))
+		}
+		for _, col := range columns {
+			remain = remain[copy(remain, col):]
+		}
+		_, writeErr := out.Write(b)
+		return writeErr == nil, true, writeErr
+	})
+}
@@ -0,0 +1,126 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuarantineUnflushableMemStore(t *testing.T) {
+	h := &hooks{}
+	h.flushRow = func(key bytemap.ByteMap) error {
+		if key.Get("k") == "poison" {
+			return fmt.Errorf("Unable to flush poisoned key")
+		}
+		return nil
+	}
+
+	db, cleanup := newTestDB(t, &DBOpts{hooks: h}, "poisoned", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	db.clock.Advance(testEpoch)
+	insert := func(ks ...string) {
+		insertKeys(t, db, "poisoned", testEpoch, ks...)
+	}
+
+	insert("a", "poison")
+	tbl := db.getTable("poisoned")
+	tbl.forceFlush()
+
+	deadLetters, err := ioutil.ReadDir(filepath.Join(tbl.rowStore.opts.dir, deadLetterDir))
+	if assert.NoError(t, err) && assert.Len(t, deadLetters, 1) {
+		assert.True(t, deadLetters[0].Size() > 0, "Dead letter file should contain the quarantined memstore")
+	}
+
+	// Subsequent data should flush normally
+	insert("b")
+	tbl.forceFlush()
+
+	var keys []string
+	_, err = tbl.iterate(context.Background(), tbl.getFields(), false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		keys = append(keys, key.Get("k").(string))
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b"}, keys)
+}
+
+func TestKeepMemStoreIfQuarantineFails(t *testing.T) {
+	h := &hooks{}
+	h.flushRow = func(key bytemap.ByteMap) error {
+		if key.Get("k") == "poison" {
+			return fmt.Errorf("Unable to flush poisoned key")
+		}
+		return nil
+	}
+
+	failures := int32(0)
+	db, cleanup := newTestDB(t, &DBOpts{
+		hooks:             h,
+		FlushRetries:      1,
+		FlushRetryBackoff: time.Millisecond,
+		OnFlushFailure: func(table string, err error) {
+			atomic.AddInt32(&failures, 1)
+		},
+	}, "poisoned", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	tbl := db.getTable("poisoned")
+	// Block creation of the dead letter directory
+	if !assert.NoError(t, ioutil.WriteFile(filepath.Join(tbl.rowStore.opts.dir, deadLetterDir), []byte("blocked"), 0644)) {
+		return
+	}
+
+	db.clock.Advance(testEpoch)
+	insertKeys(t, db, "poisoned", testEpoch, "a", "poison")
+	tbl.forceFlush()
+
+	assert.EqualValues(t, 1, atomic.LoadInt32(&failures), "Flush should have failed")
+	stats := db.TableStats("poisoned")
+	assert.NotEmpty(t, stats.RowStore.LastFlushError)
+	assert.True(t, stats.RowStore.MemStoreBytes > 0, "Memstore should have been kept")
+
+	// Once the dead letter file can be written, the memstore is quarantined
+	if !assert.NoError(t, os.Remove(filepath.Join(tbl.rowStore.opts.dir, deadLetterDir))) {
+		return
+	}
+	tbl.forceFlush()
+	deadLetters, err := ioutil.ReadDir(filepath.Join(tbl.rowStore.opts.dir, deadLetterDir))
+	if assert.NoError(t, err) {
+		assert.Len(t, deadLetters, 1)
+	}
+}
+
+func TestDontQuarantineMemStoreIfFileStoreUnreadable(t *testing.T) {
+	panicked := int32(0)
+	db, cleanup := newTestDB(t, &DBOpts{
+		Panic: func(err interface{}) {
+			atomic.AddInt32(&panicked, 1)
+		},
+	}, "corrupted", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	db.clock.Advance(testEpoch)
+	insertKeys(t, db, "corrupted", testEpoch, "a")
+	tbl := db.getTable("corrupted")
+	tbl.forceFlush()
+	// Cut off everything after the header
+	if !assert.NoError(t, os.Truncate(tbl.rowStore.fileStore.filename, fileHeaderLength)) {
+		return
+	}
+
+	insertKeys(t, db, "corrupted", testEpoch, "b")
+	tbl.forceFlush()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&panicked), "Unreadable file store should have caused a panic")
+	_, err := os.Stat(filepath.Join(tbl.rowStore.opts.dir, deadLetterDir))
+	assert.True(t, os.IsNotExist(err), "Memstore shouldn't have been quarantined")
+}
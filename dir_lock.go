@@ -0,0 +1,136 @@
+package zenodb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/shirou/gopsutil/process"
+)
+
+const (
+	dirLockSuffix = ".lock"
+)
+
+var (
+	// lockedDirs tracks the directories locked by tables in this process. Since
+	// lock files record the PID of the owning process, this is what allows us to
+	// detect conflicts between multiple DBs in the same process.
+	lockedDirs   = make(map[string]bool)
+	lockedDirsMx sync.Mutex
+)
+
+// dirLock is an exclusive lock on a table's data directory, which prevents two
+// live tables from flushing into the same directory. The lock is held by
+// creating a lock file next to the directory that contains the PID of the
+// owning process.
+type dirLock struct {
+	dir      string
+	filename string
+	released bool
+}
+
+// lockDir locks the given directory, failing if it's already locked by another
+// live table. Lock files left behind by processes that are no longer running
+// are considered stale and are replaced.
+func lockDir(dir string) (*dirLock, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, errors.New("Unable to determine absolute path of %v: %v", dir, err)
+	}
+	filename := dir + dirLockSuffix
+
+	lockedDirsMx.Lock()
+	defer lockedDirsMx.Unlock()
+	if lockedDirs[dir] {
+		return nil, errors.New("Directory %v is already in use by another table in this process", dir)
+	}
+
+	for {
+		file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(file, "%d", os.Getpid())
+			closeErr := file.Close()
+			if err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(filename)
+				return nil, errors.New("Unable to write lock file %v: %v", filename, err)
+			}
+			lockedDirs[dir] = true
+			return &dirLock{dir: dir, filename: filename}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, errors.New("Unable to create lock file %v: %v", filename, err)
+		}
+
+		pid, stale := dirLockIsStale(filename)
+		if !stale {
+			return nil, errors.New("Directory %v is already in use by process %d, remove %v if that's not the case", dir, pid, filename)
+		}
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return nil, errors.New("Unable to remove stale lock file %v: %v", filename, err)
+		}
+	}
+}
+
+// dirLockIsStale checks whether the given lock file was left behind by a
+// process that's no longer running, returning the PID recorded in the file.
+func dirLockIsStale(filename string) (int, bool) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		// Either it's gone or we can't look at it, either way try again
+		return 0, true
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, true
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		// Garbage, possibly from a crash while writing the lock file
+		return 0, true
+	}
+	if pid == os.Getpid() {
+		// We're not tracking it in lockedDirs, so it must be from an earlier
+		// process that happened to have the same PID
+		return pid, true
+	}
+	exists, err := process.PidExists(int32(pid))
+	if err != nil || !exists {
+		return pid, err == nil
+	}
+	p, err := process.NewProcess(int32(pid))
+	if err != nil {
+		return pid, false
+	}
+	createTime, err := p.CreateTime()
+	if err == nil && time.Unix(0, createTime*int64(time.Millisecond)).After(fi.ModTime()) {
+		// The process started after the lock file was written, so the PID has
+		// been reused
+		return pid, true
+	}
+	return pid, false
+}
+
+// release releases this lock. Releasing an already released lock does nothing.
+func (l *dirLock) release() error {
+	lockedDirsMx.Lock()
+	defer lockedDirsMx.Unlock()
+	if l.released {
+		return nil
+	}
+	l.released = true
+	delete(lockedDirs, l.dir)
+	if err := os.Remove(l.filename); err != nil && !os.IsNotExist(err) {
+		return errors.New("Unable to remove lock file %v: %v", l.filename, err)
+	}
+	return nil
+}
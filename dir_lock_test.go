@@ -0,0 +1,81 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirLock(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "locked", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	tableOpts := func() *TableOpts {
+		return &TableOpts{
+			Name:            "locked",
+			RetentionPeriod: 1 * time.Hour,
+			SQL:             "SELECT v FROM inbound GROUP BY k, period(1s)",
+		}
+	}
+
+	other, err := NewDB(&DBOpts{Dir: db.opts.Dir, VirtualTime: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer other.Close()
+	err = other.CreateTable(tableOpts())
+	if assert.Error(t, err, "Should not be able to open a second table on the same directory") {
+		assert.Contains(t, err.Error(), "already in use")
+	}
+
+	lockFile := filepath.Join(db.opts.Dir, "locked") + dirLockSuffix
+	_, err = os.Stat(lockFile)
+	assert.NoError(t, err, "Lock file should remain for first table")
+
+	db.Close()
+	_, err = os.Stat(lockFile)
+	assert.True(t, os.IsNotExist(err), "Closing should have released lock")
+
+	// Leave behind a stale lock
+	if !assert.NoError(t, ioutil.WriteFile(lockFile, []byte("not a pid"), 0644)) {
+		return
+	}
+	reopened, err := NewDB(&DBOpts{Dir: db.opts.Dir, VirtualTime: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer reopened.Close()
+	assert.NoError(t, reopened.CreateTable(tableOpts()), "Stale lock should have been replaced")
+}
+
+func TestDirLockIsStale(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	lockFile := filepath.Join(tmpDir, "table"+dirLockSuffix)
+	write := func(contents string) {
+		if !assert.NoError(t, ioutil.WriteFile(lockFile, []byte(contents), 0644)) {
+			t.FailNow()
+		}
+	}
+
+	write("garbage")
+	_, stale := dirLockIsStale(lockFile)
+	assert.True(t, stale, "Unparseable lock should be stale")
+
+	write("1")
+	pid, stale := dirLockIsStale(lockFile)
+	assert.Equal(t, 1, pid)
+	assert.False(t, stale, "Lock held by live process should not be stale")
+
+	write("999999999")
+	_, stale = dirLockIsStale(lockFile)
+	assert.True(t, stale, "Lock held by missing process should be stale")
+}
@@ -0,0 +1,152 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/bytetree"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// rebuildRequest asks the processInserts loop to replace all of the row
+// store's data with the contents of ms.
+type rebuildRequest struct {
+	ms   *memstore
+	done chan interface{}
+}
+
+// CreateRollup creates a table with the given name that holds the data of the
+// base table downsampled to the given resolution, which must be a multiple of
+// the base table's resolution. The rollup has the same dimensions and
+// retention period as the base table. If fields are specified, the rollup only
+// includes those fields of the base table, otherwise it includes all of them.
+//
+// Rather than reading from the WAL, rollups are periodically rebuilt (see
+// DBOpts.RollupInterval) from the data that the base table has flushed to disk,
+// so they lag behind the base table by up to that interval plus the base
+// table's flush latency.
+//
+// Queries against the base table that don't include the memstore and that
+// group by a period which is a multiple of a rollup's resolution read from the
+// coarsest such rollup, provided that it has all of the fields that the query
+// needs.
+func (db *DB) CreateRollup(base string, name string, resolution time.Duration, fields ...string) error {
+	bt := db.getTable(base)
+	if bt == nil {
+		return errors.New("Table %v not found", base)
+	}
+	if bt.rowStore == nil {
+		return errors.New("Table %v does not store data locally", base)
+	}
+	if bt.rollupOf != "" {
+		return errors.New("Table %v is itself a rollup of %v", base, bt.rollupOf)
+	}
+	if resolution <= bt.Resolution || resolution%bt.Resolution != 0 {
+		return errors.New("Rollup resolution %v is not a multiple of %v's resolution %v", resolution, base, bt.Resolution)
+	}
+
+	selected := "*"
+	if len(fields) > 0 {
+		selected = strings.Join(fields, ", ")
+	}
+	err := db.CreateTable(&TableOpts{
+		Name:            name,
+		View:            true,
+		RetentionPeriod: bt.RetentionPeriod,
+		MaxFlushLatency: bt.MaxFlushLatency,
+		SQL:             fmt.Sprintf("SELECT %v FROM %v GROUP BY period('%v')", selected, bt.Name, resolution),
+		rollupOf:        bt.Name,
+	})
+	if err != nil {
+		return err
+	}
+
+	rollup := db.getTable(name)
+	bt.rollupsMx.Lock()
+	bt.rollups = append(bt.rollups, rollup)
+	sort.Slice(bt.rollups, func(i, j int) bool {
+		return bt.rollups[i].Resolution > bt.rollups[j].Resolution
+	})
+	bt.rollupsMx.Unlock()
+	return nil
+}
+
+// getRollups returns this table's rollups, coarsest first.
+func (t *table) getRollups() []*table {
+	t.rollupsMx.RLock()
+	defer t.rollupsMx.RUnlock()
+	return t.rollups
+}
+
+// hasRolledUp indicates whether this rollup table has been built from its base
+// table at least once.
+func (t *table) hasRolledUp() bool {
+	return atomic.LoadInt32(&t.rolledUp) == 1
+}
+
+// maintainRollup periodically rebuilds this rollup table from its base table.
+func (t *table) maintainRollup(stop <-chan interface{}) {
+	ticker := time.NewTicker(t.db.opts.RollupInterval)
+	defer ticker.Stop()
+	for {
+		if err := t.rebuildRollup(); err != nil {
+			t.log.Errorf("Unable to rebuild rollup of %v: %v", t.rollupOf, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// rebuildRollup replaces the data in this rollup table with the data that the
+// base table has flushed to disk, downsampled to this table's resolution.
+func (t *table) rebuildRollup() error {
+	base := t.db.getTable(t.rollupOf)
+	if base == nil {
+		return errors.New("Base table %v not found", t.rollupOf)
+	}
+	start := time.Now()
+	fields := t.getFields()
+	baseFields := base.getFields()
+	truncateBefore := base.truncateBefore()
+	tree := bytetree.New(fields.Exprs(), baseFields.Exprs(), t.Resolution, base.Resolution, truncateBefore, time.Time{}, 0)
+	_, err := base.iterateWithTruncateBefore(context.Background(), baseFields, false, truncateBefore, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		tree.Update(key, vals, nil, key)
+		return true, nil
+	})
+	if err != nil {
+		return errors.New("Unable to read %v: %v", base.Name, err)
+	}
+
+	ms := &memstore{fields: fields, shards: []*memstoreShard{{tree: tree}}}
+	if err := t.rowStore.rebuild(ms); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&t.rolledUp, 1)
+	// Queries against the base table may have been routed to this rollup
+	t.db.invalidateQueryCache(t.Name, time.Time{}, time.Time{})
+	t.db.invalidateQueryCache(base.Name, time.Time{}, time.Time{})
+	t.log.Debugf("Rebuilt rollup of %v with %d keys in %v", base.Name, tree.Length(), time.Now().Sub(start))
+	return nil
+}
+
+// rebuild replaces all of the row store's data with the contents of the given
+// memstore, blocking until the new data has been flushed.
+func (rs *rowStore) rebuild(ms *memstore) error {
+	req := &rebuildRequest{ms: ms, done: make(chan interface{})}
+	select {
+	case rs.rebuilds <- req:
+	case <-rs.stop:
+		return errors.New("Unable to rebuild table %v, it is closing", rs.t.Name)
+	}
+	<-req.done
+	return nil
+}
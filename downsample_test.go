@@ -0,0 +1,187 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateRollupRouting(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{RollupInterval: 1 * time.Hour}, "raw", "SELECT SUM(v) AS v, COUNT(v) AS c FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	db.clock.Advance(epoch.Add(1 * time.Minute))
+	points := make([]*Point, 0, 120)
+	for i := 0; i < 60; i++ {
+		for _, k := range []string{"a", "b"} {
+			points = append(points, &Point{TS: epoch.Add(time.Duration(i) * time.Second), Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": i}})
+		}
+	}
+	_, err := db.InsertBatch("raw", points)
+	if !assert.NoError(t, err) {
+		return
+	}
+	db.getTable("raw").forceFlush()
+
+	query := func(sqlString string) map[string][]float64 {
+		source, err := db.Query(sqlString, false, nil, false)
+		if !assert.NoError(t, err, sqlString) {
+			t.FailNow()
+		}
+		result := make(map[string][]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result[fmt.Sprintf("%v@%v", row.Key.Get("k"), time.Unix(0, row.TS).UTC())] = row.Values
+			return true, nil
+		})
+		if !assert.NoError(t, err, sqlString) {
+			t.FailNow()
+		}
+		return result
+	}
+
+	expected10s := query("SELECT v, c FROM raw GROUP BY k, period(10s)")
+	expected30s := query("SELECT v, c FROM raw GROUP BY k, period(30s)")
+	if !assert.NotEmpty(t, expected10s) || !assert.NotEmpty(t, expected30s) {
+		return
+	}
+	var total, count float64
+	for _, vals := range expected10s {
+		total += vals[0]
+		count += vals[1]
+	}
+	assert.EqualValues(t, 2*1770, total, "Sanity check on base table")
+	assert.EqualValues(t, 120, count, "Sanity check on base table")
+
+	assert.Error(t, db.CreateRollup("unknown", "bad", 10*time.Second), "Rollup of unknown table should fail")
+	assert.Error(t, db.CreateRollup("raw", "bad", 1500*time.Millisecond), "Rollup resolution must be a multiple of base resolution")
+	if !assert.NoError(t, db.CreateRollup("raw", "coarse", 10*time.Second)) {
+		return
+	}
+	assert.Error(t, db.CreateRollup("coarse", "coarser", 1*time.Minute), "Rollup of rollup should fail")
+
+	coarse := db.getTable("coarse")
+	assert.Equal(t, 10*time.Second, coarse.Resolution)
+	if !assert.NoError(t, coarse.rebuildRollup()) {
+		return
+	}
+	// Rebuilding again must not double count
+	if !assert.NoError(t, coarse.rebuildRollup()) {
+		return
+	}
+
+	assert.Equal(t, expected10s, query("SELECT v, c FROM coarse GROUP BY k"), "Rollup should hold the same sums and counts as the base table")
+	assert.Equal(t, expected10s, query("SELECT v, c FROM raw GROUP BY k, period(10s)"))
+	assert.Equal(t, expected30s, query("SELECT v, c FROM raw GROUP BY k, period(30s)"))
+
+	explain := func(sqlString string) string {
+		text, err := db.ExplainText(sqlString, false, nil, false)
+		if !assert.NoError(t, err, sqlString) {
+			t.FailNow()
+		}
+		return text
+	}
+	assert.Contains(t, explain("SELECT v, c FROM raw GROUP BY k, period(30s)"), "coarse", "Coarse query should read from rollup")
+	assert.NotContains(t, explain("SELECT v, c FROM raw GROUP BY k, period(5s)"), "coarse", "Query at resolution that's not a multiple of the rollup's should read from base table")
+	assert.NotContains(t, explain("SELECT v, c FROM raw GROUP BY k"), "coarse", "Query at base resolution should read from base table")
+
+	_, err = db.InsertBatch("coarse", points)
+	assert.Equal(t, ErrTableIsRollup, err)
+}
+
+func TestDownsampleOnRead(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "minutes", "SELECT SUM(v) AS v, AVG(v) AS a FROM inbound GROUP BY k, period(1m)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 0, 0, 0, time.UTC)
+	// The end of the table's window isn't aligned with the query resolution
+	db.clock.Advance(epoch.Add(47*time.Minute + 20*time.Second))
+	insert := func(from int, to int) {
+		points := make([]*Point, 0, (to-from)*4)
+		for i := from; i < to; i++ {
+			ts := epoch.Add(time.Duration(i)*time.Minute + 10*time.Second)
+			for j, k := range []string{"a", "b"} {
+				points = append(points,
+					&Point{TS: ts, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": i * (j + 1)}},
+					&Point{TS: ts, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": i + 1}})
+			}
+		}
+		if _, err := db.InsertBatch("minutes", points); !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	insert(0, 30)
+	db.getTable("minutes").forceFlush()
+	insert(30, 47)
+
+	collect := func(source core.FlatRowSource) map[string]float64 {
+		result := make(map[string]float64)
+		var fields core.Fields
+		_, err := source.Iterate(context.Background(), func(f core.Fields) error {
+			fields = f
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			for i, field := range fields {
+				if field.Name == "v" || field.Name == "a" {
+					result[fmt.Sprintf("%v@%v.%v", row.Key.Get("k"), time.Unix(0, row.TS).UTC(), field.Name)] = row.Values[i]
+				}
+			}
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return result
+	}
+	query := func(sqlString string) map[string]float64 {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err, sqlString) {
+			t.FailNow()
+		}
+		return collect(source)
+	}
+	explain := func(sqlString string) string {
+		text, err := db.ExplainText(sqlString, false, nil, true)
+		if !assert.NoError(t, err, sqlString) {
+			t.FailNow()
+		}
+		return text
+	}
+
+	// Aggregate the full resolution data the way grouping always has
+	q, err := db.getQueryable("minutes", func(tableFields core.Fields) (core.Fields, error) {
+		return tableFields, nil
+	}, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected := collect(core.Flatten(core.Group(q, core.GroupOpts{
+		By:         []core.GroupBy{core.NewGroupBy("k", goexpr.Param("k"))},
+		Fields:     core.PassthroughFieldSource,
+		Resolution: 10 * time.Minute,
+	})))
+	var total float64
+	for key, val := range expected {
+		if key[len(key)-2:] == ".v" {
+			total += val
+		}
+	}
+	assert.EqualValues(t, 5*1081+2*47, total, "Sanity check on full resolution aggregation")
+
+	for _, sqlString := range []string{
+		"SELECT v, a FROM minutes GROUP BY k, period(10m)",
+		"SELECT * FROM minutes GROUP BY period(10m)",
+	} {
+		assert.Contains(t, explain(sqlString), "downsampled to 10m0s", sqlString)
+		assert.Equal(t, expected, query(sqlString), "Downsampling while reading should match grouping full resolution data: %v", sqlString)
+	}
+
+	assert.NotContains(t, explain("SELECT v, a FROM minutes GROUP BY k"), "downsampled", "Query at table resolution should not downsample")
+	assert.NotContains(t, explain("SELECT v / a AS r FROM minutes GROUP BY k, period(10m)"), "downsampled", "Computed fields should be grouped from full resolution")
+	assert.NotContains(t, explain("SELECT v FROM minutes ASOF '-20m' GROUP BY k, period(10m)"), "downsampled", "Query with its own window should be grouped from full resolution")
+}
@@ -0,0 +1,147 @@
+package zenodb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// DryRunResult describes what inserting a Point with InsertBatch would have
+// done.
+type DryRunResult struct {
+	// Index is the position of the Point within the batch
+	Index int
+	// Err is the error with which the Point would have been rejected, if any.
+	Err error
+	// Filtered indicates that the Point would have been filtered out by the
+	// table's WHERE clause.
+	Filtered bool
+	// Key is the row key that the Point would have been stored under.
+	Key map[string]interface{}
+	// Fields describes the effect the Point would have had on each of the
+	// table's fields, in the order of the table's fields. It is empty if the
+	// Point would have been rejected or filtered.
+	Fields []*FieldDiagnostic
+}
+
+// FieldDiagnostic describes the effect a Point would have had on a field.
+type FieldDiagnostic struct {
+	Name string
+	// Updated indicates whether the Point would have updated the field. Fields
+	// that aren't updated usually reference values that the Point doesn't
+	// contain.
+	Updated bool
+	// Expired indicates that the Point falls outside of the field's own
+	// Retention, so its value would have been dropped.
+	Expired bool
+}
+
+func (d *FieldDiagnostic) String() string {
+	switch {
+	case d.Expired:
+		return fmt.Sprintf("%v: expired", d.Name)
+	case d.Updated:
+		return fmt.Sprintf("%v: updated", d.Name)
+	default:
+		return fmt.Sprintf("%v: not updated", d.Name)
+	}
+}
+
+// DryRunInsertBatch runs the given points through the same validation and
+// field updates as InsertBatch, without inserting anything, and describes the
+// outcome for each point. This is useful for checking that a new source of
+// data matches the table's schema before going live. Like InsertBatch, it
+// calls TableOpts.InterceptInsert for every valid point. Unlike InsertBatch,
+// it doesn't count towards the table's stats or insert rate limit and doesn't
+// advance the database's clock.
+func (db *DB) DryRunInsertBatch(table string, points []*Point) ([]*DryRunResult, error) {
+	t := db.getTable(table)
+	if t == nil {
+		return nil, fmt.Errorf("Table %v not found", table)
+	}
+	if t.rowStore == nil {
+		return nil, fmt.Errorf("Table %v does not store data locally", table)
+	}
+	return t.dryRunInsertBatch(points)
+}
+
+func (t *table) dryRunInsertBatch(points []*Point) ([]*DryRunResult, error) {
+	if t.rowStore.opts.readOnly {
+		return nil, ErrTableReadOnly
+	}
+	if t.rollupOf != "" {
+		return nil, ErrTableIsRollup
+	}
+
+	fields := t.getFields()
+	limits := t.newInsertLimits()
+	results := make([]*DryRunResult, 0, len(points))
+	for i, point := range points {
+		result := &DryRunResult{Index: i}
+		results = append(results, result)
+		dims := bytemap.New(point.Dims)
+		valid, err := t.validatePoint(limits, point.TS, dims, bytemap.New(point.Vals))
+		if err != nil {
+			result.Err = err
+			continue
+		}
+		if valid == nil {
+			result.Filtered = true
+			continue
+		}
+		result.Key = valid.key.AsMap()
+
+		var allVals []bytemap.ByteMap
+		if valid.hasMainValue {
+			allVals = append(allVals, valid.mainVals)
+		}
+		allVals = append(allVals, valid.additionalVals...)
+		inserts := make([]*insert, 0, len(allVals))
+		for _, vals := range allVals {
+			ins := &insert{valid.key, encoding.NewTSParams(point.TS, vals), dims, nil, 0, 0}
+			if t.InterceptInsert != nil {
+				ins, err = t.interceptInsert(ins)
+				if err != nil {
+					break
+				}
+			}
+			inserts = append(inserts, ins)
+		}
+		if err != nil {
+			result.Err = err
+			continue
+		}
+		result.Fields = t.dryRunFields(fields, limits.truncateBefore, inserts)
+	}
+	return results, nil
+}
+
+// dryRunFields applies the given inserts to scratch values for each of the
+// given fields and reports which fields were updated.
+func (t *table) dryRunFields(fields core.Fields, truncateBefore time.Time, inserts []*insert) []*FieldDiagnostic {
+	diagnostics := make([]*FieldDiagnostic, 0, len(fields))
+	for _, field := range fields {
+		diagnostic := &FieldDiagnostic{Name: field.Name}
+		diagnostics = append(diagnostics, diagnostic)
+		fieldTruncateBefore := t.fieldTruncateBefore(field, truncateBefore)
+		scratch := make([]byte, field.Expr.EncodedWidth())
+		for _, ins := range inserts {
+			ts, params := ins.vals.TimeAndParams()
+			if ts.Before(fieldTruncateBefore) {
+				diagnostic.Expired = true
+				continue
+			}
+			_, _, updated := field.Expr.Update(scratch, params, ins.metadata)
+			if updated {
+				diagnostic.Updated = true
+			}
+		}
+		if diagnostic.Updated {
+			diagnostic.Expired = false
+		}
+	}
+	return diagnostics
+}
@@ -0,0 +1,79 @@
+package zenodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDryRunInsertBatch(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "dryrun",
+		RetentionPeriod: 1 * time.Hour,
+		FieldRetentions: map[string]time.Duration{"recent": 10 * time.Minute},
+		SQL:             "SELECT SUM(v) AS v, SUM(v) AS recent, SUM(w) AS w FROM inbound WHERE k != 'skip' GROUP BY k, period(1m)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("dryrun")
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	db.clock.Advance(epoch)
+	memStoreBytes := db.TableStats("dryrun").RowStore.MemStoreBytes
+	old := epoch.Add(-30 * time.Minute)
+	results, err := db.DryRunInsertBatch("dryrun", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: old, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1, "w": 2}},
+		{TS: epoch, Dims: map[string]interface{}{"k": "skip"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch.Add(-2 * time.Hour), Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+	})
+	if !assert.NoError(t, err) || !assert.Len(t, results, 4) {
+		return
+	}
+
+	fieldsOf := func(result *DryRunResult) map[string]string {
+		fields := make(map[string]string)
+		for _, field := range result.Fields {
+			fields[field.Name] = field.String()
+		}
+		return fields
+	}
+
+	assert.NoError(t, results[0].Err)
+	assert.Equal(t, map[string]interface{}{"k": "a"}, results[0].Key)
+	assert.Equal(t, "v: updated", fieldsOf(results[0])["v"])
+	assert.Equal(t, "recent: updated", fieldsOf(results[0])["recent"])
+	assert.Equal(t, "w: not updated", fieldsOf(results[0])["w"], "Missing value should be reported")
+
+	assert.NoError(t, results[1].Err)
+	assert.Equal(t, "v: updated", fieldsOf(results[1])["v"])
+	assert.Equal(t, "recent: expired", fieldsOf(results[1])["recent"], "Point outside field retention should be reported")
+	assert.Equal(t, "w: updated", fieldsOf(results[1])["w"])
+
+	assert.True(t, results[2].Filtered)
+	assert.Empty(t, results[2].Fields)
+	assert.Equal(t, ErrPointTooOld, results[3].Err)
+
+	stats := db.TableStats("dryrun")
+	assert.Zero(t, stats.InsertedPoints, "Dry run should not insert")
+	assert.Zero(t, stats.FilteredPoints, "Dry run should not count towards stats")
+	assert.Equal(t, memStoreBytes, stats.RowStore.MemStoreBytes, "Dry run should not grow memstore")
+	assert.Equal(t, epoch, db.clock.Now(), "Dry run should not advance clock")
+	keys := 0
+	_, err = tbl.iterate(context.Background(), tbl.getFields(), true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		keys++
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Zero(t, keys, "Dry run should not store any rows")
+
+	_, err = db.DryRunInsertBatch("unknown", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,351 @@
+package encoding
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Codec identifies how the data of a Sequence is encoded when stored on disk.
+type Codec byte
+
+const (
+	// CodecRaw stores Sequences as they are.
+	CodecRaw Codec = 0
+	// CodecDelta stores the values of counter-like Sequences as varint encoded
+	// deltas between consecutive periods.
+	CodecDelta Codec = 1
+	// CodecXOR stores the values of gauge-like Sequences using Gorilla-style XOR
+	// compression.
+	CodecXOR Codec = 2
+)
+
+// CodecValueWidth is the width of the period states supported by CodecDelta
+// and CodecXOR, which is a byte indicating whether or not the value is set
+// followed by a float64 value. This is the layout used by simple aggregates
+// like SUM and MAX.
+const CodecValueWidth = 1 + Width64bits
+
+const (
+	// modeVerbatim means that the data following the until timestamp is stored
+	// as is because it can't be represented in compact form.
+	modeVerbatim = 0
+	// modeCompact means that the data following the until timestamp is stored as
+	// numPeriods|setflags|values, where values contains only the set values.
+	modeCompact = 1
+)
+
+// Encode encodes the given Sequence using this Codec. Encoding is lossless. If
+// the Sequence's data doesn't fit the layout supported by this Codec, it is
+// stored verbatim. Unknown codecs are treated like CodecRaw.
+func (c Codec) Encode(seq Sequence) []byte {
+	if (c != CodecDelta && c != CodecXOR) || len(seq) == 0 {
+		return seq
+	}
+
+	data := seq[Width64bits:]
+	out := make([]byte, Width64bits+1, len(seq)+1)
+	copy(out, seq[:Width64bits])
+	if !compactable(data) {
+		out[Width64bits] = modeVerbatim
+		return append(out, data...)
+	}
+
+	out[Width64bits] = modeCompact
+	numPeriods := len(data) / CodecValueWidth
+	out = AppendUvarint(out, uint64(numPeriods))
+	flags := make([]byte, (numPeriods+7)/8)
+	values := make([]uint64, 0, numPeriods)
+	for p := 0; p < numPeriods; p++ {
+		slot := data[p*CodecValueWidth:]
+		if slot[0] == 1 {
+			flags[p/8] |= 1 << uint(p%8)
+			values = append(values, Binary.Uint64(slot[1:]))
+		}
+	}
+	out = append(out, flags...)
+	if c == CodecDelta {
+		return encodeDeltas(out, values)
+	}
+	return encodeXOR(out, values)
+}
+
+// Decode decodes a Sequence that was encoded with this Codec. With CodecRaw,
+// the returned Sequence shares its data with b.
+func (c Codec) Decode(b []byte) (Sequence, error) {
+	if c == CodecRaw || len(b) == 0 {
+		return Sequence(b), nil
+	}
+	if c != CodecDelta && c != CodecXOR {
+		return nil, fmt.Errorf("Unknown codec %d", c)
+	}
+	if len(b) < Width64bits+1 {
+		return nil, fmt.Errorf("Encoded sequence of length %d is too short", len(b))
+	}
+
+	until := b[:Width64bits]
+	mode := b[Width64bits]
+	b = b[Width64bits+1:]
+	switch mode {
+	case modeVerbatim:
+		seq := make(Sequence, Width64bits+len(b))
+		copy(seq, until)
+		copy(seq[Width64bits:], b)
+		return seq, nil
+	case modeCompact:
+		// handled below
+	default:
+		return nil, fmt.Errorf("Unknown encoding mode %d", mode)
+	}
+
+	n, read := binary.Uvarint(b)
+	if read <= 0 {
+		return nil, fmt.Errorf("Unable to read number of periods")
+	}
+	b = b[read:]
+	if n > uint64(len(b))*8 {
+		return nil, fmt.Errorf("Not enough data for %d periods", n)
+	}
+	numPeriods := int(n)
+	flagsLength := (numPeriods + 7) / 8
+	flags := b[:flagsLength]
+	b = b[flagsLength:]
+	numValues := 0
+	for _, f := range flags {
+		numValues += bits.OnesCount8(f)
+	}
+
+	var values []uint64
+	var err error
+	if c == CodecDelta {
+		values, err = decodeDeltas(b, numValues)
+	} else {
+		values, err = decodeXOR(b, numValues)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seq := NewSequence(CodecValueWidth, numPeriods)
+	copy(seq, until)
+	v := 0
+	for p := 0; p < numPeriods; p++ {
+		if flags[p/8]&(1<<uint(p%8)) != 0 {
+			slot := seq[Width64bits+p*CodecValueWidth:]
+			slot[0] = 1
+			Binary.PutUint64(slot[1:], values[v])
+			v++
+		}
+	}
+	return seq, nil
+}
+
+// compactable indicates whether data can be stored in compact form, which
+// requires that every period has the CodecValueWidth layout, that set flags
+// are either 0 or 1 and that unset periods contain only zeros.
+func compactable(data []byte) bool {
+	if len(data)%CodecValueWidth != 0 {
+		return false
+	}
+	for i := 0; i < len(data); i += CodecValueWidth {
+		switch data[i] {
+		case 1:
+			continue
+		case 0:
+			if Binary.Uint64(data[i+1:]) != 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// encodeDeltas encodes each value as the difference from the prior value. If
+// the difference is integral, it is stored as a zig-zag varint shifted left by
+// 1. Otherwise, the varint 1 is stored followed by the raw 64 bit value.
+func encodeDeltas(out []byte, values []uint64) []byte {
+	prev := float64(0)
+	for _, raw := range values {
+		v := math.Float64frombits(raw)
+		d := v - prev
+		if d == math.Trunc(d) && math.Abs(d) < 1<<53 && math.Float64bits(prev+float64(int64(d))) == raw {
+			out = AppendUvarint(out, zigzag(int64(d))<<1)
+		} else {
+			out = AppendUvarint(out, 1)
+			rawBytes := make([]byte, Width64bits)
+			Binary.PutUint64(rawBytes, raw)
+			out = append(out, rawBytes...)
+		}
+		prev = v
+	}
+	return out
+}
+
+func decodeDeltas(b []byte, numValues int) ([]uint64, error) {
+	values := make([]uint64, 0, numValues)
+	prev := float64(0)
+	for i := 0; i < numValues; i++ {
+		u, read := binary.Uvarint(b)
+		if read <= 0 {
+			return nil, fmt.Errorf("Unable to read delta for value %d", i)
+		}
+		b = b[read:]
+		var raw uint64
+		if u&1 == 1 {
+			if len(b) < Width64bits {
+				return nil, fmt.Errorf("Not enough data for raw value %d", i)
+			}
+			raw = Binary.Uint64(b)
+			b = b[Width64bits:]
+		} else {
+			raw = math.Float64bits(prev + float64(unzigzag(u>>1)))
+		}
+		values = append(values, raw)
+		prev = math.Float64frombits(raw)
+	}
+	return values, nil
+}
+
+// encodeXOR encodes values using the XOR scheme described in the Gorilla paper
+// (http://www.vldb.org/pvldb/vol8/p1816-teller.pdf). The first value is stored
+// in full. Subsequent values are XOR'ed with the prior value and stored as:
+//
+//	0                              - same as prior value
+//	1|0|meaningful bits            - fits within prior window of meaningful bits
+//	1|1|leading|length-1|meaningful bits - new window
+//
+// leading is 5 bits and length-1 is 6 bits.
+func encodeXOR(out []byte, values []uint64) []byte {
+	w := &bitWriter{b: out}
+	var prev uint64
+	prevLeading, prevTrailing := 0, 0
+	haveWindow := false
+	for i, v := range values {
+		if i == 0 {
+			w.writeBits(v, 64)
+			prev = v
+			continue
+		}
+		x := v ^ prev
+		prev = v
+		if x == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+		leading := bits.LeadingZeros64(x)
+		if leading > 31 {
+			leading = 31
+		}
+		trailing := bits.TrailingZeros64(x)
+		if haveWindow && leading >= prevLeading && trailing >= prevTrailing {
+			w.writeBit(false)
+			w.writeBits(x>>uint(prevTrailing), 64-prevLeading-prevTrailing)
+			continue
+		}
+		w.writeBit(true)
+		length := 64 - leading - trailing
+		w.writeBits(uint64(leading), 5)
+		w.writeBits(uint64(length-1), 6)
+		w.writeBits(x>>uint(trailing), length)
+		prevLeading, prevTrailing, haveWindow = leading, trailing, true
+	}
+	return w.b
+}
+
+func decodeXOR(b []byte, numValues int) ([]uint64, error) {
+	values := make([]uint64, 0, numValues)
+	r := &bitReader{b: b}
+	var prev uint64
+	prevLeading, prevTrailing := 0, 0
+	for i := 0; i < numValues; i++ {
+		if i == 0 {
+			prev = r.readBits(64)
+			values = append(values, prev)
+			continue
+		}
+		if r.readBit() {
+			if r.readBit() {
+				prevLeading = int(r.readBits(5))
+				length := int(r.readBits(6)) + 1
+				prevTrailing = 64 - prevLeading - length
+				if prevTrailing < 0 {
+					return nil, fmt.Errorf("Invalid window for value %d", i)
+				}
+			}
+			prev ^= r.readBits(64-prevLeading-prevTrailing) << uint(prevTrailing)
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("Unable to read value %d: %v", i, r.err)
+		}
+		values = append(values, prev)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return values, nil
+}
+
+type bitWriter struct {
+	b []byte
+	// used is the number of bits used in the last byte of b, 0 means that we
+	// need a new byte
+	used uint
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.used == 0 {
+		w.b = append(w.b, 0)
+	}
+	if bit {
+		w.b[len(w.b)-1] |= 0x80 >> w.used
+	}
+	w.used = (w.used + 1) % 8
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(v>>uint(i)&1 == 1)
+	}
+}
+
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) readBit() bool {
+	idx := r.pos / 8
+	if idx >= len(r.b) {
+		if r.err == nil {
+			r.err = fmt.Errorf("Unexpected end of data at bit %d", r.pos)
+		}
+		return false
+	}
+	bit := r.b[idx]&(0x80>>uint(r.pos%8)) != 0
+	r.pos++
+	return bit
+}
+
+func (r *bitReader) readBits(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if r.readBit() {
+			v |= 1
+		}
+	}
+	return v
+}
+
+func zigzag(i int64) uint64 {
+	return uint64((i << 1) ^ (i >> 63))
+}
+
+func unzigzag(u uint64) int64 {
+	return int64(u>>1) ^ -int64(u&1)
+}
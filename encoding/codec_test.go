@@ -0,0 +1,122 @@
+package encoding
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/getlantern/zenodb/expr"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+var codecs = []Codec{CodecRaw, CodecDelta, CodecXOR}
+
+func TestCodecRoundTrip(t *testing.T) {
+	e := expr.SUM(expr.FIELD("a"))
+	if !assert.Equal(t, CodecValueWidth, e.EncodedWidth()) {
+		return
+	}
+
+	sequences := map[string]Sequence{
+		"nil":     nil,
+		"counter": counterSequence(e, 500),
+		"gauge":   gaugeSequence(e, 500),
+		"special": specialSequence(e),
+		// not compactable, should be stored verbatim
+		"odd width": Sequence{0, 0, 0, 0, 0, 0, 0, 1, 5, 6, 7},
+	}
+	for name, seq := range sequences {
+		for _, codec := range codecs {
+			decoded, err := codec.Decode(codec.Encode(seq))
+			if assert.NoError(t, err, "%v with codec %d", name, codec) {
+				assert.Equal(t, []byte(seq), []byte(decoded), "%v with codec %d", name, codec)
+			}
+		}
+	}
+
+	assert.True(t, len(CodecDelta.Encode(sequences["counter"])) < len(sequences["counter"])/4, "Delta should compress counters")
+	assert.True(t, len(CodecXOR.Encode(sequences["gauge"])) < len(sequences["gauge"]), "XOR should compress gauges")
+
+	_, err := Codec(99).Decode(sequences["gauge"])
+	assert.Error(t, err, "Unknown codec should fail to decode")
+	encoded := CodecXOR.Encode(sequences["gauge"])
+	for i := 1; i < len(encoded); i++ {
+		CodecXOR.Decode(encoded[:i])
+		CodecDelta.Decode(encoded[:i])
+	}
+}
+
+func BenchmarkCodecXORGauge(b *testing.B) {
+	seq := gaugeSequence(expr.MAX(expr.FIELD("a")), 24*60)
+	var encoded []byte
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		encoded = CodecXOR.Encode(seq)
+		if _, err := CodecXOR.Decode(encoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	compressed := snappy.Encode(nil, encoded)
+	log.Debugf("XOR: Uncompressed: %d   Encoded: %d   Encoded+Snappy: %d   Ratio: %f", len(seq), len(encoded), len(compressed), float64(len(compressed))/float64(len(seq)))
+}
+
+func BenchmarkCodecRawSnappyGauge(b *testing.B) {
+	seq := gaugeSequence(expr.MAX(expr.FIELD("a")), 24*60)
+	var compressed []byte
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compressed = snappy.Encode(nil, seq)
+		if _, err := snappy.Decode(nil, compressed); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	log.Debugf("Raw: Uncompressed: %d   Snappy: %d   Ratio: %f", len(seq), len(compressed), float64(len(compressed))/float64(len(seq)))
+}
+
+// counterSequence builds a Sequence of slowly increasing integral values with
+// some gaps.
+func counterSequence(e expr.Expr, numPeriods int) Sequence {
+	seq := NewSequence(e.EncodedWidth(), numPeriods)
+	seq.SetUntil(epoch)
+	v := float64(0)
+	for i := 0; i < numPeriods; i++ {
+		v += float64(rand.Intn(100))
+		if rand.Intn(10) > 0 {
+			setValue(seq, i, v)
+		}
+	}
+	return seq
+}
+
+// gaugeSequence builds a Sequence of values fluctuating around a baseline.
+func gaugeSequence(e expr.Expr, numPeriods int) Sequence {
+	seq := NewSequence(e.EncodedWidth(), numPeriods)
+	seq.SetUntil(epoch)
+	v := float64(50)
+	for i := 0; i < numPeriods; i++ {
+		if rand.Intn(4) == 0 {
+			v = 50 + float64(rand.Intn(8))*0.25
+		}
+		setValue(seq, i, v)
+	}
+	return seq
+}
+
+func specialSequence(e expr.Expr) Sequence {
+	special := []float64{math.NaN(), math.Inf(1), math.Inf(-1), math.Copysign(0, -1), 1e300, -3.5, 0}
+	seq := NewSequence(e.EncodedWidth(), len(special))
+	seq.SetUntil(epoch)
+	for i, v := range special {
+		setValue(seq, i, v)
+	}
+	return seq
+}
+
+func setValue(seq Sequence, period int, v float64) {
+	slot := seq[Width64bits+period*CodecValueWidth:]
+	slot[0] = 1
+	Binary.PutUint64(slot[1:], math.Float64bits(v))
+}
@@ -65,3 +65,10 @@ func Write(b []byte, d []byte) []byte {
 	copy(b, d)
 	return b[len(d):]
 }
+
+// AppendUvarint appends the varint encoding of v to b.
+func AppendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
@@ -18,10 +18,11 @@ func NewTSParams(ts time.Time, params bytemap.ByteMap) TSParams {
 	return TSParams(append(out, params...))
 }
 
-// TimeAndParams returns the Time and Params components of this TSParams.
+// TimeAndParams returns the Time and Params components of this TSParams. The
+// Params implement expr.TimedParams.
 func (tsp TSParams) TimeAndParams() (time.Time, expr.Params) {
 	ts := TimeFromBytes(tsp)
-	params := bytemapParams(tsp[Width64bits:])
+	params := timedParams{bytemapParams(tsp[Width64bits:]), ts.UnixNano()}
 	return ts, params
 }
 
@@ -57,3 +58,13 @@ func (bmp bytemapParams) Get(field string) (float64, bool) {
 func (bmp bytemapParams) String() string {
 	return fmt.Sprint(bytemap.ByteMap(bmp).AsMap())
 }
+
+// timedParams adds the time of the point to bytemapParams.
+type timedParams struct {
+	bytemapParams
+	ts int64
+}
+
+func (tp timedParams) TimeInt() int64 {
+	return tp.ts
+}
@@ -141,6 +141,37 @@ func (seq Sequence) ValueAtOffset(offset int, e expr.Expr) (val float64, found b
 	return val, wasSet
 }
 
+// LabelAtTime returns the value kept by a LAST or FIRST expression at the given
+// time within this sequence, assuming each period represents 1 * resolution.
+// If no value is set for the given time, or e isn't a LAST or FIRST
+// expression, found will be false.
+func (seq Sequence) LabelAtTime(t time.Time, e expr.Expr, resolution time.Duration) (label string, found bool) {
+	if len(seq) == 0 {
+		return "", false
+	}
+	until := seq.Until()
+	t = RoundTimeUntilUp(t, resolution, until)
+	if t.After(until) {
+		return "", false
+	}
+	period := int(until.Sub(t) / resolution)
+	return seq.LabelAt(period, e)
+}
+
+// LabelAt returns the value kept by a LAST or FIRST expression at the given
+// period. If no value is set for the given period, or e isn't a LAST or FIRST
+// expression, found will be false.
+func (seq Sequence) LabelAt(period int, e expr.Expr) (label string, found bool) {
+	if len(seq) == 0 || period < 0 {
+		return "", false
+	}
+	offset := Width64bits + period*e.EncodedWidth()
+	if offset >= len(seq) {
+		return "", false
+	}
+	return expr.GetLabel(e, seq[offset:])
+}
+
 // UpdateValueAt updates the value at the given period by applying the supplied
 // Params to the given expression. metadata represents metadata about the
 // operation that's used by the Expr as well (e.g. information about the
@@ -156,3 +156,13 @@ func (e *aggregate) DecodeMsgpack(dec *msgpack.Decoder) error {
 	e.merge = e2.merge
 	return nil
 }
+
+// AggregateName returns the name of the aggregate (e.g. SUM) if e is an
+// aggregate, otherwise it returns "".
+func AggregateName(e Expr) string {
+	agg, ok := e.(*aggregate)
+	if !ok {
+		return ""
+	}
+	return agg.Name
+}
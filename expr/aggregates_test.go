@@ -111,3 +111,44 @@ func doTestAggregate(t *testing.T, e Expr, expected float64) {
 		AssertFloatEquals(t, expected, val)
 	}
 }
+
+func TestAbsentValuesDontCount(t *testing.T) {
+	for _, e := range []Expr{AVG("a"), COUNT("a"), WAVG("a", "w"), SUM("a")} {
+		e = msgpacked(t, e)
+		b := make([]byte, e.EncodedWidth())
+		e.Update(b, Map{"other": 1}, nil)
+		_, wasSet, _ := e.Get(b)
+		assert.False(t, wasSet, "%v should not be set without value", e)
+	}
+
+	wavg := msgpacked(t, WAVG("a", "w"))
+	b := make([]byte, wavg.EncodedWidth())
+	_, _, updated := wavg.Update(b, Map{"a": 100}, nil)
+	assert.False(t, updated, "Value without weight should not update weighted average")
+	_, wasSet, _ := wavg.Get(b)
+	assert.False(t, wasSet, "Weighted average without weight should not be set")
+	wavg.Update(b, Map{"a": 10, "w": 2}, nil)
+	val, wasSet, _ := wavg.Get(b)
+	if assert.True(t, wasSet) {
+		AssertFloatEquals(t, 10, val)
+	}
+
+	// Merging with an absent value leaves the present one unchanged
+	for _, e := range []Expr{AVG("a"), COUNT("a")} {
+		e = msgpacked(t, e)
+		present := make([]byte, e.EncodedWidth())
+		e.Update(present, Map{"a": 4}, nil)
+		e.Update(present, Map{"a": 8}, nil)
+		absent := make([]byte, e.EncodedWidth())
+		e.Update(absent, Map{"other": 1}, nil)
+		expected, _, _ := e.Get(present)
+		for _, pair := range [][2][]byte{{present, absent}, {absent, present}} {
+			merged := make([]byte, e.EncodedWidth())
+			e.Merge(merged, pair[0], pair[1])
+			val, wasSet, _ := e.Get(merged)
+			if assert.True(t, wasSet, "%v", e) {
+				AssertFloatEquals(t, expected, val)
+			}
+		}
+	}
+}
@@ -52,7 +52,9 @@ func (e *avg) Shift() time.Duration {
 func (e *avg) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
 	count, total, _, remain := e.load(b)
 	remain, value, updated := e.Value.Update(remain, params, metadata)
-	remain, weight, _ := e.Weight.Update(remain, params, metadata)
+	remain, weight, weightUpdated := e.Weight.Update(remain, params, metadata)
+	// Values without a weight don't count towards the average
+	updated = updated && (weightUpdated || e.Weight.IsConstant())
 	if updated {
 		count += weight
 		total += value * weight
@@ -100,10 +102,11 @@ func (e *avg) subMerge(data []byte, other []byte, otherRes time.Duration, metada
 
 func (e *avg) Get(b []byte) (float64, bool, []byte) {
 	count, total, wasSet, remain := e.load(b)
-	if !wasSet {
-		return 0, wasSet, remain
+	if !wasSet || count == 0 {
+		// Without any weight, there's no average
+		return 0, false, remain
 	}
-	return e.calc(count, total), wasSet, remain
+	return e.calc(count, total), true, remain
 }
 
 func (e *avg) calc(count float64, total float64) float64 {
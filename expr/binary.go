@@ -60,10 +60,11 @@ func (e *binaryExpr) validateWrappedInBinary(wrapped Expr) error {
 		typeOfWrapped == shiftType ||
 		typeOfWrapped == unaryMathType ||
 		typeOfWrapped == percentileType ||
-		typeOfWrapped == percentileOptimizedType {
+		typeOfWrapped == percentileOptimizedType ||
+		typeOfWrapped == hllType {
 		return nil
 	}
-	if typeOfWrapped == binaryType {
+	if typeOfWrapped == binaryType || typeOfWrapped == coalesceType {
 		return wrapped.Validate()
 	}
 	if e.DeAggregated {
@@ -0,0 +1,171 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/msgpack"
+)
+
+// COALESCE creates an Expr that, for each period, takes the value of the first
+// of the wrapped expressions that has a value. If none of the wrapped
+// expressions has a value, the result is null.
+func COALESCE(wrapped ...interface{}) Expr {
+	exprs := make([]Expr, 0, len(wrapped))
+	for _, w := range wrapped {
+		exprs = append(exprs, exprFor(w))
+	}
+	return &coalesce{Exprs: exprs}
+}
+
+type coalesce struct {
+	Exprs        []Expr
+	DeAggregated bool
+}
+
+func (e *coalesce) Validate() error {
+	if len(e.Exprs) == 0 {
+		return fmt.Errorf("COALESCE requires at least one expression")
+	}
+	bin := &binaryExpr{DeAggregated: e.DeAggregated}
+	for _, wrapped := range e.Exprs {
+		err := bin.validateWrappedInBinary(wrapped)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *coalesce) EncodedWidth() int {
+	width := 0
+	for _, wrapped := range e.Exprs {
+		width += wrapped.EncodedWidth()
+	}
+	return width
+}
+
+func (e *coalesce) Shift() time.Duration {
+	var result time.Duration
+	for i, wrapped := range e.Exprs {
+		shift := wrapped.Shift()
+		if i == 0 || shift < result {
+			result = shift
+		}
+	}
+	return result
+}
+
+func (e *coalesce) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	remain := b
+	result := float64(0)
+	found := false
+	updated := false
+	for _, wrapped := range e.Exprs {
+		var value float64
+		var wasUpdated bool
+		remain, value, wasUpdated = wrapped.Update(remain, params, metadata)
+		if wasUpdated {
+			updated = true
+			if !found {
+				result = value
+				found = true
+			}
+		}
+	}
+	return remain, result, updated
+}
+
+func (e *coalesce) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	for _, wrapped := range e.Exprs {
+		b, x, y = wrapped.Merge(b, x, y)
+	}
+	return b, x, y
+}
+
+func (e *coalesce) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	// See if any of the subexpressions match top level and if so, ignore others
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+			return result
+		}
+	}
+
+	// None of sub expressions match top level, build combined ones
+	width := 0
+	for _, wrapped := range e.Exprs {
+		sms := wrapped.SubMergers(subs)
+		for i := range subs {
+			result[i] = combinedSubMerge(result[i], width, sms[i])
+		}
+		width += wrapped.EncodedWidth()
+	}
+	return result
+}
+
+func (e *coalesce) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *coalesce) Get(b []byte) (float64, bool, []byte) {
+	remain := b
+	result := float64(0)
+	found := false
+	for _, wrapped := range e.Exprs {
+		value, wasSet, r := wrapped.Get(remain)
+		remain = r
+		if wasSet && !found {
+			result = value
+			found = true
+		}
+	}
+	return result, found, remain
+}
+
+func (e *coalesce) IsConstant() bool {
+	for _, wrapped := range e.Exprs {
+		if !wrapped.IsConstant() {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *coalesce) DeAggregate() Expr {
+	exprs := make([]Expr, 0, len(e.Exprs))
+	for _, wrapped := range e.Exprs {
+		exprs = append(exprs, wrapped.DeAggregate())
+	}
+	return &coalesce{Exprs: exprs, DeAggregated: true}
+}
+
+func (e *coalesce) String() string {
+	strs := make([]string, 0, len(e.Exprs))
+	for _, wrapped := range e.Exprs {
+		strs = append(strs, wrapped.String())
+	}
+	return fmt.Sprintf("COALESCE(%v)", strings.Join(strs, ", "))
+}
+
+func (e *coalesce) DecodeMsgpack(dec *msgpack.Decoder) error {
+	m := make(map[string]interface{})
+	err := dec.Decode(&m)
+	if err != nil {
+		return err
+	}
+	wrapped, _ := m["Exprs"].([]interface{})
+	e.Exprs = make([]Expr, 0, len(wrapped))
+	for _, w := range wrapped {
+		ex, ok := w.(Expr)
+		if !ok {
+			return fmt.Errorf("COALESCE can only wrap expressions, not %v", w)
+		}
+		e.Exprs = append(e.Exprs, ex)
+	}
+	e.DeAggregated, _ = m["DeAggregated"].(bool)
+	return nil
+}
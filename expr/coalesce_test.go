@@ -0,0 +1,67 @@
+package expr
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesceRegular(t *testing.T) {
+	e := msgpacked(t, COALESCE(SUM(FIELD("b")), SUM(FIELD("a"))))
+	b := make([]byte, e.EncodedWidth())
+	_, val, updated := e.Update(b, Map{"a": 4.4}, nil)
+	assert.True(t, updated)
+	assert.EqualValues(t, 4.4, val)
+	e.Update(b, Map{"b": 2.2}, nil)
+	val, wasSet, _ := e.Get(b)
+	assert.True(t, wasSet)
+	assert.EqualValues(t, 2.2, val)
+
+	empty := make([]byte, e.EncodedWidth())
+	_, wasSet, _ = e.Get(empty)
+	assert.False(t, wasSet)
+}
+
+func TestCoalesceSubMerge(t *testing.T) {
+	res := 1 * time.Hour
+	periods := 10
+	transition := 5
+
+	fOld := msgpacked(t, SUM(FIELD("old")))
+	fNew := msgpacked(t, SUM(FIELD("new")))
+	fc := msgpacked(t, COALESCE(SUM(FIELD("new")), SUM(FIELD("old"))))
+
+	old := make([]byte, fOld.EncodedWidth()*periods)
+	nu := make([]byte, fNew.EncodedWidth()*periods)
+	c := make([]byte, fc.EncodedWidth()*periods)
+
+	// The metric moves from old to new at transition and is missing in the last
+	// period.
+	for i := 0; i < periods-1; i++ {
+		if i < transition {
+			fOld.Update(old[i*fOld.EncodedWidth():], Map{"old": float64(i)}, nil)
+		} else {
+			fNew.Update(nu[i*fNew.EncodedWidth():], Map{"new": float64(i)}, nil)
+		}
+	}
+
+	subs := fc.SubMergers([]Expr{fNew, fOld})
+	for i := 0; i < periods; i++ {
+		subs[0](c[i*fc.EncodedWidth():], nu[i*fNew.EncodedWidth():], res, nil)
+		subs[1](c[i*fc.EncodedWidth():], old[i*fOld.EncodedWidth():], res, nil)
+	}
+	for i := 0; i < periods-1; i++ {
+		actual, wasSet, _ := fc.Get(c[i*fc.EncodedWidth():])
+		assert.True(t, wasSet, "Value should be set at position %d", i)
+		assert.EqualValues(t, i, actual, "Wrong value at position %d", i)
+	}
+	_, wasSet, _ := fc.Get(c[(periods-1)*fc.EncodedWidth():])
+	assert.False(t, wasSet, "Value should be null when both fields are null")
+}
+
+func TestValidateCoalesce(t *testing.T) {
+	assert.NoError(t, COALESCE(SUM(FIELD("a")), SUM(FIELD("b"))).Validate())
+	assert.Error(t, COALESCE(FIELD("a"), SUM(FIELD("b"))).Validate())
+	assert.NoError(t, ADD(COALESCE(SUM(FIELD("a")), SUM(FIELD("b"))), CONST(1)).Validate())
+}
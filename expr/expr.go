@@ -33,6 +33,8 @@ var (
 	unaryMathType           = reflect.TypeOf((*unaryMathExpr)(nil))
 	percentileType          = reflect.TypeOf((*ptile)(nil))
 	percentileOptimizedType = reflect.TypeOf((*ptileOptimized)(nil))
+	coalesceType            = reflect.TypeOf((*coalesce)(nil))
+	hllType                 = reflect.TypeOf((*hll)(nil))
 )
 
 func init() {
@@ -47,6 +49,10 @@ func init() {
 	msgpack.RegisterExt(58, &unaryMathExpr{})
 	msgpack.RegisterExt(59, &ptile{})
 	msgpack.RegisterExt(60, &ptileOptimized{})
+	msgpack.RegisterExt(61, &zscore{})
+	msgpack.RegisterExt(62, &coalesce{})
+	msgpack.RegisterExt(63, &hll{})
+	msgpack.RegisterExt(64, &label{})
 }
 
 // Params is an interface for data structures that can contain named values.
@@ -56,6 +62,16 @@ type Params interface {
 	Get(name string) (val float64, found bool)
 }
 
+// TimedParams is implemented by Params that know the time of the point they
+// came from, which is used by expressions that keep values by recency (see
+// LAST).
+type TimedParams interface {
+	Params
+
+	// TimeInt returns the time of the point in nanoseconds since the epoch
+	TimeInt() int64
+}
+
 // Map is an implementation of the Params interface using a map.
 type Map map[string]float64
 
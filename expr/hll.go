@@ -0,0 +1,195 @@
+package expr
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+const (
+	// DefaultHLLPrecision is the precision used by COUNT_DISTINCT when none is
+	// specified. It yields 4096 registers (4 KB) and a standard error of about
+	// 1.6%.
+	DefaultHLLPrecision = 12
+
+	// MinHLLPrecision is the smallest supported COUNT_DISTINCT precision.
+	MinHLLPrecision = 4
+
+	// MaxHLLPrecision is the largest supported COUNT_DISTINCT precision.
+	MaxHLLPrecision = 16
+)
+
+// COUNT_DISTINCT estimates the number of distinct values of the named
+// dimension using a HyperLogLog sketch with 2^precision single-byte registers.
+// Higher precisions are more accurate (standard error is roughly
+// 1.04/sqrt(2^precision)) but take more space.
+//
+// Sketches are merged by taking the maximum of each register, so they can be
+// combined across periods, rows and stores without losing accuracy.
+//
+// WARNING - like PERCENTILE, COUNT_DISTINCT fields are much larger than most
+// other expressions, so it is best to keep these relatively low cardinality.
+func COUNT_DISTINCT(dim string, precision int) Expr {
+	return &hll{
+		Dim:       dim,
+		Precision: precision,
+		Width:     1 << uint(precision),
+	}
+}
+
+// IsCountDistinct indicates whether the given expression is a COUNT_DISTINCT
+// expression.
+func IsCountDistinct(e Expr) bool {
+	_, ok := e.(*hll)
+	return ok
+}
+
+type hll struct {
+	Dim       string
+	Precision int
+	Width     int
+}
+
+func (e *hll) Validate() error {
+	if e.Dim == "" {
+		return fmt.Errorf("COUNT_DISTINCT requires a dimension")
+	}
+	if e.Precision < MinHLLPrecision || e.Precision > MaxHLLPrecision {
+		return fmt.Errorf("COUNT_DISTINCT precision must be between %d and %d, not %d", MinHLLPrecision, MaxHLLPrecision, e.Precision)
+	}
+	return nil
+}
+
+func (e *hll) EncodedWidth() int {
+	return e.Width
+}
+
+func (e *hll) Shift() time.Duration {
+	return 0
+}
+
+func (e *hll) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	registers, remain := b[:e.Width], b[e.Width:]
+	if metadata == nil {
+		value, _ := e.estimate(registers)
+		return remain, value, false
+	}
+	val := metadata.Get(e.Dim)
+	if val == nil {
+		value, _ := e.estimate(registers)
+		return remain, value, false
+	}
+	idx, rank := e.hash(val)
+	if rank > registers[idx] {
+		registers[idx] = rank
+	}
+	value, _ := e.estimate(registers)
+	return remain, value, true
+}
+
+func (e *hll) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	for i := 0; i < e.Width; i++ {
+		rx, ry := x[i], y[i]
+		if ry > rx {
+			b[i] = ry
+		} else {
+			b[i] = rx
+		}
+	}
+	return b[e.Width:], x[e.Width:], y[e.Width:]
+}
+
+func (e *hll) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, 0, len(subs))
+	for _, sub := range subs {
+		var sm SubMerge
+		if e.String() == sub.String() {
+			sm = e.subMerge
+		}
+		result = append(result, sm)
+	}
+	return result
+}
+
+func (e *hll) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *hll) Get(b []byte) (float64, bool, []byte) {
+	value, wasSet := e.estimate(b[:e.Width])
+	return value, wasSet, b[e.Width:]
+}
+
+// hash returns the register index and rank for the given value. The rank is
+// the position of the leftmost 1 bit in the bits of the hash that remain after
+// taking the index.
+func (e *hll) hash(val interface{}) (int, byte) {
+	h := fnv.New64a()
+	fmt.Fprint(h, val)
+	x := mix64(h.Sum64())
+	p := uint(e.Precision)
+	idx := int(x >> (64 - p))
+	// Set a guard bit so that the rank can't exceed 64 - p + 1
+	w := x<<p | 1<<(p-1)
+	return idx, byte(bits.LeadingZeros64(w) + 1)
+}
+
+// mix64 is the 64 bit finalizer from MurmurHash3, which improves the
+// distribution of the FNV hash in the high bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (e *hll) estimate(registers []byte) (float64, bool) {
+	m := float64(e.Width)
+	sum := float64(0)
+	zeros := 0
+	for _, r := range registers {
+		if r == 0 {
+			zeros++
+		}
+		sum += math.Ldexp(1, -int(r))
+	}
+	if zeros == e.Width {
+		return 0, false
+	}
+
+	var alpha float64
+	switch e.Width {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		// Use linear counting for small cardinalities
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return estimate, true
+}
+
+func (e *hll) IsConstant() bool {
+	return false
+}
+
+func (e *hll) DeAggregate() Expr {
+	return e
+}
+
+func (e *hll) String() string {
+	return fmt.Sprintf("COUNT_DISTINCT(%v, %v)", e.Dim, e.Precision)
+}
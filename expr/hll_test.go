@@ -0,0 +1,88 @@
+package expr
+
+import (
+	"math"
+	"testing"
+
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountDistinctAccuracy(t *testing.T) {
+	for _, precision := range []int{10, 12, 14} {
+		e := msgpacked(t, COUNT_DISTINCT("user", precision))
+		if !assert.NoError(t, e.Validate()) {
+			return
+		}
+		stdErr := 1.04 / math.Sqrt(float64(int(1)<<uint(precision)))
+		for _, cardinality := range []int{10, 100, 1000, 10000, 100000} {
+			b := make([]byte, e.EncodedWidth())
+			for i := 0; i < cardinality; i++ {
+				// Record each value twice to make sure duplicates aren't counted
+				for j := 0; j < 2; j++ {
+					e.Update(b, nil, goexpr.MapParams{"user": i})
+				}
+			}
+			val, wasSet, _ := e.Get(b)
+			if assert.True(t, wasSet) {
+				allowed := 4 * stdErr * float64(cardinality)
+				if allowed < 1 {
+					allowed = 1
+				}
+				assert.InDelta(t, float64(cardinality), val, allowed, "Wrong estimate at precision %d for cardinality %d", precision, cardinality)
+			}
+		}
+	}
+}
+
+func TestCountDistinctMerge(t *testing.T) {
+	e := msgpacked(t, COUNT_DISTINCT("user", 12))
+
+	fill := func(from, to int) []byte {
+		b := make([]byte, e.EncodedWidth())
+		for i := from; i < to; i++ {
+			e.Update(b, nil, goexpr.MapParams{"user": i})
+		}
+		return b
+	}
+	merge := func(x []byte, y []byte) []byte {
+		b := make([]byte, e.EncodedWidth())
+		e.Merge(b, x, y)
+		return b
+	}
+
+	x := fill(0, 5000)
+	y := fill(2500, 7500)
+	z := fill(7000, 10000)
+	empty := make([]byte, e.EncodedWidth())
+
+	_, wasSet, _ := e.Get(empty)
+	assert.False(t, wasSet)
+
+	left := merge(merge(x, y), z)
+	assert.Equal(t, left, merge(x, merge(y, z)), "merge should be associative")
+	assert.Equal(t, merge(x, y), merge(y, x), "merge should be commutative")
+	assert.Equal(t, x, merge(x, empty), "merging with unset should be identity")
+	assert.Equal(t, left, fill(0, 10000), "merged sketch should equal sketch of union")
+
+	val, _, _ := e.Get(left)
+	assert.InDelta(t, 10000, val, 10000*4*1.04/64)
+}
+
+func TestCountDistinctMissingDim(t *testing.T) {
+	e := COUNT_DISTINCT("user", 8)
+	b := make([]byte, e.EncodedWidth())
+	_, _, updated := e.Update(b, nil, goexpr.MapParams{"other": 1})
+	assert.False(t, updated)
+	_, _, updated = e.Update(b, nil, nil)
+	assert.False(t, updated)
+	_, wasSet, _ := e.Get(b)
+	assert.False(t, wasSet)
+}
+
+func TestCountDistinctValidate(t *testing.T) {
+	assert.Error(t, COUNT_DISTINCT("user", MinHLLPrecision-1).Validate())
+	assert.Error(t, COUNT_DISTINCT("user", MaxHLLPrecision+1).Validate())
+	assert.Error(t, COUNT_DISTINCT("", DefaultHLLPrecision).Validate())
+	assert.NoError(t, COUNT_DISTINCT("user", DefaultHLLPrecision).Validate())
+}
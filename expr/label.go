@@ -0,0 +1,226 @@
+package expr
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+const (
+	// DefaultLabelLength is the maximum length of values kept by LAST and FIRST
+	// when none is specified.
+	DefaultLabelLength = 64
+
+	// MaxLabelLength is the largest supported maximum length of values kept by
+	// LAST and FIRST.
+	MaxLabelLength = 255
+
+	labelTimeWidth = width64bits
+)
+
+// LAST keeps the most recent non-empty value of the named dimension, for
+// example the last reported status of a device. Values are compared as
+// strings and anything longer than maxLength bytes is truncated.
+//
+// Points are ordered by their timestamps if the Params passed to Update
+// implement TimedParams, otherwise later updates win. When merging, the value
+// with the later timestamp wins.
+//
+// In numeric contexts (e.g. query results), LAST evaluates to the time of the
+// kept value in seconds since the epoch. Use GetLabel to get the value itself.
+func LAST(dim string, maxLength int) Expr {
+	return newLabel(dim, maxLength, true)
+}
+
+// FIRST is like LAST, but keeps the earliest non-empty value.
+func FIRST(dim string, maxLength int) Expr {
+	return newLabel(dim, maxLength, false)
+}
+
+func newLabel(dim string, maxLength int, last bool) Expr {
+	return &label{
+		Dim:       dim,
+		MaxLength: maxLength,
+		Last:      last,
+	}
+}
+
+// IsLabel indicates whether the given expression is a LAST or FIRST
+// expression.
+func IsLabel(e Expr) bool {
+	_, ok := e.(*label)
+	return ok
+}
+
+// GetLabel gets the value kept by a LAST or FIRST expression in b, returning
+// false if e isn't a LAST or FIRST expression or no value was set.
+func GetLabel(e Expr, b []byte) (string, bool) {
+	l, ok := e.(*label)
+	if !ok {
+		return "", false
+	}
+	_, value, ok := l.read(b)
+	return value, ok
+}
+
+// label stores a timestamp followed by a length prefixed value, padded to
+// MaxLength so that every period has the same width:
+//
+//	ts|length|value|padding
+//
+// ts is the 64 bit time of the value in nanoseconds since the epoch
+// length is the 8 bit length of the value, 0 if no value is set
+type label struct {
+	Dim       string
+	MaxLength int
+	Last      bool
+}
+
+func (e *label) Validate() error {
+	if e.Dim == "" {
+		return fmt.Errorf("%v requires a dimension", e.name())
+	}
+	if e.MaxLength < 1 || e.MaxLength > MaxLabelLength {
+		return fmt.Errorf("%v maximum length must be between 1 and %d, not %d", e.name(), MaxLabelLength, e.MaxLength)
+	}
+	return nil
+}
+
+func (e *label) EncodedWidth() int {
+	return labelTimeWidth + 1 + e.MaxLength
+}
+
+func (e *label) Shift() time.Duration {
+	return 0
+}
+
+func (e *label) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	width := e.EncodedWidth()
+	slot, remain := b[:width], b[width:]
+	if metadata == nil {
+		value, _ := e.time(slot)
+		return remain, value, false
+	}
+	val := metadata.Get(e.Dim)
+	if val == nil {
+		value, _ := e.time(slot)
+		return remain, value, false
+	}
+	str, ok := val.(string)
+	if !ok {
+		str = fmt.Sprint(val)
+	}
+	if str == "" {
+		value, _ := e.time(slot)
+		return remain, value, false
+	}
+	ts := int64(0)
+	if timed, ok := params.(TimedParams); ok {
+		ts = timed.TimeInt()
+	}
+	existingTS, _, isSet := e.read(slot)
+	if isSet && !e.replaces(ts, existingTS) {
+		value, _ := e.time(slot)
+		return remain, value, false
+	}
+	e.write(slot, ts, str)
+	value, _ := e.time(slot)
+	return remain, value, true
+}
+
+// replaces indicates whether a value at ts replaces a value at existingTS.
+// Ties go to the newer update for LAST and to the existing value for FIRST.
+func (e *label) replaces(ts int64, existingTS int64) bool {
+	if e.Last {
+		return ts >= existingTS
+	}
+	return ts < existingTS
+}
+
+func (e *label) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	width := e.EncodedWidth()
+	xTS, _, xSet := e.read(x)
+	yTS, _, ySet := e.read(y)
+	if ySet && (!xSet || e.replaces(yTS, xTS)) {
+		copy(b[:width], y[:width])
+	} else {
+		copy(b[:width], x[:width])
+	}
+	return b[width:], x[width:], y[width:]
+}
+
+func (e *label) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, 0, len(subs))
+	for _, sub := range subs {
+		var sm SubMerge
+		if e.String() == sub.String() {
+			sm = e.subMerge
+		}
+		result = append(result, sm)
+	}
+	return result
+}
+
+func (e *label) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+func (e *label) Get(b []byte) (float64, bool, []byte) {
+	value, wasSet := e.time(b)
+	return value, wasSet, b[e.EncodedWidth():]
+}
+
+// time returns the time of the value in slot in seconds since the epoch.
+func (e *label) time(slot []byte) (float64, bool) {
+	ts, _, isSet := e.read(slot)
+	if !isSet {
+		return 0, false
+	}
+	return float64(ts) / float64(time.Second), true
+}
+
+func (e *label) read(slot []byte) (ts int64, value string, isSet bool) {
+	length := int(slot[labelTimeWidth])
+	if length == 0 {
+		return 0, "", false
+	}
+	if length > e.MaxLength {
+		length = e.MaxLength
+	}
+	ts = int64(binaryEncoding.Uint64(slot))
+	start := labelTimeWidth + 1
+	return ts, string(slot[start : start+length]), true
+}
+
+func (e *label) write(slot []byte, ts int64, value string) {
+	if len(value) > e.MaxLength {
+		value = value[:e.MaxLength]
+	}
+	binaryEncoding.PutUint64(slot, uint64(ts))
+	slot[labelTimeWidth] = byte(len(value))
+	start := labelTimeWidth + 1
+	n := copy(slot[start:start+e.MaxLength], value)
+	for i := start + n; i < start+e.MaxLength; i++ {
+		slot[i] = 0
+	}
+}
+
+func (e *label) IsConstant() bool {
+	return false
+}
+
+func (e *label) DeAggregate() Expr {
+	return e
+}
+
+func (e *label) name() string {
+	if e.Last {
+		return "LAST"
+	}
+	return "FIRST"
+}
+
+func (e *label) String() string {
+	return fmt.Sprintf("%v(%v, %v)", e.name(), e.Dim, e.MaxLength)
+}
@@ -0,0 +1,111 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/getlantern/goexpr"
+	"github.com/stretchr/testify/assert"
+)
+
+type timedTestParams int64
+
+func (p timedTestParams) Get(name string) (float64, bool) {
+	return 0, false
+}
+
+func (p timedTestParams) TimeInt() int64 {
+	return int64(p)
+}
+
+func TestLast(t *testing.T) {
+	e := msgpacked(t, LAST("status", 8))
+	if !assert.NoError(t, e.Validate()) {
+		return
+	}
+	b := make([]byte, e.EncodedWidth())
+	_, wasSet, _ := e.Get(b)
+	assert.False(t, wasSet)
+
+	update := func(ts int64, status interface{}) bool {
+		_, _, updated := e.Update(b, timedTestParams(ts), goexpr.MapParams{"status": status})
+		return updated
+	}
+	assert.True(t, update(2e9, "up"))
+	assert.True(t, update(3e9, "down"))
+	assert.False(t, update(1e9, "starting"), "Older value should not replace newer one")
+	assert.False(t, update(4e9, ""), "Empty value should be ignored")
+	label, ok := GetLabel(e, b)
+	assert.True(t, ok)
+	assert.Equal(t, "down", label)
+	val, wasSet, _ := e.Get(b)
+	assert.True(t, wasSet)
+	assert.EqualValues(t, 3, val, "Value should be the time of the label in seconds")
+
+	assert.True(t, update(5e9, "a very long status"))
+	label, _ = GetLabel(e, b)
+	assert.Equal(t, "a very l", label, "Long values should be truncated")
+	assert.True(t, update(6e9, 42))
+	label, _ = GetLabel(e, b)
+	assert.Equal(t, "42", label, "Non-string values should be formatted")
+
+	_, _, updated := e.Update(b, nil, goexpr.MapParams{"status": "untimed"})
+	assert.False(t, updated, "Value without time is older than any timed value")
+	_, _, updated = e.Update(b, nil, goexpr.MapParams{"other": "x"})
+	assert.False(t, updated)
+	_, ok = GetLabel(SUM("status"), b)
+	assert.False(t, ok, "GetLabel should only work for LAST and FIRST")
+}
+
+func TestFirst(t *testing.T) {
+	e := msgpacked(t, FIRST("status", 8))
+	b := make([]byte, e.EncodedWidth())
+	for _, update := range []struct {
+		ts     int64
+		status string
+	}{{2e9, "up"}, {1e9, "starting"}, {3e9, "down"}, {1e9, "tied"}} {
+		e.Update(b, timedTestParams(update.ts), goexpr.MapParams{"status": update.status})
+	}
+	label, ok := GetLabel(e, b)
+	assert.True(t, ok)
+	assert.Equal(t, "starting", label, "Earliest value should be kept, with ties going to the existing value")
+}
+
+func TestLabelMerge(t *testing.T) {
+	for _, last := range []bool{true, false} {
+		e := msgpacked(t, newLabel("status", 8, last))
+		fill := func(ts int64, status string) []byte {
+			b := make([]byte, e.EncodedWidth())
+			e.Update(b, timedTestParams(ts), goexpr.MapParams{"status": status})
+			return b
+		}
+		merge := func(x []byte, y []byte) []byte {
+			b := make([]byte, e.EncodedWidth())
+			e.Merge(b, x, y)
+			return b
+		}
+
+		x := fill(1e9, "x")
+		y := fill(2e9, "y")
+		z := fill(3e9, "z")
+		empty := make([]byte, e.EncodedWidth())
+
+		all := merge(merge(x, y), z)
+		assert.Equal(t, all, merge(x, merge(y, z)), "merge should be associative")
+		assert.Equal(t, merge(x, z), merge(z, x), "merge should be commutative")
+		assert.Equal(t, x, merge(x, empty), "merging with unset should be identity")
+		assert.Equal(t, x, merge(empty, x), "merging into unset should be identity")
+		label, _ := GetLabel(e, all)
+		if last {
+			assert.Equal(t, "z", label)
+		} else {
+			assert.Equal(t, "x", label)
+		}
+	}
+}
+
+func TestLabelValidate(t *testing.T) {
+	assert.NoError(t, LAST("status", DefaultLabelLength).Validate())
+	assert.Error(t, LAST("", DefaultLabelLength).Validate())
+	assert.Error(t, FIRST("status", 0).Validate())
+	assert.Error(t, FIRST("status", MaxLabelLength+1).Validate())
+}
@@ -82,3 +82,46 @@ func TestPercentileSize(t *testing.T) {
 	p := PERCENTILE("A", 50, 0, 120, 1)
 	fmt.Println(p.(*ptile).Width)
 }
+
+func TestPercentileMergeAssociative(t *testing.T) {
+	e := msgpacked(t, PERCENTILE(SUM("a"), 95, 0, 100, 2))
+	md := goexpr.MapParams{}
+
+	fill := func(from, to float64) []byte {
+		b := make([]byte, e.EncodedWidth())
+		for k := from; k <= to; k++ {
+			e.Update(b, Map{"a": k / 3}, md)
+		}
+		return b
+	}
+	merge := func(x []byte, y []byte) []byte {
+		b := make([]byte, e.EncodedWidth())
+		e.Merge(b, x, y)
+		return b
+	}
+
+	x := fill(1, 100)
+	y := fill(50, 250)
+	z := fill(200, 300)
+	empty := make([]byte, e.EncodedWidth())
+
+	left := merge(merge(x, y), z)
+	right := merge(x, merge(y, z))
+	assert.Equal(t, left, right, "merge should be associative")
+	assert.Equal(t, merge(x, y), merge(y, x), "merge should be commutative")
+	assert.Equal(t, x, merge(x, empty), "merging with unset should be identity")
+	assert.Equal(t, x, merge(empty, x), "merging into unset should be identity")
+
+	all := fill(1, 100)
+	for k := float64(50); k <= 250; k++ {
+		e.Update(all, Map{"a": k / 3}, md)
+	}
+	for k := float64(200); k <= 300; k++ {
+		e.Update(all, Map{"a": k / 3}, md)
+	}
+	expected, _, _ := e.Get(all)
+	actual, wasSet, _ := e.Get(left)
+	if assert.True(t, wasSet) {
+		AssertFloatEquals(t, expected, actual)
+	}
+}
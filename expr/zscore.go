@@ -0,0 +1,156 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/getlantern/goexpr"
+)
+
+// ZSCORE creates an Expr that, for each period, gives the number of standard
+// deviations by which the value of the wrapped expression deviates from the
+// mean of its values over the preceding window. The value is null if there
+// isn't a full window of history or if the history doesn't vary. The wrapped
+// expression must match a field in the underlying table.
+//
+// ZSCORE is calculated at the resolution of the underlying data. When multiple
+// periods or rows are grouped together, the most extreme z-score wins.
+//
+// The history is limited to the data in the query's own time window, since
+// that's all the data the table reads. Consequently, the first window's worth
+// of periods in the results is always null. To get z-scores for a given span
+// of time, query a window that starts that much earlier and ignore the leading
+// nulls.
+func ZSCORE(wrapped interface{}, window time.Duration) Expr {
+	return &zscore{exprFor(wrapped), window}
+}
+
+type zscore struct {
+	Wrapped Expr
+	Window  time.Duration
+}
+
+func (e *zscore) Validate() error {
+	if e.Window <= 0 {
+		return fmt.Errorf("ZSCORE window must be positive, not %v", e.Window)
+	}
+	return e.Wrapped.Validate()
+}
+
+func (e *zscore) EncodedWidth() int {
+	return 1 + width64bits
+}
+
+func (e *zscore) Shift() time.Duration {
+	return e.Wrapped.Shift()
+}
+
+func (e *zscore) Update(b []byte, params Params, metadata goexpr.Params) ([]byte, float64, bool) {
+	// z-scores can only be calculated from existing data using SubMerge
+	value, _, remain := e.load(b)
+	return remain, value, false
+}
+
+func (e *zscore) Merge(b []byte, x []byte, y []byte) ([]byte, []byte, []byte) {
+	valueX, xWasSet, remainX := e.load(x)
+	valueY, yWasSet, remainY := e.load(y)
+	if yWasSet && (!xWasSet || math.Abs(valueY) > math.Abs(valueX)) {
+		b = e.save(b, valueY)
+	} else if xWasSet {
+		b = e.save(b, valueX)
+	} else {
+		// Nothing to save, just advance
+		b = b[width64bits+1:]
+	}
+	return b, remainX, remainY
+}
+
+func (e *zscore) SubMergers(subs []Expr) []SubMerge {
+	result := make([]SubMerge, len(subs))
+	for i, sub := range subs {
+		if e.String() == sub.String() {
+			result[i] = e.subMerge
+		} else if e.Wrapped.String() == sub.String() {
+			result[i] = e.calculate
+		}
+	}
+	return result
+}
+
+func (e *zscore) subMerge(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	e.Merge(data, data, other)
+}
+
+// calculate calculates the z-score for the first period in other based on the
+// window of periods that follow it (i.e. precede it in time).
+func (e *zscore) calculate(data []byte, other []byte, otherRes time.Duration, metadata goexpr.Params) {
+	width := e.Wrapped.EncodedWidth()
+	windowPeriods := int(e.Window / otherRes)
+	if windowPeriods < 2 || len(other) < (windowPeriods+1)*width {
+		// not enough history
+		return
+	}
+	value, wasSet, _ := e.Wrapped.Get(other)
+	if !wasSet {
+		return
+	}
+
+	history := make([]float64, 0, windowPeriods)
+	total := float64(0)
+	for i := 1; i <= windowPeriods; i++ {
+		v, vWasSet, _ := e.Wrapped.Get(other[i*width:])
+		if vWasSet {
+			history = append(history, v)
+			total += v
+		}
+	}
+	if len(history) < 2 {
+		return
+	}
+	mean := total / float64(len(history))
+	sumOfSquares := float64(0)
+	for _, v := range history {
+		sumOfSquares += (v - mean) * (v - mean)
+	}
+	stddev := math.Sqrt(sumOfSquares / float64(len(history)))
+	if stddev == 0 {
+		return
+	}
+
+	z := make([]byte, e.EncodedWidth())
+	e.save(z, (value-mean)/stddev)
+	e.Merge(data, data, z)
+}
+
+func (e *zscore) Get(b []byte) (float64, bool, []byte) {
+	return e.load(b)
+}
+
+func (e *zscore) load(b []byte) (float64, bool, []byte) {
+	remain := b[width64bits+1:]
+	value := float64(0)
+	wasSet := b[0] == 1
+	if wasSet {
+		value = math.Float64frombits(binaryEncoding.Uint64(b[1:]))
+	}
+	return value, wasSet, remain
+}
+
+func (e *zscore) save(b []byte, value float64) []byte {
+	b[0] = 1
+	binaryEncoding.PutUint64(b[1:], math.Float64bits(value))
+	return b[width64bits+1:]
+}
+
+func (e *zscore) IsConstant() bool {
+	return e.Wrapped.IsConstant()
+}
+
+func (e *zscore) DeAggregate() Expr {
+	return ZSCORE(e.Wrapped.DeAggregate(), e.Window)
+}
+
+func (e *zscore) String() string {
+	return fmt.Sprintf("ZSCORE(%v, %v)", e.Wrapped, e.Window)
+}
@@ -0,0 +1,64 @@
+package expr
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZScoreSubMerge(t *testing.T) {
+	res := 1 * time.Minute
+	periods := 20
+	spikeAt := 5
+
+	fa := msgpacked(t, SUM(FIELD("a")))
+	zs := msgpacked(t, ZSCORE(SUM(FIELD("a")), 4*res))
+	assert.NoError(t, zs.Validate())
+	assert.Error(t, ZSCORE(SUM(FIELD("a")), 0).Validate())
+
+	// Periods are in descending time order, so the history for each period
+	// follows it. The baseline alternates between 10 and 12.
+	a := make([]byte, fa.EncodedWidth()*periods)
+	for i := 0; i < periods; i++ {
+		v := float64(10 + 2*(i%2))
+		if i == spikeAt {
+			v = 30
+		}
+		fa.Update(a[i*fa.EncodedWidth():], Map{"a": v}, nil)
+	}
+
+	s := make([]byte, zs.EncodedWidth()*periods)
+	subs := zs.SubMergers([]Expr{fa})
+	if !assert.NotNil(t, subs[0]) {
+		return
+	}
+	for i := 0; i < periods; i++ {
+		subs[0](s[i*zs.EncodedWidth():], a[i*fa.EncodedWidth():], res, nil)
+	}
+
+	threshold := float64(3)
+	for i := 0; i < periods; i++ {
+		z, wasSet, _ := zs.Get(s[i*zs.EncodedWidth():])
+		if i > periods-5 {
+			assert.False(t, wasSet, "Period %d has insufficient history and should be null", i)
+			continue
+		}
+		if !assert.True(t, wasSet, "Period %d should have a z-score", i) {
+			continue
+		}
+		if i == spikeAt {
+			assert.True(t, z > threshold, "Spike at period %d should cross threshold, z-score was %v", i, z)
+		} else {
+			assert.True(t, math.Abs(z) < threshold, "Period %d should not cross threshold, z-score was %v", i, z)
+		}
+	}
+
+	// Merging keeps the most extreme z-score
+	merged := make([]byte, zs.EncodedWidth())
+	zs.Merge(merged, s[spikeAt*zs.EncodedWidth():], s[(spikeAt+1)*zs.EncodedWidth():])
+	expected, _, _ := zs.Get(s[spikeAt*zs.EncodedWidth():])
+	actual, _, _ := zs.Get(merged)
+	assert.Equal(t, expected, actual)
+}
@@ -0,0 +1,240 @@
+package zenodb
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/core"
+)
+
+const (
+	fieldRenamesDir      = "fieldrenames"
+	fieldRenamesFilename = "fieldrenames.json"
+)
+
+// DropField removes the named field from this table. Existing files keep the
+// field's data, but it's skipped when reading them and omitted whenever they
+// get rewritten, so the space it takes up is reclaimed lazily by flushes (and
+// by compactions in incremental mode) rather than by rewriting all files now.
+// Queries that select the dropped field fail.
+//
+// Like Alter, this only changes the running table. To keep the field from
+// coming back on restart, remove it from the table's SQL in the schema as well.
+func (t *table) DropField(name string) error {
+	if name == core.PointsField.Name {
+		return errors.New("Field %v can't be dropped", name)
+	}
+	fields := t.getFields()
+	newFields := make(core.Fields, 0, len(fields))
+	for _, field := range fields {
+		if field.Name != name {
+			newFields = append(newFields, field)
+		}
+	}
+	if len(newFields) == len(fields) {
+		return errors.New("Table %v has no field named %v", t.Name, name)
+	}
+	if t.rowStore != nil && !t.rowStore.opts.readOnly {
+		// Columns renamed to the dropped field shouldn't show up under the name of
+		// some future field
+		if err := t.rowStore.updateFieldRenames(func(renames map[string]string) {
+			for oldName, newName := range renames {
+				if newName == name {
+					delete(renames, oldName)
+				}
+			}
+		}); err != nil {
+			return err
+		}
+	}
+
+	// droppedFields is guarded by fieldsMutex
+	t.fieldsMutex.Lock()
+	if t.droppedFields == nil {
+		t.droppedFields = make(map[string]bool)
+	}
+	t.droppedFields[name] = true
+	t.fieldsMutex.Unlock()
+	t.updateFields(newFields)
+	return nil
+}
+
+// RenameField renames the field oldName to newName. Existing files keep the
+// old name, which gets mapped to the new name when reading them until they're
+// rewritten. The mapping is persisted, so it survives restarts.
+//
+// Like Alter, this only changes the running table. To keep the new name on
+// restart, rename the field in the table's SQL in the schema as well.
+func (t *table) RenameField(oldName string, newName string) error {
+	if oldName == core.PointsField.Name {
+		return errors.New("Field %v can't be renamed", oldName)
+	}
+	if newName == "" {
+		return errors.New("Please specify a new name for field %v", oldName)
+	}
+	fields := t.getFields()
+	idx := -1
+	for i, field := range fields {
+		switch field.Name {
+		case oldName:
+			idx = i
+		case newName:
+			return errors.New("Table %v already has a field named %v", t.Name, newName)
+		}
+	}
+	if idx < 0 {
+		return errors.New("Table %v has no field named %v", t.Name, oldName)
+	}
+	if t.rowStore != nil && !t.rowStore.opts.readOnly {
+		if err := t.rowStore.updateFieldRenames(func(renames map[string]string) {
+			for name, renamedTo := range renames {
+				if renamedTo == oldName {
+					// Collapse chains of renames so that only one lookup is needed
+					renames[name] = newName
+				}
+			}
+			renames[oldName] = newName
+			// Columns that already have the new name don't need to be renamed
+			delete(renames, newName)
+		}); err != nil {
+			return err
+		}
+	}
+
+	t.fieldsMutex.Lock()
+	delete(t.droppedFields, newName)
+	t.fieldsMutex.Unlock()
+	fields[idx] = core.NewField(newName, fields[idx].Expr)
+	t.updateFields(fields)
+	return nil
+}
+
+// updateFields applies the given fields and, if this table has a row store that
+// writes, waits for it to pick them up.
+func (t *table) updateFields(fields core.Fields) {
+	t.applyFields(fields)
+	if !t.Virtual && !t.db.opts.Passthrough && !t.db.opts.ReadReplica && !t.ReadOnly {
+		// The row store switches fields asynchronously, forcing a flush waits for
+		// that to finish
+		t.forceFlush()
+	}
+}
+
+// checkDroppedFields returns an error if any of the given fields was dropped
+// from this table.
+func (t *table) checkDroppedFields(fields core.Fields) error {
+	t.fieldsMutex.RLock()
+	defer t.fieldsMutex.RUnlock()
+	for _, field := range fields {
+		if t.droppedFields[field.Name] {
+			return errors.New("Field %v was dropped from table %v", field.Name, t.Name)
+		}
+	}
+	return nil
+}
+
+// renamedField returns the current field for a field that's stored in a file
+// under a name that has since been renamed, or an empty field if there is none.
+func (fs *fileStore) renamedField(fieldString string) core.Field {
+	if fs.rs == nil {
+		return core.Field{}
+	}
+	for oldName, newName := range fs.rs.getFieldRenames() {
+		for _, field := range fs.fields {
+			if field.Name == newName && core.NewField(oldName, field.Expr).String() == fieldString {
+				return field
+			}
+		}
+	}
+	return core.Field{}
+}
+
+func (rs *rowStore) getFieldRenames() map[string]string {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	return rs.fieldRenames
+}
+
+// updateFieldRenames applies update to a copy of the current field renames
+// (old name -> new name) and persists the result.
+func (rs *rowStore) updateFieldRenames(update func(renames map[string]string)) error {
+	rs.mx.Lock()
+	defer rs.mx.Unlock()
+	// copy on write so that readers can hold on to the current renames
+	renames := make(map[string]string, len(rs.fieldRenames)+1)
+	for oldName, newName := range rs.fieldRenames {
+		renames[oldName] = newName
+	}
+	update(renames)
+	if err := rs.writeFieldRenames(renames); err != nil {
+		return err
+	}
+	rs.fieldRenames = renames
+	return nil
+}
+
+// fieldRenamesFile returns the path of the file in which field renames are
+// persisted. Like tombstones, it lives in its own subdirectory so that it's not
+// mistaken for a file store.
+func (rs *rowStore) fieldRenamesFile() string {
+	return filepath.Join(rs.opts.dir, fieldRenamesDir, fieldRenamesFilename)
+}
+
+func (rs *rowStore) writeFieldRenames(renames map[string]string) error {
+	filename := rs.fieldRenamesFile()
+	if len(renames) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return errors.New("Unable to remove field renames file %v: %v", filename, err)
+		}
+		return nil
+	}
+
+	b, err := json.Marshal(renames)
+	if err != nil {
+		return errors.New("Unable to marshal field renames: %v", err)
+	}
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.New("Unable to create field renames directory %v: %v", dir, err)
+	}
+	file, err := ioutil.TempFile(dir, "nextfieldrenames")
+	if err != nil {
+		return errors.New("Unable to create temp file for field renames: %v", err)
+	}
+	defer file.Close()
+	_, err = file.Write(b)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.New("Unable to write field renames to %v: %v", filename, err)
+	}
+	return nil
+}
+
+// readFieldRenames reads the persisted field renames, if any.
+func (rs *rowStore) readFieldRenames() (map[string]string, error) {
+	filename := rs.fieldRenamesFile()
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("Unable to read field renames file %v: %v", filename, err)
+	}
+	var renames map[string]string
+	if err := json.Unmarshal(b, &renames); err != nil {
+		return nil, errors.New("Unable to parse field renames file %v: %v", filename, err)
+	}
+	return renames, nil
+}
@@ -0,0 +1,122 @@
+package zenodb
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDropAndRenameField(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "changing",
+		RetentionPeriod: 1 * time.Hour,
+		// Incremental flushes leave the files written before the changes alone
+		MaxFileStores: 10,
+		SQL:           "SELECT SUM(v) AS v, SUM(w) AS w FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("changing")
+	rs := tbl.rowStore
+
+	insert := func(k string) {
+		_, err := db.InsertBatch("changing", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": 1, "w": 2}}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	query := func(sqlString string) (map[string][]float64, error) {
+		source, err := db.Query(sqlString, false, nil, true)
+		if err != nil {
+			return nil, err
+		}
+		results := make(map[string][]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			if row.TS == epoch.UnixNano() {
+				results[row.Key.Get("k").(string)] = append([]float64(nil), row.Values...)
+			}
+			return true, nil
+		})
+		return results, err
+	}
+
+	insert("old")
+	tbl.forceFlush()
+
+	assert.Error(t, tbl.RenameField("w", "v"), "Renaming to an existing name should fail")
+	assert.Error(t, tbl.RenameField("unknown", "z"), "Renaming an unknown field should fail")
+	if !assert.NoError(t, tbl.RenameField("w", "x")) {
+		return
+	}
+	insert("new")
+
+	results, err := query("SELECT x FROM changing")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string][]float64{"old": {2}, "new": {2}}, results, "Data written before the rename should be visible under the new name")
+	}
+	renames, err := rs.readFieldRenames()
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]string{"w": "x"}, renames, "Renames should have been persisted")
+	}
+
+	// Renaming again collapses the chain of renames
+	if !assert.NoError(t, tbl.RenameField("x", "y")) {
+		return
+	}
+	assert.Equal(t, map[string]string{"w": "y", "x": "y"}, rs.getFieldRenames())
+	results, err = query("SELECT y FROM changing")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string][]float64{"old": {2}, "new": {2}}, results, "Data should survive multiple renames")
+	}
+
+	assert.Error(t, tbl.DropField("unknown"), "Dropping an unknown field should fail")
+	assert.Error(t, tbl.DropField(core.PointsField.Name), "Dropping _points should fail")
+	if !assert.NoError(t, tbl.DropField("v")) {
+		return
+	}
+	_, err = query("SELECT v FROM changing")
+	assert.Error(t, err, "Querying a dropped field should fail")
+	results, err = query("SELECT * FROM changing")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string][]float64{"old": {1, 2}, "new": {1, 2}}, results, "Only _points and y should remain")
+	}
+
+	// Compacting everything rewrites the files without the dropped field and
+	// with the new names
+	_, err = tbl.PurgeDeleted(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	rs.mx.RLock()
+	fs := rs.fileStore
+	rs.mx.RUnlock()
+	if assert.Len(t, fs.files(), 1) {
+		file, err := os.Open(fs.filename)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer file.Close()
+		r, header, err := readFileHeader(file, fs.filename, 0)
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, _, fileFields, _, err := fs.info(r, header.version)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"_points", "y"}, fileFields.Names(), "Dropped field should have been omitted")
+		}
+	}
+	results, err = query("SELECT y FROM changing")
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string][]float64{"old": {2}, "new": {2}}, results)
+	}
+}
@@ -0,0 +1,116 @@
+package zenodb
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/getlantern/errors"
+	"github.com/golang/snappy"
+)
+
+const (
+	// FileCodecIDNone identifies file stores that aren't compressed
+	FileCodecIDNone = 0
+	// FileCodecIDSnappy identifies file stores that use the snappy framing
+	// format
+	FileCodecIDSnappy = 1
+)
+
+// FileCodec compresses and decompresses the data in file stores. The codec's
+// ID is recorded in each file's header so that files are always read with the
+// codec that wrote them, regardless of the codec currently configured for the
+// table.
+type FileCodec interface {
+	// ID uniquely identifies this codec in file headers
+	ID() byte
+
+	// NewWriter returns a writer that compresses to w. Closing the returned
+	// writer must flush all buffered data (reporting any errors doing so) but
+	// must not close w.
+	NewWriter(w io.Writer) io.WriteCloser
+
+	// NewReader returns a reader that decompresses from r.
+	NewReader(r io.Reader) io.Reader
+}
+
+var (
+	// SnappyFileCodec compresses file stores with snappy. This is the default.
+	SnappyFileCodec FileCodec = snappyFileCodec{}
+
+	// UncompressedFileCodec stores file stores without compression, which
+	// saves CPU on hot tables at the expense of disk space.
+	UncompressedFileCodec FileCodec = uncompressedFileCodec{}
+
+	fileCodecs = map[byte]FileCodec{
+		FileCodecIDNone:   UncompressedFileCodec,
+		FileCodecIDSnappy: SnappyFileCodec,
+	}
+)
+
+// RegisterFileCodec makes the given codec available for writing and reading
+// file stores, for example to use zstd on cold tables. Codecs must be
+// registered before opening any tables whose files use them.
+func RegisterFileCodec(codec FileCodec) error {
+	_, found := fileCodecs[codec.ID()]
+	if found {
+		return errors.New("File codec %d already registered", codec.ID())
+	}
+	fileCodecs[codec.ID()] = codec
+	return nil
+}
+
+func fileCodecFor(id byte) (FileCodec, bool) {
+	codec, found := fileCodecs[id]
+	return codec, found
+}
+
+type snappyFileCodec struct{}
+
+func (c snappyFileCodec) ID() byte {
+	return FileCodecIDSnappy
+}
+
+func (c snappyFileCodec) NewWriter(w io.Writer) io.WriteCloser {
+	return &snappyWriter{snappy.NewBufferedWriter(w)}
+}
+
+func (c snappyFileCodec) NewReader(r io.Reader) io.Reader {
+	return snappy.NewReader(r)
+}
+
+// snappyWriter flushes manually before closing, since snappy's own Close()
+// function doesn't check the return value of flush
+type snappyWriter struct {
+	*snappy.Writer
+}
+
+func (w *snappyWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		w.Writer.Close()
+		return err
+	}
+	return w.Writer.Close()
+}
+
+type uncompressedFileCodec struct{}
+
+func (c uncompressedFileCodec) ID() byte {
+	return FileCodecIDNone
+}
+
+func (c uncompressedFileCodec) NewWriter(w io.Writer) io.WriteCloser {
+	return &bufferedWriter{bufio.NewWriter(w)}
+}
+
+func (c uncompressedFileCodec) NewReader(r io.Reader) io.Reader {
+	return r
+}
+
+// bufferedWriter is a bufio.Writer that flushes on Close
+type bufferedWriter struct {
+	*bufio.Writer
+}
+
+func (w *bufferedWriter) Close() error {
+	return w.Flush()
+}
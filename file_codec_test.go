@@ -0,0 +1,90 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCodecs(t *testing.T) {
+	assert.Error(t, RegisterFileCodec(SnappyFileCodec), "Registering duplicate codec should fail")
+
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	open := func(codec FileCodec) (*DB, *table) {
+		db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		db.clock.Advance(epoch)
+		err = db.CreateTable(&TableOpts{
+			Name:            "compressed",
+			RetentionPeriod: 1 * time.Hour,
+			Codec:           codec,
+			SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+		})
+		if !assert.NoError(t, err) {
+			db.Close()
+			t.FailNow()
+		}
+		return db, db.getTable("compressed")
+	}
+	insertAndFlush := func(db *DB, tbl *table) {
+		_, err := db.InsertBatch("compressed", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		tbl.forceFlush()
+	}
+	codecOf := func(tbl *table) FileCodec {
+		tbl.rowStore.mx.RLock()
+		filename := tbl.rowStore.fileStore.filename
+		tbl.rowStore.mx.RUnlock()
+		file, err := os.Open(filename)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		defer file.Close()
+		_, header, err := readFileHeader(file, filename, 0)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return header.codec
+	}
+	read := func(tbl *table) float64 {
+		field := tbl.getFields()[0]
+		var result float64
+		_, err := tbl.iterate(context.Background(), tbl.getFields(), false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			result, _ = vals[0].ValueAtTime(epoch, field.Expr, tbl.Resolution)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	db, tbl := open(UncompressedFileCodec)
+	insertAndFlush(db, tbl)
+	assert.Equal(t, UncompressedFileCodec, codecOf(tbl))
+	assert.EqualValues(t, 1, read(tbl))
+	db.Close()
+
+	// Switching codecs still reads existing files and writes new ones with the
+	// new codec
+	db, tbl = open(SnappyFileCodec)
+	defer db.Close()
+	assert.EqualValues(t, 1, read(tbl), "Should be able to read uncompressed file after switching codec")
+	insertAndFlush(db, tbl)
+	assert.Equal(t, SnappyFileCodec, codecOf(tbl))
+	assert.EqualValues(t, 2, read(tbl))
+}
@@ -0,0 +1,149 @@
+package zenodb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// File stores begin with a small uncompressed header:
+//
+//	magic|version|framing
+//
+// magic is the 4 bytes "ZDBF"
+// version is the 16 bit file format version
+// framing is the ID of the FileCodec used to compress the remainder of the file
+//
+// Files written before the header was introduced start directly with snappy
+// framed data, in which case the version comes from the filename.
+//
+// Starting with FileVersion_9, files end with a footer (see fileFooter)
+// following the compressed data. Starting with FileVersion_13, the footer
+// records the resolution of the table that wrote the file, which is checked
+// when opening the table (see checkCompatibility).
+const (
+	fileHeaderLength = 7
+)
+
+var (
+	fileStoreMagic = []byte("ZDBF")
+)
+
+// unsupportedFileError indicates that a file store was written in a format
+// that this version of zenodb doesn't understand, which unlike other errors
+// reading the header doesn't mean that the file is corrupt.
+type unsupportedFileError struct {
+	error
+}
+
+// fileHeader describes a file store as recorded in its header.
+type fileHeader struct {
+	// version is the file format version
+	version int
+	// codec is the codec used to compress the rest of the file
+	codec FileCodec
+	// length is the number of bytes taken up by the header (0 for files without
+	// one)
+	length int
+	// footer is the footer at the end of the file, nil for files written before
+	// FileVersion_9
+	footer *fileFooter
+}
+
+// writeFileHeader writes the header for a file store in the given version
+// that's compressed with the given codec.
+func writeFileHeader(out io.Writer, fileVersion int, codec FileCodec) error {
+	header := make([]byte, fileHeaderLength)
+	copy(header, fileStoreMagic)
+	encoding.Binary.PutUint16(header[len(fileStoreMagic):], uint16(fileVersion))
+	header[fileHeaderLength-1] = codec.ID()
+	_, err := out.Write(header)
+	return err
+}
+
+// readFileHeader reads the header from the start of the given file store, if
+// it has one, and returns a reader for the decompressed data following it (up
+// to the footer, if any). Files without a header are assumed to be snappy
+// compressed and in legacyVersion.
+func readFileHeader(in io.ReadSeeker, filename string, legacyVersion int) (io.Reader, *fileHeader, error) {
+	br := bufio.NewReader(in)
+	magic, err := br.Peek(len(fileStoreMagic))
+	if err != nil && err != io.EOF {
+		return nil, nil, errors.New("Unable to read header from %v: %v", filename, err)
+	}
+	if !bytes.Equal(magic, fileStoreMagic) {
+		// Legacy file without header
+		return SnappyFileCodec.NewReader(br), &fileHeader{version: legacyVersion, codec: SnappyFileCodec}, nil
+	}
+
+	header := make([]byte, fileHeaderLength)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, nil, errors.New("Unable to read header from %v: %v", filename, err)
+	}
+	fileVersion := int(encoding.Binary.Uint16(header[len(fileStoreMagic):]))
+	if _, known := fieldsDelims[fileVersion]; !known {
+		return nil, nil, &unsupportedFileError{errors.New("File %v has unknown format version %d, this version of zenodb supports up to version %d", filename, fileVersion, CurrentFileVersion)}
+	}
+	framing := header[fileHeaderLength-1]
+	codec, found := fileCodecFor(framing)
+	if !found {
+		return nil, nil, &unsupportedFileError{errors.New("File %v uses unknown codec %d", filename, framing)}
+	}
+	fh := &fileHeader{version: fileVersion, codec: codec, length: fileHeaderLength}
+	if fileVersion < FileVersion_9 {
+		return codec.NewReader(br), fh, nil
+	}
+
+	fh.footer, err = readFileFooter(in, filename, fileVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Limit reading to the data between the header and the footer
+	if _, err := in.Seek(fileHeaderLength, io.SeekStart); err != nil {
+		return nil, nil, errors.New("Unable to seek past header of %v: %v", filename, err)
+	}
+	data := bufio.NewReader(io.LimitReader(in, fh.footer.dataEnd-fileHeaderLength))
+	return codec.NewReader(data), fh, nil
+}
+
+// checkCompatibility makes sure that all files of this file store can be read
+// by the table as it's currently defined. Merging files relies on all sorted
+// files being sorted in the given order, so a table can't mix files in
+// ascending and descending order. Sequences are laid out by the table's
+// resolution, so reading files that were written with a different resolution
+// would misinterpret their periods. Files whose header can't be read are left
+// to whoever reads them next.
+func (fs *fileStore) checkCompatibility(order keyOrder, resolution time.Duration) error {
+	for _, filename := range fs.files() {
+		file, err := os.Open(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.New("Unable to open file %v: %v", filename, err)
+		}
+		_, header, err := readFileHeader(file, filename, fs.t.versionFor(filename))
+		file.Close()
+		if err != nil {
+			fs.t.log.Errorf("Unable to check compatibility of %v: %v", filename, err)
+			continue
+		}
+		if header.footer == nil {
+			continue
+		}
+		// Only files with a key index are sorted
+		if len(header.footer.index) > 0 && header.footer.order != order {
+			return errors.New("File %v is sorted in %v key order, but table %v uses %v key order", filename, header.footer.order, fs.t.Name, order)
+		}
+		// Files written before FileVersion_13 don't record their resolution
+		if header.footer.resolution > 0 && header.footer.resolution != resolution {
+			return errors.New("File %v was written with a resolution of %v, but table %v has a resolution of %v, restore the previous resolution to open it", filename, header.footer.resolution, fs.t.Name, resolution)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileHeader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	// Version 8 files have a header but no footer
+	if !assert.NoError(t, writeFileHeader(buf, FileVersion_8, SnappyFileCodec)) {
+		return
+	}
+	sout := snappy.NewBufferedWriter(buf)
+	sout.Write([]byte("data"))
+	sout.Close()
+	rawHeader := append([]byte(nil), buf.Bytes()[:fileHeaderLength]...)
+	assert.Equal(t, fileStoreMagic, rawHeader[:len(fileStoreMagic)])
+
+	r, header, err := readFileHeader(bytes.NewReader(buf.Bytes()), "current", FileVersion_4)
+	if assert.NoError(t, err) {
+		assert.Equal(t, FileVersion_8, header.version, "Version should come from header rather than legacy version")
+		assert.Nil(t, header.footer)
+		assert.Equal(t, SnappyFileCodec, header.codec)
+		assert.Equal(t, fileHeaderLength, header.length)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "data", string(data))
+	}
+
+	// Files without a header use the legacy version
+	r, header, err = readFileHeader(bytes.NewReader(buf.Bytes()[fileHeaderLength:]), "legacy", FileVersion_6)
+	if assert.NoError(t, err) {
+		assert.Equal(t, FileVersion_6, header.version)
+		assert.Equal(t, SnappyFileCodec, header.codec, "Legacy files should use snappy")
+		assert.Zero(t, header.length)
+		data, err := ioutil.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "data", string(data))
+	}
+
+	unknownVersion := append([]byte(nil), buf.Bytes()...)
+	encoding.Binary.PutUint16(unknownVersion[len(fileStoreMagic):], uint16(CurrentFileVersion+1))
+	_, _, err = readFileHeader(bytes.NewReader(unknownVersion), "filestore_from_future.dat", FileVersion_4)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "filestore_from_future.dat")
+		assert.Contains(t, err.Error(), "unknown format version")
+	}
+
+	unknownCodec := append([]byte(nil), buf.Bytes()...)
+	unknownCodec[fileHeaderLength-1] = 255
+	_, _, err = readFileHeader(bytes.NewReader(unknownCodec), "filestore_lz4.dat", FileVersion_4)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown codec")
+	}
+}
+
+func TestUnknownFileVersion(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "versioned", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	_, err := db.InsertBatch("versioned", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("versioned")
+	tbl.forceFlush()
+	rs := tbl.rowStore
+	rs.mx.RLock()
+	fs := rs.fileStore
+	rs.mx.RUnlock()
+
+	data, err := ioutil.ReadFile(fs.filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	encoding.Binary.PutUint16(data[len(fileStoreMagic):], uint16(CurrentFileVersion+1))
+	futureFilename := filepath.Join(filepath.Dir(fs.filename), "filestore_future.dat")
+	if !assert.NoError(t, ioutil.WriteFile(futureFilename, data, 0644)) {
+		return
+	}
+	defer os.Remove(futureFilename)
+
+	future := &fileStore{t: tbl, rs: rs, fields: rs.fields, filename: futureFilename}
+	rows := 0
+	_, err = future.iterate(tbl.getFields(), nil, false, false, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		rows++
+		return true, nil
+	})
+	if assert.Error(t, err, "Reading file with unknown version should fail") {
+		assert.Contains(t, err.Error(), futureFilename)
+	}
+	assert.Zero(t, rows, "No rows should have been read from file with unknown version")
+
+	_, err = tbl.iterate(context.Background(), tbl.getFields(), false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		return true, nil
+	})
+	assert.NoError(t, err, "Reading current file should still work")
+}
+
+func TestMismatchedResolutionRejected(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	open := func(resolution string) (*DB, error) {
+		db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		db.clock.Advance(epoch)
+		return db, db.CreateTable(&TableOpts{
+			Name:            "resolved",
+			RetentionPeriod: 1 * time.Hour,
+			SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(" + resolution + ")",
+		})
+	}
+
+	db, err := open("1s")
+	if !assert.NoError(t, err) {
+		db.Close()
+		return
+	}
+	_, err = db.InsertBatch("resolved", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}}})
+	assert.NoError(t, err)
+	tbl := db.getTable("resolved")
+	tbl.forceFlush()
+	file, err := os.Open(tbl.rowStore.fileStore.filename)
+	if assert.NoError(t, err) {
+		_, header, err := readFileHeader(file, file.Name(), 0)
+		file.Close()
+		if assert.NoError(t, err) {
+			assert.Equal(t, time.Second, header.footer.resolution, "Footer should record table's resolution")
+		}
+	}
+	db.Close()
+
+	db, err = open("1m")
+	if assert.Error(t, err, "Opening files with a different resolution should fail") {
+		assert.Contains(t, err.Error(), "resolution")
+	}
+	db.Close()
+
+	db, err = open("1s")
+	assert.NoError(t, err, "Opening files with the same resolution should work")
+	db.Close()
+}
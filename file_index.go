@@ -0,0 +1,553 @@
+package zenodb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// Starting with FileVersion_9, file stores end with an uncompressed footer:
+//
+//	numEntries|entry1|entry2|...|lastentry|bloom|dictionary|order|resolution|rowCount|footerLength|magic
+//
+// numEntries is 32 bits
+// each entry is keyLength|key|row|offset
+// keyLength is 16 bits
+// row is the 64 bit (0 based) index of the row with this key
+// offset is the 64 bit position in the file at which the block of rows starting
+// with this key begins
+// bloom is a bloom filter of all keys in the file (see bloomFilter), only
+// present starting with FileVersion_10
+// dictionary is the dictionary of dimensions used to encode the keys of rows
+// (see keyDictionary), only present starting with FileVersion_11
+// order is the 1 byte keyOrder in which sorted rows are sorted, only present
+// starting with FileVersion_12
+// resolution is the 64 bit resolution in nanoseconds of the table that wrote
+// the file, only present starting with FileVersion_13
+// rowCount is the 64 bit number of rows in the file
+// footerLength is the 32 bit length of the entire footer including itself
+// magic is the 4 bytes "ZDBI"
+//
+// When the rows in a file are sorted by key, every keyIndexInterval-th row
+// starts a new block that's compressed independently of the preceding data,
+// and the footer indexes the first key of each block, in the file's keyOrder. This allows looking up
+// individual keys without decompressing the whole file. Files whose rows
+// aren't sorted have a footer with no entries.
+const (
+	fileFooterTrailerLength = encoding.Width64bits + encoding.Width32bits + 4
+)
+
+var (
+	fileFooterMagic = []byte("ZDBI")
+
+	// keyIndexInterval is the number of rows in each indexed block
+	keyIndexInterval = 1000
+)
+
+// fileFooter describes the footer at the end of a file store.
+type fileFooter struct {
+	// index contains the first key of each block, in the order given by order
+	index []*keyIndexEntry
+	// rowCount is the number of rows in the file
+	rowCount int64
+	// dataEnd is the offset at which the compressed data ends and the footer
+	// begins
+	dataEnd int64
+	// bloom is the bloom filter of keys in the file, nil if the file doesn't
+	// have one
+	bloom *bloomFilter
+	// dictionary is the dictionary with which keys are encoded, nil if keys
+	// in the file aren't encoded
+	dictionary *keyDictionary
+	// order is the order in which the rows are sorted if the file has an index
+	order keyOrder
+	// resolution is the resolution of the table that wrote the file, 0 if the
+	// file doesn't record it
+	resolution time.Duration
+}
+
+type keyIndexEntry struct {
+	key    []byte
+	row    int64
+	offset int64
+}
+
+func writeFileFooter(out io.Writer, fileVersion int, footer *fileFooter) error {
+	footerLength := encoding.Width32bits + fileFooterTrailerLength
+	for _, entry := range footer.index {
+		footerLength += encoding.Width16bits + len(entry.key) + 2*encoding.Width64bits
+	}
+	if fileVersion >= FileVersion_10 {
+		footerLength += footer.bloom.encodedLength()
+	}
+	if fileVersion >= FileVersion_11 {
+		footerLength += footer.dictionary.encodedLength()
+	}
+	if fileVersion >= FileVersion_12 {
+		footerLength++
+	}
+	if fileVersion >= FileVersion_13 {
+		footerLength += encoding.Width64bits
+	}
+	b := make([]byte, 0, footerLength)
+	b = appendUint32(b, uint32(len(footer.index)))
+	for _, entry := range footer.index {
+		b = appendUint16(b, uint16(len(entry.key)))
+		b = append(b, entry.key...)
+		b = appendUint64(b, uint64(entry.row))
+		b = appendUint64(b, uint64(entry.offset))
+	}
+	if fileVersion >= FileVersion_10 {
+		b = footer.bloom.appendTo(b)
+	}
+	if fileVersion >= FileVersion_11 {
+		b = footer.dictionary.appendTo(b)
+	}
+	if fileVersion >= FileVersion_12 {
+		b = append(b, byte(footer.order))
+	}
+	if fileVersion >= FileVersion_13 {
+		b = appendUint64(b, uint64(footer.resolution))
+	}
+	b = appendUint64(b, uint64(footer.rowCount))
+	b = appendUint32(b, uint32(footerLength))
+	b = append(b, fileFooterMagic...)
+	_, err := out.Write(b)
+	return err
+}
+
+// readFileFooter reads the footer from the end of the given file store.
+func readFileFooter(in io.ReadSeeker, filename string, fileVersion int) (*fileFooter, error) {
+	size, err := in.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, errors.New("Unable to determine size of %v: %v", filename, err)
+	}
+	if size < fileHeaderLength+fileFooterTrailerLength {
+		return nil, errors.New("File %v of size %d is too short to contain footer", filename, size)
+	}
+	trailer := make([]byte, fileFooterTrailerLength)
+	if _, err := in.Seek(size-fileFooterTrailerLength, io.SeekStart); err != nil {
+		return nil, errors.New("Unable to seek to footer of %v: %v", filename, err)
+	}
+	if _, err := io.ReadFull(in, trailer); err != nil {
+		return nil, errors.New("Unable to read footer of %v: %v", filename, err)
+	}
+	if !bytes.Equal(trailer[fileFooterTrailerLength-len(fileFooterMagic):], fileFooterMagic) {
+		return nil, errors.New("File %v is missing footer, it may be truncated", filename)
+	}
+	footer := &fileFooter{rowCount: int64(encoding.Binary.Uint64(trailer))}
+	footerLength := int64(encoding.Binary.Uint32(trailer[encoding.Width64bits:]))
+	footer.dataEnd = size - footerLength
+	if footerLength < encoding.Width32bits+fileFooterTrailerLength || footer.dataEnd < fileHeaderLength {
+		return nil, errors.New("File %v has invalid footer length %d", filename, footerLength)
+	}
+
+	b := make([]byte, footerLength-fileFooterTrailerLength)
+	if _, err := in.Seek(footer.dataEnd, io.SeekStart); err != nil {
+		return nil, errors.New("Unable to seek to footer of %v: %v", filename, err)
+	}
+	if _, err := io.ReadFull(in, b); err != nil {
+		return nil, errors.New("Unable to read footer of %v: %v", filename, err)
+	}
+	numEntries := int(encoding.Binary.Uint32(b))
+	b = b[encoding.Width32bits:]
+	for i := 0; i < numEntries; i++ {
+		if len(b) < encoding.Width16bits {
+			return nil, errors.New("Key index in %v is truncated at entry %d", filename, i)
+		}
+		keyLength := int(encoding.Binary.Uint16(b))
+		b = b[encoding.Width16bits:]
+		if len(b) < keyLength+2*encoding.Width64bits {
+			return nil, errors.New("Key index in %v is truncated at entry %d", filename, i)
+		}
+		entry := &keyIndexEntry{key: b[:keyLength]}
+		b = b[keyLength:]
+		entry.row = int64(encoding.Binary.Uint64(b))
+		entry.offset = int64(encoding.Binary.Uint64(b[encoding.Width64bits:]))
+		b = b[2*encoding.Width64bits:]
+		footer.index = append(footer.index, entry)
+	}
+	if fileVersion >= FileVersion_10 {
+		footer.bloom, b, err = readBloomFilter(b, filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fileVersion >= FileVersion_11 {
+		footer.dictionary, b, err = readKeyDictionary(b, filename)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fileVersion >= FileVersion_12 {
+		if len(b) < 1 {
+			return nil, errors.New("Footer of %v is missing key order", filename)
+		}
+		footer.order = keyOrder(b[0])
+		if footer.order != keyOrderAscending && footer.order != keyOrderDescending {
+			return nil, errors.New("File %v has unknown key order %d", filename, footer.order)
+		}
+		b = b[1:]
+	}
+	if fileVersion >= FileVersion_13 {
+		if len(b) < encoding.Width64bits {
+			return nil, errors.New("Footer of %v is missing resolution", filename)
+		}
+		footer.resolution = time.Duration(encoding.Binary.Uint64(b))
+	}
+	return footer, nil
+}
+
+// blockFor finds the block that would contain the given key, returning the
+// entry for that block and the offset at which it ends. Returns a nil entry if
+// the key comes before the first indexed key in the file's keyOrder.
+func (footer *fileFooter) blockFor(key []byte) (*keyIndexEntry, int64) {
+	i := sort.Search(len(footer.index), func(i int) bool {
+		return footer.order.compare(footer.index[i].key, key) > 0
+	})
+	if i == 0 {
+		return nil, 0
+	}
+	end := footer.dataEnd
+	if i < len(footer.index) {
+		end = footer.index[i].offset
+	}
+	return footer.index[i-1], end
+}
+
+// indexingWriter compresses rows written to it using a FileCodec and, when
+// indexing is enabled, starts a new independently compressed block every
+// interval rows, recording the first key of each block in the footer that it
+// writes on Close. Starting with FileVersion_10, the footer also includes a
+// bloom filter of all keys. Starting with FileVersion_11, the keys of rows are
+// encoded using a keyDictionary on their way into the file and the footer
+// includes the dictionary.
+type indexingWriter struct {
+	out               *countingWriter
+	codec             FileCodec
+	w                 io.WriteCloser
+	fileVersion       int
+	interval          int
+	falsePositiveRate float64
+	footer            fileFooter
+	// keyHashes are the bloomHashes of the keys written so far, from which the
+	// bloom filter is built once the number of keys is known
+	keyHashes []uint64
+	// dictionary encodes keys, nil if the file version doesn't encode keys
+	dictionary *keyDictionary
+	// preEncoded indicates that the rows written to us already have keys
+	// encoded with dictionary
+	preEncoded bool
+	// inRows indicates that the file header has been written and that we're
+	// now writing rows
+	inRows bool
+	// prefix buffers the start of the current row until we've seen its length
+	// and key
+	prefix []byte
+	// encodedPrefix buffers the prefix with its key encoded
+	encodedPrefix []byte
+	// remaining is the number of bytes remaining in the current row after the
+	// prefix
+	remaining uint64
+}
+
+// newIndexingWriter creates an indexingWriter that writes a file in the given
+// version to out, which is already at offset in the file. interval of 0
+// disables indexing. falsePositiveRate determines the size of the bloom
+// filter, a rate outside of (0, 1) disables the bloom filter.
+func newIndexingWriter(out io.Writer, codec FileCodec, fileVersion int, offset int64, interval int, falsePositiveRate float64) *indexingWriter {
+	cw := &countingWriter{w: out, n: offset}
+	iw := &indexingWriter{out: cw, codec: codec, w: codec.NewWriter(cw), fileVersion: fileVersion, interval: interval, falsePositiveRate: falsePositiveRate}
+	if fileVersion >= FileVersion_11 {
+		iw.dictionary = newKeyDictionary()
+	}
+	return iw
+}
+
+// usePreEncodedKeys indicates that the rows written to this indexingWriter
+// already have their keys encoded with the given dictionary, as is the case
+// when rewriting archived data. The dictionary is written to the footer as is.
+func (iw *indexingWriter) usePreEncodedKeys(dictionary *keyDictionary) {
+	iw.dictionary = dictionary
+	iw.preEncoded = true
+}
+
+func (iw *indexingWriter) bloomEnabled() bool {
+	return iw.fileVersion >= FileVersion_10 && iw.falsePositiveRate > 0 && iw.falsePositiveRate < 1
+}
+
+// startRows indicates that everything written from now on is rows.
+func (iw *indexingWriter) startRows() {
+	iw.inRows = true
+}
+
+func (iw *indexingWriter) Write(p []byte) (int, error) {
+	if !iw.inRows {
+		return iw.w.Write(p)
+	}
+
+	written := len(p)
+	for len(p) > 0 {
+		if iw.remaining > 0 {
+			n := len(p)
+			if uint64(n) > iw.remaining {
+				n = int(iw.remaining)
+			}
+			if _, err := iw.w.Write(p[:n]); err != nil {
+				return 0, err
+			}
+			iw.remaining -= uint64(n)
+			p = p[n:]
+			continue
+		}
+
+		// Buffer the start of the row until we know its length and key
+		n := iw.prefixLength() - len(iw.prefix)
+		if n > len(p) {
+			n = len(p)
+		}
+		iw.prefix = append(iw.prefix, p[:n]...)
+		p = p[n:]
+		if len(iw.prefix) == iw.prefixLength() {
+			if err := iw.startRow(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// prefixLength returns the length of the current row's prefix, consisting of
+// the row length, key length and key. Until the key length has been buffered,
+// this only covers the row length and key length.
+func (iw *indexingWriter) prefixLength() int {
+	keyLengthEnd := encoding.Width64bits + encoding.Width16bits
+	if len(iw.prefix) < keyLengthEnd {
+		return keyLengthEnd
+	}
+	return keyLengthEnd + int(encoding.Binary.Uint16(iw.prefix[encoding.Width64bits:]))
+}
+
+// startRow writes out the buffered prefix of a new row, starting a new block
+// first if necessary.
+func (iw *indexingWriter) startRow() error {
+	rowLength := encoding.Binary.Uint64(iw.prefix)
+	if rowLength < uint64(len(iw.prefix)) {
+		return errors.New("Row length %d is shorter than row's key", rowLength)
+	}
+	keyStart := encoding.Width64bits + encoding.Width16bits
+	key := iw.prefix[keyStart:]
+	prefix := iw.prefix
+	if iw.dictionary != nil {
+		if iw.preEncoded {
+			var err error
+			key, err = iw.dictionary.decode(key)
+			if err != nil {
+				return errors.New("Unable to decode key: %v", err)
+			}
+		} else {
+			encodedKey := iw.dictionary.encode(key)
+			if len(encodedKey) > math.MaxUint16 {
+				return errors.New("Encoded key of length %d is too long", len(encodedKey))
+			}
+			encodedRowLength := rowLength - uint64(len(key)) + uint64(len(encodedKey))
+			prefix = appendUint64(iw.encodedPrefix[:0], encodedRowLength)
+			prefix = appendUint16(prefix, uint16(len(encodedKey)))
+			prefix = append(prefix, encodedKey...)
+			iw.encodedPrefix = prefix
+		}
+	}
+	if iw.interval > 0 && iw.footer.rowCount%int64(iw.interval) == 0 {
+		if err := iw.startBlock(); err != nil {
+			return err
+		}
+		iw.footer.index = append(iw.footer.index, &keyIndexEntry{key: append([]byte(nil), key...), row: iw.footer.rowCount, offset: iw.out.n})
+	}
+	if iw.bloomEnabled() {
+		iw.keyHashes = append(iw.keyHashes, bloomHash(key))
+	}
+	if _, err := iw.w.Write(prefix); err != nil {
+		return err
+	}
+	iw.remaining = rowLength - uint64(len(iw.prefix))
+	iw.prefix = iw.prefix[:0]
+	iw.footer.rowCount++
+	return nil
+}
+
+// startBlock finishes the current compressed block and starts a new one.
+func (iw *indexingWriter) startBlock() error {
+	if err := iw.w.Close(); err != nil {
+		return err
+	}
+	iw.w = iw.codec.NewWriter(iw.out)
+	return nil
+}
+
+func (iw *indexingWriter) Flush() error {
+	f, ok := iw.w.(flushable)
+	if !ok {
+		return nil
+	}
+	return f.Flush()
+}
+
+// Close finishes writing the compressed data and writes the footer.
+func (iw *indexingWriter) Close() error {
+	if err := iw.w.Close(); err != nil {
+		return err
+	}
+	if len(iw.prefix) > 0 || iw.remaining > 0 {
+		return errors.New("Incomplete row at end of file")
+	}
+	if iw.bloomEnabled() {
+		iw.footer.bloom = newBloomFilter(iw.keyHashes, iw.falsePositiveRate)
+		iw.keyHashes = nil
+	}
+	iw.footer.dictionary = iw.dictionary
+	return writeFileFooter(iw.out, iw.fileVersion, &iw.footer)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// get looks up the columns for the given key in this file store and its
+// deltas, merging the columns found in each file. Files whose bloom filter
+// rules out the key are skipped without reading any rows. Columns are in the
+// order of fs.fields. Returns nil columns if the key wasn't found.
+func (fs *fileStore) get(key bytemap.ByteMap) ([]encoding.Sequence, error) {
+	hash := bloomHash(key)
+	truncateBefore := fs.t.truncateBefore()
+	var result []encoding.Sequence
+	for _, filename := range fs.files() {
+		columns, err := fs.getFrom(filename, key, hash)
+		if err != nil {
+			return nil, err
+		}
+		if columns != nil {
+			result = mergeColumns(result, columns, fs.fields, fs.t.Resolution, truncateBefore)
+		}
+	}
+	return result, nil
+}
+
+// getFrom looks up the columns for the key with the given bloomHash in a
+// single file. If the file has a key index, this only reads the block that
+// could contain the key, otherwise it scans the whole file.
+func (fs *fileStore) getFrom(filename string, key bytemap.ByteMap, hash uint64) ([]encoding.Sequence, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.New("Unable to open file %v: %v", filename, err)
+	}
+	defer file.Close()
+
+	sr, header, err := readFileHeader(file, filename, fs.t.versionFor(filename))
+	if err != nil {
+		return nil, err
+	}
+	if header.footer != nil && !header.footer.bloom.mayContain(hash) {
+		return nil, nil
+	}
+	fs.t.db.opts.hooks.onGetFile(filename)
+	_, _, fileFields, fileCodecs, err := fs.info(sr, header.version)
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := false
+	order := keyOrderAscending
+	if header.footer != nil && len(header.footer.index) > 0 {
+		order = header.footer.order
+		entry, end := header.footer.blockFor(key)
+		if entry == nil {
+			return nil, nil
+		}
+		if _, err := file.Seek(entry.offset, io.SeekStart); err != nil {
+			return nil, errors.New("Unable to seek to block at %d in %v: %v", entry.offset, filename, err)
+		}
+		sr = header.codec.NewReader(bufio.NewReader(io.LimitReader(file, end-entry.offset)))
+		sorted = true
+	}
+
+	hasChecksums := header.version >= FileVersion_8
+	verifyChecksums := hasChecksums && fs.shouldVerifyChecksums()
+	fileToOut := rowMapper(fs.fields, fileFields)
+	r := &countingReader{r: sr}
+	if header.footer != nil {
+		r.dictionary = header.footer.dictionary
+	}
+	for {
+		_, row, err := fs.readRow(r, nil, hasChecksums, verifyChecksums)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		keyLength, row := encoding.ReadInt16(row)
+		fileKey, row := encoding.ReadByteMap(row, keyLength)
+		comparison := order.compare(fileKey, key)
+		if comparison > 0 && sorted {
+			// We've passed where the key would have been
+			return nil, nil
+		}
+		if comparison != 0 {
+			continue
+		}
+
+		encodedColumns, err := fs.readColumns(row, header.version, nil)
+		if err != nil {
+			return nil, err
+		}
+		columns := make([]encoding.Sequence, len(fs.fields))
+		for i, seq := range encodedColumns {
+			if i < len(fileCodecs) {
+				seq, err = fileCodecs[i].Decode(seq)
+				if err != nil {
+					return nil, errors.New("Unable to decode column %d from %v: %v", i, filename, err)
+				}
+			}
+			if seq != nil {
+				fileToOut(columns, i, seq)
+			}
+		}
+		return columns, nil
+	}
+}
+
+func appendUint16(b []byte, x uint16) []byte {
+	var buf [encoding.Width16bits]byte
+	encoding.Binary.PutUint16(buf[:], x)
+	return append(b, buf[:]...)
+}
+
+func appendUint32(b []byte, x uint32) []byte {
+	var buf [encoding.Width32bits]byte
+	encoding.Binary.PutUint32(buf[:], x)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, x uint64) []byte {
+	var buf [encoding.Width64bits]byte
+	encoding.Binary.PutUint64(buf[:], x)
+	return append(b, buf[:]...)
+}
@@ -0,0 +1,180 @@
+package zenodb
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexingWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	buf.Write(make([]byte, fileHeaderLength))
+	// Use a version without key encoding, since these keys aren't ByteMaps
+	iw := newIndexingWriter(buf, UncompressedFileCodec, FileVersion_10, fileHeaderLength, 2, DefaultBloomFilterFalsePositiveRate)
+	iw.Write([]byte("header"))
+	iw.startRows()
+
+	var rows []byte
+	for _, key := range []string{"a", "bb", "ccc", "dddd", "eeeee"} {
+		row := make([]byte, encoding.Width64bits+encoding.Width16bits)
+		row = append(row, key...)
+		row = append(row, "rest of row"...)
+		encoding.Binary.PutUint64(row, uint64(len(row)))
+		encoding.Binary.PutUint16(row[encoding.Width64bits:], uint16(len(key)))
+		rows = append(rows, row...)
+	}
+	// Write one byte at a time to make sure that rows are parsed correctly
+	// across writes
+	for i := range rows {
+		_, err := iw.Write(rows[i : i+1])
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+	if !assert.NoError(t, iw.Close()) {
+		return
+	}
+
+	footer, err := readFileFooter(bytes.NewReader(buf.Bytes()), "test", FileVersion_10)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.EqualValues(t, 5, footer.rowCount)
+	assert.EqualValues(t, fileHeaderLength+len("header")+len(rows), footer.dataEnd)
+	if assert.Len(t, footer.index, 3) {
+		for i, expected := range []string{"a", "ccc", "eeeee"} {
+			entry := footer.index[i]
+			assert.Equal(t, expected, string(entry.key))
+			assert.EqualValues(t, i*2, entry.row)
+			data := buf.Bytes()[entry.offset:]
+			assert.Equal(t, expected, string(data[encoding.Width64bits+encoding.Width16bits:][:len(expected)]), "Offset should point at start of row")
+		}
+	}
+
+	entry, end := footer.blockFor([]byte("bb"))
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "a", string(entry.key))
+		assert.Equal(t, footer.index[1].offset, end)
+	}
+	entry, end = footer.blockFor([]byte("z"))
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "eeeee", string(entry.key))
+		assert.Equal(t, footer.dataEnd, end)
+	}
+	entry, _ = footer.blockFor([]byte("0"))
+	assert.Nil(t, entry, "Key before first indexed key should not be found in any block")
+}
+
+func TestKeyIndex(t *testing.T) {
+	oldInterval := keyIndexInterval
+	keyIndexInterval = 10
+	defer func() {
+		keyIndexInterval = oldInterval
+	}()
+
+	testKeyIndex(t, true, keyOrderAscending, 0)
+	testKeyIndex(t, true, keyOrderDescending, 0)
+	testKeyIndex(t, false, keyOrderAscending, 0)
+}
+
+func TestIndexBlockRows(t *testing.T) {
+	testKeyIndex(t, true, keyOrderAscending, 20)
+	testKeyIndex(t, true, keyOrderDescending, 20)
+}
+
+func testKeyIndex(t *testing.T, sorted bool, order keyOrder, blockRows int) {
+	db, cleanup := newTestDB(t, &DBOpts{SortFlushes: sorted}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "indexed",
+		RetentionPeriod: 1 * time.Hour,
+		DescendingKeys:  order == keyOrderDescending,
+		IndexBlockRows:  blockRows,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	var points []*Point
+	for i := 0; i < 95; i++ {
+		points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": fmt.Sprintf("k%03d", i)}, Vals: map[string]interface{}{"v": i}})
+	}
+	_, err = db.InsertBatch("indexed", points)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("indexed")
+	tbl.forceFlush()
+	rs := tbl.rowStore
+	rs.mx.RLock()
+	fs := rs.fileStore
+	rs.mx.RUnlock()
+
+	file, err := os.Open(fs.filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, header, err := readFileHeader(file, fs.filename, 0)
+	file.Close()
+	if !assert.NoError(t, err) || !assert.NotNil(t, header.footer) {
+		return
+	}
+	assert.EqualValues(t, 95, header.footer.rowCount)
+	if sorted {
+		expectedBlockRows := blockRows
+		if expectedBlockRows == 0 {
+			expectedBlockRows = keyIndexInterval
+		}
+		assert.Len(t, header.footer.index, (95+expectedBlockRows-1)/expectedBlockRows, "Sorted file should be indexed")
+		assert.Equal(t, order, header.footer.order)
+		for i := 1; i < len(header.footer.index); i++ {
+			assert.True(t, order.compare(header.footer.index[i-1].key, header.footer.index[i].key) < 0, "Index should be in %v order", order)
+			assert.EqualValues(t, i*expectedBlockRows, header.footer.index[i].row, "Each block should start %d rows after the previous one", expectedBlockRows)
+			assert.True(t, header.footer.index[i-1].offset < header.footer.index[i].offset, "Block offsets should increase")
+		}
+	} else {
+		assert.Empty(t, header.footer.index, "Unsorted file should not be indexed")
+	}
+
+	get := func(k string) (float64, bool) {
+		columns, err := fs.get(bytemap.New(map[string]interface{}{"k": k}))
+		if !assert.NoError(t, err) || columns == nil {
+			return 0, false
+		}
+		val, _ := columns[0].ValueAtTime(epoch, fs.fields[0].Expr, tbl.Resolution)
+		return val, true
+	}
+	for _, i := range []int{0, 9, 10, 11, 55, 90, 94} {
+		val, found := get(fmt.Sprintf("k%03d", i))
+		if assert.True(t, found, "k%03d should have been found (sorted: %v, order: %v)", i, sorted, order) {
+			assert.EqualValues(t, i, val)
+		}
+	}
+	for _, k := range []string{"a", "k0555", "k999"} {
+		_, found := get(k)
+		assert.False(t, found, "%v should not have been found (sorted: %v, order: %v)", k, sorted, order)
+	}
+
+	// Reading the whole file still works with the index in place
+	data, err := ioutil.ReadFile(fs.filename)
+	if assert.NoError(t, err) {
+		assert.True(t, bytes.HasSuffix(data, fileFooterMagic))
+	}
+	rows := 0
+	_, err = fs.iterate(tbl.getFields(), nil, false, false, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		rows++
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 95, rows)
+}
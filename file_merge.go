@@ -0,0 +1,329 @@
+package zenodb
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	// mergeSourceBuffer is how many batches of rows each file being merged reads
+	// ahead of the merge
+	mergeSourceBuffer = 4
+	// mergeBatchSize is how many rows each file being merged decodes before
+	// handing them to the merge
+	mergeBatchSize = 100
+)
+
+type mergeRow struct {
+	key     bytemap.ByteMap
+	columns []encoding.Sequence
+}
+
+// mergeSource is one stream of rows in key order that takes part in a k-way
+// merge. next returns a nil row once the source is exhausted.
+type mergeSource struct {
+	next    func() (*mergeRow, error)
+	current *mergeRow
+	// idx is the position of the source in the merge, ties between equal keys
+	// are broken by merging older sources first
+	idx int
+}
+
+// mergeHeap orders mergeSources by their current keys in the given order.
+type mergeHeap struct {
+	sources []*mergeSource
+	order   keyOrder
+}
+
+func (h *mergeHeap) Len() int { return len(h.sources) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	c := h.order.compare(h.sources[i].current.key, h.sources[j].current.key)
+	if c == 0 {
+		return h.sources[i].idx < h.sources[j].idx
+	}
+	return c < 0
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+
+func (h *mergeHeap) Push(x interface{}) { h.sources = append(h.sources, x.(*mergeSource)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := h.sources
+	source := old[len(old)-1]
+	h.sources = old[:len(old)-1]
+	return source
+}
+
+// iterateMerged iterates over all files of this file store plus the given
+// memstores as a single stream ordered by key (in the file store's keyOrder),
+// using a k-way merge so that
+// onRow sees each key exactly once with the sequences from all sources merged.
+//
+// Iteration stops between rows and returns ctx.Err() once ctx is done.
+//
+// Each file is read by its own goroutine, with at most DBOpts.ScanParallelism
+// files being decoded at the same time. Sorted files are streamed, so memory
+// use stays bounded no matter how big they are. Files that weren't sorted when
+// flushed (and memstores) have to be read into memory and sorted first.
+func (fs *fileStore) iterateMerged(ctx context.Context, outFields []core.Field, memstores []*memstore, truncateBefore time.Time, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) (offsetsBySource common.OffsetsBySource, err error) {
+	if len(outFields) == 0 {
+		outFields = fs.fields
+	}
+
+	stop := make(chan interface{})
+	var wg sync.WaitGroup
+	var offsetsMx sync.Mutex
+	var fileOffsets, msOffsets common.OffsetsBySource
+	defer func() {
+		// Make sure that we're done reading all files before returning, since
+		// only then do we know all of their offsets
+		close(stop)
+		wg.Wait()
+		offsetsBySource = fileOffsets.Advance(msOffsets)
+	}()
+
+	// Always include the base file, even if there isn't one yet, so that we pick
+	// up the offsets in the offset file.
+	filenames := append([]string{fs.filename}, fs.deltas...)
+	parallelism := len(filenames)
+	if fs.t.db.opts != nil && fs.t.db.opts.ScanParallelism > 0 && fs.t.db.opts.ScanParallelism < parallelism {
+		parallelism = fs.t.db.opts.ScanParallelism
+	}
+	// A reader holds a token only while decoding, never while waiting for the
+	// merge to take its rows. Otherwise, readers waiting for a token could keep
+	// the merge from getting the first rows of their files, while the readers
+	// holding the tokens wait for the merge.
+	tokens := make(chan interface{}, parallelism)
+	order := fs.keyOrder()
+	sources := make([]*mergeSource, 0, len(filenames)+len(memstores))
+	var sortedFlags []bool
+	for _, filename := range filenames {
+		sfs := &fileStore{t: fs.t, rs: fs.rs, fields: fs.fields, filename: filename}
+		batches := make(chan []*mergeRow, mergeSourceBuffer)
+		var iterateErr error
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(batches)
+			var batch []*mergeRow
+			send := func() bool {
+				<-tokens
+				defer func() {
+					tokens <- nil
+				}()
+				select {
+				case batches <- batch:
+					batch = nil
+					return true
+				case <-stop:
+					return false
+				}
+			}
+			tokens <- nil
+			var offsets common.OffsetsBySource
+			offsets, iterateErr = sfs.iterateWithContext(ctx, outFields, nil, false, false, truncateBefore, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+				batch = append(batch, &mergeRow{key, columns})
+				if len(batch) < mergeBatchSize {
+					return true, nil
+				}
+				return send(), nil
+			})
+			if len(batch) > 0 && iterateErr == nil {
+				send()
+			}
+			<-tokens
+			offsetsMx.Lock()
+			fileOffsets = fileOffsets.Advance(offsets)
+			offsetsMx.Unlock()
+		}()
+		var batch []*mergeRow
+		next := func() (*mergeRow, error) {
+			for len(batch) == 0 {
+				var ok bool
+				batch, ok = <-batches
+				if !ok {
+					// iterateErr was set before batches was closed
+					return nil, iterateErr
+				}
+			}
+			row := batch[0]
+			batch = batch[1:]
+			return row, nil
+		}
+		sources = append(sources, &mergeSource{next: next, idx: len(sources)})
+		sortedFlags = append(sortedFlags, sfs.isSorted(order))
+	}
+	// All readers are running by now, so unsorted files are read in parallel
+	// while we wait for each of them in turn
+	for i, isSorted := range sortedFlags {
+		if !isSorted {
+			sources[i].next, err = sortedRows(sources[i].next, order)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, ms := range memstores {
+		// Each key appears only once in a memstore, so this just lines up its
+		// columns with outFields. Unlike mergeColumns, rowMerger handles columns
+		// that are laid out differently from outFields. Rows from different
+		// sources are merged with mergeColumns below.
+		memToOut := rowMerger(outFields, ms.fields, fs.t.Resolution, truncateBefore)
+		var rows []*mergeRow
+		ms.walk(0, func(key []byte, msColumns []encoding.Sequence) (bool, bool, error) {
+			columns := make([]encoding.Sequence, len(outFields))
+			for i, msColumn := range msColumns {
+				memToOut(columns, i, msColumn)
+			}
+			rows = append(rows, &mergeRow{bytemap.ByteMap(key), columns})
+			return true, true, nil
+		})
+		next, _ := sortedRows(sliceRows(rows), order)
+		sources = append(sources, &mergeSource{next: next, idx: len(sources)})
+		msOffsets = msOffsets.Advance(ms.offsetsBySource)
+	}
+
+	h := &mergeHeap{sources: make([]*mergeSource, 0, len(sources)), order: order}
+	advance := func(source *mergeSource) error {
+		row, err := source.next()
+		if err != nil {
+			return err
+		}
+		source.current = row
+		if row != nil {
+			heap.Push(h, source)
+		}
+		return nil
+	}
+
+	for _, source := range sources {
+		if err := advance(source); err != nil {
+			return nil, err
+		}
+	}
+
+	done := ctx.Done()
+	for h.Len() > 0 {
+		select {
+		case <-done:
+			return nil, ctx.Err()
+		default:
+		}
+		source := heap.Pop(h).(*mergeSource)
+		key, columns := source.current.key, source.current.columns
+		if err := advance(source); err != nil {
+			return nil, err
+		}
+		for h.Len() > 0 && bytes.Equal(h.sources[0].current.key, key) {
+			other := heap.Pop(h).(*mergeSource)
+			columns = mergeColumns(columns, other.current.columns, outFields, fs.t.Resolution, truncateBefore)
+			if err := advance(other); err != nil {
+				return nil, err
+			}
+		}
+
+		hasData := false
+		for _, seq := range columns {
+			if seq != nil {
+				hasData = true
+				break
+			}
+		}
+		if !hasData {
+			continue
+		}
+		more, err := onRow(key, columns, nil)
+		if err != nil {
+			fs.t.log.Errorf("Error processing merged row: %v", err)
+		}
+		if !more || err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// isSorted indicates whether this file store's rows are known to be sorted by
+// key in the given order. Only files with a key index are known to be sorted.
+func (fs *fileStore) isSorted(order keyOrder) bool {
+	file, err := os.Open(fs.filename)
+	if err != nil {
+		// Missing files don't have any rows
+		return os.IsNotExist(err)
+	}
+	defer file.Close()
+	_, header, err := readFileHeader(file, fs.filename, fs.t.versionFor(fs.filename))
+	if err != nil || header.footer == nil {
+		return false
+	}
+	if header.footer.rowCount == 0 {
+		return true
+	}
+	return len(header.footer.index) > 0 && header.footer.order == order
+}
+
+// sortedRows reads all rows from next and returns a function that returns
+// them in the given key order.
+func sortedRows(next func() (*mergeRow, error), order keyOrder) (func() (*mergeRow, error), error) {
+	var rows []*mergeRow
+	for {
+		row, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			break
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return order.compare(rows[i].key, rows[j].key) < 0
+	})
+	return sliceRows(rows), nil
+}
+
+func sliceRows(rows []*mergeRow) func() (*mergeRow, error) {
+	return func() (*mergeRow, error) {
+		if len(rows) == 0 {
+			return nil, nil
+		}
+		row := rows[0]
+		rows = rows[1:]
+		return row, nil
+	}
+}
+
+// mergeColumns merges the columns in b into the corresponding columns in a,
+// which both line up with fields, and returns the merged columns. Missing
+// columns are treated as empty, so if b has more columns than a, a is extended
+// to fit them. Columns in b beyond the end of fields are ignored, since there's
+// no way to merge them. When merging two non-empty columns, periods before
+// truncateBefore are dropped, so a column that's expired entirely doesn't
+// contribute anything. mergeColumns reuses a's storage, so a shouldn't be used
+// afterwards.
+func mergeColumns(a, b []encoding.Sequence, fields core.Fields, resolution time.Duration, truncateBefore time.Time) []encoding.Sequence {
+	if len(b) > len(fields) {
+		b = b[:len(fields)]
+	}
+	for len(a) < len(b) {
+		a = append(a, nil)
+	}
+	for i, seq := range b {
+		a[i] = a[i].Merge(seq, fields[i].Expr, resolution, truncateBefore)
+	}
+	return a
+}
@@ -0,0 +1,271 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterateMerged(t *testing.T) {
+	for _, descending := range []bool{false, true} {
+		testIterateMerged(t, descending)
+	}
+}
+
+func testIterateMerged(t *testing.T, descending bool) {
+	db, cleanup := newTestDB(t, &DBOpts{SortFlushes: true}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "merged",
+		RetentionPeriod: 1 * time.Hour,
+		MaxFileStores:   10,
+		DescendingKeys:  descending,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("merged")
+	rs := tbl.rowStore
+
+	flush := func(keys ...string) {
+		var points []*Point
+		for _, k := range keys {
+			points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": 1}})
+		}
+		_, err := db.InsertBatch("merged", points)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		tbl.forceFlush()
+	}
+	flush("a", "b", "c")
+	flush("b", "c", "d")
+	flush("c", "d", "e")
+
+	newMemstore := func(keys ...string) *memstore {
+		ms := rs.newMemStore(make(common.OffsetsBySource))
+		for _, k := range keys {
+			ms.update(bytemap.New(map[string]interface{}{"k": k}), encoding.NewTSParams(epoch, bytemap.NewFloat(map[string]float64{"v": 10})), nil)
+		}
+		return ms
+	}
+	memstores := []*memstore{newMemstore("a", "e", "f"), newMemstore("c", "f", "g")}
+
+	rs.mx.RLock()
+	fs := rs.fileStore
+	rs.mx.RUnlock()
+	if !assert.Len(t, fs.files(), 3, "Each flush should have written its own file") {
+		return
+	}
+
+	order := keyOrderAscending
+	if descending {
+		order = keyOrderDescending
+	}
+	for _, filename := range fs.files() {
+		assert.True(t, (&fileStore{t: tbl, rs: rs, filename: filename}).isSorted(order), "%v should be sorted in %v order", filename, order)
+	}
+
+	field := tbl.getFields()[0]
+	var keys []string
+	var lastKey []byte
+	totals := make(map[string]float64)
+	_, err = fs.iterateMerged(context.Background(), tbl.getFields(), memstores, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		assert.True(t, lastKey == nil || order.compare(lastKey, key) < 0, "Keys should be in %v order", order)
+		lastKey = key
+		k := key.Get("k").(string)
+		keys = append(keys, k)
+		totals[k], _ = columns[0].ValueAtTime(epoch, field.Expr, tbl.Resolution)
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, keys, 7, "Each key should have been seen exactly once")
+	assert.Equal(t, map[string]float64{"a": 11, "b": 2, "c": 13, "d": 2, "e": 11, "f": 20, "g": 10}, totals)
+
+	// Stopping early shouldn't leave anything hanging
+	rows := 0
+	_, err = fs.iterateMerged(context.Background(), tbl.getFields(), memstores, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		rows++
+		return rows < 2, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rows)
+}
+
+// newManyFilesTable creates a table whose file store consists of numFiles
+// files with keysPerFile keys each. Consecutive files share half of their keys.
+func newManyFilesTable(tb testing.TB, opts *DBOpts, numFiles int, keysPerFile int) (*table, func()) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	opts.Dir = tmpDir
+	opts.VirtualTime = true
+	db, err := NewDB(opts)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		tb.Fatal(err)
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(tmpDir)
+	}
+	err = db.CreateTable(&TableOpts{
+		Name:            "manyfiles",
+		RetentionPeriod: 1 * time.Hour,
+		MaxFileStores:   numFiles + 1,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if err != nil {
+		cleanup()
+		tb.Fatal(err)
+	}
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("manyfiles")
+	for i := 0; i < numFiles; i++ {
+		points := make([]*Point, 0, keysPerFile)
+		for j := 0; j < keysPerFile; j++ {
+			points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": i*keysPerFile/2 + j}, Vals: map[string]interface{}{"v": 1}})
+		}
+		if _, err := db.InsertBatch("manyfiles", points); err != nil {
+			cleanup()
+			tb.Fatal(err)
+		}
+		tbl.forceFlush()
+	}
+	return tbl, cleanup
+}
+
+func TestIterateMergedParallelism(t *testing.T) {
+	for _, sortFlushes := range []bool{true, false} {
+		for _, parallelism := range []int{1, 2, 10} {
+			tbl, cleanup := newManyFilesTable(t, &DBOpts{SortFlushes: sortFlushes, ScanParallelism: parallelism}, 10, 1000)
+			tbl.rowStore.mx.RLock()
+			fs := tbl.rowStore.fileStore
+			tbl.rowStore.mx.RUnlock()
+			assert.Len(t, fs.files(), 10)
+
+			var lastKey []byte
+			rows := 0
+			_, err := fs.iterateMerged(context.Background(), tbl.getFields(), nil, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+				assert.True(t, lastKey == nil || bytes.Compare(lastKey, key) < 0, "Keys should be in ascending order")
+				lastKey = key
+				rows++
+				return true, nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, 5500, rows, "Each key should have been seen exactly once (sorted: %v, parallelism: %d)", sortFlushes, parallelism)
+			cleanup()
+		}
+	}
+}
+
+func BenchmarkIterateMergedSerial(b *testing.B) {
+	benchmarkIterateMerged(b, 1)
+}
+
+func BenchmarkIterateMergedParallel(b *testing.B) {
+	benchmarkIterateMerged(b, 10)
+}
+
+func benchmarkIterateMerged(b *testing.B, parallelism int) {
+	tbl, cleanup := newManyFilesTable(b, &DBOpts{SortFlushes: true, ScanParallelism: parallelism}, 10, 10000)
+	defer cleanup()
+	tbl.rowStore.mx.RLock()
+	fs := tbl.rowStore.fileStore
+	tbl.rowStore.mx.RUnlock()
+	fields := tbl.getFields()
+	truncateBefore := tbl.truncateBefore()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := fs.iterateMerged(context.Background(), fields, nil, truncateBefore, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			return true, nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMergeColumns(t *testing.T) {
+	resolution := time.Second
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	fields := core.Fields{
+		core.NewField("a", expr.SUM(expr.FIELD("a"))),
+		core.NewField("b", expr.SUM(expr.FIELD("b"))),
+	}
+	val := func(i int, v float64, ts time.Time) encoding.Sequence {
+		return encoding.NewFloatValue(fields[i].Expr, ts, v)
+	}
+	assertValue := func(expected float64, columns []encoding.Sequence, i int, ts time.Time, msg string) {
+		actual, found := columns[i].ValueAtTime(ts, fields[i].Expr, resolution)
+		if assert.True(t, found, msg) {
+			assert.EqualValues(t, expected, actual, msg)
+		}
+	}
+
+	merged := mergeColumns([]encoding.Sequence{val(0, 1, epoch), val(1, 2, epoch)}, []encoding.Sequence{val(0, 3, epoch)}, fields, resolution, time.Time{})
+	if assert.Len(t, merged, 2, "a longer than b") {
+		assertValue(4, merged, 0, epoch, "a longer than b")
+		assertValue(2, merged, 1, epoch, "a longer than b")
+	}
+
+	merged = mergeColumns([]encoding.Sequence{val(0, 1, epoch)}, []encoding.Sequence{val(0, 3, epoch), val(1, 5, epoch)}, fields, resolution, time.Time{})
+	if assert.Len(t, merged, 2, "b longer than a") {
+		assertValue(4, merged, 0, epoch, "b longer than a")
+		assertValue(5, merged, 1, epoch, "b longer than a")
+	}
+
+	merged = mergeColumns(nil, []encoding.Sequence{val(0, 3, epoch), nil}, fields, resolution, time.Time{})
+	if assert.Len(t, merged, 2, "nil a") {
+		assertValue(3, merged, 0, epoch, "nil a")
+		assert.Nil(t, merged[1], "nil in both should stay nil")
+	}
+
+	merged = mergeColumns([]encoding.Sequence{nil, val(1, 2, epoch)}, []encoding.Sequence{val(0, 3, epoch), nil}, fields, resolution, time.Time{})
+	if assert.Len(t, merged, 2, "nil columns") {
+		assertValue(3, merged, 0, epoch, "nil column in a")
+		assertValue(2, merged, 1, epoch, "nil column in b")
+	}
+
+	assert.Empty(t, mergeColumns(nil, nil, fields, resolution, time.Time{}))
+
+	merged = mergeColumns([]encoding.Sequence{val(0, 1, epoch)}, []encoding.Sequence{val(0, 3, epoch), val(1, 5, epoch), val(1, 7, epoch)}, fields, resolution, time.Time{})
+	if assert.Len(t, merged, len(fields), "b longer than fields") {
+		assertValue(4, merged, 0, epoch, "b longer than fields")
+		assertValue(5, merged, 1, epoch, "b longer than fields")
+	}
+
+	expired := epoch.Add(-10 * resolution)
+	merged = mergeColumns([]encoding.Sequence{val(0, 1, epoch)}, []encoding.Sequence{val(0, 3, expired)}, fields, resolution, epoch.Add(-5*resolution))
+	if assert.Len(t, merged, 1, "expired b") {
+		assertValue(1, merged, 0, epoch, "expired b")
+		_, found := merged[0].ValueAtTime(expired, fields[0].Expr, resolution)
+		assert.False(t, found, "expired period should have been dropped")
+	}
+
+	merged = mergeColumns([]encoding.Sequence{val(0, 1, expired)}, []encoding.Sequence{val(0, 3, epoch)}, fields, resolution, epoch.Add(-5*resolution))
+	if assert.Len(t, merged, 1, "expired a") {
+		assertValue(3, merged, 0, epoch, "expired a")
+		_, found := merged[0].ValueAtTime(expired, fields[0].Expr, resolution)
+		assert.False(t, found, "expired period should have been dropped")
+	}
+}
@@ -0,0 +1,87 @@
+package zenodb
+
+import (
+	"time"
+)
+
+const (
+	// flushRateSmoothing is the weight given to the most recent flush when
+	// updating the estimated ingestion rate
+	flushRateSmoothing = 0.3
+
+	// flushHeadroom is the fraction of maxMemStoreBytes that the memstore is
+	// allowed to fill before being flushed, leaving room for bursts above the
+	// estimated ingestion rate
+	flushHeadroom = 0.9
+)
+
+// flushController determines how long to wait between flushes. It aims to
+// flush every targetInterval, but flushes sooner whenever the recent ingestion
+// rate suggests that the memstore would otherwise grow beyond maxBytes.
+type flushController struct {
+	targetInterval time.Duration
+	minInterval    time.Duration
+	maxInterval    time.Duration
+	maxBytes       int
+	// rate is an exponentially weighted moving average of the ingestion rate in
+	// bytes per second
+	rate float64
+	// flushDuration is how long the last flush took, if there was one
+	flushDuration time.Duration
+	flushed       bool
+}
+
+func newFlushController(opts *rowStoreOptions) *flushController {
+	return &flushController{
+		targetInterval: opts.targetFlushInterval,
+		minInterval:    opts.minFlushLatency,
+		maxInterval:    opts.maxFlushLatency,
+		maxBytes:       opts.maxMemStoreBytes,
+	}
+}
+
+// next records that a flush of flushedBytes, accumulated over elapsed, took
+// flushDuration and returns how long to wait before the next flush.
+func (fc *flushController) next(flushedBytes int, elapsed time.Duration, flushDuration time.Duration) time.Duration {
+	if elapsed > 0 {
+		rate := float64(flushedBytes) / elapsed.Seconds()
+		if fc.rate == 0 {
+			fc.rate = rate
+		} else {
+			fc.rate = flushRateSmoothing*rate + (1-flushRateSmoothing)*fc.rate
+		}
+	}
+	fc.flushDuration = flushDuration
+	fc.flushed = true
+	return fc.interval()
+}
+
+// interval returns how long to wait between flushes based on what's known so
+// far. Unlike next, it doesn't record a flush, so it can be used to
+// recalculate the interval after maxBytes or maxInterval changed.
+func (fc *flushController) interval() time.Duration {
+	interval := fc.targetInterval
+	if interval <= 0 {
+		if fc.flushed {
+			// Without a target, keep flushing from taking up more than a tenth of
+			// the time
+			interval = fc.flushDuration * 10
+		} else {
+			// Until we know how long flushes take, wait as long as we can
+			interval = fc.maxInterval
+		}
+	}
+	if fc.maxBytes > 0 && fc.rate > 0 {
+		untilFull := time.Duration(float64(fc.maxBytes) * flushHeadroom / fc.rate * float64(time.Second))
+		if untilFull < interval {
+			interval = untilFull
+		}
+	}
+
+	if fc.maxInterval > 0 && interval > fc.maxInterval {
+		interval = fc.maxInterval
+	} else if interval < fc.minInterval {
+		interval = fc.minInterval
+	}
+	return interval
+}
@@ -0,0 +1,147 @@
+package zenodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushControllerConverges(t *testing.T) {
+	const bytesPerSecond = 1000
+	const flushDuration = 100 * time.Millisecond
+
+	simulate := func(opts *rowStoreOptions) time.Duration {
+		fc := newFlushController(opts)
+		interval := opts.maxFlushLatency
+		for i := 0; i < 50; i++ {
+			// At a steady insert rate, the memstore holds whatever was ingested since
+			// the last flush
+			flushedBytes := int(interval.Seconds() * bytesPerSecond)
+			if opts.maxMemStoreBytes > 0 {
+				assert.True(t, i == 0 || flushedBytes <= opts.maxMemStoreBytes, "Memstore should stay below maxMemStoreBytes once the rate is known")
+			}
+			interval = fc.next(flushedBytes, interval, flushDuration)
+		}
+		return interval
+	}
+
+	// Memstore size is the limiting factor
+	interval := simulate(&rowStoreOptions{
+		minFlushLatency:     100 * time.Millisecond,
+		maxFlushLatency:     1 * time.Minute,
+		targetFlushInterval: 30 * time.Second,
+		maxMemStoreBytes:    10000,
+	})
+	assert.InDelta(t, 9*time.Second, interval, float64(10*time.Millisecond), "Flushes should happen before the memstore reaches maxMemStoreBytes")
+
+	// Target interval is the limiting factor
+	interval = simulate(&rowStoreOptions{
+		minFlushLatency:     100 * time.Millisecond,
+		maxFlushLatency:     1 * time.Minute,
+		targetFlushInterval: 5 * time.Second,
+		maxMemStoreBytes:    10000,
+	})
+	assert.Equal(t, 5*time.Second, interval, "Flushes should happen at the target interval when the memstore stays small")
+
+	// Bounds still apply
+	interval = simulate(&rowStoreOptions{
+		minFlushLatency:     20 * time.Second,
+		maxFlushLatency:     1 * time.Minute,
+		targetFlushInterval: 10 * time.Second,
+	})
+	assert.Equal(t, 20*time.Second, interval, "Interval should never drop below minFlushLatency")
+
+	// Without a target or size limit, fall back to ten times the flush duration
+	interval = simulate(&rowStoreOptions{
+		maxFlushLatency: 1 * time.Minute,
+	})
+	assert.Equal(t, 10*flushDuration, interval)
+}
+
+func TestFlushControllerMaxBytesChanged(t *testing.T) {
+	fc := newFlushController(&rowStoreOptions{
+		minFlushLatency:     100 * time.Millisecond,
+		maxFlushLatency:     1 * time.Minute,
+		targetFlushInterval: 30 * time.Second,
+	})
+	assert.Equal(t, 30*time.Second, fc.interval(), "Should wait for target interval before first flush")
+
+	// Ingest 1000 bytes per second
+	assert.Equal(t, 30*time.Second, fc.next(30000, 30*time.Second, 100*time.Millisecond))
+
+	fc.maxBytes = 10000
+	assert.Equal(t, 9*time.Second, fc.interval(), "Lowering maxBytes should shorten the interval based on the known ingestion rate")
+
+	fc.maxBytes = 0
+	assert.Equal(t, 30*time.Second, fc.interval(), "Removing maxBytes should restore the target interval")
+}
+
+func TestSetFlushOptions(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:                "tunable",
+		RetentionPeriod:     1 * time.Hour,
+		MinFlushLatency:     1 * time.Hour,
+		MaxFlushLatency:     1 * time.Hour,
+		TargetFlushInterval: 1 * time.Hour,
+		SQL:                 "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	db.clock.Advance(testEpoch)
+	insert := func() {
+		insertKeys(t, db, "tunable", testEpoch, "a")
+	}
+	rs := db.getTable("tunable").rowStore
+	waitForFlushes := func(expected int64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for rs.Stats().Flushes < expected && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	insert()
+	assert.Equal(t, 1*time.Hour, rs.Stats().FlushInterval)
+	rs.SetFlushOptions(0, 50*time.Millisecond)
+	waitForFlushes(1)
+	stats := rs.Stats()
+	assert.EqualValues(t, 1, stats.Flushes, "Lowering max latency should have flushed without waiting for the old interval")
+	assert.Equal(t, 50*time.Millisecond, stats.FlushInterval)
+
+	rs.SetFlushOptions(0, 1*time.Hour)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1*time.Hour, rs.Stats().FlushInterval)
+	insert()
+	time.Sleep(250 * time.Millisecond)
+	assert.EqualValues(t, 1, rs.Stats().Flushes, "Raising max latency should have postponed the next flush")
+}
+
+func TestFlushWhenMemStoreFull(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:                "bounded",
+		RetentionPeriod:     1 * time.Hour,
+		MaxFlushLatency:     1 * time.Hour,
+		TargetFlushInterval: 1 * time.Hour,
+		MaxMemStoreBytes:    1,
+		SQL:                 "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	db.clock.Advance(testEpoch)
+	rs := db.getTable("bounded").rowStore
+
+	// The flush controller doesn't know the ingestion rate yet, so only the size
+	// of the memstore can trigger this flush
+	insertKeys(t, db, "bounded", testEpoch, "a")
+	deadline := time.Now().Add(5 * time.Second)
+	for rs.Stats().Flushes < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues(t, 1, rs.Stats().Flushes, "Reaching MaxMemStoreBytes should have flushed without waiting for the flush interval")
+}
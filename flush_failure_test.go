@@ -0,0 +1,88 @@
+package zenodb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingWriter struct {
+	failing *int32
+	w       io.Writer
+}
+
+func (fw *failingWriter) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(fw.failing) == 1 {
+		return 0, errors.New("disk full")
+	}
+	return fw.w.Write(b)
+}
+
+func TestFlushWriteFailure(t *testing.T) {
+	h := &hooks{}
+	failing := int32(1)
+	h.flushWriter = func(out io.Writer) io.Writer {
+		return &failingWriter{&failing, out}
+	}
+
+	var failures []error
+	db, cleanup := newTestDB(t, &DBOpts{
+		hooks:             h,
+		FlushRetries:      2,
+		FlushRetryBackoff: time.Millisecond,
+		OnFlushFailure: func(table string, err error) {
+			assert.Equal(t, "failing", table)
+			failures = append(failures, err)
+		},
+		Panic: func(err interface{}) {
+			t.Errorf("Flush failure should not have panicked: %v", err)
+		},
+	}, "failing", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	db.clock.Advance(testEpoch)
+	insert := func(k string) {
+		insertKeys(t, db, "failing", testEpoch, k)
+	}
+	tbl := db.getTable("failing")
+	read := func() map[string]bool {
+		keys := make(map[string]bool)
+		_, err := tbl.iterate(context.Background(), tbl.getFields(), true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			keys[key.Get("k").(string)] = true
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return keys
+	}
+
+	insert("a")
+	tbl.forceFlush()
+	assert.Len(t, failures, 1, "Flush should have given up once")
+	assert.Empty(t, tbl.rowStore.fileStore.filename, "No file store should have been written")
+	assert.Equal(t, map[string]bool{"a": true}, read(), "Data should remain queryable from memstore")
+
+	insert("b")
+	atomic.StoreInt32(&failing, 0)
+	tbl.forceFlush()
+	assert.Len(t, failures, 1, "Flush should have succeeded")
+	assert.NotEmpty(t, tbl.rowStore.fileStore.filename)
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, read(), "Retained data should have been flushed")
+	rs := tbl.rowStore
+	rs.mx.RLock()
+	fs := rs.fileStore
+	rs.mx.RUnlock()
+	diskKeys := make(map[string]bool)
+	_, err := fs.iterate(tbl.getFields(), nil, false, false, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		diskKeys[key.Get("k").(string)] = true
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, diskKeys, "Retained data should be on disk")
+}
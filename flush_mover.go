@@ -0,0 +1,209 @@
+package zenodb
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+)
+
+const (
+	// maxPendingMoves limits how many moves can be queued before flushing
+	// blocks waiting for the mover to catch up.
+	maxPendingMoves = 100
+)
+
+// flushMove is a unit of work for the flush mover. It either moves a flushed
+// file store from the scratch dir to the data dir or, if filename is empty,
+// records updated WAL offsets in the data dir. Moves are processed in order so
+// that durable offsets never get ahead of durable data.
+type flushMove struct {
+	filename        string
+	size            int64
+	offsetsBySource common.OffsetsBySource
+	// batchLogSegment, if positive, marks a request to remove the batch log
+	// segments up to and including this one rather than recording offsets.
+	batchLogSegment int64
+	// done, if set, marks a request to be notified once all prior moves have
+	// been processed. It receives the error from the most recent failed move,
+	// if any.
+	done chan error
+}
+
+func (rs *rowStore) enqueueMove(move *flushMove) {
+	rs.t.statsMutex.Lock()
+	rs.t.stats.PendingMoves++
+	rs.t.stats.PendingMoveBytes += move.size
+	rs.t.statsMutex.Unlock()
+	rs.moves <- move
+}
+
+// moveFlushedFiles processes queued moves until the moves channel is closed.
+// Once the database is stopping, it ignores the rate limit so that pending data
+// makes it to durable storage as quickly as possible.
+func (rs *rowStore) moveFlushedFiles(stop <-chan interface{}) {
+	var lastErr error
+	// moveFailed indicates that the most recent move failed, in which case the
+	// durable dir is missing data that was included in the offsets queued after
+	// it.
+	moveFailed := false
+	for move := range rs.moves {
+		if move.done != nil {
+			move.done <- lastErr
+			lastErr = nil
+			continue
+		}
+		if move.batchLogSegment > 0 {
+			if moveFailed {
+				// Like offsets, keep the batch log until its data is durable
+				rs.t.log.Debug("Not removing flushed batch log until a move succeeds")
+			} else {
+				rs.batchLog.remove(move.batchLogSegment)
+			}
+		} else if move.filename == "" {
+			if moveFailed {
+				// Recording these offsets would skip the data that didn't make it to
+				// durable storage when replaying the WAL after a restart
+				rs.t.log.Debug("Not writing updated offset until a move succeeds")
+			} else if err := rs.doWriteOffsets(move.offsetsBySource); err != nil {
+				rs.t.log.Errorf("Unable to write updated offset: %v", err)
+			}
+		} else if err := rs.moveFlushedFile(move.filename, stop); err != nil {
+			// Full flushes rewrite all of the table's data, so the next successful
+			// move makes this data durable too. Until then, offsets stay where they
+			// were so that the data can still be recovered from the WAL.
+			rs.t.log.Errorf("Unable to move %v to durable storage: %v", move.filename, err)
+			lastErr = err
+			moveFailed = true
+		} else {
+			lastErr = nil
+			moveFailed = false
+		}
+		rs.t.statsMutex.Lock()
+		rs.t.stats.PendingMoves--
+		rs.t.stats.PendingMoveBytes -= move.size
+		rs.t.statsMutex.Unlock()
+	}
+	rs.t.log.Debug("Done moving flushed files")
+}
+
+func (rs *rowStore) moveFlushedFile(scratchName string, stop <-chan interface{}) error {
+	rs.mx.Lock()
+	rs.iterationsInProgress[scratchName]++
+	rs.mx.Unlock()
+	defer func() {
+		rs.mx.Lock()
+		rs.iterationsInProgress[scratchName]--
+		rs.mx.Unlock()
+	}()
+
+	in, err := os.Open(scratchName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			rs.t.log.Debugf("%v was superseded by a newer flush before it could be moved", scratchName)
+			return nil
+		}
+		return errors.New("Unable to open %v: %v", scratchName, err)
+	}
+	defer in.Close()
+
+	start := time.Now()
+	// Create the temp file in the durable dir so that moving it into place is a
+	// rename rather than a second, unthrottled copy. Like the temp files of
+	// flushes, it's removed on startup if we crash before then.
+	out, err := ioutil.TempFile(rs.opts.dir, flushTempPrefix)
+	if err != nil {
+		return errors.New("Unable to create temp file: %v", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	n, err := io.Copy(out, &rateLimitedReader{r: in, bytesPerSecond: rs.t.db.opts.FlushMoveBytesPerSecond, stop: stop, start: start})
+	if err != nil {
+		return errors.New("Unable to copy after %d bytes: %v", n, err)
+	}
+	if err := rs.syncFile(out); err != nil {
+		return errors.New("Unable to sync: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return errors.New("Unable to close: %v", err)
+	}
+	durableName := filepath.Join(rs.opts.dir, filepath.Base(scratchName))
+	if err := rs.renameFile(out.Name(), durableName); err != nil {
+		return errors.New("Unable to rename to %v: %v", durableName, err)
+	}
+	if err := rs.syncDir(rs.opts.dir); err != nil {
+		return err
+	}
+
+	rs.mx.Lock()
+	if rs.fileStore.filename == scratchName {
+		rs.fileStore = &fileStore{t: rs.t, rs: rs, fields: rs.fileStore.fields, filename: durableName, deltas: rs.fileStore.deltas}
+	}
+	rs.mx.Unlock()
+
+	rs.t.log.Debugf("Moved %d bytes from %v to %v in %v", n, scratchName, durableName, time.Now().Sub(start))
+	return nil
+}
+
+// removeOldScratchFiles removes file stores from the scratch dir that have
+// been superseded and aren't being iterated on. Superseded files don't need to
+// be moved since newer file stores contain all of their data.
+func (rs *rowStore) removeOldScratchFiles() {
+	files, err := listRegularFiles(rs.opts.scratchDir)
+	if err != nil {
+		rs.t.log.Errorf("Unable to list scratch files in %v: %v", rs.opts.scratchDir, err)
+		return
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), "filestore_") {
+			// in-progress flush
+			continue
+		}
+		name := filepath.Join(rs.opts.scratchDir, file.Name())
+		rs.mx.RLock()
+		okayToRemove := rs.fileStore.filename != name && rs.iterationsInProgress[name] == 0
+		rs.mx.RUnlock()
+		if okayToRemove {
+			rs.t.log.Debugf("Removing old scratch file %v", name)
+			if err := os.Remove(name); err != nil {
+				rs.t.log.Errorf("Unable to delete old scratch file %v, still consuming space unnecessarily: %v", name, err)
+			}
+		}
+	}
+}
+
+// rateLimitedReader limits the rate at which data is read from r to
+// bytesPerSecond. Once stop is closed, it stops limiting.
+type rateLimitedReader struct {
+	r              io.Reader
+	bytesPerSecond int64
+	stop           <-chan interface{}
+	start          time.Time
+	read           int64
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	if r.bytesPerSecond <= 0 {
+		return r.r.Read(b)
+	}
+	if int64(len(b)) > r.bytesPerSecond {
+		b = b[:r.bytesPerSecond]
+	}
+	n, err := r.r.Read(b)
+	r.read += int64(n)
+	expected := time.Duration(float64(r.read) / float64(r.bytesPerSecond) * float64(time.Second))
+	if wait := expected - time.Now().Sub(r.start); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-r.stop:
+			r.bytesPerSecond = 0
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,195 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushScratchDir(t *testing.T) {
+	scratchDir, err := ioutil.TempDir("", "zenodbscratch")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(scratchDir)
+
+	db, cleanup := newTestDB(t, &DBOpts{FlushScratchDir: scratchDir}, "scratched", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	_, err = db.InsertBatch("scratched", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch, Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 2}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tbl := db.getTable("scratched")
+	tbl.forceFlush()
+
+	rs := tbl.rowStore
+	isDurable := func() bool {
+		rs.mx.RLock()
+		filename := rs.fileStore.filename
+		rs.mx.RUnlock()
+		return filepath.Dir(filename) == rs.opts.dir
+	}
+	for i := 0; i < 100 && !isDurable(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !assert.True(t, isDurable(), "File store should have been moved to durable storage") {
+		return
+	}
+	stats := db.TableStats("scratched")
+	assert.EqualValues(t, 0, stats.PendingMoves)
+	assert.EqualValues(t, 0, stats.PendingMoveBytes)
+	files, err := listRegularFiles(rs.opts.dir)
+	if assert.NoError(t, err) {
+		for _, file := range files {
+			assert.False(t, strings.HasPrefix(file.Name(), flushTempPrefix), "Temp file %v should have been renamed into place", file.Name())
+		}
+	}
+
+	rs.mx.RLock()
+	filename := rs.fileStore.filename
+	rs.mx.RUnlock()
+	moved, err := ioutil.ReadFile(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	original, err := ioutil.ReadFile(filepath.Join(rs.opts.scratchDir, filepath.Base(filename)))
+	if assert.NoError(t, err, "Scratch file should still exist until cleaned up") {
+		assert.Equal(t, original, moved)
+	}
+
+	rows := 0
+	_, err = tbl.iterate(context.Background(), tbl.getFields(), false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		rows++
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rows)
+
+	rs.removeOldScratchFiles()
+	_, err = os.Stat(filepath.Join(rs.opts.scratchDir, filepath.Base(filename)))
+	assert.True(t, os.IsNotExist(err), "Scratch file should have been removed once superseded")
+}
+
+func TestRateLimitedReader(t *testing.T) {
+	data := make([]byte, 1000)
+	start := time.Now()
+	out := &bytes.Buffer{}
+	_, err := out.ReadFrom(&rateLimitedReader{r: bytes.NewReader(data), bytesPerSecond: 5000, start: start})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, data, out.Bytes())
+	assert.True(t, time.Now().Sub(start) >= 190*time.Millisecond, "Reading should have been rate limited")
+
+	stop := make(chan interface{})
+	close(stop)
+	start = time.Now()
+	out.Reset()
+	_, err = out.ReadFrom(&rateLimitedReader{r: bytes.NewReader(data), bytesPerSecond: 10, stop: stop, start: start})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, data, out.Bytes())
+	assert.True(t, time.Now().Sub(start) < 1*time.Second, "Reading should not be rate limited once stopped")
+}
+
+func TestFlushWaitsForDurability(t *testing.T) {
+	scratchDir, err := ioutil.TempDir("", "zenodbscratch")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(scratchDir)
+
+	db, cleanup := newTestDB(t, &DBOpts{FlushScratchDir: scratchDir, FlushMoveBytesPerSecond: 1024}, "durable", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	_, err = db.InsertBatch("durable", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch, Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 2}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	if !assert.NoError(t, db.Flush("durable")) {
+		return
+	}
+	rs := db.getTable("durable").rowStore
+	rs.mx.RLock()
+	filename := rs.fileStore.filename
+	rs.mx.RUnlock()
+	assert.Equal(t, rs.opts.dir, filepath.Dir(filename), "Flushed file should already be in durable storage")
+	stats := db.TableStats("durable")
+	assert.EqualValues(t, 0, stats.PendingMoves)
+	assert.EqualValues(t, 0, stats.PendingFlushes)
+
+	assert.Error(t, db.Flush("unknown"))
+	db.Close()
+	assert.Error(t, db.Flush("durable"), "Flushing closed database should fail rather than block")
+}
+
+func TestNoOffsetsAfterFailedMove(t *testing.T) {
+	scratchDir, err := ioutil.TempDir("", "zenodbscratch")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(scratchDir)
+
+	var failMoves int32 = 1
+	h := &hooks{}
+	db, cleanup := newTestDB(t, &DBOpts{FlushScratchDir: scratchDir, hooks: h}, "durable", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+	rs := db.getTable("durable").rowStore
+	h.rename = func(from, to string) error {
+		if atomic.LoadInt32(&failMoves) == 1 && filepath.Dir(to) == rs.opts.dir && strings.HasPrefix(filepath.Base(to), "filestore_") {
+			return errors.New("move failed")
+		}
+		return os.Rename(from, to)
+	}
+
+	db.clock.Advance(testEpoch)
+	insertAndFlush := func(k string) error {
+		insertKeys(t, db, "durable", testEpoch, k)
+		return db.Flush("durable")
+	}
+	writeOffsets := func() {
+		assert.NoError(t, rs.writeOffsets(common.OffsetsBySource{}))
+		done := make(chan error, 1)
+		rs.moves <- &flushMove{done: done}
+		<-done
+	}
+	offsetsWritten := func() bool {
+		_, err := os.Stat(filepath.Join(rs.opts.dir, offsetFilename))
+		return err == nil
+	}
+
+	assert.Error(t, insertAndFlush("a"), "Flush should report failed move")
+	writeOffsets()
+	assert.False(t, offsetsWritten(), "Offsets shouldn't be written after a failed move")
+
+	atomic.StoreInt32(&failMoves, 0)
+	assert.NoError(t, insertAndFlush("b"))
+	writeOffsets()
+	assert.True(t, offsetsWritten(), "Offsets should be written once a move succeeds")
+}
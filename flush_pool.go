@@ -0,0 +1,135 @@
+package zenodb
+
+import (
+	"sync"
+	"time"
+)
+
+// FlushWorkerStats provides statistics about the pool of workers that flush
+// the database's tables.
+type FlushWorkerStats struct {
+	// Workers is the number of workers currently in the pool, whether busy or
+	// idle.
+	Workers int
+	// MaxWorkers is the most workers that the pool will start (see
+	// DBOpts.MaxFlushWorkers).
+	MaxWorkers int
+	// QueueDepth is the number of flushes waiting for a worker.
+	QueueDepth int
+}
+
+// flushPool runs the flushes of all of a database's tables. It starts a new
+// worker whenever a flush is queued and no worker is idle, up to maxWorkers,
+// so the pool grows to absorb bursts of flushes. Workers that stay idle for
+// idleTimeout exit, so the pool shrinks again once the queue has drained.
+type flushPool struct {
+	maxWorkers  int
+	idleTimeout time.Duration
+	queue       []func()
+	workers     int
+	// idle is the number of idle workers that haven't been claimed by run yet
+	idle int
+	// wake wakes idle workers that have been claimed by run
+	wake chan interface{}
+	mx   sync.Mutex
+}
+
+func newFlushPool(maxWorkers int, idleTimeout time.Duration) *flushPool {
+	return &flushPool{
+		maxWorkers:  maxWorkers,
+		idleTimeout: idleTimeout,
+		wake:        make(chan interface{}, maxWorkers),
+	}
+}
+
+// run runs fn on one of the pool's workers and waits for it to finish. If all
+// workers are busy and the pool is already at its maximum size, fn waits in
+// the queue until a worker is free. A nil pool runs fn right away.
+func (p *flushPool) run(fn func()) {
+	if p == nil {
+		fn()
+		return
+	}
+	done := make(chan interface{})
+	p.mx.Lock()
+	p.queue = append(p.queue, func() {
+		defer close(done)
+		fn()
+	})
+	if p.idle > 0 {
+		// Claim an idle worker. There's never more than one wakeup per idle
+		// worker, so this doesn't block.
+		p.idle--
+		p.wake <- nil
+	} else if p.workers < p.maxWorkers {
+		p.workers++
+		go p.work()
+	}
+	p.mx.Unlock()
+	<-done
+}
+
+func (p *flushPool) work() {
+	idleTimer := time.NewTimer(p.idleTimeout)
+	defer idleTimer.Stop()
+
+	for {
+		p.mx.Lock()
+		if len(p.queue) > 0 {
+			next := p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+			p.mx.Unlock()
+			next()
+			continue
+		}
+		p.idle++
+		p.mx.Unlock()
+
+		if !idleTimer.Stop() {
+			select {
+			case <-idleTimer.C:
+			default:
+			}
+		}
+		idleTimer.Reset(p.idleTimeout)
+		select {
+		case <-p.wake:
+			// claimed by run
+			continue
+		case <-idleTimer.C:
+		}
+
+		p.mx.Lock()
+		select {
+		case <-p.wake:
+			// claimed by run while we were timing out
+			p.mx.Unlock()
+			continue
+		default:
+		}
+		p.idle--
+		if len(p.queue) == 0 {
+			p.workers--
+			p.mx.Unlock()
+			return
+		}
+		p.mx.Unlock()
+	}
+}
+
+func (p *flushPool) stats() FlushWorkerStats {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return FlushWorkerStats{
+		Workers:    p.workers,
+		MaxWorkers: p.maxWorkers,
+		QueueDepth: len(p.queue),
+	}
+}
+
+// FlushWorkerStats returns statistics about the pool of workers that flush the
+// database's tables.
+func (db *DB) FlushWorkerStats() FlushWorkerStats {
+	return db.flushPool.stats()
+}
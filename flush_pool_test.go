@@ -0,0 +1,109 @@
+package zenodb
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushPoolBurst(t *testing.T) {
+	maxWorkers := 3
+	pool := newFlushPool(maxWorkers, 50*time.Millisecond)
+	waitFor := func(cond func(stats FlushWorkerStats) bool) FlushWorkerStats {
+		var stats FlushWorkerStats
+		for i := 0; i < 200; i++ {
+			stats = pool.stats()
+			if cond(stats) {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return stats
+	}
+
+	// A single flush only needs a single worker
+	pool.run(func() {})
+	assert.Equal(t, 1, pool.stats().Workers)
+
+	// Simulate a burst of flushes that take a while
+	burst := 10
+	release := make(chan interface{})
+	var wg sync.WaitGroup
+	wg.Add(burst)
+	for i := 0; i < burst; i++ {
+		go func() {
+			defer wg.Done()
+			pool.run(func() {
+				<-release
+			})
+		}()
+	}
+	stats := waitFor(func(stats FlushWorkerStats) bool {
+		return stats.QueueDepth == burst-maxWorkers
+	})
+	assert.Equal(t, maxWorkers, stats.Workers, "Pool should have scaled up to its maximum")
+	assert.Equal(t, maxWorkers, stats.MaxWorkers)
+	assert.Equal(t, burst-maxWorkers, stats.QueueDepth, "Flushes beyond the maximum number of workers should be queued")
+
+	close(release)
+	wg.Wait()
+	assert.Zero(t, pool.stats().QueueDepth, "Queue should have drained")
+
+	stats = waitFor(func(stats FlushWorkerStats) bool {
+		return stats.Workers == 0
+	})
+	assert.Zero(t, stats.Workers, "Idle workers should have exited")
+
+	// The pool should scale up again as needed
+	pool.run(func() {})
+	assert.Equal(t, 1, pool.stats().Workers)
+}
+
+func TestFlushesUseFlushPool(t *testing.T) {
+	db, _, cleanup := newFlushedTestDB(t, &DBOpts{MaxFlushWorkers: 2}, "pooled", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)", "a")
+	defer cleanup()
+
+	stats := db.FlushWorkerStats()
+	assert.Equal(t, 1, stats.Workers, "Flush should have started a worker")
+	assert.Equal(t, 2, stats.MaxWorkers)
+}
+
+func TestPendingFlushes(t *testing.T) {
+	h := &hooks{}
+	release := make(chan interface{})
+	h.flushRow = func(key bytemap.ByteMap) error {
+		<-release
+		return nil
+	}
+
+	db, cleanup := newTestDB(t, &DBOpts{hooks: h}, "bursty", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	db.clock.Advance(testEpoch)
+	insertKeys(t, db, "bursty", testEpoch, "a")
+	tbl := db.getTable("bursty")
+
+	// Simulate a burst of flush requests while the flusher is blocked
+	burst := 5
+	var wg sync.WaitGroup
+	wg.Add(burst)
+	for i := 0; i < burst; i++ {
+		go func() {
+			defer wg.Done()
+			tbl.forceFlush()
+		}()
+	}
+	for i := 0; i < 100 && db.TableStats("bursty").PendingFlushes < int64(burst); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues(t, burst, db.TableStats("bursty").PendingFlushes, "All flushes in burst should be pending")
+
+	close(release)
+	wg.Wait()
+	stats := db.TableStats("bursty")
+	assert.Zero(t, stats.PendingFlushes, "Pending flushes should have drained")
+	assert.True(t, stats.RowStore.LastFlushDuration > 0, "Flush duration should have been recorded")
+}
@@ -0,0 +1,53 @@
+package zenodb
+
+import (
+	"os"
+
+	"github.com/getlantern/errors"
+)
+
+// FsyncPolicy determines whether flushes wait for the files they write to
+// reach the disk. See DBOpts.FsyncOnFlush.
+type FsyncPolicy int
+
+const (
+	// FsyncEnabled syncs every file written by a flush (or by a compaction or a
+	// move from DBOpts.FlushScratchDir) before renaming it into place, and then
+	// syncs the directory containing it so that the rename itself is durable.
+	// Once a flush has finished, its data survives power loss and operating
+	// system crashes. This is the default.
+	FsyncEnabled FsyncPolicy = iota
+	// FsyncDisabled leaves it up to the operating system when to write flushed
+	// files to disk, which makes flushes faster and less disruptive to other
+	// I/O. Data survives crashes of the database process, but a power loss or
+	// operating system crash shortly after a flush can leave the newest files
+	// empty, truncated or missing. Because older files are removed once they've
+	// been superseded, this can lose data that was flushed before the crash and
+	// is no longer covered by the WAL.
+	FsyncDisabled
+)
+
+// syncFile syncs a file written by a flush, unless fsyncing is disabled.
+func (rs *rowStore) syncFile(file *os.File) error {
+	if rs.t.db.opts.FsyncOnFlush == FsyncDisabled {
+		return nil
+	}
+	return file.Sync()
+}
+
+// syncDir syncs the given directory after a file was renamed into it, so that
+// the rename survives a crash, unless fsyncing is disabled.
+func (rs *rowStore) syncDir(dir string) error {
+	if rs.t.db.opts.FsyncOnFlush == FsyncDisabled {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.New("Unable to open directory %v for syncing: %v", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return errors.New("Unable to sync directory %v: %v", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package zenodb
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFsyncOnFlush(t *testing.T) {
+	for _, policy := range []FsyncPolicy{FsyncEnabled, FsyncDisabled} {
+		db, tbl, cleanup := newFlushedTestDB(t, &DBOpts{FsyncOnFlush: policy}, "synced", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)", "a")
+		assert.EqualValues(t, 1, db.TableStats("synced").RowStore.Flushes, "Flush should succeed with policy %d", policy)
+		assert.Zero(t, db.TableStats("synced").RowStore.FlushFailures)
+
+		missingDir := filepath.Join(tbl.rowStore.opts.dir, "missing")
+		if policy == FsyncEnabled {
+			assert.Error(t, tbl.rowStore.syncDir(missingDir), "Syncing a missing directory should fail")
+		} else {
+			assert.NoError(t, tbl.rowStore.syncDir(missingDir), "Directories shouldn't be synced when fsync is disabled")
+		}
+		cleanup()
+	}
+}
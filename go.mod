@@ -39,7 +39,8 @@ require (
 	github.com/mitchellh/go-homedir v1.1.0 // indirect
 	github.com/oxtoacart/bpool v0.0.0-20190530202638-03653db5a59c
 	github.com/oxtoacart/emsort v0.0.0-20160911032127-e467347e3354
-	github.com/pkg/errors v0.8.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/client_golang v1.11.0
 	github.com/retailnext/hllpp v1.0.0
 	github.com/rickar/props v0.0.0-20170718221555-0b06aeb2f037
 	github.com/shirou/gopsutil v2.18.12+incompatible
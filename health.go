@@ -0,0 +1,62 @@
+package zenodb
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// unhealthyMemStoreFactor is how many times TableOpts.MaxMemStoreBytes a
+	// memstore may grow to before the table is considered unhealthy.
+	unhealthyMemStoreFactor = 4
+
+	// unhealthyPendingFlushes is how many forced flushes may be waiting before
+	// the table is considered unhealthy.
+	unhealthyPendingFlushes = 10
+)
+
+// Healthy indicates whether all tables are keeping up with their inserts,
+// which is suitable for use as a readiness check. A table is unhealthy if its
+// memstore has grown far beyond TableOpts.MaxMemStoreBytes, if its insert
+// queue is full, if flushes are backed up or if its most recent flush failed.
+// If unhealthy, the returned string names each unhealthy table and why.
+func (db *DB) Healthy() (bool, string) {
+	db.tablesMutex.RLock()
+	tables := make([]*table, len(db.orderedTables))
+	copy(tables, db.orderedTables)
+	db.tablesMutex.RUnlock()
+
+	var problems []string
+	for _, t := range tables {
+		if t.rowStore == nil {
+			continue
+		}
+		for _, reason := range t.unhealthyReasons(t.getStats()) {
+			problems = append(problems, fmt.Sprintf("%v: %v", t.Name, reason))
+		}
+	}
+	if len(problems) > 0 {
+		return false, strings.Join(problems, "; ")
+	}
+	return true, ""
+}
+
+func (t *table) unhealthyReasons(stats TableStats) []string {
+	var reasons []string
+	if t.MaxMemStoreBytes > 0 {
+		limit := int64(t.MaxMemStoreBytes) * unhealthyMemStoreFactor
+		if stats.RowStore.MemStoreBytes > limit {
+			reasons = append(reasons, fmt.Sprintf("memstore size %d exceeds %d", stats.RowStore.MemStoreBytes, limit))
+		}
+	}
+	if t.InsertQueueSize > 0 && stats.InsertQueueDepth >= int64(t.InsertQueueSize) {
+		reasons = append(reasons, fmt.Sprintf("insert queue full (%d)", stats.InsertQueueDepth))
+	}
+	if stats.PendingFlushes >= unhealthyPendingFlushes {
+		reasons = append(reasons, fmt.Sprintf("%d flushes pending", stats.PendingFlushes))
+	}
+	if stats.RowStore.LastFlushError != "" {
+		reasons = append(reasons, fmt.Sprintf("last flush failed: %v", stats.RowStore.LastFlushError))
+	}
+	return reasons
+}
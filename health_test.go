@@ -0,0 +1,74 @@
+package zenodb
+
+import (
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthy(t *testing.T) {
+	h := &hooks{}
+	failing := int32(0)
+	h.flushWriter = func(out io.Writer) io.Writer {
+		return &failingWriter{&failing, out}
+	}
+
+	db, cleanup := newTestDB(t, &DBOpts{
+		hooks:             h,
+		FlushRetries:      1,
+		FlushRetryBackoff: time.Millisecond,
+		Panic: func(err interface{}) {
+			t.Errorf("Flush failure should not have panicked: %v", err)
+		},
+	}, "health", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	db.clock.Advance(testEpoch)
+	insert := func() {
+		insertKeys(t, db, "health", testEpoch, "a")
+	}
+	tbl := db.getTable("health")
+
+	healthy, reason := db.Healthy()
+	assert.True(t, healthy)
+	assert.Empty(t, reason)
+
+	insert()
+	atomic.StoreInt32(&failing, 1)
+	tbl.forceFlush()
+	healthy, reason = db.Healthy()
+	assert.False(t, healthy, "Failed flush should make database unhealthy")
+	assert.Contains(t, reason, "health: last flush failed: ")
+	assert.Contains(t, reason, "disk full")
+
+	atomic.StoreInt32(&failing, 0)
+	tbl.forceFlush()
+	healthy, reason = db.Healthy()
+	assert.True(t, healthy, "Successful flush should make database healthy again")
+	assert.Empty(t, reason)
+}
+
+func TestUnhealthyReasons(t *testing.T) {
+	tbl := &table{TableOpts: &TableOpts{MaxMemStoreBytes: 100, InsertQueueSize: 10}}
+
+	stats := TableStats{InsertQueueDepth: 9, PendingFlushes: unhealthyPendingFlushes - 1}
+	stats.RowStore.MemStoreBytes = 100 * unhealthyMemStoreFactor
+	assert.Empty(t, tbl.unhealthyReasons(stats))
+
+	stats.RowStore.MemStoreBytes++
+	assert.Equal(t, []string{"memstore size 401 exceeds 400"}, tbl.unhealthyReasons(stats))
+
+	stats.RowStore.MemStoreBytes = 0
+	stats.InsertQueueDepth = 10
+	stats.PendingFlushes = unhealthyPendingFlushes
+	assert.Equal(t, []string{"insert queue full (10)", "10 flushes pending"}, tbl.unhealthyReasons(stats))
+
+	tbl.MaxMemStoreBytes = 0
+	tbl.InsertQueueSize = 0
+	stats.RowStore.MemStoreBytes = 1e9
+	stats.PendingFlushes = 0
+	assert.Empty(t, tbl.unhealthyReasons(stats), "Unlimited memstore and queue should never be unhealthy")
+}
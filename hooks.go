@@ -0,0 +1,76 @@
+package zenodb
+
+import (
+	"io"
+	"os"
+
+	"github.com/getlantern/bytemap"
+)
+
+// hooks lets tests intercept internal operations of a DB, see DBOpts.hooks.
+// Any of the functions may be nil, as may the hooks themselves, in which case
+// the operation proceeds as usual.
+type hooks struct {
+	// flushRow is called for each row written during a flush. If it returns an
+	// error, the flush fails as if the row couldn't be read.
+	flushRow func(key bytemap.ByteMap) error
+
+	// flushWriter wraps the writer to which flushes write their output.
+	flushWriter func(out io.Writer) io.Writer
+
+	// decodeColumn is called with the index of each file column that a query
+	// decodes.
+	decodeColumn func(column int)
+
+	// rename is called instead of os.Rename when moving files into place.
+	rename func(from, to string) error
+
+	// migrationChunk is called with a migration's progress before each chunk is
+	// checkpointed. If it returns an error, the migration fails, leaving its
+	// prior checkpoints in place.
+	migrationChunk func(chunk int, progress *MigrationProgress) error
+
+	// getFile is called with the name of each file that fileStore.get reads
+	// (i.e. that wasn't skipped based on its bloom filter).
+	getFile func(filename string)
+}
+
+func (h *hooks) onFlushRow(key bytemap.ByteMap) error {
+	if h == nil || h.flushRow == nil {
+		return nil
+	}
+	return h.flushRow(key)
+}
+
+func (h *hooks) wrapFlushWriter(out io.Writer) io.Writer {
+	if h == nil || h.flushWriter == nil {
+		return out
+	}
+	return h.flushWriter(out)
+}
+
+func (h *hooks) onDecodeColumn(column int) {
+	if h != nil && h.decodeColumn != nil {
+		h.decodeColumn(column)
+	}
+}
+
+func (h *hooks) doRename(from, to string) error {
+	if h == nil || h.rename == nil {
+		return os.Rename(from, to)
+	}
+	return h.rename(from, to)
+}
+
+func (h *hooks) onMigrationChunk(chunk int, progress *MigrationProgress) error {
+	if h == nil || h.migrationChunk == nil {
+		return nil
+	}
+	return h.migrationChunk(chunk, progress)
+}
+
+func (h *hooks) onGetFile(filename string) {
+	if h != nil && h.getFile != nil {
+		h.getFile(filename)
+	}
+}
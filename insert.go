@@ -3,32 +3,99 @@ package zenodb
 import (
 	"fmt"
 	"hash"
+	"math"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
+	"github.com/getlantern/goexpr"
 	"github.com/getlantern/wal"
 	"github.com/getlantern/zenodb/encoding"
 )
 
+var (
+	// ErrPointTooOld indicates that a point falls outside of the table's
+	// retention period.
+	ErrPointTooOld = errors.New("point is older than the table's retention period")
+	// ErrPointInFuture indicates that a point is further in the future than
+	// allowed by DBOpts.FutureHorizon.
+	ErrPointInFuture = errors.New("point is too far in the future")
+	// ErrPointTooLate indicates that a point is older than allowed by the
+	// table's TableOpts.MaxLateness.
+	ErrPointTooLate = errors.New("point arrived later than the table's maximum lateness")
+	// ErrPointHasNoValues indicates that a point didn't contain any usable
+	// values.
+	ErrPointHasNoValues = errors.New("point has no values")
+	// ErrKeyTooLarge indicates that the key derived from a point's dimensions
+	// is too large to be stored.
+	ErrKeyTooLarge = errors.New("point's key is too large")
+	// ErrValueNotFinite indicates that a point contained a NaN or infinite
+	// value.
+	ErrValueNotFinite = errors.New("point has a NaN or infinite value")
+	// ErrInsertQueueFull indicates that TryInsertBatch couldn't queue points
+	// because the table's insert queue is full.
+	ErrInsertQueueFull = errors.New("table's insert queue is full")
+	// ErrTableReadOnly indicates that points were inserted into a table that
+	// only serves queries (see TableOpts.ReadOnly and DBOpts.ReadReplica).
+	ErrTableReadOnly = errors.New("table is read only")
+	// ErrTableClosed indicates that points were inserted into a table whose
+	// row store has been closed.
+	ErrTableClosed = errors.New("table is closed")
+	// ErrRateLimited indicates that points were inserted faster than allowed by
+	// TableOpts.MaxInsertsPerSecond.
+	ErrRateLimited = errors.New("table's insert rate limit exceeded")
+	// ErrTableIsRollup indicates that points were inserted into a table that is
+	// built from another table (see DB.CreateRollup).
+	ErrTableIsRollup = errors.New("table is a rollup")
+)
+
+const (
+	// maxKeyLength is the largest key that can be stored, since file stores
+	// record key lengths using 16 bits.
+	maxKeyLength = math.MaxUint16
+)
+
+// Point is a single timestamped record for use with InsertBatch.
+type Point struct {
+	TS   time.Time
+	Dims map[string]interface{}
+	Vals map[string]interface{}
+}
+
+// Rejection explains why a Point in a batch was not inserted.
+type Rejection struct {
+	// Index is the position of the rejected Point within the batch
+	Index int
+	Err   error
+}
+
 func (db *DB) Insert(stream string, ts time.Time, dims map[string]interface{}, vals map[string]interface{}) error {
 	return db.InsertRaw(stream, ts, bytemap.New(dims), bytemap.New(vals))
 }
 
 func (db *DB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
+	_, err := db.insertRaw(stream, ts, dims, vals, false)
+	return err
+}
+
+// insertRaw writes the given point to the stream's WAL. If sequenced is true,
+// the point is assigned the stream's next sequence number, which is returned.
+func (db *DB) insertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap, sequenced bool) (int64, error) {
 	if db.opts.Follow != nil {
-		return errors.New("Declining to insert data directly to follower")
+		return 0, errors.New("Declining to insert data directly to follower")
 	}
 
 	stream = strings.TrimSpace(strings.ToLower(stream))
 	db.tablesMutex.Lock()
 	w := db.streams[stream]
+	seq := db.sequencers[stream]
 	db.tablesMutex.Unlock()
 	if w == nil {
-		return fmt.Errorf("No wal found for stream %v", stream)
+		return 0, fmt.Errorf("No wal found for stream %v", stream)
 	}
 
 	if len(db.opts.WhitelistedDimensions) > 0 {
@@ -51,11 +118,109 @@ func (db *DB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals
 	if db.log.IsTraceEnabled() {
 		db.log.Tracef("Writing to wal with dims length %d: %v", len(dims), bytemap.ByteMap(dims).AsMap())
 	}
-	err := w.Write(tsd, dimsLen, dims, valsLen, vals)
+	var sequence int64
+	var err error
+	if sequenced {
+		sequence, err = seq.write(w, tsd, dimsLen, dims, valsLen, vals)
+	} else {
+		err = w.Write(tsd, dimsLen, dims, valsLen, vals)
+	}
 	if err != nil {
 		db.log.Error(err)
 	}
-	return err
+	return sequence, err
+}
+
+// sequencer assigns increasing sequence numbers to the points that Sessions
+// write to a single stream's WAL. The sequence number is appended to the end of
+// the WAL entry, after the vals, where readers that don't know about it simply
+// ignore it. Points inserted outside of a Session don't get a sequence number,
+// so they neither pay for the extra bytes nor wait on the sequencer's lock.
+// Sequence numbers are seeded from the wall clock so that they keep increasing
+// across restarts.
+type sequencer struct {
+	last int64
+	mx   sync.Mutex
+}
+
+func (s *sequencer) write(w *wal.WAL, bufs ...[]byte) (int64, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	sequence := time.Now().UnixNano()
+	if sequence <= s.last {
+		sequence = s.last + 1
+	}
+	s.last = sequence
+	seqd := make([]byte, encoding.Width64bits)
+	encoding.WriteInt64(seqd, int(sequence))
+	return sequence, w.Write(append(bufs, seqd)...)
+}
+
+// walSequence extracts the sequence number from a WAL entry, returning 0 if the
+// entry doesn't have one.
+func walSequence(data []byte) int64 {
+	if len(data) < encoding.Width64bits+encoding.Width32bits {
+		return 0
+	}
+	remain := data[encoding.Width64bits:]
+	dimsLen, remain := encoding.ReadInt32(remain)
+	if len(remain) < dimsLen+encoding.Width32bits {
+		return 0
+	}
+	remain = remain[dimsLen:]
+	valsLen, remain := encoding.ReadInt32(remain)
+	if len(remain) < valsLen+encoding.Width64bits {
+		return 0
+	}
+	remain = remain[valsLen:]
+	sequence, _ := encoding.ReadInt64(remain)
+	return int64(sequence)
+}
+
+// InsertBatch inserts the given points directly into the named table, bucketing
+// each point into the correct period based on its own timestamp. Points may be
+// supplied in any order. Unlike Insert, InsertBatch bypasses the stream's WAL.
+// Instead, the points are logged to the table's own batch log (synced according
+// to DBOpts.WALSyncInterval) until the table's memstore has been flushed, so
+// that they can be recovered after a crash. Points that can't be inserted are
+// reported as Rejections, points that are filtered out by the table's WHERE
+// clause are not.
+func (db *DB) InsertBatch(table string, points []*Point) ([]*Rejection, error) {
+	t := db.getTable(table)
+	if t == nil {
+		return nil, fmt.Errorf("Table %v not found", table)
+	}
+	if t.rowStore == nil {
+		return nil, fmt.Errorf("Table %v does not store data locally", table)
+	}
+	return t.insertBatch(points, true)
+}
+
+// TryInsertBatch is like InsertBatch, except that rather than waiting for the
+// points to be applied, it queues them and returns immediately. If the table's
+// insert queue is full (see TableOpts.InsertQueueSize), it returns
+// ErrInsertQueueFull without inserting any points, allowing callers to shed
+// load. Queued points become visible to queries once they've been applied.
+func (db *DB) TryInsertBatch(table string, points []*Point) ([]*Rejection, error) {
+	t := db.getTable(table)
+	if t == nil {
+		return nil, fmt.Errorf("Table %v not found", table)
+	}
+	if t.rowStore == nil {
+		return nil, fmt.Errorf("Table %v does not store data locally", table)
+	}
+	return t.insertBatch(points, false)
+}
+
+// ValidateInsert runs the same validations that InsertBatch runs on the given
+// point against the named table, without inserting anything. See
+// table.ValidateInsert.
+func (db *DB) ValidateInsert(table string, point *Point) error {
+	t := db.getTable(table)
+	if t == nil {
+		return fmt.Errorf("Table %v not found", table)
+	}
+	return t.ValidateInsert(point.Dims, point.Vals, point.TS)
 }
 
 type walRead struct {
@@ -87,6 +252,7 @@ func (t *table) processInserts(in chan *walRead, stop <-chan interface{}) {
 	bytesRead := 0
 
 	h := partitionHash()
+	limits := &walInsertLimits{t: t}
 loop:
 	for {
 		select {
@@ -98,11 +264,28 @@ loop:
 				continue loop
 			}
 			bytesRead += len(read.data)
-			if t.insert(read.data, isFollower, h, read.offset, read.source) {
+			sequence := walSequence(read.data)
+			if t.ShedExcessInserts {
+				if !t.insertLimiter.tryTake(1) {
+					t.skip(read.offset, read.source, sequence)
+					t.statsMutex.Lock()
+					t.stats.ThrottledPoints++
+					t.statsMutex.Unlock()
+					t.db.walBuffers.Put(read.data)
+					continue loop
+				}
+			} else if delay := t.insertLimiter.take(1); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-stop:
+					return
+				}
+			}
+			if t.insert(read.data, isFollower, h, read.offset, read.source, sequence, limits) {
 				inserted++
 			} else {
 				// Did not insert (probably due to WHERE clause)
-				t.skip(read.offset, read.source)
+				t.skip(read.offset, read.source, sequence)
 				skipped++
 			}
 			t.db.walBuffers.Put(read.data)
@@ -120,7 +303,7 @@ loop:
 	}
 }
 
-func (t *table) insert(data []byte, isFollower bool, h hash.Hash32, offset wal.Offset, source int) bool {
+func (t *table) insert(data []byte, isFollower bool, h hash.Hash32, offset wal.Offset, source int, sequence int64, walLimits *walInsertLimits) bool {
 	defer func() {
 		p := recover()
 		if p != nil {
@@ -130,7 +313,8 @@ func (t *table) insert(data []byte, isFollower bool, h hash.Hash32, offset wal.O
 
 	tsd, remain := encoding.Read(data, encoding.Width64bits)
 	ts := encoding.TimeFromBytes(tsd)
-	if ts.Before(t.truncateBefore()) {
+	limits := walLimits.get(ts)
+	if ts.Before(limits.truncateBefore) {
 		// Ignore old data
 		return false
 	}
@@ -164,15 +348,27 @@ func (t *table) insert(data []byte, isFollower bool, h hash.Hash32, offset wal.O
 			t.log.Tracef("Dims are %v", dimsBM.AsMap())
 		}
 	}
-	return t.doInsert(ts, dimsBM, valsBM, offset, source)
+	return t.doInsert(ts, dimsBM, valsBM, offset, source, sequence, limits)
 }
 
-// Skip informs the table of a new offset so that we can store it
-func (t *table) skip(offset wal.Offset, source int) {
-	t.rowStore.insert(&insert{nil, nil, nil, offset, source})
+// Skip informs the table of a new offset and sequence so that we can store it
+func (t *table) skip(offset wal.Offset, source int, sequence int64) {
+	t.rowStore.insert(&insert{nil, nil, nil, offset, source, sequence})
+}
+
+// interceptInsert adapts TableOpts.InterceptInsert for the rowStore.
+func (t *table) interceptInsert(original *insert) (*insert, error) {
+	key, vals, err := t.InterceptInsert(original.key, original.vals)
+	if err != nil {
+		return nil, err
+	}
+	intercepted := *original
+	intercepted.key = key
+	intercepted.vals = vals
+	return &intercepted, nil
 }
 
-func (t *table) doInsert(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap, offset wal.Offset, source int) bool {
+func (t *table) doInsert(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap, offset wal.Offset, source int, sequence int64, limits *insertLimits) bool {
 	where := t.getWhere()
 
 	if where != nil {
@@ -187,33 +383,276 @@ func (t *table) doInsert(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMa
 			return false
 		}
 	}
+	if ts.Before(limits.lateLimit) {
+		if t.log.IsTraceEnabled() {
+			t.log.Tracef("Dropping inbound point at %v that arrived too late: %v", ts, dims.AsMap())
+		}
+		t.statsMutex.Lock()
+		t.stats.LatePoints++
+		t.statsMutex.Unlock()
+		return false
+	}
 	t.db.clock.Advance(ts)
 
 	if t.log.IsTraceEnabled() {
 		t.log.Tracef("Including inbound point at %v: %v", ts, dims.AsMap())
 	}
 
-	var key bytemap.ByteMap
-	if len(t.GroupBy) == 0 {
-		key = dims
-	} else {
-		// Reslice dimensions
-		names := make([]string, 0, len(t.GroupBy))
-		values := make([]interface{}, 0, len(t.GroupBy))
-		for _, groupBy := range t.GroupBy {
-			val := groupBy.Expr.Eval(dims)
-			if val != nil {
-				names = append(names, groupBy.Name)
-				values = append(values, val)
+	key := t.keyFor(dims)
+	mainVals, additionalVals, hasMainValue := t.splitVals(vals)
+
+	t.db.capMemorySize(true)
+	inserted := len(additionalVals)
+	if hasMainValue {
+		t.rowStore.insert(&insert{key, encoding.NewTSParams(ts, mainVals), dims, offset, source, sequence})
+		inserted++
+	}
+	for _, subVals := range additionalVals {
+		t.rowStore.insert(&insert{key, encoding.NewTSParams(ts, subVals), dims, offset, source, sequence})
+	}
+	t.statsMutex.Lock()
+	t.stats.InsertedPoints += int64(inserted)
+	t.statsMutex.Unlock()
+
+	return true
+}
+
+// ValidateInsert checks whether a point with the given dims, vals and ts would
+// be accepted by InsertBatch, returning the corresponding error (e.g.
+// ErrPointTooOld) if not. Points that would be filtered out by the table's
+// WHERE clause are considered valid. Nothing is inserted.
+func (t *table) ValidateInsert(dims map[string]interface{}, vals map[string]interface{}, ts time.Time) error {
+	_, err := t.validatePoint(t.newInsertLimits(), ts, bytemap.New(dims), bytemap.New(vals))
+	return err
+}
+
+// lateLimitAt returns the time before which points are considered too late to
+// be inserted as of the given time, or the zero time if the table accepts late
+// points.
+func (t *table) lateLimitAt(now time.Time) time.Time {
+	if t.MaxLateness <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-1 * t.MaxLateness)
+}
+
+// insertLimits captures the limits against which a batch of points is
+// validated.
+type insertLimits struct {
+	truncateBefore time.Time
+	lateLimit      time.Time
+	futureLimit    time.Time
+	where          goexpr.Expr
+}
+
+func (t *table) newInsertLimits() *insertLimits {
+	return t.newInsertLimitsAt(t.db.clock.Now())
+}
+
+func (t *table) newInsertLimitsAt(now time.Time) *insertLimits {
+	limits := &insertLimits{
+		truncateBefore: t.truncateBeforeAt(now),
+		lateLimit:      t.lateLimitAt(now),
+		where:          t.getWhere(),
+	}
+	if t.db.opts.FutureHorizon > 0 {
+		limits.futureLimit = now.Add(t.db.opts.FutureHorizon)
+	}
+	return limits
+}
+
+// maxWALInsertLimitsUses bounds how many points read from the WAL are checked
+// against the same cached insertLimits.
+const maxWALInsertLimitsUses = 1000
+
+// walInsertLimits caches the insertLimits against which points read from the
+// WAL are checked, so that the clock isn't consulted for every point. The
+// limits are recomputed once a point arrives for a later resolution window
+// than the one in which they were computed, or after maxWALInsertLimitsUses
+// points. Limits only ever move forward, so stale limits can at worst admit
+// points that are slightly too old or too late. It is only used from the
+// processInserts goroutine.
+type walInsertLimits struct {
+	t         *table
+	limits    *insertLimits
+	refreshAt int64
+	uses      int
+}
+
+func (l *walInsertLimits) get(ts time.Time) *insertLimits {
+	l.uses++
+	if l.limits == nil || ts.UnixNano() >= l.refreshAt || l.uses > maxWALInsertLimitsUses {
+		now := l.t.db.clock.Now()
+		l.limits = l.t.newInsertLimitsAt(now)
+		l.refreshAt = now.Truncate(l.t.Resolution).Add(l.t.Resolution).UnixNano()
+		l.uses = 1
+	}
+	return l.limits
+}
+
+// validPoint is a point that passed validation, ready to be inserted.
+type validPoint struct {
+	key            bytemap.ByteMap
+	mainVals       bytemap.ByteMap
+	additionalVals []bytemap.ByteMap
+	hasMainValue   bool
+}
+
+// validatePoint validates the given point against the given limits. If the
+// point is filtered out by the table's WHERE clause, it returns nil and no
+// error.
+func (t *table) validatePoint(limits *insertLimits, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) (*validPoint, error) {
+	if ts.Before(limits.truncateBefore) {
+		return nil, ErrPointTooOld
+	}
+	if ts.Before(limits.lateLimit) {
+		return nil, ErrPointTooLate
+	}
+	if !limits.futureLimit.IsZero() && ts.After(limits.futureLimit) {
+		return nil, ErrPointInFuture
+	}
+
+	if limits.where != nil && !limits.where.Eval(dims).(bool) {
+		return nil, nil
+	}
+
+	key := t.keyFor(dims)
+	if len(key) > maxKeyLength {
+		return nil, ErrKeyTooLarge
+	}
+	mainVals, additionalVals, hasMainValue := t.splitVals(vals)
+	if !hasMainValue && len(additionalVals) == 0 {
+		return nil, ErrPointHasNoValues
+	}
+	if !allFinite(mainVals) {
+		return nil, ErrValueNotFinite
+	}
+	for _, subVals := range additionalVals {
+		if !allFinite(subVals) {
+			return nil, ErrValueNotFinite
+		}
+	}
+	return &validPoint{key, mainVals, additionalVals, hasMainValue}, nil
+}
+
+func allFinite(vals bytemap.ByteMap) bool {
+	finite := true
+	vals.IterateValues(func(key string, value interface{}) bool {
+		v, ok := value.(float64)
+		if ok && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			finite = false
+		}
+		return finite
+	})
+	return finite
+}
+
+func (t *table) insertBatch(points []*Point, block bool) ([]*Rejection, error) {
+	if t.rowStore.opts.readOnly {
+		return nil, ErrTableReadOnly
+	}
+	if t.rollupOf != "" {
+		return nil, ErrTableIsRollup
+	}
+
+	var rejections []*Rejection
+	reject := func(i int, err error) {
+		rejections = append(rejections, &Rejection{Index: i, Err: err})
+	}
+
+	limits := t.newInsertLimits()
+	inserts := make([]*insert, 0, len(points))
+	filtered := 0
+	late := 0
+	throttled := 0
+	accepted := 0
+	for i, point := range points {
+		dims := bytemap.New(point.Dims)
+		valid, err := t.validatePoint(limits, point.TS, dims, bytemap.New(point.Vals))
+		if err != nil {
+			if err == ErrPointTooLate {
+				late++
 			}
+			reject(i, err)
+			continue
+		}
+		if valid == nil {
+			filtered++
+			continue
+		}
+		if t.ShedExcessInserts && !t.insertLimiter.tryTake(1) {
+			throttled++
+			reject(i, ErrRateLimited)
+			continue
+		}
+		accepted++
+
+		if valid.hasMainValue {
+			inserts = append(inserts, &insert{valid.key, encoding.NewTSParams(point.TS, valid.mainVals), dims, nil, 0, 0})
+		}
+		for _, subVals := range valid.additionalVals {
+			inserts = append(inserts, &insert{valid.key, encoding.NewTSParams(point.TS, subVals), dims, nil, 0, 0})
+		}
+		t.db.clock.Advance(point.TS)
+	}
+
+	if len(inserts) > 0 && !t.ShedExcessInserts {
+		if !block {
+			if !t.insertLimiter.tryTake(accepted) {
+				return nil, ErrRateLimited
+			}
+		} else if delay := t.insertLimiter.take(accepted); delay > 0 {
+			time.Sleep(delay)
 		}
-		key = bytemap.FromSortedKeysAndValues(names, values)
 	}
 
-	// Do separate inserts rows for array values if necessary
-	var additionalVals []bytemap.ByteMap
-	hasMainValue := false
-	mainVals := bytemap.Build(func(_include func(string, interface{})) {
+	if len(inserts) > 0 {
+		t.db.capMemorySize(true)
+		var err error
+		if block {
+			err = t.rowStore.insertBatch(inserts)
+		} else {
+			err = t.rowStore.tryInsertBatch(inserts)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	t.statsMutex.Lock()
+	t.stats.FilteredPoints += int64(filtered)
+	t.stats.LatePoints += int64(late)
+	t.stats.ThrottledPoints += int64(throttled)
+	t.stats.InsertedPoints += int64(len(inserts))
+	t.statsMutex.Unlock()
+
+	return rejections, nil
+}
+
+// keyFor determines the row key for the given dims based on the table's
+// GroupBy.
+func (t *table) keyFor(dims bytemap.ByteMap) bytemap.ByteMap {
+	if len(t.GroupBy) == 0 {
+		return dims
+	}
+
+	// Reslice dimensions
+	names := make([]string, 0, len(t.GroupBy))
+	values := make([]interface{}, 0, len(t.GroupBy))
+	for _, groupBy := range t.GroupBy {
+		val := groupBy.Expr.Eval(dims)
+		if val != nil {
+			names = append(names, groupBy.Name)
+			values = append(values, val)
+		}
+	}
+	return bytemap.FromSortedKeysAndValues(names, values)
+}
+
+// splitVals splits the given vals into the main values to insert and, for array
+// values, additional values that require separate inserts.
+func (t *table) splitVals(vals bytemap.ByteMap) (mainVals bytemap.ByteMap, additionalVals []bytemap.ByteMap, hasMainValue bool) {
+	mainVals = bytemap.Build(func(_include func(string, interface{})) {
 		include := func(key string, val float64) {
 			_include(key, val)
 			hasMainValue = true
@@ -250,21 +689,7 @@ func (t *table) doInsert(ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMa
 			return true
 		})
 	}, nil, true)
-
-	t.db.capMemorySize(true)
-	inserted := len(additionalVals)
-	if hasMainValue {
-		t.rowStore.insert(&insert{key, encoding.NewTSParams(ts, mainVals), dims, offset, source})
-		inserted++
-	}
-	for _, subVals := range additionalVals {
-		t.rowStore.insert(&insert{key, encoding.NewTSParams(ts, subVals), dims, offset, source})
-	}
-	t.statsMutex.Lock()
-	t.stats.InsertedPoints += int64(inserted)
-	t.statsMutex.Unlock()
-
-	return true
+	return
 }
 
 func (t *table) recordQueued() {
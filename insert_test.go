@@ -0,0 +1,382 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInsertBatch(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{FutureHorizon: time.Minute}, "batch", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	resolution := time.Second
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+
+	dims := map[string]interface{}{"k": "a"}
+	point := func(offset time.Duration, v float64) *Point {
+		return &Point{
+			TS:   epoch.Add(offset),
+			Dims: dims,
+			Vals: map[string]interface{}{"v": v},
+		}
+	}
+
+	rejections, err := db.InsertBatch("batch", []*Point{
+		point(-3*resolution, 3),
+		point(0, 1),
+		point(-5*resolution, 5),
+		point(-3*resolution, 30),
+		point(-1*resolution, 2),
+		point(-2*time.Hour, 100),
+		point(1*time.Hour, 200),
+		{TS: epoch, Dims: dims},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, rejections, 3) {
+		assert.Equal(t, 5, rejections[0].Index)
+		assert.Equal(t, ErrPointTooOld, rejections[0].Err)
+		assert.Equal(t, 6, rejections[1].Index)
+		assert.Equal(t, ErrPointInFuture, rejections[1].Err)
+		assert.Equal(t, 7, rejections[2].Index)
+		assert.Equal(t, ErrPointHasNoValues, rejections[2].Err)
+	}
+
+	_, err = db.InsertBatch("unknown", []*Point{point(0, 1)})
+	assert.Error(t, err)
+
+	tbl := db.getTable("batch")
+	fields := tbl.getFields()
+	vIdx := -1
+	for i, field := range fields {
+		if field.Name == "v" {
+			vIdx = i
+		}
+	}
+	if !assert.True(t, vIdx >= 0, "Field v not found") {
+		return
+	}
+
+	var seq encoding.Sequence
+	rows := 0
+	_, err = tbl.iterate(context.Background(), fields, true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		rows++
+		assert.Equal(t, "a", key.Get("k"))
+		seq = vals[vIdx]
+		return true, nil
+	})
+	if !assert.NoError(t, err) || !assert.Equal(t, 1, rows) {
+		return
+	}
+
+	ex := fields[vIdx].Expr
+	expected := map[time.Duration]float64{
+		0:               1,
+		-1 * resolution: 2,
+		-2 * resolution: 0,
+		-3 * resolution: 33,
+		-4 * resolution: 0,
+		-5 * resolution: 5,
+	}
+	for offset, v := range expected {
+		actual, _ := seq.ValueAtTime(epoch.Add(offset), ex, resolution)
+		assert.Equal(t, v, actual, "Wrong value at %v", offset)
+	}
+
+	stats := db.TableStats("batch")
+	assert.EqualValues(t, 5, stats.InsertedPoints)
+}
+
+func TestValidateInsert(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{FutureHorizon: time.Minute}, "validated", "SELECT v FROM inbound WHERE k != 'skip' GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+
+	validate := func(ts time.Time, dims map[string]interface{}, vals map[string]interface{}) error {
+		return db.ValidateInsert("validated", &Point{TS: ts, Dims: dims, Vals: vals})
+	}
+	dims := map[string]interface{}{"k": "a"}
+	vals := map[string]interface{}{"v": 1}
+
+	assert.NoError(t, validate(epoch, dims, vals))
+	assert.NoError(t, validate(epoch, map[string]interface{}{"k": "skip"}, vals), "Points filtered by WHERE clause should be valid")
+	assert.Equal(t, ErrPointTooOld, validate(epoch.Add(-2*time.Hour), dims, vals))
+	assert.Equal(t, ErrPointInFuture, validate(epoch.Add(time.Hour), dims, vals))
+	assert.Equal(t, ErrPointHasNoValues, validate(epoch, dims, nil))
+	assert.Equal(t, ErrPointHasNoValues, validate(epoch, dims, map[string]interface{}{"v": "not a number"}))
+	assert.Equal(t, ErrKeyTooLarge, validate(epoch, map[string]interface{}{"k": strings.Repeat("k", maxKeyLength)}, vals))
+	assert.Equal(t, ErrValueNotFinite, validate(epoch, dims, map[string]interface{}{"v": math.NaN()}))
+	assert.Equal(t, ErrValueNotFinite, validate(epoch, dims, map[string]interface{}{"v": []float64{1, math.Inf(1)}}))
+	assert.Error(t, db.ValidateInsert("unknown", &Point{TS: epoch, Dims: dims, Vals: vals}))
+
+	rejections, err := db.InsertBatch("validated", []*Point{{TS: epoch, Dims: dims, Vals: map[string]interface{}{"v": math.Inf(-1)}}})
+	if assert.NoError(t, err) && assert.Len(t, rejections, 1) {
+		assert.Equal(t, ErrValueNotFinite, rejections[0].Err, "InsertBatch should apply the same validation")
+	}
+
+	stats := db.TableStats("validated")
+	assert.EqualValues(t, 0, stats.InsertedPoints, "Validating should not insert anything")
+	assert.EqualValues(t, 0, stats.FilteredPoints, "Validating should not count filtered points")
+}
+
+func TestTryInsertBatch(t *testing.T) {
+	h := &hooks{}
+	blocked := make(chan interface{}, 1)
+	release := make(chan interface{})
+	h.flushRow = func(key bytemap.ByteMap) error {
+		select {
+		case blocked <- nil:
+		default:
+		}
+		<-release
+		return nil
+	}
+
+	db, cleanup := newTestDB(t, &DBOpts{hooks: h}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "shedding",
+		RetentionPeriod: 1 * time.Hour,
+		InsertQueueSize: 1,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	points := func(k string) []*Point {
+		return []*Point{{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": 1}}}
+	}
+	_, err = db.InsertBatch("shedding", points("a"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("shedding")
+
+	// Block processing of inserts with a flush
+	flushed := make(chan interface{})
+	go func() {
+		tbl.forceFlush()
+		close(flushed)
+	}()
+	<-blocked
+
+	_, err = db.TryInsertBatch("shedding", points("b"))
+	assert.NoError(t, err, "First batch should have been queued")
+	assert.EqualValues(t, 1, db.TableStats("shedding").InsertQueueDepth)
+	_, err = db.TryInsertBatch("shedding", points("c"))
+	assert.Equal(t, ErrInsertQueueFull, err, "Second batch should have been rejected")
+
+	close(release)
+	<-flushed
+	for i := 0; i < 100 && db.TableStats("shedding").InsertQueueDepth > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Zero(t, db.TableStats("shedding").InsertQueueDepth, "Queue should have drained")
+
+	keys := make(map[string]bool)
+	_, err = tbl.iterate(context.Background(), tbl.getFields(), true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		keys[key.Get("k").(string)] = true
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"a": true, "b": true}, keys, "Queued batch should have been applied and rejected batch dropped")
+}
+
+func TestMaxLateness(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "punctual",
+		RetentionPeriod: 1 * time.Hour,
+		MaxLateness:     10 * time.Minute,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	dims := map[string]interface{}{"k": "a"}
+	vals := map[string]interface{}{"v": 1}
+
+	assert.Equal(t, ErrPointTooLate, db.ValidateInsert("punctual", &Point{TS: epoch.Add(-20 * time.Minute), Dims: dims, Vals: vals}))
+	rejections, err := db.InsertBatch("punctual", []*Point{
+		{TS: epoch.Add(-5 * time.Minute), Dims: dims, Vals: vals},
+		{TS: epoch.Add(-20 * time.Minute), Dims: dims, Vals: vals},
+		{TS: epoch.Add(-2 * time.Hour), Dims: dims, Vals: vals},
+	})
+	if assert.NoError(t, err) && assert.Len(t, rejections, 2) {
+		assert.Equal(t, 1, rejections[0].Index)
+		assert.Equal(t, ErrPointTooLate, rejections[0].Err)
+		assert.Equal(t, ErrPointTooOld, rejections[1].Err, "Retention is checked before lateness")
+	}
+	stats := db.TableStats("punctual")
+	assert.EqualValues(t, 1, stats.InsertedPoints, "Point within MaxLateness should have been inserted")
+	assert.EqualValues(t, 1, stats.LatePoints)
+
+	// Points read from the WAL are dropped too
+	assert.NoError(t, db.Insert("inbound", epoch.Add(-20*time.Minute), dims, vals))
+	assert.NoError(t, db.Insert("inbound", epoch, dims, vals))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && db.TableStats("punctual").InsertedPoints < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats = db.TableStats("punctual")
+	assert.EqualValues(t, 2, stats.InsertedPoints)
+	assert.EqualValues(t, 2, stats.LatePoints, "Late point from WAL should have been counted")
+}
+
+func TestInterceptInsert(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "intercepted",
+		RetentionPeriod: 1 * time.Hour,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+		InterceptInsert: func(key bytemap.ByteMap, vals encoding.TSParams) (bytemap.ByteMap, encoding.TSParams, error) {
+			_, params := vals.TimeAndParams()
+			v, _ := params.Get("v")
+			if v > 100 {
+				return nil, nil, fmt.Errorf("%v is out of range", v)
+			}
+			dims := key.AsMap()
+			dims["size"] = "small"
+			if v > 10 {
+				dims["size"] = "large"
+			}
+			return bytemap.New(dims), vals, nil
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	point := func(k string, v float64) *Point {
+		return &Point{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": v}}
+	}
+	_, err = db.InsertBatch("intercepted", []*Point{point("a", 1), point("b", 20), point("c", 1000)})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Points read from the WAL are intercepted too
+	assert.NoError(t, db.Insert("inbound", epoch, map[string]interface{}{"k": "d"}, map[string]interface{}{"v": 2}))
+	assert.NoError(t, db.Insert("inbound", epoch, map[string]interface{}{"k": "e"}, map[string]interface{}{"v": 200}))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && db.TableStats("intercepted").RejectedPoints < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	tbl := db.getTable("intercepted")
+	tbl.forceFlush()
+	assert.EqualValues(t, 2, db.TableStats("intercepted").RejectedPoints, "Out of range points should have been rejected")
+
+	fields := tbl.getFields()
+	result := make(map[string]float64)
+	_, err = tbl.iterate(context.Background(), fields, true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		val, _ := vals[0].ValueAtTime(epoch, fields[0].Expr, tbl.Resolution)
+		result[fmt.Sprintf("%v/%v", key.Get("k"), key.Get("size"))] = val
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]float64{"a/small": 1, "b/large": 20, "d/small": 2}, result, "Accepted points should have been enriched")
+	}
+}
+
+func TestWALInsertLimits(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "limited", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("limited")
+	limits := &walInsertLimits{t: tbl}
+
+	first := limits.get(epoch)
+	assert.Equal(t, tbl.truncateBefore(), first.truncateBefore)
+	assert.True(t, first == limits.get(epoch.Add(500*time.Millisecond)), "Limits should be cached within resolution window")
+
+	db.clock.Advance(epoch.Add(2 * time.Second))
+	assert.True(t, first == limits.get(epoch), "Limits should be cached for points from an earlier window")
+	second := limits.get(epoch.Add(2 * time.Second))
+	assert.False(t, first == second, "Limits should be refreshed once window rolls over")
+	assert.Equal(t, tbl.truncateBefore(), second.truncateBefore)
+
+	db.clock.Advance(epoch.Add(2500 * time.Millisecond))
+	for i := 0; i < maxWALInsertLimitsUses-1; i++ {
+		assert.True(t, second == limits.get(epoch))
+	}
+	third := limits.get(epoch)
+	assert.False(t, second == third, "Limits should be refreshed after max uses")
+	assert.Equal(t, tbl.truncateBefore(), third.truncateBefore)
+}
+
+func BenchmarkWALInsertLimitsUncached(b *testing.B) {
+	benchmarkWALInsertLimits(b, func(tbl *table, ts time.Time) *insertLimits {
+		return tbl.newInsertLimits()
+	})
+}
+
+func BenchmarkWALInsertLimitsCached(b *testing.B) {
+	var limits *walInsertLimits
+	benchmarkWALInsertLimits(b, func(tbl *table, ts time.Time) *insertLimits {
+		if limits == nil {
+			limits = &walInsertLimits{t: tbl}
+		}
+		return limits.get(ts)
+	})
+}
+
+// benchmarkWALInsertLimits looks up the limits for b.N points using the given
+// function, with timestamps that advance by one resolution window every 100
+// points.
+func benchmarkWALInsertLimits(b *testing.B, limitsFor func(tbl *table, ts time.Time) *insertLimits) {
+	tmpDir, err := ioutil.TempDir("", "zenodbbench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := NewDB(&DBOpts{Dir: tmpDir})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	err = db.CreateTable(&TableOpts{
+		Name:            "bench",
+		RetentionPeriod: 1 * time.Hour,
+		MaxLateness:     10 * time.Minute,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	tbl := db.getTable("bench")
+
+	start := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ts := start.Add(time.Duration(i/100) * tbl.Resolution)
+		if limitsFor(tbl, ts) == nil {
+			b.Fatal("no limits")
+		}
+	}
+}
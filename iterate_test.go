@@ -0,0 +1,145 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterateCancellation(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "cancelled", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	insert := func(prefix string) {
+		var points []*Point
+		for i := 0; i < 100; i++ {
+			points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": fmt.Sprintf("%v%d", prefix, i)}, Vals: map[string]interface{}{"v": 1}})
+		}
+		_, err := db.InsertBatch("cancelled", points)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	tbl := db.getTable("cancelled")
+	insert("file")
+	tbl.forceFlush()
+	insert("mem")
+
+	cancelAfter := func(n int) (int, error) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		rows := 0
+		_, err := tbl.rowStore.iterate(ctx, tbl.getFields(), true, tbl.truncateBefore(), func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			rows++
+			if rows == n {
+				cancel()
+			}
+			return true, nil
+		})
+		return rows, err
+	}
+
+	rows, err := cancelAfter(5)
+	assert.Equal(t, context.Canceled, err, "Cancelling while scanning file store should stop iteration")
+	assert.Equal(t, 5, rows, "Scan should have stopped right after cancelling")
+
+	rows, err = cancelAfter(150)
+	assert.Equal(t, context.Canceled, err, "Cancelling while scanning memstore should stop iteration")
+	assert.Equal(t, 150, rows, "Scan should have stopped right after cancelling")
+
+	rows, err = cancelAfter(1000)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, rows, "Uncancelled scan should see all rows")
+}
+
+func TestDeterministicIteration(t *testing.T) {
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	iterateKeys := func(run int) []string {
+		db, cleanup := newTestDB(t, &DBOpts{Deterministic: true}, "ordered", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+		defer cleanup()
+		db.clock.Advance(epoch)
+		// insert in a different order on every run
+		for _, i := range rand.New(rand.NewSource(int64(run))).Perm(100) {
+			_, err := db.InsertBatch("ordered", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": fmt.Sprintf("%03d", i)}, Vals: map[string]interface{}{"v": 1}}})
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+		}
+		var keys []string
+		tbl := db.getTable("ordered")
+		_, err := tbl.iterate(context.Background(), tbl.getFields(), true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			keys = append(keys, key.Get("k").(string))
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return keys
+	}
+
+	expected := iterateKeys(0)
+	assert.Len(t, expected, 100)
+	assert.True(t, sort.StringsAreSorted(expected), "Memstore keys should be iterated in key order")
+	for run := 1; run < 5; run++ {
+		assert.Equal(t, expected, iterateKeys(run), "Iteration order should be the same on every run")
+	}
+}
+
+func TestIterateOnlyDecodesProjectedColumns(t *testing.T) {
+	h := &hooks{}
+	db, cleanup := newTestDB(t, &DBOpts{hooks: h}, "wide", "SELECT SUM(a) AS a, SUM(b) AS b, SUM(c) AS c FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	_, err := db.InsertBatch("wide", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"a": 1, "b": 2, "c": 3}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("wide")
+	tbl.forceFlush()
+
+	fileFields := tbl.getFields()
+	var projected core.Fields
+	for _, field := range fileFields {
+		if field.Name == "b" {
+			projected = append(projected, field)
+		}
+	}
+	if !assert.Len(t, projected, 1) {
+		return
+	}
+
+	var mx sync.Mutex
+	decoded := make(map[string]bool)
+	h.decodeColumn = func(column int) {
+		mx.Lock()
+		decoded[fileFields[column].Name] = true
+		mx.Unlock()
+	}
+
+	var values []float64
+	_, err = tbl.iterate(context.Background(), projected, false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		val, _ := vals[0].ValueAt(0, projected[0].Expr)
+		values = append(values, val)
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []float64{2}, values)
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, map[string]bool{"b": true}, decoded, "Only the requested column should have been decoded")
+}
@@ -0,0 +1,116 @@
+package zenodb
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterationCoalescing(t *testing.T) {
+	interval := 500 * time.Millisecond
+	db, cleanup := newTestDB(t, &DBOpts{IterationCoalesceInterval: interval}, "coalesced", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	_, err := db.InsertBatch("coalesced", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch, Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 2}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("coalesced")
+	tbl.forceFlush()
+
+	iterate := func(onRow func()) (int, error) {
+		rows := 0
+		_, err := tbl.iterate(context.Background(), nil, true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			rows++
+			onRow()
+			return true, nil
+		})
+		return rows, err
+	}
+
+	start := time.Now()
+	rows, err := iterate(func() {})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rows)
+	assert.True(t, time.Now().Sub(start) < interval/2, "Lone iteration should not have waited to coalesce")
+
+	// Block a scan so that the table is busy while more iterations arrive
+	started := make(chan interface{})
+	release := make(chan interface{})
+	var once sync.Once
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rows, err := iterate(func() {
+			once.Do(func() {
+				close(started)
+				<-release
+			})
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, rows)
+	}()
+	<-started
+
+	concurrent := 3
+	wg.Add(concurrent)
+	for i := 0; i < concurrent; i++ {
+		go func() {
+			defer wg.Done()
+			rows, err := iterate(func() {})
+			assert.NoError(t, err)
+			assert.Equal(t, 2, rows, "Each coalesced iteration should see all rows")
+		}()
+	}
+	time.Sleep(interval * 2)
+	close(release)
+	wg.Wait()
+
+	stats := db.TableStats("coalesced")
+	assert.EqualValues(t, 3, stats.Scans, "Iterations that arrived while table was busy should have shared a scan")
+	assert.EqualValues(t, concurrent-1, stats.CoalescedIterations)
+}
+
+func BenchmarkIterateConcurrentSingleClient(b *testing.B) {
+	benchmarkIterateConcurrent(b, 1)
+}
+
+func BenchmarkIterateConcurrentManyClients(b *testing.B) {
+	benchmarkIterateConcurrent(b, 20)
+}
+
+// benchmarkIterateConcurrent measures how long it takes for the given number
+// of clients to each iterate over the same table at the same time.
+func benchmarkIterateConcurrent(b *testing.B, clients int) {
+	tbl, cleanup := newManyFilesTable(b, &DBOpts{SortFlushes: true, IterationCoalesceInterval: 5 * time.Millisecond}, 10, 10000)
+	defer cleanup()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(clients)
+		for j := 0; j < clients; j++ {
+			go func() {
+				defer wg.Done()
+				_, err := tbl.iterate(context.Background(), nil, false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+					return true, nil
+				})
+				if err != nil {
+					b.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,151 @@
+package zenodb
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// KeyInfo describes how a single key is stored in a table.
+type KeyInfo struct {
+	// InMemStore indicates whether the key is in the table's memstore
+	InMemStore bool
+	// InFileStore indicates whether the key is in the table's current file store
+	InFileStore bool
+	// FileStore is the name of the file store that was searched for the key
+	FileStore string
+	// Fields contains information about each of the table's fields for this key
+	Fields []*KeyFieldInfo
+	// EarliestPeriod is the earliest period for which any field has a value
+	EarliestPeriod time.Time
+	// LatestPeriod is the latest period for which any field has a value
+	LatestPeriod time.Time
+	// TotalBytes is the total size of the key and all of its sequences in the
+	// memstore and file store
+	TotalBytes int
+}
+
+// KeyFieldInfo describes how a single field is stored for a key.
+type KeyFieldInfo struct {
+	Name string
+	// MemStoreLength is the length in bytes of the field's sequence in the
+	// memstore
+	MemStoreLength int
+	// FileStoreLength is the length in bytes of the field's (decoded) sequence
+	// in the file store
+	FileStoreLength int
+	// EarliestPeriod is the earliest period for which the field has a value
+	EarliestPeriod time.Time
+	// LatestPeriod is the latest period for which the field has a value
+	LatestPeriod time.Time
+}
+
+// KeyDiagnostics reports on the storage of the given key in the named table.
+// See table.KeyDiagnostics.
+func (db *DB) KeyDiagnostics(table string, key bytemap.ByteMap) (*KeyInfo, error) {
+	t := db.getTable(table)
+	if t == nil {
+		return nil, errors.New("Table %v not found", table)
+	}
+	return t.KeyDiagnostics(key)
+}
+
+// KeyDiagnostics reports on where and how the given key is stored in this
+// table. This is meant for debugging and scans the table's file store, so it
+// can be slow on large tables.
+func (t *table) KeyDiagnostics(key bytemap.ByteMap) (*KeyInfo, error) {
+	if t.rowStore == nil {
+		return nil, errors.New("Table %v does not store data locally", t.Name)
+	}
+	return t.rowStore.keyDiagnostics(key)
+}
+
+func (rs *rowStore) keyDiagnostics(key bytemap.ByteMap) (*KeyInfo, error) {
+	rs.mx.RLock()
+	fs := rs.fileStore
+	msFields := rs.memStore.fields
+	msColumns := rs.memStore.get(key)
+	rs.mx.RUnlock()
+	rs.mx.Lock()
+	rs.iterationsInProgress[fs.filename]++
+	rs.mx.Unlock()
+	defer func() {
+		rs.mx.Lock()
+		rs.iterationsInProgress[fs.filename]--
+		rs.mx.Unlock()
+	}()
+
+	fields := rs.t.getFields()
+	info := &KeyInfo{
+		InMemStore: msColumns != nil,
+		FileStore:  fs.filename,
+		Fields:     make([]*KeyFieldInfo, 0, len(fields)),
+	}
+
+	var fileColumns []encoding.Sequence
+	_, err := fs.iterate(fields, nil, false, false, rs.t.truncateBefore(), func(rowKey bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		if !bytes.Equal(rowKey, key) {
+			return true, nil
+		}
+		info.InFileStore = true
+		fileColumns = columns
+		return false, nil
+	})
+	if err != nil {
+		return nil, errors.New("Unable to search file store %v for key: %v", fs.filename, err)
+	}
+
+	if info.InMemStore || info.InFileStore {
+		info.TotalBytes += len(key)
+	}
+	for i, field := range fields {
+		fi := &KeyFieldInfo{Name: field.Name}
+		info.Fields = append(info.Fields, fi)
+		if i < len(fileColumns) {
+			fi.FileStoreLength = len(fileColumns[i])
+			rs.t.populatedRange(fi, field, fileColumns[i])
+		}
+		for j, msField := range msFields {
+			if j < len(msColumns) && msField.Equals(field) {
+				fi.MemStoreLength = len(msColumns[j])
+				rs.t.populatedRange(fi, field, msColumns[j])
+			}
+		}
+		info.TotalBytes += fi.MemStoreLength + fi.FileStoreLength
+		if !fi.EarliestPeriod.IsZero() && (info.EarliestPeriod.IsZero() || fi.EarliestPeriod.Before(info.EarliestPeriod)) {
+			info.EarliestPeriod = fi.EarliestPeriod
+		}
+		if fi.LatestPeriod.After(info.LatestPeriod) {
+			info.LatestPeriod = fi.LatestPeriod
+		}
+	}
+
+	return info, nil
+}
+
+// populatedRange widens the earliest and latest periods of fi to include the
+// populated periods in seq.
+func (t *table) populatedRange(fi *KeyFieldInfo, field core.Field, seq encoding.Sequence) {
+	if len(seq) == 0 {
+		return
+	}
+	e := field.Expr
+	until := seq.Until()
+	numPeriods := seq.NumPeriods(e.EncodedWidth())
+	for p := 0; p < numPeriods; p++ {
+		if _, found := seq.ValueAt(p, e); !found {
+			continue
+		}
+		ts := until.Add(-1 * time.Duration(p) * t.Resolution)
+		if fi.EarliestPeriod.IsZero() || ts.Before(fi.EarliestPeriod) {
+			fi.EarliestPeriod = ts
+		}
+		if ts.After(fi.LatestPeriod) {
+			fi.LatestPeriod = ts
+		}
+	}
+}
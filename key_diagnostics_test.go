@@ -0,0 +1,88 @@
+package zenodb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyDiagnostics(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "diagnosed", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	resolution := time.Second
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	insert := func(k string, ts time.Time) {
+		_, err := db.InsertBatch("diagnosed", []*Point{{TS: ts, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": 1}}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	key := func(k string) bytemap.ByteMap {
+		return bytemap.New(map[string]interface{}{"k": k})
+	}
+	diagnose := func(k string) *KeyInfo {
+		info, err := db.KeyDiagnostics("diagnosed", key(k))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return info
+	}
+	fieldInfo := func(info *KeyInfo) *KeyFieldInfo {
+		for _, fi := range info.Fields {
+			if fi.Name == "v" {
+				return fi
+			}
+		}
+		t.Fatal("Field v not found")
+		return nil
+	}
+
+	insert("disk", epoch.Add(-2*resolution))
+	insert("both", epoch.Add(-3*resolution))
+	db.getTable("diagnosed").forceFlush()
+	insert("mem", epoch)
+	insert("both", epoch)
+
+	info := diagnose("mem")
+	assert.True(t, info.InMemStore)
+	assert.False(t, info.InFileStore)
+	fi := fieldInfo(info)
+	assert.True(t, fi.MemStoreLength > 0)
+	assert.Zero(t, fi.FileStoreLength)
+	assert.Equal(t, epoch, info.EarliestPeriod)
+	assert.Equal(t, epoch, info.LatestPeriod)
+	assert.True(t, info.TotalBytes > fi.MemStoreLength, "Total bytes should include key")
+
+	info = diagnose("disk")
+	assert.False(t, info.InMemStore)
+	assert.True(t, info.InFileStore)
+	assert.NotEmpty(t, info.FileStore)
+	fi = fieldInfo(info)
+	assert.Zero(t, fi.MemStoreLength)
+	assert.True(t, fi.FileStoreLength > 0)
+	assert.Equal(t, epoch.Add(-2*resolution), info.EarliestPeriod)
+	assert.Equal(t, epoch.Add(-2*resolution), info.LatestPeriod)
+
+	info = diagnose("both")
+	assert.True(t, info.InMemStore)
+	assert.True(t, info.InFileStore)
+	fi = fieldInfo(info)
+	assert.True(t, fi.MemStoreLength > 0)
+	assert.True(t, fi.FileStoreLength > 0)
+	assert.Equal(t, epoch.Add(-3*resolution), info.EarliestPeriod)
+	assert.Equal(t, epoch, info.LatestPeriod)
+	assert.True(t, info.TotalBytes > fi.MemStoreLength+fi.FileStoreLength, "Total bytes should include both locations")
+
+	info = diagnose("missing")
+	assert.False(t, info.InMemStore)
+	assert.False(t, info.InFileStore)
+	assert.Zero(t, info.TotalBytes)
+	assert.True(t, info.EarliestPeriod.IsZero())
+
+	_, err := db.KeyDiagnostics("unknown", key("mem"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,200 @@
+package zenodb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// Starting with FileVersion_11, the keys of rows in file stores are
+// dictionary encoded. Each distinct dimension (name and value) is stored once
+// in a dictionary in the file footer (see fileFooter):
+//
+//	numEntries|entry1|entry2|...|lastentry
+//
+// numEntries is 32 bits
+// each entry is entryLength|entry
+// entryLength is 16 bits
+// entry is a ByteMap containing just the one dimension
+//
+// Row keys then consist of a 1 byte encoding followed by either the plain key
+// (keyLiteral) or a uvarint reference into the dictionary for each dimension
+// (keyReferences). Keys that don't survive the round trip through the
+// dictionary exactly are stored literally. Rows are only encoded on their way
+// into the file, everything else (sorting, checksums, the key index and bloom
+// filter) deals with plain keys.
+const (
+	keyLiteral    = 0
+	keyReferences = 1
+
+	// maxKeyDictionaryEntries caps the size of dictionaries, dimensions that
+	// don't fit are stored literally
+	maxKeyDictionaryEntries = 1 << 20
+)
+
+type keyDictionaryEntry struct {
+	name  string
+	value interface{}
+}
+
+// keyDictionary is the dictionary of dimensions for a file store. Writers
+// build it up with encode, readers only use decode, which is safe for
+// concurrent use.
+type keyDictionary struct {
+	encoded [][]byte
+	entries []keyDictionaryEntry
+	ids     map[string]int
+}
+
+func newKeyDictionary() *keyDictionary {
+	return &keyDictionary{ids: make(map[string]int)}
+}
+
+// encode encodes the given plain key, adding any new dimensions to the
+// dictionary.
+func (d *keyDictionary) encode(key []byte) []byte {
+	encoded := []byte{keyReferences}
+	ok := true
+	bytemap.ByteMap(key).IterateValues(func(name string, value interface{}) bool {
+		entry := bytemap.FromSortedKeysAndValues([]string{name}, []interface{}{value})
+		id, found := d.ids[string(entry)]
+		if !found {
+			if len(d.entries) >= maxKeyDictionaryEntries || len(entry) > math.MaxUint16 {
+				ok = false
+				return false
+			}
+			id = len(d.entries)
+			d.ids[string(entry)] = id
+			d.encoded = append(d.encoded, entry)
+			d.entries = append(d.entries, keyDictionaryEntry{name, value})
+		}
+		encoded = encoding.AppendUvarint(encoded, uint64(id))
+		return true
+	})
+	if ok {
+		decoded, err := d.decode(encoded)
+		if err == nil && bytes.Equal(decoded, key) {
+			return encoded
+		}
+	}
+	return append([]byte{keyLiteral}, key...)
+}
+
+// decode decodes an encoded key back into the plain key.
+func (d *keyDictionary) decode(encoded []byte) ([]byte, error) {
+	if len(encoded) == 0 {
+		return nil, errors.New("Encoded key is empty")
+	}
+	switch encoded[0] {
+	case keyLiteral:
+		return encoded[1:], nil
+	case keyReferences:
+		refs := encoded[1:]
+		names := make([]string, 0, 8)
+		values := make([]interface{}, 0, 8)
+		for len(refs) > 0 {
+			id, n := binary.Uvarint(refs)
+			if n <= 0 || id >= uint64(len(d.entries)) {
+				return nil, errors.New("Invalid reference to key dictionary")
+			}
+			refs = refs[n:]
+			entry := d.entries[id]
+			names = append(names, entry.name)
+			values = append(values, entry.value)
+		}
+		// References are in the order in which the dimensions appear in the
+		// original key, which is sorted by name
+		return bytemap.FromSortedKeysAndValues(names, values), nil
+	default:
+		return nil, errors.New("Unknown key encoding %d", encoded[0])
+	}
+}
+
+// expandRow replaces the encoded key in the given raw row with the plain key,
+// adjusting the row length to match.
+func (d *keyDictionary) expandRow(raw []byte) ([]byte, error) {
+	prefixLength := encoding.Width64bits + encoding.Width16bits
+	if len(raw) < prefixLength {
+		return nil, errors.New("Row of length %d is too short to contain key", len(raw))
+	}
+	keyLength := int(encoding.Binary.Uint16(raw[encoding.Width64bits:]))
+	if len(raw) < prefixLength+keyLength {
+		return nil, errors.New("Row of length %d is too short to contain key of length %d", len(raw), keyLength)
+	}
+	key, err := d.decode(raw[prefixLength : prefixLength+keyLength])
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > math.MaxUint16 {
+		return nil, errors.New("Decoded key of length %d is too long", len(key))
+	}
+	rest := raw[prefixLength+keyLength:]
+	expanded := make([]byte, prefixLength+len(key)+len(rest))
+	encoding.Binary.PutUint64(expanded, uint64(len(expanded)))
+	encoding.Binary.PutUint16(expanded[encoding.Width64bits:], uint16(len(key)))
+	copy(expanded[prefixLength:], key)
+	copy(expanded[prefixLength+len(key):], rest)
+	return expanded, nil
+}
+
+// encodedLength returns the number of bytes that the encoded dictionary takes
+// up in the footer.
+func (d *keyDictionary) encodedLength() int {
+	length := encoding.Width32bits
+	if d != nil {
+		for _, entry := range d.encoded {
+			length += encoding.Width16bits + len(entry)
+		}
+	}
+	return length
+}
+
+func (d *keyDictionary) appendTo(b []byte) []byte {
+	if d == nil {
+		return appendUint32(b, 0)
+	}
+	b = appendUint32(b, uint32(len(d.encoded)))
+	for _, entry := range d.encoded {
+		b = appendUint16(b, uint16(len(entry)))
+		b = append(b, entry...)
+	}
+	return b
+}
+
+// readKeyDictionary reads an encoded keyDictionary from b, returning the
+// remainder of b.
+func readKeyDictionary(b []byte, filename string) (*keyDictionary, []byte, error) {
+	if len(b) < encoding.Width32bits {
+		return nil, nil, errors.New("Key dictionary in %v is truncated", filename)
+	}
+	numEntries := int(encoding.Binary.Uint32(b))
+	b = b[encoding.Width32bits:]
+	d := &keyDictionary{}
+	for i := 0; i < numEntries; i++ {
+		if len(b) < encoding.Width16bits {
+			return nil, nil, errors.New("Key dictionary in %v is truncated at entry %d", filename, i)
+		}
+		entryLength := int(encoding.Binary.Uint16(b))
+		b = b[encoding.Width16bits:]
+		if len(b) < entryLength {
+			return nil, nil, errors.New("Key dictionary in %v is truncated at entry %d", filename, i)
+		}
+		entry := b[:entryLength]
+		b = b[entryLength:]
+		found := false
+		bytemap.ByteMap(entry).IterateValues(func(name string, value interface{}) bool {
+			d.entries = append(d.entries, keyDictionaryEntry{name, value})
+			found = true
+			return false
+		})
+		if !found {
+			return nil, nil, errors.New("Key dictionary in %v has empty entry %d", filename, i)
+		}
+		d.encoded = append(d.encoded, entry)
+	}
+	return d, b, nil
+}
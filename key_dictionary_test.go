@@ -0,0 +1,101 @@
+package zenodb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyDictionary(t *testing.T) {
+	d := newKeyDictionary()
+	keys := []bytemap.ByteMap{
+		bytemap.New(map[string]interface{}{"a": "x", "b": 1}),
+		bytemap.New(map[string]interface{}{"a": "x", "b": 2}),
+		bytemap.New(map[string]interface{}{"a": "y", "c": true}),
+	}
+	var encoded [][]byte
+	for _, key := range keys {
+		encodedKey := d.encode(key)
+		assert.EqualValues(t, keyReferences, encodedKey[0], "Key should be encoded with references")
+		encoded = append(encoded, encodedKey)
+	}
+	assert.Len(t, d.entries, 5, "Each distinct dimension should be stored once")
+
+	decodedDictionary, remain, err := readKeyDictionary(d.appendTo(nil), "test")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, remain)
+	for i, key := range keys {
+		decoded, err := decodedDictionary.decode(encoded[i])
+		if assert.NoError(t, err) {
+			assert.Equal(t, []byte(key), decoded)
+		}
+	}
+
+	_, err = decodedDictionary.decode([]byte{keyReferences, 100})
+	assert.Error(t, err, "Reference beyond end of dictionary should fail")
+	_, err = decodedDictionary.decode([]byte{2})
+	assert.Error(t, err, "Unknown encoding should fail")
+	decoded, err := decodedDictionary.decode(append([]byte{keyLiteral}, "literal"...))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "literal", string(decoded))
+	}
+}
+
+func TestKeyDictionaryReducesFileSize(t *testing.T) {
+	var rows []byte
+	for i := 0; i < 1000; i++ {
+		key := bytemap.New(map[string]interface{}{
+			"country": fmt.Sprintf("a country with a rather long name %d", i%10),
+			"device":  fmt.Sprintf("some kind of device %d", i%5),
+			"id":      i % 100,
+		})
+		row := make([]byte, encoding.Width64bits+encoding.Width16bits)
+		row = append(row, key...)
+		row = append(row, "rest of row"...)
+		encoding.Binary.PutUint64(row, uint64(len(row)))
+		encoding.Binary.PutUint16(row[encoding.Width64bits:], uint16(len(key)))
+		rows = append(rows, row...)
+	}
+
+	write := func(fileVersion int) []byte {
+		buf := &bytes.Buffer{}
+		buf.Write(make([]byte, fileHeaderLength))
+		iw := newIndexingWriter(buf, UncompressedFileCodec, fileVersion, fileHeaderLength, 0, -1)
+		iw.startRows()
+		_, err := iw.Write(rows)
+		if !assert.NoError(t, err) || !assert.NoError(t, iw.Close()) {
+			t.FailNow()
+		}
+		return buf.Bytes()
+	}
+	plain := write(FileVersion_10)
+	encoded := write(FileVersion_11)
+	assert.True(t, len(encoded) < len(plain)/2, "Dictionary encoding should at least halve file size, plain: %d encoded: %d", len(plain), len(encoded))
+
+	footer, err := readFileFooter(bytes.NewReader(encoded), "test", FileVersion_11)
+	if !assert.NoError(t, err) || !assert.NotNil(t, footer.dictionary) {
+		return
+	}
+	assert.Len(t, footer.dictionary.entries, 10+5+100)
+	fs := &fileStore{filename: "test"}
+	r := &countingReader{r: bytes.NewReader(encoded[fileHeaderLength:footer.dataEnd]), dictionary: footer.dictionary}
+	var read []byte
+	for {
+		raw, _, err := fs.readRow(r, nil, false, false)
+		if err == io.EOF {
+			break
+		}
+		if !assert.NoError(t, err) {
+			return
+		}
+		read = append(read, raw...)
+	}
+	assert.Equal(t, rows, read, "Rows should read back with their original keys")
+}
@@ -0,0 +1,39 @@
+package zenodb
+
+import (
+	"bytes"
+)
+
+// keyOrder is the order in which the rows of sorted file stores are sorted by
+// key. Starting with FileVersion_12, it's recorded in the file footer (see
+// fileFooter). Older files are always in ascending order.
+type keyOrder byte
+
+const (
+	keyOrderAscending  keyOrder = 0
+	keyOrderDescending keyOrder = 1
+)
+
+// compare compares a and b like bytes.Compare, except that in descending order
+// keys that are greater come first.
+func (o keyOrder) compare(a []byte, b []byte) int {
+	if o == keyOrderDescending {
+		return bytes.Compare(b, a)
+	}
+	return bytes.Compare(a, b)
+}
+
+func (o keyOrder) String() string {
+	if o == keyOrderDescending {
+		return "descending"
+	}
+	return "ascending"
+}
+
+// keyOrder returns the order in which this file store sorts new files.
+func (fs *fileStore) keyOrder() keyOrder {
+	if fs.rs == nil {
+		return keyOrderAscending
+	}
+	return fs.rs.opts.keyOrder
+}
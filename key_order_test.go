@@ -0,0 +1,54 @@
+package zenodb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMixedKeyOrderRejected(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	open := func(descending bool) (*DB, error) {
+		db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true, SortFlushes: true})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		db.clock.Advance(epoch)
+		return db, db.CreateTable(&TableOpts{
+			Name:            "ordered",
+			RetentionPeriod: 1 * time.Hour,
+			DescendingKeys:  descending,
+			SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+		})
+	}
+
+	db, err := open(true)
+	if !assert.NoError(t, err) {
+		db.Close()
+		return
+	}
+	_, err = db.InsertBatch("ordered", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch, Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 2}},
+	})
+	assert.NoError(t, err)
+	db.getTable("ordered").forceFlush()
+	db.Close()
+
+	db, err = open(false)
+	assert.Error(t, err, "Opening descending files in ascending order should fail")
+	db.Close()
+
+	db, err = open(true)
+	assert.NoError(t, err, "Opening descending files in descending order should work")
+	db.Close()
+}
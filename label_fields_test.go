@@ -0,0 +1,61 @@
+package zenodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelFields(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "labels", "SELECT LAST(status) AS status, FIRST(status) AS first_status, SUM(v) AS v FROM inbound GROUP BY k, period(1m)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	db.clock.Advance(epoch)
+	insert := func(age time.Duration, status string) {
+		_, err := db.InsertBatch("labels", []*Point{{TS: epoch.Add(-age), Dims: map[string]interface{}{"k": "a", "status": status}, Vals: map[string]interface{}{"v": 1}}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	tbl := db.getTable("labels")
+	fields := tbl.getFields()[1:]
+	labels := func() (string, string) {
+		var last, first string
+		_, err := tbl.iterate(context.Background(), fields, true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			last, _ = vals[0].LabelAtTime(epoch, fields[0].Expr, tbl.Resolution)
+			first, _ = vals[1].LabelAtTime(epoch, fields[1].Expr, tbl.Resolution)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return last, first
+	}
+
+	insert(30*time.Second, "up")
+	insert(50*time.Second, "booting")
+	last, first := labels()
+	assert.Equal(t, "up", last)
+	assert.Equal(t, "booting", first)
+
+	tbl.forceFlush()
+	// Merged with what's on disk by time rather than by arrival
+	insert(40*time.Second, "degraded")
+	last, first = labels()
+	assert.Equal(t, "up", last)
+	assert.Equal(t, "booting", first)
+
+	insert(10*time.Second, "down")
+	insert(55*time.Second, "")
+	last, first = labels()
+	assert.Equal(t, "down", last)
+	assert.Equal(t, "booting", first, "Empty values should be ignored")
+
+	tbl.forceFlush()
+	last, first = labels()
+	assert.Equal(t, "down", last)
+	assert.Equal(t, "booting", first)
+}
@@ -0,0 +1,228 @@
+package zenodb
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/bytetree"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// memstore holds recently inserted data in memory until it's flushed to a
+// file store. Keys are spread across several shards, each with its own lock,
+// so that inserts to different keys can be applied in parallel.
+type memstore struct {
+	// earliest and latest are the unix nano timestamps of the earliest and
+	// latest points in the memstore, accessed atomically. 0 means unset.
+	earliest        int64
+	latest          int64
+	fields          core.Fields
+	shards          []*memstoreShard
+	offsetsBySource common.OffsetsBySource
+	offsetChanged   bool
+}
+
+type memstoreShard struct {
+	mx   sync.Mutex
+	tree *bytetree.Tree
+}
+
+// newMemstore creates a memstore with one shard per available CPU, reserving
+// space for capacity keys in total.
+func newMemstore(fields core.Fields, resolution time.Duration, capacity int, offsetsBySource common.OffsetsBySource) *memstore {
+	numShards := runtime.GOMAXPROCS(0)
+	ms := &memstore{fields: fields, shards: make([]*memstoreShard, 0, numShards), offsetsBySource: offsetsBySource}
+	for i := 0; i < numShards; i++ {
+		tree := bytetree.New(fields.Exprs(), nil, resolution, 0, time.Time{}, time.Time{}, 0)
+		tree.Reserve(capacity / numShards)
+		ms.shards = append(ms.shards, &memstoreShard{tree: tree})
+	}
+	return ms
+}
+
+// shardFor returns the shard for the given key.
+func (ms *memstore) shardFor(key []byte) *memstoreShard {
+	return ms.shards[ms.shardIdxFor(key)]
+}
+
+// shardIdxFor returns the index of the shard for the given key, based on its
+// FNV-1a hash.
+func (ms *memstore) shardIdxFor(key []byte) int {
+	hash := uint32(2166136261)
+	for _, b := range key {
+		hash ^= uint32(b)
+		hash *= 16777619
+	}
+	return int(hash % uint32(len(ms.shards)))
+}
+
+func (ms *memstore) update(key bytemap.ByteMap, params encoding.TSParams, metadata bytemap.ByteMap) {
+	shard := ms.shardFor(key)
+	shard.mx.Lock()
+	shard.tree.Update(key, nil, params, metadata)
+	shard.mx.Unlock()
+	ms.recordTime(params.TimeInt())
+}
+
+// updateBatch applies the given inserts, locking each shard only once. Inserts
+// without a key are ignored. It returns the timestamp of the latest insert, or
+// 0 if nothing was applied.
+func (ms *memstore) updateBatch(inserts []*insert) int64 {
+	byShard := make([][]*insert, len(ms.shards))
+	var earliest, latest int64
+	for _, insert := range inserts {
+		if insert.key == nil {
+			continue
+		}
+		idx := ms.shardIdxFor(insert.key)
+		byShard[idx] = append(byShard[idx], insert)
+		ts := insert.vals.TimeInt()
+		if earliest == 0 || ts < earliest {
+			earliest = ts
+		}
+		if ts > latest {
+			latest = ts
+		}
+	}
+	if latest == 0 {
+		return 0
+	}
+
+	for i, shardInserts := range byShard {
+		if len(shardInserts) == 0 {
+			continue
+		}
+		shard := ms.shards[i]
+		shard.mx.Lock()
+		for _, insert := range shardInserts {
+			shard.tree.Update(insert.key, nil, insert.vals, insert.metadata)
+		}
+		shard.mx.Unlock()
+	}
+	ms.recordTime(earliest)
+	ms.recordTime(latest)
+	return latest
+}
+
+func (ms *memstore) recordTime(ts int64) {
+	for {
+		earliest := atomic.LoadInt64(&ms.earliest)
+		if (earliest != 0 && earliest <= ts) || atomic.CompareAndSwapInt64(&ms.earliest, earliest, ts) {
+			break
+		}
+	}
+	for {
+		latest := atomic.LoadInt64(&ms.latest)
+		if latest >= ts || atomic.CompareAndSwapInt64(&ms.latest, latest, ts) {
+			break
+		}
+	}
+}
+
+// timeRange returns the timestamps of the earliest and latest points in the
+// memstore. ok is false if nothing has been inserted.
+func (ms *memstore) timeRange() (earliest time.Time, latest time.Time, ok bool) {
+	_earliest := atomic.LoadInt64(&ms.earliest)
+	if _earliest == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+	return time.Unix(0, _earliest), time.Unix(0, atomic.LoadInt64(&ms.latest)), true
+}
+
+// get returns copies of the columns for the given key, since the memstore may
+// continue to update the originals.
+func (ms *memstore) get(key []byte) []encoding.Sequence {
+	shard := ms.shardFor(key)
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	var columns []encoding.Sequence
+	for _, seq := range shard.tree.Get(key) {
+		columns = append(columns, append(encoding.Sequence(nil), seq...))
+	}
+	return columns
+}
+
+func (ms *memstore) remove(ctx int64, key []byte) []encoding.Sequence {
+	shard := ms.shardFor(key)
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	return shard.tree.Remove(ctx, key)
+}
+
+// delete permanently deletes the given key, see bytetree.Tree.Delete.
+func (ms *memstore) delete(key []byte) bool {
+	shard := ms.shardFor(key)
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	return shard.tree.Delete(key)
+}
+
+// walk walks all of the shards in turn, see bytetree.Tree.Walk. Keys are only
+// in order within each shard, not across shards, so callers that need keys in
+// order (i.e. sorted flushes) have to sort them themselves.
+func (ms *memstore) walk(ctx int64, fn func(key []byte, data []encoding.Sequence) (more bool, keep bool, err error)) error {
+	for _, shard := range ms.shards {
+		more := true
+		shard.mx.Lock()
+		err := shard.tree.Walk(ctx, func(key []byte, data []encoding.Sequence) (keepWalking bool, keep bool, err error) {
+			keepWalking, keep, err = fn(key, data)
+			more = keepWalking
+			return
+		})
+		shard.mx.Unlock()
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// length returns the number of keys in the memstore.
+func (ms *memstore) length() int {
+	length := 0
+	for _, shard := range ms.shards {
+		shard.mx.Lock()
+		length += shard.tree.Length()
+		shard.mx.Unlock()
+	}
+	return length
+}
+
+// bytes returns the memory used by the memstore. Each shard is locked while
+// reading its size, so this is safe to call while inserts are being applied,
+// although the total may not reflect a single point in time.
+func (ms *memstore) bytes() int {
+	bytes := 0
+	for _, shard := range ms.shards {
+		shard.mx.Lock()
+		bytes += shard.tree.Bytes()
+		shard.mx.Unlock()
+	}
+	return bytes
+}
+
+func (ms *memstore) copy() *memstore {
+	copyOfOffsets := make(common.OffsetsBySource)
+	for source, offset := range ms.offsetsBySource {
+		copyOfOffsets[source] = offset
+	}
+	shards := make([]*memstoreShard, 0, len(ms.shards))
+	for _, shard := range ms.shards {
+		shard.mx.Lock()
+		shards = append(shards, &memstoreShard{tree: shard.tree.Copy()})
+		shard.mx.Unlock()
+	}
+	return &memstore{
+		earliest:        atomic.LoadInt64(&ms.earliest),
+		latest:          atomic.LoadInt64(&ms.latest),
+		fields:          ms.fields,
+		shards:          shards,
+		offsetsBySource: copyOfOffsets,
+		offsetChanged:   ms.offsetChanged,
+	}
+}
@@ -0,0 +1,223 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelInsertBatch(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "parallel", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("parallel")
+
+	const numInserters = 8
+	const numBatches = 50
+	var wg sync.WaitGroup
+	wg.Add(numInserters)
+	for i := 0; i < numInserters; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < numBatches; j++ {
+				_, err := db.InsertBatch("parallel", []*Point{
+					{TS: epoch, Dims: map[string]interface{}{"k": fmt.Sprintf("k%d", i)}, Vals: map[string]interface{}{"v": 1}},
+					{TS: epoch, Dims: map[string]interface{}{"k": "shared"}, Vals: map[string]interface{}{"v": 1}},
+				})
+				assert.NoError(t, err)
+				if j == numBatches/2 {
+					// Flush concurrently with inserts
+					tbl.forceFlush()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	field := tbl.getFields()[0]
+	totals := make(map[string]float64)
+	_, err := tbl.iterate(context.Background(), tbl.getFields(), true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		val, _ := vals[0].ValueAtTime(epoch, field.Expr, tbl.Resolution)
+		totals[key.Get("k").(string)] += val
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i := 0; i < numInserters; i++ {
+		assert.EqualValues(t, numBatches, totals[fmt.Sprintf("k%d", i)])
+	}
+	assert.EqualValues(t, numInserters*numBatches, totals["shared"], "No inserts to shared key should have been lost")
+}
+
+func BenchmarkParallelInsertBatch(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "zenodbbench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// Sync the batch log in the background so that fsyncs don't drown out
+	// contention on the memstore
+	db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true, WALSyncInterval: time.Second})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	err = db.CreateTable(&TableOpts{
+		Name:            "bench",
+		RetentionPeriod: 1 * time.Hour,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	var inserter int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		prefix := atomic.AddInt64(&inserter, 1)
+		i := 0
+		for pb.Next() {
+			_, err := db.InsertBatch("bench", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": fmt.Sprintf("%d_%d", prefix, i%1000)}, Vals: map[string]interface{}{"v": 1}}})
+			if err != nil {
+				// Fatal must only be called from the benchmark's own goroutine
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+func TestMemstoreUpdateBatch(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "batched", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	tbl := db.getTable("batched")
+	single := tbl.rowStore.newMemStore(nil)
+	batched := tbl.rowStore.newMemStore(nil)
+
+	inserts := make([]*insert, 0, 100)
+	for i := 0; i < cap(inserts); i++ {
+		key := bytemap.New(map[string]interface{}{"k": i % 10})
+		ts := epoch.Add(time.Duration(i%3) * time.Second)
+		inserts = append(inserts, &insert{key: key, vals: encoding.NewTSParams(ts, bytemap.NewFloat(map[string]float64{"v": float64(i)}))})
+	}
+	// Inserts without keys are ignored
+	inserts = append(inserts, &insert{})
+
+	for _, insert := range inserts[:len(inserts)-1] {
+		single.update(insert.key, insert.vals, insert.metadata)
+	}
+	latest := batched.updateBatch(inserts)
+	assert.Equal(t, epoch.Add(2*time.Second).UnixNano(), latest)
+	assert.Equal(t, single.length(), batched.length())
+
+	field := tbl.getFields()[0]
+	for i := 0; i < 10; i++ {
+		key := bytemap.New(map[string]interface{}{"k": i})
+		expected := single.get(key)
+		actual := batched.get(key)
+		if assert.Len(t, actual, len(expected)) {
+			for j := 0; j < 3; j++ {
+				ts := epoch.Add(time.Duration(j) * time.Second)
+				expectedVal, _ := expected[0].ValueAtTime(ts, field.Expr, tbl.Resolution)
+				actualVal, _ := actual[0].ValueAtTime(ts, field.Expr, tbl.Resolution)
+				assert.Equal(t, expectedVal, actualVal)
+			}
+		}
+	}
+
+	singleEarliest, singleLatest, _ := single.timeRange()
+	batchedEarliest, batchedLatest, ok := batched.timeRange()
+	assert.True(t, ok)
+	assert.Equal(t, singleEarliest, batchedEarliest)
+	assert.Equal(t, singleLatest, batchedLatest)
+
+	assert.EqualValues(t, 0, batched.updateBatch([]*insert{{}}), "Batch without keys shouldn't apply anything")
+}
+
+func BenchmarkInsertSingle(b *testing.B) {
+	benchmarkInsert(b, func(rs *rowStore, inserts []*insert) {
+		for _, insert := range inserts {
+			rs.insert(insert)
+		}
+		last := inserts[len(inserts)-1].sequence
+		for !rs.hasApplied(last) {
+			time.Sleep(10 * time.Microsecond)
+		}
+	})
+}
+
+func BenchmarkInsertBatch(b *testing.B) {
+	benchmarkInsert(b, func(rs *rowStore, inserts []*insert) {
+		if err := rs.insertBatch(inserts); err != nil {
+			b.Fatal(err)
+		}
+	})
+}
+
+// benchmarkInsert applies b.N inserts in batches of 1000 using the given insert
+// function, which must not return until the inserts have been applied.
+func benchmarkInsert(b *testing.B, doInsert func(rs *rowStore, inserts []*insert)) {
+	const batchSize = 1000
+
+	tmpDir, err := ioutil.TempDir("", "zenodbbench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	err = db.CreateTable(&TableOpts{
+		Name:            "bench",
+		RetentionPeriod: 1 * time.Hour,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	rs := db.getTable("bench").rowStore
+	offset := wal.NewOffsetForTS(epoch)
+	vals := encoding.NewTSParams(epoch, bytemap.NewFloat(map[string]float64{"v": 1}))
+	keys := make([]bytemap.ByteMap, batchSize)
+	for i := range keys {
+		keys[i] = bytemap.New(map[string]interface{}{"k": i})
+	}
+
+	b.ResetTimer()
+	sequence := int64(0)
+	for remaining := b.N; remaining > 0; remaining -= batchSize {
+		n := batchSize
+		if remaining < n {
+			n = remaining
+		}
+		inserts := make([]*insert, 0, n)
+		for i := 0; i < n; i++ {
+			sequence++
+			inserts = append(inserts, &insert{keys[i], vals, keys[i], offset, 0, sequence})
+		}
+		doInsert(rs, inserts)
+	}
+}
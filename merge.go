@@ -6,8 +6,6 @@ import (
 	"io/ioutil"
 	"os"
 
-	"github.com/golang/snappy"
-
 	"github.com/getlantern/bytemap"
 	"github.com/getlantern/errors"
 	"github.com/getlantern/goexpr"
@@ -49,8 +47,12 @@ func FileInfo(inFile string) (offsetsBySource common.OffsetsBySource, fieldsStri
 		return
 	}
 	defer file.Close()
-	r := snappy.NewReader(file)
-	return fs.info(r)
+	r, header, err := readFileHeader(file, fs.filename, fs.t.versionFor(fs.filename))
+	if err != nil {
+		return
+	}
+	offsetsBySource, fieldsString, fields, _, err = fs.info(r, header.version)
+	return
 }
 
 // Check checks all of the given inFiles for readability and returns errors
@@ -70,8 +72,12 @@ func Check(inFiles ...string) map[string]error {
 			continue
 		}
 		defer file.Close()
-		r := snappy.NewReader(file)
-		_, _, _, err = fs.info(r)
+		r, header, err := readFileHeader(file, fs.filename, fs.t.versionFor(fs.filename))
+		if err != nil {
+			errors[inFile] = err
+			continue
+		}
+		_, _, _, _, err = fs.info(r, header.version)
 		if err != nil {
 			errors[inFile] = err
 			continue
@@ -97,7 +103,7 @@ func (db *DB) CheckTable(table string, filename string) error {
 		filename: filename,
 	}
 	numRows := 0
-	_, err := fs.iterate(t.fields, nil, true, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+	_, err := fs.iterate(t.fields, nil, true, false, t.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
 		numRows++
 		return true, nil
 	})
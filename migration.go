@@ -0,0 +1,475 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	migrationDir            = "migration"
+	migrationCheckpointFile = "checkpoint.json"
+
+	// MigrationReencode rewrites the file store using the current file version
+	// and field codecs without otherwise changing its contents.
+	MigrationReencode = "reencode"
+)
+
+var (
+	// migrationChunkRows is the number of rows rewritten between checkpoints.
+	migrationChunkRows = 10000
+
+	errMigrationInterrupted = errors.New("Migration interrupted by database stopping")
+
+	// migrations are the known migrations by name
+	migrations = map[string]*migration{
+		MigrationReencode: {name: MigrationReencode},
+	}
+)
+
+// migration is a full rewrite of a table's file store.
+type migration struct {
+	name string
+	// transform, if specified, transforms each row before it's rewritten.
+	// Returning a nil key drops the row.
+	transform func(key bytemap.ByteMap, columns []encoding.Sequence) (bytemap.ByteMap, []encoding.Sequence)
+}
+
+// migrationCheckpoint records the progress of a migration so that it can be
+// resumed after a restart. Rewritten rows are stored in numbered chunk files
+// alongside the checkpoint.
+type migrationCheckpoint struct {
+	Name string
+	// Source is the base name of the file store being migrated
+	Source    string
+	TotalRows int
+	RowsDone  int
+	Chunks    int
+}
+
+// MigrationProgress reports on a file store migration that's in progress.
+type MigrationProgress struct {
+	Name            string
+	RowsDone        int
+	TotalRows       int
+	PercentComplete float64
+	// ETA estimates how much longer the migration will take, based on its rate
+	// of progress since it was started or resumed.
+	ETA time.Duration
+}
+
+type migrationRequest struct {
+	name string
+	err  error
+	done chan interface{}
+}
+
+// ReencodeTable rewrites the named table's file store using the current file
+// version and field codecs. See table.Migrate.
+func (db *DB) ReencodeTable(ctx context.Context, table string) error {
+	t := db.getTable(table)
+	if t == nil {
+		return errors.New("Table %v not found", table)
+	}
+	return t.Migrate(ctx, MigrationReencode)
+}
+
+// MigrationProgress returns the progress of the migration currently running
+// on the named table, or nil if there is none.
+func (db *DB) MigrationProgress(table string) *MigrationProgress {
+	t := db.getTable(table)
+	if t == nil || t.rowStore == nil {
+		return nil
+	}
+	return t.rowStore.getMigrationProgress()
+}
+
+// Migrate runs the named migration, rewriting the whole file store. The file
+// store is rewritten in chunks, checkpointing progress after each one, and
+// reading is limited to DBOpts.MigrationBytesPerSecond. Like flushes,
+// migrations run on the table's insert loop, so new data queues up in the WAL
+// until the migration finishes. If the database stops or crashes during a
+// migration, it resumes from the last checkpoint when the table is next
+// opened, as long as the file store hasn't changed in the meantime.
+func (t *table) Migrate(ctx context.Context, name string) error {
+	if t.rowStore == nil || t.rowStore.opts.readOnly {
+		return errors.New("Table %v does not store data locally", t.Name)
+	}
+	if migrations[name] == nil {
+		return errors.New("Unknown migration %v", name)
+	}
+	req := &migrationRequest{name: name, done: make(chan interface{})}
+	select {
+	case t.rowStore.migrations <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.rowStore.stop:
+		return errors.New("Unable to migrate table %v, it is closing", t.Name)
+	}
+	<-req.done
+	return req.err
+}
+
+// resumeMigration resumes a previously checkpointed migration, if any.
+func (rs *rowStore) resumeMigration(stop <-chan interface{}) error {
+	cp, err := rs.readMigrationCheckpoint()
+	if err != nil {
+		rs.t.log.Errorf("Unable to read migration checkpoint, discarding: %v", err)
+		return rs.clearMigration()
+	}
+	if cp == nil {
+		return nil
+	}
+	m := migrations[cp.Name]
+	if m == nil {
+		rs.t.log.Errorf("Unknown migration %v, discarding checkpoint", cp.Name)
+		return rs.clearMigration()
+	}
+	rs.t.log.Debugf("Resuming migration %v after %d of %d rows", cp.Name, cp.RowsDone, cp.TotalRows)
+	return rs.migrate(m, stop)
+}
+
+// migrate runs the given migration, resuming from the last checkpoint if it
+// applies to the current file store.
+func (rs *rowStore) migrate(m *migration, stop <-chan interface{}) error {
+	cp, err := rs.readMigrationCheckpoint()
+	if err != nil {
+		rs.t.log.Errorf("Unable to read migration checkpoint, starting over: %v", err)
+		cp = nil
+	}
+
+	// Compactions must not replace the file store out from under us
+	rs.compactionMx.Lock()
+	defer rs.compactionMx.Unlock()
+	rs.mx.RLock()
+	fs := rs.fileStore
+	rs.mx.RUnlock()
+	if len(fs.files()) == 0 {
+		// nothing to migrate
+		return rs.clearMigration()
+	}
+
+	if cp == nil || cp.Name != m.name || cp.Source != filepath.Base(fs.filename) {
+		if cp != nil {
+			rs.t.log.Debugf("Checkpoint for migration %v doesn't apply to %v, starting over", cp.Name, fs.filename)
+		}
+		if err := rs.clearMigration(); err != nil {
+			return err
+		}
+		totalRows, err := fs.countRows()
+		if err != nil {
+			return err
+		}
+		cp = &migrationCheckpoint{Name: m.name, Source: filepath.Base(fs.filename), TotalRows: totalRows}
+		if err := rs.writeMigrationCheckpoint(cp); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	resumedAt := cp.RowsDone
+	updateProgress := func() {
+		progress := &MigrationProgress{Name: cp.Name, RowsDone: cp.RowsDone, TotalRows: cp.TotalRows}
+		if cp.TotalRows > 0 {
+			progress.PercentComplete = float64(cp.RowsDone) * 100 / float64(cp.TotalRows)
+		}
+		if rowsThisRun := cp.RowsDone - resumedAt; rowsThisRun > 0 {
+			perRow := time.Now().Sub(start) / time.Duration(rowsThisRun)
+			progress.ETA = perRow * time.Duration(cp.TotalRows-cp.RowsDone)
+		}
+		rs.mx.Lock()
+		rs.migrationProgress = progress
+		rs.mx.Unlock()
+	}
+	updateProgress()
+	defer func() {
+		rs.mx.Lock()
+		rs.migrationProgress = nil
+		rs.mx.Unlock()
+	}()
+
+	fields := rs.fields
+	codecs := codecsFor(fields)
+	truncateBefore := rs.t.truncateBefore()
+	limiter := &migrationRateLimiter{bytesPerSecond: rs.t.db.opts.MigrationBytesPerSecond, stop: stop, start: start}
+	chunk := &bytes.Buffer{}
+	chunkRows := 0
+	rowIdx := 0
+
+	checkpoint := func() error {
+		if err := rs.t.db.opts.hooks.onMigrationChunk(cp.Chunks, rs.getMigrationProgress()); err != nil {
+			return err
+		}
+		if err := rs.writeMigrationFile(rs.migrationChunkFile(cp.Chunks), chunk.Bytes()); err != nil {
+			return err
+		}
+		next := *cp
+		next.RowsDone += chunkRows
+		next.Chunks++
+		if err := rs.writeMigrationCheckpoint(&next); err != nil {
+			return err
+		}
+		*cp = next
+		chunk.Reset()
+		chunkRows = 0
+		updateProgress()
+		return nil
+	}
+
+	offsetsBySource, err := fs.iterate(fields, nil, false, false, truncateBefore, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		rowIdx++
+		if rowIdx <= cp.RowsDone {
+			// already migrated
+			return true, nil
+		}
+		select {
+		case <-stop:
+			return false, errMigrationInterrupted
+		default:
+		}
+		if m.transform != nil {
+			key, columns = m.transform(key, columns)
+		}
+		if key != nil {
+			sizeBefore := chunk.Len()
+			if _, _, err := fs.doWrite(nopWriteCloser{chunk}, fields, codecs, nil, truncateBefore, false, key, columns, nil); err != nil {
+				return false, errors.New("Unable to write migrated row: %v", err)
+			}
+			if !limiter.wait(chunk.Len() - sizeBefore) {
+				return false, errMigrationInterrupted
+			}
+		}
+		chunkRows++
+		if chunkRows >= migrationChunkRows {
+			if err := checkpoint(); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err == nil && chunkRows > 0 {
+		err = checkpoint()
+	}
+	if err != nil {
+		if err != errMigrationInterrupted {
+			rs.t.log.Errorf("Migration %v failed after %d of %d rows, will resume from last checkpoint: %v", cp.Name, cp.RowsDone, cp.TotalRows, err)
+		}
+		return err
+	}
+
+	newFileStoreName, err := rs.assembleMigration(fs, cp, offsetsBySource)
+	if err != nil {
+		return err
+	}
+	newFS := &fileStore{t: rs.t, rs: rs, fields: fields, filename: newFileStoreName}
+	rollupFile := ""
+	if len(rs.t.RollupBy) > 0 {
+		var rollupErr error
+		rollupFile, rollupErr = rs.writeRollup(newFS, offsetsBySource)
+		if rollupErr != nil {
+			rs.t.log.Errorf("Unable to write rollup: %v", rollupErr)
+		}
+	}
+	rs.mx.Lock()
+	rs.fileStore = newFS
+	rs.rollupFile = rollupFile
+	rs.mx.Unlock()
+	rs.t.log.Debugf("Migration %v rewrote %d rows from %v to %v in %v", cp.Name, cp.RowsDone, fs.filename, newFileStoreName, time.Now().Sub(start))
+	return rs.clearMigration()
+}
+
+// assembleMigration combines the chunks of a finished migration into a new
+// file store that carries the same WAL offsets as the migrated one.
+func (rs *rowStore) assembleMigration(fs *fileStore, cp *migrationCheckpoint, offsetsBySource common.OffsetsBySource) (string, error) {
+	out, err := ioutil.TempFile(filepath.Join(rs.opts.dir, migrationDir), "nextrowstore")
+	if err != nil {
+		return "", errors.New("Unable to create temp file for migration: %v", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	cout, err := fs.createOutWriter(out, rs.fields, offsetsBySource, false)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < cp.Chunks; i++ {
+		if err := appendFile(cout, rs.migrationChunkFile(i)); err != nil {
+			cout.Close()
+			return "", err
+		}
+	}
+	if f, ok := cout.(flushable); ok {
+		if err := f.Flush(); err != nil {
+			cout.Close()
+			return "", errors.New("Unable to flush migrated file store: %v", err)
+		}
+	}
+	if err := cout.Close(); err != nil {
+		return "", errors.New("Unable to close migrated file store writer: %v", err)
+	}
+	if err := out.Sync(); err != nil {
+		return "", errors.New("Unable to sync migrated file store: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return "", errors.New("Unable to close migrated file store: %v", err)
+	}
+	newFileStoreName := filepath.Join(rs.opts.dir, fmt.Sprintf("filestore_%020d_%d.dat", rs.nextFileNanos(), CurrentFileVersion))
+	if err := os.Rename(out.Name(), newFileStoreName); err != nil {
+		return "", errors.New("Unable to move migrated file store into place at %v: %v", newFileStoreName, err)
+	}
+	return newFileStoreName, nil
+}
+
+func appendFile(out io.Writer, filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return errors.New("Unable to open %v: %v", filename, err)
+	}
+	defer in.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return errors.New("Unable to copy %v: %v", filename, err)
+	}
+	return nil
+}
+
+// countRows counts the rows in the file store without decoding them.
+func (fs *fileStore) countRows() (int, error) {
+	rows := 0
+	_, err := fs.iterate(fs.fields, nil, false, true, time.Time{}, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		rows++
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.New("Unable to count rows in %v: %v", fs.filename, err)
+	}
+	return rows, nil
+}
+
+func (rs *rowStore) getMigrationProgress() *MigrationProgress {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	if rs.migrationProgress == nil {
+		return nil
+	}
+	progress := *rs.migrationProgress
+	return &progress
+}
+
+// migrationDirName returns the directory in which migration checkpoints and
+// chunks are stored. It's a subdirectory so that its contents aren't mistaken
+// for file stores.
+func (rs *rowStore) migrationDirName() string {
+	return filepath.Join(rs.opts.dir, migrationDir)
+}
+
+func (rs *rowStore) migrationChunkFile(chunk int) string {
+	return filepath.Join(rs.migrationDirName(), fmt.Sprintf("chunk_%06d.dat", chunk))
+}
+
+func (rs *rowStore) readMigrationCheckpoint() (*migrationCheckpoint, error) {
+	filename := filepath.Join(rs.migrationDirName(), migrationCheckpointFile)
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("Unable to read migration checkpoint %v: %v", filename, err)
+	}
+	cp := &migrationCheckpoint{}
+	if err := json.Unmarshal(b, cp); err != nil {
+		return nil, errors.New("Unable to parse migration checkpoint %v: %v", filename, err)
+	}
+	return cp, nil
+}
+
+func (rs *rowStore) writeMigrationCheckpoint(cp *migrationCheckpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return errors.New("Unable to encode migration checkpoint: %v", err)
+	}
+	return rs.writeMigrationFile(filepath.Join(rs.migrationDirName(), migrationCheckpointFile), b)
+}
+
+// writeMigrationFile durably writes the given data to filename via a temp file
+// so that a crash never leaves a partially written file behind.
+func (rs *rowStore) writeMigrationFile(filename string, data []byte) error {
+	dir := rs.migrationDirName()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.New("Unable to create migration directory %v: %v", dir, err)
+	}
+	file, err := ioutil.TempFile(dir, "nextmigration")
+	if err != nil {
+		return errors.New("Unable to create temp file for migration: %v", err)
+	}
+	defer file.Close()
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.New("Unable to write %v: %v", filename, err)
+	}
+	return nil
+}
+
+// clearMigration removes any migration checkpoint and chunks.
+func (rs *rowStore) clearMigration() error {
+	dir := rs.migrationDirName()
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.New("Unable to remove migration directory %v: %v", dir, err)
+	}
+	return nil
+}
+
+// migrationRateLimiter limits the rate at which migrations process data to
+// bytesPerSecond. Once stop is closed, it stops waiting.
+type migrationRateLimiter struct {
+	bytesPerSecond int64
+	stop           <-chan interface{}
+	start          time.Time
+	processed      int64
+}
+
+// wait waits until n more bytes may be processed, returning false if the
+// database stopped while waiting.
+func (l *migrationRateLimiter) wait(n int) bool {
+	if l.bytesPerSecond <= 0 {
+		return true
+	}
+	l.processed += int64(n)
+	expected := time.Duration(float64(l.processed) / float64(l.bytesPerSecond) * float64(time.Second))
+	if wait := expected - time.Now().Sub(l.start); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-l.stop:
+			return false
+		}
+	}
+	return true
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
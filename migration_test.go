@@ -0,0 +1,132 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationResumesAfterInterrupt(t *testing.T) {
+	h := &hooks{}
+	oldChunkRows := migrationChunkRows
+	migrationChunkRows = 10
+	defer func() {
+		migrationChunkRows = oldChunkRows
+	}()
+
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	open := func() (*DB, *table) {
+		db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true, MigrationBytesPerSecond: 1024 * 1024, hooks: h})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		db.clock.Advance(epoch)
+		err = db.CreateTable(&TableOpts{
+			Name:            "migrated",
+			RetentionPeriod: 1 * time.Hour,
+			SQL:             "SELECT SUM(v) AS v, MAX(v) AS m FROM inbound GROUP BY k, period(1s)",
+		})
+		if !assert.NoError(t, err) {
+			db.Close()
+			t.FailNow()
+		}
+		return db, db.getTable("migrated")
+	}
+	read := func(tbl *table) map[string]string {
+		fields := tbl.getFields()
+		result := make(map[string]string)
+		_, err := tbl.iterate(context.Background(), fields, false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			for i, field := range fields {
+				result[fmt.Sprintf("%v.%v", key.Get("k"), field.Name)] = vals[i].String(field.Expr, tbl.Resolution)
+			}
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	db, tbl := open()
+	numKeys := 25
+	var points []*Point
+	for i := 0; i < numKeys; i++ {
+		for j := 0; j < 5; j++ {
+			points = append(points, &Point{TS: epoch.Add(time.Duration(-j) * time.Second), Dims: map[string]interface{}{"k": i}, Vals: map[string]interface{}{"v": float64(i + j)}})
+		}
+	}
+	_, err = db.InsertBatch("migrated", points)
+	if !assert.NoError(t, err) {
+		db.Close()
+		return
+	}
+	tbl.forceFlush()
+	expected := read(tbl)
+	originalFile := tbl.rowStore.fileStore.filename
+
+	// Simulate a crash after the first chunk has been checkpointed
+	errCrashed := errors.New("crashed")
+	h.migrationChunk = func(chunk int, progress *MigrationProgress) error {
+		if chunk == 1 {
+			return errCrashed
+		}
+		return nil
+	}
+
+	assert.Equal(t, errCrashed, db.ReencodeTable(context.Background(), "migrated"))
+	assert.Nil(t, db.MigrationProgress("migrated"), "No migration should be running after failure")
+	cp, err := tbl.rowStore.readMigrationCheckpoint()
+	if assert.NoError(t, err) && assert.NotNil(t, cp) {
+		assert.Equal(t, MigrationReencode, cp.Name)
+		assert.Equal(t, numKeys, cp.TotalRows)
+		assert.Equal(t, 10, cp.RowsDone)
+		assert.Equal(t, 1, cp.Chunks)
+	}
+	assert.Equal(t, expected, read(tbl), "Failed migration should not affect data")
+	db.Close()
+
+	// Reopening should resume from the checkpoint
+	var resumedChunks []int
+	var progress []MigrationProgress
+	h.migrationChunk = func(chunk int, p *MigrationProgress) error {
+		resumedChunks = append(resumedChunks, chunk)
+		if p != nil {
+			progress = append(progress, *p)
+		}
+		return nil
+	}
+
+	db, tbl = open()
+	defer db.Close()
+	// wait for the resumed migration to finish
+	tbl.forceFlush()
+
+	assert.Equal(t, []int{1, 2}, resumedChunks, "Migration should have resumed with second chunk")
+	if assert.Len(t, progress, 2) {
+		assert.Equal(t, 10, progress[0].RowsDone)
+		assert.Equal(t, numKeys, progress[0].TotalRows)
+		assert.Equal(t, 40.0, progress[0].PercentComplete)
+		assert.Equal(t, 20, progress[1].RowsDone)
+		assert.True(t, progress[1].ETA > 0, "ETA should be estimated once progress has been made")
+	}
+	assert.Nil(t, db.MigrationProgress("migrated"))
+	assert.NotEqual(t, originalFile, tbl.rowStore.fileStore.filename, "Migration should have written new file store")
+	assert.Equal(t, CurrentFileVersion, tbl.versionFor(tbl.rowStore.fileStore.filename))
+	_, err = os.Stat(tbl.rowStore.migrationDirName())
+	assert.True(t, os.IsNotExist(err), "Migration checkpoint should have been cleared")
+	assert.Equal(t, expected, read(tbl), "Migrated data should match original")
+
+	assert.Error(t, tbl.Migrate(context.Background(), "unknown"))
+}
@@ -0,0 +1,106 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMMapFileStores(t *testing.T) {
+	read := func(mmap bool, removeWhileIterating bool) map[string]float64 {
+		db, cleanup := newTestDB(t, &DBOpts{MMapFileStores: mmap}, "mapped", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+		defer cleanup()
+
+		epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+		db.clock.Advance(epoch)
+		var points []*Point
+		for i := 0; i < 100; i++ {
+			points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": i}, Vals: map[string]interface{}{"v": float64(i)}})
+		}
+		if _, err := db.InsertBatch("mapped", points); !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		tbl := db.getTable("mapped")
+		tbl.forceFlush()
+		fields := tbl.getFields()
+		fs := tbl.rowStore.fileStore
+
+		result := make(map[string]float64)
+		_, err := fs.iterate(fields, nil, false, false, time.Time{}, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			if removeWhileIterating && len(result) == 0 {
+				assert.NoError(t, os.Remove(fs.filename))
+			}
+			v, _ := columns[1].ValueAt(0, fields[1].Expr)
+			result[fmt.Sprint(key.Get("k"))] = v
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	buffered := read(false, false)
+	assert.Len(t, buffered, 100)
+	assert.Equal(t, buffered, read(true, false), "Reading from mmap should match buffered read")
+	assert.Equal(t, buffered, read(true, true), "Removing file while it's mapped should not affect iteration")
+}
+
+func BenchmarkIterateBuffered(b *testing.B) {
+	doBenchmarkIterate(b, false)
+}
+
+func BenchmarkIterateMMap(b *testing.B) {
+	doBenchmarkIterate(b, true)
+}
+
+func doBenchmarkIterate(b *testing.B, mmap bool) {
+	tmpDir, err := ioutil.TempDir("", "zenodbbench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true, MMapFileStores: mmap})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	err = db.CreateTable(&TableOpts{
+		Name:            "bench",
+		RetentionPeriod: 1 * time.Hour,
+		SQL:             "SELECT SUM(v) AS v, MAX(v) AS m FROM inbound GROUP BY k, period(1s)",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	var points []*Point
+	for i := 0; i < 1000; i++ {
+		for j := 0; j < 100; j++ {
+			points = append(points, &Point{TS: epoch.Add(time.Duration(-j) * time.Second), Dims: map[string]interface{}{"k": i}, Vals: map[string]interface{}{"v": float64(i * j)}})
+		}
+	}
+	if _, err := db.InsertBatch("bench", points); err != nil {
+		b.Fatal(err)
+	}
+	tbl := db.getTable("bench")
+	tbl.forceFlush()
+	fields := tbl.getFields()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := tbl.iterate(context.Background(), fields, false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			return true, nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
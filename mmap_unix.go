@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package zenodb
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/getlantern/errors"
+)
+
+// mmapFile maps the entire contents of the given file into memory read-only.
+// The mapping remains valid after the file is closed or removed, until it's
+// released with munmap.
+func mmapFile(file *os.File) ([]byte, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, errors.New("Unable to stat %v: %v", file.Name(), err)
+	}
+	size := fi.Size()
+	if size == 0 {
+		return nil, errors.New("Unable to mmap empty file %v", file.Name())
+	}
+	if int64(int(size)) != size {
+		return nil, errors.New("File %v is too large to mmap", file.Name())
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, errors.New("Unable to mmap %v: %v", file.Name(), err)
+	}
+	return data, nil
+}
+
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,17 @@
+package zenodb
+
+import (
+	"os"
+
+	"github.com/getlantern/errors"
+)
+
+// mmapFile isn't supported on Windows, so file stores are always read through
+// buffered I/O there.
+func mmapFile(file *os.File) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmap(data []byte) error {
+	return nil
+}
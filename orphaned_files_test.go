@@ -0,0 +1,143 @@
+package zenodb
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveOrphanedFileStores(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	open := func() (*DB, *table) {
+		db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		db.clock.Advance(epoch)
+		err = db.CreateTable(&TableOpts{
+			Name:            "orphans",
+			RetentionPeriod: 1 * time.Hour,
+			SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+		})
+		if !assert.NoError(t, err) {
+			db.Close()
+			t.FailNow()
+		}
+		return db, db.getTable("orphans")
+	}
+
+	db, tbl := open()
+	_, err = db.InsertBatch("orphans", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl.forceFlush()
+	dir := tbl.rowStore.opts.dir
+	db.Close()
+
+	// Simulate a file store left behind by a crash before it could be cleaned up
+	orphan := filepath.Join(dir, "filestore_00000000000000000001_8.dat")
+	if !assert.NoError(t, ioutil.WriteFile(orphan, []byte("orphaned"), 0644)) {
+		return
+	}
+
+	db, tbl = open()
+	defer db.Close()
+	rs := tbl.rowStore
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(orphan); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_, err = os.Stat(orphan)
+	assert.True(t, os.IsNotExist(err), "Orphaned file store should have been removed at startup")
+	rs.mx.RLock()
+	current := rs.fileStore.filename
+	rs.mx.RUnlock()
+	_, err = os.Stat(current)
+	assert.NoError(t, err, "Current file store should have been kept")
+}
+
+func TestOrphanedFlushFilesRemoved(t *testing.T) {
+	h := &hooks{}
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	open := func() (*DB, *table) {
+		db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true, hooks: h})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		db.clock.Advance(epoch)
+		err = db.CreateTable(&TableOpts{
+			Name:            "orphans",
+			RetentionPeriod: 1 * time.Hour,
+			SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+		})
+		if !assert.NoError(t, err) {
+			db.Close()
+			t.FailNow()
+		}
+		return db, db.getTable("orphans")
+	}
+	tableDir := filepath.Join(tmpDir, "orphans")
+	tempFiles := func() []string {
+		files, err := filepath.Glob(filepath.Join(tableDir, flushTempPrefix+"*"))
+		assert.NoError(t, err)
+		return files
+	}
+
+	var tempFilesDuringFlush []string
+	h.flushWriter = func(out io.Writer) io.Writer {
+		tempFilesDuringFlush = tempFiles()
+		return out
+	}
+
+	db, tbl := open()
+	_, err = db.InsertBatch("orphans", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}}})
+	if !assert.NoError(t, err) {
+		db.Close()
+		return
+	}
+	tbl.forceFlush()
+	db.Close()
+	assert.Len(t, tempFilesDuringFlush, 1, "Flush should write its temp file to the table's directory")
+	assert.Empty(t, tempFiles(), "Successful flush should not leave temp file behind")
+
+	// Simulate a flush that was interrupted by a crash
+	orphan := filepath.Join(tableDir, flushTempPrefix+"12345")
+	if !assert.NoError(t, ioutil.WriteFile(orphan, []byte("partial flush"), 0644)) {
+		return
+	}
+
+	db, tbl = open()
+	defer db.Close()
+	_, err = os.Stat(orphan)
+	assert.True(t, os.IsNotExist(err), "Orphaned temp file should have been removed")
+	keys := 0
+	_, err = tbl.iterate(context.Background(), tbl.getFields(), false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		keys++
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, keys, "Flushed data should have survived")
+}
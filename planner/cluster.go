@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/getlantern/goexpr"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/sql"
 )
@@ -42,6 +43,13 @@ func (cs *clusterSource) doIterate(ctx context.Context, unflat bool, onFields co
 	return cs.opts.QueryCluster(ctx, cs.query.SQL, cs.opts.IsSubQuery, subQueryResults, unflat, onFields, onRow, onFlatRow)
 }
 
+func (cs *clusterSource) describePlan(node *core.PlanNode) {
+	node.Type = "cluster"
+	if cs.opts.PartitionsFor != nil {
+		node.Partitions = cs.opts.PartitionsFor(cs.query.SQL)
+	}
+}
+
 func (cs *clusterSource) GetGroupBy() []core.GroupBy {
 	return cs.planAsIfLocal.GetGroupBy()
 }
@@ -70,6 +78,10 @@ func (cs *clusterRowSource) String() string {
 	return fmt.Sprintf("cluster %v", cs.query.SQL)
 }
 
+func (cs *clusterRowSource) DescribePlan(node *core.PlanNode) {
+	cs.describePlan(node)
+}
+
 type clusterFlatRowSource struct {
 	clusterSource
 }
@@ -84,12 +96,17 @@ func (cs *clusterFlatRowSource) String() string {
 	return fmt.Sprintf("cluster flat %v", cs.query.SQL)
 }
 
+func (cs *clusterFlatRowSource) DescribePlan(node *core.PlanNode) {
+	cs.describePlan(node)
+}
+
 // pushdownAllowed checks whether we're allowed to push down a query to the
 // individual partitions. "Push down" means that the entire query (including
 // subquery) is run on each partition and the results are combined through a
 // simple union on the leader node. If a query cannot be pushed down, the leader
-// will query the partitions for the raw data and then perform group by and
-// having logic on the leader. For queries that contains subqueries, if pushdown
+// will query the partitions for partial aggregates (or the raw data when that's
+// not possible, for example with crosstabs) and then perform the final group by
+// and having logic on the leader. For queries that contains subqueries, if pushdown
 // is not allowed, the entire subquery result set is returned to the leader for
 // further processing, which is much slower than pushdown processing for queries
 // that aggregate heavily.
@@ -197,7 +214,23 @@ func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, e
 	indexOfHaving := strings.Index(lowerSQL, "having ")
 	indexOfOrderBy := strings.Index(lowerSQL, "order by ")
 	indexOfLimit := strings.Index(lowerSQL, "limit ")
-	if indexOfGroupBy > 0 {
+	hasGroupBy := len(query.GroupBy) > 0
+	hasCrosstab := crosstabString != ""
+	// If possible, have the partitions pre-aggregate using the query's own group
+	// by so that only partial aggregates get sent to the leader, which then just
+	// merges them. With crosstabs, we need the partitions to send the raw
+	// dimensions instead.
+	preAggregate := hasGroupBy && !query.GroupByAll && !hasCrosstab && indexOfGroupBy > 0
+	if preAggregate {
+		// Keep group by but remove everything after it
+		endOfGroupBy := len(sqlString)
+		for _, idx := range []int{indexOfHaving, indexOfOrderBy, indexOfLimit} {
+			if idx > indexOfGroupBy && idx < endOfGroupBy {
+				endOfGroupBy = idx
+			}
+		}
+		sqlString = sqlString[:endOfGroupBy]
+	} else if indexOfGroupBy > 0 {
 		sqlString = sqlString[:indexOfGroupBy]
 	} else if indexOfHaving > 0 {
 		sqlString = sqlString[:indexOfHaving]
@@ -221,43 +254,43 @@ func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, e
 		sqlString = fmt.Sprintf("%v, %v %v", sqlString[:indexOfFrom], query.HavingSQL, sqlString[indexOfFrom:])
 	}
 
-	hasGroupBy := len(query.GroupBy) > 0
-	hasCrosstab := crosstabString != ""
-	var groupByParts []string
-	if query.GroupByAll {
-		if hasGroupBy || hasCrosstab {
-			// need an explicit wildcard
-			groupByParts = append(groupByParts, "*")
+	if !preAggregate {
+		var groupByParts []string
+		if query.GroupByAll {
+			if hasGroupBy || hasCrosstab {
+				// need an explicit wildcard
+				groupByParts = append(groupByParts, "*")
+			}
 		}
-	}
-	if hasGroupBy {
-		groupByParams := make(map[string]bool)
-		for _, groupBy := range query.GroupBy {
-			groupBy.Expr.WalkParams(func(name string) {
-				groupByParams[name] = true
-			})
+		if hasGroupBy {
+			groupByParams := make(map[string]bool)
+			for _, groupBy := range query.GroupBy {
+				groupBy.Expr.WalkParams(func(name string) {
+					groupByParams[name] = true
+				})
+			}
+			sortedNames := make([]string, 0, len(groupByParams))
+			for name := range groupByParams {
+				sortedNames = append(sortedNames, name)
+			}
+			sort.Strings(sortedNames)
+			for _, name := range sortedNames {
+				groupByParts = append(groupByParts, name)
+			}
 		}
-		sortedNames := make([]string, 0, len(groupByParams))
-		for name := range groupByParams {
-			sortedNames = append(sortedNames, name)
+		if hasCrosstab {
+			groupByParts = append(groupByParts, crosstabString)
+			query.Crosstab = core.ClusterCrosstab
 		}
-		sort.Strings(sortedNames)
-		for _, name := range sortedNames {
-			groupByParts = append(groupByParts, name)
+		if query.Resolution != 0 {
+			groupByParts = append(groupByParts, fmt.Sprintf("period(%v)", query.Resolution))
+		}
+		if query.Stride > 0 {
+			groupByParts = append(groupByParts, fmt.Sprintf("stride(%v)", query.Stride))
+		}
+		if len(groupByParts) > 0 {
+			sqlString = fmt.Sprintf("%v group by %v", sqlString, strings.Join(groupByParts, ", "))
 		}
-	}
-	if hasCrosstab {
-		groupByParts = append(groupByParts, crosstabString)
-		query.Crosstab = core.ClusterCrosstab
-	}
-	if query.Resolution != 0 {
-		groupByParts = append(groupByParts, fmt.Sprintf("period(%v)", query.Resolution))
-	}
-	if query.Stride > 0 {
-		groupByParts = append(groupByParts, fmt.Sprintf("stride(%v)", query.Stride))
-	}
-	if len(groupByParts) > 0 {
-		sqlString = fmt.Sprintf("%v group by %v", sqlString, strings.Join(groupByParts, ", "))
 	}
 
 	pail, err := planAsIfLocal(opts, sqlString)
@@ -289,8 +322,17 @@ func planClusterNonPushdown(opts *Opts, query *sql.Query) (core.FlatRowSource, e
 	query.AsOf = time.Time{}
 	query.Until = time.Time{}
 	query.Resolution = 0
+	if preAggregate {
+		// Partitions already evaluated the group by expressions, so just group on
+		// the resulting dimensions
+		groupBy := make([]core.GroupBy, 0, len(query.GroupBy))
+		for _, gb := range query.GroupBy {
+			groupBy = append(groupBy, core.NewGroupBy(gb.Name, goexpr.Param(gb.Name)))
+		}
+		query.GroupBy = groupBy
+	}
 
-	flat := core.Flatten(addGroupBy(source, query, true, query.Resolution, 0))
+	flat := core.Flatten(addGroupBy(source, query, true, query.Resolution, 0, false))
 	if query.HasHaving {
 		flat = addHaving(flat, query)
 	}
@@ -66,3 +66,7 @@ func (f *havingFilter) GetSource() core.Source {
 func (f *havingFilter) String() string {
 	return f.base.String()
 }
+
+func (f *havingFilter) DescribePlan(node *core.PlanNode) {
+	node.Type = "having"
+}
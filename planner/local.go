@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/getlantern/bytemap"
+	"github.com/getlantern/goexpr"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
 	"github.com/getlantern/zenodb/sql"
@@ -23,14 +24,43 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 			return nil, err
 		}
 	} else {
-		source, err = sourceForTable(query, opts)
+		var selectsTableFields bool
+		source, selectsTableFields, err = sourceForTable(query, opts)
 		if err != nil {
 			return nil, err
 		}
+		if dt, ok := source.(DownsampledTable); ok && query.Resolution > source.GetResolution() && query.Stride == 0 {
+			if downsampled := dt.Downsampled(query.Resolution); downsampled != nil && canUseDownsampled(query, opts, downsampled) {
+				log.Debugf("Using %v at resolution %v for %v", downsampled, downsampled.GetResolution(), query.From)
+				source = downsampled
+			}
+		}
+		if rt, ok := source.(RollupTable); ok && canUseRollup(query, rt.GetRollupBy()) {
+			if rollup := rt.Rollup(); rollup != nil {
+				log.Debugf("Using rollup of %v", query.From)
+				source = rollup
+			}
+		}
+		if dt, ok := source.(DownsamplingTable); ok && selectsTableFields && canDownsampleOnRead(query, opts, dt) {
+			if downsampled := dt.DownsampleOnRead(query.Resolution); downsampled != nil {
+				log.Debugf("Downsampling %v to %v while reading", query.From, query.Resolution)
+				source = downsampled
+			}
+		}
 	}
 
 	now := opts.Now(query.From)
 	asOf, asOfChanged, until, untilChanged := asOfUntilFor(query, opts, source, now)
+	if !opts.AsOf.IsZero() || !opts.Until.IsZero() {
+		asOf, asOfChanged, until, untilChanged = clampWindow(query, source, asOf, asOfChanged, until, untilChanged)
+	}
+	var subQueryPlans []core.FlatRowSource
+	if opts.RetentionOverlap == RetentionIntersection {
+		asOf, asOfChanged, subQueryPlans, err = intersectRetention(query, opts, source, asOf, asOfChanged)
+		if err != nil {
+			return nil, err
+		}
+	}
 	sourceAsOf := source.GetAsOf()
 	if asOf.Before(sourceAsOf) {
 		return nil, fmt.Errorf("Query asOf of %v is before table asOf of %v", asOf, sourceAsOf)
@@ -41,8 +71,12 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 		return nil, err
 	}
 
+	if query.MaxPeriodsPerSeries > 0 {
+		asOf, asOfChanged, resolution, resolutionChanged = limitPeriods(query, source, asOf, asOfChanged, until, resolution, strideSlice, resolutionChanged)
+	}
+
 	if query.Where != nil {
-		source, err = applySubQueryFilters(query, opts, source)
+		source, err = applySubQueryFilters(query, opts, source, subQueryPlans)
 		if err != nil {
 			return nil, err
 		}
@@ -52,7 +86,7 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 		!query.GroupByAll || query.HasSpecificFields || query.HasHaving ||
 		query.Crosstab != nil || strideSlice > 0
 	if needsGroupBy {
-		source = addGroupBy(source, query, resolutionTruncated || resolutionChanged, resolution, strideSlice)
+		source = addGroupBy(source, query, resolutionTruncated || resolutionChanged, resolution, strideSlice, canStream(query))
 	}
 
 	flat := core.Flatten(source)
@@ -64,16 +98,35 @@ func planLocal(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
 	return addOrderLimitOffset(flat, query), nil
 }
 
+// canStream determines whether the query's group by can emit rows as they're
+// read, which allows a LIMIT to stop the table scan early. This requires that
+// nothing downstream needs to see all rows (i.e. no ORDER BY) and that the
+// source yields each key only once, which is true of tables but not of
+// subqueries.
+func canStream(query *sql.Query) bool {
+	return query.Limit > 0 && len(query.OrderBy) == 0 && query.FromSubQuery == nil
+}
+
 func sourceForSubQuery(query *sql.Query, opts *Opts) (core.RowSource, error) {
 	subSource, err := Plan(query.FromSubQuery.SQL, opts)
 	if err != nil {
 		return nil, err
 	}
+	if opts.SkipNulls {
+		return core.UnflattenSkippingNulls(subSource, query.FieldsNoHaving), nil
+	}
 	return core.Unflatten(subSource, query.FieldsNoHaving), nil
 }
 
-func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, error) {
-	return opts.GetTable(query.From, func(tableFields core.Fields) (core.Fields, error) {
+// sourceForTable returns the table queried by the given query. It also
+// indicates whether the query only selects fields of the table as they are,
+// without computing anything from them.
+func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, bool, error) {
+	selectsTableFields := true
+	source, err := opts.GetTable(query.From, func(tableFields core.Fields) (core.Fields, error) {
+		fields, err := query.Fields.Get(tableFields)
+		selectsTableFields = selectsTableFields && err == nil && onlyTableFields(fields, tableFields)
+
 		if query.HasSelectAll {
 			// For SELECT *, include all table fields
 			return tableFields, nil
@@ -83,7 +136,6 @@ func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, error) {
 
 		// Otherwise, figure out minimum set of fields needed by query
 		includedFields := make([]bool, len(tableFields))
-		fields, err := query.Fields.Get(tableFields)
 		if err != nil {
 			return nil, err
 		}
@@ -105,6 +157,71 @@ func sourceForTable(query *sql.Query, opts *Opts) (core.RowSource, error) {
 
 		return result, nil
 	})
+	return source, selectsTableFields, err
+}
+
+// onlyTableFields indicates whether all of the given fields have the same
+// expression as exactly one of the table's fields.
+func onlyTableFields(fields core.Fields, tableFields core.Fields) bool {
+	tableExprs := make(map[string]bool, len(tableFields))
+	for _, field := range tableFields {
+		e := field.Expr.String()
+		if tableExprs[e] {
+			// Grouping merges each field from all matching table fields
+			return false
+		}
+		tableExprs[e] = true
+	}
+	for _, field := range fields {
+		if !tableExprs[field.Expr.String()] {
+			return false
+		}
+	}
+	return true
+}
+
+// canUseDownsampled determines whether the given downsampled table covers the
+// start of the window requested by the query.
+func canUseDownsampled(query *sql.Query, opts *Opts, downsampled Table) bool {
+	asOf := query.AsOf
+	if query.AsOfOffset != 0 {
+		asOf = opts.Now(query.From).Add(query.AsOfOffset)
+	}
+	return asOf.IsZero() || !asOf.Before(downsampled.GetAsOf())
+}
+
+// canDownsampleOnRead determines whether the given table can downsample its
+// data to the query's resolution while reading. Tables align downsampled
+// periods to the end of their own window, just like grouping does, so this
+// requires that the query doesn't change the window.
+func canDownsampleOnRead(query *sql.Query, opts *Opts, source Table) bool {
+	resolution := source.GetResolution()
+	return query.Resolution > resolution && query.Resolution%resolution == 0 &&
+		query.Resolution <= source.GetUntil().Sub(source.GetAsOf()) &&
+		query.Stride == 0 && query.MaxPeriodsPerSeries == 0 &&
+		query.AsOf.IsZero() && query.AsOfOffset == 0 &&
+		query.Until.IsZero() && query.UntilOffset == 0 &&
+		!query.HasHaving && opts.RetentionOverlap != RetentionIntersection
+}
+
+// canUseRollup determines whether a rollup by the given dimensions contains
+// everything needed to answer the query, which is the case if the query groups
+// by exactly those dimensions and doesn't filter on or crosstab by anything.
+func canUseRollup(query *sql.Query, rollupBy []string) bool {
+	if len(rollupBy) == 0 || query.GroupByAll || query.Where != nil || query.Crosstab != nil || len(query.GroupBy) != len(rollupBy) {
+		return false
+	}
+	remaining := make(map[string]bool, len(rollupBy))
+	for _, dim := range rollupBy {
+		remaining[dim] = true
+	}
+	for _, groupBy := range query.GroupBy {
+		if !remaining[groupBy.Name] || groupBy.Expr.String() != goexpr.Param(groupBy.Name).String() {
+			return false
+		}
+		delete(remaining, groupBy.Name)
+	}
+	return len(remaining) == 0
 }
 
 func asOfUntilFor(query *sql.Query, opts *Opts, source core.RowSource, now time.Time) (time.Time, bool, time.Time, bool) {
@@ -134,6 +251,84 @@ func asOfUntilFor(query *sql.Query, opts *Opts, source core.RowSource, now time.
 	return asOf, asOfChanged, until, untilChanged
 }
 
+// clampWindow clamps an explicitly requested window (see Opts.AsOf and
+// Opts.Until) to the data available in the source.
+func clampWindow(query *sql.Query, source core.RowSource, asOf time.Time, asOfChanged bool, until time.Time, untilChanged bool) (time.Time, bool, time.Time, bool) {
+	if sourceAsOf := source.GetAsOf(); asOf.Before(sourceAsOf) {
+		log.Debugf("Clamping asOf from %v to %v", asOf, sourceAsOf)
+		asOf = sourceAsOf
+		asOfChanged = false
+		query.AsOf = time.Time{}
+	}
+	if sourceUntil := source.GetUntil(); until.After(sourceUntil) {
+		log.Debugf("Clamping until from %v to %v", until, sourceUntil)
+		until = sourceUntil
+		untilChanged = false
+		query.Until = time.Time{}
+	}
+	if until.Before(asOf) {
+		// The window doesn't overlap the available data at all
+		until = asOf
+		untilChanged = true
+		query.Until = until
+	}
+	return asOf, asOfChanged, until, untilChanged
+}
+
+// intersectRetention moves asOf forward so that the query only covers the
+// window for which both the queried table and any tables read by subqueries
+// have data. To find the subqueries' windows, it plans them (clipped to the
+// same window) and returns those plans so that they don't need to be planned
+// again. If the subqueries' results were supplied (see Opts.SubQueryResults),
+// the subqueries are still planned so that asOf is the same as wherever they
+// were run, but the supplied results are used and nil is returned.
+func intersectRetention(query *sql.Query, opts *Opts, source core.RowSource, asOf time.Time, asOfChanged bool) (time.Time, bool, []core.FlatRowSource, error) {
+	latest := opts.minAsOf
+	if asOf.After(latest) {
+		latest = asOf
+	}
+	subQueries := subQueriesIn(query)
+	sqOpts := &Opts{}
+	*sqOpts = *opts
+	sqOpts.IsSubQuery = true
+	sqOpts.SubQueryResults = nil
+	sqOpts.minAsOf = latest
+	subQueryPlans, err := planEachSubQuery(sqOpts, subQueries)
+	if err != nil {
+		return asOf, asOfChanged, nil, err
+	}
+	for _, sqPlan := range subQueryPlans {
+		if sqPlan.GetAsOf().After(latest) {
+			latest = sqPlan.GetAsOf()
+		}
+	}
+
+	if latest.After(asOf) {
+		clipped := encoding.RoundTimeUp(latest, source.GetResolution())
+		log.Debugf("Clipping asOf from %v to %v to intersect retention of %v with subqueries", asOf, clipped, query.From)
+		asOf = clipped
+		asOfChanged = true
+		query.AsOf = asOf
+	}
+
+	if len(opts.SubQueryResults) == len(subQueries) {
+		return asOf, asOfChanged, nil, nil
+	}
+	// A subquery may start before the intersection if it was clipped by another
+	// subquery rather than by the queried table, in which case it has to be
+	// planned again.
+	sqOpts.minAsOf = asOf
+	for i, sqPlan := range subQueryPlans {
+		if sqPlan.GetAsOf().Before(asOf) {
+			subQueryPlans[i], err = Plan(subQueries[i].SQL, sqOpts)
+			if err != nil {
+				return asOf, asOfChanged, nil, err
+			}
+		}
+	}
+	return asOf, asOfChanged, subQueryPlans, nil
+}
+
 func resolutionFor(query *sql.Query, opts *Opts, source core.RowSource, asOf time.Time, until time.Time) (time.Duration, time.Duration, bool, bool, error) {
 	resolution := query.Resolution
 	var strideSlice time.Duration
@@ -169,10 +364,46 @@ func resolutionFor(query *sql.Query, opts *Opts, source core.RowSource, asOf tim
 	return resolution, strideSlice, resolutionChanged, resolutionTruncated, nil
 }
 
-func applySubQueryFilters(query *sql.Query, opts *Opts, source core.RowSource) (core.RowSource, error) {
-	runSubQueries, subQueryPlanErr := planSubQueries(opts, query)
-	if subQueryPlanErr != nil {
-		return nil, subQueryPlanErr
+// limitPeriods makes sure that the query returns at most
+// query.MaxPeriodsPerSeries periods for each series, either by downsampling to
+// a coarser resolution that fits the whole window or by moving asOf forward so
+// that only the most recent periods are included.
+func limitPeriods(query *sql.Query, source core.RowSource, asOf time.Time, asOfChanged bool, until time.Time, resolution time.Duration, strideSlice time.Duration, resolutionChanged bool) (time.Time, bool, time.Duration, bool) {
+	maxPeriods := time.Duration(query.MaxPeriodsPerSeries)
+	window := until.Sub(asOf)
+	if window <= maxPeriods*resolution {
+		// already fits
+		return asOf, asOfChanged, resolution, resolutionChanged
+	}
+
+	if query.DownsampleToFit && strideSlice == 0 {
+		// Use the smallest multiple of the source resolution that fits
+		sourceResolution := source.GetResolution()
+		fitted := (window + maxPeriods - 1) / maxPeriods
+		resolution = ((fitted + sourceResolution - 1) / sourceResolution) * sourceResolution
+		log.Debugf("Downsampling to %v to fit %d periods per series", resolution, query.MaxPeriodsPerSeries)
+		return asOf, asOfChanged, resolution, resolution != sourceResolution
+	}
+
+	asOf = until.Add(-1 * maxPeriods * resolution)
+	query.AsOf = asOf
+	log.Debugf("Truncating to %d periods per series as of %v", query.MaxPeriodsPerSeries, asOf)
+	return asOf, true, resolution, resolutionChanged
+}
+
+// applySubQueryFilters filters the source by the query's WHERE clause, running
+// any subqueries first. If subQueryPlans is non-nil, it holds the subqueries'
+// plans, otherwise they're planned here.
+func applySubQueryFilters(query *sql.Query, opts *Opts, source core.RowSource, subQueryPlans []core.FlatRowSource) (core.RowSource, error) {
+	var runSubQueries func(ctx context.Context) ([][]interface{}, error)
+	if subQueryPlans != nil {
+		runSubQueries = subQueryRunner(subQueriesIn(query), subQueryPlans)
+	} else {
+		var subQueryPlanErr error
+		runSubQueries, subQueryPlanErr = planSubQueries(opts, query)
+		if subQueryPlanErr != nil {
+			return nil, subQueryPlanErr
+		}
 	}
 
 	hasRunSubqueries := int32(0)
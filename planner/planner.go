@@ -13,17 +13,80 @@ var (
 	log = golog.LoggerFor("planner")
 )
 
+// RetentionOverlap determines how a query that reads from multiple tables (via
+// subqueries) treats differences in those tables' retention windows.
+type RetentionOverlap int
+
+const (
+	// RetentionUnion reads each table over its own retention window. This is
+	// the default.
+	RetentionUnion RetentionOverlap = iota
+	// RetentionIntersection clips the query and its subqueries to the window
+	// for which all of the tables have data.
+	RetentionIntersection
+)
+
 type Table interface {
 	core.RowSource
 	GetPartitionBy() []string
 }
 
+// RollupTable is a Table that also keeps a rollup of its data, pre-aggregated
+// by specific dimensions.
+type RollupTable interface {
+	Table
+	// GetRollupBy returns the dimensions by which the rollup is aggregated
+	GetRollupBy() []string
+	// Rollup returns a Table that reads from the rollup, or nil if no rollup is
+	// currently available.
+	Rollup() Table
+}
+
+// DownsampledTable is a Table whose data is also kept at coarser resolutions in
+// separate downsampled tables.
+type DownsampledTable interface {
+	Table
+	// Downsampled returns a Table that reads from the coarsest downsampled table
+	// whose resolution evenly divides the given resolution, or nil if there is
+	// no such table.
+	Downsampled(resolution time.Duration) Table
+}
+
+// DownsamplingTable is a Table that can downsample its data to a coarser
+// resolution while iterating, so that fewer periods need to be grouped.
+type DownsamplingTable interface {
+	Table
+	// DownsampleOnRead returns a Table that reads this table's data downsampled
+	// to the given resolution, or nil if that's not possible.
+	DownsampleOnRead(resolution time.Duration) Table
+}
+
 type Opts struct {
 	GetTable        func(table string, includedFields func(tableFields core.Fields) (core.Fields, error)) (Table, error)
 	Now             func(table string) time.Time
 	IsSubQuery      bool
 	SubQueryResults [][]interface{}
 	QueryCluster    QueryClusterFN
+	// PartitionsFor, if specified, returns the partitions to which QueryCluster
+	// will send the given query. It's used to describe cluster plans.
+	PartitionsFor func(sqlString string) []int
+	// SkipNulls causes periods without data in subquery results to be left out
+	// of the outer query's aggregations rather than being treated as zero.
+	SkipNulls bool
+	// RetentionOverlap determines how the retention windows of tables read by
+	// subqueries are combined with that of the queried table.
+	RetentionOverlap RetentionOverlap
+	// AsOf and Until, if set, override the window of the query (and of any
+	// subqueries), including any ASOF and UNTIL in the SQL. Unlike a window
+	// specified in SQL, the window is clamped to the data available in the
+	// queried table rather than failing if it extends beyond it.
+	AsOf  time.Time
+	Until time.Time
+	// MergeMetadata, if specified, combines the metadata returned by the
+	// queries in a UNION ALL.
+	MergeMetadata func(a interface{}, b interface{}) interface{}
+	// minAsOf, if set, clips the query window to start no earlier than this
+	minAsOf time.Time
 }
 
 func Plan(sqlString string, opts *Opts) (core.FlatRowSource, error) {
@@ -33,6 +96,18 @@ func Plan(sqlString string, opts *Opts) (core.FlatRowSource, error) {
 	}
 
 	fixupSubQuery(query, opts)
+	if !opts.AsOf.IsZero() {
+		query.AsOf = opts.AsOf
+		query.AsOfOffset = 0
+	}
+	if !opts.Until.IsZero() {
+		query.Until = opts.Until
+		query.UntilOffset = 0
+	}
+
+	if len(query.UnionAll) > 0 {
+		return planUnion(query, opts)
+	}
 
 	if opts.QueryCluster != nil {
 		allowPushdown, err := pushdownAllowed(opts, query)
@@ -50,7 +125,7 @@ func Plan(sqlString string, opts *Opts) (core.FlatRowSource, error) {
 	return planLocal(query, opts)
 }
 
-func addGroupBy(source core.RowSource, query *sql.Query, applyResolution bool, resolution time.Duration, strideSlice time.Duration) core.RowSource {
+func addGroupBy(source core.RowSource, query *sql.Query, applyResolution bool, resolution time.Duration, strideSlice time.Duration, streaming bool) core.RowSource {
 	opts := core.GroupOpts{
 		By:                    query.GroupBy,
 		Crosstab:              query.Crosstab,
@@ -59,6 +134,7 @@ func addGroupBy(source core.RowSource, query *sql.Query, applyResolution bool, r
 		AsOf:                  query.AsOf,
 		Until:                 query.Until,
 		StrideSlice:           strideSlice,
+		Streaming:             streaming,
 	}
 	if applyResolution {
 		opts.Resolution = resolution
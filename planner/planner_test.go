@@ -3,6 +3,7 @@ package planner
 import (
 	"context"
 	"fmt"
+	"sort"
 	"testing"
 	"time"
 
@@ -133,7 +134,7 @@ func TestPlans(t *testing.T) {
 
 	nonPushdownScenario("Unknown dim, pushdown not allowed",
 		"SELECT * FROM TableA GROUP BY CONCAT('_', u, v) AS c",
-		"select * from TableA group by u, v",
+		"select * from TableA group by concat('_', u, v) as c",
 		func(source RowSource) RowSource {
 			return Group(source, GroupOpts{
 				Fields: textFieldSource("*"),
@@ -145,7 +146,7 @@ func TestPlans(t *testing.T) {
 		},
 		GroupOpts{
 			Fields: textFieldSource("passthrough"),
-			By:     []GroupBy{NewGroupBy("c", goexpr.Concat(goexpr.Constant("_"), goexpr.Param("u"), goexpr.Param("v")))},
+			By:     []GroupBy{NewGroupBy("c", goexpr.Param("c"))},
 		})
 
 	nonPushdownScenario("CROSSTAB, pushdown not allowed",
@@ -377,7 +378,7 @@ func TestPlans(t *testing.T) {
 
 	nonPushdownScenario("HAVING clause with group by on non partition key, pushdown not allowed",
 		"SELECT * FROM TableA GROUP BY CONCAT(',', z, 'thing') as zplus HAVING a+b > 0",
-		"select *, a+b > 0 as _having from TableA group by z",
+		"select *, a+b > 0 as _having from TableA group by concat(',', z, 'thing') as zplus",
 		func(source RowSource) RowSource {
 			return Group(source, GroupOpts{
 				Fields: textFieldSource("*, a+b > 0 AS _having"),
@@ -389,7 +390,7 @@ func TestPlans(t *testing.T) {
 		},
 		GroupOpts{
 			Fields: textFieldSource("passthrough"),
-			By:     []GroupBy{NewGroupBy("zplus", goexpr.Concat(goexpr.Constant(","), goexpr.Param("z"), goexpr.Constant("thing")))},
+			By:     []GroupBy{NewGroupBy("zplus", goexpr.Param("zplus"))},
 		})
 
 	pushdownScenario("ASOF",
@@ -588,6 +589,133 @@ LIMIT 1
 	verify(plan)
 }
 
+func TestPreAggregatedClusterExecution(t *testing.T) {
+	queries := []string{
+		"SELECT _points, a, b FROM tablea GROUP BY y",
+		"SELECT a, b FROM tablea GROUP BY CONCAT('_', y) AS ystr, period(2s) ORDER BY ystr",
+		"SELECT a + b AS total FROM tablea GROUP BY y HAVING total > 50",
+	}
+
+	run := func(plan FlatRowSource) []string {
+		var rows []string
+		_, err := plan.Iterate(context.Background(), func(fields Fields) error {
+			return nil
+		}, func(row *FlatRow) (bool, error) {
+			rows = append(rows, fmt.Sprintf("%d %v %v", row.TS, row.Key.AsMap(), row.Values))
+			return true, nil
+		})
+		assert.NoError(t, err)
+		sort.Strings(rows)
+		return rows
+	}
+
+	for _, sqlString := range queries {
+		opts := defaultOpts()
+		plan, err := Plan(sqlString, opts)
+		if !assert.NoError(t, err, sqlString) {
+			continue
+		}
+		expected := run(plan)
+		assert.NotEmpty(t, expected, sqlString)
+
+		var partitionQueries []string
+		opts.QueryCluster = func(ctx context.Context, partitionSQL string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields OnFields, onRow OnRow, onFlatRow OnFlatRow) (interface{}, error) {
+			partitionQueries = append(partitionQueries, partitionSQL)
+			return queryPartitions(3)(ctx, partitionSQL, isSubQuery, subQueryResults, unflat, onFields, onRow, onFlatRow)
+		}
+		clusterPlan, err := Plan(sqlString, opts)
+		if !assert.NoError(t, err, sqlString) {
+			continue
+		}
+		assert.Equal(t, expected, run(clusterPlan), sqlString)
+		for _, partitionSQL := range partitionQueries {
+			assert.Contains(t, partitionSQL, "group by", "Partitions should pre-aggregate")
+			assert.NotContains(t, partitionSQL, "having", "Leader should apply having")
+		}
+	}
+}
+
+func TestMaxPeriodsPerSeries(t *testing.T) {
+	run := func(sqlString string) (FlatRowSource, map[int64]bool, float64) {
+		plan, err := Plan(sqlString, defaultOpts())
+		if !assert.NoError(t, err, sqlString) {
+			t.FailNow()
+		}
+		periods := make(map[int64]bool)
+		total := float64(0)
+		_, err = plan.Iterate(context.Background(), FieldsIgnored, func(row *FlatRow) (bool, error) {
+			periods[row.TS] = true
+			total += row.Values[0]
+			return true, nil
+		})
+		if !assert.NoError(t, err, sqlString) {
+			t.FailNow()
+		}
+		return plan, periods, total
+	}
+
+	_, fullPeriods, fullTotal := run("SELECT a FROM tablea ASOF '-10s'")
+	assert.True(t, len(fullPeriods) > 3, "Full query should return more periods than our limit")
+
+	plan, periods, total := run("SELECT -- max_periods_per_series=3\na FROM tablea ASOF '-10s'")
+	assert.Equal(t, resolution, plan.GetResolution(), "Truncating shouldn't change resolution")
+	assert.True(t, len(periods) <= 3, "Should have truncated to 3 periods, got %d", len(periods))
+	assert.True(t, periods[epoch.UnixNano()], "Truncating should keep the most recent period")
+	for ts := range periods {
+		assert.False(t, time.Unix(0, ts).Before(epoch.Add(-3*resolution)), "Truncated periods should be recent")
+	}
+	assert.True(t, total < fullTotal, "Truncating should have dropped older values")
+
+	plan, periods, total = run("SELECT -- max_periods_per_series=3 downsample\na FROM tablea ASOF '-10s'")
+	assert.Equal(t, 4*resolution, plan.GetResolution(), "Should have downsampled to fit window")
+	assert.True(t, len(periods) <= 4, "Should have downsampled to about 3 periods, got %d", len(periods))
+	assert.Equal(t, fullTotal, total, "Downsampling should preserve all values")
+}
+
+// queryPartitions is like queryCluster but queries multiple partitions, sending
+// fields only once like the real cluster code does.
+func queryPartitions(numPartitions int) QueryClusterFN {
+	return func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields OnFields, onRow OnRow, onFlatRow OnFlatRow) (interface{}, error) {
+		sentFields := false
+		onFieldsOnce := func(fields Fields) error {
+			if sentFields {
+				return nil
+			}
+			sentFields = true
+			return onFields(fields)
+		}
+		for i := 0; i < numPartitions; i++ {
+			opts := defaultOpts()
+			opts.IsSubQuery = isSubQuery
+			opts.SubQueryResults = subQueryResults
+			partitionNumber := i
+			opts.GetTable = func(table string, includedFields func(tableFields Fields) (Fields, error)) (Table, error) {
+				part := &partition{
+					partition:     partitionNumber,
+					numPartitions: numPartitions,
+				}
+				part.name = table
+				var err error
+				part.fields, err = includedFields(defaultFields)
+				return part, err
+			}
+			plan, err := Plan(sqlString, opts)
+			if err != nil {
+				return nil, err
+			}
+			if unflat {
+				_, err = UnflattenOptimized(plan).Iterate(ctx, onFieldsOnce, onRow)
+			} else {
+				_, err = plan.Iterate(ctx, onFieldsOnce, onFlatRow)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+}
+
 func defaultOpts() *Opts {
 	return &Opts{
 		GetTable: func(table string, includedFields func(tableFields Fields) (Fields, error)) (Table, error) {
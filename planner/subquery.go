@@ -11,21 +11,38 @@ import (
 )
 
 func planSubQueries(opts *Opts, query *sql.Query) (func(ctx context.Context) ([][]interface{}, error), error) {
+	subQueries := subQueriesIn(query)
+	if len(opts.SubQueryResults) == len(subQueries) {
+		for i, sq := range subQueries {
+			sq.SetResult(opts.SubQueryResults[i])
+		}
+		return noopSubQueries, nil
+	}
+
+	subQueryPlans, err := planEachSubQuery(opts, subQueries)
+	if err != nil {
+		return nil, err
+	}
+	return subQueryRunner(subQueries, subQueryPlans), nil
+}
+
+// subQueriesIn returns the subqueries in the query's WHERE clause.
+func subQueriesIn(query *sql.Query) []*sql.SubQuery {
 	var subQueries []*sql.SubQuery
+	if query.Where == nil {
+		return subQueries
+	}
 	query.Where.WalkLists(func(list goexpr.List) {
 		sq, ok := list.(*sql.SubQuery)
 		if ok {
 			subQueries = append(subQueries, sq)
 		}
 	})
-	if len(opts.SubQueryResults) == len(subQueries) {
-		for i, sq := range subQueries {
-			sq.SetResult(opts.SubQueryResults[i])
-		}
-		return noopSubQueries, nil
-	}
+	return subQueries
+}
 
-	var subQueryPlans []core.FlatRowSource
+func planEachSubQuery(opts *Opts, subQueries []*sql.SubQuery) ([]core.FlatRowSource, error) {
+	subQueryPlans := make([]core.FlatRowSource, 0, len(subQueries))
 	sqOpts := &Opts{}
 	*sqOpts = *opts
 	sqOpts.IsSubQuery = true
@@ -36,9 +53,14 @@ func planSubQueries(opts *Opts, query *sql.Query) (func(ctx context.Context) ([]
 		}
 		subQueryPlans = append(subQueryPlans, sqPlan)
 	}
+	return subQueryPlans, nil
+}
 
+// subQueryRunner returns a function that runs the given subqueries using the
+// corresponding plans and sets their results.
+func subQueryRunner(subQueries []*sql.SubQuery, subQueryPlans []core.FlatRowSource) func(ctx context.Context) ([][]interface{}, error) {
 	if len(subQueries) == 0 {
-		return noopSubQueries, nil
+		return noopSubQueries
 	}
 
 	return func(ctx context.Context) ([][]interface{}, error) {
@@ -87,7 +109,7 @@ func planSubQueries(opts *Opts, query *sql.Query) (func(ctx context.Context) ([]
 			subQueryResults = append(subQueryResults, result.dims)
 		}
 		return subQueryResults, finalErr
-	}, nil
+	}
 }
 
 type sqResult struct {
@@ -0,0 +1,50 @@
+package planner
+
+import (
+	"fmt"
+
+	"github.com/getlantern/goexpr"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/sql"
+)
+
+// planUnion plans a UNION ALL by planning each SELECT on its own, chaining
+// their results and re-aggregating them by the GROUP BY of the first SELECT.
+// The SELECTs need to yield fields with the same names at the same
+// resolution.
+func planUnion(query *sql.Query, opts *Opts) (core.FlatRowSource, error) {
+	if query.HasSelectAll {
+		return nil, fmt.Errorf("SELECT * is not supported in UNION ALL, please list the fields to select")
+	}
+	queries := append([]*sql.Query{query}, query.UnionAll...)
+	sources := make([]core.RowSource, 0, len(queries))
+	for _, member := range queries {
+		if member.Crosstab != nil {
+			return nil, fmt.Errorf("CROSSTAB is not supported in UNION ALL")
+		}
+		flat, err := Plan(member.SQL, opts)
+		if err != nil {
+			return nil, err
+		}
+		if opts.SkipNulls {
+			sources = append(sources, core.UnflattenSkippingNulls(flat, member.FieldsNoHaving))
+		} else {
+			sources = append(sources, core.Unflatten(flat, member.FieldsNoHaving))
+		}
+	}
+
+	source, err := core.Union(opts.MergeMetadata, sources...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SELECTs have already evaluated their GROUP BY expressions, so group
+	// by the resulting dimensions
+	groupBy := make([]core.GroupBy, 0, len(query.GroupBy))
+	for _, gb := range query.GroupBy {
+		groupBy = append(groupBy, core.NewGroupBy(gb.Name, goexpr.Param(gb.Name)))
+	}
+	return core.Flatten(core.Group(source, core.GroupOpts{
+		By: groupBy,
+	})), nil
+}
@@ -0,0 +1,162 @@
+package zenodb
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "zenodb"
+)
+
+var (
+	tableLabels = []string{"table"}
+
+	insertedPointsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "inserted_points_total"),
+		"Number of points inserted into the table",
+		tableLabels, nil)
+	filteredPointsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "filtered_points_total"),
+		"Number of points excluded by the table's WHERE clause",
+		tableLabels, nil)
+	droppedPointsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "dropped_points_total"),
+		"Number of points that couldn't be inserted into the table",
+		tableLabels, nil)
+	latePointsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "late_points_total"),
+		"Number of points dropped for arriving later than the table's maximum lateness",
+		tableLabels, nil)
+	rejectedPointsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "rejected_points_total"),
+		"Number of points rejected by the table's insert interceptor",
+		tableLabels, nil)
+	flushesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "flushes_total"),
+		"Number of successful flushes of the table's memstore",
+		tableLabels, nil)
+	flushedBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "flushed_bytes_total"),
+		"Number of bytes written to disk by flushes",
+		tableLabels, nil)
+	flushFailuresDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "flush_failures_total"),
+		"Number of attempts to write a flush that failed",
+		tableLabels, nil)
+	insertQueueDepthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "insert_queue_depth"),
+		"Number of inserts waiting to be applied to the memstore",
+		tableLabels, nil)
+	memStoreBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "memstore_bytes"),
+		"Current size of the table's memstore",
+		tableLabels, nil)
+	bytesOnDiskDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "bytes_on_disk"),
+		"Size on disk of the table's file store",
+		tableLabels, nil)
+)
+
+// prometheusMetrics holds the metrics that are recorded as things happen
+// rather than being read from TableStats on collection.
+type prometheusMetrics struct {
+	flushDuration   *prometheus.HistogramVec
+	iterateDuration *prometheus.HistogramVec
+}
+
+// RegisterMetrics registers Prometheus metrics for all of db's tables with reg.
+// Counters and gauges are read from each table's TableStats whenever the
+// metrics are collected, so tables created after registering are included too.
+// Flush and query iterate durations are recorded as histograms from the time of
+// registering on. All metrics are labeled with the table name.
+func RegisterMetrics(reg prometheus.Registerer, db *DB) error {
+	m := &prometheusMetrics{
+		flushDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "flush_duration_seconds",
+			Help:      "How long successful flushes took",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 15),
+		}, tableLabels),
+		iterateDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "query_iterate_duration_seconds",
+			Help:      "How long iterating over the table took when querying it",
+			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 18),
+		}, tableLabels),
+	}
+	if err := reg.Register(&tableCollector{db: db, metrics: m}); err != nil {
+		return err
+	}
+	db.prometheusMetrics.Store(m)
+	return nil
+}
+
+func (db *DB) getPrometheusMetrics() *prometheusMetrics {
+	m, _ := db.prometheusMetrics.Load().(*prometheusMetrics)
+	return m
+}
+
+// observeFlush records the duration of a successful flush of the given table,
+// if metrics have been registered.
+func (db *DB) observeFlush(table string, duration time.Duration) {
+	if m := db.getPrometheusMetrics(); m != nil {
+		m.flushDuration.WithLabelValues(table).Observe(duration.Seconds())
+	}
+}
+
+// observeIterate records how long iterating over the given table took for a
+// query, if metrics have been registered.
+func (db *DB) observeIterate(table string, duration time.Duration) {
+	if m := db.getPrometheusMetrics(); m != nil {
+		m.iterateDuration.WithLabelValues(table).Observe(duration.Seconds())
+	}
+}
+
+// tableCollector is a prometheus.Collector that reports TableStats for all of
+// a DB's tables, plus the histograms in metrics.
+type tableCollector struct {
+	db      *DB
+	metrics *prometheusMetrics
+}
+
+func (c *tableCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- insertedPointsDesc
+	ch <- filteredPointsDesc
+	ch <- droppedPointsDesc
+	ch <- latePointsDesc
+	ch <- rejectedPointsDesc
+	ch <- flushesDesc
+	ch <- flushedBytesDesc
+	ch <- flushFailuresDesc
+	ch <- insertQueueDepthDesc
+	ch <- memStoreBytesDesc
+	ch <- bytesOnDiskDesc
+	c.metrics.flushDuration.Describe(ch)
+	c.metrics.iterateDuration.Describe(ch)
+}
+
+func (c *tableCollector) Collect(ch chan<- prometheus.Metric) {
+	for name, stats := range c.db.AllTableStats() {
+		counter := func(desc *prometheus.Desc, value int64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), name)
+		}
+		gauge := func(desc *prometheus.Desc, value int64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value), name)
+		}
+		counter(insertedPointsDesc, stats.InsertedPoints)
+		counter(filteredPointsDesc, stats.FilteredPoints)
+		counter(droppedPointsDesc, stats.DroppedPoints)
+		counter(latePointsDesc, stats.LatePoints)
+		counter(rejectedPointsDesc, stats.RejectedPoints)
+		counter(flushesDesc, stats.RowStore.Flushes)
+		counter(flushedBytesDesc, stats.RowStore.FlushedBytes)
+		counter(flushFailuresDesc, stats.RowStore.FlushFailures)
+		gauge(insertQueueDepthDesc, stats.InsertQueueDepth)
+		gauge(memStoreBytesDesc, stats.RowStore.MemStoreBytes)
+		gauge(bytesOnDiskDesc, stats.RowStore.BytesOnDisk)
+	}
+	c.metrics.flushDuration.Collect(ch)
+	c.metrics.iterateDuration.Collect(ch)
+}
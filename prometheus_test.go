@@ -0,0 +1,73 @@
+package zenodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "measured", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	reg := prometheus.NewRegistry()
+	if !assert.NoError(t, RegisterMetrics(reg, db)) {
+		return
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	_, err := db.InsertBatch("measured", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch, Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 2}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	db.getTable("measured").forceFlush()
+	source, err := db.Query("SELECT v FROM measured", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	families, err := reg.Gather()
+	if !assert.NoError(t, err) {
+		return
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if assert.Len(t, metric.GetLabel(), 1) {
+				assert.Equal(t, "table", metric.GetLabel()[0].GetName())
+				assert.Equal(t, "measured", metric.GetLabel()[0].GetValue())
+			}
+			switch {
+			case metric.GetCounter() != nil:
+				values[family.GetName()] = metric.GetCounter().GetValue()
+			case metric.GetGauge() != nil:
+				values[family.GetName()] = metric.GetGauge().GetValue()
+			case metric.GetHistogram() != nil:
+				values[family.GetName()] = float64(metric.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+
+	assert.EqualValues(t, 2, values["zenodb_inserted_points_total"])
+	assert.EqualValues(t, 1, values["zenodb_flushes_total"])
+	assert.True(t, values["zenodb_flushed_bytes_total"] > 0, "Flushed bytes should have been counted")
+	assert.EqualValues(t, 0, values["zenodb_flush_failures_total"])
+	assert.EqualValues(t, 1, values["zenodb_flush_duration_seconds"], "Flush should have been observed")
+	assert.EqualValues(t, 1, values["zenodb_query_iterate_duration_seconds"], "Query should have been observed")
+
+	assert.Error(t, RegisterMetrics(reg, db), "Registering twice should fail")
+}
@@ -4,13 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/getlantern/bytemap"
 
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
 	"github.com/getlantern/zenodb/planner"
 	"github.com/getlantern/zenodb/sql"
 )
@@ -20,6 +24,84 @@ var (
 )
 
 func (db *DB) Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (core.FlatRowSource, error) {
+	return db.query(sqlString, isSubQuery, subQueryResults, includeMemStore, time.Time{}, time.Time{}, nil, db.opts.QueryTimeout)
+}
+
+// QueryWithTimeout is like Query, but limits how long iterating over the
+// results may take to the given timeout instead of DBOpts.QueryTimeout. Once
+// the timeout expires, iterating stops and returns context.DeadlineExceeded. A
+// timeout of 0 disables the limit.
+func (db *DB) QueryWithTimeout(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, timeout time.Duration) (core.FlatRowSource, error) {
+	return db.query(sqlString, isSubQuery, subQueryResults, includeMemStore, time.Time{}, time.Time{}, nil, timeout)
+}
+
+// QueryWindow is like Query, but queries the window between asOf and until
+// instead of the window given by the SQL or, by default, the table's retention
+// period. A zero asOf or until leaves that end of the window alone. The window
+// is clamped to the data available in the queried table, and the resulting
+// window is reported by MetaDataFor. This isn't supported in Passthrough mode,
+// where the window has to be specified in the SQL instead.
+func (db *DB) QueryWindow(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, asOf time.Time, until time.Time) (core.FlatRowSource, error) {
+	if db.opts.Passthrough && (!asOf.IsZero() || !until.IsZero()) {
+		return nil, errors.New("Overriding the query window isn't supported in Passthrough mode, use ASOF and UNTIL instead")
+	}
+	return db.query(sqlString, isSubQuery, subQueryResults, includeMemStore, asOf, until, nil, db.opts.QueryTimeout)
+}
+
+// Explain plans the given query without running it and returns a
+// machine-readable description of the plan.
+func (db *DB) Explain(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (*core.PlanNode, error) {
+	plan, err := db.plan(sqlString, isSubQuery, subQueryResults, includeMemStore, time.Time{}, time.Time{}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return core.DescribeSource(plan), nil
+}
+
+// ExplainText is like Explain, but returns the plan in the same human-readable
+// format that's logged when running queries.
+func (db *DB) ExplainText(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool) (string, error) {
+	plan, err := db.plan(sqlString, isSubQuery, subQueryResults, includeMemStore, time.Time{}, time.Time{}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	return core.FormatSource(plan), nil
+}
+
+func (db *DB) query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, asOf time.Time, until time.Time, session *Session, timeout time.Duration) (core.FlatRowSource, error) {
+	var tables []string
+	cacheable := db.queryCache != nil && session == nil
+	plan, err := db.plan(sqlString, isSubQuery, subQueryResults, includeMemStore, asOf, until, session, func(table string, includeMemStore bool) {
+		tables = append(tables, strings.ToLower(table))
+		if includeMemStore {
+			// Results that include the mem store change with every insert
+			cacheable = false
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cacheable && len(tables) > 0 {
+		plan = &cachingSource{
+			cache:           db.queryCache,
+			source:          plan,
+			sqlString:       sqlString,
+			isSubQuery:      isSubQuery,
+			subQueryResults: subQueryResults,
+			tables:          tables,
+		}
+	}
+	db.log.Debugf("\n------------ Query Plan ------------\n\n%v\n\n%v\n----------- End Query Plan ----------", sqlString, core.FormatSource(plan))
+	if db.opts.ScanWarningRows > 0 || db.opts.ScanWarningBytes > 0 {
+		plan = &scanWarner{db: db, source: plan, sqlString: sqlString}
+	}
+	return &emptyResultTracker{source: plan, timeout: timeout}, nil
+}
+
+// plan plans the given query. A non-zero asOf or until overrides the query's
+// window (see planner.Opts). If onTable is specified, it's called for every
+// table that the query reads from.
+func (db *DB) plan(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, includeMemStore bool, asOf time.Time, until time.Time, session *Session, onTable func(table string, includeMemStore bool)) (core.FlatRowSource, error) {
 	q, err := sql.Parse(sqlString)
 	if err != nil {
 		return nil, err
@@ -32,23 +114,68 @@ func (db *DB) Query(sqlString string, isSubQuery bool, subQueryResults [][]inter
 
 	opts := &planner.Opts{
 		GetTable: func(table string, outFields func(tableFields core.Fields) (core.Fields, error)) (planner.Table, error) {
+			if session != nil {
+				if err := session.waitForInserts(table); err != nil {
+					return nil, err
+				}
+			}
+			if onTable != nil {
+				onTable(table, includeMemStore)
+			}
 			return db.getQueryable(table, outFields, includeMemStore)
 		},
-		Now:             db.now,
-		IsSubQuery:      isSubQuery,
-		SubQueryResults: subQueryResults,
+		Now:              db.now,
+		IsSubQuery:       isSubQuery,
+		SubQueryResults:  subQueryResults,
+		SkipNulls:        db.opts.SkipNulls,
+		RetentionOverlap: db.opts.RetentionOverlap,
+		AsOf:             asOf,
+		Until:            until,
+		MergeMetadata:    mergeQueryStats,
 	}
 	if db.opts.Passthrough {
 		opts.QueryCluster = func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
 			return db.queryCluster(ctx, sqlString, isSubQuery, subQueryResults, includeMemStore, unflat, onFields, onRow, onFlatRow)
 		}
+		opts.PartitionsFor = db.partitionsFor
 	}
-	plan, err := planner.Plan(sqlString, opts)
-	if err != nil {
-		return nil, err
+	return planner.Plan(sqlString, opts)
+}
+
+// mergeQueryStats combines the *common.QueryStats of queries that were run one
+// after the other, as in a UNION ALL.
+func mergeQueryStats(a interface{}, b interface{}) interface{} {
+	statsA, ok := a.(*common.QueryStats)
+	if !ok {
+		return b
 	}
-	db.log.Debugf("\n------------ Query Plan ------------\n\n%v\n\n%v\n----------- End Query Plan ----------", sqlString, core.FormatSource(plan))
-	return plan, nil
+	statsB, ok := b.(*common.QueryStats)
+	if !ok {
+		return a
+	}
+	merged := *statsA
+	merged.NumPartitions += statsB.NumPartitions
+	merged.NumSuccessfulPartitions += statsB.NumSuccessfulPartitions
+	if merged.LowestHighWaterMark == 0 || (statsB.LowestHighWaterMark != 0 && statsB.LowestHighWaterMark < merged.LowestHighWaterMark) {
+		merged.LowestHighWaterMark = statsB.LowestHighWaterMark
+	}
+	if statsB.HighestHighWaterMark > merged.HighestHighWaterMark {
+		merged.HighestHighWaterMark = statsB.HighestHighWaterMark
+	}
+	merged.MissingPartitions = append(append([]int(nil), statsA.MissingPartitions...), statsB.MissingPartitions...)
+	merged.RowsScanned += statsB.RowsScanned
+	merged.BytesScanned += statsB.BytesScanned
+	merged.RowsInRetention += statsB.RowsInRetention
+	merged.BytesDecompressed += statsB.BytesDecompressed
+	merged.FilesRead += statsB.FilesRead
+	merged.Elapsed += statsB.Elapsed
+	merged.Empty = statsA.Empty && statsB.Empty
+	if !merged.Empty {
+		merged.EmptyReason = ""
+	}
+	merged.Warnings = append(append([]string(nil), statsA.Warnings...), statsB.Warnings...)
+	merged.SkippedFiles = append(append([]string(nil), statsA.SkippedFiles...), statsB.SkippedFiles...)
+	return &merged
 }
 
 func (db *DB) getQueryable(table string, outFields func(tableFields core.Fields) (core.Fields, error), includeMemStore bool) (*queryable, error) {
@@ -69,17 +196,210 @@ func (db *DB) getQueryable(table string, outFields func(tableFields core.Fields)
 	if out == nil {
 		out = t.getFields()
 	}
-	return &queryable{db, t, out, asOf, until, includeMemStore}, nil
+	if err := t.checkDroppedFields(out); err != nil {
+		return nil, err
+	}
+	return &queryable{db, t, out, asOf, until, includeMemStore, false, outFields, 0, nil}, nil
 }
 
+// MetaDataFor returns the metadata for a query. Warnings, Empty and the
+// execution stats are only populated once the query has finished iterating, so
+// callers that want them (like the RPC server) should call this again after
+// Iterate returns.
 func MetaDataFor(source core.FlatRowSource, fields core.Fields) *common.QueryMetaData {
-	return &common.QueryMetaData{
-		FieldNames: fields.Names(),
-		AsOf:       source.GetAsOf(),
-		Until:      source.GetUntil(),
-		Resolution: source.GetResolution(),
-		Plan:       core.FormatSource(source),
+	var empty bool
+	var emptyReason common.EmptyReason
+	var stats *common.QueryStats
+	if ert, ok := source.(*emptyResultTracker); ok {
+		empty, emptyReason = ert.getEmpty()
+		stats = ert.getStats()
+		source = ert.source
+	}
+	md := &common.QueryMetaData{
+		FieldNames:  fields.Names(),
+		AsOf:        source.GetAsOf(),
+		Until:       source.GetUntil(),
+		Resolution:  source.GetResolution(),
+		Plan:        core.FormatSource(source),
+		Empty:       empty,
+		EmptyReason: emptyReason,
+	}
+	if stats != nil {
+		md.RowsScanned = stats.RowsScanned
+		md.BytesScanned = stats.BytesScanned
+		md.BytesDecompressed = stats.BytesDecompressed
+		md.FilesRead = stats.FilesRead
+		md.Elapsed = stats.Elapsed
 	}
+	if sw, ok := source.(*scanWarner); ok {
+		md.Warnings = sw.getWarnings()
+	}
+	return md
+}
+
+// scanWarner wraps a query plan and warns if the query ended up scanning more
+// data than configured by DBOpts.ScanWarningRows or DBOpts.ScanWarningBytes.
+type scanWarner struct {
+	db        *DB
+	source    core.FlatRowSource
+	sqlString string
+	warnings  []string
+	mx        sync.Mutex
+}
+
+func (sw *scanWarner) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	result, err := sw.source.Iterate(ctx, onFields, onRow)
+	stats, ok := result.(*common.QueryStats)
+	if !ok || stats == nil {
+		return result, err
+	}
+
+	var warnings []string
+	if sw.db.opts.ScanWarningRows > 0 && stats.RowsScanned > sw.db.opts.ScanWarningRows {
+		warnings = append(warnings, fmt.Sprintf("Query scanned %v rows, more than the warning threshold of %v", humanize.Comma(stats.RowsScanned), humanize.Comma(sw.db.opts.ScanWarningRows)))
+	}
+	if sw.db.opts.ScanWarningBytes > 0 && stats.BytesScanned > sw.db.opts.ScanWarningBytes {
+		warnings = append(warnings, fmt.Sprintf("Query scanned %v, more than the warning threshold of %v", humanize.Bytes(uint64(stats.BytesScanned)), humanize.Bytes(uint64(sw.db.opts.ScanWarningBytes))))
+	}
+	for _, warning := range warnings {
+		sw.db.log.Errorf("%v\n%v\n%v", warning, sw.sqlString, core.FormatSource(sw.source))
+	}
+	if len(warnings) > 0 {
+		stats.Warnings = append(stats.Warnings, warnings...)
+		sw.mx.Lock()
+		sw.warnings = append(sw.warnings, warnings...)
+		sw.mx.Unlock()
+	}
+	return result, err
+}
+
+func (sw *scanWarner) getWarnings() []string {
+	sw.mx.Lock()
+	defer sw.mx.Unlock()
+	return append([]string(nil), sw.warnings...)
+}
+
+func (sw *scanWarner) GetGroupBy() []core.GroupBy {
+	return sw.source.GetGroupBy()
+}
+
+func (sw *scanWarner) GetResolution() time.Duration {
+	return sw.source.GetResolution()
+}
+
+func (sw *scanWarner) GetAsOf() time.Time {
+	return sw.source.GetAsOf()
+}
+
+func (sw *scanWarner) GetUntil() time.Time {
+	return sw.source.GetUntil()
+}
+
+func (sw *scanWarner) GetSource() core.Source {
+	return sw.source
+}
+
+func (sw *scanWarner) String() string {
+	return fmt.Sprintf("warn on scanning more than %d rows or %d bytes", sw.db.opts.ScanWarningRows, sw.db.opts.ScanWarningBytes)
+}
+
+// emptyResultTracker wraps a query plan and records whether and why the query
+// returned no rows. Stats from the query are annotated with the result, which
+// is also picked up by MetaDataFor once the query has finished iterating, along
+// with the stats themselves.
+type emptyResultTracker struct {
+	source core.FlatRowSource
+	// timeout, if positive, limits how long Iterate may take
+	timeout     time.Duration
+	empty       bool
+	emptyReason common.EmptyReason
+	stats       *common.QueryStats
+	mx          sync.Mutex
+}
+
+func (ert *emptyResultTracker) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	var rows int64
+	start := time.Now()
+	var timeoutCtx context.Context
+	if ert.timeout > 0 {
+		var cancel context.CancelFunc
+		timeoutCtx, cancel = context.WithTimeout(ctx, ert.timeout)
+		defer cancel()
+		ctx = timeoutCtx
+	}
+	result, err := ert.source.Iterate(ctx, onFields, func(row *core.FlatRow) (bool, error) {
+		rows++
+		return onRow(row)
+	})
+	if err != nil && timeoutCtx != nil && timeoutCtx.Err() == context.DeadlineExceeded {
+		// Report the timeout consistently, regardless of which part of the query
+		// noticed it first
+		err = context.DeadlineExceeded
+	}
+	stats, _ := result.(*common.QueryStats)
+	if stats != nil {
+		// Report the wall-clock time of the whole query, including any time
+		// spent querying the cluster and post-processing results
+		stats.Elapsed = time.Since(start)
+		ert.mx.Lock()
+		ert.stats = stats
+		ert.mx.Unlock()
+	}
+	if err != nil || rows > 0 {
+		return result, err
+	}
+
+	reason := common.EmptyReasonNoMatchingKeys
+	if stats != nil {
+		if stats.RowsScanned == 0 {
+			reason = common.EmptyReasonTableEmpty
+		} else if stats.RowsInRetention == 0 {
+			reason = common.EmptyReasonAllExpired
+		}
+		stats.Empty = true
+		stats.EmptyReason = reason
+	}
+	ert.mx.Lock()
+	ert.empty = true
+	ert.emptyReason = reason
+	ert.mx.Unlock()
+	return result, err
+}
+
+func (ert *emptyResultTracker) getEmpty() (bool, common.EmptyReason) {
+	ert.mx.Lock()
+	defer ert.mx.Unlock()
+	return ert.empty, ert.emptyReason
+}
+
+func (ert *emptyResultTracker) getStats() *common.QueryStats {
+	ert.mx.Lock()
+	defer ert.mx.Unlock()
+	return ert.stats
+}
+
+func (ert *emptyResultTracker) GetGroupBy() []core.GroupBy {
+	return ert.source.GetGroupBy()
+}
+
+func (ert *emptyResultTracker) GetResolution() time.Duration {
+	return ert.source.GetResolution()
+}
+
+func (ert *emptyResultTracker) GetAsOf() time.Time {
+	return ert.source.GetAsOf()
+}
+
+func (ert *emptyResultTracker) GetUntil() time.Time {
+	return ert.source.GetUntil()
+}
+
+func (ert *emptyResultTracker) GetSource() core.Source {
+	return ert.source
+}
+
+func (ert *emptyResultTracker) String() string {
+	return "track empty results"
 }
 
 type queryable struct {
@@ -89,6 +409,15 @@ type queryable struct {
 	asOf            time.Time
 	until           time.Time
 	includeMemStore bool
+	// rollup indicates that this queryable reads from the table's rollup
+	rollup bool
+	// outFields is used to select fields from downsampled tables
+	outFields func(tableFields core.Fields) (core.Fields, error)
+	// resolution, if set, is the coarser resolution to which this queryable
+	// downsamples the table's data while iterating
+	resolution time.Duration
+	// subMerges merge each field's periods into the coarser resolution
+	subMerges []expr.SubMerge
 }
 
 func (q *queryable) GetGroupBy() []core.GroupBy {
@@ -96,6 +425,9 @@ func (q *queryable) GetGroupBy() []core.GroupBy {
 }
 
 func (q *queryable) GetResolution() time.Duration {
+	if q.resolution > 0 {
+		return q.resolution
+	}
 	return q.t.Resolution
 }
 
@@ -111,8 +443,104 @@ func (q *queryable) GetPartitionBy() []string {
 	return q.t.PartitionBy
 }
 
+func (q *queryable) GetRollupBy() []string {
+	return q.t.RollupBy
+}
+
+func (q *queryable) Rollup() planner.Table {
+	if q.includeMemStore || q.t.rowStore == nil || !q.t.rowStore.hasRollup() {
+		// the rollup doesn't include the memstore
+		return nil
+	}
+	rollup := *q
+	rollup.rollup = true
+	return &rollup
+}
+
+func (q *queryable) Downsampled(resolution time.Duration) planner.Table {
+	if q.includeMemStore || q.rollup {
+		// downsampled tables don't include the memstore
+		return nil
+	}
+	for _, downsampled := range q.t.getRollups() {
+		if !downsampled.hasRolledUp() || resolution%downsampled.Resolution != 0 {
+			continue
+		}
+		dq, err := q.db.getQueryable(downsampled.Name, q.outFields, false)
+		if err == nil && dq.hasFields(q.fields) {
+			return dq
+		}
+	}
+	return nil
+}
+
+// DownsampleOnRead returns a queryable that downsamples the table's data to the
+// given resolution while iterating, merging adjacent periods of each field
+// according to the field's aggregation. Periods are aligned to the end of the
+// table's window using encoding.RoundTimeUntilUp, just like grouping would
+// align them, so the results are the same as grouping the full resolution
+// data. It returns nil if the resolution isn't a multiple of the table's or if
+// any of the fields can't be merged across periods.
+func (q *queryable) DownsampleOnRead(resolution time.Duration) planner.Table {
+	if q.resolution > 0 || resolution <= q.t.Resolution || resolution%q.t.Resolution != 0 {
+		return nil
+	}
+	subMerges := make([]expr.SubMerge, 0, len(q.fields))
+	for _, field := range q.fields {
+		subMerge := field.Expr.SubMergers([]expr.Expr{field.Expr})[0]
+		if subMerge == nil {
+			return nil
+		}
+		subMerges = append(subMerges, subMerge)
+	}
+	downsampled := *q
+	downsampled.resolution = resolution
+	downsampled.subMerges = subMerges
+	return &downsampled
+}
+
+// downsample merges the periods of the given vals into periods at q.resolution.
+func (q *queryable) downsample(key bytemap.ByteMap, vals []encoding.Sequence) []encoding.Sequence {
+	downsampled := make([]encoding.Sequence, len(vals))
+	for i, val := range vals {
+		if len(val) == 0 {
+			continue
+		}
+		e := q.fields[i].Expr
+		downsampled[i] = encoding.Sequence(nil).SubMerge(val, key, q.resolution, q.t.Resolution, e, e, q.subMerges[i], q.asOf, q.until, 0)
+	}
+	return downsampled
+}
+
+// hasFields indicates whether this queryable includes all of the given fields.
+func (q *queryable) hasFields(fields core.Fields) bool {
+	names := make(map[string]bool, len(q.fields))
+	for _, field := range q.fields {
+		names[field.Name] = true
+	}
+	for _, field := range fields {
+		if !names[field.Name] {
+			return false
+		}
+	}
+	return true
+}
+
 func (q *queryable) String() string {
-	return q.t.Name
+	name := q.t.Name
+	if q.rollup {
+		name = fmt.Sprintf("%v (rollup by %v)", q.t.Name, strings.Join(q.t.RollupBy, ", "))
+	}
+	if q.resolution > 0 {
+		name = fmt.Sprintf("%v (downsampled to %v)", name, q.resolution)
+	}
+	return name
+}
+
+func (q *queryable) DescribePlan(node *core.PlanNode) {
+	node.Type = "table"
+	node.Table = q.t.Name
+	node.Fields = q.fields.Names()
 }
 
 func (q *queryable) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnRow) (interface{}, error) {
@@ -127,9 +555,20 @@ func (q *queryable) Iterate(ctx context.Context, onFields core.OnFields, onRow c
 	}
 
 	i := 1
+	var rowsScanned, bytesScanned, rowsInRetention int64
+	start := time.Now()
+	// Skip corrupt files rather than failing the whole query
+	ctx, skipped := withSkippedFiles(ctx)
+	ctx, scanned := withScanStats(ctx)
 	// When iterating, as an optimization, we read only the needed fields (not
 	// all table fields).
-	highWaterMarks, err := q.t.iterate(ctx, q.fields, q.includeMemStore, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+	iterate := q.t.iterateWithTruncateBefore
+	if q.rollup {
+		iterate = func(ctx context.Context, outFields core.Fields, includeMemStore bool, truncateBefore time.Time, onValue func(bytemap.ByteMap, []encoding.Sequence) (bool, error)) (common.OffsetsBySource, error) {
+			return q.t.rowStore.iterateRollup(ctx, outFields, truncateBefore, onValue)
+		}
+	}
+	highWaterMarks, err := iterate(ctx, q.fields, q.includeMemStore, q.asOf, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
 		if i%1000 == 0 {
 			// every 1000 rows, check and cap memory size
 			if !q.db.capMemorySize(false) {
@@ -138,8 +577,24 @@ func (q *queryable) Iterate(ctx context.Context, onFields core.OnFields, onRow c
 			}
 		}
 		i++
+		rowsScanned++
+		bytesScanned += int64(len(key))
+		inRetention := false
+		for _, val := range vals {
+			bytesScanned += int64(len(val))
+			if len(val) > 0 && !val.Until().Before(q.asOf) {
+				inRetention = true
+			}
+		}
+		if inRetention {
+			rowsInRetention++
+		}
+		if q.resolution > 0 {
+			vals = q.downsample(key, vals)
+		}
 		return onRow(key, vals)
 	})
+	q.db.observeIterate(q.t.Name, time.Since(start))
 	if err != nil {
 		q.t.log.Errorf("Error on iterating: %v", err)
 	}
@@ -147,10 +602,18 @@ func (q *queryable) Iterate(ctx context.Context, onFields core.OnFields, onRow c
 	if err == nil {
 		numSuccessfulPartitions = 1
 	}
+	filesRead, bytesDecompressed := scanned.get()
 	return &common.QueryStats{
 		NumPartitions:           1,
 		NumSuccessfulPartitions: numSuccessfulPartitions,
 		LowestHighWaterMark:     common.TimeToMillis(highWaterMarks.LowestTS()),
 		HighestHighWaterMark:    common.TimeToMillis(highWaterMarks.HighestTS()),
+		RowsScanned:             rowsScanned,
+		BytesScanned:            bytesScanned,
+		RowsInRetention:         rowsInRetention,
+		BytesDecompressed:       bytesDecompressed,
+		FilesRead:               filesRead,
+		Elapsed:                 time.Since(start),
+		SkippedFiles:            skipped.get(),
 	}, err
 }
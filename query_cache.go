@@ -0,0 +1,298 @@
+package zenodb
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+)
+
+// QueryCacheStats provides statistics about the query result cache.
+type QueryCacheStats struct {
+	Hits          int64
+	Misses        int64
+	Invalidations int64
+	Entries       int
+}
+
+// HitRate returns the fraction of lookups that were served from the cache.
+func (stats QueryCacheStats) HitRate() float64 {
+	total := stats.Hits + stats.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(total)
+}
+
+// queryCacheKey identifies the results of a query over a specific time window.
+type queryCacheKey struct {
+	sql             string
+	isSubQuery      bool
+	subQueryResults string
+	asOf            int64
+	until           int64
+}
+
+func newQueryCacheKey(sqlString string, isSubQuery bool, subQueryResults [][]interface{}, asOf time.Time, until time.Time) queryCacheKey {
+	return queryCacheKey{
+		// Normalize whitespace so that trivially different formatting still hits
+		sql:             strings.Join(strings.Fields(sqlString), " "),
+		isSubQuery:      isSubQuery,
+		subQueryResults: fmt.Sprint(subQueryResults),
+		asOf:            asOf.UnixNano(),
+		until:           until.UnixNano(),
+	}
+}
+
+type queryCacheEntry struct {
+	key      queryCacheKey
+	tables   []string
+	fields   core.Fields
+	rows     []*core.FlatRow
+	metadata interface{}
+	expires  time.Time
+}
+
+// queryCache is an LRU cache of materialized query results, bounded by number
+// of entries and with entries that expire after a TTL.
+type queryCache struct {
+	maxEntries int
+	ttl        time.Duration
+	entries    map[queryCacheKey]*list.Element
+	lru        *list.List
+	stats      QueryCacheStats
+	// generation is incremented on every invalidation so that results from
+	// queries that were running at the time aren't cached
+	generation int64
+	mx         sync.Mutex
+}
+
+func newQueryCache(maxEntries int, ttl time.Duration) *queryCache {
+	return &queryCache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    make(map[queryCacheKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (c *queryCache) get(key queryCacheKey) (*queryCacheEntry, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	el := c.entries[key]
+	if el == nil {
+		c.stats.Misses++
+		return nil, false
+	}
+	entry := el.Value.(*queryCacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.remove(el)
+		c.stats.Misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+	return entry, true
+}
+
+// put caches the given entry, unless the cache was invalidated since the given
+// generation, in which case the entry may be stale.
+func (c *queryCache) put(entry *queryCacheEntry, generation int64) {
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.generation != generation {
+		return
+	}
+	if el := c.entries[entry.key]; el != nil {
+		c.remove(el)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.stats.Entries++
+	for c.stats.Entries > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate removes all entries that read from the given table and whose time
+// window overlaps [from, to]. If from is zero, all entries for the table are
+// removed.
+func (c *queryCache) invalidate(table string, from time.Time, to time.Time) {
+	table = strings.ToLower(table)
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.generation++
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		entry := el.Value.(*queryCacheEntry)
+		if entry.readsFrom(table) && (from.IsZero() || (entry.key.asOf <= to.UnixNano() && entry.key.until >= from.UnixNano())) {
+			c.remove(el)
+			c.stats.Invalidations++
+		}
+		el = next
+	}
+}
+
+func (c *queryCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*queryCacheEntry)
+	delete(c.entries, entry.key)
+	c.stats.Entries--
+}
+
+func (c *queryCache) getGeneration() int64 {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.generation
+}
+
+func (c *queryCache) getStats() QueryCacheStats {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.stats
+}
+
+func (entry *queryCacheEntry) readsFrom(table string) bool {
+	for _, t := range entry.tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// cachingSource wraps a query plan, serving results from the query cache when
+// possible and otherwise caching the results of a complete iteration.
+type cachingSource struct {
+	cache           *queryCache
+	source          core.FlatRowSource
+	sqlString       string
+	isSubQuery      bool
+	subQueryResults [][]interface{}
+	tables          []string
+}
+
+func (cs *cachingSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	key := newQueryCacheKey(cs.sqlString, cs.isSubQuery, cs.subQueryResults, cs.source.GetAsOf(), cs.source.GetUntil())
+	if entry, found := cs.cache.get(key); found {
+		return entry.replay(onFields, onRow)
+	}
+
+	generation := cs.cache.getGeneration()
+	entry := &queryCacheEntry{key: key, tables: cs.tables}
+	complete := true
+	metadata, err := cs.source.Iterate(ctx, func(fields core.Fields) error {
+		entry.fields = fields
+		return onFields(fields)
+	}, func(row *core.FlatRow) (bool, error) {
+		entry.rows = append(entry.rows, copyFlatRow(row))
+		more, err := onRow(row)
+		if err != nil || !more {
+			complete = false
+		}
+		return more, err
+	})
+	if err == nil && complete && ctx.Err() == nil {
+		if stats, ok := metadata.(*common.QueryStats); ok && stats != nil {
+			if len(stats.MissingPartitions) > 0 || len(stats.SkippedFiles) > 0 {
+				// Don't cache partial results
+				return metadata, err
+			}
+			// Nothing is scanned when replaying from the cache
+			cachedStats := *stats
+			cachedStats.RowsScanned = 0
+			cachedStats.BytesScanned = 0
+			cachedStats.BytesDecompressed = 0
+			cachedStats.FilesRead = 0
+			entry.metadata = &cachedStats
+		} else {
+			entry.metadata = metadata
+		}
+		cs.cache.put(entry, generation)
+	}
+	return metadata, err
+}
+
+func (entry *queryCacheEntry) replay(onFields core.OnFields, onRow core.OnFlatRow) (interface{}, error) {
+	if entry.fields != nil {
+		if err := onFields(entry.fields); err != nil {
+			return nil, err
+		}
+	}
+	for _, row := range entry.rows {
+		more, err := onRow(copyFlatRow(row))
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			break
+		}
+	}
+	if stats, ok := entry.metadata.(*common.QueryStats); ok {
+		// Hand out a copy so that callers can't modify the cached stats
+		statsCopy := *stats
+		return &statsCopy, nil
+	}
+	return entry.metadata, nil
+}
+
+// copyFlatRow copies the given row so that neither the cache nor the consumer
+// of a query can be affected by the other modifying the row.
+func copyFlatRow(row *core.FlatRow) *core.FlatRow {
+	rowCopy := *row
+	rowCopy.Key = append(bytemap.ByteMap(nil), row.Key...)
+	rowCopy.Values = append([]float64(nil), row.Values...)
+	if row.Nulls != nil {
+		rowCopy.Nulls = append([]bool(nil), row.Nulls...)
+	}
+	return &rowCopy
+}
+
+func (cs *cachingSource) GetGroupBy() []core.GroupBy {
+	return cs.source.GetGroupBy()
+}
+
+func (cs *cachingSource) GetResolution() time.Duration {
+	return cs.source.GetResolution()
+}
+
+func (cs *cachingSource) GetAsOf() time.Time {
+	return cs.source.GetAsOf()
+}
+
+func (cs *cachingSource) GetUntil() time.Time {
+	return cs.source.GetUntil()
+}
+
+func (cs *cachingSource) GetSource() core.Source {
+	return cs.source
+}
+
+func (cs *cachingSource) String() string {
+	return fmt.Sprintf("cache results for up to %v", cs.cache.ttl)
+}
+
+// invalidateQueryCache removes any cached query results that read from the
+// given table within [from, to]. If from is zero, all cached results for the
+// table are removed.
+func (db *DB) invalidateQueryCache(table string, from time.Time, to time.Time) {
+	if db.queryCache != nil {
+		db.queryCache.invalidate(table, from, to)
+	}
+}
+
+// QueryCacheStats returns statistics about the cache of query results. If the
+// cache is disabled, all statistics are zero.
+func (db *DB) QueryCacheStats() QueryCacheStats {
+	if db.queryCache == nil {
+		return QueryCacheStats{}
+	}
+	return db.queryCache.getStats()
+}
@@ -0,0 +1,139 @@
+package zenodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryCache(t *testing.T) {
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	key := func(sql string, asOf time.Time, until time.Time) queryCacheKey {
+		return newQueryCacheKey(sql, false, nil, asOf, until)
+	}
+	entry := func(k queryCacheKey, tables ...string) *queryCacheEntry {
+		return &queryCacheEntry{key: k, tables: tables}
+	}
+
+	a := key("SELECT * FROM a", epoch.Add(-1*time.Hour), epoch)
+	b := key("SELECT * FROM b", epoch.Add(-1*time.Hour), epoch.Add(-30*time.Minute))
+	c := key("SELECT * FROM c", epoch.Add(-1*time.Hour), epoch)
+	d := key("SELECT * FROM b", epoch.Add(-15*time.Minute), epoch)
+
+	assert.Equal(t, a, key("SELECT *\n\tFROM   a ", epoch.Add(-1*time.Hour), epoch), "Whitespace should be normalized")
+	assert.NotEqual(t, a, key("SELECT * FROM a", epoch.Add(-2*time.Hour), epoch), "Different window should not match")
+	assert.NotEqual(t, a, newQueryCacheKey("SELECT * FROM a", true, nil, epoch.Add(-1*time.Hour), epoch), "Subquery should not match")
+	assert.NotEqual(t, a, newQueryCacheKey("SELECT * FROM a", false, [][]interface{}{{"x"}}, epoch.Add(-1*time.Hour), epoch), "Different subquery results should not match")
+
+	cache := newQueryCache(3, 0)
+	cache.put(entry(a, "a"), cache.getGeneration())
+	cache.put(entry(b, "b"), cache.getGeneration())
+	cache.put(entry(c, "c"), cache.getGeneration())
+	_, found := cache.get(a)
+	assert.True(t, found)
+
+	// Exceed size, evicting least recently used
+	cache.put(entry(d, "b"), cache.getGeneration())
+	_, found = cache.get(b)
+	assert.False(t, found, "Least recently used entry should have been evicted")
+	_, found = cache.get(a)
+	assert.True(t, found, "Recently used entry should remain")
+
+	cache.invalidate("B", epoch.Add(-20*time.Minute), epoch.Add(-10*time.Minute))
+	_, found = cache.get(d)
+	assert.False(t, found, "Entry overlapping flushed range should be invalidated")
+	_, found = cache.get(a)
+	assert.True(t, found, "Entry for other table should remain")
+
+	cache.put(entry(b, "b"), cache.getGeneration())
+	cache.invalidate("b", epoch.Add(-20*time.Minute), epoch.Add(-10*time.Minute))
+	_, found = cache.get(b)
+	assert.True(t, found, "Entry not overlapping flushed range should remain")
+	cache.invalidate("b", time.Time{}, time.Time{})
+	_, found = cache.get(b)
+	assert.False(t, found, "Invalidating without range should remove all entries for table")
+
+	generation := cache.getGeneration()
+	cache.invalidate("c", time.Time{}, time.Time{})
+	cache.put(entry(c, "c"), generation)
+	_, found = cache.get(c)
+	assert.False(t, found, "Entry from before invalidation should not be cached")
+
+	stats := cache.getStats()
+	assert.EqualValues(t, 4, stats.Hits)
+	assert.EqualValues(t, 4, stats.Misses)
+	assert.EqualValues(t, 3, stats.Invalidations)
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, 0.5, stats.HitRate())
+
+	cache = newQueryCache(10, 10*time.Millisecond)
+	cache.put(entry(a, "a"), cache.getGeneration())
+	_, found = cache.get(a)
+	assert.True(t, found)
+	time.Sleep(20 * time.Millisecond)
+	_, found = cache.get(a)
+	assert.False(t, found, "Entry should have expired")
+	assert.Zero(t, cache.getStats().Entries)
+}
+
+func TestQueryCacheQuery(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{QueryCacheSize: 10}, "cached", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	insert := func(k int, v float64) {
+		_, err := db.InsertBatch("cached", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": v}}})
+		assert.NoError(t, err)
+	}
+	tbl := db.getTable("cached")
+	insert(1, 1)
+	insert(2, 2)
+	tbl.forceFlush()
+
+	sqlString := "SELECT SUM(v) AS total FROM cached"
+	query := func(includeMemStore bool) float64 {
+		source, err := db.Query(sqlString, false, nil, includeMemStore)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		var total float64
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			total += row.Values[0]
+			row.Values[0] = -1000
+			row.Key = bytemap.ByteMap(nil)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return total
+	}
+
+	assert.EqualValues(t, 3, query(false))
+	assert.EqualValues(t, 3, query(false), "Modifying rows should not affect cached results")
+	stats := db.QueryCacheStats()
+	assert.EqualValues(t, 1, stats.Hits)
+	assert.EqualValues(t, 1, stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+
+	// Data in the mem store isn't visible to cached queries until it's flushed
+	insert(3, 3)
+	assert.EqualValues(t, 3, query(false))
+	assert.EqualValues(t, 6, query(true), "Queries including mem store should not be cached")
+	assert.EqualValues(t, 2, db.QueryCacheStats().Hits)
+
+	tbl.forceFlush()
+	assert.EqualValues(t, 1, db.QueryCacheStats().Invalidations, "Flush should invalidate cached results")
+	assert.EqualValues(t, 6, query(false))
+	assert.EqualValues(t, 6, query(false))
+	stats = db.QueryCacheStats()
+	assert.EqualValues(t, 3, stats.Hits)
+	assert.EqualValues(t, 2, stats.Misses)
+
+	if assert.NoError(t, db.DeleteKeys("cached", bytemap.New(map[string]interface{}{"k": 3}))) {
+		assert.EqualValues(t, 3, query(false), "Deleting keys should invalidate cached results")
+	}
+}
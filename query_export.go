@@ -0,0 +1,195 @@
+package zenodb
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+)
+
+// Formats supported by QueryToWriter
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// QueryToWriter runs the given query and streams its results to w in the given
+// format, either FormatCSV or FormatNDJSON. Data that hasn't been flushed yet
+// is only included if ctx says so (see common.WithIncludeMemStore) or the query
+// requires fresh results.
+//
+// CSV output starts with a header containing _time followed by the dimension
+// names and the field names (see MetaDataFor). Each subsequent row contains
+// the values for a single key and period. Dimensions and fields without a
+// value are left empty. If the query groups by specific dimensions, those are
+// used as the dimension columns. Otherwise, the results are buffered in order
+// to determine which dimensions are present.
+//
+// NDJSON output contains one JSON object per row, with the period in ts and
+// the dimensions and fields in dims and vals, like the objects accepted by the
+// web insert API. Fields without a value are left out of vals.
+//
+// In both formats, timestamps are formatted as RFC3339 and numbers in their
+// shortest decimal representation.
+func (db *DB) QueryToWriter(ctx context.Context, sqlString string, format string, w io.Writer) error {
+	var write func(core.FlatRowSource) error
+	switch format {
+	case FormatCSV:
+		write = func(source core.FlatRowSource) error {
+			return writeCSV(ctx, source, w)
+		}
+	case FormatNDJSON:
+		write = func(source core.FlatRowSource) error {
+			return writeNDJSON(ctx, source, w)
+		}
+	default:
+		return errors.New("Unknown format %v, please use %v or %v", format, FormatCSV, FormatNDJSON)
+	}
+
+	source, err := db.Query(sqlString, false, nil, common.ShouldIncludeMemStore(ctx))
+	if err != nil {
+		return err
+	}
+	return write(source)
+}
+
+func writeCSV(ctx context.Context, source core.FlatRowSource, w io.Writer) error {
+	out := csv.NewWriter(w)
+	var dims []string
+	var record []string
+	var fieldNames []string
+	writeHeader := func() error {
+		header := make([]string, 0, 1+len(dims)+len(fieldNames))
+		header = append(header, "_time")
+		header = append(header, dims...)
+		header = append(header, fieldNames...)
+		record = make([]string, len(header))
+		if err := out.Write(header); err != nil {
+			return errors.New("Unable to write CSV header: %v", err)
+		}
+		return nil
+	}
+	writeRow := func(row *core.FlatRow) error {
+		record[0] = formatTS(row.TS)
+		for i, dim := range dims {
+			record[1+i] = csvValue(row.Key.Get(dim))
+		}
+		for i, val := range row.Values {
+			record[1+len(dims)+i] = ""
+			if !row.IsNull(i) {
+				record[1+len(dims)+i] = formatValue(val)
+			}
+		}
+		if err := out.Write(record); err != nil {
+			return errors.New("Unable to write CSV row: %v", err)
+		}
+		return nil
+	}
+
+	// Without specific dimensions to group by, the rows have to be buffered to
+	// find out which dimensions they have
+	groupBy := source.GetGroupBy()
+	buffer := len(groupBy) == 0
+	for _, gb := range groupBy {
+		dims = append(dims, gb.Name)
+	}
+	var buffered []*core.FlatRow
+	dimsMap := make(map[string]bool)
+
+	_, err := source.Iterate(ctx, func(fields core.Fields) error {
+		fieldNames = MetaDataFor(source, fields).FieldNames
+		if buffer {
+			return nil
+		}
+		return writeHeader()
+	}, func(row *core.FlatRow) (bool, error) {
+		if buffer {
+			for dim := range row.Key.AsMap() {
+				dimsMap[dim] = true
+			}
+			buffered = append(buffered, row)
+			return ctx.Err() == nil, ctx.Err()
+		}
+		if err := writeRow(row); err != nil {
+			return false, err
+		}
+		return ctx.Err() == nil, ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+
+	if buffer {
+		for dim := range dimsMap {
+			dims = append(dims, dim)
+		}
+		sort.Strings(dims)
+		if err := writeHeader(); err != nil {
+			return err
+		}
+		for _, row := range buffered {
+			if err := writeRow(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return errors.New("Unable to flush CSV: %v", err)
+	}
+	return nil
+}
+
+type ndjsonRow struct {
+	TS   string                     `json:"ts"`
+	Dims map[string]interface{}     `json:"dims"`
+	Vals map[string]json.RawMessage `json:"vals"`
+}
+
+func writeNDJSON(ctx context.Context, source core.FlatRowSource, w io.Writer) error {
+	out := bufio.NewWriter(w)
+	enc := json.NewEncoder(out)
+	var fieldNames []string
+	_, err := source.Iterate(ctx, func(fields core.Fields) error {
+		fieldNames = MetaDataFor(source, fields).FieldNames
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		vals := make(map[string]json.RawMessage, len(row.Values))
+		for i, val := range row.Values {
+			// JSON has no representation for non-finite numbers, so leave those
+			// out like missing values
+			if i < len(fieldNames) && !row.IsNull(i) && !math.IsNaN(val) && !math.IsInf(val, 0) {
+				vals[fieldNames[i]] = json.RawMessage(formatValue(val))
+			}
+		}
+		if err := enc.Encode(&ndjsonRow{TS: formatTS(row.TS), Dims: row.Key.AsMap(), Vals: vals}); err != nil {
+			return false, errors.New("Unable to write JSON row: %v", err)
+		}
+		return ctx.Err() == nil, ctx.Err()
+	})
+	if err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return errors.New("Unable to flush JSON: %v", err)
+	}
+	return nil
+}
+
+func formatTS(ts int64) string {
+	return time.Unix(0, ts).UTC().Format(time.RFC3339)
+}
+
+func formatValue(val float64) string {
+	return strconv.FormatFloat(val, 'f', -1, 64)
+}
@@ -0,0 +1,71 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryToWriter(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "exported", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch.Add(2 * time.Second))
+	_, err := db.InsertBatch("exported", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch.Add(time.Second), Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1.5}},
+		{TS: epoch.Add(time.Second), Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 2}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx := common.WithIncludeMemStore(context.Background(), true)
+	export := func(sqlString string, format string) string {
+		buf := &bytes.Buffer{}
+		if !assert.NoError(t, db.QueryToWriter(ctx, sqlString, format, buf)) {
+			t.FailNow()
+		}
+		return buf.String()
+	}
+	exportCSV := func(sqlString string) [][]string {
+		records, err := csv.NewReader(strings.NewReader(export(sqlString, FormatCSV))).ReadAll()
+		if !assert.NoError(t, err) || !assert.NotEmpty(t, records) {
+			t.FailNow()
+		}
+		rows := records[1:]
+		sort.Slice(rows, func(i, j int) bool {
+			return rows[i][0]+rows[i][1] < rows[j][0]+rows[j][1]
+		})
+		return records
+	}
+
+	expected := [][]string{
+		{"_time", "k", "v"},
+		{"2015-01-01T02:03:04Z", "a", "1"},
+		{"2015-01-01T02:03:05Z", "a", "1.5"},
+		{"2015-01-01T02:03:05Z", "b", "2"},
+	}
+	assert.Equal(t, expected, exportCSV("SELECT v FROM exported GROUP BY k"))
+	assert.Equal(t, expected, exportCSV("SELECT v FROM exported"), "Dimensions should be determined from results when grouping by all")
+	assert.Equal(t, [][]string{{"_time", "k", "v"}}, exportCSV("SELECT v FROM exported WHERE k = 'none' GROUP BY k"), "Empty result should only have header")
+
+	lines := strings.Split(strings.TrimSpace(export("SELECT v FROM exported GROUP BY k", FormatNDJSON)), "\n")
+	sort.Strings(lines)
+	assert.Equal(t, []string{
+		`{"ts":"2015-01-01T02:03:04Z","dims":{"k":"a"},"vals":{"v":1}}`,
+		`{"ts":"2015-01-01T02:03:05Z","dims":{"k":"a"},"vals":{"v":1.5}}`,
+		`{"ts":"2015-01-01T02:03:05Z","dims":{"k":"b"},"vals":{"v":2}}`,
+	}, lines)
+	assert.Empty(t, export("SELECT v FROM exported WHERE k = 'none' GROUP BY k", FormatNDJSON), "Empty result should have no rows")
+
+	assert.Error(t, db.QueryToWriter(ctx, "SELECT v FROM exported", "xml", &bytes.Buffer{}), "Unknown format should fail")
+}
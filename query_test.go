@@ -0,0 +1,722 @@
+package zenodb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/planner"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanWarning(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{ScanWarningRows: 1}, "scanned", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	_, err := db.InsertBatch("scanned", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch, Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 2}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	source, err := db.Query("SELECT * FROM scanned", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var fields core.Fields
+	rows := 0
+	result, err := source.Iterate(context.Background(), func(inFields core.Fields) error {
+		fields = inFields
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		rows++
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2, rows, "Query should still return all rows")
+
+	stats := result.(*common.QueryStats)
+	assert.EqualValues(t, 2, stats.RowsScanned)
+	assert.True(t, stats.BytesScanned > 0)
+	assert.Len(t, stats.Warnings, 1)
+	assert.Len(t, MetaDataFor(source, fields).Warnings, 1)
+
+	db.opts.ScanWarningBytes = 1
+	source, err = db.Query("SELECT * FROM scanned", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	result, err = source.Iterate(context.Background(), func(inFields core.Fields) error {
+		fields = inFields
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, result.(*common.QueryStats).Warnings, 2, "Exceeding both thresholds should warn about both")
+	assert.Len(t, MetaDataFor(source, fields).Warnings, 2)
+}
+
+func TestEmptyResults(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "sparse", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+
+	query := func(sqlString string) (*common.QueryMetaData, *common.QueryStats, int) {
+		source, err := db.Query(sqlString, false, nil, true)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		var fields core.Fields
+		rows := 0
+		result, err := source.Iterate(context.Background(), func(inFields core.Fields) error {
+			fields = inFields
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			rows++
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return MetaDataFor(source, fields), result.(*common.QueryStats), rows
+	}
+
+	assertEmpty := func(sqlString string, expectedReason common.EmptyReason) {
+		md, stats, rows := query(sqlString)
+		assert.Equal(t, 0, rows)
+		assert.True(t, md.Empty, sqlString)
+		assert.Equal(t, expectedReason, md.EmptyReason, sqlString)
+		assert.True(t, stats.Empty, sqlString)
+		assert.Equal(t, expectedReason, stats.EmptyReason, sqlString)
+		assert.False(t, md.AsOf.IsZero(), "Resolved time window should still be reported")
+		assert.False(t, md.Until.IsZero(), "Resolved time window should still be reported")
+	}
+
+	assertEmpty("SELECT * FROM sparse", common.EmptyReasonTableEmpty)
+
+	_, err := db.InsertBatch("sparse", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	md, stats, rows := query("SELECT * FROM sparse")
+	assert.Equal(t, 1, rows)
+	assert.False(t, md.Empty)
+	assert.Empty(t, md.EmptyReason)
+	assert.False(t, stats.Empty)
+
+	assertEmpty("SELECT * FROM sparse WHERE k = 'b'", common.EmptyReasonNoMatchingKeys)
+
+	db.getTable("sparse").forceFlush()
+	db.clock.Advance(epoch.Add(2 * time.Hour))
+	assertEmpty("SELECT * FROM sparse", common.EmptyReasonAllExpired)
+}
+
+func TestQueryExecutionMetaData(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "scanned", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	var points []*Point
+	for i := 0; i < 10; i++ {
+		points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": i}, Vals: map[string]interface{}{"v": 1}})
+	}
+	if _, err := db.InsertBatch("scanned", points); !assert.NoError(t, err) {
+		return
+	}
+	db.getTable("scanned").forceFlush()
+
+	source, err := db.Query("SELECT * FROM scanned", false, nil, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var fields core.Fields
+	result, err := source.Iterate(context.Background(), func(inFields core.Fields) error {
+		fields = inFields
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	stats := result.(*common.QueryStats)
+	md := MetaDataFor(source, fields)
+	assert.EqualValues(t, 10, md.RowsScanned)
+	assert.True(t, md.BytesScanned > 0, "Should have recorded bytes scanned")
+	assert.EqualValues(t, 1, md.FilesRead)
+	assert.True(t, md.BytesDecompressed > 0, "Should have recorded bytes decompressed")
+	assert.True(t, md.Elapsed > 0, "Should have recorded elapsed time")
+	assert.Equal(t, stats.RowsScanned, md.RowsScanned)
+	assert.Equal(t, stats.BytesDecompressed, md.BytesDecompressed)
+	assert.Equal(t, stats.FilesRead, md.FilesRead)
+	assert.Equal(t, stats.Elapsed, md.Elapsed)
+}
+
+func TestSkipNulls(t *testing.T) {
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+
+	avgOfSubQuery := func(skipNulls bool) float64 {
+		db, cleanup := newTestDB(t, &DBOpts{SkipNulls: skipNulls}, "sparse", "SELECT SUM(v) AS v, SUM(w) AS w FROM inbound GROUP BY k, period(1s)")
+		defer cleanup()
+
+		db.clock.Advance(epoch)
+		_, err := db.InsertBatch("sparse", []*Point{
+			{TS: epoch, Dims: map[string]interface{}{"k": "zero"}, Vals: map[string]interface{}{"v": 0, "w": 1}},
+			{TS: epoch, Dims: map[string]interface{}{"k": "ten"}, Vals: map[string]interface{}{"v": 10, "w": 1}},
+			{TS: epoch, Dims: map[string]interface{}{"k": "missing"}, Vals: map[string]interface{}{"w": 1}},
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+
+		source, err := db.Query("SELECT * FROM sparse", false, nil, true)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		vIdx := -1
+		nulls := make(map[string]bool)
+		_, err = source.Iterate(context.Background(), func(fields core.Fields) error {
+			for i, field := range fields {
+				if field.Name == "v" {
+					vIdx = i
+				}
+			}
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			nulls[row.Key.Get("k").(string)] = row.IsNull(vIdx)
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		assert.Equal(t, map[string]bool{"zero": false, "ten": false, "missing": true}, nulls, "Only missing value should be null")
+
+		source, err = db.Query("SELECT AVG(v) AS avg_v FROM (SELECT * FROM sparse) GROUP BY period(1s)", false, nil, true)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		var avgs []float64
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			avgs = append(avgs, row.Values[0])
+			return true, nil
+		})
+		if !assert.NoError(t, err) || !assert.Len(t, avgs, 1) {
+			t.FailNow()
+		}
+		return avgs[0]
+	}
+
+	assert.InDelta(t, 10.0/3, avgOfSubQuery(false), 0.0001, "By default, missing value should be treated as zero")
+	assert.InDelta(t, 5, avgOfSubQuery(true), 0.0001, "When skipping nulls, missing value should be excluded but zero value included")
+}
+
+func TestAbsentPeriodsDontCount(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "sparse", "SELECT AVG(v) AS a, COUNT(v) AS c, WAVG(v, weight) AS wa FROM inbound GROUP BY period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch.Add(4 * time.Second))
+	// Periods with v alternate with periods without v, and the period with v
+	// but no weight doesn't count towards the weighted average
+	_, err := db.InsertBatch("sparse", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 10, "weight": 1}},
+		{TS: epoch.Add(1 * time.Second), Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"other": 1}},
+		{TS: epoch.Add(2 * time.Second), Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 20, "weight": 3}},
+		{TS: epoch.Add(3 * time.Second), Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 100}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	query := func(sql string) map[int64][]interface{} {
+		source, err := db.Query(sql, false, nil, true)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		result := make(map[int64][]interface{})
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			vals := make([]interface{}, len(row.Values))
+			for i, val := range row.Values {
+				if row.IsNull(i) {
+					vals[i] = nil
+				} else {
+					vals[i] = val
+				}
+			}
+			result[(row.TS-epoch.UnixNano())/int64(time.Second)] = vals
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return result
+	}
+
+	byPeriod := query("SELECT a, c, wa FROM sparse")
+	assert.Equal(t, []interface{}{10.0, 1.0, 10.0}, byPeriod[0])
+	assert.Equal(t, []interface{}{20.0, 1.0, 20.0}, byPeriod[2])
+	assert.Equal(t, []interface{}{100.0, 1.0, nil}, byPeriod[3], "Weighted average without weight should be null")
+	if row, found := byPeriod[1]; found {
+		assert.Equal(t, []interface{}{nil, nil, nil}, row, "Period without v should be null")
+	}
+
+	overall := query("SELECT a, c, wa FROM sparse GROUP BY period(4s)")
+	if assert.Len(t, overall, 1) {
+		for _, row := range overall {
+			assert.InDelta(t, 130.0/3, row[0], 0.0001, "Absent period should not pull down average")
+			assert.EqualValues(t, 3, row[1], "Absent period should not be counted")
+			assert.InDelta(t, 70.0/4, row[2], 0.0001, "Unweighted value should not count towards weighted average")
+		}
+	}
+}
+
+func TestLimitStopsScanEarly(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "limited", "SELECT SUM(v) AS v FROM inbound GROUP BY k, j, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	numKeys := 100
+	points := make([]*Point, 0, numKeys)
+	for i := 0; i < numKeys; i++ {
+		points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": i, "j": i % 2}, Vals: map[string]interface{}{"v": i}})
+	}
+	_, err := db.InsertBatch("limited", points)
+	if !assert.NoError(t, err) {
+		return
+	}
+	db.getTable("limited").forceFlush()
+
+	rowsScanned := func(sqlString string) (int, int64) {
+		source, err := db.Query(sqlString, false, nil, false)
+		if !assert.NoError(t, err, sqlString) {
+			t.FailNow()
+		}
+		rows := 0
+		result, err := source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			rows++
+			return true, nil
+		})
+		if !assert.NoError(t, err, sqlString) {
+			t.FailNow()
+		}
+		return rows, result.(*common.QueryStats).RowsScanned
+	}
+
+	rows, scanned := rowsScanned("SELECT v FROM limited LIMIT 5")
+	assert.Equal(t, 5, rows)
+	assert.EqualValues(t, 5, scanned, "Unaggregated select should stop scanning once limit is reached")
+
+	rows, scanned = rowsScanned("SELECT v FROM limited LIMIT 5, 5")
+	assert.Equal(t, 5, rows)
+	assert.EqualValues(t, 10, scanned, "Offset rows should be scanned too")
+
+	rows, scanned = rowsScanned("SELECT v FROM limited ORDER BY v LIMIT 5")
+	assert.Equal(t, 5, rows)
+	assert.EqualValues(t, numKeys, scanned, "Ordered select needs to scan everything")
+
+	rows, scanned = rowsScanned("SELECT SUM(v) AS v FROM limited GROUP BY j LIMIT 1")
+	assert.Equal(t, 1, rows)
+	assert.EqualValues(t, numKeys, scanned, "Aggregated select needs to scan everything")
+}
+
+func TestQueryTimeout(t *testing.T) {
+	h := &hooks{}
+	db, cleanup := newTestDB(t, &DBOpts{QueryTimeout: 100 * time.Millisecond, hooks: h}, "slow", "SELECT SUM(v) AS v FROM inbound GROUP BY k, j, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	numKeys := 1000
+	points := make([]*Point, 0, numKeys)
+	for i := 0; i < numKeys; i++ {
+		points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": i, "j": i % 2}, Vals: map[string]interface{}{"v": i}})
+	}
+	_, err := db.InsertBatch("slow", points)
+	if !assert.NoError(t, err) {
+		return
+	}
+	db.getTable("slow").forceFlush()
+
+	// Make scanning all keys take much longer than the timeout
+	h.decodeColumn = func(column int) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	checkTimesOut := func(source core.FlatRowSource, err error, sqlString string) {
+		if !assert.NoError(t, err, sqlString) {
+			return
+		}
+		start := time.Now()
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			return true, nil
+		})
+		assert.Equal(t, context.DeadlineExceeded, err, sqlString)
+		assert.True(t, time.Since(start) < 2*time.Second, "%v should have been cancelled promptly, took %v", sqlString, time.Since(start))
+	}
+
+	sqlString := "SELECT v FROM slow"
+	source, err := db.Query(sqlString, false, nil, false)
+	checkTimesOut(source, err, sqlString)
+
+	sqlString = "SELECT SUM(v) AS v FROM slow GROUP BY j"
+	source, err = db.QueryWithTimeout(sqlString, false, nil, false, 50*time.Millisecond)
+	checkTimesOut(source, err, sqlString)
+}
+
+func TestExplain(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "explained", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+
+	// explain returns the JSON plan as a list of nodes, starting from the root
+	explain := func(sqlString string) []map[string]interface{} {
+		plan, err := db.Explain(sqlString, false, nil, false)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		b, err := json.Marshal(plan)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		var root map[string]interface{}
+		if !assert.NoError(t, json.Unmarshal(b, &root)) {
+			t.FailNow()
+		}
+		var nodes []map[string]interface{}
+		for node := root; node != nil; {
+			nodes = append(nodes, node)
+			node, _ = node["source"].(map[string]interface{})
+		}
+		return nodes
+	}
+	types := func(nodes []map[string]interface{}) []string {
+		result := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			result = append(result, node["type"].(string))
+		}
+		return result
+	}
+
+	nodes := explain("SELECT * FROM explained")
+	assert.Equal(t, []string{"flatten", "table"}, types(nodes))
+	tableNode := nodes[1]
+	assert.Equal(t, "explained", tableNode["table"])
+	assert.Contains(t, tableNode["fields"], "v")
+	assert.Equal(t, []interface{}{"k"}, tableNode["groupBy"])
+	assert.Equal(t, "1s", tableNode["resolution"])
+	assert.NotEmpty(t, tableNode["asOf"])
+	assert.NotEmpty(t, tableNode["until"])
+
+	nodes = explain("SELECT v FROM explained WHERE k = 'a' GROUP BY k ORDER BY v DESC LIMIT 5")
+	assert.Equal(t, []string{"limit", "sort", "flatten", "group", "filter", "table"}, types(nodes))
+	assert.EqualValues(t, 5, nodes[0]["limit"])
+	assert.Equal(t, []interface{}{"v(desc)"}, nodes[1]["orderBy"])
+	assert.Equal(t, []interface{}{"k"}, nodes[3]["groupBy"])
+	assert.Equal(t, "where k = 'a'", nodes[4]["filter"])
+	assert.Equal(t, "explained", nodes[5]["table"])
+
+	nodes = explain("SELECT AVG(v) AS avg_v FROM (SELECT * FROM explained) GROUP BY period(1s)")
+	assert.Equal(t, []string{"flatten", "group", "unflatten", "flatten", "table"}, types(nodes))
+	assert.Nil(t, nodes[1]["groupBy"], "Outer query should not group by any dimensions")
+	assert.Equal(t, "explained", nodes[4]["table"])
+
+	_, err := db.Explain("SELECT * FROM unknown", false, nil, false)
+	assert.Error(t, err)
+
+	text, err := db.ExplainText("SELECT v FROM explained WHERE k = 'a' GROUP BY k", false, nil, false)
+	if assert.NoError(t, err) {
+		assert.Contains(t, text, "where k = 'a'")
+		assert.Contains(t, text, "explained")
+	}
+	_, err = db.ExplainText("SELECT * FROM unknown", false, nil, false)
+	assert.Error(t, err)
+}
+
+func TestRetentionOverlap(t *testing.T) {
+	day := 24 * time.Hour
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+
+	query := func(overlap planner.RetentionOverlap, subQueryResults [][]interface{}) (*common.QueryMetaData, map[int64]float64) {
+		db, cleanup := newTestDB(t, &DBOpts{RetentionOverlap: overlap}, "", "")
+		defer cleanup()
+		for name, retention := range map[string]time.Duration{"weekly": 7 * day, "monthly": 30 * day} {
+			err := db.CreateTable(&TableOpts{
+				Name:            name,
+				RetentionPeriod: retention,
+				SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1d)",
+			})
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+		}
+
+		db.clock.Advance(epoch)
+		insert := func(table string, age time.Duration) {
+			_, err := db.InsertBatch(table, []*Point{{TS: epoch.Add(-age), Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}}})
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+		}
+		insert("monthly", 20*day)
+		insert("monthly", 2*day)
+		insert("weekly", 2*day)
+
+		source, err := db.Query("SELECT v FROM monthly WHERE k IN (SELECT k FROM weekly) GROUP BY period(1d)", false, subQueryResults, true)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		var fields core.Fields
+		result := make(map[int64]float64)
+		_, err = source.Iterate(context.Background(), func(inFields core.Fields) error {
+			fields = inFields
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			result[row.TS] = row.Values[0]
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return MetaDataFor(source, fields), result
+	}
+
+	until := encoding.RoundTimeUp(epoch, day)
+	weeklyAsOf := encoding.RoundTimeUp(until.Add(-7*day), day)
+	monthlyAsOf := encoding.RoundTimeUp(until.Add(-30*day), day)
+	countBeforeWeekly := func(result map[int64]float64) int {
+		count := 0
+		for ts, v := range result {
+			if v > 0 && ts < weeklyAsOf.UnixNano() {
+				count++
+			}
+		}
+		return count
+	}
+	total := func(result map[int64]float64) float64 {
+		sum := 0.0
+		for _, v := range result {
+			sum += v
+		}
+		return sum
+	}
+
+	md, result := query(planner.RetentionUnion, nil)
+	assert.Equal(t, monthlyAsOf.UnixNano(), md.AsOf.UnixNano(), "Union should cover monthly retention")
+	assert.Equal(t, until.UnixNano(), md.Until.UnixNano())
+	assert.Equal(t, 1, countBeforeWeekly(result), "Union should include data from before weekly retention")
+	assert.EqualValues(t, 2, total(result))
+
+	md, result = query(planner.RetentionIntersection, nil)
+	assert.Equal(t, weeklyAsOf.UnixNano(), md.AsOf.UnixNano(), "Intersection should be clipped to weekly retention")
+	assert.Equal(t, until.UnixNano(), md.Until.UnixNano())
+	assert.Zero(t, countBeforeWeekly(result), "Intersection should exclude data from before weekly retention")
+	assert.EqualValues(t, 1, total(result))
+
+	// Followers receive the results of subqueries from the leader, but should
+	// still clip to the same window
+	md, result = query(planner.RetentionIntersection, [][]interface{}{{"a"}})
+	assert.Equal(t, weeklyAsOf.UnixNano(), md.AsOf.UnixNano(), "Intersection with supplied subquery results should be clipped to weekly retention")
+	assert.Zero(t, countBeforeWeekly(result), "Intersection with supplied subquery results should exclude data from before weekly retention")
+	assert.EqualValues(t, 1, total(result))
+}
+
+func TestAddField(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "evolving", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("evolving")
+
+	insert := func(ts time.Time, k string) {
+		_, err := db.InsertBatch("evolving", []*Point{{TS: ts, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": 1, "w": 2}}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+
+	// Old data on disk and in the memstore
+	insert(epoch.Add(-2*time.Second), "flushed")
+	tbl.forceFlush()
+	insert(epoch.Add(-1*time.Second), "unflushed")
+
+	assert.Error(t, tbl.AddField(core.NewField("v", expr.SUM("w"))), "Adding a field with an existing name should fail")
+	if !assert.NoError(t, tbl.AddField(core.NewField("w", expr.SUM("w")))) {
+		return
+	}
+	insert(epoch, "new")
+	tbl.forceFlush()
+
+	query := func() map[string][]float64 {
+		source, err := db.Query("SELECT v, w FROM evolving", false, nil, true)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		results := make(map[string][]float64)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			if row.Values[0] != 0 {
+				results[row.Key.Get("k").(string)] = []float64{row.Values[0], row.Values[1]}
+			}
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return results
+	}
+	expected := map[string][]float64{
+		"flushed":   {1, 0},
+		"unflushed": {1, 0},
+		"new":       {1, 2},
+	}
+	assert.Equal(t, expected, query(), "Data stored before the field was added should have an empty new field")
+
+	// New data for old rows is merged with the old data on the next flush
+	insert(epoch.Add(-2*time.Second), "flushed")
+	tbl.forceFlush()
+	expected["flushed"] = []float64{2, 2}
+	assert.Equal(t, expected, query())
+}
+
+func TestQueryWindow(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "windowed", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1m)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	db.clock.Advance(epoch)
+	for _, age := range []time.Duration{30 * time.Minute, 20 * time.Minute, 10 * time.Minute} {
+		_, err := db.InsertBatch("windowed", []*Point{{TS: epoch.Add(-age), Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}}})
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	query := func(asOf time.Time, until time.Time) (*common.QueryMetaData, float64) {
+		source, err := db.QueryWindow("SELECT v FROM windowed", false, nil, true, asOf, until)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		var fields core.Fields
+		total := float64(0)
+		_, err = source.Iterate(context.Background(), func(inFields core.Fields) error {
+			fields = inFields
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			total += row.Values[0]
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return MetaDataFor(source, fields), total
+	}
+
+	asOf := epoch.Add(-25 * time.Minute)
+	until := epoch.Add(-15 * time.Minute)
+	md, total := query(asOf, until)
+	assert.EqualValues(t, 1, total, "Only the point within the window should be included")
+	assert.Equal(t, asOf, md.AsOf.UTC())
+	assert.Equal(t, until, md.Until.UTC())
+
+	// The same window gives the same results later on
+	db.clock.Advance(epoch.Add(5 * time.Minute))
+	_, total = query(asOf, until)
+	assert.EqualValues(t, 1, total)
+
+	// A window that extends beyond the available data is clamped to it rather
+	// than failing
+	md, total = query(epoch.Add(-24*time.Hour), epoch.Add(24*time.Hour))
+	assert.EqualValues(t, 3, total)
+	assert.Equal(t, epoch.Add(5*time.Minute).Add(-1*time.Hour), md.AsOf.UTC())
+	assert.Equal(t, epoch.Add(5*time.Minute), md.Until.UTC())
+	_, err := db.Query(fmt.Sprintf("SELECT v FROM windowed ASOF '%v'", epoch.Add(-24*time.Hour).Format(time.RFC3339)), false, nil, true)
+	assert.Error(t, err, "Window before retention specified in SQL should still fail")
+
+	// Zero times leave the default window alone
+	md, total = query(time.Time{}, time.Time{})
+	assert.EqualValues(t, 3, total)
+	assert.Equal(t, epoch.Add(5*time.Minute), md.Until.UTC())
+}
+
+func TestUnionAll(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	for _, name := range []string{"north", "south"} {
+		err := db.CreateTable(&TableOpts{
+			Name:            name,
+			RetentionPeriod: 1 * time.Hour,
+			SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	insert := func(table string, k string, v int) {
+		_, err := db.InsertBatch(table, []*Point{{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": v}}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	insert("north", "a", 1)
+	insert("north", "b", 2)
+	insert("south", "a", 10)
+	insert("south", "c", 20)
+
+	source, err := db.Query("SELECT SUM(v) AS v FROM north GROUP BY k UNION ALL SELECT SUM(v) AS v FROM south GROUP BY k", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	result := make(map[string]float64)
+	rowsPerKey := make(map[string]int)
+	md, err := source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		k := row.Key.Get("k").(string)
+		result[k] += row.Values[0]
+		rowsPerKey[k]++
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]float64{"a": 11, "b": 2, "c": 20}, result, "Overlapping keys should have been aggregated")
+	assert.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1}, rowsPerKey, "Each key should appear only once")
+	assert.EqualValues(t, 4, md.(*common.QueryStats).RowsScanned, "Stats should cover both tables")
+
+	source, err = db.Query("SELECT SUM(v) AS v FROM north GROUP BY k UNION ALL SELECT SUM(v) AS w FROM south GROUP BY k", false, nil, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+		return true, nil
+	})
+	assert.Error(t, err, "Selecting different fields should fail")
+
+	_, err = db.Query("SELECT SUM(v) AS v FROM north UNION SELECT SUM(v) AS v FROM south", false, nil, true)
+	assert.Error(t, err, "UNION without ALL should fail")
+}
@@ -0,0 +1,100 @@
+package zenodb
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter limits some activity to perSecond units per second, allowing
+// bursts of up to one second's worth of units. If perSecond isn't positive, it
+// doesn't limit anything and only measures the rate. It's safe for concurrent
+// use. A nil rateLimiter neither limits nor measures anything.
+type rateLimiter struct {
+	perSecond float64
+	// available is the number of units that can be taken without waiting. It
+	// goes negative when more units are taken than are available.
+	available float64
+	updated   time.Time
+	// counted is the number of units taken since countedSince, from which rate
+	// is calculated
+	counted      float64
+	countedSince time.Time
+	rate         float64
+	mx           sync.Mutex
+}
+
+func newRateLimiter(perSecond int64) *rateLimiter {
+	now := time.Now()
+	return &rateLimiter{
+		perSecond:    float64(perSecond),
+		available:    float64(perSecond),
+		updated:      now,
+		countedSince: now,
+	}
+}
+
+// take takes n units and returns how long the caller has to wait before
+// proceeding in order to stay within the limit.
+func (l *rateLimiter) take(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.update(time.Now())
+	l.counted += float64(n)
+	if l.perSecond <= 0 {
+		return 0
+	}
+	l.available -= float64(n)
+	if l.available >= 0 {
+		return 0
+	}
+	return time.Duration(-l.available / l.perSecond * float64(time.Second))
+}
+
+// tryTake takes n units if they're available without waiting and returns
+// whether it did.
+func (l *rateLimiter) tryTake(n int) bool {
+	if l == nil {
+		return true
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.update(time.Now())
+	if l.perSecond > 0 {
+		if l.available < float64(n) {
+			return false
+		}
+		l.available -= float64(n)
+	}
+	l.counted += float64(n)
+	return true
+}
+
+// currentRate returns the number of units taken per second, as measured over
+// the most recent interval of at least a second.
+func (l *rateLimiter) currentRate() float64 {
+	if l == nil {
+		return 0
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	l.update(time.Now())
+	return l.rate
+}
+
+func (l *rateLimiter) update(now time.Time) {
+	if l.perSecond > 0 {
+		l.available += now.Sub(l.updated).Seconds() * l.perSecond
+		if l.available > l.perSecond {
+			l.available = l.perSecond
+		}
+	}
+	l.updated = now
+	if elapsed := now.Sub(l.countedSince); elapsed >= time.Second {
+		l.rate = l.counted / elapsed.Seconds()
+		l.counted = 0
+		l.countedSince = now
+	}
+}
@@ -0,0 +1,143 @@
+package zenodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(100)
+	assert.True(t, l.tryTake(60), "Should allow burst of up to a second's worth")
+	assert.False(t, l.tryTake(60), "Should not allow exceeding burst")
+	assert.Zero(t, l.take(40), "Should not have to wait for remainder of burst")
+	delay := l.take(50)
+	assert.True(t, delay > 400*time.Millisecond && delay <= 500*time.Millisecond, "Should have to wait for 50 units at 100 per second, not %v", delay)
+
+	unlimited := newRateLimiter(0)
+	assert.True(t, unlimited.tryTake(1000000))
+	assert.Zero(t, unlimited.take(1000000))
+
+	var nilLimiter *rateLimiter
+	assert.True(t, nilLimiter.tryTake(1))
+	assert.Zero(t, nilLimiter.take(1))
+	assert.Zero(t, nilLimiter.currentRate())
+}
+
+func TestInsertRateLimit(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	points := func(n int) []*Point {
+		result := make([]*Point, 0, n)
+		for i := 0; i < n; i++ {
+			result = append(result, &Point{TS: epoch, Dims: map[string]interface{}{"k": i}, Vals: map[string]interface{}{"v": 1}})
+		}
+		return result
+	}
+
+	err := db.CreateTable(&TableOpts{
+		Name:                "shed",
+		RetentionPeriod:     1 * time.Hour,
+		MaxInsertsPerSecond: 100,
+		ShedExcessInserts:   true,
+		SQL:                 "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	rejections, err := db.InsertBatch("shed", points(500))
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Allow a little slack for time passing while inserting
+	assert.True(t, len(rejections) >= 390 && len(rejections) <= 400, "Should have rejected points beyond limit, not %d", len(rejections))
+	for _, rejection := range rejections {
+		assert.Equal(t, ErrRateLimited, rejection.Err)
+	}
+	stats := db.TableStats("shed")
+	assert.EqualValues(t, len(rejections), stats.ThrottledPoints)
+	assert.EqualValues(t, 500-len(rejections), stats.InsertedPoints)
+
+	err = db.CreateTable(&TableOpts{
+		Name:                "blocking",
+		RetentionPeriod:     1 * time.Hour,
+		MaxInsertsPerSecond: 1000,
+		SQL:                 "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	start := time.Now()
+	rejections, err = db.InsertBatch("blocking", points(2000))
+	elapsed := time.Since(start)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Empty(t, rejections)
+	assert.True(t, elapsed >= 900*time.Millisecond, "Inserting twice the limit should have taken about a second, not %v", elapsed)
+	_, err = db.TryInsertBatch("blocking", points(500))
+	assert.Equal(t, ErrRateLimited, err, "TryInsertBatch should fail rather than wait")
+	assert.True(t, db.TableStats("blocking").InsertRate > 0)
+}
+
+func TestScanRateLimit(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "scanned", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	var points []*Point
+	for i := 0; i < 100; i++ {
+		points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": i}, Vals: map[string]interface{}{"v": 1}})
+	}
+	if _, err := db.InsertBatch("scanned", points); !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("scanned")
+	tbl.forceFlush()
+
+	query := func(ctx context.Context) (int64, error) {
+		source, err := db.Query("SELECT v FROM scanned", false, nil, false)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		result, err := source.Iterate(ctx, core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			return true, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		return result.(*common.QueryStats).BytesScanned, nil
+	}
+
+	bytesScanned, err := query(context.Background())
+	if !assert.NoError(t, err) || !assert.True(t, bytesScanned > 0) {
+		return
+	}
+
+	// Limit the scan rate so that scanning everything takes about a second
+	tbl.scanLimiter = newRateLimiter(bytesScanned / 2)
+	start := time.Now()
+	_, err = query(context.Background())
+	elapsed := time.Since(start)
+	assert.NoError(t, err)
+	assert.True(t, elapsed >= 900*time.Millisecond, "Scanning twice the limit should have taken about a second, not %v", elapsed)
+	assert.True(t, db.TableStats("scanned").ScanRate > 0)
+
+	// A throttled query can still be cancelled
+	tbl.scanLimiter = newRateLimiter(bytesScanned / 100)
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = query(ctx)
+	elapsed = time.Since(start)
+	assert.Error(t, err, "Throttled query should have been cancelled")
+	assert.True(t, elapsed < 5*time.Second, "Throttled query should have been cancelled promptly, not after %v", elapsed)
+}
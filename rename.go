@@ -0,0 +1,68 @@
+package zenodb
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/getlantern/errors"
+)
+
+// renameFile moves from to to like os.Rename. Temp files are created in the
+// system temp dir, which is often a separate filesystem from the data dir, in
+// which case the rename fails with EXDEV. renameFile then falls back to
+// copying the file into a temp file next to to, syncing it (if sync is true)
+// and renaming that into place, so that readers never see a partial file.
+func (db *DB) renameFile(from, to string, sync bool) error {
+	err := db.opts.hooks.doRename(from, to)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return errors.New("Unable to open %v for copying: %v", from, err)
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(filepath.Dir(to), flushTempPrefix)
+	if err != nil {
+		return errors.New("Unable to create temp file next to %v: %v", to, err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return errors.New("Unable to copy %v to %v: %v", from, out.Name(), err)
+	}
+	if sync {
+		if err := out.Sync(); err != nil {
+			return errors.New("Unable to sync %v: %v", out.Name(), err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return errors.New("Unable to close %v: %v", out.Name(), err)
+	}
+	// Source and destination are now on the same filesystem
+	if err := os.Rename(out.Name(), to); err != nil {
+		return err
+	}
+	in.Close()
+	os.Remove(from)
+	return nil
+}
+
+// isCrossDevice indicates whether err is a rename failure caused by the source
+// and destination being on different filesystems.
+func isCrossDevice(err error) bool {
+	linkErr, ok := err.(*os.LinkError)
+	return ok && linkErr.Err == syscall.EXDEV
+}
+
+// renameFile moves from to to, syncing any copy that's needed to get across
+// filesystems unless fsyncing is disabled.
+func (rs *rowStore) renameFile(from, to string) error {
+	return rs.t.db.renameFile(from, to, rs.t.db.opts.FsyncOnFlush != FsyncDisabled)
+}
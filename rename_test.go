@@ -0,0 +1,113 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameFileAcrossDevices(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	h := &hooks{}
+	db := &DB{opts: &DBOpts{hooks: h}}
+	renames := 0
+	h.rename = func(from, to string) error {
+		renames++
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+	}
+
+	from := filepath.Join(tmpDir, "from")
+	to := filepath.Join(tmpDir, "to")
+	if !assert.NoError(t, ioutil.WriteFile(from, []byte("the data"), 0644)) {
+		return
+	}
+	if !assert.NoError(t, db.renameFile(from, to, true)) {
+		return
+	}
+	assert.Equal(t, 1, renames)
+	data, err := ioutil.ReadFile(to)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "the data", string(data))
+	}
+	_, err = os.Stat(from)
+	assert.True(t, os.IsNotExist(err), "Source should have been removed")
+	leftovers, err := filepath.Glob(filepath.Join(tmpDir, flushTempPrefix+"*"))
+	assert.NoError(t, err)
+	assert.Empty(t, leftovers, "Copy should not leave temp file behind")
+
+	h.rename = func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.ENOENT}
+	}
+
+	assert.Error(t, db.renameFile(filepath.Join(tmpDir, "missing"), to, true), "Errors other than EXDEV should be returned")
+}
+
+func TestFlushAcrossDevices(t *testing.T) {
+	h := &hooks{}
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	h.rename = func(from, to string) error {
+		return &os.LinkError{Op: "rename", Old: from, New: to, Err: syscall.EXDEV}
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	open := func() (*DB, *table) {
+		db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true, hooks: h})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		db.clock.Advance(epoch)
+		err = db.CreateTable(&TableOpts{
+			Name:            "crossdevice",
+			RetentionPeriod: 1 * time.Hour,
+			SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+		})
+		if !assert.NoError(t, err) {
+			db.Close()
+			t.FailNow()
+		}
+		return db, db.getTable("crossdevice")
+	}
+
+	db, tbl := open()
+	_, err = db.InsertBatch("crossdevice", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 2}},
+	})
+	if !assert.NoError(t, err) {
+		db.Close()
+		return
+	}
+	tbl.forceFlush()
+	db.Close()
+
+	db, tbl = open()
+	defer db.Close()
+	fields := tbl.getFields()
+	keys := 0
+	_, err = tbl.iterate(context.Background(), fields, false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		keys++
+		val, _ := vals[0].ValueAtTime(epoch, fields[0].Expr, tbl.Resolution)
+		assert.EqualValues(t, 3, val)
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, keys, "Flushed data should have survived the cross-device rename")
+}
@@ -0,0 +1,194 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// replicationSource is the source under which a follower's rowStore tracks the
+// offset of the leader's WAL up to which it has applied replicated inserts. It
+// is distinct from the sources used for the table's own WAL (0) and for
+// cluster leaders, so replication can resume independently of either.
+const replicationSource = -1
+
+// maxReplicationFrameLength guards against allocating huge buffers when
+// reading a garbled length from the stream.
+const maxReplicationFrameLength = 64 * 1024 * 1024
+
+// ErrReplicationChecksum indicates that a replicated record failed checksum
+// verification.
+var ErrReplicationChecksum = errors.New("replicated record failed checksum verification")
+
+// WALStream streams this table's inbound WAL, starting after fromOffset, as a
+// sequence of framed and checksummed records that a follower can apply with
+// ReplicateFrom. A nil fromOffset starts at the beginning of the WAL. The
+// stream keeps tailing the WAL until ctx is done or the returned ReadCloser is
+// closed.
+func (rs *rowStore) WALStream(ctx context.Context, fromOffset wal.Offset) (io.ReadCloser, error) {
+	db := rs.t.db
+	db.tablesMutex.RLock()
+	w := db.streams[rs.t.From]
+	db.tablesMutex.RUnlock()
+	if w == nil {
+		return nil, errors.New("Stream '%v' not found", rs.t.From)
+	}
+
+	r, err := w.NewReader(fmt.Sprintf("replication.%v", rs.t.Name), fromOffset, db.walBuffers.Get)
+	if err != nil {
+		return nil, errors.New("Unable to open wal reader for %v: %v", rs.t.From, err)
+	}
+
+	pr, pw := io.Pipe()
+	stopped := make(chan interface{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+		}
+		r.Stop()
+		pr.CloseWithError(ctx.Err())
+	}()
+
+	db.Go(func(stopDB <-chan interface{}) {
+		defer r.Close()
+		var frame []byte
+		for {
+			data, err := r.Read()
+			if err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					pw.Close()
+					return
+				}
+				rs.t.log.Debugf("Unable to read from stream '%v' for replication, continuing: %v", rs.t.From, err)
+				continue
+			}
+			select {
+			case <-stopDB:
+				pw.CloseWithError(errors.New("Database closed"))
+				return
+			default:
+				// keep going
+			}
+			if data == nil {
+				// Ignore empty data
+				continue
+			}
+			frame = appendReplicationFrame(frame[:0], r.Offset(), data)
+			db.walBuffers.Put(data)
+			if _, writeErr := pw.Write(frame); writeErr != nil {
+				// Reader went away
+				return
+			}
+		}
+	})
+
+	return &walStream{pr, stopped}, nil
+}
+
+type walStream struct {
+	*io.PipeReader
+	stopped chan interface{}
+}
+
+func (s *walStream) Close() error {
+	select {
+	case <-s.stopped:
+		// already closed
+	default:
+		close(s.stopped)
+	}
+	return s.PipeReader.Close()
+}
+
+// appendReplicationFrame frames a WAL entry for replication as a 32 bit length
+// of offset and data, followed by the WAL offset, the data and a crc32c
+// checksum of offset and data.
+func appendReplicationFrame(frame []byte, offset wal.Offset, data []byte) []byte {
+	length := len(offset) + len(data)
+	needed := encoding.Width32bits + length + encoding.Width32bits
+	if cap(frame) < needed {
+		frame = make([]byte, 0, needed)
+	}
+	frame = frame[:needed]
+	encoding.WriteInt32(frame, length)
+	body := frame[encoding.Width32bits : encoding.Width32bits+length]
+	copy(body, offset)
+	copy(body[len(offset):], data)
+	encoding.WriteInt32(frame[encoding.Width32bits+length:], int(crc32.Checksum(body, crc32cTable)))
+	return frame
+}
+
+// ReplicateFrom applies the records read from a leader's WALStream to this
+// rowStore until the stream ends or ctx is done. Records at or before the
+// offset that was last applied (see ReplicatedOffset) are ignored, so a
+// follower that restarts can safely resume streaming from ReplicatedOffset.
+// If a record fails checksum verification, ReplicateFrom stops and returns
+// ErrReplicationChecksum without applying it. Since reads from the stream can
+// block, callers should close reader to interrupt a ReplicateFrom that's
+// waiting for data.
+func (rs *rowStore) ReplicateFrom(ctx context.Context, reader io.Reader) error {
+	t := rs.t
+	h := partitionHash()
+	limits := &walInsertLimits{t: t}
+	lastOffset := rs.ReplicatedOffset()
+	header := make([]byte, encoding.Width32bits)
+	var body []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				// Stream ended cleanly between records
+				return nil
+			}
+			return errors.New("Unable to read replicated record length: %v", err)
+		}
+		length, _ := encoding.ReadInt32(header)
+		if length < wal.OffsetSize || length > maxReplicationFrameLength {
+			return errors.New("Invalid replicated record length %d", length)
+		}
+		needed := length + encoding.Width32bits
+		if cap(body) < needed {
+			body = make([]byte, needed)
+		}
+		body = body[:needed]
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return errors.New("Unable to read replicated record: %v", err)
+		}
+		expected, _ := encoding.ReadInt32(body[length:])
+		if uint32(expected) != crc32.Checksum(body[:length], crc32cTable) {
+			return ErrReplicationChecksum
+		}
+
+		offset := wal.Offset(body[:wal.OffsetSize])
+		if lastOffset != nil && !offset.After(lastOffset) {
+			// Already applied
+			continue
+		}
+		// offset gets tracked by the memstore, so it can't share body's buffer
+		offset = append(wal.Offset(nil), offset...)
+		lastOffset = offset
+		data := body[wal.OffsetSize:length]
+		sequence := walSequence(data)
+		if !t.insert(data, false, h, offset, replicationSource, sequence, limits) {
+			// Did not insert (probably due to WHERE clause)
+			t.skip(offset, replicationSource, sequence)
+		}
+	}
+}
+
+// ReplicatedOffset returns the offset in the leader's WAL up to which this
+// rowStore has applied replicated inserts, including ones that were applied
+// before the last restart. It returns nil if nothing has been replicated yet.
+func (rs *rowStore) ReplicatedOffset() wal.Offset {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	return rs.memStore.offsetsBySource[replicationSource]
+}
@@ -0,0 +1,147 @@
+package zenodb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getlantern/wal"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplication(t *testing.T) {
+	const sql = "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)"
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+
+	leader, cleanup := newTestDB(t, &DBOpts{}, "replicated", sql)
+	defer cleanup()
+	leader.clock.Advance(epoch)
+	insert := func(n int) {
+		for i := 0; i < n; i++ {
+			err := leader.Insert("inbound", epoch, map[string]interface{}{"k": i % 10}, map[string]interface{}{"v": 1})
+			if !assert.NoError(t, err) {
+				t.FailNow()
+			}
+		}
+	}
+
+	// failing simulates a crash of the follower by failing its final flush
+	h := &hooks{}
+	failing := int32(0)
+	h.flushWriter = func(out io.Writer) io.Writer {
+		return &failingWriter{&failing, out}
+	}
+	followerDir, err := ioutil.TempDir("", "zenodbfollower")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(followerDir)
+	openFollower := func() *DB {
+		follower, err := NewDB(&DBOpts{Dir: followerDir, VirtualTime: true, IterationCoalesceInterval: 1 * time.Millisecond, hooks: h, FlushRetryBackoff: time.Millisecond})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		follower.clock.Advance(epoch)
+		err = follower.CreateTable(&TableOpts{Name: "replicated", RetentionPeriod: 1 * time.Hour, SQL: sql})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return follower
+	}
+
+	total := func(db *DB) float64 {
+		source, err := db.Query("SELECT v FROM replicated", false, nil, true)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		result := float64(0)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	waitFor := func(db *DB, expected float64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for total(db) != expected && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		assert.EqualValues(t, expected, total(db))
+	}
+
+	replicate := func(follower *DB, fromOffset wal.Offset) func() {
+		stream, err := leader.getTable("replicated").rowStore.WALStream(context.Background(), fromOffset)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		finished := make(chan error)
+		go func() {
+			finished <- follower.getTable("replicated").rowStore.ReplicateFrom(context.Background(), stream)
+		}()
+		return func() {
+			stream.Close()
+			<-finished
+		}
+	}
+
+	insert(100)
+	follower := openFollower()
+	stop := replicate(follower, nil)
+	waitFor(follower, 100)
+	insert(50)
+	waitFor(follower, 150)
+	stop()
+
+	// Restart follower, making sure it remembers where it left off
+	follower.getTable("replicated").forceFlush()
+	replicatedOffset := follower.getTable("replicated").rowStore.ReplicatedOffset()
+	assert.NotNil(t, replicatedOffset)
+	follower.Close()
+	insert(25)
+	follower = openFollower()
+	assert.Equal(t, replicatedOffset, follower.getTable("replicated").rowStore.ReplicatedOffset(), "Follower should have resumed at last replicated offset")
+
+	// Even replaying from the beginning shouldn't duplicate anything
+	stop = replicate(follower, nil)
+	waitFor(follower, 175)
+	stop()
+	time.Sleep(250 * time.Millisecond)
+	assert.EqualValues(t, 175, total(follower), "Replicated data should not have been duplicated")
+
+	// Replicated data that wasn't flushed before a crash isn't covered by
+	// ReplicatedOffset, so it gets replicated again after restarting
+	insert(25)
+	stop = replicate(follower, follower.getTable("replicated").rowStore.ReplicatedOffset())
+	waitFor(follower, 200)
+	stop()
+	atomic.StoreInt32(&failing, 1)
+	follower.Close()
+	atomic.StoreInt32(&failing, 0)
+	follower = openFollower()
+	defer follower.Close()
+	stop = replicate(follower, follower.getTable("replicated").rowStore.ReplicatedOffset())
+	waitFor(follower, 200)
+	stop()
+}
+
+func TestReplicationChecksum(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "replicated", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+	rs := db.getTable("replicated").rowStore
+
+	frame := appendReplicationFrame(nil, wal.NewOffsetForTS(time.Now()), []byte("some data"))
+	assert.NoError(t, rs.ReplicateFrom(context.Background(), bytes.NewReader(nil)), "Empty stream should be fine")
+	corrupted := append([]byte(nil), frame...)
+	corrupted[len(corrupted)-6] ^= 0xFF
+	assert.Equal(t, ErrReplicationChecksum, rs.ReplicateFrom(context.Background(), bytes.NewReader(corrupted)))
+	assert.Error(t, rs.ReplicateFrom(context.Background(), io.LimitReader(bytes.NewReader(frame), int64(len(frame)-1))), "Truncated record should fail")
+	assert.Nil(t, rs.ReplicatedOffset(), "Nothing should have been applied")
+}
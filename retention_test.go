@@ -0,0 +1,198 @@
+package zenodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlushAllExpired(t *testing.T) {
+	testFlushAllExpired(t, 0)
+	testFlushAllExpired(t, 10)
+}
+
+func testFlushAllExpired(t *testing.T, maxFileStores int) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "expiring",
+		RetentionPeriod: 1 * time.Hour,
+		MaxFileStores:   maxFileStores,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("expiring")
+	insert := func(ts time.Time) {
+		_, err := db.InsertBatch("expiring", []*Point{{TS: ts, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	total := func() float64 {
+		source, err := db.Query("SELECT v FROM expiring", false, nil, false)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		result := float64(0)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			result += row.Values[0]
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+	files := func() []string {
+		tbl.rowStore.mx.RLock()
+		defer tbl.rowStore.mx.RUnlock()
+		return tbl.rowStore.fileStore.files()
+	}
+
+	insert(epoch)
+	tbl.forceFlush()
+	filesBefore := files()
+	assert.EqualValues(t, 1, total())
+
+	// Insert data that's already past retention by the time it's flushed
+	insert(epoch)
+	later := epoch.Add(2 * time.Hour)
+	db.clock.Advance(later)
+	tbl.forceFlush()
+	assert.Zero(t, tbl.rowStore.Stats().MemStoreBytes, "Memstore should have been flushed")
+	if maxFileStores > 0 {
+		assert.Equal(t, filesBefore, files(), "Empty delta should not have been added")
+	} else if assert.Len(t, files(), 1) {
+		fs := &fileStore{t: tbl, fields: tbl.getFields(), filename: files()[0]}
+		rows := 0
+		_, err := fs.iterate(tbl.getFields(), nil, false, false, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			rows++
+			return true, nil
+		})
+		assert.NoError(t, err, "Empty file store should be readable")
+		assert.Zero(t, rows, "All rows should have been dropped")
+	}
+	assert.Zero(t, total())
+
+	// Flushing and querying should keep working afterwards
+	insert(later)
+	tbl.forceFlush()
+	assert.EqualValues(t, 1, total())
+}
+
+func TestRetentionInterval(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:              "expiring",
+		RetentionPeriod:   1 * time.Hour,
+		RetentionInterval: 50 * time.Millisecond,
+		SQL:               "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	var points []*Point
+	for i := 0; i < 100; i++ {
+		points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": i}, Vals: map[string]interface{}{"v": 1}})
+	}
+	_, err = db.InsertBatch("expiring", points)
+	if !assert.NoError(t, err) {
+		return
+	}
+	db.getTable("expiring").forceFlush()
+	stats := db.TableStats("expiring").RowStore
+	bytesWithData := stats.BytesOnDisk
+	assert.True(t, bytesWithData > 0)
+
+	// Once the data expires, it gets dropped from disk without any further inserts
+	db.clock.Advance(epoch.Add(2 * time.Hour))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		stats = db.TableStats("expiring").RowStore
+		if stats.BytesOnDisk < bytesWithData {
+			break
+		}
+		time.Sleep(25 * time.Millisecond)
+	}
+	assert.True(t, stats.BytesOnDisk < bytesWithData, "Expired data should have been dropped from disk")
+	assert.True(t, stats.Flushes > 1, "File store should have been rewritten")
+}
+
+func TestFieldRetentions(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "unknownfield",
+		RetentionPeriod: 1 * time.Hour,
+		FieldRetentions: map[string]time.Duration{"missing": 10 * time.Minute},
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1m)",
+	})
+	assert.Error(t, err, "Retention for unknown field should be rejected")
+
+	err = db.CreateTable(&TableOpts{
+		Name:            "mixed",
+		RetentionPeriod: 1 * time.Hour,
+		FieldRetentions: map[string]time.Duration{"raw": 10 * time.Minute},
+		SQL:             "SELECT SUM(v) AS raw, SUM(v) AS total FROM inbound GROUP BY k, period(1m)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("mixed")
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 0, 0, time.UTC)
+	db.clock.Advance(epoch)
+	old := epoch.Add(-30 * time.Minute)
+	recent := epoch.Add(-1 * time.Minute)
+	_, err = db.InsertBatch("mixed", []*Point{
+		{TS: old, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: recent, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 2}},
+		{TS: old, Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 4}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fields := core.Fields{tbl.getFields()[1], tbl.getFields()[2]}
+	check := func(includeMemStore bool, label string) {
+		type values struct {
+			raw, total map[time.Time]float64
+		}
+		result := make(map[string]values)
+		_, err := tbl.iterate(context.Background(), fields, includeMemStore, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			v := values{make(map[time.Time]float64), make(map[time.Time]float64)}
+			for _, ts := range []time.Time{old, recent} {
+				if val, found := vals[0].ValueAtTime(ts, fields[0].Expr, tbl.Resolution); found {
+					v.raw[ts] = val
+				}
+				if val, found := vals[1].ValueAtTime(ts, fields[1].Expr, tbl.Resolution); found {
+					v.total[ts] = val
+				}
+			}
+			result[key.Get("k").(string)] = v
+			return true, nil
+		})
+		if !assert.NoError(t, err, label) {
+			return
+		}
+		assert.Equal(t, map[time.Time]float64{recent: 2}, result["a"].raw, label+": raw should only include data within its retention")
+		assert.Equal(t, map[time.Time]float64{old: 1, recent: 2}, result["a"].total, label+": total should include data within the table's retention")
+		assert.Empty(t, result["b"].raw, label+": raw should be empty for expired periods")
+		assert.Equal(t, map[time.Time]float64{old: 4}, result["b"].total, label)
+	}
+
+	check(true, "memstore")
+	tbl.forceFlush()
+	check(false, "file")
+}
@@ -0,0 +1,218 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	rollupDir = "rollup"
+)
+
+// rollupFilenameFor returns the name of the rollup file that accompanies the
+// given file store. Rollups live in their own subdirectory so that they're not
+// mistaken for file stores.
+func (rs *rowStore) rollupFilenameFor(fileStoreName string) string {
+	return filepath.Join(rs.opts.dir, rollupDir, filepath.Base(fileStoreName))
+}
+
+// existingRollupFor returns the name of the rollup file for the given file
+// store if the table has a rollup and the file exists, otherwise "".
+func (rs *rowStore) existingRollupFor(fileStoreName string) string {
+	if len(rs.t.RollupBy) == 0 || fileStoreName == "" {
+		return ""
+	}
+	filename := rs.rollupFilenameFor(fileStoreName)
+	if _, err := os.Stat(filename); err != nil {
+		return ""
+	}
+	return filename
+}
+
+// rollupBuilder aggregates rows by the table's RollupBy dimensions so that
+// they can be written out as a rollup.
+type rollupBuilder struct {
+	rs             *rowStore
+	include        map[string]bool
+	truncateBefore time.Time
+	rows           map[string][]encoding.Sequence
+}
+
+// newRollupBuilder returns a rollupBuilder for this table, or nil if the table
+// doesn't have a rollup.
+func (rs *rowStore) newRollupBuilder() *rollupBuilder {
+	if len(rs.t.RollupBy) == 0 {
+		return nil
+	}
+	include := make(map[string]bool, len(rs.t.RollupBy))
+	for _, dim := range rs.t.RollupBy {
+		include[dim] = true
+	}
+	return &rollupBuilder{
+		rs:             rs,
+		include:        include,
+		truncateBefore: rs.t.truncateBefore(),
+		rows:           make(map[string][]encoding.Sequence),
+	}
+}
+
+// add adds a row to the rollup. The rollup holds on to the sequences in
+// columns, so their buffers must not be reused afterwards.
+func (rb *rollupBuilder) add(key bytemap.ByteMap, columns []encoding.Sequence) {
+	rollupKey := string(key.Slice(rb.include))
+	existing := rb.rows[rollupKey]
+	if existing == nil {
+		// Copy the slice since merging updates it in place
+		rb.rows[rollupKey] = append([]encoding.Sequence(nil), columns...)
+		return
+	}
+	rb.rows[rollupKey] = mergeColumns(existing, columns, rb.rs.fields, rb.rs.t.Resolution, rb.truncateBefore)
+}
+
+// writeRollup writes a rollup of the given file store by reading it. Flushes
+// build their rollup while writing the file store instead, see fileStore.flush.
+func (rs *rowStore) writeRollup(fs *fileStore, offsetsBySource common.OffsetsBySource) (string, error) {
+	rb := rs.newRollupBuilder()
+	_, err := fs.iterate(rs.fields, nil, false, false, rb.truncateBefore, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		rb.add(key, columns)
+		return true, nil
+	})
+	if err != nil {
+		return "", errors.New("Unable to read %v for rollup: %v", fs.filename, err)
+	}
+	return rb.write(fs, offsetsBySource)
+}
+
+// write writes the rollup that accompanies the given file store. The rollup is
+// stored in the same format as a file store.
+func (rb *rollupBuilder) write(fs *fileStore, offsetsBySource common.OffsetsBySource) (string, error) {
+	rs := rb.rs
+	start := time.Now()
+	fields := rs.fields
+
+	dir := filepath.Join(rs.opts.dir, rollupDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.New("Unable to create rollup directory %v: %v", dir, err)
+	}
+	out, err := ioutil.TempFile(rs.opts.scratchDir, "nextrollup")
+	if err != nil {
+		return "", errors.New("Unable to create temp file for rollup: %v", err)
+	}
+	defer out.Close()
+
+	cout, err := fs.createOutWriter(out, fields, offsetsBySource, false)
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0, len(rb.rows))
+	for key := range rb.rows {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	codecs := codecsFor(fields)
+	for _, key := range keys {
+		if _, _, err := fs.doWrite(cout, fields, codecs, nil, rb.truncateBefore, false, bytemap.ByteMap(key), rb.rows[key], nil); err != nil {
+			cout.Close()
+			return "", errors.New("Unable to write rollup row: %v", err)
+		}
+	}
+	if f, ok := cout.(flushable); ok {
+		if err := f.Flush(); err != nil {
+			cout.Close()
+			return "", errors.New("Unable to flush rollup: %v", err)
+		}
+	}
+	if err := cout.Close(); err != nil {
+		return "", errors.New("Unable to close rollup writer: %v", err)
+	}
+	if err := out.Sync(); err != nil {
+		return "", errors.New("Unable to sync rollup: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		return "", errors.New("Unable to close rollup: %v", err)
+	}
+
+	filename := rs.rollupFilenameFor(fs.filename)
+	if err := rs.renameFile(out.Name(), filename); err != nil {
+		return "", errors.New("Unable to move rollup into place at %v: %v", filename, err)
+	}
+	rs.t.log.Debugf("Rolled up %v into %d rows at %v in %v", fs.filename, len(keys), filename, time.Now().Sub(start))
+	return filename, nil
+}
+
+// iterateRollup iterates over the rollup for the current file store. The
+// rollup doesn't include data from the memstore.
+func (rs *rowStore) iterateRollup(ctx context.Context, outFields core.Fields, truncateBefore time.Time, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) (common.OffsetsBySource, error) {
+	guard := core.Guard(ctx)
+
+	rs.mx.Lock()
+	filename := rs.rollupFile
+	if filename == "" {
+		rs.mx.Unlock()
+		return nil, errors.New("No rollup available for table %v", rs.t.Name)
+	}
+	rs.iterationsInProgress[filename]++
+	rs.mx.Unlock()
+	defer func() {
+		rs.mx.Lock()
+		rs.iterationsInProgress[filename]--
+		rs.mx.Unlock()
+	}()
+
+	fs := &fileStore{t: rs.t, rs: rs, fields: rs.fields, filename: filename}
+	return fs.iterate(outFields, nil, false, false, truncateBefore, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		return guard.ProceedAfter(onValue(key, columns))
+	})
+}
+
+// hasRollup indicates whether a rollup is available for the current file store.
+func (rs *rowStore) hasRollup() bool {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	return rs.rollupFile != ""
+}
+
+// removeOldRollups removes rollups that have been superseded for longer than
+// opts.oldFileRetention and that aren't being iterated.
+func (rs *rowStore) removeOldRollups() {
+	dir := filepath.Join(rs.opts.dir, rollupDir)
+	files, err := listRegularFiles(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			rs.t.log.Errorf("Unable to list rollups in %v: %v", dir, err)
+		}
+		return
+	}
+
+	rs.mx.RLock()
+	current := rs.rollupFile
+	rs.mx.RUnlock()
+	// files are sorted chronologically, so each file was superseded by the next
+	for i := 0; i < len(files)-1; i++ {
+		filename := filepath.Join(dir, files[i].Name())
+		if filename == current || time.Since(files[i+1].ModTime()) < rs.opts.oldFileRetention {
+			continue
+		}
+		rs.mx.RLock()
+		okayToRemove := rs.iterationsInProgress[filename] == 0
+		rs.mx.RUnlock()
+		if okayToRemove {
+			rs.t.log.Debugf("Removing old rollup %v", filename)
+			if err := os.Remove(filename); err != nil {
+				rs.t.log.Errorf("Unable to delete old rollup %v: %v", filename, err)
+			} else {
+				rs.t.db.invalidateSequenceCache(filename)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollup(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+
+	err := db.CreateTable(&TableOpts{
+		Name:            "rolled",
+		RetentionPeriod: 1 * time.Hour,
+		SQL:             "SELECT SUM(v) AS v, COUNT(v) AS c FROM inbound GROUP BY a, b, period(1s)",
+		RollupBy:        []string{"a"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	resolution := time.Second
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+
+	insert := func(a string, b string, ts time.Time, v float64) {
+		_, err := db.InsertBatch("rolled", []*Point{{TS: ts, Dims: map[string]interface{}{"a": a, "b": b}, Vals: map[string]interface{}{"v": v}}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+
+	query := func(sqlString string) (map[string][]float64, string) {
+		source, err := db.Query(sqlString, false, nil, false)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		var fields core.Fields
+		result := make(map[string][]float64)
+		_, err = source.Iterate(context.Background(), func(inFields core.Fields) error {
+			fields = inFields
+			return nil
+		}, func(row *core.FlatRow) (bool, error) {
+			result[fmt.Sprintf("%v@%d", row.Key.Get("a"), row.TS)] = row.Values
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return result, MetaDataFor(source, fields).Plan
+	}
+
+	insert("1", "x", epoch.Add(-2*resolution), 1)
+	insert("1", "y", epoch.Add(-2*resolution), 2)
+	insert("1", "y", epoch.Add(-1*resolution), 3)
+	insert("2", "x", epoch.Add(-1*resolution), 4)
+	insert("2", "z", epoch, 5)
+	db.getTable("rolled").forceFlush()
+
+	rs := db.getTable("rolled").rowStore
+	rollupFile := rs.rollupFile
+	assert.NotEmpty(t, rollupFile, "Flush should have written a rollup")
+	_, err = os.Stat(rollupFile)
+	assert.NoError(t, err, "Rollup file should exist")
+
+	rolledUp, plan := query("SELECT v, c FROM rolled GROUP BY a")
+	assert.Contains(t, plan, "rollup by a")
+	fullScan, plan := query("SELECT v, c FROM rolled WHERE b <> 'none' GROUP BY a")
+	assert.NotContains(t, plan, "rollup by")
+	assert.Len(t, rolledUp, 4)
+	assert.Equal(t, fullScan, rolledUp, "Rollup should match aggregate of full scan")
+
+	_, plan = query("SELECT v, c FROM rolled GROUP BY a, b")
+	assert.NotContains(t, plan, "rollup by", "Rollup should not be used when grouping by other dimensions")
+
+	// Subsequent flushes should roll up the new file store, including data from
+	// the prior one
+	insert("1", "z", epoch.Add(-2*resolution), 6)
+	db.getTable("rolled").forceFlush()
+	assert.NotEqual(t, rollupFile, rs.rollupFile)
+	rolledUp, _ = query("SELECT v, c FROM rolled GROUP BY a")
+	fullScan, _ = query("SELECT v, c FROM rolled WHERE b <> 'none' GROUP BY a")
+	assert.Equal(t, fullScan, rolledUp, "Rollup should match aggregate of full scan after additional flush")
+}
@@ -7,16 +7,18 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/golang/snappy"
 	"github.com/oxtoacart/emsort"
 
 	"github.com/dustin/go-humanize"
@@ -24,32 +26,133 @@ import (
 	"github.com/getlantern/errors"
 	"github.com/getlantern/goexpr"
 	"github.com/getlantern/wal"
-	"github.com/getlantern/zenodb/bytetree"
 	"github.com/getlantern/zenodb/common"
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
 )
 
 const (
 	// File format versions
-	FileVersion_4      = 4
-	FileVersion_5      = 5
-	CurrentFileVersion = FileVersion_5
+	FileVersion_4 = 4
+	FileVersion_5 = 5
+	FileVersion_6 = 6
+	// Version 7 stores column lengths as varints rather than uint64s
+	FileVersion_7 = 7
+	// Version 8 appends a CRC32C checksum of each row to the row
+	FileVersion_8 = 8
+	// Version 9 ends with a footer containing the row count and a sparse index
+	// of keys
+	FileVersion_9 = 9
+	// Version 10 adds a bloom filter of keys to the footer
+	FileVersion_10 = 10
+	// Version 11 encodes keys using a dictionary of dimensions stored in the
+	// footer
+	FileVersion_11 = 11
+	// Version 12 records the order in which sorted rows are sorted in the
+	// footer
+	FileVersion_12 = 12
+	// Version 13 records the table's resolution in the footer
+	FileVersion_13     = 13
+	CurrentFileVersion = FileVersion_13
 
 	offsetFilename = "offset"
+
+	// flushTempPrefix is the prefix of the temp files to which flushes write
+	// before moving them into place
+	flushTempPrefix = "nextrowstore"
+
+	// memStoreLengthsToTrack is how many recent memstore lengths to consider
+	// when sizing new memstores
+	memStoreLengthsToTrack = 5
 )
 
 var (
 	fieldsDelims = map[int]string{
-		FileVersion_4: "|",
-		FileVersion_5: "|",
-	}
+		FileVersion_4:  "|",
+		FileVersion_5:  "|",
+		FileVersion_6:  "|",
+		FileVersion_7:  "|",
+		FileVersion_8:  "|",
+		FileVersion_9:  "|",
+		FileVersion_10: "|",
+		FileVersion_11: "|",
+		FileVersion_12: "|",
+		FileVersion_13: "|",
+	}
+
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 )
 
 type rowStoreOptions struct {
 	dir             string
+	scratchDir      string
 	minFlushLatency time.Duration
 	maxFlushLatency time.Duration
+	// targetFlushInterval, if positive, is how long to wait between flushes as
+	// long as that keeps the memstore below maxMemStoreBytes. If 0, the wait is
+	// ten times the duration of the last flush.
+	targetFlushInterval time.Duration
+	// maxMemStoreBytes, if positive, is the size that the memstore should stay
+	// below. Flushes happen sooner than targetFlushInterval whenever the recent
+	// ingestion rate would otherwise fill the memstore beyond this, and as soon
+	// as the memstore reaches it.
+	maxMemStoreBytes int
+	// initialMemStoreCapacity, if positive, is the number of keys for which to
+	// reserve space in new memstores
+	initialMemStoreCapacity int
+	// retentionInterval, if positive, is how frequently to rewrite the file
+	// store in order to drop data that has fallen out of the retention period,
+	// regardless of whether there's anything to flush
+	retentionInterval time.Duration
+	// readOnly indicates that this row store only reads the file stores in dir,
+	// picking up new ones as they appear. It never inserts, flushes or removes
+	// files.
+	readOnly bool
+	// readReplica indicates that another process owns dir and that this row
+	// store only reads the file stores written by it. Read replicas are always
+	// readOnly.
+	readReplica bool
+	// pollInterval is how frequently read only row stores check for new file
+	// stores
+	pollInterval time.Duration
+	// oldFileRetention is how long to keep superseded file stores around
+	oldFileRetention time.Duration
+	// skipDirLock disables locking of dir
+	skipDirLock bool
+	// skipChecksumVerification disables verification of row checksums when
+	// reading file stores
+	skipChecksumVerification bool
+	// maxFileStores, if greater than 1, enables incremental flushes. Rather
+	// than rewriting the entire file store, each flush writes just the memstore
+	// to a new delta file, and a background compaction merges the oldest files
+	// whenever there are more than maxFileStores of them.
+	maxFileStores int
+	// minCompactionBytes is the minimum size of the files merged by a
+	// compaction. Compaction merges additional files until it reaches this size.
+	minCompactionBytes int64
+	// codec is used to compress new file stores, defaults to SnappyFileCodec
+	codec FileCodec
+	// bloomFalsePositiveRate is the false positive rate of the bloom filters
+	// in new file stores, defaults to DefaultBloomFilterFalsePositiveRate.
+	// Negative disables bloom filters.
+	bloomFalsePositiveRate float64
+	// indexBlockRows is the number of rows in each indexed block of sorted file
+	// stores, defaults to keyIndexInterval.
+	indexBlockRows int
+	// insertQueueSize is the number of inserts and batches that can be queued
+	// for processInserts before inserting blocks
+	insertQueueSize int
+	// restoreFrom, if set, is a snapshot directory from which to initialize dir
+	// if it doesn't contain any file stores yet
+	restoreFrom string
+	// interceptInsert, if set, is called for every insert before it's applied
+	// to the memstore. Returning an error drops the insert, otherwise the
+	// returned insert is applied instead.
+	interceptInsert func(*insert) (*insert, error)
+	// keyOrder is the order in which sorted flushes sort rows by key. All
+	// sorted files in dir need to be in this order.
+	keyOrder keyOrder
 }
 
 type insert struct {
@@ -58,6 +161,23 @@ type insert struct {
 	metadata bytemap.ByteMap
 	offset   wal.Offset
 	source   int
+	sequence int64
+}
+
+// insertBatch is a group of inserts that get applied to the memstore under a
+// single lock acquisition. done is closed once all inserts have been applied.
+type insertBatch struct {
+	inserts []*insert
+	done    chan interface{}
+}
+
+// flushRequest asks the processInserts loop to flush the memstore. Once the
+// flush is done, the result is sent to done.
+type flushRequest struct {
+	// durable indicates that the flushed file must also have been moved to
+	// durable storage (see DBOpts.FlushScratchDir) before the flush is done
+	durable bool
+	done    chan error
 }
 
 type rowStore struct {
@@ -68,37 +188,118 @@ type rowStore struct {
 	memStore             *memstore
 	fileStore            *fileStore
 	inserts              chan *insert
-	forceFlushes         chan bool
-	forceFlushCompletes  chan bool
+	batches              chan *insertBatch
+	forceFlushes         chan *flushRequest
+	moves                chan *flushMove
 	flushCount           int
 	iterationsInProgress map[string]int
-	mx                   sync.RWMutex
+	// corruptionChecks holds the names of files that are being verified as
+	// corrupt, see verifyCorruptLater
+	corruptionChecks map[string]bool
+	// appliedSequence is the highest WAL sequence number that has been applied
+	// to the memstore
+	appliedSequence int64
+	// lastFileNanos is the timestamp embedded in the name of the newest file
+	// store written or found by this row store. It is accessed atomically.
+	lastFileNanos int64
+	// recentMemStoreLengths tracks the number of keys in recently flushed
+	// memstores. It is only accessed from the processInserts goroutine.
+	recentMemStoreLengths []int
+	// dirLock, if not nil, is the lock on opts.dir held by this row store
+	dirLock *dirLock
+	// batchLog logs batch inserts until they're flushed, nil for read only row
+	// stores
+	batchLog *batchLog
+	// rollupFile is the rollup for the current file store, if available
+	rollupFile string
+	// tombstones are deleted keys that haven't been purged from storage yet.
+	// The map is replaced rather than modified whenever it changes.
+	tombstones map[string]bool
+	purges     chan *purgeRequest
+	// fieldRenames maps the old names of renamed fields to their current names,
+	// so that files written before the rename can still be read. The map is
+	// replaced rather than modified whenever it changes.
+	fieldRenames map[string]string
+	// keysPurgedByLastFlush is the number of deleted keys dropped by the most
+	// recent flush. It is only accessed from the processInserts goroutine.
+	keysPurgedByLastFlush int
+	// truncateOnNextFlush forces the next full flush to drop expired data. It's
+	// only accessed from the processInserts goroutine.
+	truncateOnNextFlush bool
+	// replaceOnNextFlush causes the next full flush to write just the memstore,
+	// discarding the data in the existing file store. It's only accessed from
+	// the processInserts goroutine.
+	replaceOnNextFlush bool
+	rebuilds           chan *rebuildRequest
+	migrations         chan *migrationRequest
+	// migrationProgress is the progress of the currently running migration, if
+	// any
+	migrationProgress  *MigrationProgress
+	compactionRequests chan interface{}
+	// maxMemStoreBytes and maxFlushLatency start out as the corresponding
+	// opts and can be changed at runtime with SetFlushOptions. They are
+	// accessed atomically.
+	maxMemStoreBytes int64
+	maxFlushLatency  int64
+	// flushOptionsChanged tells processInserts that SetFlushOptions was called
+	flushOptionsChanged chan interface{}
+	// memStoreFull tells processInserts that insertBatch filled the memstore
+	// up to maxMemStoreBytes
+	memStoreFull chan interface{}
+	// flushStats holds the flush related parts of Stats()
+	flushStats RowStoreStats
+	// compactionMx is held by anything that replaces the base file store while
+	// deltas may exist (compactions, full flushes and migrations)
+	compactionMx sync.Mutex
+	// applyMx is held for reading while batches are applied directly to the
+	// memstore by their callers, and for writing by processInserts whenever it
+	// needs the memstore to hold still, e.g. while flushing it.
+	applyMx sync.RWMutex
+	// closing is closed by Close to stop the row store
+	closing   chan interface{}
+	closeOnce sync.Once
+	// stop is closed as soon as either the database or the row store is
+	// closing. It's what the row store's background tasks stop on.
+	stop chan interface{}
+	// tasks tracks the row store's background tasks
+	tasks sync.WaitGroup
+	mx    sync.RWMutex
 }
 
-type memstore struct {
-	fields          core.Fields
-	tree            *bytetree.Tree
-	offsetsBySource common.OffsetsBySource
-	offsetChanged   bool
-}
+func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, common.OffsetsBySource, error) {
+	err := os.MkdirAll(opts.dir, 0755)
+	if err != nil && !os.IsExist(err) {
+		return nil, nil, errors.New("Unable to create folder for row store: %v", err)
+	}
 
-func (ms *memstore) copy() *memstore {
-	copyOfOffsets := make(common.OffsetsBySource)
-	for source, offset := range ms.offsetsBySource {
-		copyOfOffsets[source] = offset
+	if opts.readReplica || opts.skipDirLock {
+		// read replicas share the directory with the writer that owns it
+		return t.doOpenRowStore(opts, nil)
+	}
+	lock, err := lockDir(opts.dir)
+	if err != nil {
+		return nil, nil, err
 	}
-	return &memstore{
-		fields:          ms.fields,
-		tree:            ms.tree.Copy(),
-		offsetsBySource: copyOfOffsets,
-		offsetChanged:   ms.offsetChanged,
+	rs, offsetsBySource, err := t.doOpenRowStore(opts, lock)
+	if err != nil {
+		lock.release()
 	}
+	return rs, offsetsBySource, err
 }
 
-func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, common.OffsetsBySource, error) {
-	err := os.MkdirAll(opts.dir, 0755)
-	if err != nil && !os.IsExist(err) {
-		return nil, nil, errors.New("Unable to create folder for row store: %v", err)
+func (t *table) doOpenRowStore(opts *rowStoreOptions, lock *dirLock) (*rowStore, common.OffsetsBySource, error) {
+	if opts.restoreFrom != "" && !opts.readReplica {
+		if err := t.restoreSnapshot(opts.restoreFrom, opts.dir); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if !opts.readOnly {
+		// Read only row stores leave the temp files of whoever writes the files
+		// alone
+		if err := t.removeOrphanedFlushFiles(opts.dir); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	existingFileName := ""
@@ -116,6 +317,10 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, common.OffsetsBy
 		for i := len(files) - 1; i >= 0; i-- {
 			filename := files[i].Name()
 			existingFileName = filepath.Join(opts.dir, files[i].Name())
+			if strings.HasPrefix(filename, flushTempPrefix) {
+				// This is an in-progress flush of whoever writes the files
+				continue
+			}
 			if filename == offsetFilename {
 				// This is an offset file, just read the offset
 				o, err := ioutil.ReadFile(existingFileName)
@@ -143,6 +348,10 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, common.OffsetsBy
 			if err != nil {
 				if !opened {
 					return nil, nil, err
+				} else if opts.readOnly {
+					// Leave it to whoever writes the files to deal with the corrupted file
+					t.log.Errorf("Unable to read offset from existing file %v, skipping: %v", existingFileName, err)
+					continue
 				} else {
 					t.log.Errorf("Unable to read offset from existing file %v, assuming corrupted and will remove: %v", existingFileName, err)
 					rmErr := os.Remove(existingFileName)
@@ -158,6 +367,18 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, common.OffsetsBy
 			break
 		}
 	}
+	deltas, err := liveDeltas(opts.dir, existingFileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(deltas) > 0 {
+		newOffsetsBySource, _, err := t.readWALOffsets(deltas[len(deltas)-1])
+		if err != nil {
+			return nil, nil, err
+		}
+		offsetsBySource = newOffsetsBySource.Advance(offsetsBySource)
+		t.log.Debugf("Initializing row store with %d deltas", len(deltas))
+	}
 
 	fields := t.getFields()
 	rs := &rowStore{
@@ -165,26 +386,129 @@ func (t *table) openRowStore(opts *rowStoreOptions) (*rowStore, common.OffsetsBy
 		t:                    t,
 		fields:               fields,
 		fieldUpdates:         make(chan core.Fields),
-		inserts:              make(chan *insert),
-		forceFlushes:         make(chan bool),
-		forceFlushCompletes:  make(chan bool),
+		inserts:              make(chan *insert, opts.insertQueueSize),
+		batches:              make(chan *insertBatch, opts.insertQueueSize),
+		forceFlushes:         make(chan *flushRequest),
+		purges:               make(chan *purgeRequest),
+		rebuilds:             make(chan *rebuildRequest),
+		migrations:           make(chan *migrationRequest),
+		compactionRequests:   make(chan interface{}, 1),
+		maxMemStoreBytes:     int64(opts.maxMemStoreBytes),
+		maxFlushLatency:      int64(opts.maxFlushLatency),
+		flushOptionsChanged:  make(chan interface{}, 1),
+		memStoreFull:         make(chan interface{}, 1),
 		iterationsInProgress: make(map[string]int),
+		corruptionChecks:     make(map[string]bool),
+		dirLock:              lock,
+		closing:              make(chan interface{}),
+		stop:                 make(chan interface{}),
 		fileStore: &fileStore{
 			t:        t,
 			fields:   fields,
 			filename: existingFileName,
+			deltas:   deltas,
 		},
 	}
 	rs.fileStore.rs = rs
+	if err := rs.fileStore.checkCompatibility(opts.keyOrder, t.Resolution); err != nil {
+		return nil, nil, err
+	}
+	for _, filename := range rs.fileStore.files() {
+		rs.advanceFileNanos(fileStoreNanos(filename))
+	}
+	if len(deltas) == 0 {
+		rs.rollupFile = rs.existingRollupFor(existingFileName)
+	}
+	rs.tombstones, err = rs.readTombstones()
+	if err != nil {
+		return nil, nil, err
+	}
+	rs.fieldRenames, err = rs.readFieldRenames()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The memstore exists before processInserts starts so that batches can be
+	// applied to it right away
+	rs.memStore = rs.newMemStore(offsetsBySource)
+	go func() {
+		select {
+		case <-t.db.closing:
+		case <-rs.closing:
+		}
+		close(rs.stop)
+	}()
+
+	if opts.readOnly {
+		// Read only row stores never insert or flush, they just pick up new file
+		// stores as they appear (e.g. as a read replica's writer creates them).
+		rs.Go(rs.pollFileStores)
+		return rs, offsetsBySource, nil
+	}
 
-	t.db.Go(func(stop <-chan interface{}) {
+	if opts.scratchDir != "" {
+		// Anything left in the scratch dir never made it to durable storage, so
+		// we'll recover it from the WAL instead.
+		if err := os.RemoveAll(opts.scratchDir); err != nil {
+			return nil, nil, errors.New("Unable to clear scratch dir %v: %v", opts.scratchDir, err)
+		}
+		if err := os.MkdirAll(opts.scratchDir, 0755); err != nil {
+			return nil, nil, errors.New("Unable to create scratch dir %v: %v", opts.scratchDir, err)
+		}
+		rs.moves = make(chan *flushMove, maxPendingMoves)
+		rs.Go(rs.moveFlushedFiles)
+	}
+
+	// Recover batch inserts that weren't flushed before the last shutdown
+	rs.batchLog, err = openBatchLog(filepath.Join(opts.dir, batchLogDirName), t.db.opts.WALSyncInterval, t.log)
+	if err != nil {
+		return nil, nil, err
+	}
+	replayed, err := rs.batchLog.replay(func(inserts []*insert) {
+		rs.applyToMemStore(rs.memStore, inserts)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if replayed > 0 {
+		t.log.Debugf("Replayed %d unflushed batch inserts", replayed)
+	}
+	if rs.batchLog.syncInterval > 0 {
+		rs.Go(rs.batchLog.sync)
+	}
+
+	rs.Go(func(stop <-chan interface{}) {
 		rs.processInserts(offsetsBySource, stop)
 	})
-	t.db.Go(rs.removeOldFiles)
+	rs.Go(rs.removeOldFiles)
+	if rs.incrementalFlushes() {
+		rs.Go(rs.compactFileStores)
+		rs.requestCompaction()
+	}
 
 	return rs, offsetsBySource, nil
 }
 
+// removeOrphanedFlushFiles removes the temp files of flushes that were
+// interrupted by a crash from dir.
+func (t *table) removeOrphanedFlushFiles(dir string) error {
+	files, err := listRegularFiles(dir)
+	if err != nil {
+		return errors.New("Unable to read contents of directory: %v", err)
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), flushTempPrefix) {
+			continue
+		}
+		filename := filepath.Join(dir, file.Name())
+		t.log.Debugf("Removing temp file %v left behind by interrupted flush", filename)
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return errors.New("Unable to remove temp file %v: %v", filename, err)
+		}
+	}
+	return nil
+}
+
 func (t *table) readWALOffsets(filename string) (common.OffsetsBySource, bool, error) {
 	opened := false
 	var offsetsBySource common.OffsetsBySource
@@ -197,9 +521,11 @@ func (t *table) readWALOffsets(filename string) (common.OffsetsBySource, bool, e
 	defer file.Close()
 	opened = true
 
-	fileVersion := t.versionFor(filename)
-
-	r := snappy.NewReader(file)
+	r, header, err := readFileHeader(file, filename, t.versionFor(filename))
+	if err != nil {
+		return offsetsBySource, opened, err
+	}
+	fileVersion := header.version
 
 	headerLength := uint32(0)
 	lengthErr := binary.Read(r, encoding.Binary, &headerLength)
@@ -219,39 +545,279 @@ func (rs *rowStore) memStoreSize() int {
 	size := 0
 	rs.mx.RLock()
 	if rs.memStore != nil {
-		size = rs.memStore.tree.Bytes()
+		size = rs.memStore.bytes()
 	}
 	rs.mx.RUnlock()
 	return size
 }
 
+// Go runs the given task in the background like DB.Go, except that the task is
+// told to stop as soon as either the database or this row store is closing.
+func (rs *rowStore) Go(task func(stop <-chan interface{})) {
+	rs.tasks.Add(1)
+	rs.t.db.Go(func(_ <-chan interface{}) {
+		defer rs.tasks.Done()
+		task(rs.stop)
+	})
+}
+
+// Close stops the row store. It stops accepting inserts, applies the inserts
+// that have already been queued, flushes the memstore one last time, waits for
+// flushed files to be moved to durable storage and stops all of the row
+// store's background tasks. Inserts that are read from the WAL after that
+// aren't applied, so they're read again once the table is reopened. Close
+// returns an error if the final flush failed, in which case the data that
+// wasn't flushed can only be recovered from the WAL or the batch log. It's safe
+// to call Close more than once.
+func (rs *rowStore) Close() error {
+	rs.closeOnce.Do(func() {
+		rs.t.log.Debug("Closing row store")
+		close(rs.closing)
+	})
+	rs.tasks.Wait()
+	if rs.opts.readOnly {
+		return nil
+	}
+	rs.mx.RLock()
+	unflushed := rs.memStore.length()
+	rs.mx.RUnlock()
+	if unflushed > 0 {
+		return errors.New("Unable to flush %d keys of table %v before closing", unflushed, rs.t.Name)
+	}
+	return nil
+}
+
+// isStopped indicates whether the row store has stopped accepting inserts.
+func (rs *rowStore) isStopped() bool {
+	select {
+	case <-rs.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// insert queues the given insert, blocking while the queue is full. Once the
+// row store is stopped, inserts are dropped.
 func (rs *rowStore) insert(insert *insert) {
-	rs.inserts <- insert
+	select {
+	case rs.inserts <- insert:
+	case <-rs.stop:
+	}
+}
+
+// queueDepth returns the number of inserts and batches waiting to be applied
+// to the memstore.
+func (rs *rowStore) queueDepth() int {
+	return len(rs.inserts) + len(rs.batches)
+}
+
+// hasApplied indicates whether the insert with the given WAL sequence number
+// has been applied to the memstore.
+func (rs *rowStore) hasApplied(sequence int64) bool {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	return rs.appliedSequence >= sequence
+}
+
+// insertBatch applies all of the given inserts to the memstore. Rather than
+// going through processInserts, the inserts are applied on the calling
+// goroutine, so batches from different callers are applied in parallel,
+// contending only for the memstore shards of the keys they insert. This blocks
+// while processInserts is flushing. It returns ErrTableClosed once the row
+// store is stopped.
+func (rs *rowStore) insertBatch(inserts []*insert) error {
+	rs.applyMx.RLock()
+	defer rs.applyMx.RUnlock()
+	// The final flush happens while holding applyMx, so checking while holding
+	// it for reading guarantees that the batch is either included in that
+	// flush or rejected
+	if rs.isStopped() {
+		return ErrTableClosed
+	}
+	if err := rs.batchLog.append(inserts); err != nil {
+		return err
+	}
+	rs.mx.RLock()
+	ms := rs.memStore
+	rs.mx.RUnlock()
+	rs.applyToMemStore(ms, inserts)
+	if maxBytes, _ := rs.flushOptions(); maxBytes > 0 && ms.bytes() >= maxBytes {
+		select {
+		case rs.memStoreFull <- nil:
+		default:
+			// processInserts already knows
+		}
+	}
+	return nil
+}
+
+// applyToMemStore applies the data from the given inserts to ms and updates the
+// table's in-memory high water mark. Inserts without a key only advance WAL
+// offsets and are ignored.
+func (rs *rowStore) applyToMemStore(ms *memstore, inserts []*insert) {
+	if rs.opts.interceptInsert != nil {
+		inserts = rs.intercept(inserts)
+	}
+	if latest := ms.updateBatch(inserts); latest > 0 {
+		rs.t.updateHighWaterMarkMemory(latest)
+	}
+}
+
+// intercept passes the given inserts through interceptInsert, returning the
+// inserts to apply. The given slice is left alone since callers still need the
+// WAL offsets of the original inserts.
+func (rs *rowStore) intercept(inserts []*insert) []*insert {
+	intercepted := make([]*insert, 0, len(inserts))
+	rejected := int64(0)
+	for _, original := range inserts {
+		if original.key == nil {
+			// Only advances offsets
+			continue
+		}
+		insert, err := rs.opts.interceptInsert(original)
+		if err != nil {
+			rs.t.log.Tracef("Rejected insert: %v", err)
+			rejected++
+			continue
+		}
+		if insert == nil {
+			insert = original
+		}
+		intercepted = append(intercepted, insert)
+	}
+	if rejected > 0 {
+		rs.t.statsMutex.Lock()
+		rs.t.stats.RejectedPoints += rejected
+		rs.t.statsMutex.Unlock()
+	}
+	return intercepted
+}
+
+// tryInsertBatch queues the given inserts without waiting for them to be
+// applied. It returns ErrInsertQueueFull if the queue is full and
+// ErrTableClosed once the row store is stopped.
+func (rs *rowStore) tryInsertBatch(inserts []*insert) error {
+	// See insertBatch. Queued batches are applied before the final flush.
+	rs.applyMx.RLock()
+	defer rs.applyMx.RUnlock()
+	if rs.isStopped() {
+		return ErrTableClosed
+	}
+	batch := &insertBatch{inserts: inserts, done: make(chan interface{})}
+	select {
+	case rs.batches <- batch:
+		return nil
+	default:
+		return ErrInsertQueueFull
+	}
 }
 
 func (rs *rowStore) forceFlush() {
-	rs.forceFlushes <- true
-	<-rs.forceFlushCompletes
+	if rs.opts.readOnly {
+		// nothing to flush
+		return
+	}
+	if err := rs.requestFlush(false); err != nil {
+		rs.t.log.Debug(err)
+	}
+}
+
+// requestFlush flushes the memstore, blocking until the flush is done.
+func (rs *rowStore) requestFlush(durable bool) error {
+	rs.t.statsMutex.Lock()
+	rs.t.stats.PendingFlushes++
+	rs.t.statsMutex.Unlock()
+	defer func() {
+		rs.t.statsMutex.Lock()
+		rs.t.stats.PendingFlushes--
+		rs.t.statsMutex.Unlock()
+	}()
+
+	req := &flushRequest{durable: durable, done: make(chan error, 1)}
+	select {
+	case rs.forceFlushes <- req:
+	case <-rs.stop:
+		return errors.New("Unable to flush table %v, it is closing", rs.t.Name)
+	}
+	return <-req.done
 }
 
 func (rs *rowStore) newMemStore(offsetsBySource common.OffsetsBySource) *memstore {
-	fields := rs.fields
-	tree := bytetree.New(fields.Exprs(), nil, rs.t.Resolution, 0, time.Time{}, time.Time{}, 0)
-	return &memstore{fields: fields, tree: tree, offsetsBySource: offsetsBySource}
+	return newMemstore(rs.fields, rs.t.Resolution, rs.memStoreCapacity(), offsetsBySource)
 }
 
+// SetFlushOptions changes the memstore size and maximum latency that govern
+// flushes (see rowStoreOptions) without having to reopen the row store. The
+// pending flush is rescheduled to respect the new maxBytes and maxLatency.
+func (rs *rowStore) SetFlushOptions(maxBytes int, maxLatency time.Duration) {
+	atomic.StoreInt64(&rs.maxMemStoreBytes, int64(maxBytes))
+	atomic.StoreInt64(&rs.maxFlushLatency, int64(maxLatency))
+	select {
+	case rs.flushOptionsChanged <- nil:
+	default:
+		// processInserts will already pick up the change
+	}
+}
+
+func (rs *rowStore) flushOptions() (maxBytes int, maxLatency time.Duration) {
+	return int(atomic.LoadInt64(&rs.maxMemStoreBytes)), time.Duration(atomic.LoadInt64(&rs.maxFlushLatency))
+}
+
+// processInserts applies inserts to the memstore and periodically flushes it
+// to a new file store. The memstore itself isn't persisted. Instead, it tracks
+// the WAL offsets of the inserts that it contains, and each file store records
+// those offsets in its header, so after a crash the table resumes reading its
+// stream's WAL from the offsets of the latest file store and rebuilds the
+// memstore from there. Data inserted with InsertBatch bypasses the WAL, so
+// it's logged to the row store's batch log instead (see batchLog), which gets
+// replayed when the row store is opened.
+//
+// Other than applying inserts, everything that processInserts does with the
+// memstore happens while holding applyMx, which keeps insertBatch from
+// applying batches at the same time.
 func (rs *rowStore) processInserts(offsetsBySource common.OffsetsBySource, stop <-chan interface{}) {
-	ms := rs.newMemStore(offsetsBySource)
-	rs.mx.Lock()
-	rs.memStore = ms
-	rs.mx.Unlock()
+	defer rs.batchLog.close()
 
-	flushInterval := rs.opts.maxFlushLatency
+	rs.mx.RLock()
+	ms := rs.memStore
+	rs.mx.RUnlock()
+
+	flushController := newFlushController(rs.opts)
+	flushController.maxBytes, flushController.maxInterval = rs.flushOptions()
+	flushInterval := flushController.interval()
+	lastFlush := time.Now()
 	flushTimer := time.NewTimer(flushInterval)
+	var retentionTicks <-chan time.Time
+	if rs.opts.retentionInterval > 0 {
+		retentionTicker := time.NewTicker(rs.opts.retentionInterval)
+		defer retentionTicker.Stop()
+		retentionTicks = retentionTicker.C
+	}
+	rs.mx.Lock()
+	rs.flushStats.FlushInterval = flushInterval
+	rs.mx.Unlock()
 	rs.t.log.Debugf("Will flush after %v", flushInterval)
 
+	finishMoves := func() {
+		if rs.moves != nil {
+			// let the mover finish up pending moves
+			close(rs.moves)
+		}
+	}
+
+	rs.applyMx.Lock()
+	err := rs.resumeMigration(stop)
+	rs.applyMx.Unlock()
+	if err == errMigrationInterrupted {
+		// Don't flush so that the file store stays the same and the migration can
+		// resume from its checkpoint. The memstore will be recovered from the WAL.
+		finishMoves()
+		return
+	}
+
 	flush := func(allowSort bool) *memstore {
-		if ms.tree.Length() == 0 {
+		if ms.length() == 0 {
 			rs.t.log.Trace("No data to flush")
 
 			if ms.offsetChanged {
@@ -268,45 +834,210 @@ func (rs *rowStore) processInserts(offsetsBySource common.OffsetsBySource, stop
 			return nil
 		}
 		if rs.t.log.IsTraceEnabled() {
-			rs.t.log.Tracef("Requesting flush at memstore size: %v", humanize.Bytes(uint64(ms.tree.Bytes())))
+			rs.t.log.Tracef("Requesting flush at memstore size: %v", humanize.Bytes(uint64(ms.bytes())))
 		}
-		newMS, flushDuration := rs.processFlush(ms, allowSort)
+		flushedBytes := ms.bytes()
+		elapsed := time.Now().Sub(lastFlush)
+		lastFlush = time.Now()
+		newMS, flushDuration := rs.processFlush(ms, allowSort, false)
 		ms = newMS
-		flushInterval = flushDuration * 10
-		if flushInterval > rs.opts.maxFlushLatency {
-			flushInterval = rs.opts.maxFlushLatency
-		} else if flushInterval < rs.opts.minFlushLatency {
-			flushInterval = rs.opts.minFlushLatency
-		}
+		flushInterval = flushController.next(flushedBytes, elapsed, flushDuration)
+		rs.mx.Lock()
+		rs.flushStats.FlushInterval = flushInterval
+		rs.mx.Unlock()
 		flushTimer.Reset(flushInterval)
 		return newMS
 	}
 
+	// pending buffers single inserts so that inserts which queued up while we
+	// were busy are applied together
+	pending := make([]*insert, 0, cap(rs.inserts)+1)
+
+	applyInserts := func(first *insert) {
+		pending = append(pending[:0], first)
+	drainLoop:
+		for len(pending) < cap(pending) {
+			select {
+			case insert := <-rs.inserts:
+				pending = append(pending, insert)
+			default:
+				break drainLoop
+			}
+		}
+
+		// Update the data before the applied sequence so that anyone waiting on
+		// the sequence sees the data
+		rs.applyToMemStore(ms, pending)
+		rs.mx.Lock()
+		for _, insert := range pending {
+			ms.offsetsBySource[insert.source] = insert.offset
+			if insert.sequence > rs.appliedSequence {
+				rs.appliedSequence = insert.sequence
+			}
+		}
+		ms.offsetChanged = true
+		rs.mx.Unlock()
+
+		// Don't hold on to applied inserts
+		for i := range pending {
+			pending[i] = nil
+		}
+	}
+
+	applyBatch := func(batch *insertBatch) {
+		// The batch is logged as it's applied so that it ends up in the same
+		// segment of the batch log as the rest of the memstore's batches. By now,
+		// TryInsertBatch has returned, so failing to log only makes the batch
+		// less durable.
+		if err := rs.batchLog.append(batch.inserts); err != nil {
+			rs.t.log.Errorf("Unable to log batch, it will only be durable once flushed: %v", err)
+		}
+		rs.applyToMemStore(ms, batch.inserts)
+		close(batch.done)
+	}
+
+	// flushIfFull flushes as soon as the memstore reaches maxBytes, in case
+	// inserts arrive faster than the flush controller estimated. Like timed
+	// flushes, these don't happen more often than minInterval.
+	flushIfFull := func() {
+		if flushController.maxBytes <= 0 || time.Now().Sub(lastFlush) < flushController.minInterval {
+			return
+		}
+		if ms.bytes() < flushController.maxBytes {
+			return
+		}
+		rs.t.log.Debug("Requesting flush due to memstore size")
+		// flush re-arms flushTimer, so make sure it's drained
+		if !flushTimer.Stop() {
+			select {
+			case <-flushTimer.C:
+			default:
+			}
+		}
+		rs.applyMx.Lock()
+		flush(false)
+		rs.applyMx.Unlock()
+	}
+
+	// applyQueued applies everything that's already queued, so that a forced
+	// flush includes everything inserted before the flush was requested.
+	applyQueued := func() {
+		for {
+			select {
+			case insert := <-rs.inserts:
+				applyInserts(insert)
+			case batch := <-rs.batches:
+				applyBatch(batch)
+			default:
+				return
+			}
+		}
+	}
+
 	for {
 		select {
 		case insert := <-rs.inserts:
-			rs.mx.Lock()
-			ms.offsetsBySource[insert.source] = insert.offset
-			ms.offsetChanged = true
-			if insert.key != nil {
-				ms.tree.Update(insert.key, nil, insert.vals, insert.metadata)
-				rs.t.updateHighWaterMarkMemory(insert.vals.TimeInt())
-			}
-			rs.mx.Unlock()
+			applyInserts(insert)
+			flushIfFull()
+		case batch := <-rs.batches:
+			applyBatch(batch)
+			flushIfFull()
+		case <-rs.memStoreFull:
+			flushIfFull()
 		case <-flushTimer.C:
 			rs.t.log.Trace("Requesting flush due to flush interval")
+			rs.applyMx.Lock()
 			flush(false)
-		case <-rs.forceFlushes:
+			rs.applyMx.Unlock()
+		case <-rs.flushOptionsChanged:
+			// A new maxBytes changes how soon the memstore will fill up at the
+			// current ingestion rate, so recalculate the interval from scratch
+			flushController.maxBytes, flushController.maxInterval = rs.flushOptions()
+			flushInterval = flushController.interval()
+			rs.mx.Lock()
+			rs.flushStats.FlushInterval = flushInterval
+			rs.mx.Unlock()
+			rs.t.log.Debugf("Flush options changed, will flush after %v", flushInterval)
+			// Re-arm flushTimer for the remainder of the new interval
+			if !flushTimer.Stop() {
+				select {
+				case <-flushTimer.C:
+				default:
+				}
+			}
+			remaining := flushInterval - time.Now().Sub(lastFlush)
+			if remaining < 0 {
+				remaining = 0
+			}
+			flushTimer.Reset(remaining)
+		case req := <-rs.forceFlushes:
 			rs.t.log.Debug("Forcing flush")
+			rs.applyMx.Lock()
+			applyQueued()
 			flush(true)
-			rs.forceFlushCompletes <- true
+			rs.applyMx.Unlock()
+			if req.durable && rs.moves != nil {
+				// Moves happen in order, so once the mover gets to this, the flushed
+				// file has been moved too
+				rs.moves <- &flushMove{done: req.done}
+			} else {
+				req.done <- nil
+			}
+		case <-retentionTicks:
+			rs.mx.RLock()
+			hasFiles := len(rs.fileStore.files()) > 0
+			rs.mx.RUnlock()
+			if !hasFiles {
+				continue
+			}
+			rs.t.log.Debug("Rewriting file store to drop data outside of retention period")
+			rs.applyMx.Lock()
+			rs.truncateOnNextFlush = true
+			// Like purges, this rewrites the file store even if the memstore is empty
+			ms, _ = rs.processFlush(ms, false, true)
+			rs.applyMx.Unlock()
+		case purge := <-rs.purges:
+			rs.t.log.Debug("Purging deleted keys")
+			// Always rewrite the file store, even if there's nothing in the memstore
+			bytesBefore := rs.fileStoreSize()
+			rs.applyMx.Lock()
+			ms, _ = rs.processFlush(ms, true, true)
+			rs.applyMx.Unlock()
+			purge.stats.KeysPurged = rs.keysPurgedByLastFlush
+			purge.stats.BytesReclaimed = bytesBefore - rs.fileStoreSize()
+			rs.t.log.Debugf("Purged %d deleted keys, reclaiming %d bytes", purge.stats.KeysPurged, purge.stats.BytesReclaimed)
+			close(purge.done)
+		case req := <-rs.rebuilds:
+			rs.t.log.Debug("Replacing data with rebuilt memstore")
+			rs.applyMx.Lock()
+			req.ms.offsetsBySource = ms.offsetsBySource
+			rs.replaceOnNextFlush = true
+			ms, _ = rs.processFlush(req.ms, false, true)
+			rs.applyMx.Unlock()
+			close(req.done)
+		case req := <-rs.migrations:
+			rs.t.log.Debugf("Running migration %v", req.name)
+			rs.applyMx.Lock()
+			req.err = rs.migrate(migrations[req.name], stop)
+			rs.applyMx.Unlock()
+			close(req.done)
+			if req.err == errMigrationInterrupted {
+				// See above
+				finishMoves()
+				return
+			}
 		case <-stop:
-			rs.t.log.Debug("Forcing flush due to database stopped")
+			rs.t.log.Debug("Forcing flush due to row store stopped")
+			rs.applyMx.Lock()
+			applyQueued()
 			flush(true)
-			rs.t.log.Debug("Done forcing flush due to database stopped")
+			rs.applyMx.Unlock()
+			rs.t.log.Debug("Done forcing flush due to row store stopped")
+			finishMoves()
 			return
 		case fields := <-rs.fieldUpdates:
 			rs.t.log.Debugf("Updating fields to %v", fields)
+			rs.applyMx.Lock()
 			// update fields immediately
 			rs.fields = fields
 
@@ -321,48 +1052,248 @@ func (rs *rowStore) processInserts(offsetsBySource common.OffsetsBySource, stop
 				rs.memStore = ms
 				rs.mx.Unlock()
 			}
+			rs.applyMx.Unlock()
+		}
+	}
+}
+
+// memStoreCapacity returns the number of keys for which to reserve space in a
+// new memstore. If no initialMemStoreCapacity was configured, this is the
+// maximum length of recently flushed memstores.
+func (rs *rowStore) memStoreCapacity() int {
+	if rs.opts.initialMemStoreCapacity > 0 {
+		return rs.opts.initialMemStoreCapacity
+	}
+	capacity := 0
+	for _, length := range rs.recentMemStoreLengths {
+		if length > capacity {
+			capacity = length
 		}
 	}
+	return capacity
+}
+
+func (rs *rowStore) recordMemStoreLength(length int) {
+	rs.recentMemStoreLengths = append(rs.recentMemStoreLengths, length)
+	if len(rs.recentMemStoreLengths) > memStoreLengthsToTrack {
+		rs.recentMemStoreLengths = rs.recentMemStoreLengths[1:]
+	}
 }
 
-func (rs *rowStore) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) (common.OffsetsBySource, error) {
+func (rs *rowStore) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, truncateBefore time.Time, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) (common.OffsetsBySource, error) {
 	guard := core.Guard(ctx)
 
+	if rs.opts.readOnly {
+		rs.mx.RLock()
+		files := rs.fileStore.files()
+		rs.mx.RUnlock()
+		for _, filename := range files {
+			if _, err := os.Stat(filename); os.IsNotExist(err) {
+				// The writer removed the file store we were using before we noticed
+				// that there's a newer one, switch now. Once opened, the file remains
+				// readable even if the writer removes it.
+				rs.refreshFileStore()
+				break
+			}
+		}
+	}
+
 	rs.mx.RLock()
 	fs := rs.fileStore
 	var ms *memstore
 	if includeMemStore {
 		ms = rs.memStore.copy()
 	}
+	tombstones := rs.tombstones
 	rs.mx.RUnlock()
+	files := fs.files()
 	rs.mx.Lock()
-	rs.iterationsInProgress[fs.filename]++
+	for _, filename := range files {
+		rs.iterationsInProgress[filename]++
+	}
 	rs.mx.Unlock()
 	defer func() {
 		rs.mx.Lock()
-		rs.iterationsInProgress[fs.filename]--
+		for _, filename := range files {
+			rs.iterationsInProgress[filename]--
+		}
 		rs.mx.Unlock()
 	}()
-	return fs.iterate(outFields, ms, false, false, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+	return fs.iterateWithContext(ctx, outFields, ms, false, false, truncateBefore, func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		if tombstones[string(key)] {
+			// deleted
+			return true, nil
+		}
+		if !rs.throttleScan(ctx, key, columns) {
+			return false, ctx.Err()
+		}
 		return guard.ProceedAfter(onValue(key, columns))
 	})
 }
 
-func (rs *rowStore) processFlush(ms *memstore, allowSort bool) (*memstore, time.Duration) {
+// throttleScan waits as long as necessary to keep scanning within the table's
+// MaxScanBytesPerSecond, returning false if ctx is done before then.
+func (rs *rowStore) throttleScan(ctx context.Context, key bytemap.ByteMap, columns []encoding.Sequence) bool {
+	n := len(key)
+	for _, column := range columns {
+		n += len(column)
+	}
+	delay := rs.t.scanLimiter.take(n)
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// fileStoreSize returns the size on disk of the current file store (including
+// any deltas), or 0 if it can't be determined.
+func (rs *rowStore) fileStoreSize() int64 {
+	rs.mx.RLock()
+	files := rs.fileStore.files()
+	rs.mx.RUnlock()
+	size := int64(0)
+	for _, filename := range files {
+		size += fileSize(filename)
+	}
+	return size
+}
+
+// Stats returns statistics about this rowStore's memstore, flushes and file
+// store.
+func (rs *rowStore) Stats() RowStoreStats {
+	rs.mx.RLock()
+	stats := rs.flushStats
+	ms := rs.memStore
+	rs.mx.RUnlock()
+	if !rs.opts.readOnly {
+		stats.MemStores = 1
+		stats.MemStoreBytes = int64(ms.bytes())
+	}
+	stats.BytesOnDisk = rs.fileStoreSize()
+	return stats
+}
+
+// recordFlush updates flushStats after a successful flush that took the given
+// duration.
+func (rs *rowStore) recordFlush(duration time.Duration) {
+	rs.mx.RLock()
+	files := rs.fileStore.files()
+	rs.mx.RUnlock()
+	// The flushed file is always the newest one
+	var size int64
+	if len(files) > 0 {
+		size = fileSize(files[len(files)-1])
+	}
+	rs.mx.Lock()
+	rs.flushStats.Flushes++
+	rs.flushStats.LastFlushDuration = duration
+	rs.flushStats.LastFlushFinished = time.Now()
+	rs.flushStats.LastFlushBytes = size
+	rs.flushStats.FlushedBytes += size
+	rs.flushStats.LastFlushError = ""
+	rs.mx.Unlock()
+	rs.t.db.observeFlush(rs.t.Name, duration)
+}
+
+// processFlush flushes the given memstore on the database's pool of flush
+// workers. If full is true, or flushes aren't incremental, the flush rewrites
+// the entire file store.
+func (rs *rowStore) processFlush(ms *memstore, allowSort bool, full bool) (result *memstore, duration time.Duration) {
+	// Batches applied from here on go to the next memstore
+	batchLogSegment := rs.batchLog.rotate()
+	rs.t.db.flushPool.run(func() {
+		result, duration = rs.flushWithRetries(ms, allowSort, full)
+	})
+	if result != ms {
+		rs.removeFlushedBatchLog(batchLogSegment)
+	}
+	return
+}
+
+// removeFlushedBatchLog removes the segments of the batch log up to and
+// including the given segment, whose batches have just been flushed. If
+// flushes are moved to durable storage in the background, this waits until the
+// flushed file has been moved.
+func (rs *rowStore) removeFlushedBatchLog(segment int64) {
+	if rs.batchLog == nil {
+		return
+	}
+	if rs.moves != nil {
+		rs.enqueueMove(&flushMove{batchLogSegment: segment})
+		return
+	}
+	rs.batchLog.remove(segment)
+}
+
+// flushWithRetries flushes the given memstore, retrying failed flushes.
+func (rs *rowStore) flushWithRetries(ms *memstore, allowSort bool, full bool) (*memstore, time.Duration) {
+	rs.recordMemStoreLength(ms.length())
+	start := time.Now()
 	attempts := 3
-	for i := 0; i < attempts; i++ {
+	writeFailures := 0
+	backoff := rs.t.db.opts.FlushRetryBackoff
+	for i := 0; i < attempts; {
 		// Try a few times just in case we encounter a random error reading the file
 		last := i == attempts-1
-		result, duration := rs.doProcessFlush(ms, allowSort, !last)
+		var result *memstore
+		var duration time.Duration
+		var writeErr error
+		if rs.incrementalFlushes() && !full {
+			result, duration, writeErr = rs.doProcessDeltaFlush(ms, allowSort)
+		} else {
+			rs.compactionMx.Lock()
+			result, duration, writeErr = rs.doProcessFlush(ms, allowSort, !last)
+			rs.compactionMx.Unlock()
+		}
+		if writeErr != nil {
+			writeFailures++
+			rs.mx.Lock()
+			rs.flushStats.FlushFailures++
+			rs.mx.Unlock()
+			if writeFailures > rs.t.db.opts.FlushRetries {
+				rs.t.log.Errorf("Giving up on flush after %d failures, keeping memstore to flush later: %v", writeFailures, writeErr)
+				rs.keysPurgedByLastFlush = 0
+				rs.mx.Lock()
+				rs.flushStats.LastFlushError = writeErr.Error()
+				rs.mx.Unlock()
+				if rs.t.db.opts.OnFlushFailure != nil {
+					rs.t.db.opts.OnFlushFailure(rs.t.Name, writeErr)
+				}
+				return ms, time.Now().Sub(start)
+			}
+			rs.t.log.Errorf("Unable to write flush, will retry in %v: %v", backoff, writeErr)
+			time.Sleep(backoff)
+			backoff *= 2
+			continue
+		}
 		if result != nil {
+			rs.recordFlush(duration)
+			if earliest, latest, ok := ms.timeRange(); ok {
+				// Cached query results over the flushed data are now stale. Points
+				// count towards the period that ends after them, so widen the range
+				// by the table's resolution.
+				rs.t.db.invalidateQueryCache(rs.t.Name, earliest, latest.Add(rs.t.Resolution))
+			}
 			return result, duration
 		}
+		i++
 	}
 	rs.t.db.Panic("processFlush loop terminated without result, should never happen")
 	return nil, 0
 }
 
-func (rs *rowStore) doProcessFlush(ms *memstore, allowSort, allowFailure bool) (*memstore, time.Duration) {
+// doProcessFlush flushes the given memstore to a new file store. If it fails to
+// read the existing data, it returns a nil memstore if allowFailure is true.
+// If it fails to write the new file store, it returns an error and leaves
+// everything as it was.
+func (rs *rowStore) doProcessFlush(ms *memstore, allowSort, allowFailure bool) (*memstore, time.Duration, error) {
 	shouldSort := allowSort && rs.t.shouldSort()
 	willSort := "not sorted"
 	if shouldSort {
@@ -372,11 +1303,17 @@ func (rs *rowStore) doProcessFlush(ms *memstore, allowSort, allowFailure bool) (
 
 	rs.mx.RLock()
 	fs := rs.fileStore
+	tombstones := rs.tombstones
 	rs.mx.RUnlock()
+	if rs.replaceOnNextFlush {
+		// Flush the memstore on its own, dropping the existing data
+		fs = &fileStore{t: rs.t, rs: rs, fields: rs.fields}
+	}
 	// We allow raw most of the time for efficiency purposes, but every 10 flushes
 	// we don't so that we have an opportunity to truncate old data.
-	disallowRaw := rs.flushCount%10 == 9
+	disallowRaw := rs.flushCount%10 == 9 || rs.truncateOnNextFlush
 	rs.flushCount++
+	rs.truncateOnNextFlush = false
 	if disallowRaw {
 		rs.t.log.Debug("Disallowing raw on flush to force truncation")
 	}
@@ -384,13 +1321,31 @@ func (rs *rowStore) doProcessFlush(ms *memstore, allowSort, allowFailure bool) (
 	fs.t.log.Debugf("Starting flush, %v", willSort)
 	start := time.Now()
 
-	out, err := ioutil.TempFile("", "nextrowstore")
+	// Write the file in the directory that it ends up in, so that moving it into
+	// place is an atomic rename within the same file system
+	flushDir := rs.opts.dir
+	if rs.opts.scratchDir != "" {
+		flushDir = rs.opts.scratchDir
+	}
+	out, err := ioutil.TempFile(flushDir, flushTempPrefix)
 	if err != nil {
-		rs.t.db.Panic(err)
+		return nil, 0, errors.New("Unable to create temp file for flush: %v", err)
 	}
 	defer out.Close()
+	succeeded := false
+	defer func() {
+		if !succeeded {
+			os.Remove(out.Name())
+		}
+	}()
 
-	highWaterMark, rowCount, flushErr := fs.flush(out, rs.fields, nil, ms.offsetsBySource, ms, shouldSort, disallowRaw)
+	// Build the rollup from the rows as they're flushed rather than reading the
+	// new file store again afterwards
+	rollup := rs.newRollupBuilder()
+	highWaterMark, rowCount, keysPurged, flushErr := fs.flush(out, rs.fields, nil, tombstones, ms.offsetsBySource, ms, shouldSort, disallowRaw, rollup)
+	if writeErr, ok := flushErr.(*flushWriteError); ok {
+		return nil, 0, writeErr
+	}
 	if flushErr != nil {
 		shasum, err := calcShaSum(fs.filename)
 		if err != nil {
@@ -400,30 +1355,65 @@ func (rs *rowStore) doProcessFlush(ms *memstore, allowSort, allowFailure bool) (
 		}
 		if allowFailure {
 			rs.t.log.Errorf("Unable to flush using %v, failed after reading %d rows, will try again: %v", fs.filename, rowCount, flushErr)
-			return nil, 0
+			return nil, 0, nil
+		}
+		if ms.length() > 0 {
+			// The problem may be with the memstore rather than the file store. If the
+			// file store can be read on its own, quarantine the memstore and see if
+			// we can flush without it. Its offsets are retained so that we don't
+			// reprocess the same data from the WAL.
+			fsErr := rs.checkReadable(fs, !disallowRaw)
+			if fsErr == nil {
+				deadLetterFile, quarantineErr := rs.quarantine(ms)
+				if quarantineErr != nil {
+					// Without a dead letter file, discarding the memstore would lose its
+					// data, so keep it and its offsets and fail the flush instead
+					return nil, 0, errors.New("Unable to flush memstore with %d keys and unable to persist it to dead letter file, keeping it: %v. Flush error: %v", ms.length(), quarantineErr, flushErr)
+				}
+				rs.t.log.Errorf("!!!! Unable to flush memstore with %d keys after repeated attempts, discarding it and continuing. Its contents were written to dead letter file %v. Flush error: %v", ms.length(), deadLetterFile, flushErr)
+				return rs.doProcessFlush(rs.newMemStore(ms.offsetsBySource), false, false)
+			}
+			rs.t.log.Errorf("Unable to read %v on its own, keeping memstore: %v", fs.filename, fsErr)
 		}
 		rs.t.log.Errorf("Unable to flush using %v, failed after reading %d rows, marking file as corrupted and panicking: %v", fs.filename, rowCount, flushErr)
 		fs.markCorrupted()
 		rs.t.db.Panic(flushErr)
 	}
 
-	if syncErr := out.Sync(); syncErr != nil {
-		rs.t.db.Panic(syncErr)
+	if rowCount == 0 {
+		// Everything expired or was deleted. The new file store is still valid,
+		// just without any rows, and it supersedes the old one as usual so that
+		// the dropped data stays gone.
+		rs.t.log.Debug("Flush dropped all rows, new file store will be empty")
+	}
+	if syncErr := rs.syncFile(out); syncErr != nil {
+		return nil, 0, errors.New("Unable to sync flushed file: %v", syncErr)
 	}
 	fi, err := out.Stat()
 	if err != nil {
 		fs.t.log.Errorf("Unable to stat output file to get size: %v", err)
 	}
 	if closeErr := out.Close(); closeErr != nil {
-		rs.t.db.Panic(closeErr)
+		return nil, 0, errors.New("Unable to close flushed file: %v", closeErr)
 	}
 
 	// Note - we left-pad the unix nano value to the widest possible length to
 	// ensure lexicographical sort matches time-based sort (e.g. on directory
 	// listing).
-	newFileStoreName := filepath.Join(rs.opts.dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), CurrentFileVersion))
-	if renameErr := os.Rename(out.Name(), newFileStoreName); renameErr != nil {
-		rs.t.db.Panic(renameErr)
+	newFileStoreName := filepath.Join(flushDir, fmt.Sprintf("filestore_%020d_%d.dat", rs.nextFileNanos(), CurrentFileVersion))
+	if renameErr := rs.renameFile(out.Name(), newFileStoreName); renameErr != nil {
+		return nil, 0, errors.New("Unable to move flushed file into place at %v: %v", newFileStoreName, renameErr)
+	}
+	if syncErr := rs.syncDir(flushDir); syncErr != nil {
+		return nil, 0, syncErr
+	}
+	succeeded = true
+	if rs.moves != nil {
+		move := &flushMove{filename: newFileStoreName}
+		if fi != nil {
+			move.size = fi.Size()
+		}
+		defer rs.enqueueMove(move)
 	}
 	defer func() {
 		shasum, err := calcShaSum(newFileStoreName)
@@ -434,12 +1424,26 @@ func (rs *rowStore) doProcessFlush(ms *memstore, allowSort, allowFailure bool) (
 		}
 	}()
 
-	fs = &fileStore{rs.t, rs, rs.fields, newFileStoreName}
+	fs = &fileStore{t: rs.t, rs: rs, fields: rs.fields, filename: newFileStoreName}
+	rollupFile := ""
+	if rollup != nil {
+		var rollupErr error
+		rollupFile, rollupErr = rollup.write(fs, ms.offsetsBySource)
+		if rollupErr != nil {
+			// Queries will just have to use the full data
+			rs.t.log.Errorf("Unable to write rollup: %v", rollupErr)
+		}
+	}
 	ms = rs.newMemStore(ms.offsetsBySource)
 	rs.mx.Lock()
 	rs.fileStore = fs
 	rs.memStore = ms
+	rs.rollupFile = rollupFile
 	rs.mx.Unlock()
+	rs.replaceOnNextFlush = false
+	// Everything that was deleted as of the start of the flush is now gone
+	rs.clearTombstones(tombstones)
+	rs.keysPurgedByLastFlush = keysPurged
 
 	flushDuration := time.Now().Sub(start)
 	if fi != nil {
@@ -449,30 +1453,56 @@ func (rs *rowStore) doProcessFlush(ms *memstore, allowSort, allowFailure bool) (
 	}
 
 	rs.t.updateHighWaterMarkDisk(highWaterMark)
-	return ms, flushDuration
+	return ms, flushDuration, nil
 }
 
-func (fs *fileStore) flush(out *os.File, fields core.Fields, filter goexpr.Expr, offsetsBySource common.OffsetsBySource, ms *memstore, shouldSort bool, disallowRaw bool) (int64, int, error) {
-	cout, err := fs.createOutWriter(out, fields, offsetsBySource, shouldSort)
+// flush writes the file store, merged with the given memstore, to out. If
+// rollup is not nil, each written row is also added to it.
+func (fs *fileStore) flush(out *os.File, fields core.Fields, filter goexpr.Expr, tombstones map[string]bool, offsetsBySource common.OffsetsBySource, ms *memstore, shouldSort bool, disallowRaw bool, rollup *rollupBuilder) (int64, int, int, error) {
+	h := fs.t.db.opts.hooks
+	w := h.wrapFlushWriter(out)
+	cout, err := fs.createOutWriter(w, fields, offsetsBySource, shouldSort)
 	if err != nil {
-		fs.t.db.Panic(fmt.Errorf("Unable to create out writer: %v", err))
+		return 0, 0, 0, &flushWriteError{errors.New("Unable to create out writer: %v", err)}
 	}
 
 	highWaterMark := int64(0)
 	truncateBefore := fs.t.truncateBefore()
+	codecs := codecsFor(fields)
 	rowCount := 0
+	keysPurged := 0
 	write := func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
-		nextHighWaterMark, err := fs.doWrite(cout, fields, filter, truncateBefore, shouldSort, key, columns, raw)
+		if tombstones[string(key)] {
+			// deleted, drop it
+			keysPurged++
+			return true, nil
+		}
+		if err := h.onFlushRow(key); err != nil {
+			return false, err
+		}
+		nextHighWaterMark, written, err := fs.doWrite(cout, fields, codecs, filter, truncateBefore, shouldSort, key, columns, raw)
 		if err != nil {
-			fs.t.db.Panic(fmt.Errorf("Unable to write row out: %v", err))
+			return false, &flushWriteError{errors.New("Unable to write row out: %v", err)}
 		}
 		if nextHighWaterMark > highWaterMark {
 			highWaterMark = nextHighWaterMark
 		}
-		rowCount++
+		if written {
+			rowCount++
+			if rollup != nil {
+				rollup.add(key, columns)
+			}
+		}
 		return true, nil
 	}
 
+	okayToReuseBuffer := !shouldSort
+	if rollup != nil {
+		// The rollup needs decoded columns that it can hold on to
+		okayToReuseBuffer = false
+		disallowRaw = true
+	}
+
 	iterate := func() (err error) {
 		defer func() {
 			if r := recover(); r != nil {
@@ -480,47 +1510,99 @@ func (fs *fileStore) flush(out *os.File, fields core.Fields, filter goexpr.Expr,
 			}
 		}()
 
-		_, err = fs.iterate(fields, ms, !shouldSort, !disallowRaw, write)
+		_, err = fs.iterate(fields, ms, okayToReuseBuffer, !disallowRaw, truncateBefore, write)
 		return
 	}
 
 	if iterateErr := iterate(); iterateErr != nil {
+		if _, ok := iterateErr.(*flushWriteError); ok {
+			cout.Close()
+		}
 		// this is the only case in which we return an error to signify that we can self-heal by deleting this filestore
-		return highWaterMark, rowCount, iterateErr
+		return highWaterMark, rowCount, keysPurged, iterateErr
 	}
 
-	// manually flush to the underlying snappy writer, since snappy's own Close() function doesn't check the return value of flush
+	// manually flush to the underlying compressed writer so that we can report errors flushing
 	f, ok := cout.(flushable)
 	if ok {
 		err = f.Flush()
 		if err != nil {
 			cout.Close()
-			fs.t.db.Panic(fmt.Errorf("Unable to flush flushable writer: %v", err))
+			return highWaterMark, rowCount, keysPurged, &flushWriteError{errors.New("Unable to flush flushable writer: %v", err)}
 		}
 	}
 
 	err = cout.Close()
 	if err != nil {
-		fs.t.db.Panic(fmt.Errorf("Unable to close out writer: %v", err))
+		return highWaterMark, rowCount, keysPurged, &flushWriteError{errors.New("Unable to close out writer: %v", err)}
 	}
 
-	return highWaterMark, rowCount, nil
+	return highWaterMark, rowCount, keysPurged, nil
 }
 
 type flushable interface {
 	Flush() error
 }
 
-func (fs *fileStore) createOutWriter(out *os.File, fields core.Fields, offsetsBySource common.OffsetsBySource, shouldSort bool) (io.WriteCloser, error) {
-	sout := snappy.NewBufferedWriter(out)
+// flushWriteError indicates that a flush failed because it couldn't write the
+// new file store, as opposed to being unable to read the existing data.
+type flushWriteError struct {
+	err error
+}
+
+func (e *flushWriteError) Error() string {
+	return e.err.Error()
+}
+
+// rowKey returns the key from an encoded row (including the row length).
+func rowKey(row []byte) []byte {
+	keyLength, row := encoding.ReadInt16(row[encoding.Width64bits:])
+	return row[:keyLength]
+}
+
+// countingReader counts the bytes read through it, which allows reporting the
+// (uncompressed) offset at which problems in a file store are found. If
+// dictionary is set, keys of rows read with readRow are decoded using it.
+type countingReader struct {
+	r          io.Reader
+	n          int64
+	dictionary *keyDictionary
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (fs *fileStore) createOutWriter(out io.Writer, fields core.Fields, offsetsBySource common.OffsetsBySource, shouldSort bool) (io.WriteCloser, error) {
+	codec := fs.codec()
+	err := writeFileHeader(out, CurrentFileVersion, codec)
+	if err != nil {
+		return nil, errors.New("Unable to write file header: %v", err)
+	}
+	// Rows can only be indexed by key if they're sorted
+	indexInterval := 0
+	if shouldSort {
+		indexInterval = fs.indexBlockRows()
+	}
+	sout := newIndexingWriter(out, codec, CurrentFileVersion, fileHeaderLength, indexInterval, fs.bloomFalsePositiveRate())
+	order := fs.keyOrder()
+	sout.footer.order = order
+	sout.footer.resolution = fs.t.Resolution
 
 	fieldStrings := make([]string, 0, len(fields))
 	for _, field := range fields {
 		fieldStrings = append(fieldStrings, field.String())
 	}
 	fieldsBytes := []byte(strings.Join(fieldStrings, fieldsDelims[CurrentFileVersion]))
-	headerLength := uint32(encoding.Width64bits + len(offsetsBySource)*(encoding.Width64bits+wal.OffsetSize) + len(fieldsBytes))
-	err := binary.Write(sout, encoding.Binary, headerLength)
+	codecsBytes := make([]byte, encoding.Width16bits, encoding.Width16bits+len(fields))
+	encoding.WriteInt16(codecsBytes, len(fields))
+	for _, codec := range codecsFor(fields) {
+		codecsBytes = append(codecsBytes, byte(codec))
+	}
+	headerLength := uint32(encoding.Width64bits + len(offsetsBySource)*(encoding.Width64bits+wal.OffsetSize) + len(codecsBytes) + len(fieldsBytes))
+	err = binary.Write(sout, encoding.Binary, headerLength)
 	if err != nil {
 		return nil, errors.New("Unable to write header length: %v", err)
 	}
@@ -528,11 +1610,17 @@ func (fs *fileStore) createOutWriter(out *os.File, fields core.Fields, offsetsBy
 	if err != nil {
 		return nil, errors.New("Unable to write header: %v", err)
 	}
+	_, err = sout.Write(codecsBytes)
+	if err != nil {
+		return nil, errors.New("Unable to write header: %v", err)
+	}
 	_, err = sout.Write(fieldsBytes)
 	if err != nil {
 		return nil, errors.New("Unable to write header: %v", err)
 	}
 
+	sout.startRows()
+
 	if !shouldSort {
 		return sout, nil
 	}
@@ -550,11 +1638,12 @@ func (fs *fileStore) createOutWriter(out *os.File, fields core.Fields, offsetsBy
 		return _row, err
 	}
 
+	// order rows by key, skipping the row length
 	less := func(a []byte, b []byte) bool {
-		return bytes.Compare(a, b) < 0
+		return order.compare(rowKey(a), rowKey(b)) < 0
 	}
 
-	cout, sortErr := emsort.New(sout, chunk, less, int(fs.t.db.maxMemoryBytes())/10)
+	cout, sortErr := emsort.New(sout, chunk, less, fs.t.db.sortBufferBytes())
 	if sortErr != nil {
 		fs.t.db.Panic(sortErr)
 	}
@@ -562,24 +1651,28 @@ func (fs *fileStore) createOutWriter(out *os.File, fields core.Fields, offsetsBy
 	return cout, nil
 }
 
-func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goexpr.Expr, truncateBefore time.Time, shouldSort bool, key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (int64, error) {
+// doWrite writes a row to cout, returning the highest timestamp in the row and
+// whether the row was written at all. Rows that don't match filter or whose
+// sequences have all expired are dropped.
+func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, codecs []encoding.Codec, filter goexpr.Expr, truncateBefore time.Time, shouldSort bool, key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (int64, bool, error) {
 	highWaterMark := int64(0)
 
-	if !shouldSort && raw != nil {
+	if raw != nil {
 		// This is an optimization that allows us to skip other processing by just
-		// passing through the raw data
+		// passing through the raw data. Since raw contains the entire row, this
+		// works for sorting too.
 		_, writeErr := cout.Write(raw)
-		return highWaterMark, writeErr
+		return highWaterMark, writeErr == nil, writeErr
 	}
 
 	if filter != nil && !filter.Eval(key).(bool) {
 		// Didn't meet filter criteria, remove key
-		return highWaterMark, nil
+		return highWaterMark, false, nil
 	}
 
 	hasActiveSequence := false
 	for i, seq := range columns {
-		seq = seq.Truncate(fields[i].Expr.EncodedWidth(), fs.t.Resolution, truncateBefore, time.Time{})
+		seq = seq.Truncate(fields[i].Expr.EncodedWidth(), fs.t.Resolution, fs.t.fieldTruncateBefore(fields[i], truncateBefore), time.Time{})
 		columns[i] = seq
 		if seq != nil {
 			hasActiveSequence = true
@@ -588,17 +1681,22 @@ func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goe
 
 	if !hasActiveSequence {
 		// all encoding.Sequences expired, remove key
-		return highWaterMark, nil
+		return highWaterMark, false, nil
 	}
 
 	rowLength := encoding.Width64bits + encoding.Width16bits + len(key) + encoding.Width16bits
-	for _, seq := range columns {
-		rowLength += encoding.Width64bits + len(seq)
+	encodedColumns := make([][]byte, len(columns))
+	colLengths := make([]byte, 0, len(columns)*binary.MaxVarintLen64)
+	for i, seq := range columns {
+		encodedColumns[i] = codecs[i].Encode(seq)
+		colLengths = encoding.AppendUvarint(colLengths, uint64(len(encodedColumns[i])))
+		rowLength += len(encodedColumns[i])
 		ts := seq.UntilInt()
 		if ts > highWaterMark {
 			highWaterMark = ts
 		}
 	}
+	rowLength += len(colLengths) + crc32.Size
 
 	var o io.Writer = cout
 	var buf *bytes.Buffer
@@ -610,51 +1708,69 @@ func (fs *fileStore) doWrite(cout io.WriteCloser, fields core.Fields, filter goe
 		buf = bytes.NewBuffer(b)
 		o = buf
 	}
+	checksum := crc32.New(crc32cTable)
+	w := io.MultiWriter(o, checksum)
 
-	err := binary.Write(o, encoding.Binary, uint64(rowLength))
+	err := binary.Write(w, encoding.Binary, uint64(rowLength))
 	if err != nil {
-		return highWaterMark, errors.Wrap(err)
+		return highWaterMark, false, errors.Wrap(err)
 	}
 
-	err = binary.Write(o, encoding.Binary, uint16(len(key)))
+	err = binary.Write(w, encoding.Binary, uint16(len(key)))
 	if err != nil {
-		return highWaterMark, errors.Wrap(err)
+		return highWaterMark, false, errors.Wrap(err)
 	}
-	_, err = o.Write(key)
+	_, err = w.Write(key)
 	if err != nil {
-		return highWaterMark, errors.Wrap(err)
+		return highWaterMark, false, errors.Wrap(err)
 	}
 
-	err = binary.Write(o, encoding.Binary, uint16(len(columns)))
+	err = binary.Write(w, encoding.Binary, uint16(len(encodedColumns)))
 	if err != nil {
-		return highWaterMark, errors.Wrap(err)
+		return highWaterMark, false, errors.Wrap(err)
 	}
-	for _, seq := range columns {
-		err = binary.Write(o, encoding.Binary, uint64(len(seq)))
-		if err != nil {
-			return highWaterMark, errors.Wrap(err)
-		}
+	_, err = w.Write(colLengths)
+	if err != nil {
+		return highWaterMark, false, errors.Wrap(err)
 	}
-	for _, seq := range columns {
-		_, err = o.Write(seq)
+	for _, col := range encodedColumns {
+		_, err = w.Write(col)
 		if err != nil {
-			return highWaterMark, errors.Wrap(err)
+			return highWaterMark, false, errors.Wrap(err)
 		}
 	}
+	err = binary.Write(o, encoding.Binary, checksum.Sum32())
+	if err != nil {
+		return highWaterMark, false, errors.Wrap(err)
+	}
 
 	if shouldSort {
 		// flush buffer
 		_b := buf.Bytes()
 		_, writeErr := cout.Write(_b)
 		if writeErr != nil {
-			return highWaterMark, errors.Wrap(err)
+			return highWaterMark, false, errors.Wrap(err)
 		}
 	}
 
-	return highWaterMark, nil
+	return highWaterMark, true, nil
 }
 
 func (rs *rowStore) writeOffsets(offsetsBySource common.OffsetsBySource) error {
+	if rs.moves != nil {
+		// Queue the offsets behind any pending moves so that we don't record
+		// offsets that get ahead of the data in durable storage.
+		copyOfOffsets := make(common.OffsetsBySource, len(offsetsBySource))
+		for source, offset := range offsetsBySource {
+			copyOfOffsets[source] = offset
+		}
+		rs.enqueueMove(&flushMove{offsetsBySource: copyOfOffsets})
+		return nil
+	}
+	return rs.doWriteOffsets(offsetsBySource)
+}
+
+func (rs *rowStore) doWriteOffsets(offsetsBySource common.OffsetsBySource) error {
 	out, err := ioutil.TempFile("", "nextoffset")
 	if err != nil {
 		rs.t.db.Panic(err)
@@ -666,7 +1782,7 @@ func (rs *rowStore) writeOffsets(offsetsBySource common.OffsetsBySource) error {
 		return errors.New("Unable to write offsets: %v", err)
 	}
 
-	err = out.Sync()
+	err = rs.syncFile(out)
 	if err != nil {
 		return errors.New("Unable to sync offset file: %v", err)
 	}
@@ -675,80 +1791,206 @@ func (rs *rowStore) writeOffsets(offsetsBySource common.OffsetsBySource) error {
 		return errors.New("Unable to close offset file: %v", err)
 	}
 
-	return os.Rename(out.Name(), filepath.Join(rs.opts.dir, offsetFilename))
+	err = rs.renameFile(out.Name(), filepath.Join(rs.opts.dir, offsetFilename))
+	if err != nil {
+		return err
+	}
+	return rs.syncDir(rs.opts.dir)
+}
+
+// pollFileStores periodically checks for new file stores written by the writer
+// that owns a read replica's directory.
+func (rs *rowStore) pollFileStores(stop <-chan interface{}) {
+	ticker := time.NewTicker(rs.opts.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			rs.t.log.Debug("Stop polling for file stores")
+			return
+		case <-ticker.C:
+			rs.refreshFileStore()
+		}
+	}
 }
 
+// refreshFileStore switches a read replica to the most recent file store in
+// its directory.
+func (rs *rowStore) refreshFileStore() {
+	files, err := listRegularFiles(rs.opts.dir)
+	if err != nil {
+		rs.t.log.Errorf("Unable to list data files in %v: %v", rs.opts.dir, err)
+		return
+	}
+	latest := ""
+	for i := len(files) - 1; i >= 0; i-- {
+		filename := files[i].Name()
+		if isFileStoreName(filename) {
+			latest = filepath.Join(rs.opts.dir, filename)
+			break
+		}
+	}
+	deltas, err := liveDeltas(rs.opts.dir, latest)
+	if err != nil {
+		rs.t.log.Error(err)
+		return
+	}
+	if latest == "" && len(deltas) == 0 {
+		return
+	}
+
+	rs.mx.Lock()
+	defer rs.mx.Unlock()
+	if latest == rs.fileStore.filename && len(deltas) == len(rs.fileStore.deltas) && (len(deltas) == 0 || deltas[len(deltas)-1] == rs.fileStore.deltas[len(deltas)-1]) {
+		return
+	}
+	rs.t.log.Debugf("Switching to new file store %v with %d deltas", latest, len(deltas))
+	rs.fileStore = &fileStore{t: rs.t, rs: rs, fields: rs.fields, filename: latest, deltas: deltas}
+	rs.rollupFile = ""
+	if len(deltas) == 0 {
+		rs.rollupFile = rs.existingRollupFor(latest)
+	}
+}
+
+// removeOldFiles is a janitor that periodically removes files that are no
+// longer needed. It runs once right away to clean up files orphaned by a
+// restart.
 func (rs *rowStore) removeOldFiles(stop <-chan interface{}) {
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
 
 	for {
+		rs.removeOldFileStores(stop)
+		if rs.opts.scratchDir != "" {
+			rs.removeOldScratchFiles()
+		}
+		if len(rs.t.RollupBy) > 0 {
+			rs.removeOldRollups()
+		}
+		rs.removeOldDeltas()
+
 		select {
 		case <-stop:
 			rs.t.log.Debug("Stop removing old files")
 			return
 		case <-ticker.C:
-			files, err := listRegularFiles(rs.opts.dir)
+		}
+	}
+}
+
+// removeOldFileStores removes file stores in opts.dir that aren't the current
+// file store, once they've been superseded for longer than
+// opts.oldFileRetention and aren't being iterated. The most recent file store
+// in opts.dir is always kept, since it may be the only durable copy of the
+// data (see DBOpts.FlushScratchDir).
+func (rs *rowStore) removeOldFileStores(stop <-chan interface{}) {
+	files, err := listRegularFiles(rs.opts.dir)
+	if err != nil {
+		rs.t.log.Errorf("Unable to list data files in %v: %v", rs.opts.dir, err)
+		return
+	}
+	fileStores := make([]os.FileInfo, 0, len(files))
+	for _, file := range files {
+		if isFileStoreName(file.Name()) {
+			fileStores = append(fileStores, file)
+		}
+	}
+
+	rs.mx.RLock()
+	current := rs.fileStore.filename
+	rs.mx.RUnlock()
+	// Note - the list of files is sorted by name, which in our case is the
+	// timestamp, so each file store was superseded by the next one.
+	for i := 0; i < len(fileStores)-1; i++ {
+		filename := filepath.Join(rs.opts.dir, fileStores[i].Name())
+		if filename == current {
+			continue
+		}
+		if time.Since(fileStores[i+1].ModTime()) < rs.opts.oldFileRetention {
+			// Read replicas may still be reading this file
+			continue
+		}
+		rs.t.db.waitForBackupToFinish(stop)
+		rs.mx.RLock()
+		okayToRemove := rs.iterationsInProgress[filename] == 0 // don't remove file if we're iterating on it
+		rs.mx.RUnlock()
+		if okayToRemove {
+			rs.t.log.Debugf("Removing old file %v", filename)
+			err := os.Remove(filename)
 			if err != nil {
-				rs.t.log.Errorf("Unable to list data files in %v: %v", rs.opts.dir, err)
-			}
-			// Note - the list of files is sorted by name, which in our case is the
-			// timestamp, so that means they're sorted chronologically. We don't want
-			// to delete the last file in the list because that's the current one.
-			foundLatest := false
-			for i := len(files) - 3; i >= 0; i-- {
-				filename := files[i].Name()
-				if filename == offsetFilename {
-					// Ignore offset file
-					continue
-				}
-				if !foundLatest {
-					foundLatest = true
-					continue
-				}
-				rs.t.db.waitForBackupToFinish(stop)
-				rs.mx.RLock()
-				okayToRemove := rs.iterationsInProgress[filename] == 0 // don't remove file if we're iterating on it
-				rs.mx.RUnlock()
-				if okayToRemove {
-					// Okay to delete now
-					name := filepath.Join(rs.opts.dir, filename)
-					rs.t.log.Debugf("Removing old file %v", name)
-					err := os.Remove(name)
-					if err != nil {
-						rs.t.log.Errorf("Unable to delete old file store %v, still consuming disk space unnecessarily: %v", name, err)
-					}
-				}
+				rs.t.log.Errorf("Unable to delete old file store %v, still consuming disk space unnecessarily: %v", filename, err)
+			} else {
+				rs.t.db.invalidateSequenceCache(filename)
 			}
 		}
 	}
 }
 
+func isFileStoreName(name string) bool {
+	return strings.HasPrefix(name, "filestore_") && strings.HasSuffix(name, ".dat")
+}
+
 // fileStore stores rows on disk, encoding them as:
-//   rowLength|keylength|key|numcolumns|col1len|col2len|...|lastcollen|col1|col2|...|lastcol
+//   rowLength|keylength|key|numcolumns|col1len|col2len|...|lastcollen|col1|col2|...|lastcol|checksum
 //
 // rowLength is 64 bits and includes itself
 // keylength is 16 bits and does not include itself
 // key can be up to 64KB
 // numcolumns is 16 bits (i.e. 65,536 columns allowed)
-// col*len is 64 bits
+// col*len is 64 bits (varints since version 7)
+// checksum is a 32 bit CRC32C of the rest of the row (since version 8)
+//
+// With incremental flushes, the data is spread across the base file in
+// filename and newer deltas, whose rows are merged when iterating.
 type fileStore struct {
 	t        *table
 	rs       *rowStore
 	fields   core.Fields
 	filename string
+	deltas   []string
+}
+
+func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBuffer bool, rawOkay bool, truncateBefore time.Time, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) (common.OffsetsBySource, error) {
+	return fs.iterateWithContext(context.Background(), outFields, ms, okayToReuseBuffer, rawOkay, truncateBefore, onRow)
 }
 
-func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBuffer bool, rawOkay bool, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) (common.OffsetsBySource, error) {
+// iterateWithContext is like iterate, but stops between rows and returns
+// ctx.Err() once ctx is done.
+func (fs *fileStore) iterateWithContext(ctx context.Context, outFields []core.Field, ms *memstore, okayToReuseBuffer bool, rawOkay bool, truncateBefore time.Time, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) (common.OffsetsBySource, error) {
+	fieldsToTruncate := outFields
+	if len(fieldsToTruncate) == 0 {
+		fieldsToTruncate = fs.fields
+	}
+	if truncate := fs.t.fieldRetentionTruncator(fieldsToTruncate, truncateBefore); truncate != nil {
+		// Fields with their own retention need to be truncated, so raw isn't okay
+		rawOkay = false
+		onTruncatedRow := onRow
+		onRow = func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			if !truncate(columns) {
+				// all of the row's data has expired
+				return true, nil
+			}
+			return onTruncatedRow(key, columns, raw)
+		}
+	}
+	if len(fs.deltas) > 0 {
+		// Rows need to be merged, so raw isn't okay
+		var memstores []*memstore
+		if ms != nil {
+			memstores = append(memstores, ms)
+		}
+		return fs.iterateMerged(ctx, outFields, memstores, truncateBefore, onRow)
+	}
 	fs.t.log.Debugf("Iterating over %v", fs.filename)
-	ctx := time.Now().UnixNano()
+	msCtx := time.Now().UnixNano()
+	done := ctx.Done()
 	var offsetsBySource common.OffsetsBySource
 
 	if fs.t.log.IsTraceEnabled() {
 		fs.t.log.Tracef("Iterating with memstore ? %v from file %v", ms != nil, fs.filename)
 	}
 
-	truncateBefore := fs.t.truncateBefore()
 	if len(outFields) == 0 {
 		// default outFields to in fields
 		outFields = fs.fields
@@ -786,65 +2028,106 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 		if err != nil {
 			return offsetsBySource, fs.t.log.Errorf("Unable to open file %v: %v", fs.filename, err)
 		}
+		defer file.Close()
 		fs.t.log.Debugf("Found filestore at %v", fs.filename)
-		r := snappy.NewReader(file)
+		var in io.ReadSeeker = file
+		if fs.t.db.opts.MMapFileStores {
+			data, mmapErr := mmapFile(file)
+			if mmapErr != nil {
+				fs.t.log.Debugf("Reading %v without mmap: %v", fs.filename, mmapErr)
+			} else {
+				// The mapping stays valid even if the janitor removes the file, so we
+				// hold onto it until we're done iterating. Rows are copied out of the
+				// mapping as they're decompressed, so nothing that's passed to onRow
+				// refers to it.
+				defer munmap(data)
+				in = bytes.NewReader(data)
+			}
+		}
+		sr, header, err := readFileHeader(in, fs.filename, fs.t.versionFor(fs.filename))
+		if err != nil {
+			if _, unsupported := err.(*unsupportedFileError); !unsupported && fs.skipCorrupt(ctx, err) {
+				return fs.iterateRemainingMemStore(ctx, ms, msCtx, outFields, memToOut, offsetsBySource, onRow)
+			}
+			return offsetsBySource, fs.t.log.Error(err)
+		}
+		fileVersion := header.version
+		r := &countingReader{r: sr}
+		if header.footer != nil {
+			r.dictionary = header.footer.dictionary
+		}
+		defer func() {
+			scanStatsFrom(ctx).fileRead(r.n)
+		}()
 
 		var fileFields core.Fields
-		offsetsBySource, _, fileFields, err = fs.info(r)
+		var fileCodecs []encoding.Codec
+		offsetsBySource, _, fileFields, fileCodecs, err = fs.info(r, fileVersion)
 		if err != nil {
+			if fs.skipCorrupt(ctx, err) {
+				return fs.iterateRemainingMemStore(ctx, ms, msCtx, outFields, memToOut, offsetsBySource, onRow)
+			}
 			return offsetsBySource, err
 		}
 		fs.t.log.Debugf("Set highWaterMark from data file: %v", offsetsBySource.TSString())
 
-		// raw is only okay if the file fields match the out fields
-		rawOkay = rawOkay && fileFields.Equals(outFields)
+		// raw is only okay if the file fields and their encodings match the out
+		// fields, and the file is in the current format
+		rawOkay = rawOkay && fileVersion == CurrentFileVersion && fileFields.Equals(outFields) && codecsEqual(fileCodecs, codecsFor(outFields))
 
 		// this function will map fields from the file into the right positions on
 		// the outbound row
 		fileToOut := rowMapper(outFields, fileFields)
+		// only columns that map to an out field need to be read at all
+		wanted := make([]bool, len(fileFields))
+		for i, o := range outIdxsFor(outFields, fileFields) {
+			wanted[i] = o >= 0
+		}
+		hasChecksums := fileVersion >= FileVersion_8
+		verifyChecksums := hasChecksums && fs.shouldVerifyChecksums()
 
 		var rowBuffer []byte
-		var row []byte
+		cache := fs.t.db.sequenceCache
+		rowIdx := -1
 
 		// Read from file
 		for {
-			rowLength := uint64(0)
-			err := binary.Read(r, encoding.Binary, &rowLength)
-			if err == io.EOF {
-				break
+			select {
+			case <-done:
+				return offsetsBySource, ctx.Err()
+			default:
 			}
-			if err != nil {
-				return offsetsBySource, fs.t.log.Errorf("Unexpected error reading row length from %v: %v", fs.filename, err)
+			var buffer []byte
+			if okayToReuseBuffer {
+				buffer = rowBuffer
 			}
-
-			useBuffer := okayToReuseBuffer && int(rowLength) <= cap(rowBuffer)
-			if useBuffer {
-				// Reslice
-				row = rowBuffer[:rowLength]
-			} else {
-				row = make([]byte, rowLength)
+			raw, row, err := fs.readRow(r, buffer, hasChecksums, verifyChecksums)
+			if err == io.EOF {
+				break
 			}
-			rowBuffer = row
-			raw := row
-			encoding.Binary.PutUint64(row, rowLength)
-			row = row[encoding.Width64bits:]
-			_, err = io.ReadFull(r, row)
 			if err != nil {
-				return offsetsBySource, fs.t.log.Errorf("Unexpected error while reading row from %v: %v", fs.filename, err)
+				if fs.skipCorrupt(ctx, err) {
+					return fs.iterateRemainingMemStore(ctx, ms, msCtx, outFields, memToOut, offsetsBySource, onRow)
+				}
+				return offsetsBySource, fs.t.log.Error(err)
 			}
+			rowBuffer = raw
+			rowIdx++
 
 			keyLength, row := encoding.ReadInt16(row)
 			key, row := encoding.ReadByteMap(row, keyLength)
 
 			var msColumns []encoding.Sequence
 			if ms != nil {
-				msColumns = ms.tree.Remove(ctx, key)
+				msColumns = ms.remove(msCtx, key)
 			}
 			if msColumns == nil && rawOkay {
 				// There's nothing to merge in, just pass through the raw data
 				more, err := onRow(key, nil, raw)
+				if err != nil {
+					fs.t.log.Errorf("Error processing row from %v: %v", fs.filename, err)
+				}
 				if !more || err != nil {
-					fs.t.log.Errorf("Error processing row: %v", err)
 					return offsetsBySource, err
 				}
 				continue
@@ -852,25 +2135,31 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 			// At this point, we should never pass the raw data
 			raw = nil
 
-			numColumns, row := encoding.ReadInt16(row)
-			colLengths := make([]int, 0, numColumns)
-			for i := 0; i < numColumns; i++ {
-				if len(row) < 8 {
-					return offsetsBySource, fs.t.log.Errorf("Not enough data left to decode column %d length on row of length %d from %v!", i, rowLength, fs.filename)
+			encodedColumns, err := fs.readColumns(row, fileVersion, wanted)
+			if err != nil {
+				if fs.skipCorrupt(ctx, err) {
+					return fs.iterateRemainingMemStore(ctx, ms, msCtx, outFields, memToOut, offsetsBySource, onRow)
 				}
-				var colLength int
-				colLength, row = encoding.ReadInt64(row)
-				colLengths = append(colLengths, int(colLength))
+				return offsetsBySource, fs.t.log.Error(err)
 			}
 
 			includesAtLeastOneColumn := false
 			columns := make([]encoding.Sequence, len(outFields))
-			for i, colLength := range colLengths {
-				var seq encoding.Sequence
-				if colLength > len(row) {
-					return offsetsBySource, fs.t.log.Errorf("Not enough data left to decode column from %v, wanted %d have %d", fs.filename, colLength, len(row))
+			for i, seq := range encodedColumns {
+				if i < len(wanted) && !wanted[i] {
+					continue
+				}
+				fs.t.db.opts.hooks.onDecodeColumn(i)
+				if i < len(fileCodecs) {
+					seq, err = fs.decode(cache, fileCodecs[i], seq, rowIdx, i)
+					if err != nil {
+						err = errors.New("Unable to decode column %d from %v: %v", i, fs.filename, err)
+						if fs.skipCorrupt(ctx, err) {
+							return fs.iterateRemainingMemStore(ctx, ms, msCtx, outFields, memToOut, offsetsBySource, onRow)
+						}
+						return offsetsBySource, fs.t.log.Error(err)
+					}
 				}
-				seq, row = encoding.ReadSequence(row, colLength)
 				if seq != nil && fileToOut(columns, i, seq) {
 					includesAtLeastOneColumn = true
 				}
@@ -900,37 +2189,229 @@ func (fs *fileStore) iterate(outFields []core.Field, ms *memstore, okayToReuseBu
 		}
 	}
 
-	// Read remaining stuff from memstore
+	return fs.iterateRemainingMemStore(ctx, ms, msCtx, outFields, memToOut, offsetsBySource, onRow)
+}
+
+// iterateRemainingMemStore iterates over the rows of the given memstore that
+// weren't already merged into rows read from file.
+func (fs *fileStore) iterateRemainingMemStore(ctx context.Context, ms *memstore, msCtx int64, outFields []core.Field, memToOut func(out []encoding.Sequence, i int, seq encoding.Sequence) bool, offsetsBySource common.OffsetsBySource, onRow func(bytemap.ByteMap, []encoding.Sequence, []byte) (more bool, err error)) (common.OffsetsBySource, error) {
 	if ms != nil {
+		done := ctx.Done()
 		offsetsBySource = offsetsBySource.Advance(ms.offsetsBySource)
-		ms.tree.Walk(ctx, func(key []byte, msColumns []encoding.Sequence) (bool, bool, error) {
+		var rows []*mergeRow
+		deterministic := fs.t.db.opts.Deterministic
+		err := ms.walk(msCtx, func(key []byte, msColumns []encoding.Sequence) (bool, bool, error) {
+			select {
+			case <-done:
+				return false, true, ctx.Err()
+			default:
+			}
 			columns := make([]encoding.Sequence, len(outFields))
 			for i, msColumn := range msColumns {
 				memToOut(columns, i, msColumn)
 			}
+			if deterministic {
+				// emit once we've seen all rows and sorted them
+				rows = append(rows, &mergeRow{bytemap.ByteMap(key), columns})
+				return true, false, nil
+			}
 			more, err := onRow(bytemap.ByteMap(key), columns, nil)
 			return more, false, err
 		})
+		if err == nil && deterministic {
+			order := fs.keyOrder()
+			sort.Slice(rows, func(i, j int) bool {
+				return order.compare(rows[i].key, rows[j].key) < 0
+			})
+			for _, row := range rows {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+					break
+				}
+				more, onRowErr := onRow(row.key, row.columns, nil)
+				if onRowErr != nil || !more {
+					err = onRowErr
+					break
+				}
+			}
+		}
+		if err != nil {
+			if err != ctx.Err() {
+				fs.t.log.Errorf("Error processing row from memstore: %v", err)
+			}
+			return offsetsBySource, err
+		}
 	}
 
 	return offsetsBySource, nil
 }
 
-func (fs *fileStore) info(r io.Reader) (common.OffsetsBySource, string, core.Fields, error) {
+// shouldVerifyChecksums indicates whether to verify row checksums. File stores
+// that aren't associated with a rowStore (e.g. when checking files) always
+// verify.
+func (fs *fileStore) shouldVerifyChecksums() bool {
+	return fs.rs == nil || !fs.rs.opts.skipChecksumVerification
+}
+
+// readRow reads the next row from r. raw is the entire row including its
+// length and checksum, row is the portion after the length, excluding the
+// checksum. If buffer is big enough, the row is read into it. Returns io.EOF
+// once there are no more rows. Keys encoded with r's dictionary are decoded, so
+// raw and row always contain the plain key.
+func (fs *fileStore) readRow(r *countingReader, buffer []byte, hasChecksums bool, verifyChecksums bool) (raw []byte, row []byte, err error) {
+	rowOffset := r.n
+	rowLength := uint64(0)
+	err = binary.Read(r, encoding.Binary, &rowLength)
+	if err == io.EOF {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, errors.New("Unexpected error reading row length from %v: %v", fs.filename, err)
+	}
+
+	if int(rowLength) <= cap(buffer) {
+		// Reslice
+		row = buffer[:rowLength]
+	} else {
+		row = make([]byte, rowLength)
+	}
+	raw = row
+	encoding.Binary.PutUint64(row, rowLength)
+	row = row[encoding.Width64bits:]
+	_, err = io.ReadFull(r, row)
+	if err != nil {
+		return nil, nil, errors.New("Unexpected error while reading row from %v: %v", fs.filename, err)
+	}
+	if r.dictionary != nil {
+		raw, err = r.dictionary.expandRow(raw)
+		if err != nil {
+			return nil, nil, errors.New("Unable to decode key of row at offset %d in %v: %v", rowOffset, fs.filename, err)
+		}
+		row = raw[encoding.Width64bits:]
+	}
+	if hasChecksums {
+		if len(row) < crc32.Size {
+			return nil, nil, errors.New("Row of length %d at offset %d in %v is too short to contain checksum", rowLength, rowOffset, fs.filename)
+		}
+		checksummed := len(raw) - crc32.Size
+		if verifyChecksums {
+			expected := encoding.Binary.Uint32(raw[checksummed:])
+			actual := crc32.Checksum(raw[:checksummed], crc32cTable)
+			if actual != expected {
+				return nil, nil, errors.New("Checksum mismatch on row of length %d at offset %d in %v, expected %x got %x", rowLength, rowOffset, fs.filename, expected, actual)
+			}
+		}
+		row = row[:len(row)-crc32.Size]
+	}
+	return raw, row, nil
+}
+
+// readColumns reads the still encoded columns from the remainder of a row
+// following its key. If wanted is not nil, columns for which it is false are
+// skipped using their lengths and left nil in the result.
+func (fs *fileStore) readColumns(row []byte, fileVersion int, wanted []bool) ([]encoding.Sequence, error) {
+	numColumns, row := encoding.ReadInt16(row)
+	colLengths := make([]int, 0, numColumns)
+	for i := 0; i < numColumns; i++ {
+		var colLength int
+		if fileVersion >= FileVersion_7 {
+			length, n := binary.Uvarint(row)
+			if n <= 0 {
+				return nil, errors.New("Unable to decode column %d length from %v!", i, fs.filename)
+			}
+			colLength, row = int(length), row[n:]
+		} else {
+			if len(row) < 8 {
+				return nil, errors.New("Not enough data left to decode column %d length from %v!", i, fs.filename)
+			}
+			colLength, row = encoding.ReadInt64(row)
+		}
+		colLengths = append(colLengths, colLength)
+	}
+
+	columns := make([]encoding.Sequence, 0, numColumns)
+	for i, colLength := range colLengths {
+		if colLength > len(row) {
+			return nil, errors.New("Not enough data left to decode column from %v, wanted %d have %d", fs.filename, colLength, len(row))
+		}
+		if wanted != nil && i < len(wanted) && !wanted[i] {
+			row = row[colLength:]
+			columns = append(columns, nil)
+			continue
+		}
+		var seq encoding.Sequence
+		seq, row = encoding.ReadSequence(row, colLength)
+		columns = append(columns, seq)
+	}
+	return columns, nil
+}
+
+// codec returns the codec with which to compress new files
+func (fs *fileStore) codec() FileCodec {
+	if fs.rs == nil || fs.rs.opts.codec == nil {
+		return SnappyFileCodec
+	}
+	return fs.rs.opts.codec
+}
+
+func (fs *fileStore) bloomFalsePositiveRate() float64 {
+	if fs.rs == nil || fs.rs.opts.bloomFalsePositiveRate == 0 {
+		return DefaultBloomFilterFalsePositiveRate
+	}
+	return fs.rs.opts.bloomFalsePositiveRate
+}
+
+func (fs *fileStore) indexBlockRows() int {
+	if fs.rs == nil || fs.rs.opts.indexBlockRows <= 0 {
+		return keyIndexInterval
+	}
+	return fs.rs.opts.indexBlockRows
+}
+
+// decode decodes the given column using the supplied codec, consulting the
+// cache of decoded sequences if one is configured. Raw columns don't need
+// decoding and are never cached. By the time we get here, the row has already
+// been read and decompressed, so the cache only saves the codec's work.
+func (fs *fileStore) decode(cache *sequenceCache, codec encoding.Codec, encoded encoding.Sequence, row int, column int) (encoding.Sequence, error) {
+	if cache == nil || codec == encoding.CodecRaw {
+		return codec.Decode(encoded)
+	}
+	key := sequenceCacheKey{fs.filename, row, column}
+	if seq, found := cache.get(key); found {
+		return seq, nil
+	}
+	seq, err := codec.Decode(encoded)
+	if err == nil {
+		cache.put(key, seq)
+	}
+	return seq, err
+}
+
+func (fs *fileStore) info(r io.Reader, fileVersion int) (common.OffsetsBySource, string, core.Fields, []encoding.Codec, error) {
 	var offsetsBySource common.OffsetsBySource
-	fileVersion := fs.t.versionFor(fs.filename)
 	// File contains header with field info, use it
 	headerLength := uint32(0)
 	lengthErr := binary.Read(r, encoding.Binary, &headerLength)
 	if lengthErr != nil {
-		return offsetsBySource, "", nil, fs.t.log.Errorf("Unexpected error reading header length from %v: %v", fs.filename, lengthErr)
+		return offsetsBySource, "", nil, nil, fs.t.log.Errorf("Unexpected error reading header length from %v: %v", fs.filename, lengthErr)
 	}
 	fieldsBytes := make([]byte, headerLength)
 	_, readErr := io.ReadFull(r, fieldsBytes)
 	if readErr != nil {
-		return offsetsBySource, "", nil, fs.t.log.Errorf("Unable to read fields from %v: %v", fs.filename, readErr)
+		return offsetsBySource, "", nil, nil, fs.t.log.Errorf("Unable to read fields from %v: %v", fs.filename, readErr)
 	}
 	offsetsBySource, fieldsBytes = fs.t.readOffsets(fileVersion, fieldsBytes)
+	var codecs []encoding.Codec
+	if fileVersion >= FileVersion_6 {
+		// Header contains the codec used for each field
+		var numCodecs int
+		numCodecs, fieldsBytes = encoding.ReadInt16(fieldsBytes)
+		codecs = make([]encoding.Codec, 0, numCodecs)
+		for i := 0; i < numCodecs; i++ {
+			codecs = append(codecs, encoding.Codec(fieldsBytes[i]))
+		}
+		fieldsBytes = fieldsBytes[numCodecs:]
+	}
 	delim := fieldsDelims[fileVersion]
 	fieldsString := string(fieldsBytes)
 	fieldStrings := strings.Split(fieldsString, delim)
@@ -945,11 +2426,18 @@ func (fs *fileStore) info(r io.Reader) (common.OffsetsBySource, string, core.Fie
 			}
 		}
 		if !foundField {
-			fileFields = append(fileFields, core.Field{})
+			// The field may have been renamed since the file was written, otherwise
+			// it's no longer in use
+			fileFields = append(fileFields, fs.renamedField(fieldString))
 		}
 	}
 
-	return offsetsBySource, fieldsString, fileFields, nil
+	if codecs == nil {
+		// Older files store all fields raw
+		codecs = make([]encoding.Codec, len(fileFields))
+	}
+
+	return offsetsBySource, fieldsString, fileFields, codecs, nil
 }
 
 func (fs *fileStore) markCorrupted() error {
@@ -966,6 +2454,7 @@ func (fs *fileStore) markCorrupted() error {
 	if err != nil {
 		return errors.New("Unable to move corrupted filestore %v to %v: %v", fs.filename, corruptedFile, err)
 	}
+	fs.t.db.invalidateSequenceCache(fs.filename)
 
 	return nil
 }
@@ -1030,6 +2519,39 @@ func outIdxsFor(outFields core.Fields, inFields core.Fields) []int {
 	return outIdxs
 }
 
+// codecsFor chooses the codec with which to store each of the given fields
+// based on the kind of data the field holds. Counters (SUM and COUNT) use delta
+// encoding, gauges (MIN and MAX) use XOR encoding and everything else is stored
+// raw.
+func codecsFor(fields core.Fields) []encoding.Codec {
+	codecs := make([]encoding.Codec, 0, len(fields))
+	for _, field := range fields {
+		codec := encoding.CodecRaw
+		if field.Expr != nil && field.Expr.EncodedWidth() == encoding.CodecValueWidth {
+			switch expr.AggregateName(field.Expr) {
+			case "SUM", "COUNT":
+				codec = encoding.CodecDelta
+			case "MIN", "MAX":
+				codec = encoding.CodecXOR
+			}
+		}
+		codecs = append(codecs, codec)
+	}
+	return codecs
+}
+
+func codecsEqual(a []encoding.Codec, b []encoding.Codec) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, codec := range a {
+		if codec != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (t *table) writeOffsets(file io.Writer, offsetsBySource common.OffsetsBySource) error {
 	t.log.Debugf("Writing offsets: %v", offsetsBySource)
 	numOffsets := make([]byte, encoding.Width64bits)
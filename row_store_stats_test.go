@@ -0,0 +1,31 @@
+package zenodb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRowStoreStats(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "stats", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	db.clock.Advance(testEpoch)
+	insertKeys(t, db, "stats", testEpoch, "a")
+
+	stats := db.TableStats("stats").RowStore
+	assert.Equal(t, 1, stats.MemStores)
+	assert.True(t, stats.MemStoreBytes > 0, "Memstore should have data")
+	assert.Zero(t, stats.Flushes)
+	assert.Zero(t, stats.BytesOnDisk)
+	assert.True(t, stats.FlushInterval > 0)
+
+	db.getTable("stats").forceFlush()
+	stats = db.TableStats("stats").RowStore
+	assert.Zero(t, stats.MemStoreBytes, "Memstore should have been flushed")
+	assert.EqualValues(t, 1, stats.Flushes)
+	assert.False(t, stats.LastFlushFinished.IsZero())
+	assert.True(t, stats.LastFlushBytes > 0, "Flushed file should have been recorded")
+	assert.Equal(t, stats.LastFlushBytes, stats.BytesOnDisk, "Flushed file should be the entire file store")
+	assert.True(t, stats.LastFlushDuration > 0, "Flush duration should have been recorded")
+}
@@ -1,11 +1,24 @@
 package zenodb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/getlantern/bytemap"
 	"github.com/getlantern/golog"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/getlantern/zenodb/expr"
+	"github.com/getlantern/zenodb/sql"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -31,3 +44,460 @@ func TestStorage(t *testing.T) {
 		cs.insert(&insert{})
 	}
 }
+
+func TestFieldCodecs(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "codecs", "SELECT SUM(c) AS c, MAX(g) AS g, AVG(a) AS a FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	resolution := time.Second
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	var points []*Point
+	expected := make(map[time.Time][]float64)
+	for i := 0; i < 100; i++ {
+		ts := epoch.Add(time.Duration(-i) * resolution)
+		c, g, a := float64(i*3), 20+float64(i%4)*0.5, float64(i)/3
+		points = append(points, &Point{TS: ts, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"c": c, "g": g, "a": a}})
+		expected[ts] = []float64{c, g, a}
+	}
+	_, err := db.InsertBatch("codecs", points)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tbl := db.getTable("codecs")
+	tbl.forceFlush()
+
+	fields := tbl.getFields()
+	codecsByName := make(map[string]encoding.Codec)
+	for i, codec := range codecsFor(fields) {
+		codecsByName[fields[i].Name] = codec
+	}
+	assert.Equal(t, encoding.CodecDelta, codecsByName["c"])
+	assert.Equal(t, encoding.CodecXOR, codecsByName["g"])
+	assert.Equal(t, encoding.CodecRaw, codecsByName["a"])
+
+	tbl.rowStore.mx.RLock()
+	fs := tbl.rowStore.fileStore
+	tbl.rowStore.mx.RUnlock()
+	file, err := os.Open(fs.filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer file.Close()
+	r, header, err := readFileHeader(file, fs.filename, 0)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, CurrentFileVersion, header.version, "Header should record file version")
+	_, _, fileFields, fileCodecs, err := fs.info(r, header.version)
+	if assert.NoError(t, err) {
+		assert.Equal(t, codecsFor(fileFields), fileCodecs, "Header should record codec for each field")
+	}
+
+	rows := 0
+	_, err = tbl.iterate(context.Background(), fields, false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		rows++
+		for i, name := range []string{"c", "g", "a"} {
+			idx := -1
+			for j, field := range fields {
+				if field.Name == name {
+					idx = j
+				}
+			}
+			for ts, values := range expected {
+				actual, _ := vals[idx].ValueAtTime(ts, fields[idx].Expr, resolution)
+				assert.Equal(t, values[i], actual, "Wrong value of %v at %v", name, ts)
+			}
+		}
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, rows)
+}
+
+func TestIterateWithFixedTruncateBefore(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "snapshot", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	_, err := db.InsertBatch("snapshot", []*Point{
+		{TS: epoch, Dims: map[string]interface{}{"k": "a"}, Vals: map[string]interface{}{"v": 1}},
+		{TS: epoch, Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 2}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tbl := db.getTable("snapshot")
+	fields := tbl.getFields()
+	vIdx := -1
+	for i, field := range fields {
+		if field.Name == "v" {
+			vIdx = i
+		}
+	}
+	if !assert.True(t, vIdx >= 0, "Field v not found") {
+		return
+	}
+	truncateBefore := tbl.truncateBefore()
+
+	// Move past the retention period both before and during the scan
+	db.clock.Advance(epoch.Add(tbl.RetentionPeriod))
+	values := make(map[string]float64)
+	_, err = tbl.iterateWithTruncateBefore(context.Background(), fields, true, truncateBefore, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		db.clock.Advance(epoch.Add(2 * tbl.RetentionPeriod))
+		val, _ := vals[vIdx].ValueAtTime(epoch, fields[vIdx].Expr, tbl.Resolution)
+		values[key.Get("k").(string)] = val
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]float64{"a": 1, "b": 2}, values, "Data within the captured retention period should be returned for the whole scan")
+	}
+
+	values = make(map[string]float64)
+	_, err = tbl.iterate(context.Background(), fields, true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+		val, _ := vals[vIdx].ValueAtTime(epoch, fields[vIdx].Expr, tbl.Resolution)
+		values[key.Get("k").(string)] = val
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		for k, val := range values {
+			assert.EqualValues(t, 0, val, "Data for %v outside of the current retention period should have been truncated", k)
+		}
+	}
+}
+
+func TestReadReplica(t *testing.T) {
+	tableSQL := "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)"
+	writer, cleanup := newTestDB(t, &DBOpts{}, "replicated", tableSQL)
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	writer.clock.Advance(epoch)
+
+	replica, err := NewDB(&DBOpts{
+		Dir:                     writer.opts.Dir,
+		VirtualTime:             true,
+		ReadReplica:             true,
+		ReadReplicaPollInterval: 10 * time.Millisecond,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer replica.Close()
+	replica.clock.Advance(epoch)
+	err = replica.CreateTable(&TableOpts{
+		Name:            "replicated",
+		RetentionPeriod: 1 * time.Hour,
+		SQL:             tableSQL,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	replicaTable := replica.getTable("replicated")
+	fields := replicaTable.getFields()
+	vIdx := -1
+	for i, field := range fields {
+		if field.Name == "v" {
+			vIdx = i
+		}
+	}
+	if !assert.True(t, vIdx >= 0, "Field v not found") {
+		return
+	}
+
+	readReplica := func() map[string]float64 {
+		values := make(map[string]float64)
+		_, err := replicaTable.iterate(context.Background(), fields, false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			val, _ := vals[vIdx].ValueAtTime(epoch, fields[vIdx].Expr, replicaTable.Resolution)
+			values[key.Get("k").(string)] = val
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return values
+	}
+
+	waitForReplica := func(expected map[string]float64) {
+		var values map[string]float64
+		for i := 0; i < 500; i++ {
+			values = readReplica()
+			if len(values) == len(expected) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.Equal(t, expected, values)
+	}
+
+	writerTable := writer.getTable("replicated")
+	insertAndFlush := func(k string, v float64) string {
+		_, err := writer.InsertBatch("replicated", []*Point{
+			{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": v}},
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		writerTable.forceFlush()
+		writerTable.rowStore.mx.RLock()
+		defer writerTable.rowStore.mx.RUnlock()
+		return writerTable.rowStore.fileStore.filename
+	}
+
+	assert.Empty(t, readReplica(), "Replica should start out empty")
+	firstGeneration := insertAndFlush("a", 1)
+	waitForReplica(map[string]float64{"a": 1})
+
+	// Simulate the writer removing the generation that the replica is on,
+	// possibly before the replica has noticed the new one
+	insertAndFlush("b", 2)
+	if !assert.NoError(t, os.Remove(firstGeneration)) {
+		return
+	}
+	assert.Equal(t, map[string]float64{"a": 1, "b": 2}, readReplica(), "Replica should switch to latest generation if its generation was removed")
+
+	insertAndFlush("c", 3)
+	waitForReplica(map[string]float64{"a": 1, "b": 2, "c": 3})
+}
+
+func TestFileVersion6Compat(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "compat", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	insert := func(k string, v float64) {
+		_, err := db.InsertBatch("compat", []*Point{
+			{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": v}},
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	insert("a", 1)
+	insert("b", 2)
+
+	tbl := db.getTable("compat")
+	tbl.forceFlush()
+	fields := tbl.getFields()
+	vIdx := -1
+	for i, field := range fields {
+		if field.Name == "v" {
+			vIdx = i
+		}
+	}
+	if !assert.True(t, vIdx >= 0, "Field v not found") {
+		return
+	}
+	read := func() map[string]float64 {
+		values := make(map[string]float64)
+		_, err := tbl.iterate(context.Background(), fields, true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			val, _ := vals[vIdx].ValueAtTime(epoch, fields[vIdx].Expr, tbl.Resolution)
+			values[key.Get("k").(string)] = val
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return values
+	}
+
+	rs := tbl.rowStore
+	rs.mx.RLock()
+	fs := rs.fileStore
+	rs.mx.RUnlock()
+	assert.Equal(t, CurrentFileVersion, tbl.versionFor(fs.filename))
+
+	// Rewrite the current file store using version 6's uint64 column lengths
+	var keys []bytemap.ByteMap
+	var rows [][]encoding.Sequence
+	offsetsBySource, err := fs.iterate(fields, nil, false, false, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		keys = append(keys, key)
+		rows = append(rows, columns)
+		return true, nil
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	v6Filename := filepath.Join(rs.opts.dir, fmt.Sprintf("filestore_%020d_%d.dat", time.Now().UnixNano(), FileVersion_6))
+	out := &bytes.Buffer{}
+	cout, err := fs.createOutWriter(out, fields, offsetsBySource, false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Version 6 files have plain keys
+	cout.(*indexingWriter).dictionary = nil
+	codecs := codecsFor(fields)
+	for i, key := range keys {
+		encodedColumns := make([][]byte, 0, len(rows[i]))
+		rowLength := encoding.Width64bits + encoding.Width16bits + len(key) + encoding.Width16bits
+		for j, seq := range rows[i] {
+			encoded := codecs[j].Encode(seq)
+			encodedColumns = append(encodedColumns, encoded)
+			rowLength += encoding.Width64bits + len(encoded)
+		}
+		binary.Write(cout, encoding.Binary, uint64(rowLength))
+		binary.Write(cout, encoding.Binary, uint16(len(key)))
+		cout.Write(key)
+		binary.Write(cout, encoding.Binary, uint16(len(encodedColumns)))
+		for _, col := range encodedColumns {
+			binary.Write(cout, encoding.Binary, uint64(len(col)))
+		}
+		for _, col := range encodedColumns {
+			cout.Write(col)
+		}
+	}
+	assert.NoError(t, cout.(flushable).Flush())
+	assert.NoError(t, cout.Close())
+	// Version 6 files didn't have a file header or footer
+	footer, err := readFileFooter(bytes.NewReader(out.Bytes()), v6Filename, CurrentFileVersion)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, ioutil.WriteFile(v6Filename, out.Bytes()[fileHeaderLength:footer.dataEnd], 0644)) {
+		return
+	}
+
+	rs.mx.Lock()
+	rs.fileStore = &fileStore{t: tbl, rs: rs, fields: rs.fields, filename: v6Filename}
+	rs.mx.Unlock()
+	assert.Equal(t, map[string]float64{"a": 1, "b": 2}, read(), "Should be able to read version 6 file")
+
+	// Flushing merges the version 6 file into a new file in the current version,
+	// which must not pass through version 6 rows as-is
+	insert("c", 3)
+	tbl.forceFlush()
+	rs.mx.RLock()
+	fs = rs.fileStore
+	rs.mx.RUnlock()
+	assert.Equal(t, CurrentFileVersion, tbl.versionFor(fs.filename))
+	assert.Equal(t, map[string]float64{"a": 1, "b": 2, "c": 3}, read(), "Should be able to read data migrated from version 6 file")
+}
+
+// BenchmarkWriteWideSparseRow writes rows with many short columns and reports
+// the per-row overhead of column lengths compared to fixed uint64 lengths.
+func BenchmarkWriteWideSparseRow(b *testing.B) {
+	resolution := time.Second
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	numColumns := 200
+	fields := make(core.Fields, 0, numColumns)
+	columns := make([]encoding.Sequence, 0, numColumns)
+	for i := 0; i < numColumns; i++ {
+		field := core.NewField(fmt.Sprintf("f%d", i), expr.SUM(expr.FIELD(fmt.Sprintf("f%d", i))))
+		fields = append(fields, field)
+		columns = append(columns, encoding.NewFloatValue(field.Expr, epoch, float64(i)))
+	}
+	fs := &fileStore{t: &table{Query: sql.Query{Resolution: resolution}}}
+	codecs := codecsFor(fields)
+	key := bytemap.New(map[string]interface{}{"k": "a"})
+
+	out := &countingWriteCloser{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := fs.doWrite(out, fields, codecs, nil, time.Time{}, false, key, columns, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+
+	rowBytes := out.n / int64(b.N)
+	legacyRowBytes := rowBytes - int64(len(appendLengths(columns, codecs))) + int64(numColumns*encoding.Width64bits)
+	b.SetBytes(rowBytes)
+	b.Logf("Row size %d bytes, would have been %d bytes with uint64 column lengths (%.1f%% smaller)", rowBytes, legacyRowBytes, 100*float64(legacyRowBytes-rowBytes)/float64(legacyRowBytes))
+}
+
+func appendLengths(columns []encoding.Sequence, codecs []encoding.Codec) []byte {
+	var lengths []byte
+	for i, seq := range columns {
+		lengths = encoding.AppendUvarint(lengths, uint64(len(codecs[i].Encode(seq))))
+	}
+	return lengths
+}
+
+type countingWriteCloser struct {
+	n int64
+}
+
+func (w *countingWriteCloser) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	return len(b), nil
+}
+
+func (w *countingWriteCloser) Close() error {
+	return nil
+}
+
+func TestIterateCallbackError(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{IterationCoalesceInterval: 50 * time.Millisecond}, "erroring", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	insert := func(keys ...string) {
+		var points []*Point
+		for _, k := range keys {
+			points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": 1}})
+		}
+		_, err := db.InsertBatch("erroring", points)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	tbl := db.getTable("erroring")
+	errClientGone := errors.New("client gone")
+	failAfterFirst := func(rows *int) func(bytemap.ByteMap, []encoding.Sequence) (bool, error) {
+		return func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			*rows++
+			return true, errClientGone
+		}
+	}
+
+	// Error while scanning memstore
+	insert("a", "b", "c")
+	rows := 0
+	_, err := tbl.iterate(context.Background(), nil, true, failAfterFirst(&rows))
+	assert.Equal(t, errClientGone, err, "Error from memstore scan should propagate")
+	assert.Equal(t, 1, rows, "Scan should have stopped at first error")
+
+	// Error while scanning file store
+	tbl.forceFlush()
+	insert("d")
+	rows = 0
+	_, err = tbl.iterate(context.Background(), nil, true, failAfterFirst(&rows))
+	assert.Equal(t, errClientGone, err, "Error from file store scan should propagate")
+	assert.Equal(t, 1, rows, "Scan should have stopped at first error")
+
+	// An error in one coalesced iteration only stops that iteration
+	var wg sync.WaitGroup
+	wg.Add(3)
+	failingRows := 0
+	var failingErr error
+	go func() {
+		defer wg.Done()
+		_, failingErr = tbl.iterate(context.Background(), nil, true, failAfterFirst(&failingRows))
+	}()
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var cancelledErr error
+	go func() {
+		defer wg.Done()
+		_, cancelledErr = tbl.iterate(cancelledCtx, nil, true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			t.Error("Cancelled iteration should not receive rows")
+			return true, nil
+		})
+	}()
+	healthyRows := 0
+	var healthyErr error
+	go func() {
+		defer wg.Done()
+		_, healthyErr = tbl.iterate(context.Background(), nil, true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			healthyRows++
+			return true, nil
+		})
+	}()
+	wg.Wait()
+	assert.Equal(t, errClientGone, failingErr)
+	assert.Equal(t, 1, failingRows)
+	assert.Equal(t, context.Canceled, cancelledErr)
+	assert.NoError(t, healthyErr)
+	assert.Equal(t, 4, healthyRows, "Healthy iteration should have seen all rows")
+}
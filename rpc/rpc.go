@@ -15,6 +15,10 @@ import (
 
 const (
 	PasswordKey = "pwd"
+
+	// DefaultRemoteQueryBatchSize is the default number of flat rows that
+	// followers send to the leader per message when answering remote queries.
+	DefaultRemoteQueryBatchSize = 100
 )
 
 var (
@@ -45,6 +49,9 @@ type Query struct {
 	Unflat          bool
 	Deadline        time.Time
 	HasDeadline     bool
+	// BatchSize is the maximum number of flat rows to send per
+	// RemoteQueryResult, values below 2 send each row individually.
+	BatchSize int
 }
 
 type Point struct {
@@ -61,9 +68,14 @@ type RemoteQueryResult struct {
 	Key          bytemap.ByteMap
 	Vals         core.Vals
 	Row          *core.FlatRow
+	Rows         []*core.FlatRow
 	Stats        *common.QueryStats
 	Error        string
 	EndOfResults bool
+	// MetaData accompanies EndOfResults and contains the query's metadata as
+	// of the end of iteration, including anything that is only known once the
+	// query has finished (Warnings, Empty and the execution stats).
+	MetaData *common.QueryMetaData
 }
 
 type RegisterQueryHandler struct {
@@ -92,6 +104,20 @@ type Server interface {
 	HandleRemoteQueries(r *RegisterQueryHandler, stream grpc.ServerStream) error
 }
 
+// ServiceDesc describes the zenodb gRPC service.
+//
+// Clients query with "query", follow streams with "follow" and insert with
+// "insert".
+//
+// Followers answer queries for their partition with "remoteQuery". A follower
+// registers with a RegisterQueryHandler, the leader sends it a Query and the
+// follower streams back a RemoteQueryResult with the fields, then results
+// holding either a single Key and Vals (for unflat queries) or batches of up to
+// Query.BatchSize FlatRows, and finally a result with EndOfResults and Stats.
+// Results are subject to gRPC flow control, so a leader that stops reading
+// causes the follower to block rather than buffer. The query's deadline is sent
+// along with it, and if the leader abandons the query, it ends the stream,
+// which cancels the follower's query.
 var ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "zenodb",
 	HandlerType: (*Server)(nil),
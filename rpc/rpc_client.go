@@ -135,6 +135,14 @@ func (c *client) Query(ctx context.Context, sqlString string, includeMemStore bo
 				return nil, rowErr
 			}
 			if result.EndOfResults {
+				if result.MetaData != nil {
+					// Metadata as of the end of the query supersedes what we got up front
+					*md = *result.MetaData
+				} else if result.Stats != nil {
+					// Whether or not the result was empty is only known at the end
+					md.Empty = result.Stats.Empty
+					md.EmptyReason = result.Stats.EmptyReason
+				}
 				return result.Stats, nil
 			}
 			more, rowErr := onRow(result.Row)
@@ -226,12 +234,30 @@ func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query pl
 	}
 	var onRow core.OnRow
 	var onFlatRow core.OnFlatRow
+	flushBatch := func() error { return nil }
 
 	if q.Unflat {
 		onRow = func(key bytemap.ByteMap, vals core.Vals) (bool, error) {
 			err := stream.SendMsg(&RemoteQueryResult{Key: key, Vals: vals})
 			return true, err
 		}
+	} else if q.BatchSize > 1 {
+		batch := make([]*core.FlatRow, 0, q.BatchSize)
+		onFlatRow = func(row *core.FlatRow) (bool, error) {
+			batch = append(batch, row)
+			if len(batch) < q.BatchSize {
+				return true, nil
+			}
+			err := stream.SendMsg(&RemoteQueryResult{Rows: batch})
+			batch = make([]*core.FlatRow, 0, q.BatchSize)
+			return true, err
+		}
+		flushBatch = func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			return stream.SendMsg(&RemoteQueryResult{Rows: batch})
+		}
 	} else {
 		onFlatRow = func(row *core.FlatRow) (bool, error) {
 			err := stream.SendMsg(&RemoteQueryResult{Row: row})
@@ -239,7 +265,15 @@ func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query pl
 		}
 	}
 
-	streamCtx := stream.Context()
+	streamCtx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		// The leader doesn't send anything else on this stream, so this only
+		// returns once the leader ends the stream, for example because it
+		// abandoned the query, in which case we stop working on it.
+		stream.RecvMsg(&Query{})
+		cancel()
+	}()
 	if q.HasDeadline {
 		var cancel context.CancelFunc
 		streamCtx, cancel = context.WithDeadline(streamCtx, q.Deadline)
@@ -248,6 +282,11 @@ func (c *client) ProcessRemoteQuery(ctx context.Context, partition int, query pl
 	streamCtx = common.WithIncludeMemStore(streamCtx, q.IncludeMemStore)
 
 	_stats, queryErr := query(streamCtx, q.SQLString, q.IsSubQuery, q.SubQueryResults, q.Unflat, onFields, onRow, onFlatRow)
+	if queryErr == nil || queryErr == io.EOF {
+		if flushErr := flushBatch(); flushErr != nil {
+			queryErr = flushErr
+		}
+	}
 	var stats *common.QueryStats
 	if _stats != nil {
 		stats = _stats.(*common.QueryStats)
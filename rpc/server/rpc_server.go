@@ -27,6 +27,11 @@ type Opts struct {
 	// Password, if specified, is the password that clients must present in order
 	// to access the server.
 	Password string
+
+	// RemoteQueryBatchSize is the number of flat rows that followers should send
+	// per message when answering remote queries. Defaults to
+	// rpc.DefaultRemoteQueryBatchSize.
+	RemoteQueryBatchSize int
 }
 
 // DB is an interface for database-like things (implemented by common.DB).
@@ -41,17 +46,22 @@ type DB interface {
 }
 
 func PrepareServer(db DB, l net.Listener, opts *Opts) (func() error, func()) {
+	remoteQueryBatchSize := opts.RemoteQueryBatchSize
+	if remoteQueryBatchSize <= 0 {
+		remoteQueryBatchSize = rpc.DefaultRemoteQueryBatchSize
+	}
 	l = &rpc.SnappyListener{l}
 	gs := grpc.NewServer(grpc.CustomCodec(rpc.Codec))
-	gs.RegisterService(&rpc.ServiceDesc, &server{golog.LoggerFor(fmt.Sprintf("zenodb.rpc (%d)", opts.ID)), db, opts.ID, opts.Password})
+	gs.RegisterService(&rpc.ServiceDesc, &server{golog.LoggerFor(fmt.Sprintf("zenodb.rpc (%d)", opts.ID)), db, opts.ID, opts.Password, remoteQueryBatchSize})
 	return func() error { return gs.Serve(l) }, gs.Stop
 }
 
 type server struct {
-	log      golog.Logger
-	db       DB
-	id       int
-	password string
+	log                  golog.Logger
+	db                   DB
+	id                   int
+	password             string
+	remoteQueryBatchSize int
 }
 
 func (s *server) Insert(stream grpc.ServerStream) error {
@@ -122,8 +132,10 @@ func (s *server) Query(q *rpc.Query, stream grpc.ServerStream) error {
 	}
 
 	rr := &rpc.RemoteQueryResult{}
-	stats, err := source.Iterate(stream.Context(), func(fields core.Fields) error {
+	var fields core.Fields
+	stats, err := source.Iterate(stream.Context(), func(inFields core.Fields) error {
 		// Send query metadata
+		fields = inFields
 		md := zenodb.MetaDataFor(source, fields)
 		return stream.SendMsg(md)
 	}, func(row *core.FlatRow) (bool, error) {
@@ -140,6 +152,9 @@ func (s *server) Query(q *rpc.Query, stream grpc.ServerStream) error {
 		rr.Stats = stats.(*common.QueryStats)
 	}
 	rr.EndOfResults = true
+	// Send the metadata again now that iteration has finished, since things
+	// like warnings and execution stats weren't known up front
+	rr.MetaData = zenodb.MetaDataFor(source, fields)
 	return stream.SendMsg(rr)
 }
 
@@ -182,10 +197,23 @@ func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.Se
 			SubQueryResults: subQueryResults,
 			Unflat:          unflat,
 			IncludeMemStore: common.ShouldIncludeMemStore(ctx),
+			BatchSize:       s.remoteQueryBatchSize,
 		}
 		q.Deadline, q.HasDeadline = ctx.Deadline()
 		sendErr := stream.SendMsg(q)
 
+		// If the query is cancelled, end the stream so that the follower stops
+		// working on it too
+		done := make(chan interface{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				finish(ctx.Err())
+			case <-done:
+			}
+		}()
+
 		m, recvErr := <-initialResultCh, <-initialErrCh
 
 		// Check send error after reading initial result to avoid blocking
@@ -223,13 +251,16 @@ func (s *server) HandleRemoteQueries(r *rpc.RegisterQueryHandler, stream grpc.Se
 				if m.EndOfResults {
 					break
 				}
-				var more bool
+				more := true
 				var err error
 				if unflat {
 					more, err = onRow(m.Key, m.Vals)
-				} else {
+				} else if m.Row != nil {
 					more, err = onFlatRow(m.Row)
 				}
+				for i := 0; more && err == nil && i < len(m.Rows); i++ {
+					more, err = onFlatRow(m.Rows[i])
+				}
 				if !more || err != nil {
 					finalErr = err
 					break receiveLoop
@@ -78,8 +78,80 @@ func TestInsert(t *testing.T) {
 	}
 }
 
+func TestRemoteQuery(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+
+	db := &mockDB{handlers: make(chan planner.QueryClusterFN, 1)}
+	start, stop := PrepareServer(db, l, &Opts{
+		RemoteQueryBatchSize: 3,
+	})
+	go start()
+	defer stop()
+	time.Sleep(1 * time.Second)
+
+	client, err := rpc.Dial(l.Addr().String(), &rpc.ClientOpts{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+
+	// Batched rows
+	go client.ProcessRemoteQuery(context.Background(), 0, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+		onFields(nil)
+		for i := 0; i < 10; i++ {
+			onFlatRow(&core.FlatRow{TS: int64(i), Values: []float64{float64(i)}})
+		}
+		return &common.QueryStats{RowsScanned: 10}, nil
+	}, 1*time.Minute)
+
+	handler := <-db.handlers
+	var rows []*core.FlatRow
+	stats, err := handler(context.Background(), "select", false, nil, false, func(fields core.Fields) error {
+		return nil
+	}, nil, func(row *core.FlatRow) (bool, error) {
+		rows = append(rows, row)
+		return true, nil
+	})
+	if assert.NoError(t, err) && assert.Len(t, rows, 10, "All rows should have been received, including partial last batch") {
+		for i, row := range rows {
+			assert.EqualValues(t, i, row.TS, "Rows should have been received in order")
+		}
+		assert.EqualValues(t, 10, stats.(*common.QueryStats).RowsScanned)
+	}
+
+	// Cancellation
+	remoteCancelled := make(chan interface{})
+	go client.ProcessRemoteQuery(context.Background(), 0, func(ctx context.Context, sqlString string, isSubQuery bool, subQueryResults [][]interface{}, unflat bool, onFields core.OnFields, onRow core.OnRow, onFlatRow core.OnFlatRow) (interface{}, error) {
+		onFields(nil)
+		<-ctx.Done()
+		close(remoteCancelled)
+		return nil, ctx.Err()
+	}, 1*time.Minute)
+
+	handler = <-db.handlers
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = handler(ctx, "select", false, nil, false, func(fields core.Fields) error {
+		cancel()
+		return nil
+	}, nil, func(row *core.FlatRow) (bool, error) {
+		return true, nil
+	})
+	assert.Error(t, err, "Cancelled query should have failed")
+	select {
+	case <-remoteCancelled:
+		// good
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "Cancelling query should have cancelled remote query")
+	}
+}
+
 type mockDB struct {
 	numInserts int64
+	handlers   chan planner.QueryClusterFN
 }
 
 func (db *mockDB) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
@@ -99,5 +171,7 @@ func (db *mockDB) Follow(f *common.Follow, cb func([]byte, wal.Offset) error) {
 }
 
 func (db *mockDB) RegisterQueryHandler(partition int, query planner.QueryClusterFN) {
-
+	if db.handlers != nil {
+		db.handlers <- query
+	}
 }
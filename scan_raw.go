@@ -0,0 +1,57 @@
+package zenodb
+
+import (
+	"context"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// ScanRaw scans the named table, passing the raw sequences for each key to
+// onRow. See table.ScanRaw.
+func (db *DB) ScanRaw(ctx context.Context, table string, fields []string, includeMemStore bool, onRow func(key bytemap.ByteMap, seqs []encoding.Sequence) bool) error {
+	t := db.getTable(table)
+	if t == nil {
+		return errors.New("Table %v not found", table)
+	}
+	return t.ScanRaw(ctx, fields, includeMemStore, onRow)
+}
+
+// ScanRaw scans this table, calling onRow with each key and the raw sequences
+// for the named fields, in the order in which they were named. If no fields
+// are named, onRow gets the sequences for all of the table's fields in the
+// order in which the table defines them. Sequences for fields without data are
+// empty. Returning false from onRow stops the scan. Like queries, the scan
+// only includes data within the table's retention period, and only includes
+// data that hasn't been flushed yet if includeMemStore is true.
+//
+// This allows building custom aggregations, exporters and migration tools on
+// top of a table's data. The sequences are only valid for the duration of the
+// call to onRow, so copy any that need to be retained.
+func (t *table) ScanRaw(ctx context.Context, fields []string, includeMemStore bool, onRow func(key bytemap.ByteMap, seqs []encoding.Sequence) bool) error {
+	tableFields := t.getFields()
+	outFields := tableFields
+	if len(fields) > 0 {
+		outFields = make(core.Fields, 0, len(fields))
+		for _, name := range fields {
+			found := false
+			for _, field := range tableFields {
+				if field.Name == name {
+					outFields = append(outFields, field)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return errors.New("Table %v has no field %v", t.Name, name)
+			}
+		}
+	}
+
+	_, err := t.iterate(ctx, outFields, includeMemStore, func(key bytemap.ByteMap, seqs []encoding.Sequence) (bool, error) {
+		return onRow(key, seqs), nil
+	})
+	return err
+}
@@ -0,0 +1,60 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanRaw(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "raw", "SELECT SUM(v) AS v, SUM(w) AS w FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	var points []*Point
+	for i := 0; i < 5; i++ {
+		points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": fmt.Sprint(i)}, Vals: map[string]interface{}{"v": i, "w": 10 * i}})
+	}
+	if _, err := db.InsertBatch("raw", points); !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("raw")
+	tbl.forceFlush()
+	var w core.Field
+	for _, field := range tbl.getFields() {
+		if field.Name == "w" {
+			w = field
+		}
+	}
+
+	result := make(map[string]float64)
+	err := db.ScanRaw(context.Background(), "raw", []string{"w"}, false, func(key bytemap.ByteMap, seqs []encoding.Sequence) bool {
+		if assert.Len(t, seqs, 1) {
+			val, _ := seqs[0].ValueAtTime(epoch, w.Expr, tbl.Resolution)
+			result[key.Get("k").(string)] = val
+		}
+		return true
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]float64{"0": 0, "1": 10, "2": 20, "3": 30, "4": 40}, result)
+	}
+
+	rows := 0
+	err = db.ScanRaw(context.Background(), "raw", nil, false, func(key bytemap.ByteMap, seqs []encoding.Sequence) bool {
+		assert.Len(t, seqs, len(tbl.getFields()), "Should get all fields by default")
+		rows++
+		return rows < 2
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rows, "Returning false should stop scan")
+
+	assert.Error(t, db.ScanRaw(context.Background(), "raw", []string{"unknown"}, false, nil), "Unknown field should fail")
+	assert.Error(t, db.ScanRaw(context.Background(), "unknown", nil, false, nil), "Unknown table should fail")
+}
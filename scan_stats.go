@@ -0,0 +1,43 @@
+package zenodb
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+const keyScanStats = "zenodb.scanStats"
+
+// scanStats accumulates statistics about the files read while iterating. It's
+// safe for concurrent use, since merged iteration reads files in parallel.
+type scanStats struct {
+	filesRead         int64
+	bytesDecompressed int64
+}
+
+// withScanStats returns a context under which iterating over file stores
+// records what it reads in the returned scanStats.
+func withScanStats(ctx context.Context) (context.Context, *scanStats) {
+	stats := &scanStats{}
+	return context.WithValue(ctx, keyScanStats, stats), stats
+}
+
+// scanStatsFrom returns the scanStats of the given context, or nil if nothing
+// is being recorded.
+func scanStatsFrom(ctx context.Context) *scanStats {
+	stats, _ := ctx.Value(keyScanStats).(*scanStats)
+	return stats
+}
+
+// fileRead records that a file was read, decompressing the given number of
+// bytes. A nil scanStats ignores it.
+func (ss *scanStats) fileRead(bytesDecompressed int64) {
+	if ss == nil {
+		return
+	}
+	atomic.AddInt64(&ss.filesRead, 1)
+	atomic.AddInt64(&ss.bytesDecompressed, bytesDecompressed)
+}
+
+func (ss *scanStats) get() (filesRead int64, bytesDecompressed int64) {
+	return atomic.LoadInt64(&ss.filesRead), atomic.LoadInt64(&ss.bytesDecompressed)
+}
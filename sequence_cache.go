@@ -0,0 +1,157 @@
+package zenodb
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	// sequenceCacheEntryOverhead approximates the memory used by a cache entry
+	// in addition to the sequence itself
+	sequenceCacheEntryOverhead = 96
+)
+
+// SequenceCacheStats provides statistics about the decoded sequence cache.
+type SequenceCacheStats struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+	Bytes   int
+}
+
+// HitRate returns the fraction of lookups that were served from the cache.
+func (stats SequenceCacheStats) HitRate() float64 {
+	total := stats.Hits + stats.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(stats.Hits) / float64(total)
+}
+
+// sequenceCacheKey identifies a column in a row of a specific file store. Since
+// file stores are never modified once written, this uniquely identifies the
+// encoded sequence.
+type sequenceCacheKey struct {
+	filename string
+	row      int
+	column   int
+}
+
+type sequenceCacheEntry struct {
+	key     sequenceCacheKey
+	seq     encoding.Sequence
+	expires time.Time
+}
+
+// sequenceCache is an LRU cache of decoded sequences, bounded by size and with
+// entries that expire after a TTL.
+type sequenceCache struct {
+	maxBytes int
+	ttl      time.Duration
+	entries  map[sequenceCacheKey]*list.Element
+	lru      *list.List
+	stats    SequenceCacheStats
+	mx       sync.Mutex
+}
+
+func newSequenceCache(maxBytes int, ttl time.Duration) *sequenceCache {
+	return &sequenceCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		entries:  make(map[sequenceCacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// get returns a copy of the cached sequence for the given key, if any. Since
+// some operations on sequences (like Truncate) modify them in place, the cache
+// never hands out the sequences that it holds.
+func (c *sequenceCache) get(key sequenceCacheKey) (encoding.Sequence, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	el := c.entries[key]
+	if el == nil {
+		c.stats.Misses++
+		return nil, false
+	}
+	entry := el.Value.(*sequenceCacheEntry)
+	if c.ttl > 0 && time.Now().After(entry.expires) {
+		c.remove(el)
+		c.stats.Misses++
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	c.stats.Hits++
+	return append(encoding.Sequence(nil), entry.seq...), true
+}
+
+// put caches a copy of the given sequence.
+func (c *sequenceCache) put(key sequenceCacheKey, seq encoding.Sequence) {
+	size := len(seq) + sequenceCacheEntryOverhead
+	if size > c.maxBytes {
+		return
+	}
+	seq = append(encoding.Sequence(nil), seq...)
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if el := c.entries[key]; el != nil {
+		c.remove(el)
+	}
+	entry := &sequenceCacheEntry{key: key, seq: seq}
+	if c.ttl > 0 {
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.stats.Bytes += size
+	c.stats.Entries++
+	for c.stats.Bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// invalidate removes all entries for the given file store, e.g. once it has
+// been removed from disk.
+func (c *sequenceCache) invalidate(filename string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*sequenceCacheEntry).key.filename == filename {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+func (c *sequenceCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*sequenceCacheEntry)
+	delete(c.entries, entry.key)
+	c.stats.Bytes -= len(entry.seq) + sequenceCacheEntryOverhead
+	c.stats.Entries--
+}
+
+func (c *sequenceCache) getStats() SequenceCacheStats {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.stats
+}
+
+// invalidateSequenceCache removes any cached sequences for the given file
+// store.
+func (db *DB) invalidateSequenceCache(filename string) {
+	if db.sequenceCache != nil {
+		db.sequenceCache.invalidate(filename)
+	}
+}
+
+// SequenceCacheStats returns statistics about the cache of decoded sequences.
+// If the cache is disabled, all statistics are zero.
+func (db *DB) SequenceCacheStats() SequenceCacheStats {
+	if db.sequenceCache == nil {
+		return SequenceCacheStats{}
+	}
+	return db.sequenceCache.getStats()
+}
@@ -0,0 +1,190 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequenceCache(t *testing.T) {
+	seq := func(b byte, length int) encoding.Sequence {
+		s := make(encoding.Sequence, length)
+		for i := range s {
+			s[i] = b
+		}
+		return s
+	}
+	key := func(filename string, row int) sequenceCacheKey {
+		return sequenceCacheKey{filename, row, 0}
+	}
+
+	c := newSequenceCache(3*(100+sequenceCacheEntryOverhead), 0)
+	c.put(key("a", 0), seq(1, 100))
+	c.put(key("a", 1), seq(2, 100))
+	c.put(key("b", 0), seq(3, 100))
+
+	cached, found := c.get(key("a", 0))
+	if assert.True(t, found) {
+		assert.Equal(t, seq(1, 100), cached)
+		cached[0] = 99
+		cached, _ = c.get(key("a", 0))
+		assert.EqualValues(t, 1, cached[0], "Modifying returned sequence should not affect cache")
+	}
+
+	// Exceed size, evicting least recently used
+	c.put(key("b", 1), seq(4, 100))
+	_, found = c.get(key("a", 1))
+	assert.False(t, found, "Least recently used entry should have been evicted")
+	_, found = c.get(key("a", 0))
+	assert.True(t, found, "Recently used entry should remain")
+
+	c.invalidate("a")
+	_, found = c.get(key("a", 0))
+	assert.False(t, found, "Invalidated entry should be gone")
+	_, found = c.get(key("b", 0))
+	assert.True(t, found, "Entry for other file should remain")
+
+	stats := c.getStats()
+	assert.EqualValues(t, 4, stats.Hits)
+	assert.EqualValues(t, 2, stats.Misses)
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, 2*(100+sequenceCacheEntryOverhead), stats.Bytes)
+	assert.Equal(t, 4.0/6, stats.HitRate())
+
+	c.put(key("c", 0), seq(5, 10*c.maxBytes))
+	_, found = c.get(key("c", 0))
+	assert.False(t, found, "Sequence larger than cache should not be cached")
+
+	c = newSequenceCache(1000, 10*time.Millisecond)
+	c.put(key("a", 0), seq(1, 10))
+	_, found = c.get(key("a", 0))
+	assert.True(t, found)
+	time.Sleep(20 * time.Millisecond)
+	_, found = c.get(key("a", 0))
+	assert.False(t, found, "Entry should have expired")
+	assert.Zero(t, c.getStats().Entries)
+}
+
+func TestSequenceCacheQuery(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{SequenceCacheBytes: 1024 * 1024}, "cached", "SELECT SUM(v) AS v, MAX(v) AS m FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	var points []*Point
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 20; j++ {
+			points = append(points, &Point{TS: epoch.Add(time.Duration(-j) * time.Second), Dims: map[string]interface{}{"k": i}, Vals: map[string]interface{}{"v": float64(i + j)}})
+		}
+	}
+	_, err := db.InsertBatch("cached", points)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("cached")
+	tbl.forceFlush()
+
+	fields := tbl.getFields()
+	read := func() map[string]string {
+		result := make(map[string]string)
+		_, err := tbl.iterate(context.Background(), fields, false, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			for i, field := range fields {
+				result[fmt.Sprintf("%v.%v", key.Get("k"), field.Name)] = vals[i].String(field.Expr, tbl.Resolution)
+			}
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	uncached := read()
+	stats := db.SequenceCacheStats()
+	assert.Zero(t, stats.Hits)
+	assert.True(t, stats.Misses > 0)
+	assert.True(t, stats.Entries > 0)
+
+	assert.Equal(t, uncached, read(), "Cached read should match uncached read")
+	stats2 := db.SequenceCacheStats()
+	assert.Equal(t, stats.Misses, stats2.Misses, "Second read should not have missed")
+	assert.Equal(t, stats.Misses, stats2.Hits, "Second read should have hit for every column decoded by first read")
+
+	// A new generation doesn't use the old generation's entries
+	_, err = db.InsertBatch("cached", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": 100}, Vals: map[string]interface{}{"v": 1}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl.forceFlush()
+	after := read()
+	assert.Len(t, after, len(uncached)+len(fields))
+	assert.True(t, db.SequenceCacheStats().Misses > stats2.Misses, "New file store generation should not have been cached yet")
+}
+
+func BenchmarkRepeatedQueryUncached(b *testing.B) {
+	doBenchmarkRepeatedQuery(b, 0)
+}
+
+func BenchmarkRepeatedQueryCached(b *testing.B) {
+	doBenchmarkRepeatedQuery(b, 100*1024*1024)
+}
+
+func doBenchmarkRepeatedQuery(b *testing.B, cacheBytes int) {
+	tmpDir, err := ioutil.TempDir("", "zenodbbench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	db, err := NewDB(&DBOpts{Dir: tmpDir, VirtualTime: true, SequenceCacheBytes: cacheBytes})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	err = db.CreateTable(&TableOpts{
+		Name:            "bench",
+		RetentionPeriod: 1 * time.Hour,
+		SQL:             "SELECT SUM(v) AS v, MAX(v) AS m FROM inbound GROUP BY k, period(1s)",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	var points []*Point
+	for i := 0; i < 1000; i++ {
+		for j := 0; j < 100; j++ {
+			points = append(points, &Point{TS: epoch.Add(time.Duration(-j) * time.Second), Dims: map[string]interface{}{"k": i}, Vals: map[string]interface{}{"v": float64(i * j)}})
+		}
+	}
+	if _, err := db.InsertBatch("bench", points); err != nil {
+		b.Fatal(err)
+	}
+	db.getTable("bench").forceFlush()
+
+	// Run the whole query each time so that we measure the latency that clients
+	// see, of which decoding is only a part
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		source, err := db.Query("SELECT v, m FROM bench GROUP BY k", false, nil, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			return true, nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if cacheBytes > 0 {
+		b.Logf("Cache hit rate: %.2f", db.SequenceCacheStats().HitRate())
+	}
+}
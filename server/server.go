@@ -83,7 +83,9 @@ type Server struct {
 	Partition                 int
 	ClusterQueryConcurrency   int
 	ClusterQueryTimeout       time.Duration
+	ClusterQueryBatchSize     int
 	NextQueryTimeout          time.Duration
+	QueryTimeout              time.Duration
 	MaxFollowAge              time.Duration
 	MaxFollowQueue            int
 	TLSDomain                 string
@@ -184,6 +186,7 @@ func (s *Server) Prepare() (db *zenodb.DB, run func() error, finalErr error) {
 		Partition:                 s.Partition,
 		ClusterQueryConcurrency:   s.ClusterQueryConcurrency,
 		ClusterQueryTimeout:       s.ClusterQueryTimeout,
+		QueryTimeout:              s.QueryTimeout,
 		MaxFollowAge:              s.MaxFollowAge,
 		MaxFollowQueue:            s.MaxFollowQueue,
 		Panic:                     s.Panic,
@@ -475,8 +478,9 @@ func (s *Server) followSource(client rpc.Client, source int, f *common.Follow, i
 
 func (s *Server) serveRPC() error {
 	serve, stop := rpcserver.PrepareServer(s.db, s.Listener, &rpcserver.Opts{
-		ID:       s.ID,
-		Password: s.Password,
+		ID:                   s.ID,
+		Password:             s.Password,
+		RemoteQueryBatchSize: s.ClusterQueryBatchSize,
 	})
 	s.stopRPC = stop
 	if err := serve(); err != nil {
@@ -660,6 +664,8 @@ func (s *Server) ConfigureFlags() {
 	flag.IntVar(&s.Partition, "partition", 0, "the partition number assigned to this follower")
 	flag.IntVar(&s.ClusterQueryConcurrency, "clusterqueryconcurrency", DefaultClusterQueryConcurrency, "specifies the maximum concurrency for clustered queries")
 	flag.DurationVar(&s.ClusterQueryTimeout, "clusterquerytimeout", zenodb.DefaultClusterQueryTimeout, "specifies the maximum time leader will wait for followers to answer a query")
+	flag.IntVar(&s.ClusterQueryBatchSize, "clusterquerybatchsize", rpc.DefaultRemoteQueryBatchSize, "specifies how many rows followers send to the leader per message when answering queries")
+	flag.DurationVar(&s.QueryTimeout, "querytimeout", 0, "if positive, limits how long queries may run before they're cancelled")
 	flag.DurationVar(&s.NextQueryTimeout, "nextquerytimeout", DefaultNextQueryTimeout, "specifies the maximum time follower will wait for leader to send a query on an open connection")
 	flag.DurationVar(&s.MaxFollowAge, "maxfollowage", 0, "use with -follow, limits how far to go back when pulling data from leader")
 	flag.IntVar(&s.MaxFollowQueue, "maxfollowqueue", zenodb.DefaultMaxFollowQueue, fmt.Sprintf("limits how many rows to queue for any given follower, defaults to %d", zenodb.DefaultMaxFollowQueue))
@@ -523,6 +523,7 @@ test_ab:
 					if !assert.EqualValues(t, expectedFields, md.FieldNames, "%v, wrong field names in query result for %v", tst.label, sql) {
 						return false
 					}
+					assert.True(t, md.Elapsed > 0, "%v, execution stats should be sent at the end of results for %v", tst.label, sql)
 					if !er.Assert(t, fmt.Sprintf("%v (%d)", tst.label, i), md, rows) {
 						for partition, followersForPartition := range followersByPartition {
 							followerClients, closeClients, err := clientsForServers(followersForPartition)
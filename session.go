@@ -0,0 +1,86 @@
+package zenodb
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/core"
+)
+
+const (
+	readYourWritesPollInterval = 5 * time.Millisecond
+)
+
+// Session provides read-your-writes consistency for a single client. Queries
+// run through a Session include the mem store and wait until every point that
+// was inserted through the Session has been applied to the queried tables,
+// up to DBOpts.ReadYourWritesTimeout. Sessions can only guarantee this for
+// tables that store their data locally, so querying other tables (e.g. on a
+// cluster leader) through a Session fails.
+type Session struct {
+	db        *DB
+	sequences map[string]int64
+	mx        sync.Mutex
+}
+
+// NewSession creates a new Session.
+func (db *DB) NewSession() *Session {
+	return &Session{db: db, sequences: make(map[string]int64)}
+}
+
+// Insert is like DB.Insert, but records the insert with the Session.
+func (s *Session) Insert(stream string, ts time.Time, dims map[string]interface{}, vals map[string]interface{}) error {
+	return s.InsertRaw(stream, ts, bytemap.New(dims), bytemap.New(vals))
+}
+
+// InsertRaw is like DB.InsertRaw, but records the insert with the Session.
+func (s *Session) InsertRaw(stream string, ts time.Time, dims bytemap.ByteMap, vals bytemap.ByteMap) error {
+	sequence, err := s.db.insertRaw(stream, ts, dims, vals, true)
+	if err != nil {
+		return err
+	}
+	stream = strings.TrimSpace(strings.ToLower(stream))
+	s.mx.Lock()
+	if sequence > s.sequences[stream] {
+		s.sequences[stream] = sequence
+	}
+	s.mx.Unlock()
+	return nil
+}
+
+// Query is like DB.Query, but always includes the mem store and makes sure
+// that the results reflect all inserts made through this Session.
+func (s *Session) Query(sqlString string, isSubQuery bool, subQueryResults [][]interface{}) (core.FlatRowSource, error) {
+	return s.db.query(sqlString, isSubQuery, subQueryResults, true, time.Time{}, time.Time{}, s, s.db.opts.QueryTimeout)
+}
+
+// waitForInserts waits until the named table has applied the latest insert
+// made through this Session to the table's stream.
+func (s *Session) waitForInserts(table string) error {
+	t := s.db.getTable(table)
+	if t == nil {
+		// Let the regular query logic deal with this
+		return nil
+	}
+	if t.rowStore == nil {
+		return errors.New("Table %v does not store data locally, unable to guarantee read-your-writes consistency", table)
+	}
+	s.mx.Lock()
+	sequence := s.sequences[t.From]
+	s.mx.Unlock()
+	if sequence == 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(s.db.opts.ReadYourWritesTimeout)
+	for !t.rowStore.hasApplied(sequence) {
+		if time.Now().After(deadline) {
+			return errors.New("Timed out after %v waiting for inserts to be applied to table %v", s.db.opts.ReadYourWritesTimeout, table)
+		}
+		time.Sleep(readYourWritesPollInterval)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package zenodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionReadYourWrites(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "session", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	session := db.NewSession()
+	for i := 0; i < 10; i++ {
+		for j := 0; j < 3; j++ {
+			if !assert.NoError(t, session.Insert("inbound", epoch, map[string]interface{}{"k": "a"}, map[string]interface{}{"v": 1})) {
+				return
+			}
+		}
+
+		source, err := session.Query("SELECT v FROM session", false, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		v := float64(0)
+		_, err = source.Iterate(context.Background(), core.FieldsIgnored, func(row *core.FlatRow) (bool, error) {
+			v += row.Values[0]
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.EqualValues(t, (i+1)*3, v, "Session query should see all of the session's inserts")
+	}
+
+	assert.Error(t, session.Insert("unknown", epoch, map[string]interface{}{"k": "a"}, map[string]interface{}{"v": 1}))
+}
+
+func TestSessionRequiresLocalData(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{Passthrough: true, NumPartitions: 1}, "leader", "SELECT v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	_, err := db.NewSession().Query("SELECT v FROM leader", false, nil)
+	if assert.Error(t, err, "Session query on table without local data should fail") {
+		assert.Contains(t, err.Error(), "does not store data locally")
+	}
+}
+
+func TestWALSequence(t *testing.T) {
+	dims := bytemap.New(map[string]interface{}{"k": "a"})
+	vals := bytemap.New(map[string]interface{}{"v": 1})
+	entry := make([]byte, encoding.Width64bits+encoding.Width32bits+len(dims)+encoding.Width32bits+len(vals))
+	encoding.EncodeTime(entry, time.Now())
+	remain := encoding.WriteInt32(entry[encoding.Width64bits:], len(dims))
+	remain = encoding.Write(remain, dims)
+	remain = encoding.WriteInt32(remain, len(vals))
+	encoding.Write(remain, vals)
+	assert.EqualValues(t, 0, walSequence(entry), "Entry without sequence should have sequence 0")
+
+	seqd := make([]byte, encoding.Width64bits)
+	encoding.WriteInt64(seqd, 55)
+	assert.EqualValues(t, 55, walSequence(append(entry, seqd...)))
+	assert.EqualValues(t, 0, walSequence(entry[:5]), "Truncated entry should have sequence 0")
+}
@@ -0,0 +1,265 @@
+package zenodb
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	snapshotManifestFilename = "snapshot.json"
+)
+
+// snapshotManifest describes the table and files contained in a snapshot.
+type snapshotManifest struct {
+	Name            string
+	SQL             string
+	Resolution      time.Duration
+	RetentionPeriod time.Duration
+	MinFlushLatency time.Duration
+	MaxFlushLatency time.Duration
+	Backfill        time.Duration
+	PartitionBy     []string
+	MaxFileStores   int
+	Fields          []string
+	// Files are the paths of the snapshotted files relative to the snapshot
+	// directory, with the base file store first and deltas after
+	Files   []string
+	Created time.Time
+}
+
+// SnapshotTable writes a snapshot of the named table to destDir. See
+// table.Snapshot.
+func (db *DB) SnapshotTable(table string, destDir string) error {
+	t := db.getTable(table)
+	if t == nil {
+		return errors.New("Table %v not found", table)
+	}
+	return t.Snapshot(destDir)
+}
+
+// Snapshot flushes the memstore and then writes a point-in-time copy of the
+// table's current file stores (plus its deleted keys and field renames) to
+// destDir, along with a manifest describing the table's schema. Files are
+// hard-linked where possible and copied otherwise. The snapshot is assembled in
+// a temporary directory next to destDir and then renamed into place, so destDir
+// either contains a complete snapshot or doesn't exist. destDir must not exist
+// yet.
+//
+// Files referenced by a snapshot in progress aren't removed by the cleanup of
+// old files. Once finished, the snapshot doesn't depend on the table's
+// directory, so it can be restored with RestoreFrom or TableOpts.RestoreFrom.
+func (t *table) Snapshot(destDir string) error {
+	if t.rowStore == nil || t.rowStore.opts.readReplica {
+		return errors.New("Table %v does not store data locally and can't be snapshotted", t.Name)
+	}
+	if _, err := os.Stat(destDir); err == nil {
+		return errors.New("Snapshot destination %v already exists", destDir)
+	} else if !os.IsNotExist(err) {
+		return errors.New("Unable to check snapshot destination %v: %v", destDir, err)
+	}
+
+	t.forceFlush()
+
+	rs := t.rowStore
+	rs.mx.Lock()
+	files := rs.fileStore.files()
+	for _, filename := range files {
+		rs.iterationsInProgress[filename]++
+	}
+	rs.mx.Unlock()
+	defer func() {
+		rs.mx.Lock()
+		for _, filename := range files {
+			rs.iterationsInProgress[filename]--
+		}
+		rs.mx.Unlock()
+	}()
+
+	parent := filepath.Dir(destDir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return errors.New("Unable to create directory %v for snapshot: %v", parent, err)
+	}
+	tmpDir, err := ioutil.TempDir(parent, "."+filepath.Base(destDir))
+	if err != nil {
+		return errors.New("Unable to create temp directory for snapshot: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	manifest := &snapshotManifest{
+		Name:            t.Name,
+		SQL:             t.TableOpts.SQL,
+		Resolution:      t.Resolution,
+		RetentionPeriod: t.RetentionPeriod,
+		MinFlushLatency: t.MinFlushLatency,
+		MaxFlushLatency: t.MaxFlushLatency,
+		Backfill:        t.Backfill,
+		PartitionBy:     t.PartitionBy,
+		MaxFileStores:   t.MaxFileStores,
+		Created:         t.db.clock.Now(),
+	}
+	for _, field := range t.getFields() {
+		manifest.Fields = append(manifest.Fields, field.String())
+	}
+	for i, filename := range files {
+		name := filepath.Base(filename)
+		if i > 0 || len(rs.fileStore.deltas) == len(files) {
+			// Deltas go in their own directory, as they do in the table's directory
+			name = filepath.Join(deltasDir, name)
+		}
+		if err := linkOrCopy(filename, filepath.Join(tmpDir, name)); err != nil {
+			return errors.New("Unable to add %v to snapshot: %v", filename, err)
+		}
+		manifest.Files = append(manifest.Files, name)
+	}
+	for _, filename := range []string{rs.tombstonesFile(), rs.fieldRenamesFile()} {
+		name, _ := filepath.Rel(rs.opts.dir, filename)
+		if err := linkOrCopy(filename, filepath.Join(tmpDir, name)); err != nil && !os.IsNotExist(err) {
+			return errors.New("Unable to add %v to snapshot: %v", filename, err)
+		}
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.New("Unable to encode snapshot manifest: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, snapshotManifestFilename), manifestBytes, 0644); err != nil {
+		return errors.New("Unable to write snapshot manifest: %v", err)
+	}
+	if err := os.Rename(tmpDir, destDir); err != nil {
+		return errors.New("Unable to move snapshot into place at %v: %v", destDir, err)
+	}
+	t.log.Debugf("Snapshotted %d files to %v", len(files), destDir)
+	return nil
+}
+
+// RestoreFrom creates a table from the snapshot in srcDir, using the schema
+// recorded in the snapshot. The table must not already exist in this database.
+// See TableOpts.RestoreFrom.
+func (db *DB) RestoreFrom(srcDir string) error {
+	if db.opts.ReadOnly {
+		return errors.New("Unable to restore snapshot into read-only database")
+	}
+	manifest, err := readSnapshotManifest(srcDir)
+	if err != nil {
+		return err
+	}
+	name := strings.ToLower(manifest.Name)
+	if db.getTable(name) != nil {
+		return errors.New("Table %v already exists", name)
+	}
+	return db.CreateTable(&TableOpts{
+		Name:            name,
+		SQL:             manifest.SQL,
+		RetentionPeriod: manifest.RetentionPeriod,
+		MinFlushLatency: manifest.MinFlushLatency,
+		MaxFlushLatency: manifest.MaxFlushLatency,
+		Backfill:        manifest.Backfill,
+		PartitionBy:     manifest.PartitionBy,
+		MaxFileStores:   manifest.MaxFileStores,
+		RestoreFrom:     srcDir,
+	})
+}
+
+// restoreSnapshot copies the files from the snapshot in srcDir into dir, after
+// making sure that the snapshot is compatible with this table. Nothing is
+// restored if dir already contains file stores.
+func (t *table) restoreSnapshot(srcDir string, dir string) error {
+	existing, err := listRegularFiles(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New("Unable to list contents of %v: %v", dir, err)
+	}
+	for _, file := range existing {
+		if isFileStoreName(file.Name()) {
+			t.log.Debugf("Table already has data, not restoring snapshot from %v", srcDir)
+			return nil
+		}
+	}
+
+	manifest, err := readSnapshotManifest(srcDir)
+	if err != nil {
+		return err
+	}
+	if manifest.Resolution != t.Resolution {
+		return errors.New("Snapshot in %v has resolution %v, incompatible with resolution %v of table %v", srcDir, manifest.Resolution, t.Resolution, t.Name)
+	}
+	// Extra fields in the table are fine, but data for fields that the table
+	// doesn't have would be lost
+	tableFields := make(map[string]bool)
+	for _, field := range t.getFields() {
+		tableFields[field.String()] = true
+	}
+	for _, field := range manifest.Fields {
+		if !tableFields[field] {
+			return errors.New("Snapshot in %v contains field %v that table %v doesn't have", srcDir, field, t.Name)
+		}
+	}
+	for _, name := range manifest.Files {
+		if version := t.versionFor(name); version > CurrentFileVersion {
+			return errors.New("Snapshot in %v contains file %v in version %d, newer than supported version %d", srcDir, name, version, CurrentFileVersion)
+		}
+	}
+
+	for _, name := range manifest.Files {
+		if err := linkOrCopy(filepath.Join(srcDir, name), filepath.Join(dir, name)); err != nil {
+			return errors.New("Unable to restore %v from snapshot in %v: %v", name, srcDir, err)
+		}
+	}
+	// Deleted keys and field renames are only there if the table had any
+	for _, name := range []string{filepath.Join(tombstonesDir, tombstonesFilename), filepath.Join(fieldRenamesDir, fieldRenamesFilename)} {
+		if err := linkOrCopy(filepath.Join(srcDir, name), filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return errors.New("Unable to restore %v from snapshot in %v: %v", name, srcDir, err)
+		}
+	}
+	t.log.Debugf("Restored %d files from snapshot in %v", len(manifest.Files), srcDir)
+	return nil
+}
+
+func readSnapshotManifest(srcDir string) (*snapshotManifest, error) {
+	filename := filepath.Join(srcDir, snapshotManifestFilename)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.New("Unable to read snapshot manifest %v: %v", filename, err)
+	}
+	manifest := &snapshotManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, errors.New("Unable to decode snapshot manifest %v: %v", filename, err)
+	}
+	return manifest, nil
+}
+
+// linkOrCopy hard-links src to dst, falling back to copying it if src can't be
+// linked (e.g. because it's on a different device). Errors are returned as is,
+// so callers can check for a missing src with os.IsNotExist.
+func linkOrCopy(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
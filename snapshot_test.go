@@ -0,0 +1,200 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotAndRestore(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "snapshotted",
+		RetentionPeriod: 1 * time.Hour,
+		MaxFileStores:   10,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("snapshotted")
+
+	insert := func(k string, v float64) {
+		_, err := db.InsertBatch("snapshotted", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": v}}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	totals := func(tbl *table) map[string]float64 {
+		field := tbl.getFields()[1]
+		result := make(map[string]float64)
+		_, err := tbl.iterate(context.Background(), tbl.getFields(), true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			result[key.Get("k").(string)], _ = vals[1].ValueAtTime(epoch, field.Expr, tbl.Resolution)
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	insert("a", 1)
+	tbl.forceFlush()
+	insert("b", 2)
+	tbl.forceFlush()
+	insert("c", 3)
+	if !assert.NoError(t, tbl.DeleteKeys(bytemap.New(map[string]interface{}{"k": "b"}))) {
+		return
+	}
+
+	tmpDir, err := ioutil.TempDir("", "zenodbsnapshot")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	snapshotDir := filepath.Join(tmpDir, "snapshot")
+	if !assert.NoError(t, db.SnapshotTable("snapshotted", snapshotDir)) {
+		return
+	}
+	assert.Error(t, tbl.Snapshot(snapshotDir), "Snapshotting to an existing directory should fail")
+	leftovers, _ := ioutil.ReadDir(tmpDir)
+	assert.Len(t, leftovers, 1, "Only the finished snapshot should remain")
+
+	// Changes after the snapshot, including compacting away the snapshotted
+	// files, don't affect it
+	insert("a", 10)
+	insert("d", 4)
+	_, err = tbl.PurgeDeleted(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl.rowStore.removeOldDeltas()
+
+	manifest, err := readSnapshotManifest(snapshotDir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "snapshotted", manifest.Name)
+	assert.Len(t, manifest.Files, 3, "Snapshot should include all files after flushing the memstore")
+	for _, name := range manifest.Files {
+		_, err := os.Stat(filepath.Join(snapshotDir, name))
+		assert.NoError(t, err, name)
+	}
+
+	db2, cleanup2 := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup2()
+	db2.clock.Advance(epoch)
+
+	err = db2.CreateTable(&TableOpts{
+		Name:            "incompatible",
+		RetentionPeriod: 1 * time.Hour,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1m)",
+		RestoreFrom:     snapshotDir,
+	})
+	assert.Error(t, err, "Restoring snapshot with different resolution should fail")
+
+	if !assert.NoError(t, db2.RestoreFrom(snapshotDir)) {
+		return
+	}
+	assert.Error(t, db2.RestoreFrom(snapshotDir), "Restoring an existing table should fail")
+	restored := db2.getTable("snapshotted")
+	if !assert.NotNil(t, restored) {
+		return
+	}
+	assert.Equal(t, 10, restored.MaxFileStores)
+	assert.Equal(t, map[string]float64{"a": 1, "c": 3}, totals(restored), "Restored table should have data as of the snapshot, without deleted keys")
+	assert.Equal(t, map[string]float64{"a": 11, "c": 3, "d": 4}, totals(tbl), "Original table should be unaffected")
+}
+
+func TestReadOnlyTable(t *testing.T) {
+	tableSQL := "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)"
+	writer, cleanup := newTestDB(t, &DBOpts{}, "source", tableSQL)
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	writer.clock.Advance(epoch)
+	writerTable := writer.getTable("source")
+	insertAndSnapshot := func(k string, v float64, snapshotDir string) {
+		_, err := writer.InsertBatch("source", []*Point{
+			{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": v}},
+		})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		if !assert.NoError(t, writerTable.Snapshot(snapshotDir)) {
+			t.FailNow()
+		}
+	}
+
+	tmpDir, err := ioutil.TempDir("", "zenodbreadonly")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	insertAndSnapshot("a", 1, filepath.Join(tmpDir, "first"))
+
+	reader, cleanupReader := newTestDB(t, &DBOpts{ReadReplicaPollInterval: 10 * time.Millisecond}, "", "")
+	defer cleanupReader()
+	reader.clock.Advance(epoch)
+	err = reader.CreateTable(&TableOpts{
+		Name:            "source",
+		RetentionPeriod: 1 * time.Hour,
+		SQL:             tableSQL,
+		ReadOnly:        true,
+		RestoreFrom:     filepath.Join(tmpDir, "first"),
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	readerTable := reader.getTable("source")
+	assert.False(t, readerTable.rowStore.opts.readReplica)
+	fields := readerTable.getFields()
+
+	read := func() map[string]float64 {
+		values := make(map[string]float64)
+		_, err := readerTable.iterate(context.Background(), fields, true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			val, _ := vals[1].ValueAtTime(epoch, fields[1].Expr, readerTable.Resolution)
+			values[key.Get("k").(string)] = val
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return values
+	}
+	assert.Equal(t, map[string]float64{"a": 1}, read(), "Read only table should serve data from restored snapshot")
+
+	_, err = reader.InsertBatch("source", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": "b"}, Vals: map[string]interface{}{"v": 2}}})
+	assert.Equal(t, ErrTableReadOnly, err, "Inserting into read only table should fail")
+	assert.Error(t, readerTable.Flush(), "Flushing read only table should fail")
+	assert.Error(t, readerTable.DeleteKeys(bytemap.New(map[string]interface{}{"k": "a"})), "Deleting from read only table should fail")
+	readerTable.forceFlush()
+
+	// Ship a newer snapshot
+	insertAndSnapshot("b", 2, filepath.Join(tmpDir, "second"))
+	manifest, err := readSnapshotManifest(filepath.Join(tmpDir, "second"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, name := range manifest.Files {
+		if !assert.NoError(t, linkOrCopy(filepath.Join(tmpDir, "second", name), filepath.Join(readerTable.rowStore.opts.dir, name))) {
+			return
+		}
+	}
+	var values map[string]float64
+	for i := 0; i < 500; i++ {
+		values = read()
+		if len(values) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, map[string]float64{"a": 1, "b": 2}, values, "Read only table should pick up newly shipped file stores")
+}
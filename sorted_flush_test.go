@@ -0,0 +1,61 @@
+package zenodb
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortedFlush(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{SortFlushes: true}, "sorted", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("sorted")
+	rs := tbl.rowStore
+
+	insert := func(from, to int) {
+		var points []*Point
+		// Insert in descending order with keys of varying lengths
+		for i := to - 1; i >= from; i-- {
+			points = append(points, &Point{TS: epoch, Dims: map[string]interface{}{"k": strings.Repeat("k", i%7+1) + fmt.Sprint(i)}, Vals: map[string]interface{}{"v": 1}})
+		}
+		_, err := db.InsertBatch("sorted", points)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	checkSorted := func(expectedRows int) {
+		rs.mx.RLock()
+		fs := rs.fileStore
+		rs.mx.RUnlock()
+		var keys [][]byte
+		_, err := fs.iterate(tbl.getFields(), nil, false, false, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			keys = append(keys, append([]byte(nil), key...))
+			return true, nil
+		})
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, keys, expectedRows)
+		for i := 1; i < len(keys); i++ {
+			assert.True(t, bytes.Compare(keys[i-1], keys[i]) < 0, "Keys should be in ascending order")
+		}
+	}
+
+	insert(0, 100)
+	tbl.forceFlush()
+	checkSorted(100)
+
+	// Second flush merges new rows with existing (raw) rows from the file store
+	insert(50, 150)
+	tbl.forceFlush()
+	checkSorted(150)
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -24,6 +25,8 @@ import (
 
 var (
 	log = golog.LoggerFor("zenodb.sql")
+
+	maxPeriodsPerSeriesRegex = regexp.MustCompile(`max_periods_per_series\s*=\s*(\d+)(\s+downsample)?`)
 )
 
 var (
@@ -35,6 +38,12 @@ var (
 	ErrShiftArity                    = errors.New("SHIFT requires two parameters, like SHIFT(SUM(b), '-1h')")
 	ErrCrosshiftArity                = errors.New("CROSSHIFT requires three parameters, like CROSSHIFT(SUM(b), '1h', '-1d')")
 	ErrCrosshiftZeroCutoffOrInterval = errors.New("CROSSHIFT cutoff and interval must be non-zero")
+	ErrZScoreArity                   = errors.New("ZSCORE requires two parameters, like ZSCORE(SUM(b), '1h')")
+	ErrCoalesceArity                 = errors.New("COALESCE requires at least one parameter, like COALESCE(SUM(b), SUM(a))")
+	ErrCountDistinctArity            = errors.New("COUNT_DISTINCT requires one or two parameters, like COUNT_DISTINCT(dim) or COUNT_DISTINCT(dim, 12)")
+	ErrCountDistinctDim              = errors.New("COUNT_DISTINCT must be applied to a dimension name, like COUNT_DISTINCT(user_id)")
+	ErrLabelArity                    = errors.New("LAST and FIRST require one or two parameters, like LAST(status) or LAST(status, 32)")
+	ErrLabelDim                      = errors.New("LAST and FIRST must be applied to a dimension name, like LAST(status)")
 	ErrCROSSTABArity                 = errors.New("CROSSTAB requires at least one argument")
 	ErrCROSSTABUnique                = errors.New("Only one CROSSTAB statement allowed per query")
 	ErrAggregateArity                = errors.New("Aggregate functions take only one parameter, like SUM(b)")
@@ -42,6 +51,8 @@ var (
 	ErrNestedFunctionCall            = errors.New("Nested function calls are not currently supported in SELECT")
 	ErrInvalidPeriod                 = errors.New("Please specify a period in the form period(5s) where 5s can be any valid Go duration expression")
 	ErrInvalidStride                 = errors.New("Please specify a stride in the form stride(5s) where 5s can be any valid Go duration expression")
+	ErrUnionNotAll                   = errors.New("Only UNION ALL is supported, like SELECT * FROM a UNION ALL SELECT * FROM b")
+	ErrUnsupportedStatement          = errors.New("Only SELECT statements are supported")
 )
 
 var aggregateFuncs = map[string]func(interface{}) expr.Expr{
@@ -175,11 +186,17 @@ type Query struct {
 	Resolution   time.Duration
 	Where        goexpr.Expr
 	WhereSQL     string
-	AsOf         time.Time
-	AsOfOffset   time.Duration
-	Until        time.Time
-	UntilOffset  time.Duration
-	Stride       time.Duration
+	// WhereEquals maps dimensions to the string values that the WHERE clause
+	// requires them to equal. It only includes dimensions constrained by
+	// top-level conditions like dim = 'a' or dim IN ('a', 'b'), so rows whose
+	// dimension doesn't match one of the values can never satisfy the WHERE. An
+	// empty list of values means that the conditions contradict each other.
+	WhereEquals map[string][]string
+	AsOf        time.Time
+	AsOfOffset  time.Duration
+	Until       time.Time
+	UntilOffset time.Duration
+	Stride      time.Duration
 	// GroupBy are the GroupBy expressions ordered alphabetically by name.
 	GroupBy    []core.GroupBy
 	GroupByAll bool
@@ -192,6 +209,20 @@ type Query struct {
 	Offset                int
 	Limit                 int
 	ForceFresh            bool
+	// MaxPeriodsPerSeries, if positive, limits the number of periods returned for
+	// each series. It is specified with a comment like
+	// "-- max_periods_per_series=100".
+	MaxPeriodsPerSeries int
+	// DownsampleToFit indicates that series with more than MaxPeriodsPerSeries
+	// periods should be downsampled to a coarser resolution rather than truncated
+	// to the most recent periods. It is specified by adding "downsample" to the
+	// max_periods_per_series comment.
+	DownsampleToFit bool
+	// UnionAll are the queries that follow this one in a UNION ALL, in the order
+	// in which they appear. The rest of this Query describes just the first
+	// SELECT. Each SELECT's ORDER BY, LIMIT and OFFSET only apply to that
+	// SELECT.
+	UnionAll []*Query
 }
 
 // TableFor returns the table in the FROM clause of this query
@@ -200,8 +231,17 @@ func TableFor(sql string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	stmt := parsed.(*sqlparser.Select)
-	return strings.ToLower(nodeToString(stmt.From[0])), nil
+	for {
+		switch stmt := parsed.(type) {
+		case *sqlparser.Select:
+			return strings.ToLower(nodeToString(stmt.From[0])), nil
+		case *sqlparser.Union:
+			// Use the table of the first SELECT
+			parsed = stmt.Left
+		default:
+			return "", ErrUnsupportedStatement
+		}
+	}
 }
 
 // Parse parses a SQL statement and returns a corresponding *Query object.
@@ -210,7 +250,32 @@ func Parse(sql string) (*Query, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error parsing %v: %v", sql, err)
 	}
-	return parse(parsed.(*sqlparser.Select))
+	return parseStatement(parsed)
+}
+
+func parseStatement(parsed sqlparser.Statement) (*Query, error) {
+	switch stmt := parsed.(type) {
+	case *sqlparser.Select:
+		return parse(stmt)
+	case *sqlparser.Union:
+		if strings.ToLower(stmt.Type) != "union all" {
+			return nil, ErrUnionNotAll
+		}
+		q, err := parseStatement(stmt.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := parseStatement(stmt.Right)
+		if err != nil {
+			return nil, err
+		}
+		q.UnionAll = append(q.UnionAll, right)
+		q.UnionAll = append(q.UnionAll, right.UnionAll...)
+		right.UnionAll = nil
+		return q, nil
+	default:
+		return nil, ErrUnsupportedStatement
+	}
 }
 
 func parse(stmt *sqlparser.Select) (*Query, error) {
@@ -280,6 +345,10 @@ func parse(stmt *sqlparser.Select) (*Query, error) {
 		if strings.Contains(string(comment), "force_fresh") {
 			q.ForceFresh = true
 		}
+		if match := maxPeriodsPerSeriesRegex.FindStringSubmatch(string(comment)); match != nil {
+			q.MaxPeriodsPerSeries, _ = strconv.Atoi(match[1])
+			q.DownsampleToFit = match[2] != ""
+		}
 	}
 	return q, nil
 }
@@ -491,9 +560,69 @@ func (q *Query) applyWhere(stmt *sqlparser.Select) error {
 	log.Tracef("Applying where: %v", where)
 	q.Where = where
 	q.WhereSQL = strings.TrimSpace(nodeToString(stmt.Where))
+	q.WhereEquals = make(map[string][]string)
+	applyWhereEquals(q.WhereEquals, stmt.Where.Expr)
 	return err
 }
 
+// applyWhereEquals walks the AND-ed conditions of the given expression and
+// records string equality constraints into whereEquals. Anything under an OR
+// or a NOT is ignored since it doesn't constrain all matching rows.
+func applyWhereEquals(whereEquals map[string][]string, _e sqlparser.Expr) {
+	switch e := _e.(type) {
+	case *sqlparser.AndExpr:
+		applyWhereEquals(whereEquals, e.Left)
+		applyWhereEquals(whereEquals, e.Right)
+	case *sqlparser.ParenBoolExpr:
+		applyWhereEquals(whereEquals, e.Expr)
+	case *sqlparser.ComparisonExpr:
+		col, ok := e.Left.(*sqlparser.ColName)
+		if !ok {
+			return
+		}
+		dim := strings.TrimSpace(strings.ToLower(string(col.Name)))
+		var values []string
+		switch strings.ToUpper(e.Operator) {
+		case "=":
+			val, ok := e.Right.(sqlparser.StrVal)
+			if !ok {
+				return
+			}
+			values = []string{string(val)}
+		case "IN":
+			tuple, ok := e.Right.(sqlparser.ValTuple)
+			if !ok {
+				return
+			}
+			for _, ve := range tuple {
+				val, ok := ve.(sqlparser.StrVal)
+				if !ok {
+					return
+				}
+				values = append(values, string(val))
+			}
+		default:
+			return
+		}
+		existing, found := whereEquals[dim]
+		if found {
+			// Dimension is already constrained, only values allowed by both
+			// conditions can match
+			var intersection []string
+			for _, val := range values {
+				for _, ex := range existing {
+					if val == ex {
+						intersection = append(intersection, val)
+						break
+					}
+				}
+			}
+			values = intersection
+		}
+		whereEquals[dim] = values
+	}
+}
+
 func (q *Query) applyTimeRange(stmt *sqlparser.Select) error {
 	if stmt.TimeRange.From != "" {
 		t, d, err := stringToTimeOrDuration(stmt.TimeRange.From)
@@ -681,6 +810,18 @@ func (f *fielded) exprFor(_e sqlparser.Expr, defaultToSum bool) (interface{}, er
 		if fname == "SHIFT" {
 			return f.shiftExprFor(e, fname, defaultToSum)
 		}
+		if fname == "ZSCORE" {
+			return f.zscoreExprFor(e, fname, defaultToSum)
+		}
+		if fname == "COALESCE" {
+			return f.coalesceExprFor(e, fname, defaultToSum)
+		}
+		if fname == "COUNT_DISTINCT" {
+			return f.countDistinctExprFor(e, fname, defaultToSum)
+		}
+		if fname == "LAST" || fname == "FIRST" {
+			return f.labelExprFor(e, fname, defaultToSum)
+		}
 		switch len(e.Exprs) {
 		case 1:
 			return f.unaryFuncExprFor(e, fname, defaultToSum)
@@ -871,6 +1012,105 @@ func (f *fielded) shiftExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum
 	return expr.SHIFT(valueEx, offset), nil
 }
 
+func (f *fielded) zscoreExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	if len(e.Exprs) != 2 {
+		return nil, ErrZScoreArity
+	}
+	_valueEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	valueEx, valueErr := f.exprFor(_valueEx.Expr, true)
+	if valueErr != nil {
+		return nil, valueErr
+	}
+	window, windowErr := nodeToDuration(e.Exprs[1])
+	if windowErr != nil {
+		return nil, windowErr
+	}
+	return expr.ZSCORE(valueEx, window), nil
+}
+
+func (f *fielded) coalesceExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	if len(e.Exprs) == 0 {
+		return nil, ErrCoalesceArity
+	}
+	wrapped := make([]interface{}, 0, len(e.Exprs))
+	for _, _valueEx := range e.Exprs {
+		valueEx, ok := _valueEx.(*sqlparser.NonStarExpr)
+		if !ok {
+			return nil, ErrWildcardNotAllowed
+		}
+		ex, err := f.exprFor(valueEx.Expr, true)
+		if err != nil {
+			return nil, err
+		}
+		wrapped = append(wrapped, ex)
+	}
+	return expr.COALESCE(wrapped...), nil
+}
+
+func (f *fielded) countDistinctExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	if len(e.Exprs) != 1 && len(e.Exprs) != 2 {
+		return nil, ErrCountDistinctArity
+	}
+	_dimEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	col, ok := _dimEx.Expr.(*sqlparser.ColName)
+	if !ok {
+		return nil, ErrCountDistinctDim
+	}
+	name := strings.ToLower(string(col.Name))
+	existing, found := f.fieldsMap[name]
+	if found && expr.IsCountDistinct(existing.Expr) {
+		// existing field is already a COUNT_DISTINCT, just use it
+		return existing.Expr, nil
+	}
+	precision := int64(expr.DefaultHLLPrecision)
+	if len(e.Exprs) == 2 {
+		var err error
+		precision, err = nodeToInt(e.Exprs[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expr.COUNT_DISTINCT(name, int(precision)), nil
+}
+
+func (f *fielded) labelExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
+	if len(e.Exprs) != 1 && len(e.Exprs) != 2 {
+		return nil, ErrLabelArity
+	}
+	_dimEx, ok := e.Exprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return nil, ErrWildcardNotAllowed
+	}
+	col, ok := _dimEx.Expr.(*sqlparser.ColName)
+	if !ok {
+		return nil, ErrLabelDim
+	}
+	name := strings.ToLower(string(col.Name))
+	existing, found := f.fieldsMap[name]
+	if found && expr.IsLabel(existing.Expr) && strings.HasPrefix(existing.Expr.String(), fname+"(") {
+		// existing field is already the same kind of label, just use it
+		return existing.Expr, nil
+	}
+	maxLength := int64(expr.DefaultLabelLength)
+	if len(e.Exprs) == 2 {
+		var err error
+		maxLength, err = nodeToInt(e.Exprs[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fname == "LAST" {
+		return expr.LAST(name, int(maxLength)), nil
+	}
+	return expr.FIRST(name, int(maxLength)), nil
+}
+
 func (f *fielded) unaryFuncExprFor(e *sqlparser.FuncExpr, fname string, defaultToSum bool) (interface{}, error) {
 	var fn func(interface{}) (expr.Expr, error)
 	_fn, ok := aggregateFuncs[fname]
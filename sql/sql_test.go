@@ -57,6 +57,8 @@ SELECT -- force_fresh
 	IF(dim = 'test2', _) AS present,
 	SHIFT(SUM(s), '1h') AS shifted,
 	CROSSHIFT(cs, '-1w', '1d'),
+	ZSCORE(s, '1h') AS zs,
+	COALESCE(s_new, s) AS stitched,
 	LN(l) AS log1,
 	LOG2(l) AS log2,
 	LOG10(l) AS log3,
@@ -118,7 +120,7 @@ LIMIT 100, 10
 	if !assert.NoError(t, err) {
 		return
 	}
-	numFields := 28
+	numFields := 30
 	assert.Len(t, fieldsNoHaving, numFields-1)
 	if assert.Len(t, fields, numFields) {
 		idx := 0
@@ -223,6 +225,18 @@ LIMIT 100, 10
 			assert.Equal(t, expected, actual)
 		}
 
+		field = fields[idx]
+		idx++
+		expected = core.NewField("zs", ZSCORE(SUM("s"), 1*time.Hour)).String()
+		actual = field.String()
+		assert.Equal(t, expected, actual)
+
+		field = fields[idx]
+		idx++
+		expected = core.NewField("stitched", COALESCE(SUM("s_new"), SUM("s"))).String()
+		actual = field.String()
+		assert.Equal(t, expected, actual)
+
 		unaryMath := func(name string, wrapped interface{}) Expr {
 			result, _ := UnaryMath(name, wrapped)
 			return result
@@ -409,6 +423,46 @@ GROUP BY A, period('10s')
 	assert.False(t, q.ForceFresh)
 }
 
+func TestMaxPeriodsPerSeries(t *testing.T) {
+	q, err := Parse("SELECT -- max_periods_per_series=100\n* FROM Table_A")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 100, q.MaxPeriodsPerSeries)
+		assert.False(t, q.DownsampleToFit)
+	}
+
+	q, err = Parse("SELECT -- max_periods_per_series=50 downsample\n* FROM Table_A")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 50, q.MaxPeriodsPerSeries)
+		assert.True(t, q.DownsampleToFit)
+	}
+
+	q, err = Parse("SELECT * FROM Table_A")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0, q.MaxPeriodsPerSeries)
+	}
+}
+
+func TestUnionAll(t *testing.T) {
+	q, err := Parse("SELECT SUM(v) AS v FROM table_a GROUP BY k UNION ALL SELECT SUM(v) AS v FROM table_b GROUP BY k UNION ALL SELECT SUM(v) AS v FROM table_c GROUP BY k")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "table_a", q.From)
+	if assert.Len(t, q.UnionAll, 2) {
+		assert.Equal(t, "table_b", q.UnionAll[0].From)
+		assert.Equal(t, "table_c", q.UnionAll[1].From)
+		assert.Empty(t, q.UnionAll[0].UnionAll)
+	}
+
+	table, err := TableFor("SELECT * FROM table_a UNION ALL SELECT * FROM table_b")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "table_a", table)
+	}
+
+	_, err = Parse("SELECT * FROM table_a UNION SELECT * FROM table_b")
+	assert.Equal(t, ErrUnionNotAll, err)
+}
+
 func TestSQLDefaults(t *testing.T) {
 	q, err := Parse(`
 SELECT _
@@ -425,6 +479,85 @@ FROM Table_A
 	assert.True(t, q.GroupByAll)
 }
 
+func TestCountDistinct(t *testing.T) {
+	usersField := core.NewField("users", COUNT_DISTINCT("user_id", 10))
+	q, err := Parse(`
+SELECT
+	COUNT_DISTINCT(User_Id) AS u_default,
+	COUNT_DISTINCT(ip, 14) AS ips,
+	COUNT_DISTINCT(users) AS users_again
+FROM Table_A
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(core.Fields{usersField})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, fields, 3) {
+		assert.Equal(t, core.NewField("u_default", COUNT_DISTINCT("user_id", DefaultHLLPrecision)).String(), fields[0].String())
+		assert.Equal(t, core.NewField("ips", COUNT_DISTINCT("ip", 14)).String(), fields[1].String())
+		assert.Equal(t, core.NewField("users_again", usersField.Expr).String(), fields[2].String())
+	}
+
+	q, err = Parse(`SELECT COUNT_DISTINCT(a, 10, 2) AS bad FROM Table_A`)
+	if assert.NoError(t, err) {
+		_, err = q.Fields.Get(nil)
+		assert.Equal(t, ErrCountDistinctArity, err)
+	}
+}
+
+func TestLastAndFirst(t *testing.T) {
+	q, err := Parse(`
+SELECT
+	LAST(Status) AS status,
+	FIRST(status, 16) AS first_status
+FROM Table_A
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fields, err := q.Fields.Get(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	if assert.Len(t, fields, 2) {
+		assert.Equal(t, core.NewField("status", LAST("status", DefaultLabelLength)).String(), fields[0].String())
+		assert.Equal(t, core.NewField("first_status", FIRST("status", 16)).String(), fields[1].String())
+	}
+
+	q, err = Parse(`SELECT LAST(a, 10, 2) AS bad FROM Table_A`)
+	if assert.NoError(t, err) {
+		_, err = q.Fields.Get(nil)
+		assert.Equal(t, ErrLabelArity, err)
+	}
+}
+
+func TestWhereEquals(t *testing.T) {
+	q, err := Parse(`
+SELECT *
+FROM Table_A
+WHERE
+	Dim_A = 'a' AND
+	(dim_b IN ('b1', 'b2', 'b3') AND dim_b IN ('b2', 'b3', 'b4')) AND
+	dim_c IN ('c1', 5) AND
+	dim_d > 'd' AND
+	dim_e = 5 AND
+	(dim_f = 'f1' OR dim_f = 'f2') AND
+	NOT dim_g = 'g' AND
+	dim_h = 'h1' AND dim_h = 'h2'
+`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string][]string{
+		"dim_a": {"a"},
+		"dim_b": {"b2", "b3"},
+		"dim_h": nil,
+	}, q.WhereEquals)
+}
+
 func TestParseIt(t *testing.T) {
 	_, err := Parse(`select * from TableA  group by concat('_', ct1, concat('|', ct2)) as _crosstab`)
 	assert.NoError(t, err)
@@ -0,0 +1,154 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/vtime"
+	"github.com/getlantern/zenodb/common"
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+// OpenStandaloneSource opens the file stores in dir, which can be a table's
+// directory or a snapshot (see table.Snapshot), as a source of flattened rows
+// without a running DB. schema lists the fields to read, in the order in which
+// they're reported, and resolution is the resolution of the data in the files.
+// Fields in the files that aren't in schema are skipped. Nothing is truncated
+// based on retention, so all data in the files is reported, except for keys
+// that were deleted. The files must not be removed while iterating.
+//
+// This is meant for batch jobs and debugging tools that work with archived
+// data. Files are read with the same logic as in a DB, including merging
+// deltas and mapping renamed fields.
+func OpenStandaloneSource(dir string, schema core.Fields, resolution time.Duration) (core.FlatRowSource, error) {
+	if len(schema) == 0 {
+		return nil, errors.New("Please specify the fields to read from %v", dir)
+	}
+	if resolution <= 0 {
+		return nil, errors.New("Please specify a resolution for the data in %v", dir)
+	}
+	files, err := listRegularFiles(dir)
+	if err != nil {
+		return nil, errors.New("Unable to list contents of %v: %v", dir, err)
+	}
+	base := ""
+	// files are sorted by name, so the last file store is the newest
+	for i := len(files) - 1; i >= 0; i-- {
+		if isFileStoreName(files[i].Name()) {
+			base = filepath.Join(dir, files[i].Name())
+			break
+		}
+	}
+	deltas, err := liveDeltas(dir, base)
+	if err != nil {
+		return nil, err
+	}
+	if base == "" && len(deltas) == 0 {
+		return nil, errors.New("No file stores found in %v", dir)
+	}
+
+	db := &DB{
+		log:   golog.LoggerFor("zenodb.standalone"),
+		opts:  &DBOpts{Dir: dir, ScanParallelism: runtime.NumCPU()},
+		clock: vtime.RealClock,
+	}
+	t := &table{
+		TableOpts: &TableOpts{Name: filepath.Base(dir)},
+		fields:    schema,
+		db:        db,
+		log:       db.log,
+	}
+	t.Resolution = resolution
+	// The row store is only there to hold the deleted keys and field renames
+	// that were persisted along with the files
+	rs := &rowStore{t: t, opts: &rowStoreOptions{dir: dir, readOnly: true}}
+	if rs.tombstones, err = rs.readTombstones(); err != nil {
+		return nil, err
+	}
+	if rs.fieldRenames, err = rs.readFieldRenames(); err != nil {
+		return nil, err
+	}
+	source := &standaloneSource{
+		dir:   dir,
+		rs:    rs,
+		fs:    &fileStore{t: t, rs: rs, fields: schema, filename: base, deltas: deltas},
+		until: db.clock.Now(),
+	}
+	return core.Flatten(source), nil
+}
+
+// standaloneSource is a core.RowSource that reads a fixed set of file stores
+// outside of a DB.
+type standaloneSource struct {
+	dir   string
+	rs    *rowStore
+	fs    *fileStore
+	until time.Time
+}
+
+func (s *standaloneSource) GetGroupBy() []core.GroupBy {
+	return nil
+}
+
+func (s *standaloneSource) GetResolution() time.Duration {
+	return s.fs.t.Resolution
+}
+
+// GetAsOf returns the zero time, since nothing is truncated.
+func (s *standaloneSource) GetAsOf() time.Time {
+	return time.Time{}
+}
+
+// GetUntil returns the time at which the source was opened.
+func (s *standaloneSource) GetUntil() time.Time {
+	return s.until
+}
+
+func (s *standaloneSource) String() string {
+	return fmt.Sprintf("standalone (%v)", s.dir)
+}
+
+func (s *standaloneSource) Iterate(ctx context.Context, onFields core.OnFields, onRow core.OnRow) (interface{}, error) {
+	fields := s.fs.fields
+	if err := onFields(fields); err != nil {
+		return nil, err
+	}
+
+	var rowsScanned, bytesScanned int64
+	start := time.Now()
+	ctx, scanned := withScanStats(ctx)
+	highWaterMarks, err := s.fs.iterateWithContext(ctx, fields, nil, false, false, time.Time{}, func(key bytemap.ByteMap, vals []encoding.Sequence, _ []byte) (bool, error) {
+		if s.rs.tombstones[string(key)] {
+			return true, nil
+		}
+		rowsScanned++
+		bytesScanned += int64(len(key))
+		for _, val := range vals {
+			bytesScanned += int64(len(val))
+		}
+		return onRow(key, vals)
+	})
+	numSuccessfulPartitions := 0
+	if err == nil {
+		numSuccessfulPartitions = 1
+	}
+	filesRead, bytesDecompressed := scanned.get()
+	return &common.QueryStats{
+		NumPartitions:           1,
+		NumSuccessfulPartitions: numSuccessfulPartitions,
+		LowestHighWaterMark:     common.TimeToMillis(highWaterMarks.LowestTS()),
+		HighestHighWaterMark:    common.TimeToMillis(highWaterMarks.HighestTS()),
+		RowsScanned:             rowsScanned,
+		BytesScanned:            bytesScanned,
+		BytesDecompressed:       bytesDecompressed,
+		FilesRead:               filesRead,
+		Elapsed:                 time.Since(start),
+	}, err
+}
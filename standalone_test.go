@@ -0,0 +1,82 @@
+package zenodb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStandaloneSource(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "", "")
+	defer cleanup()
+	err := db.CreateTable(&TableOpts{
+		Name:            "archived",
+		RetentionPeriod: 1 * time.Hour,
+		MaxFileStores:   10,
+		SQL:             "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("archived")
+	insert := func(k string, v float64) {
+		_, err := db.InsertBatch("archived", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": v}}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	insert("a", 1)
+	insert("b", 2)
+	tbl.forceFlush()
+	insert("a", 10)
+	insert("c", 3)
+	if !assert.NoError(t, tbl.DeleteKeys(bytemap.New(map[string]interface{}{"k": "c"}))) {
+		return
+	}
+
+	tmpDir, err := ioutil.TempDir("", "zenodbstandalone")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	_, err = OpenStandaloneSource(tmpDir, tbl.getFields(), tbl.Resolution)
+	assert.Error(t, err, "Directory without file stores should fail")
+
+	snapshotDir := filepath.Join(tmpDir, "snapshot")
+	if !assert.NoError(t, tbl.Snapshot(snapshotDir)) {
+		return
+	}
+	// Close the database to make sure that the source doesn't depend on it
+	db.Close()
+
+	source, err := OpenStandaloneSource(snapshotDir, tbl.getFields(), tbl.Resolution)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, tbl.Resolution, source.GetResolution())
+	var fieldNames []string
+	results := make(map[string]float64)
+	_, err = source.Iterate(context.Background(), func(fields core.Fields) error {
+		fieldNames = fields.Names()
+		return nil
+	}, func(row *core.FlatRow) (bool, error) {
+		if row.TS == epoch.UnixNano() {
+			results[row.Key.Get("k").(string)] = row.Values[1]
+		}
+		return true, nil
+	})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"_points", "v"}, fieldNames)
+		assert.Equal(t, map[string]float64{"a": 11, "b": 2}, results, "Deltas should have been merged and deleted keys skipped")
+	}
+}
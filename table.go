@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/bytemap"
@@ -29,6 +30,81 @@ type TableStats struct {
 	InsertedPoints int64
 	DroppedPoints  int64
 	ExpiredValues  int64
+	// LatePoints is the number of points that were dropped because they were
+	// older than allowed by TableOpts.MaxLateness.
+	LatePoints int64
+	// RejectedPoints is the number of points that were dropped because
+	// TableOpts.InterceptInsert returned an error for them.
+	RejectedPoints int64
+	// PendingMoves is the number of flushed files and offset updates that are
+	// waiting to be moved from DBOpts.FlushScratchDir to durable storage.
+	PendingMoves int64
+	// PendingMoveBytes is the size of the flushed files counted in
+	// PendingMoves.
+	PendingMoveBytes int64
+	// PendingFlushes is the number of forced flushes that have been requested
+	// but not yet completed. Flushes for a table are processed one at a time, so
+	// a growing value indicates that flushing can't keep up with demand.
+	PendingFlushes int64
+	// InsertQueueDepth is the number of inserts and batches waiting to be
+	// applied to the memstore. A value near TableOpts.InsertQueueSize indicates
+	// that the table can't keep up with inserts.
+	InsertQueueDepth int64
+	// ThrottledPoints is the number of points that were dropped because they
+	// exceeded TableOpts.MaxInsertsPerSecond (see TableOpts.ShedExcessInserts).
+	ThrottledPoints int64
+	// InsertRate is the number of points per second recently inserted into the
+	// table.
+	InsertRate float64
+	// ScanRate is the number of bytes per second recently scanned from the table
+	// by queries.
+	ScanRate float64
+	// Scans is the number of scans of the table's data performed on behalf of
+	// iterations (e.g. queries).
+	Scans int64
+	// CoalescedIterations is the number of iterations that shared a scan with
+	// an earlier iteration rather than requiring their own (see
+	// DBOpts.IterationCoalesceInterval).
+	CoalescedIterations int64
+	// RowStore contains statistics about the table's memstore and flushes.
+	RowStore RowStoreStats
+}
+
+// RowStoreStats presents statistics about a table's memstore, flushes and file
+// store.
+type RowStoreStats struct {
+	// MemStoreBytes is the current size of the memstore.
+	MemStoreBytes int64
+	// MemStores is the number of memstores held in memory. The memstore is
+	// replaced by a new one once it has been flushed, so this is 1 except on
+	// read replicas, which don't have memstores.
+	MemStores int
+	// Flushes is the number of successful flushes (since the database process
+	// was started).
+	Flushes int64
+	// LastFlushDuration is how long the most recent flush took.
+	LastFlushDuration time.Duration
+	// LastFlushFinished is when the most recent flush finished.
+	LastFlushFinished time.Time
+	// LastFlushBytes is the size on disk of the file written by the most recent
+	// flush.
+	LastFlushBytes int64
+	// FlushedBytes is the total size on disk of all files written by successful
+	// flushes.
+	FlushedBytes int64
+	// FlushFailures is the number of attempts to write a flush that failed,
+	// including ones that were retried successfully afterwards.
+	FlushFailures int64
+	// LastFlushError is the error with which the most recent flush gave up
+	// (after retrying), empty if the most recent flush succeeded.
+	LastFlushError string
+	// FlushInterval is how long the table currently waits between flushes, as
+	// determined by TableOpts' TargetFlushInterval and MaxMemStoreBytes and the
+	// recent ingestion rate.
+	FlushInterval time.Duration
+	// BytesOnDisk is the size on disk of the current file store, including any
+	// deltas.
+	BytesOnDisk int64
 }
 
 // TableOpts configures a table.
@@ -43,9 +119,57 @@ type TableOpts struct {
 	// MaxFlushLatency sets an upper bound on how long to wait before flushing the
 	// memstore to disk.
 	MaxFlushLatency time.Duration
+	// TargetFlushInterval is how long to wait between flushes, bounded by
+	// MinFlushLatency and MaxFlushLatency. If 0, the wait is ten times the
+	// duration of the last flush.
+	TargetFlushInterval time.Duration
+	// MaxMemStoreBytes, if positive, limits how big the memstore should get. The
+	// table flushes sooner than TargetFlushInterval whenever the recent
+	// ingestion rate would otherwise grow the memstore beyond this size, and
+	// flushes right away once it does (though never more often than
+	// MinFlushLatency).
+	MaxMemStoreBytes int
+	// InitialMemStoreCapacity is the number of keys for which to preallocate
+	// space in new memstores. If 0, new memstores are sized based on the number
+	// of keys in recently flushed memstores.
+	InitialMemStoreCapacity int
 	// RetentionPeriod limits how long data is kept in the table (based on the
 	// timestamp of the data itself).
 	RetentionPeriod time.Duration
+	// FieldRetentions overrides the RetentionPeriod for individual fields,
+	// keyed by field name, so that for example raw high resolution fields can
+	// expire sooner than aggregates. Only retentions shorter than the
+	// RetentionPeriod have an effect. Values of fields past their retention are
+	// dropped on flush and omitted from queries, though points past a field's
+	// retention are still inserted as long as they're within the
+	// RetentionPeriod.
+	FieldRetentions map[string]time.Duration
+	// RetentionInterval, if positive, is how frequently to rewrite the table's
+	// files in order to drop data that has fallen out of the RetentionPeriod.
+	// Otherwise, expired data is only dropped from disk as a side effect of
+	// flushes, so the files of tables that stop receiving inserts never shrink.
+	// Each rewrite reads and writes all of the table's data.
+	RetentionInterval time.Duration
+	// MaxLateness, if positive, limits how far behind the current time points
+	// may be when they arrive. Points that are older than that are dropped
+	// (InsertBatch rejects them with ErrPointTooLate) and counted in
+	// TableStats.LatePoints. Points within MaxLateness (and within the
+	// RetentionPeriod) are always accepted, even if their period has already
+	// been flushed. Such late points show up right away in queries that include
+	// the memstore, and in queries that only read files once the next flush
+	// has merged them into the table's files. Since the current time is based
+	// on the data, this is most useful with DBOpts.VirtualTime.
+	MaxLateness time.Duration
+	// InterceptInsert, if specified, is called for every point right before
+	// it's added to the memstore, with the point's key (its dimensions as
+	// grouped by the table) and values. If it returns an error, the point is
+	// dropped and counted in TableStats.RejectedPoints. Otherwise, the returned
+	// key and values are inserted in place of the original ones, which allows validating and
+	// enriching points (for example adding derived dimensions). Points read
+	// from the WAL after a restart pass through InterceptInsert again. It's
+	// called from a single goroutine for inserts from the WAL, but may be
+	// called concurrently for batches inserted with InsertBatch.
+	InterceptInsert func(key bytemap.ByteMap, vals encoding.TSParams) (bytemap.ByteMap, encoding.TSParams, error)
 	// Backfill limits how far back to grab data from the WAL when first creating
 	// a table. If 0, backfill is limited only by the RetentionPeriod.
 	Backfill time.Duration
@@ -53,6 +177,85 @@ type TableOpts struct {
 	// dimensions to use in partitioning data. If unspecified, all dimensions are
 	// used for partitioning.
 	PartitionBy []string
+	// RollupBy, if specified, causes each flush to also write a rollup of the
+	// table's data aggregated by these dimensions. Queries that group by exactly
+	// these dimensions, don't filter and don't include the memstore read the
+	// rollup instead of scanning all keys.
+	RollupBy []string
+	// MaxFileStores, if greater than 1, enables incremental flushes, which write
+	// just the memstore to a new file rather than rewriting all of the table's
+	// data. Once there are more than MaxFileStores files, a background
+	// compaction merges the oldest ones. Queries have to merge the files that
+	// haven't been compacted in memory.
+	MaxFileStores int
+	// MinCompactionBytes is the minimum size of the files merged by a
+	// compaction (see MaxFileStores).
+	MinCompactionBytes int64
+	// Codec is the codec used to compress new file stores, defaults to
+	// SnappyFileCodec. Changing it only affects newly written files, existing
+	// files are read using whichever codec they were written with.
+	Codec FileCodec
+	// BloomFilterFalsePositiveRate is the false positive rate of the bloom
+	// filters of keys that are stored with new file stores, which allow point
+	// lookups to skip files that don't contain a key. Lower rates make for
+	// larger filters. Defaults to DefaultBloomFilterFalsePositiveRate, set to a
+	// negative value to disable bloom filters.
+	BloomFilterFalsePositiveRate float64
+	// IndexBlockRows is the number of rows in each block of sorted file stores.
+	// Each block is compressed independently and the footer indexes the first
+	// key of each block, so that looking up a key only decompresses the block
+	// that may contain it. Smaller blocks make for faster lookups at the cost
+	// of worse compression and a larger index. Defaults to 1000. Changing it
+	// only affects newly written files.
+	IndexBlockRows int
+	// DescendingKeys, if true, sorts the rows of sorted flushes in descending
+	// rather than ascending key order. The order is recorded in each file, and
+	// opening the table fails if it has sorted files in the other order. To
+	// change the order of an existing table, first rewrite its files unsorted
+	// with DB.ReencodeTable while it still uses the old order.
+	DescendingKeys bool
+	// InsertQueueSize is how many inserts (or batches passed to TryInsertBatch)
+	// can be queued for the table's memstore before inserting blocks or
+	// TryInsertBatch fails with ErrInsertQueueFull. Defaults to
+	// DefaultInsertQueueSize, set to a negative value to disable queueing.
+	// Batches passed to InsertBatch aren't queued, they're applied directly by
+	// the caller.
+	//
+	// Queued inserts are applied in the order in which they were queued, and a
+	// forced flush includes everything queued before it was requested. However,
+	// inserts from the WAL and batches are applied separately, so their relative
+	// order isn't guaranteed, and batches queued with TryInsertBatch only
+	// become visible to queries once they've been applied.
+	InsertQueueSize int
+	// MaxInsertsPerSecond, if positive, limits how many points per second are
+	// inserted into the table, both from the WAL and with InsertBatch. Inserts
+	// beyond the limit wait until they're within the limit, unless
+	// ShedExcessInserts is set. TryInsertBatch never waits and instead fails
+	// with ErrRateLimited.
+	MaxInsertsPerSecond int64
+	// ShedExcessInserts, if true, drops points that exceed MaxInsertsPerSecond
+	// rather than waiting to insert them. InsertBatch rejects such points with
+	// ErrRateLimited. Dropped points are counted in TableStats.ThrottledPoints.
+	ShedExcessInserts bool
+	// MaxScanBytesPerSecond, if positive, limits how many bytes of keys and
+	// values per second queries may scan from the table, across all queries.
+	// Queries that exceed the limit are slowed down, but can still be cancelled
+	// while waiting.
+	MaxScanBytesPerSecond int64
+	// RestoreFrom, if set, is a directory containing a snapshot written by
+	// Snapshot from which to initialize the table's data. It's only used if the
+	// table doesn't have any data of its own yet, and creating the table fails if
+	// the snapshot's resolution or fields are incompatible with the table. The
+	// restored table resumes reading its stream from the WAL offsets recorded in
+	// the snapshot, so restoring into the database from which the snapshot was
+	// taken only replays what arrived after the snapshot.
+	RestoreFrom string
+	// ReadOnly, if true, opens the table for querying only. The table serves
+	// queries from the file stores in its directory (for example snapshots
+	// shipped from another database, see Snapshot) and switches to newer file
+	// stores as they appear. It doesn't read from the WAL, never flushes or
+	// removes files, and inserting into it fails with ErrTableReadOnly.
+	ReadOnly bool
 	// SQL is the SELECT query that determines the fields, filtering and input
 	// source for this table.
 	SQL string
@@ -61,12 +264,16 @@ type TableOpts struct {
 	// from which other tables can select.
 	Virtual      bool
 	dependencyOf []*TableOpts
+	// rollupOf is the name of the base table if this table is a rollup created
+	// with CreateRollup
+	rollupOf string
 }
 
 type table struct {
 	*TableOpts
 	sql.Query
 	fields              core.Fields
+	droppedFields       map[string]bool
 	db                  *DB
 	rowStore            *rowStore
 	log                 golog.Logger
@@ -80,6 +287,19 @@ type table struct {
 	highWaterMarkDisk   int64
 	highWaterMarkMemory int64
 	highWaterMarkMx     sync.RWMutex
+	// rollups are the rollups of this table, coarsest first
+	rollups   []*table
+	rollupsMx sync.RWMutex
+	// rolledUp is set to 1 (atomically) once a rollup table has been built from
+	// its base table
+	rolledUp int32
+	// activeScans is the number of coalesced iterations of this table that have
+	// been dispatched but not yet finished (accessed atomically)
+	activeScans int32
+	// insertLimiter and scanLimiter enforce MaxInsertsPerSecond and
+	// MaxScanBytesPerSecond and measure the current rates
+	insertLimiter *rateLimiter
+	scanLimiter   *rateLimiter
 }
 
 type iteration struct {
@@ -87,6 +307,7 @@ type iteration struct {
 	ctx             context.Context
 	outFields       core.Fields
 	includeMemStore bool
+	truncateBefore  time.Time
 	onValue         func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)
 	fieldMappings   map[int]int
 	offsetsCh       chan common.OffsetsBySource
@@ -119,15 +340,22 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 			opts.MaxFlushLatency = time.Duration(math.MaxInt64)
 			db.log.Debug("MaxFlushLatency disabled")
 		}
+		if opts.InsertQueueSize == 0 {
+			opts.InsertQueueSize = DefaultInsertQueueSize
+		} else if opts.InsertQueueSize < 0 {
+			opts.InsertQueueSize = 0
+		}
 	}
 	opts.Name = strings.ToLower(opts.Name)
 
 	t := &table{
-		TableOpts: opts,
-		Query:     *q,
-		fields:    fields,
-		db:        db,
-		log:       golog.LoggerFor(fmt.Sprintf("%v.%v", db.opts.logLabel(), opts.Name)),
+		TableOpts:     opts,
+		Query:         *q,
+		fields:        fields,
+		db:            db,
+		log:           golog.LoggerFor(fmt.Sprintf("%v.%v", db.opts.logLabel(), opts.Name)),
+		insertLimiter: newRateLimiter(opts.MaxInsertsPerSecond),
+		scanLimiter:   newRateLimiter(opts.MaxScanBytesPerSecond),
 	}
 
 	t.log.Debugf("Fields will be: %v", fields)
@@ -149,14 +377,45 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 		var rsErr error
 		var offsetsBySource common.OffsetsBySource
 		if !t.db.opts.Passthrough {
-			t.rowStore, offsetsBySource, rsErr = t.openRowStore(&rowStoreOptions{
-				dir:             filepath.Join(db.opts.Dir, t.Name),
-				minFlushLatency: t.MinFlushLatency,
-				maxFlushLatency: t.MaxFlushLatency,
-			})
+			rsOpts := &rowStoreOptions{
+				dir:                      filepath.Join(db.opts.Dir, t.Name),
+				minFlushLatency:          t.MinFlushLatency,
+				maxFlushLatency:          t.MaxFlushLatency,
+				targetFlushInterval:      t.TargetFlushInterval,
+				maxMemStoreBytes:         t.MaxMemStoreBytes,
+				initialMemStoreCapacity:  t.InitialMemStoreCapacity,
+				retentionInterval:        t.RetentionInterval,
+				readOnly:                 t.ReadOnly || db.opts.ReadReplica,
+				readReplica:              db.opts.ReadReplica,
+				pollInterval:             db.opts.ReadReplicaPollInterval,
+				oldFileRetention:         db.opts.OldFileStoreRetention,
+				skipDirLock:              db.opts.DisableDirLocks,
+				skipChecksumVerification: db.opts.SkipChecksumVerification,
+				maxFileStores:            t.MaxFileStores,
+				minCompactionBytes:       t.MinCompactionBytes,
+				codec:                    t.Codec,
+				bloomFalsePositiveRate:   t.BloomFilterFalsePositiveRate,
+				indexBlockRows:           t.IndexBlockRows,
+				insertQueueSize:          t.InsertQueueSize,
+				restoreFrom:              t.RestoreFrom,
+			}
+			if t.InterceptInsert != nil {
+				rsOpts.interceptInsert = t.interceptInsert
+			}
+			if t.DescendingKeys {
+				rsOpts.keyOrder = keyOrderDescending
+			}
+			if db.opts.FlushScratchDir != "" {
+				rsOpts.scratchDir = filepath.Join(db.opts.FlushScratchDir, t.Name)
+			}
+			t.rowStore, offsetsBySource, rsErr = t.openRowStore(rsOpts)
 			if rsErr != nil {
 				return rsErr
 			}
+			if rsOpts.readOnly {
+				// Read only tables only serve queries from what's already on disk
+				return nil
+			}
 
 			// Don't bother looking further back than table's retention period
 			offsetByRetentionPeriod := wal.NewOffsetForTS(t.truncateBefore())
@@ -171,6 +430,11 @@ func (db *DB) CreateTable(opts *TableOpts) error {
 			t.db.Go(t.logHighWaterMark)
 		}
 
+		if t.rollupOf != "" {
+			// Rollups are built from their base table rather than the WAL
+			t.rowStore.Go(t.maintainRollup)
+			return nil
+		}
 		if t.db.opts.Follow != nil {
 			t.startFollowing(offsetsBySource)
 			return nil
@@ -191,6 +455,34 @@ func (t *table) Alter(opts *TableOpts) error {
 	return nil
 }
 
+// AddField adds the given field to this table without affecting existing
+// fields. Data that was stored before the field was added has no values for
+// it, so queries see empty sequences for the new field until new data arrives.
+// The memstore is flushed right away so that new file stores include the new
+// field, and all data inserted after AddField returns includes it.
+//
+// Like Alter, this only changes the running table. To keep the field across
+// restarts, add it to the table's SQL in the schema as well.
+func (t *table) AddField(field core.Field) error {
+	if field.Name == "" {
+		return errors.New("Please specify a name for the new field")
+	}
+	if field.Expr == nil {
+		return errors.New("Please specify an expression for field %v", field.Name)
+	}
+	fields := t.getFields()
+	for _, existing := range fields {
+		if existing.Name == field.Name {
+			return errors.New("Table %v already has a field named %v", t.Name, field.Name)
+		}
+	}
+	t.fieldsMutex.Lock()
+	delete(t.droppedFields, field.Name)
+	t.fieldsMutex.Unlock()
+	t.updateFields(append(fields, field))
+	return nil
+}
+
 func (db *DB) queryAndFields(opts *TableOpts) (q *sql.Query, fields core.Fields, err error) {
 	q, err = sql.Parse(opts.SQL)
 	if err != nil {
@@ -242,6 +534,9 @@ func (db *DB) queryAndFields(opts *TableOpts) (q *sql.Query, fields core.Fields,
 		fields, err = q.Fields.Get(t.getFields())
 	}
 
+	if err == nil {
+		fields, err = applyFieldRetentions(fields, opts.FieldRetentions)
+	}
 	if err == nil {
 		fields = addPointsField(fields)
 	}
@@ -249,6 +544,31 @@ func (db *DB) queryAndFields(opts *TableOpts) (q *sql.Query, fields core.Fields,
 	return
 }
 
+// applyFieldRetentions sets the Retention of the named fields.
+func applyFieldRetentions(fields core.Fields, retentions map[string]time.Duration) (core.Fields, error) {
+	if len(retentions) == 0 {
+		return fields, nil
+	}
+	result := make(core.Fields, len(fields))
+	copy(result, fields)
+	for name, retention := range retentions {
+		if retention <= 0 {
+			return nil, errors.New("Please specify a positive retention for field %v", name)
+		}
+		found := false
+		for i, field := range result {
+			if field.Name == name {
+				result[i].Retention = retention
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New("Unable to set retention for unknown field %v", name)
+		}
+	}
+	return result, nil
+}
+
 func addPointsField(fields core.Fields) core.Fields {
 	for _, field := range fields {
 		if field.Equals(core.PointsField) {
@@ -296,6 +616,7 @@ func (t *table) startWALProcessing(walOffset wal.Offset) error {
 			t.db.capWALAge(w, stop)
 		})
 		t.db.streams[t.From] = w
+		t.db.sequencers[t.From] = &sequencer{}
 	}
 
 	if t.db.opts.Passthrough {
@@ -316,14 +637,19 @@ func (t *table) startWALProcessing(walOffset wal.Offset) error {
 func (t *table) applyFields(fields core.Fields) {
 	var fieldsChanged bool
 	t.fieldsMutex.Lock()
-	fieldsChanged = !fields.Equals(t.fields)
+	fieldsChanged = !fields.Equals(t.fields) || !retentionsEqual(fields, t.fields)
 	if fieldsChanged {
 		t.fields = fields
 	}
 	t.fieldsMutex.Unlock()
 	if fieldsChanged {
-		if !t.Virtual && !t.db.opts.Passthrough {
-			t.rowStore.fieldUpdates <- fields
+		if !t.Virtual && !t.db.opts.Passthrough && !t.db.opts.ReadReplica && !t.ReadOnly {
+			// read only tables don't write, so their row stores don't need to know
+			select {
+			case t.rowStore.fieldUpdates <- fields:
+			case <-t.rowStore.stop:
+				// a closed row store doesn't write anymore
+			}
 		}
 		t.log.Debugf("Updated fields to %v", fields)
 	} else {
@@ -331,6 +657,19 @@ func (t *table) applyFields(fields core.Fields) {
 	}
 }
 
+// retentionsEqual indicates whether the given fields have the same Retentions.
+func retentionsEqual(a, b core.Fields) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, field := range a {
+		if field.Retention != b[i].Retention {
+			return false
+		}
+	}
+	return true
+}
+
 func (t *table) getFields() core.Fields {
 	t.fieldsMutex.RLock()
 	fields := make(core.Fields, len(t.fields))
@@ -359,8 +698,71 @@ func (t *table) getWhere() goexpr.Expr {
 	return where
 }
 
+// getStats returns a snapshot of the table's stats.
+func (t *table) getStats() TableStats {
+	t.statsMutex.RLock()
+	stats := t.stats
+	t.statsMutex.RUnlock()
+	stats.InsertRate = t.insertLimiter.currentRate()
+	stats.ScanRate = t.scanLimiter.currentRate()
+	if t.rowStore != nil {
+		stats.InsertQueueDepth = int64(t.rowStore.queueDepth())
+		stats.RowStore = t.rowStore.Stats()
+	}
+	return stats
+}
+
 func (t *table) truncateBefore() time.Time {
-	return t.db.clock.Now().Add(-1 * t.RetentionPeriod)
+	return t.truncateBeforeAt(t.db.clock.Now())
+}
+
+// truncateBeforeAt returns the retention boundary as of the given time.
+func (t *table) truncateBeforeAt(now time.Time) time.Time {
+	return now.Add(-1 * t.RetentionPeriod)
+}
+
+// fieldTruncateBefore returns the retention boundary for the given field
+// based on the table's retention boundary.
+func (t *table) fieldTruncateBefore(field core.Field, truncateBefore time.Time) time.Time {
+	if field.Retention <= 0 || field.Retention >= t.RetentionPeriod {
+		return truncateBefore
+	}
+	return truncateBefore.Add(t.RetentionPeriod - field.Retention)
+}
+
+// fieldRetentionTruncator returns a function that truncates the columns of a
+// row whose fields have their own Retention and reports whether any of the
+// columns still has data. It returns nil if none of the fields has its own
+// Retention.
+func (t *table) fieldRetentionTruncator(fields core.Fields, truncateBefore time.Time) func(columns []encoding.Sequence) bool {
+	var truncateBefores []time.Time
+	for i, field := range fields {
+		fieldTruncateBefore := t.fieldTruncateBefore(field, truncateBefore)
+		if fieldTruncateBefore == truncateBefore {
+			continue
+		}
+		if truncateBefores == nil {
+			truncateBefores = make([]time.Time, len(fields))
+		}
+		truncateBefores[i] = fieldTruncateBefore
+	}
+	if truncateBefores == nil {
+		return nil
+	}
+
+	return func(columns []encoding.Sequence) bool {
+		hasData := false
+		for i, seq := range columns {
+			if i < len(truncateBefores) && !truncateBefores[i].IsZero() {
+				seq = seq.Truncate(fields[i].Expr.EncodedWidth(), t.Resolution, truncateBefores[i], time.Time{})
+				columns[i] = seq
+			}
+			if seq != nil {
+				hasData = true
+			}
+		}
+		return hasData
+	}
 }
 
 func (t *table) backfillTo() time.Time {
@@ -371,6 +773,14 @@ func (t *table) backfillTo() time.Time {
 }
 
 func (t *table) iterate(ctx context.Context, outFields core.Fields, includeMemStore bool, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) (common.OffsetsBySource, error) {
+	return t.iterateWithTruncateBefore(ctx, outFields, includeMemStore, t.truncateBefore(), onValue)
+}
+
+// iterateWithTruncateBefore is like iterate but uses the given truncateBefore
+// for the entire scan rather than the table's current retention boundary. This
+// allows queries to see a consistent retention boundary even if the clock
+// advances while they're waiting for or performing the scan.
+func (t *table) iterateWithTruncateBefore(ctx context.Context, outFields core.Fields, includeMemStore bool, truncateBefore time.Time, onValue func(bytemap.ByteMap, []encoding.Sequence) (more bool, err error)) (common.OffsetsBySource, error) {
 	origOnValue := onValue
 	iterCount := 0
 	defer func() {
@@ -385,6 +795,7 @@ func (t *table) iterate(ctx context.Context, outFields core.Fields, includeMemSt
 		ctx:             ctx,
 		outFields:       outFields,
 		includeMemStore: includeMemStore,
+		truncateBefore:  truncateBefore,
 		onValue:         onValue,
 		offsetsCh:       make(chan common.OffsetsBySource, 1),
 		errCh:           make(chan error, 1),
@@ -404,19 +815,40 @@ func (db *DB) coalesceIterations() {
 func (db *DB) coalesceIteration(it *iteration) {
 	iterations := append([]*iteration(nil), it)
 	iterationsForOtherTables := make([]*iteration, 0)
+	add := func(it2 *iteration) {
+		if it2.t == it.t {
+			iterations = append(iterations, it2)
+		} else {
+			iterationsForOtherTables = append(iterationsForOtherTables, it2)
+		}
+	}
 
-coalesceLoop:
-	for {
-		select {
-		case it2 := <-db.requestedIterations:
-			if it2.t == it.t {
-				iterations = append(iterations, it2)
-			} else {
-				iterationsForOtherTables = append(iterationsForOtherTables, it2)
+	if atomic.LoadInt32(&it.t.activeScans) > 0 {
+		// The table is busy, wait (at most IterationCoalesceInterval in total) for
+		// more iterations to share the next scan
+		window := time.NewTimer(db.opts.IterationCoalesceInterval)
+		defer window.Stop()
+	coalesceLoop:
+		for {
+			select {
+			case it2 := <-db.requestedIterations:
+				add(it2)
+			case <-window.C:
+				// stop waiting to coalesce
+				break coalesceLoop
+			}
+		}
+	} else {
+		// Under low concurrency, don't delay the scan, just pick up whatever
+		// iterations are already waiting
+	drainLoop:
+		for {
+			select {
+			case it2 := <-db.requestedIterations:
+				add(it2)
+			default:
+				break drainLoop
 			}
-		case <-time.After(db.opts.IterationCoalesceInterval):
-			// stop waiting to coalesce
-			break coalesceLoop
 		}
 	}
 
@@ -426,6 +858,7 @@ coalesceLoop:
 		db.requestedIterations <- otherIt
 	}
 
+	atomic.AddInt32(&it.t.activeScans, 1)
 	db.coalescedIterations <- iterations
 }
 
@@ -436,8 +869,18 @@ func (db *DB) processIterations() {
 }
 
 func (db *DB) doProcessIterations(iterations []*iteration) {
+	t := iterations[0].t
+	defer atomic.AddInt32(&t.activeScans, -1)
+	t.statsMutex.Lock()
+	t.stats.Scans++
+	t.stats.CoalescedIterations += int64(len(iterations) - 1)
+	t.statsMutex.Unlock()
+
 	var maxDeadline time.Time
 	includeMemStore := false
+	// use the least strict retention boundary so that every iteration gets all
+	// of the data it's entitled to
+	truncateBefore := iterations[0].truncateBefore
 	allOutFields := make(core.Fields, 0)
 	hasOutField := func(field core.Field) bool {
 		for _, existingField := range allOutFields {
@@ -450,6 +893,9 @@ func (db *DB) doProcessIterations(iterations []*iteration) {
 
 	for _, it := range iterations {
 		includeMemStore = includeMemStore || it.includeMemStore
+		if it.truncateBefore.Before(truncateBefore) {
+			truncateBefore = it.truncateBefore
+		}
 		deadline, hasDeadline := it.ctx.Deadline()
 		if hasDeadline && deadline.After(maxDeadline) {
 			maxDeadline = deadline
@@ -478,10 +924,19 @@ func (db *DB) doProcessIterations(iterations []*iteration) {
 	for i, it := range iterations {
 		remainingIterations[i] = it
 	}
+	// errors encountered by individual iterations, which stop only those
+	// iterations
+	iterationErrors := make(map[int]error, len(iterations))
 
 	combinedOnValue := func(dims bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
 		more := false
 		for i, it := range remainingIterations {
+			if err := it.ctx.Err(); err != nil {
+				// The consumer went away (e.g. the client disconnected)
+				iterationErrors[i] = err
+				delete(remainingIterations, i)
+				continue
+			}
 			itVals := make([]encoding.Sequence, len(it.outFields))
 			for i, val := range vals {
 				itI := it.fieldMappings[i]
@@ -492,7 +947,9 @@ func (db *DB) doProcessIterations(iterations []*iteration) {
 			itMore, err := it.onValue(dims, itVals)
 			if err != nil {
 				it.t.log.Errorf("Error while iterating: %v", err)
-				return false, err
+				iterationErrors[i] = err
+				delete(remainingIterations, i)
+				continue
 			}
 			if !itMore {
 				// This iteration doesn't want any more data, stop feeding it
@@ -504,19 +961,41 @@ func (db *DB) doProcessIterations(iterations []*iteration) {
 		return more, nil
 	}
 
-	newCtx := context.Background()
+	// Stop scanning once all of the iterations have been cancelled
+	scanCtx, cancelAll := context.WithCancel(context.Background())
+	defer cancelAll()
+	go func() {
+		for _, it := range iterations {
+			select {
+			case <-it.ctx.Done():
+			case <-scanCtx.Done():
+				return
+			}
+		}
+		cancelAll()
+	}()
+	newCtx := scanCtx
 	if !maxDeadline.IsZero() {
 		var cancel context.CancelFunc
 		newCtx, cancel = context.WithDeadline(newCtx, maxDeadline)
 		defer cancel()
 	}
-	offsetsBySource, err := iterations[0].t.rowStore.iterate(newCtx, allOutFields, includeMemStore, combinedOnValue)
+	newCtx, skipped := withSkippedFiles(newCtx)
+	offsetsBySource, err := iterations[0].t.rowStore.iterate(newCtx, allOutFields, includeMemStore, truncateBefore, combinedOnValue)
 	if err != nil {
 		iterations[0].t.log.Errorf("Got error while iterating: %v", err)
 	}
-	for _, it := range iterations {
+	skippedFilenames := skipped.get()
+	for i, it := range iterations {
+		if itSkipped := skippedFilesFrom(it.ctx); itSkipped != nil {
+			itSkipped.add(skippedFilenames...)
+		}
 		it.offsetsCh <- offsetsBySource
-		it.errCh <- err
+		if itErr := iterationErrors[i]; itErr != nil {
+			it.errCh <- itErr
+		} else {
+			it.errCh <- err
+		}
 	}
 }
 
@@ -529,37 +1008,57 @@ func (it *iteration) indexOfOutField(field core.Field) int {
 	return -1
 }
 
-// shouldSort determines whether or not a flush should be sorted. The flush will
-// sort if the table is the next table in line to be sorted, and no other sort
-// is currently happening. If shouldSort returns true, the flushing process
-// must call stopSorting when finished so that other tables have a chance to
-// sort.
+// shouldSort determines whether or not a flush should be sorted. If SortFlushes
+// is set, every flush sorts. Otherwise, the flush will sort if the table is the
+// next table in line to be sorted, and no other sort is currently happening. If
+// shouldSort returns true, the flushing process must call stopSorting when
+// finished so that other tables have a chance to sort.
 func (t *table) shouldSort() bool {
+	if t.db.opts.SortFlushes {
+		return true
+	}
 	if t.db.opts.MaxMemoryRatio <= 0 {
 		return false
 	}
 
-	t.db.tablesMutex.RLock()
+	t.db.tablesMutex.Lock()
+	defer t.db.tablesMutex.Unlock()
 	if t.db.nextTableToSort >= len(t.db.orderedTables) {
 		t.db.nextTableToSort = 0
 	}
 	nextTableToSort := t.db.orderedTables[t.db.nextTableToSort]
 	result := t.Name == nextTableToSort.Name && !t.db.isSorting
-	t.db.tablesMutex.RUnlock()
+	if result {
+		t.db.isSorting = true
+	}
 	return result
 }
 
 func (t *table) stopSorting() {
-	t.db.tablesMutex.RLock()
+	if t.db.opts.SortFlushes {
+		return
+	}
+	t.db.tablesMutex.Lock()
 	t.db.isSorting = false
 	t.db.nextTableToSort++
-	t.db.tablesMutex.RUnlock()
+	t.db.tablesMutex.Unlock()
 }
 
 func (t *table) memStoreSize() int {
 	return t.rowStore.memStoreSize()
 }
 
+// Flush flushes the table's memstore to disk, blocking until the flushed data
+// is durable. If DBOpts.FlushScratchDir is configured, that includes moving the
+// flushed file to durable storage. Inserts that arrive during the flush are
+// applied to the next memstore.
+func (t *table) Flush() error {
+	if t.rowStore == nil || t.rowStore.opts.readOnly {
+		return errors.New("Table %v does not store data locally", t.Name)
+	}
+	return t.rowStore.requestFlush(true)
+}
+
 func (t *table) forceFlush() {
 	if t.rowStore != nil {
 		t.rowStore.forceFlush()
@@ -0,0 +1,277 @@
+package zenodb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/errors"
+	"github.com/getlantern/zenodb/encoding"
+)
+
+const (
+	tombstonesDir      = "tombstones"
+	tombstonesFilename = "tombstones.dat"
+)
+
+// PurgeStats reports on the results of purging deleted keys.
+type PurgeStats struct {
+	// KeysPurged is the number of deleted keys that were dropped from storage
+	KeysPurged int
+	// BytesReclaimed is the reduction in the size of the file store on disk. It
+	// is net of any data that was flushed from the memstore as part of the purge.
+	BytesReclaimed int64
+}
+
+// purgeRequest asks the processInserts loop to rewrite the file store.
+type purgeRequest struct {
+	stats PurgeStats
+	done  chan interface{}
+}
+
+// DeleteKeys deletes the given keys from the named table. See
+// table.DeleteKeys.
+func (db *DB) DeleteKeys(table string, keys ...bytemap.ByteMap) error {
+	t := db.getTable(table)
+	if t == nil {
+		return errors.New("Table %v not found", table)
+	}
+	return t.DeleteKeys(keys...)
+}
+
+// Delete deletes all series matching the given where clause from the named
+// table. See table.Delete.
+func (db *DB) Delete(table string, whereSQL string) (int, error) {
+	t := db.getTable(table)
+	if t == nil {
+		return 0, errors.New("Table %v not found", table)
+	}
+	return t.Delete(whereSQL)
+}
+
+// PurgeDeleted purges deleted keys from the named table. See
+// table.PurgeDeleted.
+func (db *DB) PurgeDeleted(ctx context.Context, table string) (*PurgeStats, error) {
+	t := db.getTable(table)
+	if t == nil {
+		return nil, errors.New("Table %v not found", table)
+	}
+	return t.PurgeDeleted(ctx)
+}
+
+// DeleteKeys deletes all data for the given keys. Deleted keys are immediately
+// hidden from queries, but their data remains on disk until the next flush
+// rewrites the file store, or until PurgeDeleted is called. Data inserted for
+// a deleted key before that happens is discarded along with it.
+func (t *table) DeleteKeys(keys ...bytemap.ByteMap) error {
+	if t.rowStore == nil || t.rowStore.opts.readOnly {
+		return errors.New("Table %v does not store data locally", t.Name)
+	}
+	return t.rowStore.deleteKeys(keys)
+}
+
+// Delete deletes all series whose keys match the given where clause (e.g.
+// "user = 'bob'"), returning the number of series deleted. Matching keys are
+// deleted as with DeleteKeys, so their data is dropped by the next flush.
+func (t *table) Delete(whereSQL string) (int, error) {
+	if t.rowStore == nil || t.rowStore.opts.readOnly {
+		return 0, errors.New("Table %v does not store data locally", t.Name)
+	}
+	if strings.TrimSpace(whereSQL) == "" {
+		return 0, errors.New("Refusing to delete from table %v without a where clause", t.Name)
+	}
+	where, err := whereFor(whereSQL)
+	if err != nil {
+		return 0, err
+	}
+
+	var keys []bytemap.ByteMap
+	_, err = t.iterate(context.Background(), t.getFields(), true, func(key bytemap.ByteMap, columns []encoding.Sequence) (bool, error) {
+		if matches, _ := where.Eval(key).(bool); matches {
+			// copy the key since the underlying buffer may get reused
+			keys = append(keys, append(bytemap.ByteMap(nil), key...))
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, errors.New("Unable to find keys to delete from table %v: %v", t.Name, err)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	if err := t.rowStore.deleteKeys(keys); err != nil {
+		return 0, err
+	}
+	t.log.Debugf("Deleted %d series matching %v", len(keys), whereSQL)
+	return len(keys), nil
+}
+
+// PurgeDeleted immediately rewrites the file store, dropping all deleted keys
+// and clearing the set of deleted keys.
+func (t *table) PurgeDeleted(ctx context.Context) (*PurgeStats, error) {
+	if t.rowStore == nil || t.rowStore.opts.readOnly {
+		return nil, errors.New("Table %v does not store data locally", t.Name)
+	}
+	return t.rowStore.purgeDeleted(ctx)
+}
+
+func (rs *rowStore) deleteKeys(keys []bytemap.ByteMap) error {
+	rs.mx.Lock()
+	defer rs.mx.Unlock()
+	// copy on write so that iterations can hold on to the current set
+	tombstones := make(map[string]bool, len(rs.tombstones)+len(keys))
+	for key := range rs.tombstones {
+		tombstones[key] = true
+	}
+	for _, key := range keys {
+		tombstones[string(key)] = true
+	}
+	if err := rs.writeTombstones(tombstones); err != nil {
+		return err
+	}
+	rs.tombstones = tombstones
+	// Deleted keys are hidden from queries right away, so cached results may
+	// now be stale
+	rs.t.db.invalidateQueryCache(rs.t.Name, time.Time{}, time.Time{})
+	// Free up the memory used by deleted keys right away rather than waiting for
+	// the next flush to drop them
+	for _, key := range keys {
+		rs.memStore.delete(key)
+	}
+	return nil
+}
+
+func (rs *rowStore) getTombstones() map[string]bool {
+	rs.mx.RLock()
+	defer rs.mx.RUnlock()
+	return rs.tombstones
+}
+
+// clearTombstones removes the given keys from the set of deleted keys once
+// they've been purged.
+func (rs *rowStore) clearTombstones(purged map[string]bool) {
+	if len(purged) == 0 {
+		return
+	}
+	rs.mx.Lock()
+	defer rs.mx.Unlock()
+	tombstones := make(map[string]bool, len(rs.tombstones))
+	for key := range rs.tombstones {
+		if !purged[key] {
+			tombstones[key] = true
+		}
+	}
+	if err := rs.writeTombstones(tombstones); err != nil {
+		// Keeping the old tombstones around just means that we'll purge again
+		rs.t.log.Errorf("Unable to clear purged tombstones: %v", err)
+		return
+	}
+	rs.tombstones = tombstones
+}
+
+func (rs *rowStore) purgeDeleted(ctx context.Context) (*PurgeStats, error) {
+	req := &purgeRequest{done: make(chan interface{})}
+	select {
+	case rs.purges <- req:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-rs.stop:
+		return nil, errors.New("Unable to purge deleted keys from table %v, it is closing", rs.t.Name)
+	}
+	// Once submitted, the purge runs to completion
+	<-req.done
+	return &req.stats, nil
+}
+
+// tombstonesFile returns the path of the file in which deleted keys are
+// persisted. It lives in its own subdirectory so that it's not mistaken for a
+// file store.
+func (rs *rowStore) tombstonesFile() string {
+	return filepath.Join(rs.opts.dir, tombstonesDir, tombstonesFilename)
+}
+
+// writeTombstones persists the given set of deleted keys. Each key is stored as
+// a 16 bit length followed by the key itself.
+func (rs *rowStore) writeTombstones(tombstones map[string]bool) error {
+	filename := rs.tombstonesFile()
+	if len(tombstones) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return errors.New("Unable to remove tombstones file %v: %v", filename, err)
+		}
+		return nil
+	}
+
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.New("Unable to create tombstones directory %v: %v", dir, err)
+	}
+	file, err := ioutil.TempFile(dir, "nexttombstones")
+	if err != nil {
+		return errors.New("Unable to create temp file for tombstones: %v", err)
+	}
+	defer file.Close()
+	out := bufio.NewWriter(file)
+	for key := range tombstones {
+		if err = binary.Write(out, encoding.Binary, uint16(len(key))); err != nil {
+			break
+		}
+		if _, err = out.WriteString(key); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return errors.New("Unable to write tombstones to %v: %v", filename, err)
+	}
+	return nil
+}
+
+// readTombstones reads the persisted set of deleted keys, if any.
+func (rs *rowStore) readTombstones() (map[string]bool, error) {
+	filename := rs.tombstonesFile()
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("Unable to open tombstones file %v: %v", filename, err)
+	}
+	defer file.Close()
+
+	tombstones := make(map[string]bool)
+	in := bufio.NewReader(file)
+	for {
+		keyLength := uint16(0)
+		err := binary.Read(in, encoding.Binary, &keyLength)
+		if err == io.EOF {
+			return tombstones, nil
+		}
+		if err != nil {
+			return nil, errors.New("Unable to read key length from tombstones file %v: %v", filename, err)
+		}
+		key := make([]byte, keyLength)
+		if _, err := io.ReadFull(in, key); err != nil {
+			return nil, errors.New("Unable to read key from tombstones file %v: %v", filename, err)
+		}
+		tombstones[string(key)] = true
+	}
+}
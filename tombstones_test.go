@@ -0,0 +1,186 @@
+package zenodb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/getlantern/bytemap"
+	"github.com/getlantern/zenodb/encoding"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPurgeDeleted(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "purged", "SELECT SUM(v) AS v FROM inbound GROUP BY k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	numKeys := 100
+	keyName := func(i int) string {
+		return fmt.Sprintf("key_%d", i)
+	}
+	key := func(i int) bytemap.ByteMap {
+		return bytemap.New(map[string]interface{}{"k": keyName(i)})
+	}
+	var points []*Point
+	for i := 0; i < numKeys; i++ {
+		for j := 0; j < 10; j++ {
+			points = append(points, &Point{TS: epoch.Add(time.Duration(-j) * time.Second), Dims: map[string]interface{}{"k": keyName(i)}, Vals: map[string]interface{}{"v": float64(i*j + 1)}})
+		}
+	}
+	_, err := db.InsertBatch("purged", points)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tbl := db.getTable("purged")
+	tbl.forceFlush()
+	rs := tbl.rowStore
+
+	read := func() map[string]bool {
+		keys := make(map[string]bool)
+		_, err := tbl.iterate(context.Background(), tbl.getFields(), true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			keys[key.Get("k").(string)] = true
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return keys
+	}
+	readDisk := func() (map[string]bool, int64) {
+		rs.mx.RLock()
+		fs := rs.fileStore
+		rs.mx.RUnlock()
+		keys := make(map[string]bool)
+		_, err := fs.iterate(tbl.getFields(), nil, false, false, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+			keys[key.Get("k").(string)] = true
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return keys, rs.fileStoreSize()
+	}
+
+	var deleted []bytemap.ByteMap
+	for i := 0; i < numKeys; i += 2 {
+		deleted = append(deleted, key(i))
+	}
+	if !assert.NoError(t, db.DeleteKeys("purged", deleted...)) {
+		return
+	}
+
+	keys := read()
+	assert.Len(t, keys, numKeys/2, "Deleted keys should be hidden from reads")
+	for i := 0; i < numKeys; i++ {
+		assert.Equal(t, i%2 == 1, keys[keyName(i)], keyName(i))
+	}
+	diskKeys, sizeBeforePurge := readDisk()
+	assert.Len(t, diskKeys, numKeys, "Deleted keys should remain on disk until purged")
+	persisted, err := rs.readTombstones()
+	if assert.NoError(t, err) {
+		assert.Len(t, persisted, len(deleted), "Tombstones should have been persisted")
+	}
+
+	stats, err := db.PurgeDeleted(context.Background(), "purged")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, len(deleted), stats.KeysPurged)
+	diskKeys, sizeAfterPurge := readDisk()
+	assert.Len(t, diskKeys, numKeys/2, "Deleted keys should have been removed from disk")
+	for _, k := range deleted {
+		assert.False(t, diskKeys[k.Get("k").(string)])
+	}
+	assert.True(t, stats.BytesReclaimed > 0, "Purge should have reclaimed space")
+	assert.Equal(t, sizeBeforePurge-sizeAfterPurge, stats.BytesReclaimed)
+	assert.Empty(t, rs.getTombstones(), "Purge should have cleared tombstones")
+	_, err = os.Stat(rs.tombstonesFile())
+	assert.True(t, os.IsNotExist(err), "Tombstones file should have been removed")
+
+	// New data for a purged key is visible again
+	_, err = db.InsertBatch("purged", []*Point{{TS: epoch, Dims: map[string]interface{}{"k": keyName(0)}, Vals: map[string]interface{}{"v": 1}}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, read()[keyName(0)], "Data inserted after purge should be visible")
+
+	// Deleting during normal operation is also purged by the next flush
+	if !assert.NoError(t, tbl.DeleteKeys(key(1))) {
+		return
+	}
+	assert.False(t, read()[keyName(1)])
+	tbl.forceFlush()
+	diskKeys, _ = readDisk()
+	assert.False(t, diskKeys[keyName(1)], "Flush should have dropped deleted key")
+	assert.True(t, diskKeys[keyName(0)], "Flush should have kept key inserted after purge")
+	assert.Empty(t, rs.getTombstones())
+
+	_, err = db.PurgeDeleted(context.Background(), "unknown")
+	assert.Error(t, err)
+}
+
+func TestDeleteWhere(t *testing.T) {
+	db, cleanup := newTestDB(t, &DBOpts{}, "deletewhere", "SELECT SUM(v) AS v FROM inbound GROUP BY u, k, period(1s)")
+	defer cleanup()
+
+	epoch := time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+	db.clock.Advance(epoch)
+	tbl := db.getTable("deletewhere")
+	rs := tbl.rowStore
+
+	insert := func(u string, k string) {
+		_, err := db.InsertBatch("deletewhere", []*Point{{TS: epoch, Dims: map[string]interface{}{"u": u, "k": k}, Vals: map[string]interface{}{"v": 1}}})
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+	read := func() map[string]bool {
+		keys := make(map[string]bool)
+		_, err := tbl.iterate(context.Background(), tbl.getFields(), true, func(key bytemap.ByteMap, vals []encoding.Sequence) (bool, error) {
+			keys[fmt.Sprintf("%v_%v", key.Get("u"), key.Get("k"))] = true
+			return true, nil
+		})
+		assert.NoError(t, err)
+		return keys
+	}
+
+	// Some data on disk and some only in the memstore
+	insert("bob", "a")
+	insert("alice", "a")
+	tbl.forceFlush()
+	insert("bob", "b")
+	insert("alice", "b")
+	msBytesBefore := rs.memStore.bytes()
+
+	deleted, err := db.Delete("deletewhere", "u = 'bob'")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2, deleted)
+	assert.Equal(t, map[string]bool{"alice_a": true, "alice_b": true}, read())
+	assert.Equal(t, 1, rs.memStore.length(), "Deleted key should have been removed from memstore")
+	assert.True(t, rs.memStore.bytes() < msBytesBefore, "Deleting should have freed memstore bytes")
+
+	deleted, err = tbl.Delete("u = 'bob'")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted, "Already deleted series should not be counted again")
+
+	tbl.forceFlush()
+	diskKeys := make(map[string]bool)
+	rs.mx.RLock()
+	fs := rs.fileStore
+	rs.mx.RUnlock()
+	_, err = fs.iterate(tbl.getFields(), nil, false, false, tbl.truncateBefore(), func(key bytemap.ByteMap, columns []encoding.Sequence, raw []byte) (bool, error) {
+		diskKeys[fmt.Sprintf("%v_%v", key.Get("u"), key.Get("k"))] = true
+		return true, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"alice_a": true, "alice_b": true}, diskKeys, "Flush should have dropped deleted series")
+
+	_, err = tbl.Delete("")
+	assert.Error(t, err, "Deleting without a where clause should fail")
+	_, err = tbl.Delete("u = ")
+	assert.Error(t, err, "Invalid where clause should fail")
+	_, err = db.Delete("unknown", "u = 'bob'")
+	assert.Error(t, err)
+}
@@ -38,6 +38,27 @@ const (
 
 	DefaultClusterQueryTimeout = 1 * time.Hour
 	DefaultMaxFollowQueue      = 100000
+
+	DefaultReadYourWritesTimeout = 5 * time.Second
+
+	DefaultReadReplicaPollInterval = 5 * time.Second
+
+	DefaultSequenceCacheTTL = 5 * time.Minute
+
+	DefaultQueryCacheTTL = 1 * time.Minute
+
+	DefaultRollupInterval = 1 * time.Minute
+
+	DefaultFlushRetries      = 3
+	DefaultFlushRetryBackoff = 1 * time.Second
+
+	DefaultFlushWorkerIdleTimeout = 30 * time.Second
+
+	// DefaultSortBufferBytes is how much memory a sorted flush uses to sort
+	// rows before spilling to disk when MaxMemoryRatio isn't set.
+	DefaultSortBufferBytes = 64 * 1024 * 1024
+
+	DefaultInsertQueueSize = 1000
 )
 
 var (
@@ -60,6 +81,31 @@ type DBOpts struct {
 	ReadOnly bool
 	// Dir points at the directory that contains the data files.
 	Dir string
+	// ReadReplica opens the tables in Dir for querying only. A separate writer
+	// process owns Dir and does all of the inserting and flushing. The replica
+	// polls Dir for new file stores written by the writer and switches to them
+	// as they appear. Inserting into a read replica fails with
+	// ErrTableReadOnly.
+	ReadReplica bool
+	// ReadReplicaPollInterval governs how frequently read replicas (and tables
+	// opened with TableOpts.ReadOnly) check for new file stores (defaults to 5
+	// seconds).
+	ReadReplicaPollInterval time.Duration
+	// OldFileStoreRetention specifies how long to keep file stores around after
+	// they've been superseded by a newer flush. Set this on writers that have
+	// read replicas so that replicas have a chance to finish reading older file
+	// stores before they're removed. File stores left behind by a previous run
+	// (for example after a crash) are removed on startup once they're past the
+	// same retention period.
+	OldFileStoreRetention time.Duration
+	// DisableDirLocks disables the lock files that prevent two live tables from
+	// writing to the same data directory. Only set this if something else
+	// guarantees that each directory has a single writer.
+	DisableDirLocks bool
+	// SkipChecksumVerification disables verification of the checksums stored
+	// with each row of a file store, trading detection of corruption for read
+	// throughput.
+	SkipChecksumVerification bool
 	// SchemaFile points at a YAML schema file that configures the tables and
 	// views in the database.
 	SchemaFile string
@@ -81,8 +127,9 @@ type DBOpts struct {
 	// VirtualTime, if true, tells zenodb to use a virtual clock that advances
 	// based on the timestamps of Points received via inserts.
 	VirtualTime bool
-	// WALSyncInterval governs how frequently to sync the WAL to disk. 0 means
-	// it syncs after every write (which is not great for performance).
+	// WALSyncInterval governs how frequently to sync the WAL (and the batch logs
+	// of tables receiving InsertBatch) to disk. 0 means it syncs after every
+	// write (which is not great for performance).
 	WALSyncInterval time.Duration
 	// MaxWALMemoryBacklog sets the maximum number of writes to buffer in memory.
 	MaxWALMemoryBacklog int
@@ -90,15 +137,132 @@ type DBOpts struct {
 	MaxWALSize int
 	// WALCompressionSize specifies the size beyond which to compress WAL segments
 	WALCompressionSize int
+	// FutureHorizon limits how far into the future the timestamps of points
+	// passed to InsertBatch may be. 0 means no limit.
+	FutureHorizon time.Duration
+	// FlushScratchDir, if specified, points at a fast scratch location (e.g. a
+	// tmpfs RAM disk) to which memstores are flushed. Flushed files are then
+	// copied to Dir in the background. Data is only durable once it has been
+	// copied to Dir, so until then a crash may require replaying the WAL from
+	// further back (see TableStats.PendingMoves). Anything left in the scratch
+	// location from a previous run is discarded on startup.
+	FlushScratchDir string
+	// FlushMoveBytesPerSecond limits the rate at which flushed files are copied
+	// from FlushScratchDir to Dir. 0 means no limit.
+	FlushMoveBytesPerSecond int64
+	// MigrationBytesPerSecond limits the rate at which migrations (see
+	// table.Migrate) rewrite file stores, so that they don't starve queries of
+	// I/O. 0 means no limit.
+	MigrationBytesPerSecond int64
+	// FlushRetries is how many times a flush that fails to write its file store
+	// is retried before giving up (defaults to 3). When a flush gives up, the
+	// memstore is retained and flushed again later.
+	FlushRetries int
+	// FlushRetryBackoff is how long to wait before the first retry of a failed
+	// flush (defaults to 1 second). The wait doubles with each retry.
+	FlushRetryBackoff time.Duration
+	// FsyncOnFlush determines whether flushes sync the files they write, and
+	// the directories they write them to, to disk before finishing. Defaults to
+	// FsyncEnabled. See FsyncPolicy for the durability that each setting
+	// provides.
+	FsyncOnFlush FsyncPolicy
+	// OnFlushFailure, if specified, is called whenever a table gives up on a
+	// flush after FlushRetries.
+	OnFlushFailure func(table string, err error)
+	// MaxFlushWorkers limits how many tables can flush at the same time
+	// (defaults to the number of CPUs). Flushes run on a pool of workers that
+	// grows while flushes are waiting for a worker and shrinks again once they
+	// have drained (see FlushWorkerStats).
+	MaxFlushWorkers int
+	// FlushWorkerIdleTimeout is how long a flush worker waits for another flush
+	// before exiting (defaults to 30 seconds).
+	FlushWorkerIdleTimeout time.Duration
 	// MaxMemoryRatio caps the maximum memory of this process. When the system
 	// comes under memory pressure, it will start flushing table memstores.
 	MaxMemoryRatio float64
-	// IterationCoalesceInterval specifies how long we wait between iteration
-	// requests in order to coalesce multiple related ones.
+	// SortFlushes causes every flush to write its file store in key order. By
+	// default, flushes are only sorted when MaxMemoryRatio is set, and then only
+	// one table at a time. Sorted file stores include an index of their keys.
+	// Unsorted flushes don't write keys in any particular order, since the
+	// memstore is split into shards that are written one after the other.
+	SortFlushes bool
+	// IterationCoalesceInterval specifies how long we wait for more iteration
+	// requests for a table that's already being scanned, in order to coalesce
+	// them into a single scan that decodes the table's files once for all of
+	// them. Iterations of tables that aren't being scanned start right away.
 	IterationCoalesceInterval time.Duration
+	// ScanParallelism limits how many files are decoded at the same time when a
+	// scan reads a table that has multiple files (see TableOpts.MaxFileStores).
+	// Decoding files in parallel trades CPU for lower query latency. Defaults to
+	// the number of CPUs, 1 decodes one file at a time.
+	ScanParallelism int
 	// IterationConcurrency specifies how many iterations can be performed in
 	// parallel
 	IterationConcurrency int
+	// ScanWarningRows, if positive, causes a warning to be logged and reported
+	// with the query results whenever a query scans more than this many rows.
+	// The query itself still completes.
+	ScanWarningRows int64
+	// ScanWarningBytes is like ScanWarningRows, but for the number of bytes
+	// scanned.
+	ScanWarningBytes int64
+	// QueryTimeout, if positive, limits how long iterating over the results of
+	// a query may take. Once it expires, iterating stops and returns
+	// context.DeadlineExceeded. QueryWithTimeout overrides it for individual
+	// queries.
+	QueryTimeout time.Duration
+	// MMapFileStores, if true, causes file stores to be memory-mapped while
+	// iterating rather than read through buffered I/O. This saves system calls
+	// and copying for large files that are queried repeatedly and lets their
+	// contents be shared via the OS page cache. It's ignored on platforms that
+	// don't support mmap.
+	MMapFileStores bool
+	// Deterministic, if true, causes iterating over tables to emit the rows of
+	// keys that are only in the memstore in key order (ascending unless the
+	// table uses TableOpts.DescendingKeys) rather than in whatever order the
+	// memstore holds them. Rows read from files keep the order of the files.
+	// This makes the output of queries that include the memstore reproducible,
+	// for example in tests and exports, at the cost of buffering and sorting the
+	// memstore's remaining rows.
+	Deterministic bool
+	// SequenceCacheBytes, if positive, enables an in-memory cache of sequences
+	// decoded from file stores, limited to approximately this many bytes. This
+	// saves CPU on repeated queries over the same data. Note that it only saves
+	// decoding the columns' codecs. Queries still read and decompress the
+	// entire file store, since file stores are compressed as a single stream
+	// that can't be read from the middle.
+	SequenceCacheBytes int
+	// SequenceCacheTTL is how long decoded sequences stay in the cache (defaults
+	// to 5 minutes).
+	SequenceCacheTTL time.Duration
+	// QueryCacheSize, if positive, enables an LRU cache of up to this many query
+	// results. Only queries that don't read the mem store are cached, and cached
+	// results are invalidated whenever one of the queried tables flushes data
+	// within the query's time window. Passthrough nodes don't flush, so on those
+	// cached results only expire via QueryCacheTTL.
+	QueryCacheSize int
+	// QueryCacheTTL is how long query results stay in the cache (defaults to 1
+	// minute).
+	QueryCacheTTL time.Duration
+	// RollupInterval is how frequently rollups created with CreateRollup are
+	// rebuilt from their base tables (defaults to 1 minute).
+	RollupInterval time.Duration
+	// SkipNulls, if true, causes queries over subqueries to leave periods for
+	// which the subquery had no data out of their aggregations. By default, such
+	// periods are treated as zero, which for example pulls down averages over
+	// sparse data.
+	SkipNulls bool
+	// RetentionOverlap determines how queries whose subqueries read from tables
+	// with different retention periods handle the periods for which only some
+	// of the tables have data. By default, each table is read over its own
+	// retention window. With planner.RetentionIntersection, queries are clipped
+	// to the window covered by all of the tables, which is reflected in the
+	// AsOf of the QueryMetaData.
+	RetentionOverlap planner.RetentionOverlap
+	// ReadYourWritesTimeout limits how long a Session query will wait for the
+	// session's inserts to be applied to the queried tables (defaults to 5
+	// seconds).
+	ReadYourWritesTimeout time.Duration
 	// MaxBackupWait limits how long we're willing to wait for a backup before
 	// resuming file operations
 	MaxBackupWait time.Duration
@@ -133,6 +297,9 @@ type DBOpts struct {
 	// WhitelistedDimensions allow specifying an optional whitelist of dimensions to include in the WAL.
 	// If specified, only dimensions appearing in the whiteliste will be recorded in the WAL.
 	WhitelistedDimensions map[string]bool
+
+	// hooks, if specified, intercept internal operations. This is used in tests.
+	hooks *hooks
 }
 
 // BuildLogger builds a logger for the database configured with these DBOpts
@@ -170,6 +337,7 @@ type DB struct {
 	orderedTables         []*table
 	walBuffers            *bpool.BytePool
 	streams               map[string]*wal.WAL
+	sequencers            map[string]*sequencer
 	newStreamSubscriber   map[string]chan *tableWithOffsets
 	newStreamSubscriberMx sync.Mutex
 	tablesMutex           sync.RWMutex
@@ -186,6 +354,10 @@ type DB struct {
 	tasks                 sync.WaitGroup
 	closeOnce             sync.Once
 	closing               chan interface{}
+	sequenceCache         *sequenceCache
+	queryCache            *queryCache
+	flushPool             *flushPool
+	prometheusMetrics     atomic.Value // *prometheusMetrics, set by RegisterMetrics
 	Panic                 func(interface{})
 }
 
@@ -194,9 +366,18 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	if opts.IterationConcurrency <= 0 {
 		opts.IterationConcurrency = DefaultIterationConcurrency
 	}
+	if opts.ScanParallelism <= 0 {
+		opts.ScanParallelism = runtime.NumCPU()
+	}
 	if opts.MaxFollowQueue <= 0 {
 		opts.MaxFollowQueue = DefaultMaxFollowQueue
 	}
+	if opts.FlushRetries <= 0 {
+		opts.FlushRetries = DefaultFlushRetries
+	}
+	if opts.FlushRetryBackoff <= 0 {
+		opts.FlushRetryBackoff = DefaultFlushRetryBackoff
+	}
 	if opts.Panic == nil {
 		opts.Panic = func(err interface{}) {
 			panic(err)
@@ -213,6 +394,7 @@ func NewDB(opts *DBOpts) (*DB, error) {
 		tables:              make(map[string]*table),
 		walBuffers:          bpool.NewBytePool(1000, 1024),
 		streams:             make(map[string]*wal.WAL),
+		sequencers:          make(map[string]*sequencer),
 		newStreamSubscriber: make(map[string]chan *tableWithOffsets),
 		logMemStatsCh:       make(chan *memoryInfo),
 		followerJoined:      make(chan *follower, opts.NumPartitions),
@@ -231,6 +413,9 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	if opts.WALCompressionSize <= 0 {
 		opts.WALCompressionSize = opts.MaxWALSize / 10
 	}
+	if opts.ReadYourWritesTimeout <= 0 {
+		opts.ReadYourWritesTimeout = DefaultReadYourWritesTimeout
+	}
 	if opts.IterationCoalesceInterval <= 0 {
 		opts.IterationCoalesceInterval = DefaultIterationCoalesceInterval
 	}
@@ -240,6 +425,31 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	if opts.ClusterQueryTimeout <= 0 {
 		opts.ClusterQueryTimeout = DefaultClusterQueryTimeout
 	}
+	if opts.ReadReplicaPollInterval <= 0 {
+		opts.ReadReplicaPollInterval = DefaultReadReplicaPollInterval
+	}
+	if opts.SequenceCacheTTL <= 0 {
+		opts.SequenceCacheTTL = DefaultSequenceCacheTTL
+	}
+	if opts.SequenceCacheBytes > 0 {
+		db.sequenceCache = newSequenceCache(opts.SequenceCacheBytes, opts.SequenceCacheTTL)
+	}
+	if opts.MaxFlushWorkers <= 0 {
+		opts.MaxFlushWorkers = runtime.NumCPU()
+	}
+	if opts.FlushWorkerIdleTimeout <= 0 {
+		opts.FlushWorkerIdleTimeout = DefaultFlushWorkerIdleTimeout
+	}
+	db.flushPool = newFlushPool(opts.MaxFlushWorkers, opts.FlushWorkerIdleTimeout)
+	if opts.QueryCacheTTL <= 0 {
+		opts.QueryCacheTTL = DefaultQueryCacheTTL
+	}
+	if opts.QueryCacheSize > 0 {
+		db.queryCache = newQueryCache(opts.QueryCacheSize, opts.QueryCacheTTL)
+	}
+	if opts.RollupInterval <= 0 {
+		opts.RollupInterval = DefaultRollupInterval
+	}
 
 	go db.logMemStats()
 	db.opts.ReadOnly = opts.Dir == ""
@@ -308,6 +518,15 @@ func NewDB(opts *DBOpts) (*DB, error) {
 	return db, err
 }
 
+// Flush flushes the named table to disk. See table.Flush.
+func (db *DB) Flush(table string) error {
+	t := db.getTable(table)
+	if t == nil {
+		return fmt.Errorf("Table %v not found", table)
+	}
+	return t.Flush()
+}
+
 // FlushAll flushes all tables
 func (db *DB) FlushAll() {
 	db.tablesMutex.Lock()
@@ -341,13 +560,29 @@ func (db *DB) Close() {
 			db.log.Debugf("Closing stream %v", name)
 			stream.Close()
 			delete(db.streams, name)
+			delete(db.sequencers, name)
 		}
 		db.tablesMutex.Unlock()
 	})
 	db.tasks.Wait()
+	db.releaseDirLocks()
 	db.log.Debug("Closed")
 }
 
+// releaseDirLocks releases the locks on all tables' data directories. This must
+// only be called once background tasks have stopped writing to them.
+func (db *DB) releaseDirLocks() {
+	db.tablesMutex.RLock()
+	defer db.tablesMutex.RUnlock()
+	for _, t := range db.tables {
+		if t.rowStore != nil && t.rowStore.dirLock != nil {
+			if err := t.rowStore.dirLock.release(); err != nil {
+				t.log.Error(err)
+			}
+		}
+	}
+}
+
 func (db *DB) registerAliases(aliasesFile string) {
 	db.log.Debugf("Registering aliases from file at %v", aliasesFile)
 
@@ -378,9 +613,7 @@ func (db *DB) TableStats(table string) TableStats {
 	if t == nil {
 		return TableStats{}
 	}
-	t.statsMutex.RLock()
-	defer t.statsMutex.RUnlock()
-	return t.stats
+	return t.getStats()
 }
 
 // AllTableStats returns all TableStats for all tables, keyed to the table
@@ -394,9 +627,7 @@ func (db *DB) AllTableStats() map[string]TableStats {
 	}
 	db.tablesMutex.RUnlock()
 	for name, t := range tables {
-		t.statsMutex.RLock()
-		m[name] = t.stats
-		t.statsMutex.RUnlock()
+		m[name] = t.getStats()
 	}
 	return m
 }
@@ -405,13 +636,14 @@ func (db *DB) AllTableStats() map[string]TableStats {
 func (db *DB) PrintTableStats(table string) string {
 	stats := db.TableStats(table)
 	now := db.clock.Now()
-	return fmt.Sprintf("%v (%v)\tFiltered: %v    Queued: %v    Inserted: %v    Dropped: %v    Expired: %v",
+	return fmt.Sprintf("%v (%v)\tFiltered: %v    Queued: %v    Inserted: %v    Dropped: %v    Late: %v    Expired: %v",
 		table,
 		now.In(time.UTC),
 		humanize.Comma(stats.FilteredPoints),
 		humanize.Comma(stats.QueuedPoints),
 		humanize.Comma(stats.InsertedPoints),
 		humanize.Comma(stats.DroppedPoints),
+		humanize.Comma(stats.LatePoints),
 		humanize.Comma(stats.ExpiredValues))
 }
 
@@ -552,6 +784,15 @@ func (db *DB) maxMemoryBytes() uint64 {
 	return uint64(systemRAM * db.opts.MaxMemoryRatio)
 }
 
+// sortBufferBytes returns how much memory a sorted flush may use before
+// spilling to disk.
+func (db *DB) sortBufferBytes() int {
+	if db.opts.MaxMemoryRatio <= 0 {
+		return DefaultSortBufferBytes
+	}
+	return int(db.maxMemoryBytes()) / 10
+}
+
 type memStoreSize struct {
 	t    *table
 	size int
@@ -796,3 +796,71 @@ func assertExpectedResult(t *testing.T, db *DB, sqlString string, includeMemStor
 		assert.False(t, timedOut, "Timed out running %v", sqlString)
 	}
 }
+
+// newTestDB creates a standalone DB in a temp directory using virtual time and,
+// if tableName is not empty, creates a table with the given name and SQL on it.
+// The returned function closes the DB and cleans up the temp directory.
+func newTestDB(t *testing.T, opts *DBOpts, tableName string, tableSQL string) (*DB, func()) {
+	tmpDir, err := ioutil.TempDir("", "zenodbtest")
+	if !assert.NoError(t, err, "Unable to create temp directory") {
+		t.FailNow()
+	}
+
+	opts.Dir = tmpDir
+	opts.VirtualTime = true
+	if opts.IterationCoalesceInterval == 0 {
+		opts.IterationCoalesceInterval = 1 * time.Millisecond
+	}
+	db, err := NewDB(opts)
+	if !assert.NoError(t, err) {
+		os.RemoveAll(tmpDir)
+		t.FailNow()
+	}
+
+	if tableName != "" {
+		err = db.CreateTable(&TableOpts{
+			Name:            tableName,
+			RetentionPeriod: 1 * time.Hour,
+			SQL:             tableSQL,
+		})
+		if !assert.NoError(t, err) {
+			db.Close()
+			os.RemoveAll(tmpDir)
+			t.FailNow()
+		}
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+// testEpoch is the time as of which most tests insert their data.
+var testEpoch = time.Date(2015, time.January, 1, 2, 3, 4, 0, time.UTC)
+
+// insertKeys inserts a point with v = 1 into the named table at ts for each of
+// the given values of dimension k, failing the test if that doesn't work.
+func insertKeys(t *testing.T, db *DB, tableName string, ts time.Time, keys ...string) {
+	t.Helper()
+	points := make([]*Point, 0, len(keys))
+	for _, k := range keys {
+		points = append(points, &Point{TS: ts, Dims: map[string]interface{}{"k": k}, Vals: map[string]interface{}{"v": 1}})
+	}
+	_, err := db.InsertBatch(tableName, points)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+}
+
+// newFlushedTestDB is like newTestDB, but also advances the clock to testEpoch,
+// inserts the given keys at testEpoch (see insertKeys) and flushes the table.
+func newFlushedTestDB(t *testing.T, opts *DBOpts, tableName string, tableSQL string, keys ...string) (*DB, *table, func()) {
+	t.Helper()
+	db, cleanup := newTestDB(t, opts, tableName, tableSQL)
+	db.clock.Advance(testEpoch)
+	insertKeys(t, db, tableName, testEpoch, keys...)
+	tbl := db.getTable(tableName)
+	tbl.forceFlush()
+	return db, tbl, cleanup
+}